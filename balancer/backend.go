@@ -0,0 +1,284 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSlowClient marks request bodies aborted because the client sent them
+// too slowly; the client gets 408 instead of a backend error
+var ErrSlowClient = errors.New("request body arrived too slowly")
+
+// Enhanced Backend with circuit breaker and health scoring
+type Backend struct {
+	ID              int      `json:"id"`
+	URL             *url.URL `json:"url"`
+	Weight          int      `json:"weight"`
+	CurrentWeight   int      `json:"current_weight"`
+	Alive           bool     `json:"alive"`
+	mu              sync.RWMutex
+	ReverseProxy    *httputil.ReverseProxy `json:"-"`
+	Connections     int64                  `json:"connections"`
+	RequestCount    int64                  `json:"request_count"`
+	ErrorCount      int64                  `json:"error_count"`
+	LastCheck       time.Time              `json:"last_check"`
+	ResponseLatency EWMA                   `json:"response_time"` // Latest, moving average and deviation of proxied requests
+	CircuitBreaker  *CircuitBreaker        `json:"circuit_breaker"`
+	HealthScore     float64                `json:"health_score"`
+	RecentErrors    WindowCounter          `json:"recent_errors"`   // Errors in the last RateWindow
+	RecentRequests  WindowCounter          `json:"recent_requests"` // Requests in the last RateWindow
+	Region          string                 `json:"region"`
+	Capacity        int64                  `json:"capacity"`
+	clusterDown     atomic.Bool            // reported down by another load balancer instance
+	agentDown       atomic.Bool            // reported unhealthy by the agent running next to it
+	faultDown       atomic.Bool            // held down by an injected backend failure
+}
+
+// Circuit Breaker implementation
+type CircuitBreaker struct {
+	mu           sync.RWMutex
+	State        string        `json:"state"` // "closed", "open", "half-open"
+	Failures     int64         `json:"failures"`
+	Requests     int64         `json:"requests"`
+	LastFailTime time.Time     `json:"last_fail_time"`
+	LastOpenTime time.Time     `json:"last_open_time"`
+	Threshold    int64         `json:"threshold"`
+	Timeout      time.Duration `json:"timeout"`
+	SuccessCount int64         `json:"success_count"`
+}
+
+// Circuit Breaker implementation
+func NewCircuitBreaker(threshold int64, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		State:     "closed",
+		Threshold: threshold,
+		Timeout:   timeout,
+	}
+}
+
+func (cb *CircuitBreaker) Call(fn func() error) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.State {
+	case "open":
+		if time.Since(cb.LastOpenTime) > cb.Timeout {
+			cb.State = "half-open"
+			cb.SuccessCount = 0
+		} else {
+			return fmt.Errorf("circuit breaker is open")
+		}
+	}
+
+	atomic.AddInt64(&cb.Requests, 1)
+	err := fn()
+
+	if err != nil {
+		atomic.AddInt64(&cb.Failures, 1)
+		cb.LastFailTime = time.Now()
+
+		if cb.State == "half-open" || cb.Failures >= cb.Threshold {
+			cb.State = "open"
+			cb.LastOpenTime = time.Now()
+		}
+		return err
+	}
+
+	if cb.State == "half-open" {
+		cb.SuccessCount++
+		if cb.SuccessCount >= 3 {
+			cb.State = "closed"
+			cb.Failures = 0
+		}
+	}
+
+	return nil
+}
+
+func (cb *CircuitBreaker) GetState() string {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.State
+}
+
+// Enhanced Backend methods
+func (b *Backend) UpdateHealthScore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Events of the last RateWindow
+	totalRequests := b.RecentRequests.Count()
+	totalErrors := b.RecentErrors.Count()
+
+	if totalRequests == 0 {
+		b.HealthScore = 1.0
+		return
+	}
+
+	// Calculate error rate
+	errorRate := float64(totalErrors) / float64(totalRequests)
+
+	// Calculate response time score (normalized)
+	responseTimeScore := 1.0 - math.Min(float64(b.ResponseLatency.Mean().Milliseconds())/1000.0, 1.0)
+
+	// Calculate connection utilization score
+	utilizationScore := 1.0 - math.Min(float64(atomic.LoadInt64(&b.Connections))/float64(b.Capacity), 1.0)
+
+	// Calculate circuit breaker score
+	cbScore := 1.0
+	if b.CircuitBreaker.GetState() == "open" {
+		cbScore = 0.0
+	} else if b.CircuitBreaker.GetState() == "half-open" {
+		cbScore = 0.5
+	}
+
+	// Weighted health score calculation
+	b.HealthScore = (1.0-errorRate)*0.4 + responseTimeScore*0.3 + utilizationScore*0.2 + cbScore*0.1
+	b.HealthScore = math.Max(0.0, math.Min(1.0, b.HealthScore))
+}
+
+func (b *Backend) IsAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Alive && !b.clusterDown.Load() && !b.agentDown.Load() && !b.faultDown.Load() && b.CircuitBreaker.GetState() != "open"
+}
+
+// ProbedAlive returns this instance's own view of the backend, its health
+// checks and its agent's reports, ignoring other instances' views
+func (b *Backend) ProbedAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Alive && !b.agentDown.Load()
+}
+
+// SetClusterDown holds the backend down while another load balancer
+// instance sees it down and reports whether that changed
+func (b *Backend) SetClusterDown(down bool) bool {
+	return b.clusterDown.Swap(down) != down
+}
+
+// ClusterDown reports whether another instance holds the backend down
+func (b *Backend) ClusterDown() bool {
+	return b.clusterDown.Load()
+}
+
+// SetAgentDown holds the backend down while its agent reports it unhealthy
+// and reports whether that changed
+func (b *Backend) SetAgentDown(down bool) bool {
+	return b.agentDown.Swap(down) != down
+}
+
+// AgentDown reports whether the backend's agent reports it unhealthy
+func (b *Backend) AgentDown() bool {
+	return b.agentDown.Load()
+}
+
+// SetFaultDown holds the backend down for fault injection and reports
+// whether that changed
+func (b *Backend) SetFaultDown(down bool) bool {
+	return b.faultDown.Swap(down) != down
+}
+
+// FaultDown reports whether an injected failure holds the backend down
+func (b *Backend) FaultDown() bool {
+	return b.faultDown.Load()
+}
+
+func (b *Backend) SetAlive(alive bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Alive = alive
+	b.LastCheck = time.Now()
+}
+
+func (b *Backend) AddConnection() {
+	atomic.AddInt64(&b.Connections, 1)
+}
+
+func (b *Backend) RemoveConnection() {
+	atomic.AddInt64(&b.Connections, -1)
+}
+
+func (b *Backend) GetConnections() int64 {
+	return atomic.LoadInt64(&b.Connections)
+}
+
+func (b *Backend) AddRequest() {
+	atomic.AddInt64(&b.RequestCount, 1)
+	b.RecentRequests.Add()
+}
+
+func (b *Backend) AddError() {
+	atomic.AddInt64(&b.ErrorCount, 1)
+	b.RecentErrors.Add()
+}
+
+func (b *Backend) GetRequestCount() int64 {
+	return atomic.LoadInt64(&b.RequestCount)
+}
+
+func (b *Backend) GetErrorCount() int64 {
+	return atomic.LoadInt64(&b.ErrorCount)
+}
+
+// NewBackend creates a backend with a reverse proxy that records errors against it
+func NewBackend(u *url.URL) *Backend {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(u)
+			pr.Out.Host = pr.In.Host
+			// Keep appending to the client's X-Forwarded-For chain
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+			// Out.Trailer is a copy of the announced keys taken before the
+			// body was read; share the inbound map so the request trailers
+			// the server fills in at the end of the body reach the backend
+			if pr.In.Trailer != nil {
+				pr.Out.Trailer = pr.In.Trailer
+			}
+		},
+	}
+
+	backend := &Backend{
+		URL:          u,
+		Alive:        true,
+		ReverseProxy: proxy,
+	}
+
+	// Enhanced proxy error handler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// The client's upload outgrew the body limit; not the backend's fault
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("📦 Request body exceeded %d bytes while streaming to %s", tooLarge.Limit, u.Redacted())
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The client trickled its upload; the connection is not worth keeping
+		if errors.Is(err, ErrSlowClient) {
+			if r.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+			return
+		}
+		log.Printf("❌ Enhanced backend error for %s: %v", u.Redacted(), err)
+		backend.AddError()
+		http.Error(w, "Backend temporarily unavailable", http.StatusBadGateway)
+	}
+
+	return backend
+}
+
+// RecordResponseTime updates the last and average response times
+func (b *Backend) RecordResponseTime(responseTime time.Duration) {
+	b.ResponseLatency.Observe(responseTime)
+}
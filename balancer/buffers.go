@@ -0,0 +1,53 @@
+package balancer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBufferSize is the copy buffer size of a proxied body
+const DefaultBufferSize = 32 * 1024
+
+// BufferPool hands out fixed-size copy buffers for proxied bodies, so each
+// transfer holds one buffer however large the body is. It implements
+// httputil.BufferPool.
+type BufferPool struct {
+	size atomic.Int64
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of size-byte buffers, DefaultBufferSize when size is 0
+func NewBufferPool(size int) *BufferPool {
+	bp := &BufferPool{}
+	bp.SetSize(size)
+	return bp
+}
+
+// SetSize changes the size of buffers handed out from now on
+func (bp *BufferPool) SetSize(size int) {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	bp.size.Store(int64(size))
+}
+
+// Size returns the current buffer size
+func (bp *BufferPool) Size() int {
+	return int(bp.size.Load())
+}
+
+// Get returns a buffer of the current size
+func (bp *BufferPool) Get() []byte {
+	size := bp.Size()
+	if b, ok := bp.pool.Get().(*[]byte); ok && len(*b) == size {
+		return *b
+	}
+	return make([]byte, size)
+}
+
+// Put returns a buffer; buffers of an old size are dropped
+func (bp *BufferPool) Put(b []byte) {
+	if len(b) == bp.Size() {
+		bp.pool.Put(&b)
+	}
+}
@@ -0,0 +1,32 @@
+package balancer
+
+import "testing"
+
+// Proxy copies take their buffer from the pool instead of allocating one
+// per transfer; only the slice header put back is allocated
+func TestBufferPoolReuse(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	bp := NewBufferPool(0)
+	bp.Put(bp.Get())
+	allocs := testing.AllocsPerRun(1000, func() {
+		bp.Put(bp.Get())
+	})
+	if allocs > 1 {
+		t.Errorf("Get and Put allocate %.1f times, want at most 1", allocs)
+	}
+
+	bp.SetSize(4096)
+	if got := len(bp.Get()); got != 4096 {
+		t.Errorf("buffer of %d bytes after SetSize(4096)", got)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	bp := NewBufferPool(0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bp.Put(bp.Get())
+	}
+}
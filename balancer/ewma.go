@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"encoding/json"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaAlpha is the weight of each new sample; older samples fade by 1-alpha
+// per sample, so roughly the last ten dominate
+const ewmaAlpha = 0.2
+
+// EWMA is an exponentially weighted moving average and variance of response
+// times, updated without locks. Mean and variance are each stored
+// atomically; under concurrent updates the variance may use a mean one
+// sample old, which does not matter for a moving estimate.
+type EWMA struct {
+	mean     atomic.Uint64 // float64 bits of nanoseconds, 0 before the first sample
+	variance atomic.Uint64 // float64 bits of nanoseconds squared
+	last     atomic.Int64
+	samples  atomic.Int64
+}
+
+// Observe adds a sample
+func (e *EWMA) Observe(d time.Duration) {
+	x := float64(d)
+	e.last.Store(int64(d))
+	e.samples.Add(1)
+
+	var diff float64
+	for {
+		old := e.mean.Load()
+		if old == 0 {
+			// First sample: the average starts at it with no variance
+			if e.mean.CompareAndSwap(0, math.Float64bits(x)) {
+				return
+			}
+			continue
+		}
+		mean := math.Float64frombits(old)
+		diff = x - mean
+		if e.mean.CompareAndSwap(old, math.Float64bits(mean+ewmaAlpha*diff)) {
+			break
+		}
+	}
+	for {
+		old := e.variance.Load()
+		variance := (1 - ewmaAlpha) * (math.Float64frombits(old) + ewmaAlpha*diff*diff)
+		if e.variance.CompareAndSwap(old, math.Float64bits(variance)) {
+			return
+		}
+	}
+}
+
+// Mean returns the moving average, 0 before the first sample
+func (e *EWMA) Mean() time.Duration {
+	return time.Duration(math.Float64frombits(e.mean.Load()))
+}
+
+// StdDev returns the moving standard deviation
+func (e *EWMA) StdDev() time.Duration {
+	return time.Duration(math.Sqrt(math.Float64frombits(e.variance.Load())))
+}
+
+// Last returns the latest sample
+func (e *EWMA) Last() time.Duration {
+	return time.Duration(e.last.Load())
+}
+
+// MarshalJSON writes the latest sample, average and standard deviation in
+// milliseconds
+func (e *EWMA) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	return json.Marshal(map[string]interface{}{
+		"last_ms":   ms(e.Last()),
+		"avg_ms":    ms(e.Mean()),
+		"stddev_ms": ms(e.StdDev()),
+		"samples":   e.samples.Load(),
+	})
+}
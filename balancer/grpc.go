@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Backend protocols of a pool
+const (
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+)
+
+// grpcServing is the serialized HealthCheckResponse{status: SERVING}
+var grpcServing = []byte{0x08, 0x01}
+
+// isGRPCServing calls the gRPC health service (grpc.health.v1.Health/Check)
+// for the whole server and reports whether it answered SERVING
+func isGRPCServing(ctx context.Context, u *url.URL, signature string, transport http.RoundTripper) bool {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	// An empty HealthCheckRequest: uncompressed flag and zero length
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if signature != "" {
+		req.Header.Set(HealthSignatureHeader, signature)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return false
+	}
+
+	// Trailers-only responses carry grpc-status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" || len(body) < 5 || body[0] != 0 {
+		return false
+	}
+	n := binary.BigEndian.Uint32(body[1:5])
+	if uint32(len(body)-5) < n {
+		return false
+	}
+	return bytes.Equal(body[5:5+n], grpcServing)
+}
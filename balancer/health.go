@@ -0,0 +1,219 @@
+package balancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig controls how a pool probes its backends
+type HealthCheckConfig struct {
+	Path     string   `json:"path,omitempty"` // HTTP GET path expecting 2xx/3xx (gRPC pools: health method, e.g. /grpc.health.v1.Health/Check); empty uses a TCP dial
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+
+	Concurrency int `json:"concurrency,omitempty"` // Probes a pool runs at once, default 16; larger pools are probed in waves
+
+	SigningKeyRef string `json:"signing_key_ref,omitempty"` // Secret reference for an HMAC key signing HTTP and gRPC probes in X-LB-Health-Signature, so backends can refuse status to anyone else
+}
+
+// defaultHealthCheckConcurrency is how many backends a pool probes at once
+// unless configured
+const defaultHealthCheckConcurrency = 16
+
+// concurrency returns the configured probe concurrency or its default
+func (hc HealthCheckConfig) concurrency() int {
+	if hc.Concurrency <= 0 {
+		return defaultHealthCheckConcurrency
+	}
+	return hc.Concurrency
+}
+
+// HealthSignatureHeader carries the signature of a health probe:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<path>">". Backends
+// recompute the HMAC with the shared key and reject stale timestamps.
+const HealthSignatureHeader = "X-LB-Health-Signature"
+
+// SignHealthCheck returns the HealthSignatureHeader value for a probe of path at t
+func SignHealthCheck(key []byte, t time.Time, path string) string {
+	ts := fmt.Sprintf("%d", t.Unix())
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ts + "." + path))
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Duration is a time.Duration written as a string ("15s") in JSON
+type Duration time.Duration
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"15s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// StartHealthChecks runs the pool's health check loop until ctx is done,
+// Stop is called or the interval changes through Configure
+func (lb *Pool) StartHealthChecks(ctx context.Context) {
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		lb.runHealthChecks(ctx)
+	}()
+}
+
+// Enhanced health checking, one loop per pool until the pool is removed.
+// Each round probes at most health_check.concurrency backends at once and
+// waits for its probes, so no probe outlives the loop; stopping the loop
+// cancels the probes in flight.
+func (lb *Pool) runHealthChecks(ctx context.Context) {
+	lb.mu.RLock()
+	stop := lb.stop
+	t := time.NewTicker(lb.healthCheck.Interval.Duration())
+	lb.mu.RUnlock()
+	defer t.Stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		lb.mu.RLock()
+		backends := make([]*Backend, len(lb.backends))
+		copy(backends, lb.backends)
+		hc := lb.healthCheck
+		key := lb.healthCheckKey
+		transport := lb.transport
+		protocol := lb.protocol
+		lb.mu.RUnlock()
+
+		queue := make(chan *Backend, len(backends))
+		for _, backend := range backends {
+			queue <- backend
+		}
+		close(queue)
+
+		var probes sync.WaitGroup
+		for range min(hc.concurrency(), len(backends)) {
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				for b := range queue {
+					if ctx.Err() != nil {
+						return
+					}
+					lb.probe(ctx, b, hc, key, transport, protocol)
+				}
+			}()
+		}
+		probes.Wait()
+		lb.RefreshPeers()
+	}
+}
+
+// probe checks one backend and records its state, health score and
+// response time
+func (lb *Pool) probe(ctx context.Context, b *Backend, hc HealthCheckConfig, key []byte, transport http.RoundTripper, protocol string) {
+	start := time.Now()
+	isAlive := isBackendAlive(ctx, b.URL, hc, key, transport, protocol)
+	if ctx.Err() != nil {
+		return // shutting down, the probe was cancelled rather than failed
+	}
+	responseTime := time.Since(start)
+
+	b.RecordResponseTime(responseTime)
+
+	b.SetAlive(isAlive)
+	b.UpdateHealthScore()
+
+	status := "❌ DOWN"
+	if isAlive {
+		status = "✅ UP"
+	}
+
+	cbState := b.CircuitBreaker.GetState()
+	log.Printf("🏥 Enhanced Backend #%d [%s] %s %s (Health: %.2f, CB: %s, RT: %v)",
+		b.ID, lb.name, b.URL, status, b.HealthScore, cbState, responseTime)
+}
+
+// isBackendAlive probes a backend with a TCP dial, or an HTTP GET when a path
+// is configured; gRPC pools call the gRPC health service at that path instead.
+// Probes with a path are signed when key is set.
+func isBackendAlive(ctx context.Context, u *url.URL, hc HealthCheckConfig, key []byte, transport http.RoundTripper, protocol string) bool {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout.Duration())
+	defer cancel()
+
+	if hc.Path == "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return true
+	}
+
+	var signature string
+	if len(key) > 0 {
+		signature = SignHealthCheck(key, time.Now(), hc.Path)
+	}
+	if protocol == ProtocolGRPC {
+		return isGRPCServing(ctx, u.ResolveReference(&url.URL{Path: hc.Path}), signature, transport)
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.ResolveReference(&url.URL{Path: hc.Path}).String(), nil)
+	if err != nil {
+		return false
+	}
+	if signature != "" {
+		req.Header.Set(HealthSignatureHeader, signature)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
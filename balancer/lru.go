@@ -0,0 +1,152 @@
+package balancer
+
+import "container/list"
+
+// lruCompactMin is the peak size below which a shrunken table is not
+// rebuilt; small maps are not worth copying
+const lruCompactMin = 1024
+
+// TableStats reports the occupancy of a bounded routing table
+type TableStats struct {
+	Size        int   `json:"size"`
+	Max         int   `json:"max"`  // 0 for no limit
+	Peak        int   `json:"peak"` // largest size since the last compaction
+	Evicted     int64 `json:"evicted"`
+	Compactions int64 `json:"compactions"`
+}
+
+// lruTable maps keys to backends, bounded to max entries with the least
+// recently used key evicted first. Go maps never give back their buckets,
+// so once the table shrinks to a quarter of its peak it is rebuilt. It is
+// not safe for concurrent use.
+type lruTable struct {
+	entries     map[string]*list.Element
+	order       list.List // *lruEntry, most recently used at the front
+	max         int
+	peak        int
+	evicted     int64
+	compactions int64
+}
+
+// lruEntry is one key of an lruTable
+type lruEntry struct {
+	key     string
+	backend *Backend
+}
+
+// newLRUTable creates an unbounded table
+func newLRUTable() *lruTable {
+	return &lruTable{entries: make(map[string]*list.Element)}
+}
+
+// get returns the backend of key, or nil, and marks key as recently used
+func (t *lruTable) get(key string) *Backend {
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	t.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).backend
+}
+
+// peek returns the backend of key, or nil, leaving the order alone
+func (t *lruTable) peek(key string) *Backend {
+	elem, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	return elem.Value.(*lruEntry).backend
+}
+
+// set maps key to backend, evicting the least recently used key when full
+func (t *lruTable) set(key string, backend *Backend) {
+	if elem, ok := t.entries[key]; ok {
+		elem.Value.(*lruEntry).backend = backend
+		t.order.MoveToFront(elem)
+		return
+	}
+	if t.max > 0 && len(t.entries) >= t.max {
+		t.evictOldest(len(t.entries) - t.max + 1)
+	}
+	t.entries[key] = t.order.PushFront(&lruEntry{key: key, backend: backend})
+	t.peak = max(t.peak, len(t.entries))
+}
+
+// full reports whether another key would evict one
+func (t *lruTable) full() bool {
+	return t.max > 0 && len(t.entries) >= t.max
+}
+
+// deleteBackend removes every key mapped to backend
+func (t *lruTable) deleteBackend(backend *Backend) {
+	for key, elem := range t.entries {
+		if elem.Value.(*lruEntry).backend == backend {
+			t.order.Remove(elem)
+			delete(t.entries, key)
+		}
+	}
+	t.compact()
+}
+
+// evictOldest drops the n least recently used keys
+func (t *lruTable) evictOldest(n int) int {
+	dropped := 0
+	for ; dropped < n; dropped++ {
+		elem := t.order.Back()
+		if elem == nil {
+			break
+		}
+		t.order.Remove(elem)
+		delete(t.entries, elem.Value.(*lruEntry).key)
+	}
+	t.evicted += int64(dropped)
+	t.compact()
+	return dropped
+}
+
+// setLimit bounds the table, evicting at once when it holds more; 0 removes
+// the bound
+func (t *lruTable) setLimit(max int) {
+	t.max = max
+	if max > 0 && len(t.entries) > max {
+		t.evictOldest(len(t.entries) - max)
+	}
+}
+
+// trim evicts keys until at most keep remain and returns how many it dropped
+func (t *lruTable) trim(keep int) int {
+	return t.evictOldest(len(t.entries) - keep)
+}
+
+// compact rebuilds the map once it holds a quarter of its peak
+func (t *lruTable) compact() {
+	if t.peak < lruCompactMin || len(t.entries) > t.peak/4 {
+		return
+	}
+	entries := make(map[string]*list.Element, len(t.entries))
+	for key, elem := range t.entries {
+		entries[key] = elem
+	}
+	t.entries = entries
+	t.peak = len(entries)
+	t.compactions++
+}
+
+// each calls fn for every key, most recently used first
+func (t *lruTable) each(fn func(key string, backend *Backend)) {
+	for elem := t.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*lruEntry)
+		fn(entry.key, entry.backend)
+	}
+}
+
+// stats reports the table's occupancy
+func (t *lruTable) stats() TableStats {
+	return TableStats{
+		Size:        len(t.entries),
+		Max:         t.max,
+		Peak:        t.peak,
+		Evicted:     t.evicted,
+		Compactions: t.compactions,
+	}
+}
@@ -0,0 +1,631 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolSettings are the hot-reloadable settings of a backend pool
+type PoolSettings struct {
+	Name           string
+	Algorithm      string // "round-robin", "weighted-round-robin", "least-connections"
+	SessionCookie  string // Cookie used for session affinity
+	HealthCheck    HealthCheckConfig
+	HealthCheckKey []byte            // Resolved HealthCheck.SigningKeyRef, probes are unsigned when empty
+	Transport      http.RoundTripper // Proxied requests and health checks, http.DefaultTransport when nil
+	Protocol       string            // ProtocolHTTP (default) or ProtocolGRPC
+	Buffers        *BufferPool       // Copy buffers of proxied bodies, allocated per transfer when nil
+	GRPCWeb        bool              // Translate gRPC-Web requests to gRPC for this pool
+	Cache          bool              // Serve cacheable GET responses from the shared HTTP cache
+}
+
+// Pool is a named set of backends with its own algorithm, session affinity
+// table and health check loop
+type Pool struct {
+	name           string
+	backends       []*Backend
+	current        uint64
+	mu             sync.RWMutex
+	algorithm      string
+	consistentHash *ConsistentHash
+	peers          atomic.Pointer[peerSnapshot] // read by backend selection without taking mu
+	weightMu       sync.Mutex                   // smooth weighted round-robin state (Backend.CurrentWeight)
+	sessionMu      sync.Mutex                   // guards sessions; lookups reorder it
+	sessions       *lruTable                    // session key -> pinned backend, least recently used evicted first
+	sessionCookie  string
+	healthCheck    HealthCheckConfig
+	healthCheckKey []byte
+	transport      http.RoundTripper
+	protocol       string
+	grpcWeb        bool
+	cache          bool
+	buffers        *BufferPool
+	stop           chan struct{}
+	stopped        bool
+	wg             sync.WaitGroup // health check loops
+	created        time.Time
+}
+
+// peerSnapshot is an immutable view of a pool for backend selection. It is
+// published whenever the backends, their health or the algorithm change,
+// so requests pick a backend without locking the pool.
+type peerSnapshot struct {
+	algorithm string
+	backends  []*Backend
+	healthy   []*Backend // alive when the snapshot was taken
+}
+
+// NewPool creates an empty backend pool; call StartHealthChecks to probe its backends
+func NewPool(pc PoolSettings) *Pool {
+	lb := &Pool{
+		name:           pc.Name,
+		backends:       []*Backend{},
+		algorithm:      pc.Algorithm,
+		sessions:       newLRUTable(),
+		sessionCookie:  pc.SessionCookie,
+		healthCheck:    pc.HealthCheck,
+		healthCheckKey: pc.HealthCheckKey,
+		transport:      pc.Transport,
+		protocol:       pc.Protocol,
+		grpcWeb:        pc.GRPCWeb,
+		cache:          pc.Cache,
+		buffers:        pc.Buffers,
+		stop:           make(chan struct{}),
+		created:        time.Now(),
+	}
+	lb.publishPeers()
+	return lb
+}
+
+// publishPeers takes a new selection snapshot; callers hold mu
+func (lb *Pool) publishPeers() {
+	peers := &peerSnapshot{
+		algorithm: lb.algorithm,
+		backends:  slices.Clone(lb.backends),
+	}
+	for _, b := range lb.backends {
+		if b.IsAlive() {
+			peers.healthy = append(peers.healthy, b)
+		}
+	}
+	lb.peers.Store(peers)
+}
+
+// RefreshPeers takes a new selection snapshot after backend health changed
+func (lb *Pool) RefreshPeers() {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	lb.publishPeers()
+}
+
+// Consistent Hash ring for consistent hashing algorithm
+type ConsistentHash struct {
+	mu       sync.RWMutex
+	ring     map[uint32]*Backend
+	sorted   []uint32
+	replicas int
+}
+
+// Simplified metrics
+type Stats struct {
+	Pool              string     `json:"pool"`
+	TotalRequests     int64      `json:"total_requests"`
+	TotalConnections  int64      `json:"total_connections"`
+	ActiveConnections int64      `json:"active_connections"`
+	RequestsPerSecond float64    `json:"requests_per_second"` // Over the last RateWindow
+	ErrorRate         float64    `json:"error_rate"`          // Over the last RateWindow
+	TotalBackends     int        `json:"total_backends"`
+	HealthyBackends   int        `json:"healthy_backends"`
+	Algorithm         string     `json:"algorithm"`
+	BackendStats      []*Backend `json:"backend_stats"`
+	LastUpdate        time.Time  `json:"last_update"`
+}
+
+// Consistent Hash implementation
+func NewConsistentHash(replicas int) *ConsistentHash {
+	return &ConsistentHash{
+		ring:     make(map[uint32]*Backend),
+		replicas: replicas,
+	}
+}
+
+func (ch *ConsistentHash) Add(backend *Backend) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for i := 0; i < ch.replicas; i++ {
+		hash := ch.hashKey(fmt.Sprintf("%s:%d", backend.URL.String(), i))
+		ch.ring[hash] = backend
+		ch.sorted = append(ch.sorted, hash)
+	}
+	sort.Slice(ch.sorted, func(i, j int) bool {
+		return ch.sorted[i] < ch.sorted[j]
+	})
+}
+
+func (ch *ConsistentHash) Get(key string) *Backend {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	if len(ch.ring) == 0 {
+		return nil
+	}
+
+	hash := ch.hashKey(key)
+	idx := ch.search(hash)
+	return ch.ring[ch.sorted[idx]]
+}
+
+func (ch *ConsistentHash) hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+func (ch *ConsistentHash) search(hash uint32) int {
+	f := func(x int) bool {
+		return ch.sorted[x] >= hash
+	}
+	i := sort.Search(len(ch.sorted), f)
+	if i >= len(ch.sorted) {
+		i = 0
+	}
+	return i
+}
+
+// Enhanced Load Balancer methods
+func (lb *Pool) AddBackend(backend *Backend) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	backend.ID = len(lb.backends)
+	backend.CircuitBreaker = NewCircuitBreaker(5, 30*time.Second)
+	backend.Weight = 1 + backend.ID // Progressive weights
+	backend.CurrentWeight = 0
+	backend.Capacity = 1000 * int64(backend.ID+1) // Different capacities
+	backend.Region = fmt.Sprintf("region-%d", backend.ID%3)
+
+	lb.backends = append(lb.backends, backend)
+
+	// Initialize consistent hash if using that algorithm
+	if lb.consistentHash != nil {
+		lb.consistentHash.Add(backend)
+	}
+	lb.publishPeers()
+
+	log.Printf("🏪 Enhanced backend #%d added: %s (Weight: %d, Capacity: %d)",
+		backend.ID, backend.URL.Redacted(), backend.Weight, backend.Capacity)
+}
+
+// HasBackend reports whether backend belongs to this pool
+func (lb *Pool) HasBackend(backend *Backend) bool {
+	return slices.Contains(lb.peers.Load().backends, backend)
+}
+
+// RemoveBackend removes the backend with the given URL and returns it, or nil if absent
+func (lb *Pool) RemoveBackend(rawURL string) *Backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for i, backend := range lb.backends {
+		if backend.URL.String() == rawURL {
+			lb.backends = append(lb.backends[:i], lb.backends[i+1:]...)
+			lb.publishPeers()
+			lb.sessionMu.Lock()
+			lb.sessions.deleteBackend(backend)
+			lb.sessionMu.Unlock()
+			log.Printf("🗑️ Backend #%d removed: %s", backend.ID, rawURL)
+			return backend
+		}
+	}
+	return nil
+}
+
+// GetNextPeer picks the backend for a request: the session's backend while
+// it is alive, otherwise one chosen by the pool's algorithm. It reads the
+// published snapshot and does not lock the pool.
+func (lb *Pool) GetNextPeer(sessionKey string) *Backend {
+	peers := lb.peers.Load()
+	if len(peers.backends) == 0 {
+		return nil
+	}
+
+	// Session affinity check
+	if sessionKey != "" {
+		if backend := lb.session(sessionKey); backend != nil && backend.IsAlive() {
+			return backend
+		}
+	}
+
+	// Simplified algorithms only
+	switch peers.algorithm {
+	case "weighted-round-robin":
+		return lb.getWeightedRoundRobinBackend(peers)
+	case "least-connections":
+		return getLeastConnectionsBackend(peers)
+	case "round-robin":
+		fallthrough
+	default:
+		return lb.getRoundRobinBackend(peers)
+	}
+}
+
+// PeekNextPeer returns the backend GetNextPeer would pick, without advancing
+// the round-robin position or weights
+func (lb *Pool) PeekNextPeer(sessionKey string) (backend *Backend, affinity bool) {
+	peers := lb.peers.Load()
+	if len(peers.backends) == 0 {
+		return nil, false
+	}
+
+	if sessionKey != "" {
+		if backend := lb.session(sessionKey); backend != nil && backend.IsAlive() {
+			return backend, true
+		}
+	}
+
+	switch peers.algorithm {
+	case "weighted-round-robin":
+		lb.weightMu.Lock()
+		defer lb.weightMu.Unlock()
+		var selected *Backend
+		selectedWeight := 0
+		for _, b := range peers.healthy {
+			if selected == nil || b.CurrentWeight+b.Weight > selectedWeight {
+				selected = b
+				selectedWeight = b.CurrentWeight + b.Weight
+			}
+		}
+		return selected, false
+	case "least-connections":
+		return getLeastConnectionsBackend(peers), false
+	default:
+		n := len(peers.healthy)
+		if n == 0 {
+			return nil, false
+		}
+		next := int((atomic.LoadUint64(&lb.current) + 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			if b := peers.healthy[(next+i)%n]; b.IsAlive() {
+				return b, false
+			}
+		}
+		return nil, false
+	}
+}
+
+// session returns the backend a session key is pinned to
+func (lb *Pool) session(key string) *Backend {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	return lb.sessions.get(key)
+}
+
+// Simplified: Removed complex algorithms (adaptive-weighted, health-based, consistent-hash)
+// Only keeping basic algorithms for educational use
+
+// getWeightedRoundRobinBackend runs smooth weighted round-robin; the
+// weights are shared state, so this is the one algorithm that takes a lock
+func (lb *Pool) getWeightedRoundRobinBackend(peers *peerSnapshot) *Backend {
+	lb.weightMu.Lock()
+	defer lb.weightMu.Unlock()
+
+	var selected *Backend
+	totalWeight := 0
+
+	for _, backend := range peers.healthy {
+		backend.CurrentWeight += backend.Weight
+		totalWeight += backend.Weight
+
+		if selected == nil || backend.CurrentWeight > selected.CurrentWeight {
+			selected = backend
+		}
+	}
+
+	if selected != nil {
+		selected.CurrentWeight -= totalWeight
+	}
+
+	return selected
+}
+
+// getRoundRobinBackend takes the next healthy backend. A backend that went
+// down since the snapshot was taken is skipped.
+func (lb *Pool) getRoundRobinBackend(peers *peerSnapshot) *Backend {
+	n := len(peers.healthy)
+	if n == 0 {
+		return nil
+	}
+	next := int(atomic.AddUint64(&lb.current, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		if b := peers.healthy[(next+i)%n]; b.IsAlive() {
+			return b
+		}
+	}
+	return nil
+}
+
+func getLeastConnectionsBackend(peers *peerSnapshot) *Backend {
+	var selected *Backend
+	minConnections := int64(math.MaxInt64)
+
+	for _, backend := range peers.healthy {
+		connections := backend.GetConnections()
+		if connections < minConnections {
+			minConnections = connections
+			selected = backend
+		}
+	}
+	return selected
+}
+
+// Simplified: Removed health-based algorithm method
+
+// GetStats returns the pool's request, error and backend health figures.
+// Connection counts are process-wide and left for the caller to fill in.
+func (lb *Pool) GetStats() *Stats {
+	peers := lb.peers.Load()
+
+	healthy := 0
+	for _, backend := range peers.backends {
+		if backend.IsAlive() {
+			healthy++
+		}
+	}
+
+	// Request total since start, rates over the last RateWindow
+	totalRequests := int64(0)
+	var recentRequests, recentErrors int64
+	for _, backend := range peers.backends {
+		totalRequests += backend.GetRequestCount()
+		recentRequests += backend.RecentRequests.Count()
+		recentErrors += backend.RecentErrors.Count()
+	}
+	rps := float64(recentRequests) / RateWindow.Seconds()
+
+	var errorRate float64
+	if recentRequests > 0 {
+		errorRate = float64(recentErrors) / float64(recentRequests)
+	}
+
+	for _, backend := range peers.backends {
+		backend.UpdateHealthScore()
+	}
+
+	return &Stats{
+		Pool:              lb.name,
+		TotalRequests:     totalRequests,
+		TotalBackends:     len(peers.backends),
+		HealthyBackends:   healthy,
+		Algorithm:         peers.algorithm,
+		BackendStats:      peers.backends,
+		RequestsPerSecond: rps,
+		LastUpdate:        time.Now(),
+		ErrorRate:         errorRate,
+	}
+}
+
+// Name returns the pool name
+func (lb *Pool) Name() string {
+	return lb.name
+}
+
+// Settings returns the pool's current settings
+func (lb *Pool) Settings() PoolSettings {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return PoolSettings{
+		Name:          lb.name,
+		Algorithm:     lb.algorithm,
+		SessionCookie: lb.sessionCookie,
+		HealthCheck:   lb.healthCheck,
+		Protocol:      lb.protocol,
+		GRPCWeb:       lb.grpcWeb,
+		Cache:         lb.cache,
+		Buffers:       lb.buffers,
+	}
+}
+
+// RoundTrip sends a proxied request with the pool's current transport, so
+// transport changes apply to existing backends too
+func (lb *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	lb.mu.RLock()
+	transport := lb.transport
+	lb.mu.RUnlock()
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+
+// Algorithm returns the balancing algorithm
+func (lb *Pool) Algorithm() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.algorithm
+}
+
+// SetAlgorithm changes the balancing algorithm
+func (lb *Pool) SetAlgorithm(algorithm string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.algorithm = algorithm
+	lb.publishPeers()
+}
+
+// SessionCookie returns the name of the session affinity cookie
+func (lb *Pool) SessionCookie() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.sessionCookie
+}
+
+// Backends returns a copy of the pool's backend list
+func (lb *Pool) Backends() []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	backends := make([]*Backend, len(lb.backends))
+	copy(backends, lb.backends)
+	return backends
+}
+
+// Configure updates the hot-reloadable pool settings. It returns true when the
+// health check interval changed and the old health check loop was stopped.
+func (lb *Pool) Configure(pc PoolSettings) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.algorithm != pc.Algorithm {
+		log.Printf("🔄 Pool %s algorithm changed to: %s", lb.name, pc.Algorithm)
+	}
+	lb.algorithm = pc.Algorithm
+	lb.publishPeers()
+	lb.sessionCookie = pc.SessionCookie
+	lb.transport = pc.Transport
+	if lb.protocol != pc.Protocol {
+		log.Printf("🔄 Pool %s backend protocol changed to: %s", lb.name, pc.Protocol)
+	}
+	lb.protocol = pc.Protocol
+	lb.grpcWeb = pc.GRPCWeb
+	lb.cache = pc.Cache
+	lb.buffers = pc.Buffers
+
+	restart := lb.healthCheck.Interval != pc.HealthCheck.Interval && !lb.stopped
+	lb.healthCheck = pc.HealthCheck
+	lb.healthCheckKey = pc.HealthCheckKey
+	if restart {
+		close(lb.stop)
+		lb.stop = make(chan struct{})
+	}
+	return restart
+}
+
+// Stop ends the pool's health check loop and waits for it to exit
+func (lb *Pool) Stop() {
+	lb.mu.Lock()
+	if !lb.stopped {
+		lb.stopped = true
+		close(lb.stop)
+	}
+	lb.mu.Unlock()
+	lb.wg.Wait()
+}
+
+// ReconcileBackends adds and removes backends so the pool serves exactly urls.
+// New backends get the next free ID from router; removed ones are unregistered.
+func (lb *Pool) ReconcileBackends(urls []*url.URL, router *QUICLB) {
+	wanted := make(map[string]bool)
+	for _, u := range urls {
+		wanted[u.String()] = true
+	}
+
+	existing := make(map[string]bool)
+	for _, backend := range lb.Backends() {
+		existing[backend.URL.String()] = true
+		if !wanted[backend.URL.String()] {
+			if removed := lb.RemoveBackend(backend.URL.String()); removed != nil {
+				router.RemoveBackend(removed)
+			}
+		}
+	}
+
+	for _, u := range urls {
+		if existing[u.String()] {
+			continue
+		}
+		// Backends keep their server ID when they return
+		id, err := router.ServerIDs().Assign(lb.name, u.Redacted())
+		if err != nil {
+			log.Printf("❌ Backend %s not added to pool %s: %v", u.Redacted(), lb.name, err)
+			continue
+		}
+		backend := NewBackend(u)
+		backend.ReverseProxy.Transport = lb
+		lb.mu.RLock()
+		if lb.buffers != nil {
+			backend.ReverseProxy.BufferPool = lb.buffers
+		}
+		lb.mu.RUnlock()
+
+		// Add to both legacy and QUIC-LB load balancers
+		lb.AddBackend(backend)
+		router.AddBackend(backend, id)
+		log.Printf("✅ Added backend %d to pool %s: %s", id, lb.name, u.Redacted())
+	}
+}
+
+// SetSession pins a session key to a backend, evicting the least recently
+// used key when the table is full
+func (lb *Pool) SetSession(key string, backend *Backend) {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	lb.sessions.set(key, backend)
+}
+
+// SetSessionLimit bounds the session affinity table, trimming it at once
+// when it holds more; 0 removes the bound. Evicted clients are balanced
+// afresh on their next request.
+func (lb *Pool) SetSessionLimit(max int) {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	lb.sessions.setLimit(max)
+}
+
+// TrimSessions unpins the least recently used session keys until at most
+// keep remain and returns how many it dropped
+func (lb *Pool) TrimSessions(keep int) int {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	return lb.sessions.trim(keep)
+}
+
+// SessionStats reports the occupancy of the session affinity table
+func (lb *Pool) SessionStats() TableStats {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	return lb.sessions.stats()
+}
+
+// Sessions returns the session affinity table as session key -> backend URL
+func (lb *Pool) Sessions() map[string]string {
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+
+	sessions := make(map[string]string, len(lb.sessions.entries))
+	lb.sessions.each(func(key string, backend *Backend) {
+		sessions[key] = backend.URL.String()
+	})
+	return sessions
+}
+
+// RestoreSessions re-links saved session keys to this pool's backends
+func (lb *Pool) RestoreSessions(saved map[string]string) int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	byURL := make(map[string]*Backend)
+	for _, backend := range lb.backends {
+		byURL[backend.URL.String()] = backend
+	}
+
+	lb.sessionMu.Lock()
+	defer lb.sessionMu.Unlock()
+	restored := 0
+	for key, u := range saved {
+		if lb.sessions.full() {
+			break
+		}
+		if backend, ok := byURL[u]; ok {
+			lb.sessions.set(key, backend)
+			restored++
+		}
+	}
+	return restored
+}
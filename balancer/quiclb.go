@@ -0,0 +1,584 @@
+package balancer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	mathrand "math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"quic-moodle/quiclb"
+)
+
+// QUIC-LB Draft 20 Compliant Load Balancer with Config Rotation Support
+type QUICLB struct {
+	backends       []*Backend
+	peers          atomic.Pointer[[]*Backend] // copy of backends read by SelectBackend without locking
+	mu             sync.RWMutex
+	encoders       map[uint8]*quiclb.Encoder // Map of config rotation bits to encoders
+	configs        map[uint8]*quiclb.Config  // Map of config rotation bits to configs
+	activeConfig   uint8                     // Currently active config rotation bits
+	backendMap     map[uint16]*Backend       // Direct mapping from backend ID to backend
+	algorithm      string
+	consistentHash *ConsistentHash
+	// Unroutable CID handling
+	unroutableTable map[string]*Backend // 4-tuple to backend mapping for unroutable CIDs
+	unroutableCIDs  atomic.Int64        // CIDs that fell back to handleUnroutableCID
+
+	cidMu    sync.Mutex // guards cidTable, which the fallback uses without mu
+	cidTable *lruTable  // hex CID -> fallback backend, least recently used evicted first
+
+	fallbackStore CIDFallbackStore // shares fallback choices with other instances, nil when alone
+
+	serverIDs *ServerIDRegistry // server IDs of the backends, kept while they come and go
+}
+
+// CIDFallbackStore shares the fallback choices for unroutable CIDs between
+// load balancer instances behind one address, so the packets of a
+// connection reach the same backend whichever instance receives them
+type CIDFallbackStore interface {
+	// Claim offers backendURL for a hex CID and returns the backend URL the
+	// instances agreed on: the earlier choice of another instance, if any
+	Claim(cid, backendURL string) (string, error)
+	// Move replaces the agreed backend from, which is down, with to and
+	// returns the backend URL agreed on afterwards; another instance may
+	// have moved the CID first
+	Move(cid, from, to string) (string, error)
+	// Touch notes that a CID was routed from the local table, so its shared
+	// choice is kept for as long as the connection lasts
+	Touch(cid string)
+}
+
+// NewQUICLB creates a new QUIC-LB load balancer with config rotation support
+func NewQUICLB(algorithm string, config *quiclb.Config) (*QUICLB, error) {
+	var encoder *quiclb.Encoder
+	var err error
+
+	switch config.Algorithm {
+	case "plaintext":
+		encoder = quiclb.NewPlaintext(config.ConfigRotationBits, config.ServerIDLen, config.ConnectionIDLen)
+	case "stream-cipher", "block-cipher":
+		if len(config.Key) == 0 {
+			return nil, fmt.Errorf("key required for encrypted algorithm: %s", config.Algorithm)
+		}
+		encoder, err = quiclb.NewEncrypted(config.Algorithm, config.ConfigRotationBits, config.ServerIDLen, config.ConnectionIDLen, config.NonceLen, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create encrypted encoder: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", config.Algorithm)
+	}
+
+	lb := &QUICLB{
+		backends:        []*Backend{},
+		encoders:        make(map[uint8]*quiclb.Encoder),
+		configs:         make(map[uint8]*quiclb.Config),
+		activeConfig:    config.ConfigRotationBits,
+		backendMap:      make(map[uint16]*Backend),
+		algorithm:       algorithm,
+		unroutableTable: make(map[string]*Backend),
+		cidTable:        newLRUTable(),
+		serverIDs:       NewServerIDRegistry(config.ServerIDLen),
+	}
+
+	// Add the initial configuration
+	lb.encoders[config.ConfigRotationBits] = encoder
+	lb.configs[config.ConfigRotationBits] = config
+
+	return lb, nil
+}
+
+// AddBackend adds a backend to the QUIC-LB load balancer with a specific ID
+func (qlb *QUICLB) AddBackend(backend *Backend, backendID uint16) {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+
+	backend.ID = int(backendID)
+	qlb.backends = append(qlb.backends, backend)
+	qlb.backendMap[backendID] = backend
+	qlb.publishPeers()
+}
+
+// publishPeers publishes a copy of the backend list; callers hold mu
+func (qlb *QUICLB) publishPeers() {
+	peers := slices.Clone(qlb.backends)
+	qlb.peers.Store(&peers)
+}
+
+// RemoveBackend removes a backend and its ID mapping from the QUIC-LB load balancer
+func (qlb *QUICLB) RemoveBackend(backend *Backend) {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+
+	for i, b := range qlb.backends {
+		if b == backend {
+			qlb.backends = append(qlb.backends[:i], qlb.backends[i+1:]...)
+			break
+		}
+	}
+	if qlb.backendMap[uint16(backend.ID)] == backend {
+		delete(qlb.backendMap, uint16(backend.ID))
+		qlb.serverIDs.ReleaseID(uint16(backend.ID))
+	}
+	// Published first, so a fallback running without mu either sees the
+	// backend gone or stored it before the table is cleared
+	qlb.publishPeers()
+	qlb.cidMu.Lock()
+	qlb.cidTable.deleteBackend(backend)
+	qlb.cidMu.Unlock()
+}
+
+// ServerIDs returns the registry assigning server IDs to backends
+func (qlb *QUICLB) ServerIDs() *ServerIDRegistry {
+	return qlb.serverIDs
+}
+
+// NextBackendID returns the lowest unused backend ID (IDs start from 1)
+func (qlb *QUICLB) NextBackendID() uint16 {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+
+	for id := uint16(1); id < math.MaxUint16; id++ {
+		if _, used := qlb.backendMap[id]; !used {
+			return id
+		}
+	}
+	return math.MaxUint16
+}
+
+// RouteByConnectionID implements stateless routing per QUIC-LB Draft 20 with fallback support
+func (qlb *QUICLB) RouteByConnectionID(connectionID []byte) (*Backend, error) {
+	qlb.mu.RLock()
+	backend, decoded, err := qlb.decodeLocked(connectionID)
+	store := qlb.fallbackStore
+	qlb.mu.RUnlock()
+	if decoded {
+		return backend, err
+	}
+	// The fallback may wait on the shared store, so it runs without mu
+	return qlb.handleUnroutableCID(connectionID, store)
+}
+
+// LookupConnectionID reports where RouteByConnectionID would send a
+// connection ID without routing it: nothing is counted, remembered or
+// shared with other instances. fallback is set for CIDs that do not decode
+// to a backend; their answer ignores choices only other instances know.
+func (qlb *QUICLB) LookupConnectionID(connectionID []byte) (backend *Backend, fallback bool, err error) {
+	qlb.mu.RLock()
+	backend, decoded, err := qlb.decodeLocked(connectionID)
+	qlb.mu.RUnlock()
+	if decoded {
+		return backend, false, err
+	}
+
+	qlb.cidMu.Lock()
+	previous := qlb.cidTable.peek(hex.EncodeToString(connectionID))
+	qlb.cidMu.Unlock()
+	if previous != nil && previous.IsAlive() {
+		return previous, true, nil
+	}
+	healthy := qlb.healthyPeers()
+	if len(healthy) == 0 {
+		return nil, true, fmt.Errorf("no healthy backends available for unroutable CID")
+	}
+	return fallbackBackend(healthy, connectionID), true, nil
+}
+
+// decodeLocked routes a connection ID by the config its rotation bits
+// name. decoded is false for CIDs left to the fallback: unroutable ones,
+// those no config decodes and those naming a server ID no backend has.
+// Callers hold mu.
+func (qlb *QUICLB) decodeLocked(connectionID []byte) (backend *Backend, decoded bool, err error) {
+	if len(connectionID) == 0 {
+		return nil, false, nil
+	}
+	configRotationBits := (connectionID[0] >> 5) & 0x07
+
+	// Check for reserved value (unroutable)
+	if configRotationBits == 0x07 {
+		return nil, false, nil
+	}
+
+	// Try to find encoder for this config
+	encoder, exists := qlb.encoders[configRotationBits]
+	if !exists {
+		return nil, false, nil
+	}
+	cidInfo, err := encoder.DecodeCID(connectionID)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	// Stateless routing - directly map to backend
+	backend, exists = qlb.backendMap[cidInfo.BackendID]
+	if !exists {
+		// A server ID no backend has, like a client's random Initial DCID
+		// that happens to carry this config's bits
+		return nil, false, nil
+	}
+
+	// Check if backend is healthy (fail-fast)
+	if !backend.IsAlive() {
+		return nil, true, fmt.Errorf("backend %d is not healthy", cidInfo.BackendID)
+	}
+	return backend, true, nil
+}
+
+// healthyPeers returns the live backends of the published backend list
+func (qlb *QUICLB) healthyPeers() []*Backend {
+	peers := qlb.peers.Load()
+	if peers == nil {
+		return nil
+	}
+	var healthy []*Backend
+	for _, backend := range *peers {
+		if backend.IsAlive() {
+			healthy = append(healthy, backend)
+		}
+	}
+	return healthy
+}
+
+// handleUnroutableCID implements Draft 20 Section 4 fallback algorithms.
+// It works on the published backend list without mu, since agreeing on a
+// choice through store can wait on the network.
+func (qlb *QUICLB) handleUnroutableCID(connectionID []byte, store CIDFallbackStore) (*Backend, error) {
+	qlb.unroutableCIDs.Add(1)
+
+	// Draft 20 Section 4.2 - Baseline Fallback Algorithm
+
+	if peers := qlb.peers.Load(); peers == nil || len(*peers) == 0 {
+		return nil, fmt.Errorf("no backends available for unroutable CID")
+	}
+
+	// A CID seen before keeps its backend while that is healthy
+	cidKey := hex.EncodeToString(connectionID)
+	qlb.cidMu.Lock()
+	previous := qlb.cidTable.get(cidKey)
+	qlb.cidMu.Unlock()
+	if previous != nil && previous.IsAlive() {
+		if store != nil {
+			store.Touch(cidKey)
+		}
+		return previous, nil
+	}
+
+	// Health-aware selection
+	healthyBackends := qlb.healthyPeers()
+	if len(healthyBackends) == 0 {
+		return nil, fmt.Errorf("no healthy backends available for unroutable CID")
+	}
+
+	selected := fallbackBackend(healthyBackends, connectionID)
+
+	// Another instance may have routed this CID already; follow its choice
+	// when the backend is healthy here too, otherwise move the CID for all
+	if store != nil {
+		selectedURL := selected.URL.String()
+		agreed, err := store.Claim(cidKey, selectedURL)
+		if err == nil && agreed != selectedURL && findBackendByURL(healthyBackends, agreed) == nil {
+			agreed, err = store.Move(cidKey, agreed, selectedURL)
+		}
+		if err == nil {
+			if backend := findBackendByURL(healthyBackends, agreed); backend != nil {
+				selected = backend
+			}
+		}
+	}
+
+	// Store in unroutable table for future use (based on CID), unless the
+	// backend was removed meanwhile
+	qlb.cidMu.Lock()
+	if peers := qlb.peers.Load(); peers != nil && slices.Contains(*peers, selected) {
+		qlb.cidTable.set(cidKey, selected)
+	}
+	qlb.cidMu.Unlock()
+
+	return selected, nil
+}
+
+// fallbackBackend picks the backend of an unroutable CID by rendezvous
+// hashing: the backend scoring highest for the CID wins, so CIDs spread
+// over the backends, every instance picks the same one, and only the CIDs
+// of a backend that goes away move
+func fallbackBackend(backends []*Backend, connectionID []byte) *Backend {
+	var selected *Backend
+	var best uint64
+	for _, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(backend.URL.String()))
+		h.Write(connectionID)
+		// FNV alone leaves the high bits poorly mixed; finish like splitmix64
+		score := h.Sum64()
+		score = (score ^ score>>30) * 0xbf58476d1ce4e5b9
+		score = (score ^ score>>27) * 0x94d049bb133111eb
+		score ^= score >> 31
+		if selected == nil || score > best {
+			selected, best = backend, score
+		}
+	}
+	return selected
+}
+
+// findBackendByURL returns the backend of backends with url, or nil
+func findBackendByURL(backends []*Backend, url string) *Backend {
+	for _, backend := range backends {
+		if backend.URL.String() == url {
+			return backend
+		}
+	}
+	return nil
+}
+
+// SetCIDTableLimit bounds the fallback CID table, trimming it at once when
+// it holds more; 0 removes the bound. A dropped CID is routed by the
+// fallback again on its next packet.
+func (qlb *QUICLB) SetCIDTableLimit(max int) {
+	qlb.cidMu.Lock()
+	defer qlb.cidMu.Unlock()
+	qlb.cidTable.setLimit(max)
+}
+
+// TrimCIDTable drops the least recently used fallback CID mappings until at
+// most keep remain and returns how many it dropped
+func (qlb *QUICLB) TrimCIDTable(keep int) int {
+	qlb.cidMu.Lock()
+	defer qlb.cidMu.Unlock()
+	return qlb.cidTable.trim(keep)
+}
+
+// CIDTableStats reports the occupancy of the fallback CID table
+func (qlb *QUICLB) CIDTableStats() TableStats {
+	qlb.cidMu.Lock()
+	defer qlb.cidMu.Unlock()
+	return qlb.cidTable.stats()
+}
+
+// SetCIDFallbackStore shares fallback CID choices through store; nil keeps
+// them local
+func (qlb *QUICLB) SetCIDFallbackStore(store CIDFallbackStore) {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+	qlb.fallbackStore = store
+}
+
+// UnroutableCIDs returns how many connection IDs could not be decoded to a backend
+func (qlb *QUICLB) UnroutableCIDs() int64 {
+	return qlb.unroutableCIDs.Load()
+}
+
+// GenerateConnectionID creates a new connection ID for a selected backend (all algorithms)
+func (qlb *QUICLB) GenerateConnectionID(backendID uint16) ([]byte, error) {
+	var buf [20]byte
+	n, err := qlb.GenerateConnectionIDInto(buf[:], backendID)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(buf[:n]), nil
+}
+
+// GenerateConnectionIDInto writes a new connection ID for a selected backend
+// into dst with the active config and returns its length; a 20-byte dst
+// fits every config
+func (qlb *QUICLB) GenerateConnectionIDInto(dst []byte, backendID uint16) (int, error) {
+	qlb.mu.RLock()
+	encoder := qlb.encoders[qlb.activeConfig]
+	qlb.mu.RUnlock()
+
+	if encoder == nil {
+		return 0, fmt.Errorf("no active configuration available")
+	}
+	return encoder.EncodeCIDInto(dst, uint64(backendID))
+}
+
+// SelectBackend selects an appropriate backend using health-aware round robin
+// This is used for new connections when no specific backend is required.
+// It reads the published backend list and does not lock the load balancer.
+func (qlb *QUICLB) SelectBackend() (*Backend, uint16, error) {
+	peers := qlb.peers.Load()
+	if peers == nil || len(*peers) == 0 {
+		return nil, 0, fmt.Errorf("no backends available")
+	}
+
+	// Health-aware selection, uniform over the live backends
+	healthy := 0
+	for _, backend := range *peers {
+		if backend.IsAlive() {
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		return nil, 0, fmt.Errorf("no healthy backends available")
+	}
+
+	// Simple round-robin for now, can be enhanced with weighted algorithms
+	pick := mathrand.Intn(healthy)
+	for _, backend := range *peers {
+		if backend.IsAlive() {
+			if pick == 0 {
+				return backend, uint16(backend.ID), nil
+			}
+			pick--
+		}
+	}
+	return nil, 0, fmt.Errorf("no healthy backends available")
+}
+
+// GetBackendStats returns statistics for all backends
+func (qlb *QUICLB) GetBackendStats() []*Backend {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+
+	stats := make([]*Backend, len(qlb.backends))
+	copy(stats, qlb.backends)
+	return stats
+}
+
+// GetConfig returns the active QUIC-LB configuration
+func (qlb *QUICLB) GetConfig() *quiclb.Config {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+	return qlb.configs[qlb.activeConfig]
+}
+
+// AddConfig adds a new configuration for config rotation
+func (qlb *QUICLB) AddConfig(config *quiclb.Config) error {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+
+	if config.ConfigRotationBits > 6 {
+		return fmt.Errorf("config rotation bits must be 0-6, got %d", config.ConfigRotationBits)
+	}
+	// Every backend must stay addressable once the config becomes active
+	if err := qlb.serverIDs.CheckFits(config.ServerIDLen); err != nil {
+		return err
+	}
+
+	var encoder *quiclb.Encoder
+	var err error
+
+	switch config.Algorithm {
+	case "plaintext":
+		encoder = quiclb.NewPlaintext(config.ConfigRotationBits, config.ServerIDLen, config.ConnectionIDLen)
+	case "stream-cipher", "block-cipher":
+		if len(config.Key) == 0 {
+			return fmt.Errorf("key required for encrypted algorithm: %s", config.Algorithm)
+		}
+		encoder, err = quiclb.NewEncrypted(config.Algorithm, config.ConfigRotationBits, config.ServerIDLen, config.ConnectionIDLen, config.NonceLen, config.Key)
+		if err != nil {
+			return fmt.Errorf("failed to create encrypted encoder: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", config.Algorithm)
+	}
+
+	qlb.configs[config.ConfigRotationBits] = config
+	qlb.encoders[config.ConfigRotationBits] = encoder
+
+	return nil
+}
+
+// SetActiveConfig changes the active configuration, resizing the server ID
+// registry to its server ID length
+func (qlb *QUICLB) SetActiveConfig(configRotationBits uint8) error {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+
+	config, exists := qlb.configs[configRotationBits]
+	if !exists {
+		return fmt.Errorf("configuration %d not found", configRotationBits)
+	}
+	if err := qlb.serverIDs.Resize(config.ServerIDLen); err != nil {
+		return fmt.Errorf("configuration %d cannot be activated: %v", configRotationBits, err)
+	}
+
+	qlb.activeConfig = configRotationBits
+	return nil
+}
+
+// Configs returns the installed configurations keyed by config rotation bits
+func (qlb *QUICLB) Configs() map[uint8]*quiclb.Config {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+
+	configs := make(map[uint8]*quiclb.Config, len(qlb.configs))
+	for bits, config := range qlb.configs {
+		configs[bits] = config
+	}
+	return configs
+}
+
+// ConnectionIDLen returns the length of the connection IDs whose first
+// octet is firstOctet: that of the config named by its rotation bits, or
+// of the active config when no config has them, as for unroutable CIDs
+func (qlb *QUICLB) ConnectionIDLen(firstOctet byte) int {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+	if config, ok := qlb.configs[firstOctet>>5&0x07]; ok {
+		return int(config.ConnectionIDLen)
+	}
+	return int(qlb.configs[qlb.activeConfig].ConnectionIDLen)
+}
+
+// ActiveConfigBits returns the config rotation bits of the active configuration
+func (qlb *QUICLB) ActiveConfigBits() uint8 {
+	qlb.mu.RLock()
+	defer qlb.mu.RUnlock()
+	return qlb.activeConfig
+}
+
+// CIDMappings returns the fallback CID table as hex CID -> backend URL
+func (qlb *QUICLB) CIDMappings() map[string]string {
+	qlb.cidMu.Lock()
+	defer qlb.cidMu.Unlock()
+
+	mappings := make(map[string]string, len(qlb.cidTable.entries))
+	qlb.cidTable.each(func(key string, backend *Backend) {
+		mappings[key] = backend.URL.String()
+	})
+	return mappings
+}
+
+// RestoreCIDMappings re-links saved CID mappings to backends that still exist
+func (qlb *QUICLB) RestoreCIDMappings(saved map[string]string) int {
+	qlb.mu.Lock()
+	defer qlb.mu.Unlock()
+
+	byURL := make(map[string]*Backend)
+	for _, backend := range qlb.backends {
+		byURL[backend.URL.String()] = backend
+	}
+
+	qlb.cidMu.Lock()
+	defer qlb.cidMu.Unlock()
+	restored := 0
+	for key, u := range saved {
+		if qlb.cidTable.full() {
+			break
+		}
+		if backend, ok := byURL[u]; ok {
+			qlb.cidTable.set(key, backend)
+			restored++
+		}
+	}
+	return restored
+}
+
+// DecodeCID decodes a connection ID with the encoder for its config rotation bits
+func (qlb *QUICLB) DecodeCID(cid []byte) (*quiclb.ConnectionID, error) {
+	if len(cid) == 0 {
+		return nil, fmt.Errorf("empty CID")
+	}
+
+	configRotationBits := (cid[0] >> 5) & 0x07
+	qlb.mu.RLock()
+	encoder, exists := qlb.encoders[configRotationBits]
+	qlb.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("no encoder for config rotation %d", configRotationBits)
+	}
+	return encoder.DecodeCID(cid)
+}
@@ -0,0 +1,222 @@
+package balancer
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quic-moodle/quiclb"
+)
+
+func newTestQUICLB(t testing.TB) *QUICLB {
+	t.Helper()
+	config := &quiclb.Config{
+		Algorithm:          "block-cipher",
+		ConfigRotationBits: 1,
+		ServerIDLen:        2,
+		NonceLen:           6,
+		ConnectionIDLen:    9,
+		Key:                []byte("0123456789abcdef"),
+	}
+	qlb, err := NewQUICLB("round-robin", config)
+	if err != nil {
+		t.Fatalf("NewQUICLB: %v", err)
+	}
+	return qlb
+}
+
+// A connection ID for each new connection is written with pooled scratch
+// blocks and a pooled nonce, allocating nothing
+func TestGenerateConnectionIDIntoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	qlb := newTestQUICLB(t)
+	var cid [20]byte
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := qlb.GenerateConnectionIDInto(cid[:], 300); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("GenerateConnectionIDInto allocates %.1f times per call, want 0", allocs)
+	}
+}
+
+func BenchmarkGenerateConnectionID(b *testing.B) {
+	qlb := newTestQUICLB(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := qlb.GenerateConnectionID(300); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// newTestBackends adds n healthy backends to qlb
+func newTestBackends(t testing.TB, qlb *QUICLB, n int) []*Backend {
+	t.Helper()
+	var backends []*Backend
+	for i := range n {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := NewBackend(u)
+		backend.CircuitBreaker = NewCircuitBreaker(5, 30*time.Second)
+		backend.SetAlive(true)
+		qlb.AddBackend(backend, uint16(i+1))
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// Unroutable CIDs spread over the healthy backends, and instances with the
+// same backends pick the same one for a CID
+func TestUnroutableCIDFallbackSpreads(t *testing.T) {
+	qlb, other := newTestQUICLB(t), newTestQUICLB(t)
+	backends := newTestBackends(t, qlb, 4)
+	newTestBackends(t, other, 4)
+
+	counts := make(map[*Backend]int)
+	for i := range 400 {
+		// Config rotation bits 0b111 mark a CID as unroutable
+		cid := []byte{0xe0, byte(i), byte(i >> 8), 1, 2, 3, 4, 5}
+		backend, err := qlb.RouteByConnectionID(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[backend]++
+		if again, _ := other.RouteByConnectionID(cid); again.URL.String() != backend.URL.String() {
+			t.Errorf("CID %x: %s on one instance, %s on another", cid, backend.URL, again.URL)
+		}
+	}
+	for _, backend := range backends {
+		if counts[backend] < 50 {
+			t.Errorf("backend %s got %d of 400 unroutable CIDs: %v", backend.URL, counts[backend], counts)
+		}
+	}
+}
+
+// Short header CIDs are as long as the config their rotation bits name
+func TestConnectionIDLenFollowsRotationBits(t *testing.T) {
+	qlb := newTestQUICLB(t)
+	if err := qlb.AddConfig(&quiclb.Config{Algorithm: "plaintext", ConfigRotationBits: 2, ServerIDLen: 2, ConnectionIDLen: 12}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		firstOctet byte
+		want       int
+	}{
+		{1 << 5, 9},    // the active config
+		{2 << 5, 12},   // installed for rotation
+		{3 << 5, 9},    // no such config
+		{0x07 << 5, 9}, // unroutable
+	} {
+		if got := qlb.ConnectionIDLen(tt.firstOctet); got != tt.want {
+			t.Errorf("ConnectionIDLen(%#02x) = %d, want %d", tt.firstOctet, got, tt.want)
+		}
+	}
+}
+
+// blockingStore is a CIDFallbackStore whose Claim waits for release,
+// counting the calls it gets
+type blockingStore struct {
+	claiming chan struct{}
+	release  chan struct{}
+	calls    atomic.Int64
+}
+
+func (s *blockingStore) Claim(cid, backendURL string) (string, error) {
+	s.calls.Add(1)
+	if s.claiming != nil {
+		s.claiming <- struct{}{}
+		<-s.release
+	}
+	return backendURL, nil
+}
+
+func (s *blockingStore) Move(cid, from, to string) (string, error) {
+	s.calls.Add(1)
+	return to, nil
+}
+
+func (s *blockingStore) Touch(cid string) {
+	s.calls.Add(1)
+}
+
+// A fallback waiting on the shared store does not hold the load balancer's
+// lock, so backends can still be added meanwhile
+func TestUnroutableCIDFallbackStoreUnlocked(t *testing.T) {
+	qlb := newTestQUICLB(t)
+	newTestBackends(t, qlb, 2)
+	store := &blockingStore{claiming: make(chan struct{}), release: make(chan struct{})}
+	qlb.SetCIDFallbackStore(store)
+
+	routed := make(chan error)
+	go func() {
+		_, err := qlb.RouteByConnectionID([]byte{0xe0, 1, 2, 3, 4, 5, 6, 7})
+		routed <- err
+	}()
+	<-store.claiming
+
+	added := make(chan struct{})
+	go func() {
+		qlb.AddBackend(NewBackend(&url.URL{Scheme: "http", Host: "10.0.0.9:8080"}), 9)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddBackend blocked while a fallback waited on the store")
+	}
+	close(store.release)
+	if err := <-routed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Looking a CID up routes it like RouteByConnectionID without counting,
+// remembering or sharing anything
+func TestLookupConnectionIDHasNoSideEffects(t *testing.T) {
+	qlb := newTestQUICLB(t)
+	backends := newTestBackends(t, qlb, 3)
+	store := &blockingStore{}
+	qlb.SetCIDFallbackStore(store)
+
+	cid, err := qlb.GenerateConnectionID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend, fallback, err := qlb.LookupConnectionID(cid); err != nil || fallback || backend != backends[1] {
+		t.Errorf("routable CID: backend %v, fallback %v, %v; want backend 2", backend, fallback, err)
+	}
+
+	unroutable := []byte{0xe0, 9, 8, 7, 6, 5, 4, 3}
+	looked, fallback, err := qlb.LookupConnectionID(unroutable)
+	if err != nil || !fallback {
+		t.Fatalf("unroutable CID: fallback %v, %v", fallback, err)
+	}
+	if n := qlb.UnroutableCIDs(); n != 0 {
+		t.Errorf("%d unroutable CIDs counted by lookups", n)
+	}
+	if n := len(qlb.CIDMappings()); n != 0 {
+		t.Errorf("%d CIDs remembered by lookups", n)
+	}
+	if n := store.calls.Load(); n != 0 {
+		t.Errorf("%d store calls made by lookups", n)
+	}
+
+	routed, err := qlb.RouteByConnectionID(unroutable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routed != looked {
+		t.Errorf("lookup answered %s, routing chose %s", looked.URL, routed.URL)
+	}
+	if n := qlb.UnroutableCIDs(); n != 1 {
+		t.Errorf("%d unroutable CIDs counted after routing, want 1", n)
+	}
+}
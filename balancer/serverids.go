@@ -0,0 +1,296 @@
+package balancer
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/quiclb"
+)
+
+// ServerIDEntry is the QUIC-LB server ID assigned to one backend of a pool
+type ServerIDEntry struct {
+	Pool       string    `json:"pool"`
+	URL        string    `json:"url"`
+	ID         uint16    `json:"id"`
+	Pinned     bool      `json:"pinned,omitempty"` // Set by configuration rather than allocated
+	Active     bool      `json:"active"`           // The backend is configured; inactive entries keep the ID for its return
+	AssignedAt time.Time `json:"assigned_at"`
+	ReleasedAt time.Time `json:"released_at"`
+}
+
+// key identifies the backend the entry belongs to
+func (e *ServerIDEntry) key() string {
+	return e.Pool + "\x00" + e.URL
+}
+
+// ServerIDRegistry allocates QUIC-LB server IDs to backends and remembers
+// them, so a backend keeps its ID across configuration changes and, when
+// saved, restarts: connection IDs already issued keep routing to it. A
+// released ID goes to another backend only when no unused ID is left, the
+// longest released first, and never while it is pinned for another URL.
+type ServerIDRegistry struct {
+	mu         sync.Mutex
+	capacity   int
+	pins       map[string]uint16 // backend URL -> pinned ID
+	pinnedIDs  map[uint16]string // pinned ID -> backend URL
+	entries    map[string]*ServerIDEntry
+	byID       map[uint16]*ServerIDEntry
+	onChange   func()
+	collisions atomic.Int64
+}
+
+// NewServerIDRegistry creates an empty registry for server IDs of
+// serverIDLen bytes
+func NewServerIDRegistry(serverIDLen uint8) *ServerIDRegistry {
+	return &ServerIDRegistry{
+		capacity:  quiclb.ServerIDCapacity(serverIDLen),
+		pins:      make(map[string]uint16),
+		pinnedIDs: make(map[uint16]string),
+		entries:   make(map[string]*ServerIDEntry),
+		byID:      make(map[uint16]*ServerIDEntry),
+	}
+}
+
+// Capacity returns the largest server ID the registry allocates
+func (r *ServerIDRegistry) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capacity
+}
+
+// CheckFits reports an error when an active backend's ID or a pinned ID
+// cannot be encoded in server IDs of serverIDLen bytes
+func (r *ServerIDRegistry) CheckFits(serverIDLen uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkFits(serverIDLen)
+}
+
+// checkFits implements CheckFits; callers hold mu
+func (r *ServerIDRegistry) checkFits(serverIDLen uint8) error {
+	capacity := quiclb.ServerIDCapacity(serverIDLen)
+	var tooLarge []string
+	for _, entry := range r.entries {
+		if entry.Active && int(entry.ID) > capacity {
+			tooLarge = append(tooLarge, fmt.Sprintf("%d (%s)", entry.ID, entry.URL))
+		}
+	}
+	for id, url := range r.pinnedIDs {
+		if int(id) > capacity && (r.byID[id] == nil || !r.byID[id].Active) {
+			tooLarge = append(tooLarge, fmt.Sprintf("%d (pinned for %s)", id, url))
+		}
+	}
+	if len(tooLarge) > 0 {
+		slices.Sort(tooLarge)
+		return fmt.Errorf("%d-byte server IDs hold IDs up to %d, but server IDs %s are in use", serverIDLen, capacity, strings.Join(tooLarge, ", "))
+	}
+	return nil
+}
+
+// Resize switches the registry to server IDs of serverIDLen bytes. It
+// fails, changing nothing, when an active or pinned ID would not fit; a
+// released ID that no longer fits is replaced when its backend returns.
+func (r *ServerIDRegistry) Resize(serverIDLen uint8) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkFits(serverIDLen); err != nil {
+		return err
+	}
+	r.capacity = quiclb.ServerIDCapacity(serverIDLen)
+	return nil
+}
+
+// SetPins replaces the pinned IDs, backend URL to ID. Pins apply when a
+// backend is next assigned an ID.
+func (r *ServerIDRegistry) SetPins(pins map[string]uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pins = make(map[string]uint16, len(pins))
+	r.pinnedIDs = make(map[uint16]string, len(pins))
+	for url, id := range pins {
+		r.pins[url] = id
+		r.pinnedIDs[id] = url
+	}
+}
+
+// SetOnChange installs fn, called after every assignment or release, e.g.
+// to save the entries
+func (r *ServerIDRegistry) SetOnChange(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = fn
+}
+
+// Load restores saved entries as inactive, so their backends get their IDs
+// back. Entries beyond the capacity are skipped; entries whose backend or
+// ID is already known are skipped as collisions. It returns how many were
+// restored.
+func (r *ServerIDRegistry) Load(entries []ServerIDEntry) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	restored := 0
+	for _, saved := range entries {
+		if saved.ID == 0 || int(saved.ID) > r.capacity {
+			log.Printf("⚠️ Saved server ID %d of %s [%s] does not fit the current server ID length; dropped", saved.ID, saved.URL, saved.Pool)
+			continue
+		}
+		if other := r.byID[saved.ID]; other != nil || r.entries[saved.key()] != nil {
+			r.collisions.Add(1)
+			log.Printf("⚠️ Server ID collision: saved ID %d of %s [%s] is already taken; dropped", saved.ID, saved.URL, saved.Pool)
+			continue
+		}
+		entry := saved
+		entry.Active = false
+		if entry.ReleasedAt.IsZero() {
+			entry.ReleasedAt = time.Now()
+		}
+		r.entries[entry.key()] = &entry
+		r.byID[entry.ID] = &entry
+		restored++
+	}
+	return restored
+}
+
+// Assign returns the server ID of the backend url in pool: its pinned ID,
+// the ID it had before, or a new one
+func (r *ServerIDRegistry) Assign(pool, url string) (uint16, error) {
+	r.mu.Lock()
+	id, err := r.assign(pool, url)
+	onChange := r.onChange
+	r.mu.Unlock()
+	if err == nil && onChange != nil {
+		onChange()
+	}
+	return id, err
+}
+
+// assign implements Assign; callers hold mu
+func (r *ServerIDRegistry) assign(pool, url string) (uint16, error) {
+	key := pool + "\x00" + url
+	now := time.Now()
+	entry := r.entries[key]
+
+	if pin, ok := r.pins[url]; ok {
+		if int(pin) > r.capacity {
+			return 0, fmt.Errorf("server ID %d pinned for %s exceeds the %d server IDs available", pin, url, r.capacity)
+		}
+		if other := r.byID[pin]; other != nil && other != entry {
+			if other.Active {
+				r.collisions.Add(1)
+				return 0, fmt.Errorf("server ID %d pinned for %s is in use by %s in pool %s", pin, url, other.URL, other.Pool)
+			}
+			// The pin takes the ID from a backend that is gone
+			r.remove(other)
+		}
+		if entry != nil && entry.ID != pin {
+			r.remove(entry)
+			entry = nil
+		}
+		if entry == nil {
+			entry = &ServerIDEntry{Pool: pool, URL: url, ID: pin, AssignedAt: now}
+			r.entries[key] = entry
+			r.byID[pin] = entry
+		}
+		entry.Pinned = true
+		entry.Active = true
+		entry.ReleasedAt = time.Time{}
+		return pin, nil
+	}
+
+	if entry != nil && int(entry.ID) > r.capacity {
+		// Released under a longer server ID length
+		r.remove(entry)
+		entry = nil
+	}
+	if entry != nil {
+		if owner, pinned := r.pinnedIDs[entry.ID]; !pinned || owner == url {
+			entry.Pinned = false
+			entry.Active = true
+			entry.ReleasedAt = time.Time{}
+			return entry.ID, nil
+		}
+		// Its ID has been pinned for another backend since
+		r.remove(entry)
+	}
+
+	id, err := r.allocate()
+	if err != nil {
+		return 0, err
+	}
+	entry = &ServerIDEntry{Pool: pool, URL: url, ID: id, Active: true, AssignedAt: now}
+	r.entries[key] = entry
+	r.byID[id] = entry
+	return id, nil
+}
+
+// allocate returns the lowest ID never assigned, or else the one released
+// the longest ago, removing its entry; callers hold mu
+func (r *ServerIDRegistry) allocate() (uint16, error) {
+	for id := 1; id <= r.capacity; id++ {
+		if r.byID[uint16(id)] == nil && r.pinnedIDs[uint16(id)] == "" {
+			return uint16(id), nil
+		}
+	}
+	var oldest *ServerIDEntry
+	for _, entry := range r.entries {
+		if entry.Active || r.pinnedIDs[entry.ID] != "" || int(entry.ID) > r.capacity {
+			continue
+		}
+		if oldest == nil || entry.ReleasedAt.Before(oldest.ReleasedAt) {
+			oldest = entry
+		}
+	}
+	if oldest == nil {
+		return 0, fmt.Errorf("all %d server IDs are in use", r.capacity)
+	}
+	r.remove(oldest)
+	return oldest.ID, nil
+}
+
+// remove forgets an entry; callers hold mu
+func (r *ServerIDRegistry) remove(entry *ServerIDEntry) {
+	delete(r.entries, entry.key())
+	if r.byID[entry.ID] == entry {
+		delete(r.byID, entry.ID)
+	}
+}
+
+// ReleaseID marks the backend holding id as gone; the ID stays reserved for
+// it until needed for another backend
+func (r *ServerIDRegistry) ReleaseID(id uint16) {
+	r.mu.Lock()
+	entry := r.byID[id]
+	released := entry != nil && entry.Active
+	if released {
+		entry.Active = false
+		entry.ReleasedAt = time.Now()
+	}
+	onChange := r.onChange
+	r.mu.Unlock()
+	if released && onChange != nil {
+		onChange()
+	}
+}
+
+// Entries returns a copy of every entry, by ID
+func (r *ServerIDRegistry) Entries() []ServerIDEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]ServerIDEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b ServerIDEntry) int { return int(a.ID) - int(b.ID) })
+	return entries
+}
+
+// Collisions returns how many assignments and restored entries were
+// refused because their ID was taken
+func (r *ServerIDRegistry) Collisions() int64 {
+	return r.collisions.Load()
+}
@@ -0,0 +1,90 @@
+package balancer
+
+import (
+	"strings"
+	"testing"
+
+	"quic-moodle/quiclb"
+)
+
+// Shrinking to 1-byte server IDs is refused while an active or pinned ID
+// needs two bytes, and leaves the registry as it was
+func TestServerIDRegistryResizeRefused(t *testing.T) {
+	r := NewServerIDRegistry(2)
+	r.SetPins(map[string]uint16{"http://a:8080": 300})
+	if _, err := r.Assign("default", "http://a:8080"); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Resize(1)
+	if err == nil || !strings.Contains(err.Error(), "300 (http://a:8080)") {
+		t.Errorf("Resize(1) with active ID 300: %v", err)
+	}
+	if c := r.Capacity(); c != 65535 {
+		t.Errorf("capacity %d after a refused resize, want 65535", c)
+	}
+
+	// A pin no backend holds yet still has to fit
+	r.ReleaseID(300)
+	r.SetPins(map[string]uint16{"http://b:8080": 400})
+	if err := r.Resize(1); err == nil || !strings.Contains(err.Error(), "400 (pinned for http://b:8080)") {
+		t.Errorf("Resize(1) with pinned ID 400: %v", err)
+	}
+}
+
+// An ID released under 2-byte server IDs that no longer fits after
+// shrinking is replaced when its backend returns
+func TestServerIDRegistryResizeReplacesReleased(t *testing.T) {
+	r := NewServerIDRegistry(2)
+	r.SetPins(map[string]uint16{"http://a:8080": 300})
+	if _, err := r.Assign("default", "http://a:8080"); err != nil {
+		t.Fatal(err)
+	}
+	r.SetPins(nil)
+	r.ReleaseID(300)
+	if err := r.Resize(1); err != nil {
+		t.Fatalf("Resize(1) with only a released ID too large: %v", err)
+	}
+	id, err := r.Assign("default", "http://a:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 300 || int(id) > r.Capacity() {
+		t.Errorf("returning backend got ID %d, want a new one up to %d", id, r.Capacity())
+	}
+	if entries := r.Entries(); len(entries) != 1 || entries[0].ID != id {
+		t.Errorf("entries %+v, want only the new ID", entries)
+	}
+}
+
+// A config with shorter server IDs cannot be installed or activated while
+// a backend's ID would not fit it
+func TestQUICLBServerIDLenChecked(t *testing.T) {
+	qlb := newTestQUICLB(t)
+	installed := &quiclb.Config{Algorithm: "plaintext", ConfigRotationBits: 2, ServerIDLen: 1, ConnectionIDLen: 8}
+	if err := qlb.AddConfig(installed); err != nil {
+		t.Fatal(err)
+	}
+	qlb.ServerIDs().SetPins(map[string]uint16{"http://a:8080": 300})
+	if _, err := qlb.ServerIDs().Assign("default", "http://a:8080"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := qlb.AddConfig(&quiclb.Config{Algorithm: "plaintext", ConfigRotationBits: 3, ServerIDLen: 1, ConnectionIDLen: 8}); err == nil {
+		t.Error("1-byte server ID config installed while ID 300 is active")
+	}
+	if err := qlb.SetActiveConfig(2); err == nil {
+		t.Error("1-byte server ID config activated while ID 300 is active")
+	}
+	if bits, c := qlb.ActiveConfigBits(), qlb.ServerIDs().Capacity(); bits != 1 || c != 65535 {
+		t.Errorf("config %d with capacity %d after a refused activation, want 1 and 65535", bits, c)
+	}
+
+	qlb.ServerIDs().SetPins(nil)
+	qlb.ServerIDs().ReleaseID(300)
+	if err := qlb.SetActiveConfig(2); err != nil {
+		t.Fatal(err)
+	}
+	if c := qlb.ServerIDs().Capacity(); c != 255 {
+		t.Errorf("capacity %d after activating 1-byte server IDs, want 255", c)
+	}
+}
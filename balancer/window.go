@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// RateWindow is how far back backend request and error rates look
+const RateWindow = 5 * time.Minute
+
+// windowBuckets is the number of one-second buckets in RateWindow
+const windowBuckets = int(RateWindow / time.Second)
+
+// WindowCounter counts events over the last RateWindow in per-second
+// buckets, so its memory stays fixed however many events arrive. A bucket
+// is reused once its second has left the window.
+type WindowCounter struct {
+	mu      sync.Mutex
+	seconds [windowBuckets]int64 // Unix second each bucket counts
+	counts  [windowBuckets]int64
+}
+
+// Add counts one event now
+func (wc *WindowCounter) Add() {
+	wc.add(time.Now().Unix())
+}
+
+func (wc *WindowCounter) add(second int64) {
+	i := int(second % int64(windowBuckets))
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.seconds[i] != second {
+		wc.seconds[i] = second
+		wc.counts[i] = 0
+	}
+	wc.counts[i]++
+}
+
+// Count returns the events of the last RateWindow
+func (wc *WindowCounter) Count() int64 {
+	cutoff := time.Now().Unix() - int64(windowBuckets)
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	var total int64
+	for i, second := range wc.seconds {
+		if second > cutoff {
+			total += wc.counts[i]
+		}
+	}
+	return total
+}
+
+// MarshalJSON writes the event count of the window
+func (wc *WindowCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wc.Count())
+}
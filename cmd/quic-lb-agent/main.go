@@ -0,0 +1,348 @@
+// Command quic-lb-agent runs next to a Moodle or QUIC backend. It registers
+// the backend with a pool of the load balancer, writes the server ID and
+// QUIC-LB configs the backend needs to issue routable connection IDs, and
+// reports the backend's health and load until it is stopped, when it takes
+// the backend out of the pool.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"quic-moodle/internal/atomicfile"
+)
+
+// errNotRegistered means the load balancer forgot the agent, e.g. after a
+// restart, and it has to register again
+var errNotRegistered = errors.New("not registered")
+
+// agent talks to the admin API of the load balancer
+type agent struct {
+	lb       string
+	token    string
+	client   *http.Client
+	name     string
+	pool     string
+	url      string
+	health   string
+	maxLoad  float64
+	out      string
+	onChange string
+
+	registration registration
+}
+
+// registration is the answer to POST /api/agents/register
+type registration struct {
+	ServerID       int               `json:"server_id"`
+	Pool           string            `json:"pool"`
+	URL            string            `json:"url"`
+	ActiveConfig   uint8             `json:"active_config"`
+	Configs        []json.RawMessage `json:"configs"`
+	ReportInterval string            `json:"report_interval"`
+}
+
+// report is the body of POST /api/agents/report
+type report struct {
+	Pool       string  `json:"pool"`
+	URL        string  `json:"url"`
+	Healthy    bool    `json:"healthy"`
+	Reason     string  `json:"reason,omitempty"`
+	Load1      float64 `json:"load1"`
+	CPUs       int     `json:"cpus"`
+	MemoryUsed float64 `json:"memory_used_percent"`
+}
+
+func main() {
+	lb := flag.String("lb", "http://127.0.0.1:9444", "admin API URL of the load balancer")
+	tokenRef := flag.String("token-file", "", "file holding an admin API key with the agent scope (default $QUIC_LB_AGENT_TOKEN)")
+	caFile := flag.String("ca", "", "CA bundle of the admin API certificate (default the system roots)")
+	pool := flag.String("pool", "default", "pool the backend joins")
+	backendURL := flag.String("url", "", "backend URL as the load balancer reaches it, e.g. http://10.0.0.5:8080 (required)")
+	name := flag.String("name", "", "name shown by the load balancer (default the host name)")
+	health := flag.String("health", "", "local URL probed before each report; a 2xx or 3xx answer is healthy (default only load is checked)")
+	maxLoad := flag.Float64("max-load", 0, "report unhealthy while the 1-minute load per CPU exceeds this (0 disables)")
+	out := flag.String("out", "quic-lb-agent.json", "file the server ID and QUIC-LB configs are written to")
+	onChange := flag.String("on-change", "", "command run through sh after the QUIC-LB configs or server ID changed, e.g. a reload of the backend")
+	flag.Parse()
+
+	if *backendURL == "" {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb-agent -url <backend URL> [-lb <admin URL>] [-pool default] [-out file]")
+		os.Exit(2)
+	}
+	token := os.Getenv("QUIC_LB_AGENT_TOKEN")
+	if *tokenRef != "" {
+		data, err := os.ReadFile(*tokenRef)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("❌ no certificates in %s", *caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	a := &agent{
+		lb:       strings.TrimSuffix(*lb, "/"),
+		token:    token,
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		name:     *name,
+		pool:     *pool,
+		url:      *backendURL,
+		health:   *health,
+		maxLoad:  *maxLoad,
+		out:      *out,
+		onChange: *onChange,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	a.run(ctx)
+
+	// Leave the pool so requests stop before the backend does
+	if a.registration.URL != "" {
+		if err := a.post("/api/agents/deregister", map[string]string{"name": a.name, "pool": a.pool, "url": a.registration.URL}, nil); err != nil {
+			log.Printf("⚠️ Deregistration failed, the load balancer drops the backend when its registration expires: %v", err)
+		} else {
+			log.Printf("🛰️ Deregistered from pool %s", a.pool)
+		}
+	}
+}
+
+// run registers and reports until ctx is done, registering again whenever
+// the load balancer forgot the agent or rotated its QUIC-LB config
+func (a *agent) run(ctx context.Context) {
+	backoff := time.Second
+	registered := false
+	for ctx.Err() == nil {
+		if !registered {
+			if err := a.register(); err != nil {
+				log.Printf("⚠️ Registration failed, retrying in %v: %v", backoff, err)
+				if !sleep(ctx, backoff) {
+					return
+				}
+				backoff = min(2*backoff, 30*time.Second)
+				continue
+			}
+			registered, backoff = true, time.Second
+		}
+
+		interval, err := time.ParseDuration(a.registration.ReportInterval)
+		if err != nil || interval <= 0 {
+			interval = 10 * time.Second
+		}
+		if !sleep(ctx, interval) {
+			return
+		}
+
+		active, err := a.report()
+		switch {
+		case errors.Is(err, errNotRegistered):
+			log.Printf("🛰️ The load balancer forgot this backend, registering again")
+			registered = false
+		case err != nil:
+			log.Printf("⚠️ Report failed: %v", err)
+		case active != a.registration.ActiveConfig:
+			log.Printf("🔑 QUIC-LB config rotated to %d, fetching it", active)
+			registered = false
+		}
+	}
+}
+
+// register joins the pool and writes the server ID and QUIC-LB configs,
+// running the change command when they changed
+func (a *agent) register() error {
+	var reg registration
+	if err := a.post("/api/agents/register", map[string]string{"name": a.name, "pool": a.pool, "url": a.url}, &reg); err != nil {
+		return err
+	}
+	previous := a.registration
+	a.registration = reg
+	log.Printf("🛰️ Registered %s in pool %s as server ID %d (QUIC-LB config %d)", reg.URL, reg.Pool, reg.ServerID, reg.ActiveConfig)
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"server_id":     reg.ServerID,
+		"active_config": reg.ActiveConfig,
+		"configs":       reg.Configs,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	old, _ := os.ReadFile(a.out)
+	if bytes.Equal(old, append(data, '\n')) && previous.URL != "" {
+		return nil
+	}
+	if err := atomicfile.WriteFile(a.out, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", a.out, err)
+	}
+	if a.onChange != "" {
+		cmd := exec.Command("sh", "-c", a.onChange)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("⚠️ %q failed: %v", a.onChange, err)
+		}
+	}
+	return nil
+}
+
+// report sends the backend's health and load and returns the active
+// QUIC-LB config
+func (a *agent) report() (uint8, error) {
+	r := report{
+		Pool:    a.pool,
+		URL:     a.registration.URL,
+		Healthy: true,
+		CPUs:    runtime.NumCPU(),
+	}
+	r.Load1, _ = loadAverage()
+	r.MemoryUsed, _ = memoryUsed()
+	if a.maxLoad > 0 && r.Load1/float64(r.CPUs) > a.maxLoad {
+		r.Healthy, r.Reason = false, fmt.Sprintf("load %.2f over %.2f per CPU", r.Load1, a.maxLoad)
+	}
+	if a.health != "" && r.Healthy {
+		if err := probe(a.health); err != nil {
+			r.Healthy, r.Reason = false, err.Error()
+		}
+	}
+
+	var answer struct {
+		ActiveConfig uint8 `json:"active_config"`
+	}
+	if err := a.post("/api/agents/report", r, &answer); err != nil {
+		return 0, err
+	}
+	return answer.ActiveConfig, nil
+}
+
+// post sends body as JSON to the admin API and decodes the answer into out
+func (a *agent) post(path string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.lb+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && path == "/api/agents/report" {
+		return errNotRegistered
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		return fmt.Errorf("%s: %s %s", path, resp.Status, strings.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// probe checks the backend's local health URL
+func probe(url string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// loadAverage returns the 1-minute load average from /proc/loadavg
+func loadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// memoryUsed returns the share of memory in use from /proc/meminfo
+func memoryUsed() (float64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var total, available float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, _ := strconv.ParseFloat(fields[1], 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = value
+		case "MemAvailable:":
+			available = value
+		}
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+	return 100 * (total - available) / total, nil
+}
+
+// sleep waits for d and reports false when ctx ended first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// benchClient is one simulated client: its own transport, so its own TCP
+// or QUIC connection, and the connection ID the load balancer handed it
+type benchClient struct {
+	http *http.Client
+	mu   sync.Mutex
+	cid  string
+}
+
+// benchResult is the outcome of one request
+type benchResult struct {
+	latency time.Duration
+	status  int // 0 when the request failed before a response
+	proto   string
+	err     string
+}
+
+// runBench implements the `bench` subcommand. It sends requests at a fixed
+// rate over HTTP/1.1, HTTP/2 or HTTP/3 and prints latency percentiles and
+// error rates, so performance changes can be measured against a running
+// load balancer.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("url", "", "URL to request, e.g. https://localhost:8443/ (required)")
+	proto := fs.String("proto", "h3", "protocol: h1, h2 or h3")
+	rps := fs.Int("rps", 100, "requests started per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	connections := fs.Int("connections", 10, "simulated clients, each with its own connection")
+	concurrency := fs.Int("concurrency", 100, "requests in flight at most; requests due while all are busy are counted as dropped")
+	cidMode := fs.String("cid", "", "X-Quic-Connection-Id to send: \"\" none, \"echo\" the one the load balancer assigned the client over HTTP/3 (needs response_headers.expose_internal to include it), \"random\" a new random one per request")
+	cidLen := fs.Int("cid-len", 8, "bytes of random connection IDs")
+	method := fs.String("method", http.MethodGet, "request method")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each request")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification, e.g. against -dev-tls")
+	var headers headerFlags
+	fs.Var(&headers, "H", "extra request header \"Name: value\", repeatable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || *rps <= 0 || *duration <= 0 || *connections <= 0 || *concurrency <= 0 ||
+		!slices.Contains([]string{"h1", "h2", "h3"}, *proto) || !slices.Contains([]string{"", "echo", "random"}, *cidMode) {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb bench -url <url> [-proto h1|h2|h3] [-rps 100] [-duration 10s] [-connections 10] [-concurrency 100] [-cid echo|random] [-insecure] [-H 'Name: value']")
+		return 2
+	}
+	if *proto != "h1" && !strings.HasPrefix(*target, "https://") {
+		fmt.Fprintf(os.Stderr, "❌ %s needs an https:// URL\n", *proto)
+		return 2
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	clients := make([]*benchClient, *connections)
+	for i := range clients {
+		clients[i] = &benchClient{http: &http.Client{
+			Transport: benchTransport(*proto, tlsConfig),
+			Timeout:   *timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}}
+	}
+	defer func() {
+		for _, c := range clients {
+			if closer, ok := c.http.Transport.(io.Closer); ok {
+				closer.Close()
+			} else if t, ok := c.http.Transport.(*http.Transport); ok {
+				t.CloseIdleConnections()
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	fmt.Printf("🏁 %s %s over %s at %d rps for %v (%d clients, %d in flight at most)\n", *method, *target, *proto, *rps, *duration, *connections, *concurrency)
+
+	var (
+		resultsMu sync.Mutex
+		results   []benchResult
+		dropped   atomic.Int64
+		inFlight  = make(chan struct{}, *concurrency)
+		wg        sync.WaitGroup
+	)
+	send := func(client *benchClient) {
+		defer wg.Done()
+		defer func() { <-inFlight }()
+		result := client.do(*method, *target, headers, *cidMode, *cidLen)
+		resultsMu.Lock()
+		results = append(results, result)
+		resultsMu.Unlock()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(*rps))
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			select {
+			case inFlight <- struct{}{}:
+				wg.Add(1)
+				go send(clients[n%len(clients)])
+			default:
+				dropped.Add(1)
+			}
+			continue
+		}
+		break
+	}
+	sending := time.Since(start)
+	wg.Wait()
+
+	printBenchReport(results, dropped.Load(), sending)
+	return 0
+}
+
+// benchTransport returns a round tripper that only speaks proto
+func benchTransport(proto string, tlsConfig *tls.Config) http.RoundTripper {
+	switch proto {
+	case "h3":
+		return &http3.Transport{TLSClientConfig: tlsConfig.Clone()}
+	case "h2":
+		return &http.Transport{TLSClientConfig: tlsConfig.Clone(), ForceAttemptHTTP2: true, MaxConnsPerHost: 1}
+	default:
+		// A non-nil empty TLSNextProto turns HTTP/2 off
+		return &http.Transport{
+			TLSClientConfig:     tlsConfig.Clone(),
+			TLSNextProto:        map[string]func(string, *tls.Conn) http.RoundTripper{},
+			MaxIdleConnsPerHost: 100,
+		}
+	}
+}
+
+// do sends one request and reads the whole response
+func (c *benchClient) do(method, target string, headers headerFlags, cidMode string, cidLen int) benchResult {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return benchResult{err: err.Error()}
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	switch cidMode {
+	case "echo":
+		c.mu.Lock()
+		if c.cid != "" {
+			req.Header.Set("X-Quic-Connection-Id", c.cid)
+		}
+		c.mu.Unlock()
+	case "random":
+		cid := make([]byte, cidLen)
+		rand.Read(cid)
+		req.Header.Set("X-Quic-Connection-Id", hex.EncodeToString(cid))
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(start), err: benchError(err)}
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result := benchResult{latency: time.Since(start), status: resp.StatusCode, proto: resp.Proto}
+	if err != nil {
+		result.err = benchError(err)
+	}
+	if cid := resp.Header.Get("X-Quic-Connection-Id"); cid != "" && cidMode == "echo" {
+		c.mu.Lock()
+		c.cid = cid
+		c.mu.Unlock()
+	}
+	return result
+}
+
+// benchError returns err without the method and URL, so errors can be counted
+func benchError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return err.Error()
+}
+
+// printBenchReport prints throughput, latency percentiles, status codes and errors
+func printBenchReport(results []benchResult, dropped int64, sending time.Duration) {
+	total := len(results)
+	if total == 0 {
+		fmt.Printf("❌ No requests completed (%d dropped)\n", dropped)
+		return
+	}
+
+	latencies := make([]time.Duration, total)
+	statuses := make(map[string]int)
+	protos := make(map[string]int)
+	errs := make(map[string]int)
+	failed := 0
+	for i, r := range results {
+		latencies[i] = r.latency
+		if r.status != 0 {
+			statuses[fmt.Sprint(r.status)]++
+			protos[r.proto]++
+		}
+		if r.err != "" {
+			errs[r.err]++
+		}
+		if r.err != "" || r.status >= 500 {
+			failed++
+		}
+	}
+	slices.Sort(latencies)
+	percentile := func(p float64) time.Duration {
+		return latencies[min(int(float64(total)*p), total-1)].Round(time.Microsecond)
+	}
+
+	fmt.Printf("📊 %d requests in %v, %.1f rps, %d dropped\n", total, sending.Round(time.Millisecond), float64(total)/sending.Seconds(), dropped)
+	fmt.Printf("   latency p50 %v  p90 %v  p99 %v  p99.9 %v  max %v\n", percentile(0.50), percentile(0.90), percentile(0.99), percentile(0.999), latencies[total-1].Round(time.Microsecond))
+	fmt.Printf("   errors %d (%.2f%%, failed requests and 5xx)\n", failed, 100*float64(failed)/float64(total))
+	fmt.Printf("   status %s\n", formatCounts(statuses))
+	fmt.Printf("   protocols %s\n", formatCounts(protos))
+	if len(errs) > 0 {
+		fmt.Println("   request errors:")
+		for _, e := range sortedKeys(errs) {
+			fmt.Printf("   • %dx %s\n", errs[e], e)
+		}
+	}
+}
+
+// formatCounts formats counts as "key=count" pairs in key order
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(counts))
+	for _, k := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, counts[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// headerFlags collects repeated -H flags
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q is not \"Name: value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
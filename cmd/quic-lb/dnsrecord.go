@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"quic-moodle/server"
+)
+
+// runDNSRecord implements the `dns-record` subcommand. It prints the DNS
+// HTTPS records matching the Alt-Svc advertisement of a config so clients
+// can use HTTP/3 from their first connection.
+func runDNSRecord(args []string) int {
+	fs := flag.NewFlagSet("dns-record", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the JSON config file (defaults to the built-in config)")
+	name := fs.String("name", "", "DNS name clients connect to, e.g. moodle.example.com (required)")
+	ttl := fs.Int("ttl", 3600, "TTL of the records in seconds")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" || *ttl < 0 {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb dns-record -name <host> [-config <file>] [-ttl 3600]")
+		return 2
+	}
+
+	cfg := server.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = server.LoadConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ invalid configuration: %v\n", err)
+		return 1
+	}
+
+	for _, record := range cfg.HTTPSRecords(*name, *ttl) {
+		fmt.Println(record)
+	}
+	return 0
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"quic-moodle/quiclb"
+	"quic-moodle/server"
+)
+
+// stubBackend is a backend that names itself in every answer, started
+// in-process or a `quic-lb stub` reached at url
+type stubBackend struct {
+	index  int
+	url    string
+	server *http.Server // nil for a stub the harness did not start
+}
+
+// interopEnv is the load balancer under test, its stub backends and the
+// codec the checks decode its connection IDs with
+type interopEnv struct {
+	lbAddr    *net.UDPAddr
+	tlsConfig *tls.Config
+	encoder   *quiclb.Encoder
+	backends  []*stubBackend
+	clients   int
+	timeout   time.Duration
+	vectors   string
+}
+
+// interopCheck is one assertion about the load balancer
+type interopCheck struct {
+	name string
+	run  func(*interopEnv) error
+}
+
+// quicLBVector is one entry of a -vectors file: a QUIC-LB config, a
+// connection ID and the server ID and nonce it must decode to, as listed
+// in the appendix of the QUIC-LB draft
+type quicLBVector struct {
+	Algorithm          string `json:"algorithm"` // "plaintext", "stream-cipher" or "block-cipher"
+	ConfigRotationBits uint8  `json:"config_rotation_bits"`
+	ServerIDLen        uint8  `json:"server_id_len"`
+	NonceLen           uint8  `json:"nonce_len"`
+	Key                string `json:"key,omitempty"` // hex
+	CID                string `json:"cid"`           // hex
+	ServerID           string `json:"server_id"`     // hex
+	Nonce              string `json:"nonce,omitempty"`
+}
+
+// interopChecks are the checks of the interop subcommand and its test, in
+// order
+var interopChecks = []interopCheck{
+	{"http3 requests reach every backend", checkSpread},
+	{"connection IDs decode to the backend that answered", checkCIDDecode},
+	{"requests carrying a connection ID stay on its backend", checkCIDRouting},
+	{"a migrated connection keeps its backend", checkMigration},
+	{"codec round trip for every algorithm", checkCodecRoundTrip},
+	{"QUIC-LB test vectors", checkVectors},
+}
+
+// runInterop implements the `interop` subcommand. It starts a load
+// balancer in-process in front of stub backends, its own or running ones
+// such as containers, drives HTTP/3 clients through it over real QUIC
+// connections and checks connection ID routing, connection migration and
+// QUIC-LB codec interop, exiting non-zero when a check fails.
+func runInterop(args []string) int {
+	fs := flag.NewFlagSet("interop", flag.ContinueOnError)
+	backends := fs.Int("backends", 3, "stub backends started behind the load balancer")
+	backendURLs := fs.String("backend-urls", "", "comma-separated URLs of running `quic-lb stub` backends, in -index order, used instead of starting stubs")
+	clients := fs.Int("clients", 6, "HTTP/3 clients, each with its own QUIC connection")
+	algorithm := fs.String("algorithm", "plaintext", "QUIC-LB algorithm of the load balancer: plaintext, stream-cipher or block-cipher")
+	vectors := fs.String("vectors", "", "JSON file of QUIC-LB test vectors (config, cid, server_id, nonce) the codec must decode")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each check")
+	verbose := fs.Bool("v", false, "show the load balancer's log")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var urls []string
+	if *backendURLs != "" {
+		urls = strings.Split(*backendURLs, ",")
+		*backends = len(urls)
+	}
+	if *backends < 2 || *clients < 1 || !slices.Contains([]string{"plaintext", "stream-cipher", "block-cipher"}, *algorithm) {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb interop [-backends 3 | -backend-urls url,url,...] [-clients 6] [-algorithm plaintext|stream-cipher|block-cipher] [-vectors file] [-v]")
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	env, stop, err := startInterop(*backends, *algorithm, urls)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	defer stop()
+	env.clients, env.timeout, env.vectors = *clients, *timeout, *vectors
+
+	fmt.Printf("🧪 %d stub backends behind %s (QUIC-LB %s)\n", len(env.backends), env.lbAddr, *algorithm)
+	failed := 0
+	for _, check := range interopChecks {
+		start := time.Now()
+		err := check.run(env)
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Printf("⏭️  %s: %v\n", check.name, err)
+		case err != nil:
+			failed++
+			fmt.Printf("❌ %s: %v\n", check.name, err)
+		default:
+			fmt.Printf("✅ %s (%v)\n", check.name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("❌ %d of %d checks failed\n", failed, len(interopChecks))
+		return 1
+	}
+	fmt.Printf("✅ All checks passed\n")
+	return 0
+}
+
+// errSkipped marks a check that had nothing to check
+var errSkipped = errors.New("skipped")
+
+// startInterop starts a load balancer on loopback ports in front of the
+// stubs at backendURLs, or of as many stubs of its own as backends, and
+// returns a function stopping them
+func startInterop(backends int, algorithm string, backendURLs []string) (*interopEnv, func(), error) {
+	env := &interopEnv{
+		tlsConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+	}
+	var stops []func()
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	cfg := server.DefaultConfig()
+	cfg.Backends = nil
+	for i, url := range backendURLs {
+		env.backends = append(env.backends, &stubBackend{index: i, url: url})
+	}
+	for i := len(env.backends); i < backends; i++ {
+		backend, err := startStubBackend(i)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		stops = append(stops, func() { backend.server.Close() })
+		env.backends = append(env.backends, backend)
+	}
+	for _, backend := range env.backends {
+		cfg.Backends = append(cfg.Backends, server.BackendConfig{URL: backend.url})
+	}
+
+	cfg.Server.ListenAddr = "127.0.0.1:0"
+	cfg.Server.HTTPListenAddr = ""
+	cfg.Admin.ListenAddr = "127.0.0.1:0"
+	cfg.LoadBalancer.Algorithm = "round-robin"
+	// The checks read the routing decision from the internal headers
+	cfg.ResponseHeaders.DebugClients = []string{"127.0.0.1"}
+	settings := server.QUICLBSettings{Algorithm: algorithm, ConfigRotationBits: 1, ServerIDLen: 2, ConnectionIDLen: 8}
+	var key []byte
+	switch algorithm {
+	case "stream-cipher":
+		settings.NonceLen, settings.ConnectionIDLen = 8, 11
+	case "block-cipher":
+		settings.NonceLen, settings.ConnectionIDLen = 14, 17
+	}
+	if algorithm != "plaintext" {
+		key = make([]byte, 16)
+		rand.Read(key)
+		settings.KeyRef = "hex:" + hex.EncodeToString(key)
+	}
+	cfg.QUICLB = settings
+
+	var err error
+	if algorithm == "plaintext" {
+		env.encoder = quiclb.NewPlaintext(settings.ConfigRotationBits, settings.ServerIDLen, settings.ConnectionIDLen)
+	} else if env.encoder, err = quiclb.NewEncrypted(algorithm, settings.ConfigRotationBits, settings.ServerIDLen, settings.ConnectionIDLen, settings.NonceLen, key); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	listeners := &server.Listeners{}
+	if listeners.TCP, err = net.Listen("tcp", cfg.Server.ListenAddr); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	if listeners.UDP, err = net.ListenPacket("udp", cfg.Server.ListenAddr); err != nil {
+		listeners.Close()
+		stop()
+		return nil, nil, err
+	}
+	if listeners.Admin, err = net.Listen("tcp", cfg.Admin.ListenAddr); err != nil {
+		listeners.Close()
+		stop()
+		return nil, nil, err
+	}
+	env.lbAddr = listeners.UDP.LocalAddr().(*net.UDPAddr)
+
+	srv, err := server.New(cfg, server.WithDevTLS(true), server.WithListeners(listeners))
+	if err != nil {
+		listeners.Close()
+		stop()
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	stops = append(stops, func() {
+		cancel()
+		<-done
+		srv.Close()
+	})
+
+	// Wait until the load balancer answers over HTTP/3
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		client := env.newClient()
+		resp, err := client.get("/", "", "")
+		client.close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return nil, nil, fmt.Errorf("load balancer did not answer over HTTP/3: %v", err)
+		}
+		select {
+		case err := <-done:
+			stop()
+			return nil, nil, fmt.Errorf("load balancer stopped: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return env, stop, nil
+}
+
+// startStubBackend serves answers naming backend index on a loopback port
+func startStubBackend(index int) (*stubBackend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	backend := &stubBackend{index: index, url: "http://" + ln.Addr().String(), server: &http.Server{Handler: stubHandler(index)}}
+	go backend.server.Serve(ln)
+	return backend, nil
+}
+
+// stubHandler answers every request naming stub backend index
+func stubHandler(index int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Stub-Backend", strconv.Itoa(index))
+		fmt.Fprintf(w, "stub backend %d\n", index)
+	})
+}
+
+// runStub implements the `stub` subcommand, a stub backend of the interop
+// checks run on its own, e.g. as a container
+func runStub(args []string) int {
+	fs := flag.NewFlagSet("stub", flag.ContinueOnError)
+	listen := fs.String("listen", ":8000", "address to serve HTTP on")
+	index := fs.Int("index", 0, "index the stub names itself with, its position in interop -backend-urls")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	log.Printf("🧪 Stub backend %d listening on %s", *index, *listen)
+	if err := http.ListenAndServe(*listen, stubHandler(*index)); err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	return 0
+}
+
+// interopClient is one HTTP/3 client with its own QUIC connection
+type interopClient struct {
+	env       *interopEnv
+	transport *http3.Transport
+	conn      *quic.Conn        // set by dial, nil for clients of newClient
+	h3        *http3.ClientConn // set by dial
+}
+
+// interopResponse is what the checks read from an answer
+type interopResponse struct {
+	StatusCode    int
+	Proto         string
+	Stub          string // index of the stub backend that answered
+	BackendID     string // the load balancer's ID of that backend
+	RoutingMethod string
+	CID           string // connection ID the load balancer handed out
+}
+
+// newClient returns a client that dials its connection on first use
+func (env *interopEnv) newClient() *interopClient {
+	return &interopClient{env: env, transport: &http3.Transport{TLSClientConfig: env.tlsConfig}}
+}
+
+// dial opens a QUIC connection over a UDP socket of its own, so the
+// connection can later migrate to another socket
+func (env *interopEnv) dial(ctx context.Context) (*interopClient, error) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	conn, err := tr.Dial(ctx, env.lbAddr, env.tlsConfig, &quic.Config{})
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	transport := &http3.Transport{TLSClientConfig: env.tlsConfig}
+	return &interopClient{env: env, transport: transport, conn: conn, h3: transport.NewClientConn(conn)}, nil
+}
+
+// get requests path, sending session as X-Session-ID and cid as
+// X-Quic-Connection-Id when set
+func (c *interopClient) get(path, session, cid string) (*interopResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+c.env.lbAddr.String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if session != "" {
+		req.Header.Set("X-Session-ID", session)
+	}
+	if cid != "" {
+		req.Header.Set("X-Quic-Connection-Id", cid)
+	}
+	var resp *http.Response
+	if c.h3 != nil {
+		resp, err = c.h3.RoundTrip(req)
+	} else {
+		resp, err = c.transport.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return &interopResponse{
+		StatusCode:    resp.StatusCode,
+		Proto:         resp.Proto,
+		Stub:          resp.Header.Get("X-Stub-Backend"),
+		BackendID:     resp.Header.Get("X-Backend-ID"),
+		RoutingMethod: resp.Header.Get("X-Routing-Method"),
+		CID:           resp.Header.Get("X-Quic-Connection-Id"),
+	}, nil
+}
+
+// close closes the client's connection
+func (c *interopClient) close() {
+	if c.conn != nil {
+		c.conn.CloseWithError(0, "")
+	}
+	c.transport.Close()
+}
+
+// firstRequests sends one request per client, each over its own connection
+// and with its own session, and returns the answers
+func (env *interopEnv) firstRequests() ([]*interopResponse, error) {
+	responses := make([]*interopResponse, env.clients)
+	for i := range responses {
+		client := env.newClient()
+		resp, err := client.get("/", fmt.Sprintf("interop-%d-%d", i, time.Now().UnixNano()), "")
+		client.close()
+		if err != nil {
+			return nil, fmt.Errorf("client %d: %v", i, err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Stub == "" {
+			return nil, fmt.Errorf("client %d: status %d from stub %q", i, resp.StatusCode, resp.Stub)
+		}
+		responses[i] = resp
+	}
+	return responses, nil
+}
+
+// checkSpread sends a request per client over HTTP/3 and expects every
+// backend to answer some
+func checkSpread(env *interopEnv) error {
+	responses, err := env.firstRequests()
+	if err != nil {
+		return err
+	}
+	answered := make(map[string]bool)
+	for _, resp := range responses {
+		if resp.Proto != "HTTP/3.0" {
+			return fmt.Errorf("answered over %s", resp.Proto)
+		}
+		answered[resp.Stub] = true
+	}
+	if env.clients < len(env.backends) {
+		return nil
+	}
+	for _, backend := range env.backends {
+		if !answered[strconv.Itoa(backend.index)] {
+			return fmt.Errorf("stub backend %d answered none of %d clients", backend.index, env.clients)
+		}
+	}
+	return nil
+}
+
+// checkCIDDecode decodes the connection IDs the load balancer handed out
+// with the harness's own codec
+func checkCIDDecode(env *interopEnv) error {
+	responses, err := env.firstRequests()
+	if err != nil {
+		return err
+	}
+	for i, resp := range responses {
+		if resp.CID == "" {
+			return fmt.Errorf("client %d got no X-Quic-Connection-Id", i)
+		}
+		raw, err := hex.DecodeString(resp.CID)
+		if err != nil {
+			return fmt.Errorf("client %d: connection ID %q: %v", i, resp.CID, err)
+		}
+		decoded, err := env.encoder.DecodeCID(raw)
+		if err != nil {
+			return fmt.Errorf("client %d: connection ID %s: %v", i, resp.CID, err)
+		}
+		if strconv.Itoa(int(decoded.BackendID)) != resp.BackendID {
+			return fmt.Errorf("client %d: connection ID %s decodes to backend %d, answered by backend %s", i, resp.CID, decoded.BackendID, resp.BackendID)
+		}
+	}
+	return nil
+}
+
+// checkCIDRouting replays each handed-out connection ID over new
+// connections with other sessions and expects the same backend every time
+func checkCIDRouting(env *interopEnv) error {
+	responses, err := env.firstRequests()
+	if err != nil {
+		return err
+	}
+	for i, first := range responses {
+		for n := range 3 {
+			client := env.newClient()
+			resp, err := client.get("/", fmt.Sprintf("replay-%d-%d-%d", i, n, time.Now().UnixNano()), first.CID)
+			client.close()
+			if err != nil {
+				return fmt.Errorf("client %d replay %d: %v", i, n, err)
+			}
+			if resp.RoutingMethod != "quic-lb-cid" {
+				return fmt.Errorf("client %d replay %d: routed by %q, not by connection ID", i, n, resp.RoutingMethod)
+			}
+			if resp.Stub != first.Stub {
+				return fmt.Errorf("client %d replay %d: connection ID %s reached stub %s, first answered by stub %s", i, n, first.CID, resp.Stub, first.Stub)
+			}
+		}
+	}
+	return nil
+}
+
+// checkMigration moves a live QUIC connection to a new client socket and
+// expects requests on it to keep reaching the same backend
+func checkMigration(env *interopEnv) error {
+	ctx, cancel := context.WithTimeout(context.Background(), env.timeout)
+	defer cancel()
+	client, err := env.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	session := fmt.Sprintf("migration-%d", time.Now().UnixNano())
+	before, err := client.get("/", session, "")
+	if err != nil {
+		return fmt.Errorf("before migration: %v", err)
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udp}
+	defer tr.Close()
+	path, err := client.conn.AddPath(tr)
+	if err != nil {
+		return fmt.Errorf("adding a path: %v", err)
+	}
+	if err := path.Probe(ctx); err != nil {
+		return fmt.Errorf("probing the new path: %v", err)
+	}
+	if err := path.Switch(); err != nil {
+		return fmt.Errorf("switching to the new path: %v", err)
+	}
+
+	after, err := client.get("/", session, before.CID)
+	if err != nil {
+		return fmt.Errorf("after migration: %v", err)
+	}
+	if client.conn.LocalAddr().String() != udp.LocalAddr().String() {
+		return fmt.Errorf("connection still sends from %s, not %s", client.conn.LocalAddr(), udp.LocalAddr())
+	}
+	if client.conn.Context().Err() != nil {
+		return fmt.Errorf("connection closed after migrating: %v", context.Cause(client.conn.Context()))
+	}
+	if after.Stub != before.Stub {
+		return fmt.Errorf("stub %s answered before migration, stub %s after", before.Stub, after.Stub)
+	}
+	return nil
+}
+
+// checkCodecRoundTrip encodes and decodes connection IDs with every
+// algorithm and a spread of lengths
+func checkCodecRoundTrip(*interopEnv) error {
+	key := make([]byte, 16)
+	rand.Read(key)
+	var encoders []*quiclb.Encoder
+	for sidLen := uint8(2); sidLen <= 6; sidLen += 2 {
+		encoders = append(encoders, quiclb.NewPlaintext(2, sidLen, sidLen+5))
+		for _, nonceLen := range []uint8{4, 8, 16 - sidLen} {
+			for _, algorithm := range []string{"stream-cipher", "block-cipher"} {
+				if algorithm == "stream-cipher" && nonceLen < 8 {
+					continue // the stream cipher needs 8-16 byte nonces
+				}
+				encoder, err := quiclb.NewEncrypted(algorithm, 2, sidLen, 1+sidLen+nonceLen, nonceLen, key)
+				if err != nil {
+					return fmt.Errorf("%s with server ID %d and nonce %d bytes: %v", algorithm, sidLen, nonceLen, err)
+				}
+				encoders = append(encoders, encoder)
+			}
+		}
+	}
+	for _, encoder := range encoders {
+		config := encoder.Config()
+		for _, backendID := range []uint16{0, 1, 255, 4096, 65535} {
+			cid := make([]byte, 20)
+			n, err := encoder.EncodeCIDInto(cid, uint64(backendID))
+			if err != nil {
+				return fmt.Errorf("%s (server ID %d, nonce %d bytes): encoding %d: %v", config.Algorithm, config.ServerIDLen, config.NonceLen, backendID, err)
+			}
+			decoded, err := encoder.DecodeCID(cid[:n])
+			if err != nil {
+				return fmt.Errorf("%s (server ID %d, nonce %d bytes): decoding %x: %v", config.Algorithm, config.ServerIDLen, config.NonceLen, cid[:n], err)
+			}
+			if decoded.BackendID != backendID {
+				return fmt.Errorf("%s (server ID %d, nonce %d bytes): %x decodes to %d, encoded %d", config.Algorithm, config.ServerIDLen, config.NonceLen, cid[:n], decoded.BackendID, backendID)
+			}
+		}
+	}
+	return nil
+}
+
+// checkVectors decodes the connection IDs of a -vectors file and compares
+// their server IDs and nonces
+func checkVectors(env *interopEnv) error {
+	if env.vectors == "" {
+		return fmt.Errorf("%w: no -vectors file", errSkipped)
+	}
+	data, err := os.ReadFile(env.vectors)
+	if err != nil {
+		return err
+	}
+	var vectors []quicLBVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		return fmt.Errorf("%s: %v", env.vectors, err)
+	}
+	if len(vectors) == 0 {
+		return fmt.Errorf("%w: %s lists no vectors", errSkipped, env.vectors)
+	}
+	for i, v := range vectors {
+		if err := v.check(); err != nil {
+			return fmt.Errorf("vector %d (%s, cid %s): %v", i, v.Algorithm, v.CID, err)
+		}
+	}
+	return nil
+}
+
+// check decodes the vector's connection ID and compares the result
+func (v quicLBVector) check() error {
+	cid, err := hex.DecodeString(v.CID)
+	if err != nil {
+		return fmt.Errorf("cid: %v", err)
+	}
+	key, err := hex.DecodeString(v.Key)
+	if err != nil {
+		return fmt.Errorf("key: %v", err)
+	}
+	var encoder *quiclb.Encoder
+	if v.Algorithm == "plaintext" {
+		encoder = quiclb.NewPlaintext(v.ConfigRotationBits, v.ServerIDLen, uint8(len(cid)))
+	} else if encoder, err = quiclb.NewEncrypted(v.Algorithm, v.ConfigRotationBits, v.ServerIDLen, uint8(len(cid)), v.NonceLen, key); err != nil {
+		return err
+	}
+	decoded, err := encoder.DecodeCID(cid)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(decoded.ServerID); got != v.ServerID {
+		return fmt.Errorf("server ID %s, want %s", got, v.ServerID)
+	}
+	if v.Nonce != "" {
+		if got := hex.EncodeToString(decoded.Nonce); got != v.Nonce {
+			return fmt.Errorf("nonce %s, want %s", got, v.Nonce)
+		}
+	}
+	return nil
+}
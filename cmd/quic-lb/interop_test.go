@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// vectorsFile holds the QUIC-LB draft 20 Appendix B vectors
+const vectorsFile = "testdata/quic-lb-vectors.json"
+
+func TestQUICLBVectors(t *testing.T) {
+	if err := checkVectors(&interopEnv{vectors: vectorsFile}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestInterop runs the interop checks against an in-process load balancer
+// and stub backends for every algorithm, over real QUIC connections on
+// loopback
+func TestInterop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts load balancers and QUIC clients")
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, algorithm := range []string{"plaintext", "stream-cipher", "block-cipher"} {
+		t.Run(algorithm, func(t *testing.T) {
+			env, stop, err := startInterop(3, algorithm, nil)
+			if err != nil {
+				t.Fatalf("starting: %v", err)
+			}
+			defer stop()
+			env.clients, env.timeout, env.vectors = 6, 10*time.Second, vectorsFile
+
+			for _, check := range interopChecks {
+				if err := check.run(env); err != nil {
+					t.Errorf("%s: %v", check.name, err)
+				}
+			}
+		})
+	}
+}
+
+// External stubs, as run in containers, are reached by URL and named by
+// their position
+func TestInteropBackendURLs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a load balancer and QUIC clients")
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var urls []string
+	for i := range 2 {
+		stub, err := startStubBackend(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stub.server.Close()
+		urls = append(urls, stub.url)
+	}
+	env, stop, err := startInterop(0, "plaintext", urls)
+	if err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	defer stop()
+	env.clients, env.timeout = 4, 10*time.Second
+	if err := checkSpread(env); err != nil {
+		t.Error(err)
+	}
+	if err := checkCIDRouting(env); err != nil {
+		t.Error(err)
+	}
+}
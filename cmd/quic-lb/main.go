@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"quic-moodle/server"
+)
+
+func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dns-record" {
+		os.Exit(runDNSRecord(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "interop" {
+		os.Exit(runInterop(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stub" {
+		os.Exit(runStub(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "", "path to the JSON config file")
+	dryRun := flag.Bool("dry-run", false, "answer load-balanced requests with the routing decision instead of proxying")
+	devTLS := flag.Bool("dev-tls", false, "serve a self-signed certificate for localhost generated at startup instead of the configured certificate files")
+	flag.Parse()
+
+	cfg := server.DefaultConfig()
+	var err error
+	if *configPath != "" {
+		cfg, err = server.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Printf("📄 Loaded config from %s", *configPath)
+	}
+	if *dryRun {
+		log.Printf("🧪 Dry-run mode: load-balanced requests return routing decisions and are not proxied")
+	}
+
+	if *devTLS {
+		log.Printf("🧪 Development TLS: serving a generated self-signed certificate, do not use in production")
+	}
+
+	srv, err := server.New(cfg, server.WithConfigPath(*configPath), server.WithDryRun(*dryRun), server.WithDevTLS(*devTLS))
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	log.Printf("🔁 Send SIGUSR2 to upgrade the binary without closing the listening sockets")
+
+	// Keep server alive until asked to stop or hand off to a new binary
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for {
+		select {
+		case err := <-done:
+			srv.Close()
+			log.Fatalf("❌ %v", err)
+		case sig := <-signals:
+			if sig == syscall.SIGUSR2 {
+				if err := srv.Upgrade(); err != nil {
+					log.Printf("❌ Binary upgrade aborted, continuing to serve: %v", err)
+					continue
+				}
+				log.Printf("🔁 Upgrade handed off, draining this process")
+			} else {
+				log.Printf("🛑 Received %v, shutting down", sig)
+			}
+		}
+		break
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	srv.Close()
+	log.Println("👋 Shutdown complete")
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// combinedLogTime is the timestamp layout of the combined log format
+const combinedLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// combinedLogLine matches the combined log format of Apache and nginx,
+// followed by any further fields
+var combinedLogLine = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) \S+(?: "[^"]*" "([^"]*)")?(.*)$`)
+
+// replayEntry is one recorded request
+type replayEntry struct {
+	Time      time.Time         `json:"time"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"` // path and query
+	Host      string            `json:"host,omitempty"`
+	Session   string            `json:"session,omitempty"` // session cookie value or another affinity key
+	ClientIP  string            `json:"client_ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Status    int               `json:"status,omitempty"` // status recorded, compared with the replayed one
+}
+
+// sessionKey returns the recorded session, or the client address and
+// user agent for logs that do not record one
+func (e *replayEntry) sessionKey() string {
+	if e.Session != "" {
+		return "session " + e.Session
+	}
+	return "client " + e.ClientIP + " " + e.UserAgent
+}
+
+// replaySession is one recorded session replayed over its own connection
+// with a session ID of its own
+type replaySession struct {
+	client   *benchClient
+	id       string          // session ID sent instead of the recorded one
+	backends map[string]bool // backends that answered, from X-Backend-ID
+	mu       sync.Mutex
+}
+
+// runReplay implements the `replay` subcommand. It replays recorded
+// requests against the load balancer at their recorded pace, scaled by
+// -speed, keeping each recorded session on a connection and session ID of
+// its own, so a config change can be tried with real Moodle traffic
+// before it goes live.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	logFile := fs.String("log", "", "recorded requests: a combined-format access log or JSON lines, \"-\" for stdin (required)")
+	format := fs.String("format", "auto", "log format: combined, json or auto")
+	target := fs.String("url", "", "load balancer base URL, e.g. https://localhost:8443 (required)")
+	proto := fs.String("proto", "h3", "protocol: h1, h2 or h3")
+	speed := fs.Float64("speed", 1, "pace relative to the recording, e.g. 2 for twice as fast; 0 sends as fast as -concurrency allows")
+	concurrency := fs.Int("concurrency", 100, "requests in flight at most; requests due while all are busy wait")
+	cookie := fs.String("cookie", "MoodleSession", "cookie carrying the replayed session IDs; empty sends X-Session-ID instead")
+	methods := fs.String("methods", "GET,HEAD", "methods replayed, \"*\" for all; recorded bodies are not replayed")
+	host := fs.String("host", "", "Host header sent instead of the recorded one")
+	limit := fs.Int("limit", 0, "replay at most this many requests (0 for all)")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification, e.g. against -dev-tls")
+	var headers headerFlags
+	fs.Var(&headers, "H", "extra request header \"Name: value\", repeatable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *logFile == "" || *target == "" || *speed < 0 || *concurrency <= 0 ||
+		!slices.Contains([]string{"h1", "h2", "h3"}, *proto) || !slices.Contains([]string{"auto", "combined", "json"}, *format) {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb replay -log <file> -url <url> [-format auto|combined|json] [-proto h1|h2|h3] [-speed 1] [-concurrency 100] [-cookie MoodleSession] [-methods GET,HEAD] [-insecure]")
+		return 2
+	}
+	if *proto != "h1" && !strings.HasPrefix(*target, "https://") {
+		fmt.Fprintf(os.Stderr, "❌ %s needs an https:// URL\n", *proto)
+		return 2
+	}
+
+	entries, skipped, err := readReplayLog(*logFile, *format, *methods, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "❌ No requests to replay in %s (%d lines skipped)\n", *logFile, skipped)
+		return 1
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	sessions := make(map[string]*replaySession)
+	for _, e := range entries {
+		key := e.sessionKey()
+		if sessions[key] == nil {
+			// The same recording replays with the same session IDs
+			sum := sha256.Sum256([]byte(key))
+			sessions[key] = &replaySession{
+				client: &benchClient{http: &http.Client{
+					Transport: benchTransport(*proto, tlsConfig),
+					Timeout:   *timeout,
+					CheckRedirect: func(*http.Request, []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}},
+				id:       "replay-" + hex.EncodeToString(sum[:12]),
+				backends: make(map[string]bool),
+			}
+		}
+	}
+	defer func() {
+		for _, session := range sessions {
+			if closer, ok := session.client.http.Transport.(io.Closer); ok {
+				closer.Close()
+			} else if t, ok := session.client.http.Transport.(*http.Transport); ok {
+				t.CloseIdleConnections()
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	recorded := entries[len(entries)-1].Time.Sub(entries[0].Time)
+	pace := "as fast as possible"
+	if *speed > 0 {
+		pace = fmt.Sprintf("%gx speed, about %v", *speed, time.Duration(float64(recorded) / *speed).Round(time.Second))
+	}
+	fmt.Printf("⏯️  Replaying %d requests of %d sessions recorded over %v against %s over %s (%s, %d lines skipped)\n",
+		len(entries), len(sessions), recorded.Round(time.Second), *target, *proto, pace, skipped)
+
+	var (
+		resultsMu  sync.Mutex
+		results    []benchResult
+		mismatched int // replayed status class differs from the recorded one
+		inFlight   = make(chan struct{}, *concurrency)
+		wg         sync.WaitGroup
+		base       = strings.TrimSuffix(*target, "/")
+	)
+	start := time.Now()
+	for _, e := range entries {
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(e.Time.Sub(entries[0].Time)) / *speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(wait):
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case inFlight <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		session := sessions[e.sessionKey()]
+		wg.Add(1)
+		go func(e replayEntry) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			result, backend := session.replay(e, base, *host, *cookie, headers)
+			if backend != "" {
+				session.mu.Lock()
+				session.backends[backend] = true
+				session.mu.Unlock()
+			}
+			resultsMu.Lock()
+			results = append(results, result)
+			if e.Status != 0 && result.status != 0 && e.Status/100 != result.status/100 {
+				mismatched++
+			}
+			resultsMu.Unlock()
+		}(e)
+	}
+	wg.Wait()
+
+	printBenchReport(results, 0, time.Since(start))
+	fmt.Printf("   status class differs from the recording for %d requests\n", mismatched)
+	printAffinityReport(sessions)
+	return 0
+}
+
+// replay sends one recorded request as the session and returns the result
+// and the backend that answered, when the load balancer names it
+func (s *replaySession) replay(e replayEntry, base, host, cookie string, headers headerFlags) (benchResult, string) {
+	req, err := http.NewRequest(e.Method, base+e.Path, nil)
+	if err != nil {
+		return benchResult{err: err.Error()}, ""
+	}
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	if e.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", e.UserAgent)
+	}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	switch {
+	case host != "":
+		req.Host = host
+	case e.Host != "":
+		req.Host = e.Host
+	}
+	if cookie != "" {
+		req.Header.Del("Cookie")
+		req.AddCookie(&http.Cookie{Name: cookie, Value: s.id})
+	} else {
+		req.Header.Set("X-Session-ID", s.id)
+	}
+	s.client.mu.Lock()
+	if s.client.cid != "" {
+		req.Header.Set("X-Quic-Connection-Id", s.client.cid)
+	}
+	s.client.mu.Unlock()
+
+	started := time.Now()
+	resp, err := s.client.http.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(started), err: benchError(err)}, ""
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result := benchResult{latency: time.Since(started), status: resp.StatusCode, proto: resp.Proto}
+	if err != nil {
+		result.err = benchError(err)
+	}
+	if cid := resp.Header.Get("X-Quic-Connection-Id"); cid != "" {
+		s.client.mu.Lock()
+		s.client.cid = cid
+		s.client.mu.Unlock()
+	}
+	return result, resp.Header.Get("X-Backend-ID")
+}
+
+// printAffinityReport prints how many sessions stayed on one backend; the
+// load balancer names backends only to clients allowed its internal headers
+func printAffinityReport(sessions map[string]*replaySession) {
+	seen, moved := 0, 0
+	for _, session := range sessions {
+		switch {
+		case len(session.backends) > 1:
+			moved++
+			fallthrough
+		case len(session.backends) == 1:
+			seen++
+		}
+	}
+	if seen == 0 {
+		fmt.Println("   affinity unknown: no X-Backend-ID in the answers (see response_headers.debug_clients)")
+		return
+	}
+	fmt.Printf("   affinity %d of %d sessions kept one backend, %d moved\n", seen-moved, seen, moved)
+}
+
+// readReplayLog reads the requests of a log whose methods are replayed and
+// returns them with the number of lines skipped
+func readReplayLog(path, format, methods string, limit int) ([]replayEntry, int, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	allowed := make(map[string]bool)
+	for _, m := range strings.Split(methods, ",") {
+		allowed[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+
+	var entries []replayEntry
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		lineFormat := format
+		if lineFormat == "auto" {
+			lineFormat = "combined"
+			if strings.HasPrefix(line, "{") {
+				lineFormat = "json"
+			}
+		}
+		var e replayEntry
+		var err error
+		if lineFormat == "json" {
+			err = json.Unmarshal([]byte(line), &e)
+		} else {
+			e, err = parseCombinedLine(line)
+		}
+		if err != nil || e.Method == "" || !strings.HasPrefix(e.Path, "/") || !(allowed["*"] || allowed[e.Method]) {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, skipped, nil
+}
+
+// parseCombinedLine parses a combined log line. A field such as
+// MoodleSession=<id> after the user agent, as logged by nginx's
+// $cookie_MoodleSession or Apache's %{MoodleSession}C, is taken as the
+// session.
+func parseCombinedLine(line string) (replayEntry, error) {
+	m := combinedLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return replayEntry{}, fmt.Errorf("not a combined log line")
+	}
+	t, err := time.Parse(combinedLogTime, m[2])
+	if err != nil {
+		return replayEntry{}, err
+	}
+	e := replayEntry{Time: t, ClientIP: m[1], Method: m[3], Path: m[4], UserAgent: m[6]}
+	fmt.Sscan(m[5], &e.Status)
+	for _, field := range strings.Fields(strings.ReplaceAll(m[7], `"`, " ")) {
+		if name, value, ok := strings.Cut(field, "="); ok && strings.HasPrefix(name, "MoodleSession") && value != "" && value != "-" {
+			e.Session = value
+		}
+	}
+	return e, nil
+}
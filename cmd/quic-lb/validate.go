@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"quic-moodle/server"
+)
+
+// runValidate implements the `validate` subcommand. It loads a config file,
+// runs Config.Validate (which includes the QUIC-LB constraint checks), resolves
+// backend hostnames and returns the process exit code (0 valid, 1 invalid, 2 usage).
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the JSON config file (required)")
+	skipDNS := fs.Bool("skip-dns", false, "do not resolve backend hostnames")
+	dnsTimeout := fs.Duration("dns-timeout", 5*time.Second, "timeout for each backend hostname lookup")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: quic-lb validate -config <file> [-skip-dns] [-dns-timeout 5s]")
+		return 2
+	}
+
+	cfg, err := server.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	var problems []error
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, server.UnwrapErrors(err)...)
+	}
+	if !*skipDNS {
+		for _, pool := range cfg.AllPools() {
+			problems = append(problems, resolveBackends(pool.Name, pool.Backends, *dnsTimeout)...)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "❌ %s: %d problem(s) found\n", *configPath, len(problems))
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "   • %v\n", p)
+		}
+		return 1
+	}
+
+	fmt.Printf("✅ %s is valid (%d backends in %d pools)\n", *configPath, cfg.BackendCount(), len(cfg.AllPools()))
+	return 0
+}
+
+// resolveBackends checks that every backend hostname resolves
+func resolveBackends(pool string, backends []server.BackendConfig, timeout time.Duration) []error {
+	var errs []error
+	for i, b := range backends {
+		u, err := url.Parse(b.URL)
+		if err != nil || u.Hostname() == "" {
+			continue // already reported by Validate
+		}
+		host := u.Hostname()
+		if net.ParseIP(host) != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err = net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s backends[%d]: cannot resolve %q: %v", pool, i, host, err))
+		}
+	}
+	return errs
+}
@@ -1,18 +1,31 @@
 module quic-moodle
 
-go 1.24
+go 1.24.0
 
 toolchain go1.24.8
 
-require github.com/quic-go/quic-go v0.55.0
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/go-jose/go-jose/v4 v4.1.5
+	github.com/klauspost/compress v1.19.0
+	github.com/oschwald/maxminddb-golang/v2 v2.1.1
+	github.com/quic-go/qpack v0.6.0
+	github.com/quic-go/quic-go v0.59.0
+	github.com/quic-go/webtransport-go v0.10.0
+	github.com/redis/go-redis/v9 v9.22.0
+	github.com/spiffe/go-spiffe/v2 v2.8.2
+	golang.org/x/crypto v0.46.0
+	golang.org/x/net v0.48.0
+)
 
 require (
-	github.com/quic-go/qpack v0.5.1 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/mod v0.27.0 // indirect
-	golang.org/x/net v0.43.0 // indirect
-	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
-	golang.org/x/text v0.28.0 // indirect
-	golang.org/x/tools v0.36.0 // indirect
+	github.com/Microsoft/go-winio v0.6.2 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dunglas/httpsfv v1.1.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
+	google.golang.org/grpc v1.79.3 // indirect
+	google.golang.org/protobuf v1.36.12 // indirect
 )
@@ -0,0 +1,182 @@
+package quiclb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// QUIC packet header layout (RFC 9000 section 17)
+const (
+	headerFormLong = 0x80 // first byte bit set on long header packets
+	maxCIDLen      = 20   // longest connection ID of QUIC version 1
+	longHeaderDCID = 6    // DCID offset: first byte, 4 byte version, DCID length
+)
+
+// QUIC versions whose long header packet types ParseHeader knows
+const (
+	Version1 uint32 = 0x00000001 // RFC 9000
+	Version2 uint32 = 0x6b3343cf // RFC 9369
+)
+
+// Errors from DestinationCID and ParseHeader
+var (
+	ErrShortPacket = errors.New("packet too short for its connection ID")
+	ErrCIDTooLong  = errors.New("connection ID longer than 20 bytes")
+	ErrShortCIDLen = errors.New("short header connection ID length must be 0-20 bytes")
+)
+
+// PacketType is the kind of a QUIC packet as told by its header
+type PacketType uint8
+
+// Packet types; PacketLongHeader is a long header packet of a version
+// ParseHeader does not know
+const (
+	PacketInitial PacketType = iota + 1
+	Packet0RTT
+	PacketHandshake
+	PacketRetry
+	PacketVersionNegotiation
+	Packet1RTT
+	PacketLongHeader
+)
+
+// String names the packet type as RFC 9000 does
+func (t PacketType) String() string {
+	switch t {
+	case PacketInitial:
+		return "Initial"
+	case Packet0RTT:
+		return "0-RTT"
+	case PacketHandshake:
+		return "Handshake"
+	case PacketRetry:
+		return "Retry"
+	case PacketVersionNegotiation:
+		return "Version Negotiation"
+	case Packet1RTT:
+		return "1-RTT"
+	case PacketLongHeader:
+		return "long header"
+	default:
+		return fmt.Sprintf("PacketType(%d)", uint8(t))
+	}
+}
+
+// longHeaderTypes maps the two type bits of the first byte to the packet
+// type, per version
+var longHeaderTypes = map[uint32][4]PacketType{
+	Version1: {PacketInitial, Packet0RTT, PacketHandshake, PacketRetry},
+	Version2: {PacketRetry, PacketInitial, Packet0RTT, PacketHandshake},
+}
+
+// Header holds the connection IDs and type of a QUIC packet. The
+// connection IDs share the parsed packet's memory.
+type Header struct {
+	Type    PacketType
+	Version uint32 // long headers only; 0 for Version Negotiation
+	DCID    []byte
+	SCID    []byte // long headers only
+}
+
+// IsLong reports whether the packet has a long header
+func (h *Header) IsLong() bool {
+	return h.Type != Packet1RTT
+}
+
+// ParseHeader parses the invariant header fields of the first QUIC packet
+// in a datagram (RFC 8999) and classifies it. Short headers do not carry
+// the DCID length, so shortLen is the length of the connection IDs this
+// load balancer issues. Connection IDs of versions 1 and 2 are at most 20
+// bytes; Version Negotiation and unknown versions allow up to 255.
+func ParseHeader(packet []byte, shortLen int) (Header, error) {
+	if len(packet) == 0 {
+		return Header{}, ErrShortPacket
+	}
+	if packet[0]&headerFormLong == 0 {
+		dcid, err := shortHeaderDCID(packet, shortLen)
+		if err != nil {
+			return Header{}, err
+		}
+		return Header{Type: Packet1RTT, DCID: dcid}, nil
+	}
+
+	if len(packet) < longHeaderDCID {
+		return Header{}, ErrShortPacket
+	}
+	h := Header{Version: binary.BigEndian.Uint32(packet[1:5])}
+	types, known := longHeaderTypes[h.Version]
+	switch {
+	case h.Version == 0:
+		h.Type = PacketVersionNegotiation
+	case known:
+		h.Type = types[packet[0]>>4&0x03]
+	default:
+		h.Type = PacketLongHeader
+	}
+
+	dcid, err := longHeaderDCIDOf(packet)
+	if err != nil {
+		return Header{}, err
+	}
+	h.DCID = dcid
+	scidLenAt := longHeaderDCID + len(dcid)
+	if len(packet) < scidLenAt+1 {
+		return Header{}, ErrShortPacket
+	}
+
+	scidLen := int(packet[scidLenAt])
+	if known && scidLen > maxCIDLen {
+		return Header{}, ErrCIDTooLong
+	}
+	if len(packet) < scidLenAt+1+scidLen {
+		return Header{}, ErrShortPacket
+	}
+	h.SCID = packet[scidLenAt+1 : scidLenAt+1+scidLen]
+	return h, nil
+}
+
+// DestinationCID returns the destination connection ID of a QUIC packet,
+// sharing packet's memory. Long headers carry the length; short headers do
+// not, so shortLen is the length of the connection IDs this load balancer
+// issues. It accepts the same connection IDs as ParseHeader but stops after
+// the DCID, for routing.
+func DestinationCID(packet []byte, shortLen int) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, ErrShortPacket
+	}
+	if packet[0]&headerFormLong == 0 {
+		return shortHeaderDCID(packet, shortLen)
+	}
+	if len(packet) < longHeaderDCID {
+		return nil, ErrShortPacket
+	}
+	return longHeaderDCIDOf(packet)
+}
+
+// shortHeaderDCID returns the shortLen bytes after the first byte of a
+// short header packet
+func shortHeaderDCID(packet []byte, shortLen int) ([]byte, error) {
+	if shortLen < 0 || shortLen > maxCIDLen {
+		return nil, ErrShortCIDLen
+	}
+	if len(packet) < 1+shortLen {
+		return nil, ErrShortPacket
+	}
+	return packet[1 : 1+shortLen], nil
+}
+
+// longHeaderDCIDOf returns the DCID of a long header packet of at least
+// longHeaderDCID bytes. Versions 1 and 2 limit it to 20 bytes; Version
+// Negotiation and unknown versions allow up to 255.
+func longHeaderDCIDOf(packet []byte) ([]byte, error) {
+	_, known := longHeaderTypes[binary.BigEndian.Uint32(packet[1:5])]
+	dcidLen := int(packet[longHeaderDCID-1])
+	if known && dcidLen > maxCIDLen {
+		return nil, ErrCIDTooLong
+	}
+	if len(packet) < longHeaderDCID+dcidLen {
+		return nil, ErrShortPacket
+	}
+	return packet[longHeaderDCID : longHeaderDCID+dcidLen], nil
+}
@@ -0,0 +1,69 @@
+package quiclb
+
+import (
+	"bytes"
+	"testing"
+)
+
+// packetSeeds are headers of each kind, plus the malformed ones that once
+// made the parsers panic or disagree
+var packetSeeds = []struct {
+	packet   string
+	shortLen int
+}{
+	{"40" + "0102030405060708" + "aabb", 8},                                             // 1-RTT
+	{"c0" + "00000001" + "08" + "0102030405060708" + "04" + "0a0b0c0d", 8},              // Version 1 Initial
+	{"d0" + "6b3343cf" + "04" + "01020304" + "00", 8},                                   // Version 2 Initial
+	{"80" + "00000000" + "04" + "01020304" + "04" + "0a0b0c0d" + "00000001", 8},         // Version Negotiation
+	{"c0" + "0a0a0a0a" + "15" + "000102030405060708090a0b0c0d0e0f1011121314" + "00", 8}, // unknown version, 21-byte DCID
+	{"c0" + "00000001" + "15" + "000102030405060708090a0b0c0d0e0f1011121314" + "00", 8}, // Version 1, 21-byte DCID
+	{"40" + "01", -1},
+	{"40" + "01", 21},
+	{"c0" + "000000", 8},
+}
+
+func FuzzParseHeader(f *testing.F) {
+	for _, seed := range packetSeeds {
+		f.Add(mustHex(f, seed.packet), seed.shortLen)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte, shortLen int) {
+		h, err := ParseHeader(packet, shortLen)
+		dcid, dcidErr := DestinationCID(packet, shortLen)
+		if err != nil {
+			return
+		}
+		if dcidErr != nil {
+			t.Fatalf("ParseHeader accepted the packet, but DestinationCID: %v", dcidErr)
+		}
+		if !bytes.Equal(h.DCID, dcid) {
+			t.Fatalf("ParseHeader DCID %x, DestinationCID %x", h.DCID, dcid)
+		}
+		if h.Type == Packet1RTT && len(h.DCID) != shortLen {
+			t.Fatalf("1-RTT DCID of %d bytes, want %d", len(h.DCID), shortLen)
+		}
+		if (h.Type == PacketInitial || h.Type == PacketHandshake) && (len(h.DCID) > maxCIDLen || len(h.SCID) > maxCIDLen) {
+			t.Fatalf("%s with connection IDs of %d and %d bytes", h.Type, len(h.DCID), len(h.SCID))
+		}
+	})
+}
+
+func FuzzDestinationCID(f *testing.F) {
+	for _, seed := range packetSeeds {
+		f.Add(mustHex(f, seed.packet), seed.shortLen)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte, shortLen int) {
+		dcid, err := DestinationCID(packet, shortLen)
+		if err != nil {
+			return
+		}
+		if len(dcid) > 0 && !bytes.Contains(packet, dcid) {
+			t.Fatalf("DCID %x is not part of the packet", dcid)
+		}
+		if packet[0]&headerFormLong == 0 && (shortLen < 0 || shortLen > maxCIDLen || len(dcid) != shortLen) {
+			t.Fatalf("short header DCID of %d bytes for shortLen %d", len(dcid), shortLen)
+		}
+		if packet[0]&headerFormLong != 0 && len(dcid) != int(packet[longHeaderDCID-1]) {
+			t.Fatalf("long header DCID of %d bytes, length byte %d", len(dcid), packet[longHeaderDCID-1])
+		}
+	})
+}
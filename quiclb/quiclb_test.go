@@ -0,0 +1,263 @@
+package quiclb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// testKey is the key of the Draft 20 Appendix B encrypted vectors
+const testKey = "8f95f09245765f80256934e50c66207f"
+
+func mustHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// cidVector is a server ID and nonce and the connection ID they encode to,
+// first octet included, with the length self-encoded
+type cidVector struct {
+	name     string
+	cr       uint8
+	serverID string
+	nonce    string
+	cid      string
+}
+
+func TestPlaintextVectors(t *testing.T) {
+	vectors := []cidVector{
+		// Draft 20 Appendix B.1
+		{"draft cr 0", 0, "c4605e", "4504cc4f", "07c4605e4504cc4f"},
+		// The plaintext layout with other rotations and lengths
+		{"cr 1", 1, "350d28b420", "3487d970b7", "2a350d28b4203487d970b7"},
+		{"cr 6 one-byte server ID", 6, "2f", "0123456789abcdef", "c92f0123456789abcdef"},
+	}
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			serverID, nonce, cid := mustHex(t, v.serverID), mustHex(t, v.nonce), mustHex(t, v.cid)
+			e := NewPlaintext(v.cr, uint8(len(serverID)), uint8(len(cid)))
+			e.config.FirstOctetEncodesCIDLen = true
+
+			first := make([]byte, 1)
+			e.putFirstOctet(first)
+			if first[0] != cid[0] {
+				t.Errorf("first octet %02x, want %02x", first[0], cid[0])
+			}
+			decoded, err := e.DecodeCID(cid)
+			if err != nil {
+				t.Fatalf("DecodeCID: %v", err)
+			}
+			if !bytes.Equal(decoded.ServerID, serverID) {
+				t.Errorf("server ID %x, want %x", decoded.ServerID, serverID)
+			}
+			if !bytes.Equal(cid[1+len(serverID):], nonce) {
+				t.Errorf("nonce %x, want %x", cid[1+len(serverID):], nonce)
+			}
+		})
+	}
+}
+
+func TestBlockCipherVectors(t *testing.T) {
+	vectors := []cidVector{
+		// Draft 20 Appendix B.2: four-pass, odd and even lengths
+		{"draft four-pass 7 bytes", 0, "ed793a", "ee080dbf", "0720b1d07b359d3c"},
+		{"draft four-pass 15 bytes", 1, "ed793a51d49b8f5fab65", "ee080dbf48", "2fcc381bc74cb4fbad2823a3d1f8fed2"},
+		// Draft 20 Appendix B.2: single-pass
+		{"draft single-pass", 2, "ed793a51d49b8f5f", "ee080dbf48c0d1e5", "504dd2d05a7b0de9b2b9907afb5ecf8cc3"},
+		// Four-pass with an odd length and a server ID longer than the nonce
+		{"four-pass 14 bytes", 3, "ed793a51d49b8f5fab", "ee080dbf48", "6ef70943948d1ca868bf48fa98a528"},
+	}
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			testEncryptedVector(t, "block-cipher", v)
+		})
+	}
+}
+
+// Draft 20 no longer has a stream-cipher algorithm, so these are regression
+// vectors of this implementation rather than published ones
+func TestStreamCipherVectors(t *testing.T) {
+	vectors := []cidVector{
+		{"8-byte nonce", 0, "ed793a", "ee080dbf48c0d1e5", "0b7ffebe19e45dbc96faeb07"},
+		{"16-byte nonce", 2, "ed79", "ee080dbf48c0d1e5ab65de0123456789", "525acd56273b14e804fd9b1d36c511dadab8ff"},
+	}
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			testEncryptedVector(t, "stream-cipher", v)
+		})
+	}
+}
+
+// testEncryptedVector encrypts the vector's server ID and nonce, compares
+// the result with its connection ID and decodes that back
+func testEncryptedVector(t *testing.T, algorithm string, v cidVector) {
+	t.Helper()
+	key, serverID, nonce, cid := mustHex(t, testKey), mustHex(t, v.serverID), mustHex(t, v.nonce), mustHex(t, v.cid)
+	e, err := NewEncrypted(algorithm, v.cr, uint8(len(serverID)), uint8(len(cid)), uint8(len(nonce)), key)
+	if err != nil {
+		t.Fatalf("NewEncrypted: %v", err)
+	}
+	e.config.FirstOctetEncodesCIDLen = true
+
+	got := make([]byte, len(cid))
+	e.putFirstOctet(got)
+	plaintext := append(append([]byte{}, serverID...), nonce...)
+	scratch := new(cidScratch)
+	switch {
+	case algorithm == "stream-cipher":
+		e.streamCipherEncrypt(got[1:], plaintext, scratch)
+	case len(plaintext) == 16:
+		err = e.singlePassEncrypt(got[1:], plaintext)
+	default:
+		err = e.fourPassEncrypt(got[1:], plaintext, scratch)
+	}
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !bytes.Equal(got, cid) {
+		t.Errorf("cid %x, want %x", got, cid)
+	}
+
+	decoded, err := e.DecodeCID(cid)
+	if err != nil {
+		t.Fatalf("DecodeCID: %v", err)
+	}
+	if !bytes.Equal(decoded.ServerID, serverID) || !bytes.Equal(decoded.Nonce, nonce) {
+		t.Errorf("decoded %x/%x, want %x/%x", decoded.ServerID, decoded.Nonce, serverID, nonce)
+	}
+}
+
+// Every length the encrypted algorithms allow encodes and decodes back to
+// the backend ID and nonce
+func TestEncryptedRoundTrip(t *testing.T) {
+	key := mustHex(t, testKey)
+	for _, algorithm := range []string{"stream-cipher", "block-cipher"} {
+		for serverIDLen := uint8(1); serverIDLen <= 15; serverIDLen++ {
+			for nonceLen := uint8(4); serverIDLen+nonceLen <= 19; nonceLen++ {
+				cidLen := 1 + serverIDLen + nonceLen
+				e, err := NewEncrypted(algorithm, 1, serverIDLen, cidLen, nonceLen, key)
+				if err != nil {
+					continue // outside the algorithm's nonce lengths
+				}
+				backendID := uint16(ServerIDCapacity(serverIDLen))
+				nonce := bytes.Repeat([]byte{0xa5}, int(nonceLen))
+				cid := make([]byte, cidLen)
+				if _, err := e.EncodeEncryptedCIDInto(cid, uint64(backendID), nonce); err != nil {
+					t.Fatalf("%s %d+%d: encode: %v", algorithm, serverIDLen, nonceLen, err)
+				}
+				decoded, err := e.DecodeCID(cid)
+				if err != nil {
+					t.Fatalf("%s %d+%d: decode: %v", algorithm, serverIDLen, nonceLen, err)
+				}
+				if decoded.BackendID != backendID || !bytes.Equal(decoded.Nonce, nonce) {
+					t.Errorf("%s %d+%d: decoded backend %d nonce %x, want %d %x", algorithm, serverIDLen, nonceLen, decoded.BackendID, decoded.Nonce, backendID, nonce)
+				}
+			}
+		}
+	}
+}
+
+// benchmarkEncoder is an encoder of each algorithm, and of both
+// block-cipher passes, for the benchmarks and allocation tests
+type benchmarkEncoder struct {
+	name string
+	e    *Encoder
+}
+
+func benchmarkEncoders(tb testing.TB) []benchmarkEncoder {
+	key := mustHex(tb, testKey)
+	encoders := []benchmarkEncoder{{"plaintext", NewPlaintext(0, 2, 8)}}
+	for _, c := range []struct {
+		name, algorithm               string
+		serverIDLen, nonceLen, cidLen uint8
+	}{
+		{"stream-cipher", "stream-cipher", 2, 8, 11},
+		{"single-pass", "block-cipher", 8, 8, 17},
+		{"four-pass", "block-cipher", 2, 6, 9},
+	} {
+		e, err := NewEncrypted(c.algorithm, 0, c.serverIDLen, c.cidLen, c.nonceLen, key)
+		if err != nil {
+			tb.Fatalf("%s: %v", c.name, err)
+		}
+		encoders = append(encoders, benchmarkEncoder{c.name, e})
+	}
+	return encoders
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, be := range benchmarkEncoders(b) {
+		e := be.e
+		b.Run(be.name, func(b *testing.B) {
+			b.ReportAllocs()
+			cid := make([]byte, e.config.ConnectionIDLen)
+			for i := 0; i < b.N; i++ {
+				if _, err := e.EncodeCIDInto(cid, uint64(uint16(i)|1)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, be := range benchmarkEncoders(b) {
+		e := be.e
+		b.Run(be.name, func(b *testing.B) {
+			cid := make([]byte, e.config.ConnectionIDLen)
+			if _, err := e.EncodeCIDInto(cid, 300); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.DecodeCID(cid); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The connection path writes connection IDs without allocating
+func TestEncodeCIDIntoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	for _, be := range benchmarkEncoders(t) {
+		cid := make([]byte, be.e.config.ConnectionIDLen)
+		allocs := testing.AllocsPerRun(1000, func() {
+			if _, err := be.e.EncodeCIDInto(cid, 300); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: EncodeCIDInto allocates %.1f times per call, want 0", be.name, allocs)
+		}
+	}
+}
+
+// Backend IDs the server ID cannot hold are refused rather than truncated
+func TestEncodeCIDIntoBackendIDRange(t *testing.T) {
+	cid := make([]byte, 20)
+	for _, c := range []struct {
+		serverIDLen uint8
+		backendID   uint64
+		ok          bool
+	}{
+		{1, 255, true},
+		{1, 256, false},
+		{2, 65535, true},
+		{2, 65536, false},
+		{8, 1 << 32, false},
+	} {
+		e := NewPlaintext(0, c.serverIDLen, c.serverIDLen+5)
+		_, err := e.EncodeCIDInto(cid, c.backendID)
+		if (err == nil) != c.ok {
+			t.Errorf("%d-byte server ID, backend ID %d: err %v, want ok %v", c.serverIDLen, c.backendID, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessConfig allows or denies clients by address. Entries are CIDRs
+// ("203.0.113.0/24", "2001:db8::/32") or single addresses. A client on the
+// deny list is refused; when the allow list is not empty, only clients on
+// it are accepted. Country and ASN rules need the geoip databases.
+type AccessConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	AllowCountries []string `json:"allow_countries,omitempty"` // ISO 3166-1 alpha-2 codes accepted in addition to allow
+	DenyCountries  []string `json:"deny_countries,omitempty"`  // ISO 3166-1 alpha-2 codes refused
+	DenyASNs       []uint   `json:"deny_asns,omitempty"`       // Autonomous systems refused, e.g. hosting providers
+
+	DenyFingerprints []string `json:"deny_fingerprints,omitempty"` // JA4 or JA3 TLS fingerprints refused, see /api/tls/fingerprints
+}
+
+// validate checks the entries of both lists
+func (ac *AccessConfig) validate(prefix string) []error {
+	var errs []error
+	for list, entries := range map[string][]string{"allow": ac.Allow, "deny": ac.Deny} {
+		for i, entry := range entries {
+			if _, err := parseAccessEntry(entry); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s[%d]: %v", prefix, list, i, err))
+			}
+		}
+	}
+	for i, fp := range ac.DenyFingerprints {
+		if !validTLSFingerprint(fp) {
+			errs = append(errs, fmt.Errorf("%s.deny_fingerprints[%d] %q must be a JA4 fingerprint or a JA3 hash", prefix, i, fp))
+		}
+	}
+	for list, codes := range map[string][]string{"allow_countries": ac.AllowCountries, "deny_countries": ac.DenyCountries} {
+		for i, code := range codes {
+			if !validCountryCode(code) {
+				errs = append(errs, fmt.Errorf("%s.%s[%d] %q must be an ISO 3166-1 alpha-2 code", prefix, list, i, code))
+			}
+		}
+	}
+	return errs
+}
+
+// usesGeoIP reports whether the lists have country or ASN rules
+func (ac *AccessConfig) usesGeoIP() bool {
+	return len(ac.AllowCountries) > 0 || len(ac.DenyCountries) > 0 || len(ac.DenyASNs) > 0
+}
+
+// validCountryCode reports whether code looks like "DE"
+func validCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+// parseAccessEntry parses a CIDR or a single address
+func parseAccessEntry(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", entry)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// accessList is a compiled AccessConfig
+type accessList struct {
+	allow            []netip.Prefix
+	deny             []netip.Prefix
+	allowCountries   map[string]bool
+	denyCountries    map[string]bool
+	denyASNs         map[uint]bool
+	denyFingerprints map[string]bool
+}
+
+// compileAccess compiles validated entries; nil when both lists are empty
+func compileAccess(ac AccessConfig) *accessList {
+	if len(ac.Allow) == 0 && len(ac.Deny) == 0 && !ac.usesGeoIP() && len(ac.DenyFingerprints) == 0 {
+		return nil
+	}
+	list := &accessList{allowCountries: make(map[string]bool), denyCountries: make(map[string]bool), denyASNs: make(map[uint]bool), denyFingerprints: make(map[string]bool)}
+	for _, fp := range ac.DenyFingerprints {
+		list.denyFingerprints[fp] = true
+	}
+	for _, code := range ac.AllowCountries {
+		list.allowCountries[code] = true
+	}
+	for _, code := range ac.DenyCountries {
+		list.denyCountries[code] = true
+	}
+	for _, asn := range ac.DenyASNs {
+		list.denyASNs[asn] = true
+	}
+	for _, entry := range ac.Allow {
+		if prefix, err := parseAccessEntry(entry); err == nil {
+			list.allow = append(list.allow, prefix)
+		}
+	}
+	for _, entry := range ac.Deny {
+		if prefix, err := parseAccessEntry(entry); err == nil {
+			list.deny = append(list.deny, prefix)
+		}
+	}
+	return list
+}
+
+// check returns why addr, located at geo and connected with the TLS
+// fingerprint fp, is refused, or "" when it is accepted. Clients of unknown
+// location only pass country allow lists through the address allow list.
+func (l *accessList) check(addr netip.Addr, geo geoInfo, fp tlsFingerprint) string {
+	if l == nil {
+		return ""
+	}
+	for _, prefix := range l.deny {
+		if prefix.Contains(addr) {
+			return "denied"
+		}
+	}
+	if fp.JA4 != "" && (l.denyFingerprints[fp.JA4] || l.denyFingerprints[fp.JA3]) {
+		return "fingerprint_denied"
+	}
+	if geo.Country != "" && l.denyCountries[geo.Country] {
+		return "country_denied"
+	}
+	if geo.ASN != 0 && l.denyASNs[geo.ASN] {
+		return "asn_denied"
+	}
+	if len(l.allow) == 0 && len(l.allowCountries) == 0 {
+		return ""
+	}
+	for _, prefix := range l.allow {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	if geo.Country != "" && l.allowCountries[geo.Country] {
+		return ""
+	}
+	return "not_allowed"
+}
+
+// clientAddr returns the address of r's client
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// AccessControl applies the global access lists and counts refusals; route
+// lists are compiled with the routes
+type AccessControl struct {
+	mu      sync.RWMutex
+	global  *accessList
+	denied  map[string]int64 // "global" or "routes[N]" -> refused requests
+	reasons map[string]int64 // "denied", "not_allowed", "country_denied", "asn_denied", "fingerprint_denied" -> refused requests
+}
+
+// NewAccessControl creates an access control accepting every client
+func NewAccessControl() *AccessControl {
+	return &AccessControl{denied: make(map[string]int64), reasons: make(map[string]int64)}
+}
+
+// Configure replaces the global lists
+func (ac *AccessControl) Configure(cfg AccessConfig) {
+	list := compileAccess(cfg)
+	ac.mu.Lock()
+	ac.global = list
+	ac.mu.Unlock()
+}
+
+// allow checks r's client against the global lists and then the matched
+// route's, answering refused requests with 403
+func (ac *AccessControl) allow(w http.ResponseWriter, r *http.Request, match RouteMatch) bool {
+	ac.mu.RLock()
+	global := ac.global
+	ac.mu.RUnlock()
+	if global == nil && match.Access == nil {
+		return true
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return true
+	}
+
+	geo, _ := geoFromRequest(r)
+	fp, _ := fingerprintFromRequest(r)
+	scope, reason := "global", global.check(addr, geo, fp)
+	if reason == "" {
+		scope, reason = match.Reason, match.Access.check(addr, geo, fp)
+	}
+	if reason == "" {
+		return true
+	}
+
+	ac.mu.Lock()
+	ac.denied[scope]++
+	ac.reasons[reason]++
+	ac.mu.Unlock()
+	log.Printf("⛔ Refused %s %s from %s [%s] (%s by %s)", r.Method, r.URL.Path, addr, geo, strings.ReplaceAll(reason, "_", " "), scope)
+	http.Error(w, "🚫 Access denied", http.StatusForbidden)
+	return false
+}
+
+// Snapshot reports refused requests per list
+func (ac *AccessControl) Snapshot() map[string]interface{} {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	denied := make(map[string]int64, len(ac.denied))
+	var total int64
+	for scope, n := range ac.denied {
+		denied[scope] = n
+		total += n
+	}
+	reasons := make(map[string]int64, len(ac.reasons))
+	for reason, n := range ac.reasons {
+		reasons[reason] = n
+	}
+	return map[string]interface{}{
+		"denied":           denied,
+		"denied_by_reason": reasons,
+		"denied_total":     total,
+	}
+}
+
+// errAccessNotFound answers an access list change naming a missing route or
+// entry
+var errAccessNotFound = errors.New("not found")
+
+// accessChange is the body of POST and DELETE /api/access
+type accessChange struct {
+	List  string `json:"list"`            // "allow" or "deny"
+	CIDR  string `json:"cidr"`            // CIDR or address
+	Route *int   `json:"route,omitempty"` // Index into routes; global lists when omitted
+}
+
+// handleAccess serves /api/access: GET lists the rules and refusal counts,
+// POST adds and DELETE removes an entry {"list": "deny", "cidr": "203.0.113.0/24",
+// "route": 0}. Changes go through the configuration and are persisted.
+func (s *Server) handleAccess(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodGet {
+		cfg := s.config.Current()
+		routes := make(map[string]AccessConfig)
+		for i, rt := range cfg.Routes {
+			if len(rt.Access.Allow) > 0 || len(rt.Access.Deny) > 0 || rt.Access.usesGeoIP() || len(rt.Access.DenyFingerprints) > 0 {
+				routes[fmt.Sprintf("routes[%d]", i)] = rt.Access
+			}
+		}
+		stats := s.access.Snapshot()
+		stats["global"] = cfg.Access
+		stats["routes"] = routes
+		stats["timestamp"] = time.Now()
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var change accessChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if change.List != "allow" && change.List != "deny" {
+		http.Error(w, `list must be "allow" or "deny"`, http.StatusBadRequest)
+		return
+	}
+	prefix, err := parseAccessEntry(change.CIDR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The entry is added to or removed from the accepted config under the
+	// config lock, so concurrent changes are not lost
+	var target AccessConfig
+	scope := "global"
+	_, persisted, err := s.config.Modify("admin-api:access", func(cfg *Config) (*Config, error) {
+		list := &cfg.Access
+		if change.Route != nil {
+			if *change.Route < 0 || *change.Route >= len(cfg.Routes) {
+				return nil, fmt.Errorf("%w: route %d does not exist", errAccessNotFound, *change.Route)
+			}
+			list, scope = &cfg.Routes[*change.Route].Access, fmt.Sprintf("routes[%d]", *change.Route)
+		}
+		entries := &list.Deny
+		if change.List == "allow" {
+			entries = &list.Allow
+		}
+		// Entries are compared in their parsed form, "10.0.0.1" equals "10.0.0.1/32"
+		index := slices.IndexFunc(*entries, func(entry string) bool {
+			parsed, err := parseAccessEntry(entry)
+			return err == nil && parsed == prefix
+		})
+		switch {
+		case r.Method == http.MethodPost && index < 0:
+			*entries = append(*entries, change.CIDR)
+		case r.Method == http.MethodDelete && index >= 0:
+			*entries = slices.Delete(*entries, index, index+1)
+		case r.Method == http.MethodDelete:
+			return nil, fmt.Errorf("%w: %s is not on the %s %s list", errAccessNotFound, change.CIDR, scope, change.List)
+		}
+		target = *list
+		return cfg, nil
+	})
+	if errors.Is(err, errAccessNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), configErrorStatus(err))
+		return
+	}
+
+	action := "added to"
+	if r.Method == http.MethodDelete {
+		action = "removed from"
+	}
+	log.Printf("⛔ %s %s the %s %s list (persisted: %v)", change.CIDR, action, scope, change.List, persisted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"scope":     scope,
+		"allow":     target.Allow,
+		"deny":      target.Deny,
+		"persisted": persisted,
+		"timestamp": time.Now(),
+	})
+}
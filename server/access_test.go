@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testJA4 = "t13d1516h2_8daaf6152771_02713d6af862"
+
+func TestAccessListCheck(t *testing.T) {
+	list := compileAccess(AccessConfig{
+		Allow:            []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:             []string{"10.0.0.66", "2001:db8:bad::/48"},
+		AllowCountries:   []string{"DE"},
+		DenyCountries:    []string{"KP"},
+		DenyASNs:         []uint{64496},
+		DenyFingerprints: []string{testJA4},
+	})
+	tests := []struct {
+		name   string
+		addr   string
+		geo    geoInfo
+		fp     tlsFingerprint
+		reason string
+	}{
+		{"allowed network", "10.1.2.3", geoInfo{}, tlsFingerprint{}, ""},
+		{"denied address in an allowed network", "10.0.0.66", geoInfo{}, tlsFingerprint{}, "denied"},
+		{"denied IPv6 network", "2001:db8:bad::1", geoInfo{}, tlsFingerprint{}, "denied"},
+		{"allowed IPv6 network", "2001:db8:1::1", geoInfo{}, tlsFingerprint{}, ""},
+		{"not on the allow list", "192.0.2.1", geoInfo{}, tlsFingerprint{}, "not_allowed"},
+		{"allowed country", "192.0.2.1", geoInfo{Country: "DE"}, tlsFingerprint{}, ""},
+		{"denied country on the allow list", "10.1.2.3", geoInfo{Country: "KP"}, tlsFingerprint{}, "country_denied"},
+		{"denied ASN", "10.1.2.3", geoInfo{Country: "DE", ASN: 64496}, tlsFingerprint{}, "asn_denied"},
+		{"denied fingerprint", "10.1.2.3", geoInfo{}, tlsFingerprint{JA4: testJA4}, "fingerprint_denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := list.check(netip.MustParseAddr(tt.addr), tt.geo, tt.fp); reason != tt.reason {
+				t.Errorf("reason %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+
+	if compileAccess(AccessConfig{}) != nil {
+		t.Error("empty lists compiled into a list")
+	}
+	var empty *accessList
+	if reason := empty.check(netip.MustParseAddr("192.0.2.1"), geoInfo{}, tlsFingerprint{}); reason != "" {
+		t.Errorf("no lists refused a client: %s", reason)
+	}
+}
+
+func TestAccessConfigValidate(t *testing.T) {
+	ac := AccessConfig{
+		Allow:            []string{"10.0.0.0/8", "10.0.0.0/33"},
+		Deny:             []string{"example.com"},
+		DenyCountries:    []string{"de"},
+		DenyFingerprints: []string{"not-a-fingerprint"},
+	}
+	var got []string
+	for _, err := range ac.validate("access") {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{`access.allow[1]: invalid CIDR "10.0.0.0/33"`, `access.deny[0]: invalid address "example.com"`, `access.deny_countries[0] "de"`, `access.deny_fingerprints[0]`} {
+		if !slices.ContainsFunc(got, func(err string) bool { return strings.HasPrefix(err, want) }) {
+			t.Errorf("errors %q, want one starting with %s", got, want)
+		}
+	}
+}
+
+// The global lists apply before the route's, refusals are counted by list
+// and reason, and IPv4-mapped clients match IPv4 entries
+func TestAccessControlAllow(t *testing.T) {
+	ac := NewAccessControl()
+	ac.Configure(AccessConfig{Deny: []string{"203.0.113.0/24"}})
+	route := RouteMatch{Access: compileAccess(AccessConfig{Allow: []string{"192.0.2.0/24"}}), Reason: "routes[0]"}
+
+	tests := []struct {
+		name    string
+		remote  string
+		match   RouteMatch
+		allowed bool
+	}{
+		{"no route list", "198.51.100.1:5000", RouteMatch{}, true},
+		{"globally denied", "203.0.113.5:5000", route, false},
+		{"IPv4-mapped globally denied", "[::ffff:203.0.113.5]:5000", RouteMatch{}, false},
+		{"on the route's allow list", "192.0.2.5:5000", route, true},
+		{"not on the route's allow list", "198.51.100.1:5000", route, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			if allowed := ac.allow(w, r, tt.match); allowed != tt.allowed {
+				t.Fatalf("allowed %v, want %v", allowed, tt.allowed)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Errorf("status %d, want 403", w.Code)
+			}
+		})
+	}
+
+	stats := ac.Snapshot()
+	denied, reasons := stats["denied"].(map[string]int64), stats["denied_by_reason"].(map[string]int64)
+	if denied["global"] != 2 || denied["routes[0]"] != 1 || reasons["denied"] != 2 || reasons["not_allowed"] != 1 || stats["denied_total"] != int64(3) {
+		t.Errorf("stats %v, want 2 global denials and 1 route refusal", stats)
+	}
+}
+
+// Entries are added once in any notation, removed by their parsed form,
+// and persisted with the config
+func TestHandleAccess(t *testing.T) {
+	m, _ := newTestConfigManager(t)
+	s := &Server{config: m, access: NewAccessControl()}
+	change := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.handleAccess(w, httptest.NewRequest(method, "/api/access", strings.NewReader(body)))
+		return w
+	}
+
+	if w := change(http.MethodPost, `{"list": "deny", "cidr": "203.0.113.7"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	change(http.MethodPost, `{"list": "deny", "cidr": "203.0.113.7/32"}`)
+	if deny := m.Accepted().Access.Deny; !slices.Equal(deny, []string{"203.0.113.7"}) {
+		t.Errorf("deny list %q, want the address once", deny)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"unknown list", http.MethodPost, `{"list": "block", "cidr": "203.0.113.7"}`, http.StatusBadRequest},
+		{"invalid CIDR", http.MethodPost, `{"list": "deny", "cidr": "203.0.113.0/40"}`, http.StatusBadRequest},
+		{"missing route", http.MethodPost, `{"list": "deny", "cidr": "203.0.113.7", "route": 99}`, http.StatusNotFound},
+		{"entry not on the list", http.MethodDelete, `{"list": "allow", "cidr": "203.0.113.7"}`, http.StatusNotFound},
+		{"remove in another notation", http.MethodDelete, `{"list": "deny", "cidr": "203.0.113.7/32"}`, http.StatusOK},
+		{"unsupported method", http.MethodPut, `{}`, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := change(tt.method, tt.body); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	if deny := m.Accepted().Access.Deny; len(deny) != 0 {
+		t.Errorf("deny list %q after removing its entry", deny)
+	}
+}
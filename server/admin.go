@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"quic-moodle/internal/atomicfile"
+)
+
+// Errors of a config change, telling the admin API how to answer
+var (
+	errConfigInvalid      = errors.New("invalid configuration")
+	errConfigNotPersisted = errors.New("configuration not applied, the config file could not be written")
+)
+
+// ConfigManager owns the effective configuration and applies/persists updates
+type ConfigManager struct {
+	mu        sync.RWMutex
+	path      string   // config file path, empty when running on defaults
+	current   *Config  // what the process runs
+	accepted  *Config  // latest accepted config, as written to the file; its restart-required sections may not run yet
+	pending   []string // sections of accepted that take effect after a restart
+	appliedAt time.Time
+	history   []ConfigVersion // accepted configs, oldest first, bounded by Admin.HistorySize
+	version   int
+
+	// apply hot-applies a new configuration and returns the fields that need a restart
+	apply func(old, cfg *Config) []string
+	// running, when set, checks a candidate against the running state
+	running func(cfg *Config) error
+}
+
+// NewConfigManager wraps an already applied configuration
+func NewConfigManager(path string, cfg *Config, apply func(old, cfg *Config) []string) *ConfigManager {
+	m := &ConfigManager{
+		path:      path,
+		current:   cfg,
+		accepted:  cloneConfig(cfg),
+		appliedAt: time.Now(),
+		apply:     apply,
+	}
+	m.record(cfg, "startup")
+	return m
+}
+
+// Current returns a deep copy of the configuration the process runs
+func (m *ConfigManager) Current() *Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return cloneConfig(m.current)
+}
+
+// Accepted returns a deep copy of the latest accepted configuration. It
+// differs from Current in the sections that take effect after a restart,
+// and is what config changes are based on.
+func (m *ConfigManager) Accepted() *Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return cloneConfig(m.accepted)
+}
+
+// RestartRequired returns the sections of the accepted configuration that
+// only take effect after a restart
+func (m *ConfigManager) RestartRequired() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.pending)
+}
+
+// Check validates a candidate configuration
+func (m *ConfigManager) Check(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if m.running != nil {
+		return m.running(cfg)
+	}
+	return nil
+}
+
+// Update validates, persists and applies a new configuration.
+// source describes who applied it and is kept in the version history.
+// It returns the config fields that only take effect after a restart.
+func (m *ConfigManager) Update(cfg *Config, source string) (restartRequired []string, persisted bool, err error) {
+	return m.Modify(source, func(*Config) (*Config, error) { return cfg, nil })
+}
+
+// Modify builds a new configuration from the accepted one with change,
+// then validates, persists and applies it like Update. change runs under
+// the manager's lock, so no other change lands between what it sees and
+// what is applied; an error from it cancels the change. Nothing is applied
+// when the config file cannot be written.
+func (m *ConfigManager) Modify(source string, change func(accepted *Config) (*Config, error)) (restartRequired []string, persisted bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg, err := change(cloneConfig(m.accepted))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := m.Check(cfg); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", errConfigInvalid, err)
+	}
+
+	switch {
+	case m.path == "":
+	case len(cfg.Include) > 0:
+		// Writing the merged config back would duplicate the included sections
+		log.Printf("⚠️ Config uses include directives; runtime changes are not written to %s", m.path)
+	default:
+		if err := writeConfigAtomic(m.path, cfg); err != nil {
+			return nil, false, fmt.Errorf("%w: %v", errConfigNotPersisted, err)
+		}
+		persisted = true
+	}
+	return m.applyLocked(cfg, source), persisted, nil
+}
+
+// Apply validates and applies a configuration without writing it to the
+// config file, for settings kept elsewhere such as Kubernetes resources
+func (m *ConfigManager) Apply(cfg *Config, source string) (restartRequired []string, err error) {
+	if err := m.Check(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errConfigInvalid, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.applyLocked(cfg, source), nil
+}
+
+// applyLocked applies cfg against what runs and records it; the sections
+// needing a restart keep their running values in current. Callers hold mu.
+func (m *ConfigManager) applyLocked(cfg *Config, source string) []string {
+	restartRequired := m.apply(m.current, cfg)
+	m.current = runningConfig(m.current, cfg, restartRequired)
+	m.accepted = cloneConfig(cfg)
+	m.pending = restartRequired
+	m.appliedAt = time.Now()
+	m.record(cfg, source)
+	return restartRequired
+}
+
+// runningConfig returns cfg with the sections named by restartRequired, as
+// applyConfig reports them, taken from running: what the process runs
+// until it restarts
+func runningConfig(running, cfg *Config, restartRequired []string) *Config {
+	out, old := cloneConfig(cfg), cloneConfig(running)
+	for _, section := range restartRequired {
+		switch section {
+		case "server":
+			out.Server = old.Server
+		case "qpack":
+			out.QPACK = old.QPACK
+		case "admin":
+			historySize := out.Admin.HistorySize
+			out.Admin = old.Admin
+			out.Admin.HistorySize = historySize
+		case "timeouts":
+			out.Timeouts.ReadHeader, out.Timeouts.Idle = old.Timeouts.ReadHeader, old.Timeouts.Idle
+		case "header_limits":
+			out.HeaderLimits.MaxTotalBytes = old.HeaderLimits.MaxTotalBytes
+		case "upstream.transport":
+			out.Upstream.Transport = old.Upstream.Transport
+		case "routing_state":
+			out.RoutingState = old.RoutingState
+		case "cluster_sync":
+			out.ClusterSync = old.ClusterSync
+		case "kubernetes":
+			out.Kubernetes = old.Kubernetes
+		case "session_state":
+			out.SessionState = old.SessionState
+		case "tls":
+			out.TLS, out.TLSProfiles = old.TLS, old.TLSProfiles
+		case "quic_lb":
+			out.QUICLB = old.QUICLB
+		case "features.udp_l4":
+			out.Features.UDPL4 = old.Features.UDPL4
+		}
+	}
+	return out
+}
+
+// configErrorStatus returns the HTTP status answering a failed config change
+func configErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errConfigForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errConfigInvalid):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// applyConfig hot-applies the parts of cfg that can change at runtime
+// (pools, virtual hosts, backend sets) and reports fields that need a restart.
+func (s *Server) applyConfig(old, cfg *Config) []string {
+	var restartRequired []string
+	if old.Server != cfg.Server {
+		restartRequired = append(restartRequired, "server")
+	}
+	if old.QPACK != cfg.QPACK {
+		restartRequired = append(restartRequired, "qpack")
+	}
+	// The admin listener and its credentials are set up once; history_size applies at once
+	oldAdmin, newAdmin := old.Admin, cfg.Admin
+	oldAdmin.HistorySize, newAdmin.HistorySize = 0, 0
+	if !reflect.DeepEqual(oldAdmin, newAdmin) {
+		restartRequired = append(restartRequired, "admin")
+	}
+	if old.Timeouts.ReadHeader != cfg.Timeouts.ReadHeader || old.Timeouts.Idle != cfg.Timeouts.Idle {
+		restartRequired = append(restartRequired, "timeouts")
+	}
+	if old.HeaderLimits.MaxTotalBytes != cfg.HeaderLimits.MaxTotalBytes {
+		restartRequired = append(restartRequired, "header_limits")
+	}
+	if old.Upstream.Transport != cfg.Upstream.Transport {
+		restartRequired = append(restartRequired, "upstream.transport")
+	}
+	if old.RoutingState != cfg.RoutingState {
+		restartRequired = append(restartRequired, "routing_state")
+	}
+	if old.ClusterSync != cfg.ClusterSync {
+		restartRequired = append(restartRequired, "cluster_sync")
+	}
+	if old.Kubernetes != cfg.Kubernetes {
+		restartRequired = append(restartRequired, "kubernetes")
+	}
+	if old.SessionState != cfg.SessionState {
+		restartRequired = append(restartRequired, "session_state")
+	}
+	if !reflect.DeepEqual(old.TLS, cfg.TLS) || !reflect.DeepEqual(old.TLSProfiles, cfg.TLSProfiles) {
+		restartRequired = append(restartRequired, "tls")
+	}
+
+	if cfg.QUICLB != old.QUICLB {
+		if cfg.QUICLB.ConfigRotationBits == old.QUICLB.ConfigRotationBits {
+			// Changing parameters in place would make live CIDs undecodable
+			restartRequired = append(restartRequired, "quic_lb")
+		} else if !s.cluster.mayRotate() {
+			// Followers apply the leader's rotations, not their own
+			log.Printf("🗳️ QUIC-LB rotation to %d left to the cluster leader %q", cfg.QUICLB.ConfigRotationBits, s.cluster.leaderName())
+		} else if err := s.rotateQUICLBConfig(&cfg.QUICLB); err != nil {
+			log.Printf("⚠️ QUIC-LB config rotation failed: %v", err)
+			restartRequired = append(restartRequired, "quic_lb")
+		} else {
+			s.cluster.announce(cfg.QUICLB)
+		}
+	}
+
+	// Pools, backends, algorithms, session cookies and health checks
+	s.upstream.Configure(cfg.Upstream)
+	s.cache.Configure(cfg.Cache)
+	s.rateLimiter.Configure(cfg.RateLimit)
+	s.admission.Configure(cfg.Admission)
+	s.access.Configure(cfg.Access)
+	s.geoip.Configure(cfg.GeoIP)
+	s.addressValidation.Configure(cfg.AddressValidation)
+	s.clientLimits.Configure(cfg.ClientLimits)
+	s.plugins.Configure(cfg.Plugins)
+	s.jwt.Configure(s.ctx, cfg.JWT)
+	s.forwardAuth.Configure(cfg.ForwardAuth)
+	s.responseHeaders.Configure(cfg.ResponseHeaders, cfg.SecurityHeaders)
+	s.requestValidator.Configure(cfg.RequestValidation)
+	s.timeouts.Configure(cfg.Timeouts)
+	s.basicAuth.Configure(cfg.BasicAuth)
+	s.authFailures.Configure(cfg.AuthFailures)
+	s.bots.Configure(cfg.Bots)
+	s.headerLimits.Configure(cfg.HeaderLimits)
+	s.applyServerIDs(cfg.ServerIDs)
+	s.pools.Apply(cfg)
+	s.memory.Configure(cfg.Memory)
+	s.moodle.Configure(cfg.Moodle)
+	s.agents.Configure(cfg.Agents)
+	s.faults.Configure(cfg.Faults)
+	s.applyFaultedBackends()
+	s.experiments.Configure(cfg.Experiments)
+	s.udpL4.Configure(cfg.UDPL4)
+	if routingChanged(old, cfg) && !cfg.Drain.SkipPoolChange {
+		s.drainer.Drain(s.ctx, "pool configuration changed")
+	}
+
+	if cfg.Priority != old.Priority {
+		s.priority.SetLimit(cfg.Priority.MaxConcurrentStreams)
+		log.Printf("🚦 Priority scheduling: %d concurrent streams per connection", cfg.Priority.MaxConcurrentStreams)
+	}
+
+	s.applyAltSvc(cfg)
+
+	restartRequired = append(restartRequired, s.applyFeatures(cfg.Features)...)
+
+	return restartRequired
+}
+
+// rotateQUICLBConfig installs new QUIC-LB parameters under their own config
+// rotation bits and makes them active; CIDs issued under the previous config
+// remain routable.
+func (s *Server) rotateQUICLBConfig(settings *QUICLBSettings) error {
+	config, err := settings.ToQUICLBConfig()
+	if err != nil {
+		return err
+	}
+	if err := s.quicLB.AddConfig(config); err != nil {
+		return err
+	}
+	if err := s.quicLB.SetActiveConfig(config.ConfigRotationBits); err != nil {
+		return err
+	}
+	s.cluster.setActive(*settings)
+	log.Printf("🔑 QUIC-LB config rotated to %d (%s)", config.ConfigRotationBits, config.Algorithm)
+	return nil
+}
+
+// writeConfigAtomic writes cfg to path, replacing the file atomically
+func writeConfigAtomic(path string, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// cloneConfig deep-copies a configuration through its JSON form
+func cloneConfig(cfg *Config) *Config {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg
+	}
+	clone := &Config{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		return cfg
+	}
+	return clone
+}
+
+// handleAdminConfig serves GET/PUT /api/admin/config
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		s.config.mu.RLock()
+		appliedAt := s.config.appliedAt
+		path := s.config.path
+		s.config.mu.RUnlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"config":           redactConfig(s.config.Accepted()),
+			"path":             path,
+			"applied_at":       appliedAt,
+			"restart_required": s.config.RestartRequired(),
+		})
+
+	case http.MethodPut:
+		newConfig := DefaultConfig()
+		newConfig.Backends = nil
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(newConfig); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		restartRequired, persisted, err := s.config.Modify("admin-api", func(accepted *Config) (*Config, error) {
+			// Secrets come back redacted when the config was fetched from here
+			restoreRedacted(newConfig, accepted)
+			return newConfig, configChangeAllowed(r, accepted, newConfig)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), configErrorStatus(err))
+			return
+		}
+
+		log.Printf("⚙️ Configuration updated via admin API (persisted: %v)", persisted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":          "Configuration applied",
+			"config":           redactConfig(s.config.Accepted()),
+			"persisted":        persisted,
+			"restart_required": restartRequired,
+		})
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestConfigManager manages DefaultConfig, written to a file in a
+// temporary directory; apply reports the sections in restart as needing a
+// restart whenever they change
+func newTestConfigManager(t *testing.T, restart ...string) (*ConfigManager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	cfg := DefaultConfig()
+	if err := writeConfigAtomic(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	apply := func(old, cfg *Config) []string {
+		var restartRequired []string
+		for _, section := range restart {
+			if slices.ContainsFunc(diffConfigs(old, cfg), func(c ConfigChange) bool { return strings.HasPrefix(c.Path, section+".") }) {
+				restartRequired = append(restartRequired, section)
+			}
+		}
+		return restartRequired
+	}
+	return NewConfigManager(path, cfg, apply), path
+}
+
+// A config that cannot be written is not applied either
+func TestConfigManagerPersistsBeforeApplying(t *testing.T) {
+	m, path := newTestConfigManager(t)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err) // a directory cannot be replaced by the config file
+	}
+
+	cfg := m.Accepted()
+	cfg.LoadBalancer.Algorithm = "least-connections"
+	_, persisted, err := m.Update(cfg, "test")
+	if !errors.Is(err, errConfigNotPersisted) {
+		t.Fatalf("Update: %v, want errConfigNotPersisted", err)
+	}
+	if persisted {
+		t.Error("reported persisted")
+	}
+	if got := m.Current().LoadBalancer.Algorithm; got != "round-robin" {
+		t.Errorf("running algorithm %q after a failed write, want round-robin", got)
+	}
+	if got := m.Accepted().LoadBalancer.Algorithm; got != "round-robin" {
+		t.Errorf("accepted algorithm %q after a failed write, want round-robin", got)
+	}
+	if versions := m.Versions(); len(versions) != 1 {
+		t.Errorf("%d versions recorded, want only startup", len(versions))
+	}
+}
+
+// Sections needing a restart are accepted and persisted but keep running
+// with their old values
+func TestConfigManagerKeepsRestartSectionsRunning(t *testing.T) {
+	m, path := newTestConfigManager(t, "server")
+
+	cfg := m.Accepted()
+	cfg.Server.ListenAddr = ":10443"
+	cfg.LoadBalancer.Algorithm = "least-connections"
+	restartRequired, persisted, err := m.Update(cfg, "test")
+	if err != nil || !persisted {
+		t.Fatalf("Update: persisted %v, %v", persisted, err)
+	}
+	if !slices.Equal(restartRequired, []string{"server"}) || !slices.Equal(m.RestartRequired(), []string{"server"}) {
+		t.Errorf("restart required %v, pending %v, want [server]", restartRequired, m.RestartRequired())
+	}
+	running, accepted := m.Current(), m.Accepted()
+	if running.Server.ListenAddr != ":9443" || running.LoadBalancer.Algorithm != "least-connections" {
+		t.Errorf("running listen_addr %q algorithm %q, want :9443 and least-connections", running.Server.ListenAddr, running.LoadBalancer.Algorithm)
+	}
+	if accepted.Server.ListenAddr != ":10443" {
+		t.Errorf("accepted listen_addr %q, want :10443", accepted.Server.ListenAddr)
+	}
+	saved, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Server.ListenAddr != ":10443" {
+		t.Errorf("config file listen_addr %q, want :10443", saved.Server.ListenAddr)
+	}
+
+	// Changing it back to what runs needs no restart any more
+	cfg.Server.ListenAddr = ":9443"
+	if restartRequired, _, err = m.Update(cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(restartRequired) != 0 || len(m.RestartRequired()) != 0 {
+		t.Errorf("restart required %v, pending %v after reverting, want none", restartRequired, m.RestartRequired())
+	}
+}
+
+// Concurrent changes each see the one before, so none is lost
+func TestConfigManagerModifySerializesChanges(t *testing.T) {
+	m, _ := newTestConfigManager(t)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := m.Modify("test", func(cfg *Config) (*Config, error) {
+				cfg.Access.Deny = append(cfg.Access.Deny, fmt.Sprintf("192.0.2.%d", i))
+				return cfg, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if deny := m.Accepted().Access.Deny; len(deny) != 20 {
+		t.Errorf("%d deny entries after 20 concurrent additions: %v", len(deny), deny)
+	}
+}
+
+// A change refused by its callback or by validation leaves the config alone
+func TestConfigManagerModifyRefused(t *testing.T) {
+	m, _ := newTestConfigManager(t)
+	refused := errors.New("refused")
+	if _, _, err := m.Modify("test", func(cfg *Config) (*Config, error) { return cfg, refused }); !errors.Is(err, refused) {
+		t.Errorf("Modify: %v, want the callback's error", err)
+	}
+	_, _, err := m.Modify("test", func(cfg *Config) (*Config, error) {
+		cfg.LoadBalancer.Algorithm = "no-such-algorithm"
+		return cfg, nil
+	})
+	if !errors.Is(err, errConfigInvalid) || configErrorStatus(err) != 422 {
+		t.Errorf("Modify: %v, want errConfigInvalid answered with 422", err)
+	}
+	if versions := m.Versions(); len(versions) != 1 {
+		t.Errorf("%d versions recorded, want only startup", len(versions))
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin CSRF defaults
+const (
+	adminCSRFHeader   = "X-CSRF-Token"
+	adminCSRFTokenTTL = 12 * time.Hour
+)
+
+// validAdminOrigin reports whether origin is a scheme://host[:port] origin
+func validAdminOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
+
+// adminPrincipalKey carries the authenticated admin client of a request
+type adminPrincipalKey struct{}
+
+// AdminCSRF protects admin requests that change state from cross-site
+// request forgery. Browsers attach client certificates and cookies to
+// requests any page makes, so mutating requests from other origins are
+// refused, and those authenticated by a certificate alone need a token
+// fetched from /api/admin/csrf-token. Bearer tokens and API keys travel
+// in headers other sites cannot set.
+type AdminCSRF struct {
+	key []byte
+}
+
+// NewAdminCSRF creates CSRF protection with a random token key; tokens do
+// not survive restarts
+func NewAdminCSRF() *AdminCSRF {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &AdminCSRF{key: key}
+}
+
+// token returns a token for principal valid until expiry, "<expiry>.<signature>"
+func (c *AdminCSRF) token(principal string, expiry int64) string {
+	mac := hmac.New(sha256.New, c.key)
+	fmt.Fprintf(mac, "%s|%d", principal, expiry)
+	return strconv.FormatInt(expiry, 10) + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verify reports whether token was issued to principal and has not expired
+func (c *AdminCSRF) verify(token, principal string) bool {
+	expiryText, _, _ := strings.Cut(token, ".")
+	expiry, err := strconv.ParseInt(expiryText, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(c.token(principal, expiry)))
+}
+
+// crossOrigin returns why a mutating request comes from another site, or ""
+// when it is same-origin, from an allowed origin or not from a browser.
+// Browsers send Sec-Fetch-Site; older ones only Origin, non-browser
+// clients usually neither.
+func crossOrigin(r *http.Request, allowed []string) string {
+	origin := r.Header.Get("Origin")
+	if origin != "" && slices.Contains(allowed, origin) {
+		return ""
+	}
+	switch site := r.Header.Get("Sec-Fetch-Site"); site {
+	case "same-origin", "none":
+		return ""
+	case "":
+	default:
+		return "Sec-Fetch-Site " + site
+	}
+	if origin == "" {
+		return ""
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return ""
+	}
+	return "Origin " + origin
+}
+
+// handleAdminCSRFToken serves GET /api/admin/csrf-token with a token for
+// the authenticated client, to send in X-CSRF-Token on changes
+func (s *Server) handleAdminCSRFToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	principal, _ := r.Context().Value(adminPrincipalKey{}).(*adminPrincipal)
+	if principal == nil {
+		http.Error(w, "No authenticated admin client", http.StatusForbidden)
+		return
+	}
+	expiry := time.Now().Add(adminCSRFTokenTTL)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     s.adminCSRF.token(principal.name, expiry.Unix()),
+		"header":    adminCSRFHeader,
+		"expires":   expiry,
+		"timestamp": time.Now(),
+	})
+}
+
+// check refuses mutating admin requests from other origins and, when the
+// client did not present a token or key, without a valid CSRF token. It
+// reports whether r may proceed.
+func (c *AdminCSRF) check(w http.ResponseWriter, r *http.Request, cfg AdminConfig, principal *adminPrincipal, headerCredentials bool) bool {
+	if why := crossOrigin(r, cfg.AllowedOrigins); why != "" {
+		log.Printf("🔒 Refused cross-origin admin %s %s from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, why)
+		http.Error(w, "Forbidden: cross-origin request", http.StatusForbidden)
+		return false
+	}
+	if headerCredentials {
+		return true
+	}
+	if !c.verify(r.Header.Get(adminCSRFHeader), principal.name) {
+		log.Printf("🔒 Refused admin %s %s from %s by %s: missing or invalid %s", r.Method, r.URL.Path, r.RemoteAddr, principal.name, adminCSRFHeader)
+		http.Error(w, fmt.Sprintf("Forbidden: %s required, fetch one from /api/admin/csrf-token", adminCSRFHeader), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminCSRFToken(t *testing.T) {
+	c := NewAdminCSRF()
+	expiry := time.Now().Add(time.Hour).Unix()
+	token := c.token("certificate ops", expiry)
+
+	tests := []struct {
+		name      string
+		token     string
+		principal string
+		valid     bool
+	}{
+		{"issued token", token, "certificate ops", true},
+		{"other principal", token, "certificate dev", false},
+		{"expired", c.token("certificate ops", time.Now().Add(-time.Second).Unix()), "certificate ops", false},
+		{"extended expiry", strconv.FormatInt(expiry+3600, 10) + token[strings.Index(token, "."):], "certificate ops", false},
+		{"other key", NewAdminCSRF().token("certificate ops", expiry), "certificate ops", false},
+		{"empty", "", "certificate ops", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := c.verify(tt.token, tt.principal); valid != tt.valid {
+				t.Errorf("valid %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCrossOrigin(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    map[string]string
+		crossSite bool
+	}{
+		{"no browser headers", nil, false},
+		{"same-origin fetch", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://admin.example"}, false},
+		{"typed into the address bar", map[string]string{"Sec-Fetch-Site": "none"}, false},
+		{"cross-site fetch", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, true},
+		{"same-site fetch", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "https://www.admin.example"}, true},
+		{"allowed origin", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://ops.example.org"}, false},
+		{"same host without Sec-Fetch-Site", map[string]string{"Origin": "https://admin.example"}, false},
+		{"other host without Sec-Fetch-Site", map[string]string{"Origin": "https://evil.example"}, true},
+		{"opaque origin", map[string]string{"Origin": "null"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://admin.example/api/config", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if why := crossOrigin(r, []string{"https://ops.example.org"}); (why != "") != tt.crossSite {
+				t.Errorf("cross-origin %q, want %v", why, tt.crossSite)
+			}
+		})
+	}
+}
+
+// withClientCert returns r as sent with a verified client certificate
+func withClientCert(r *http.Request, commonName string) *http.Request {
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+	return r
+}
+
+// Changes authenticated by a client certificate alone need a CSRF token
+// fetched by that client; bearer tokens do not, but neither may come from
+// another site
+func TestAdminAuthMiddlewareCSRF(t *testing.T) {
+	csrf := NewAdminCSRF()
+	cfg := AdminConfig{Token: "s3cret"}
+	cfg.ClientCerts = []AdminClientCert{{Identity: "ops", Scopes: []string{adminScopeAll}}}
+	h := adminAuthMiddleware(cfg, nil, csrf, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s := &Server{adminCSRF: csrf}
+	tokens := adminAuthMiddleware(cfg, nil, csrf, http.HandlerFunc(s.handleAdminCSRFToken))
+
+	w := httptest.NewRecorder()
+	tokens.ServeHTTP(w, withClientCert(httptest.NewRequest(http.MethodGet, "/api/admin/csrf-token", nil), "ops"))
+	var issued struct{ Token, Header string }
+	if err := json.NewDecoder(w.Body).Decode(&issued); err != nil || issued.Token == "" || issued.Header != adminCSRFHeader {
+		t.Fatalf("csrf-token answered %d: %+v (%v)", w.Code, issued, err)
+	}
+
+	tests := []struct {
+		name   string
+		r      func() *http.Request
+		status int
+	}{
+		{"certificate without token", func() *http.Request {
+			return withClientCert(httptest.NewRequest(http.MethodPost, "/api/config", nil), "ops")
+		}, http.StatusForbidden},
+		{"certificate with token", func() *http.Request {
+			r := withClientCert(httptest.NewRequest(http.MethodPost, "/api/config", nil), "ops")
+			r.Header.Set(adminCSRFHeader, issued.Token)
+			return r
+		}, http.StatusOK},
+		{"certificate with another client's token", func() *http.Request {
+			r := withClientCert(httptest.NewRequest(http.MethodPost, "/api/config", nil), "ops")
+			r.Header.Set(adminCSRFHeader, csrf.token("certificate dev", time.Now().Add(time.Hour).Unix()))
+			return r
+		}, http.StatusForbidden},
+		{"certificate with token from another site", func() *http.Request {
+			r := withClientCert(httptest.NewRequest(http.MethodPost, "/api/config", nil), "ops")
+			r.Header.Set(adminCSRFHeader, issued.Token)
+			r.Header.Set("Sec-Fetch-Site", "cross-site")
+			return r
+		}, http.StatusForbidden},
+		{"bearer token", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/api/config", nil)
+			r.Header.Set("Authorization", "Bearer s3cret")
+			return r
+		}, http.StatusOK},
+		{"bearer token from another site", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/api/config", nil)
+			r.Header.Set("Authorization", "Bearer s3cret")
+			r.Header.Set("Origin", "https://evil.example")
+			return r
+		}, http.StatusForbidden},
+		{"read with certificate", func() *http.Request {
+			return withClientCert(httptest.NewRequest(http.MethodGet, "/api/config", nil), "ops")
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.r())
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
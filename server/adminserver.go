@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin scopes of the endpoints that change state. Any scope allows reads,
+// "*" allows everything.
+const (
+	adminScopeRead    = "read"
+	adminScopeConfig  = "config"
+	adminScopeRouting = "routing"
+	adminScopeAccess  = "access"
+	adminScopeCache   = "cache"
+	adminScopeAgent   = "agent"
+	adminScopeAll     = "*"
+)
+
+// adminEndpointScopes maps mutating admin endpoints to the scope they need;
+// other mutating requests need "*"
+var adminEndpointScopes = map[string]string{
+	"/api/admin/config":           adminScopeConfig,
+	"/api/admin/config/rollback":  adminScopeConfig,
+	"/api/quic-lb/config":         adminScopeConfig,
+	"/api/loadbalancer/algorithm": adminScopeRouting,
+	"/api/access":                 adminScopeAccess,
+	"/api/cache/purge":            adminScopeCache,
+	"/api/agents/register":        adminScopeAgent,
+	"/api/agents/report":          adminScopeAgent,
+	"/api/agents/deregister":      adminScopeAgent,
+}
+
+// adminCredentialSections are the config sections holding credentials,
+// deciding who gets in or loading code and secrets from the host; changing
+// them through the config endpoints takes "*", so a "config" key cannot
+// grant itself more
+var adminCredentialSections = map[string]bool{
+	"admin":         true,
+	"tls":           true,
+	"tls_profiles":  true,
+	"jwt":           true,
+	"forward_auth":  true,
+	"basic_auth":    true,
+	"session_state": true,
+	"quic_lb":       true,
+	"plugins":       true,
+	"server":        true,
+	"kubernetes":    true,
+	"cluster_sync":  true,
+	"routing_state": true,
+}
+
+// credentialChanges returns the changed settings of the credential sections
+// between two configs
+func credentialChanges(from, to *Config) []string {
+	var paths []string
+	for _, change := range diffConfigs(from, to) {
+		section, _, _ := strings.Cut(change.Path, ".")
+		section, _, _ = strings.Cut(section, "[")
+		if adminCredentialSections[section] {
+			paths = append(paths, change.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// errConfigForbidden refuses a config change the admin client's scopes do
+// not cover
+var errConfigForbidden = errors.New("forbidden")
+
+// configChangeAllowed refuses a config change touching the credential
+// sections unless the admin client holds "*"
+func configChangeAllowed(r *http.Request, from, to *Config) error {
+	changed := credentialChanges(from, to)
+	if len(changed) == 0 {
+		return nil
+	}
+	principal, _ := r.Context().Value(adminPrincipalKey{}).(*adminPrincipal)
+	if principal != nil && principal.allows(adminScopeAll) {
+		return nil
+	}
+	name := "anonymous"
+	if principal != nil {
+		name = principal.name
+	}
+	log.Printf("🔒 Refused admin %s %s from %s: %s lacks the %q scope to change %s", r.Method, r.URL.Path, r.RemoteAddr, name, adminScopeAll, strings.Join(changed, ", "))
+	return fmt.Errorf("%w: the %q scope is required to change %s", errConfigForbidden, adminScopeAll, strings.Join(changed, ", "))
+}
+
+// validateAdminScopes checks the scopes of an API key or client certificate
+func validateAdminScopes(prefix string, scopes []string) []error {
+	if len(scopes) == 0 {
+		return []error{fmt.Errorf("%s needs at least one scope", prefix)}
+	}
+	var errs []error
+	for _, scope := range scopes {
+		switch scope {
+		case adminScopeRead, adminScopeConfig, adminScopeRouting, adminScopeAccess, adminScopeCache, adminScopeAgent, adminScopeAll:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown scope %q", prefix, scope))
+		}
+	}
+	return errs
+}
+
+// adminScopeFor returns the scope r needs
+func adminScopeFor(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return adminScopeRead
+	}
+	if scope, ok := adminEndpointScopes[r.URL.Path]; ok {
+		return scope
+	}
+	return adminScopeAll
+}
+
+// adminPrincipal is an authenticated admin client
+type adminPrincipal struct {
+	name   string
+	scopes []string
+}
+
+// allows reports whether the principal holds scope
+func (p *adminPrincipal) allows(scope string) bool {
+	for _, held := range p.scopes {
+		if held == adminScopeAll || held == scope || scope == adminScopeRead {
+			return true
+		}
+	}
+	return false
+}
+
+// adminKey is a resolved API key
+type adminKey struct {
+	key       []byte
+	principal *adminPrincipal
+}
+
+// newAdminServer builds the HTTP server for the dedicated admin listener.
+// Requests must carry the configured bearer token or an API key and, when a
+// client CA is configured, a client certificate signed by it. Changes are
+// protected against cross-site request forgery by csrf.
+func newAdminServer(cfg AdminConfig, csrf *AdminCSRF, handler http.Handler) (*http.Server, error) {
+	token, err := cfg.resolveToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin token: %v", err)
+	}
+	cfg.Token = token
+	keys := make([]adminKey, 0, len(cfg.APIKeys))
+	for _, k := range cfg.APIKeys {
+		key, err := k.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin API key %s: %v", k.Name, err)
+		}
+		keys = append(keys, adminKey{key: []byte(key), principal: &adminPrincipal{name: "key " + k.Name, scopes: k.Scopes}})
+	}
+	if token == "" && len(keys) == 0 && cfg.ClientCAFile == "" {
+		log.Printf("🔒 No admin credentials configured: the admin API is read-only until admin.api_keys, admin.token or admin.client_ca_file is set")
+	}
+
+	server := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           adminAuthMiddleware(cfg, keys, csrf, handler),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+
+	if cfg.CertFile == "" {
+		return server, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin certificate: %v", err)
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in admin client CA %s", cfg.ClientCAFile)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server, nil
+}
+
+// adminAuthMiddleware authenticates admin API requests by bearer token, API
+// key or client certificate and checks the scope of requests changing state.
+// The token and client certificates without client_certs entries keep full
+// access; without any credentials configured the API is read-only.
+// Changes must pass the CSRF checks.
+func adminAuthMiddleware(cfg AdminConfig, keys []adminKey, csrf *AdminCSRF, next http.Handler) http.Handler {
+	token := []byte(cfg.Token)
+	credentials := len(token) > 0 || len(keys) > 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, presented := adminKeyPrincipal(r, token, keys)
+		if presented && principal == nil {
+			rejectAdminRequest(w, r, "invalid credentials")
+			return
+		}
+		if !presented {
+			// Certificates listed in client_certs stand on their own,
+			// others still need the token or a key when those are set
+			var listed bool
+			principal, listed = adminCertPrincipal(r, cfg.ClientCerts)
+			if credentials && !listed {
+				rejectAdminRequest(w, r, "no credentials")
+				return
+			}
+		}
+		if principal == nil {
+			principal = &adminPrincipal{name: "anonymous", scopes: []string{adminScopeRead}}
+		}
+
+		scope := adminScopeFor(r)
+		if !principal.allows(scope) {
+			log.Printf("🔒 Refused admin %s %s from %s: %s lacks the %q scope", r.Method, r.URL.Path, r.RemoteAddr, principal.name, scope)
+			http.Error(w, fmt.Sprintf("Forbidden: the %q scope is required", scope), http.StatusForbidden)
+			return
+		}
+		if scope != adminScopeRead {
+			if !csrf.check(w, r, cfg, principal, presented) {
+				return
+			}
+			log.Printf("🔑 Admin %s %s from %s by %s", r.Method, r.URL.Path, r.RemoteAddr, principal.name)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal)))
+	})
+}
+
+// rejectAdminRequest answers an unauthenticated admin request
+func rejectAdminRequest(w http.ResponseWriter, r *http.Request, why string) {
+	log.Printf("🔒 Rejected unauthenticated admin request from %s: %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, why)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="quic-lb-admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// adminKeyPrincipal matches the bearer token or X-API-Key header against the
+// token and the API keys, reporting whether one was presented
+func adminKeyPrincipal(r *http.Request, token []byte, keys []adminKey) (*adminPrincipal, bool) {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		presented = r.Header.Get("X-API-Key")
+	}
+	if presented == "" {
+		return nil, false
+	}
+	if len(token) > 0 && subtle.ConstantTimeCompare([]byte(presented), token) == 1 {
+		return &adminPrincipal{name: "admin token", scopes: []string{adminScopeAll}}, true
+	}
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), k.key) == 1 {
+			return k.principal, true
+		}
+	}
+	return nil, true
+}
+
+// adminCertPrincipal returns the principal of a verified client
+// certificate and whether client_certs lists it. Without entries
+// certificates get full access, unlisted ones only read.
+func adminCertPrincipal(r *http.Request, certs []AdminClientCert) (*adminPrincipal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if len(certs) == 0 {
+		return &adminPrincipal{name: "certificate " + leaf.Subject.CommonName, scopes: []string{adminScopeAll}}, false
+	}
+	identities := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	identities = append(identities, leaf.EmailAddresses...)
+	for _, u := range leaf.URIs {
+		identities = append(identities, u.String())
+	}
+	for _, cert := range certs {
+		for _, identity := range identities {
+			if identity != "" && identity == cert.Identity {
+				return &adminPrincipal{name: "certificate " + identity, scopes: cert.Scopes}, true
+			}
+		}
+	}
+	return &adminPrincipal{name: "certificate " + leaf.Subject.CommonName, scopes: []string{adminScopeRead}}, false
+}
+
+// readOnlyHandler exposes an admin handler on the public listener for GET/HEAD only
+func readOnlyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed on the public listener; use the admin listener", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
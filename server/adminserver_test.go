@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withPrincipal returns r as authenticated by an admin client holding scopes
+func withPrincipal(r *http.Request, scopes ...string) *http.Request {
+	principal := &adminPrincipal{name: "test", scopes: scopes}
+	return r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal))
+}
+
+// Sections holding credentials or loading code and secrets take "*"
+func TestConfigChangeAllowedScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		scopes  []string
+		allowed bool
+	}{
+		{"ordinary section with config", func(c *Config) { c.LoadBalancer.Algorithm = "least-connections" }, []string{adminScopeConfig}, true},
+		{"admin with config", func(c *Config) { c.Admin.HistorySize++ }, []string{adminScopeConfig}, false},
+		{"quic_lb key_ref with config", func(c *Config) { c.QUICLB.KeyRef = "file:/etc/shadow" }, []string{adminScopeConfig}, false},
+		{"plugins with config", func(c *Config) { c.Plugins = append(c.Plugins, PluginConfig{Name: "p", Path: "/tmp/p.so"}) }, []string{adminScopeConfig}, false},
+		{"server with config", func(c *Config) { c.Server.ListenAddr = ":10443" }, []string{adminScopeConfig}, false},
+		{"kubernetes with config", func(c *Config) { c.Kubernetes.Enabled = !c.Kubernetes.Enabled }, []string{adminScopeConfig}, false},
+		{"cluster_sync with config", func(c *Config) { c.ClusterSync.InstanceID = "other" }, []string{adminScopeConfig}, false},
+		{"routing_state with config", func(c *Config) { c.RoutingState.Path = "/tmp/state.json" }, []string{adminScopeConfig}, false},
+		{"server with *", func(c *Config) { c.Server.ListenAddr = ":10443" }, []string{adminScopeAll}, true},
+		{"anonymous", func(c *Config) { c.Server.ListenAddr = ":10443" }, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := DefaultConfig()
+			to := cloneConfig(from)
+			tt.change(to)
+			r := httptest.NewRequest(http.MethodPut, "/api/admin/config", nil)
+			if tt.scopes != nil {
+				r = withPrincipal(r, tt.scopes...)
+			}
+			err := configChangeAllowed(r, from, to)
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, errConfigForbidden) {
+				t.Errorf("got %v, want errConfigForbidden", err)
+			}
+		})
+	}
+}
+
+// POST /api/quic-lb/config goes through the config manager and its scope
+// check instead of installing the parameters directly
+func TestQUICLBConfigPostNeedsScope(t *testing.T) {
+	m, _ := newTestConfigManager(t)
+	s := &Server{config: m}
+	body := `{"key_ref": "hex:000102030405060708090a0b0c0d0e0f"}`
+
+	w := httptest.NewRecorder()
+	r := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/quic-lb/config", strings.NewReader(body)), adminScopeConfig)
+	s.handleQUICLBConfig(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("config scope: status %d, want 403", w.Code)
+	}
+	if got := m.Accepted().QUICLB.KeyRef; got != "" {
+		t.Errorf("key_ref %q accepted without the * scope", got)
+	}
+
+	w = httptest.NewRecorder()
+	r = withPrincipal(httptest.NewRequest(http.MethodPost, "/api/quic-lb/config", strings.NewReader(body)), adminScopeAll)
+	s.handleQUICLBConfig(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("* scope: status %d: %s", w.Code, w.Body)
+	}
+	accepted := m.Accepted().QUICLB
+	if accepted.KeyRef == "" || accepted.Algorithm != DefaultConfig().QUICLB.Algorithm {
+		t.Errorf("accepted %+v, want the key_ref merged into the other settings", accepted)
+	}
+	if versions := m.Versions(); len(versions) != 2 {
+		t.Errorf("%d versions recorded, want startup and the POST", len(versions))
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Admission control defaults
+const (
+	defaultAdmissionQueueTimeout = 2 * time.Second
+	defaultAdmissionRetryAfter   = 5 * time.Second
+	defaultBrownoutThreshold     = 0.8
+)
+
+// AdmissionConfig caps the requests proxied at once across all clients.
+// Requests above the cap wait in a bounded queue; when it is full or the
+// wait is too long they are shed with 503. Before the cap is reached, a
+// brownout sheds low-priority requests (reports, log views, cron pokes) so
+// course pages keep working under load.
+type AdmissionConfig struct {
+	MaxInFlight        int               `json:"max_in_flight,omitempty"`        // Requests proxied at once; 0 disables admission control
+	MaxQueue           int               `json:"max_queue,omitempty"`            // Requests waiting for a slot; more are shed right away
+	QueueTimeout       balancer.Duration `json:"queue_timeout,omitempty"`        // How long a request may wait for a slot, default 2s
+	RetryAfter         balancer.Duration `json:"retry_after,omitempty"`          // Retry-After sent with shed requests, default 5s
+	BrownoutThreshold  float64           `json:"brownout_threshold,omitempty"`   // Fraction of max_in_flight above which low-priority requests are shed, default 0.8
+	LowPriorityPaths   []string          `json:"low_priority_paths,omitempty"`   // Path prefixes shed first, e.g. "/report/", "/admin/cron.php"
+	LowPriorityUrgency int               `json:"low_priority_urgency,omitempty"` // RFC 9218 urgency from which requests count as low priority (1-7); 0 only uses paths
+}
+
+// validate checks the admission control settings
+func (ac *AdmissionConfig) validate() []error {
+	var errs []error
+	if ac.MaxInFlight < 0 || ac.MaxQueue < 0 {
+		errs = append(errs, fmt.Errorf("admission.max_in_flight and admission.max_queue must not be negative"))
+	}
+	if ac.QueueTimeout < 0 || ac.RetryAfter < 0 {
+		errs = append(errs, fmt.Errorf("admission timeouts must not be negative"))
+	}
+	if ac.BrownoutThreshold < 0 || ac.BrownoutThreshold > 1 {
+		errs = append(errs, fmt.Errorf("admission.brownout_threshold %.2f must be between 0 and 1", ac.BrownoutThreshold))
+	}
+	for i, p := range ac.LowPriorityPaths {
+		if !strings.HasPrefix(p, "/") {
+			errs = append(errs, fmt.Errorf("admission.low_priority_paths[%d] %q must start with /", i, p))
+		}
+	}
+	if ac.LowPriorityUrgency < 0 || ac.LowPriorityUrgency > maxUrgency {
+		errs = append(errs, fmt.Errorf("admission.low_priority_urgency %d must be between 0 and %d", ac.LowPriorityUrgency, maxUrgency))
+	}
+	return errs
+}
+
+// queueTimeout returns the configured queue timeout or its default
+func (ac *AdmissionConfig) queueTimeout() time.Duration {
+	if ac.QueueTimeout == 0 {
+		return defaultAdmissionQueueTimeout
+	}
+	return ac.QueueTimeout.Duration()
+}
+
+// retryAfter returns the configured Retry-After or its default
+func (ac *AdmissionConfig) retryAfter() time.Duration {
+	if ac.RetryAfter == 0 {
+		return defaultAdmissionRetryAfter
+	}
+	return ac.RetryAfter.Duration()
+}
+
+// brownoutAt returns the in-flight count from which the brownout starts
+func (ac *AdmissionConfig) brownoutAt() int {
+	threshold := ac.BrownoutThreshold
+	if threshold == 0 {
+		threshold = defaultBrownoutThreshold
+	}
+	return int(math.Ceil(threshold * float64(ac.MaxInFlight)))
+}
+
+// lowPriority reports whether r is shed during a brownout
+func (ac *AdmissionConfig) lowPriority(r *http.Request) bool {
+	for _, prefix := range ac.LowPriorityPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return ac.LowPriorityUrgency > 0 && parsePriority(r.Header).Urgency >= ac.LowPriorityUrgency
+}
+
+// AdmissionController counts in-flight requests and queues the excess
+type AdmissionController struct {
+	mu       sync.Mutex
+	cfg      AdmissionConfig
+	inFlight int
+	queue    *list.List // of chan struct{}, closed when the waiter got a slot
+	brownout time.Time  // when the current brownout started, zero outside one
+
+	admitted  int64
+	queued    int64
+	shed      map[string]int64 // reason -> requests
+	peak      int
+	brownouts int64
+}
+
+// NewAdmissionController creates a controller without a limit
+func NewAdmissionController() *AdmissionController {
+	return &AdmissionController{queue: list.New(), shed: make(map[string]int64)}
+}
+
+// Configure applies new limits; a raised limit admits waiting requests
+func (ac *AdmissionController) Configure(cfg AdmissionConfig) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.cfg = cfg
+	for ac.queue.Len() > 0 && (cfg.MaxInFlight == 0 || ac.inFlight < cfg.MaxInFlight) {
+		ac.grantLocked()
+	}
+	ac.updateBrownoutLocked()
+}
+
+// grantLocked hands a slot to the longest waiting request
+func (ac *AdmissionController) grantLocked() {
+	waiter := ac.queue.Remove(ac.queue.Front()).(chan struct{})
+	ac.inFlight++
+	close(waiter)
+}
+
+// updateBrownoutLocked starts or ends the brownout as load crosses the threshold
+func (ac *AdmissionController) updateBrownoutLocked() {
+	active := ac.cfg.MaxInFlight > 0 && (ac.inFlight >= ac.cfg.brownoutAt() || ac.queue.Len() > 0)
+	switch {
+	case active && ac.brownout.IsZero():
+		ac.brownout = time.Now()
+		ac.brownouts++
+		log.Printf("🟠 Brownout: %d requests in flight (limit %d), shedding low-priority requests", ac.inFlight, ac.cfg.MaxInFlight)
+	case !active && !ac.brownout.IsZero():
+		log.Printf("🟢 Brownout over after %v", time.Since(ac.brownout).Round(time.Millisecond))
+		ac.brownout = time.Time{}
+	}
+}
+
+// admit takes a slot for r, waiting in the queue when all are taken. It
+// answers shed requests with 503 and returns nil for them; otherwise call
+// the returned release once the request is done.
+func (ac *AdmissionController) admit(w http.ResponseWriter, r *http.Request) func() {
+	ac.mu.Lock()
+	cfg := ac.cfg
+	if cfg.MaxInFlight == 0 {
+		ac.mu.Unlock()
+		return func() {}
+	}
+
+	reason := ""
+	switch {
+	case !ac.brownout.IsZero() && cfg.lowPriority(r):
+		reason = "brownout"
+	case ac.inFlight < cfg.MaxInFlight && ac.queue.Len() == 0:
+		ac.takeLocked()
+		ac.mu.Unlock()
+		return ac.release
+	case ac.queue.Len() >= cfg.MaxQueue:
+		reason = "queue_full"
+	}
+	if reason != "" {
+		ac.shed[reason]++
+		ac.mu.Unlock()
+		ac.reject(w, r, cfg, reason)
+		return nil
+	}
+
+	waiter := make(chan struct{})
+	elem := ac.queue.PushBack(waiter)
+	ac.queued++
+	ac.updateBrownoutLocked()
+	ac.mu.Unlock()
+
+	timer := time.NewTimer(cfg.queueTimeout())
+	defer timer.Stop()
+	select {
+	case <-waiter:
+		ac.mu.Lock()
+		ac.admitted++
+		ac.peak = max(ac.peak, ac.inFlight)
+		ac.mu.Unlock()
+		return ac.release
+	case <-timer.C:
+		reason = "queue_timeout"
+	case <-r.Context().Done():
+		reason = "client_gone"
+	}
+
+	ac.mu.Lock()
+	ac.shed[reason]++
+	select {
+	case <-waiter:
+		// Granted while giving up; pass the slot on
+		ac.mu.Unlock()
+		ac.release()
+	default:
+		ac.queue.Remove(elem)
+		ac.updateBrownoutLocked()
+		ac.mu.Unlock()
+	}
+	if reason != "client_gone" {
+		ac.reject(w, r, cfg, reason)
+	}
+	return nil
+}
+
+// takeLocked counts an admitted request
+func (ac *AdmissionController) takeLocked() {
+	ac.inFlight++
+	ac.admitted++
+	ac.peak = max(ac.peak, ac.inFlight)
+	ac.updateBrownoutLocked()
+}
+
+// release frees a slot, handing it to the next waiting request
+func (ac *AdmissionController) release() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.inFlight--
+	if ac.queue.Len() > 0 && ac.inFlight < ac.cfg.MaxInFlight {
+		ac.grantLocked()
+	}
+	ac.updateBrownoutLocked()
+}
+
+// reject sheds a request with 503 and Retry-After
+func (ac *AdmissionController) reject(w http.ResponseWriter, r *http.Request, cfg AdmissionConfig, reason string) {
+	retryAfter := int(math.Ceil(cfg.retryAfter().Seconds()))
+	log.Printf("🛑 Shed %s %s from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, reason)
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	http.Error(w, "🚫 Server overloaded, retry later", http.StatusServiceUnavailable)
+}
+
+// Snapshot reports in-flight and queued requests and shed counts
+func (ac *AdmissionController) Snapshot() map[string]interface{} {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	shed := make(map[string]int64, len(ac.shed))
+	for reason, n := range ac.shed {
+		shed[reason] = n
+	}
+	stats := map[string]interface{}{
+		"enabled":         ac.cfg.MaxInFlight > 0,
+		"max_in_flight":   ac.cfg.MaxInFlight,
+		"max_queue":       ac.cfg.MaxQueue,
+		"in_flight":       ac.inFlight,
+		"queued_now":      ac.queue.Len(),
+		"peak_in_flight":  ac.peak,
+		"admitted":        ac.admitted,
+		"queued":          ac.queued,
+		"shed":            shed,
+		"brownout_at":     ac.cfg.brownoutAt(),
+		"brownout_active": !ac.brownout.IsZero(),
+		"brownouts":       ac.brownouts,
+	}
+	if !ac.brownout.IsZero() {
+		stats["brownout_seconds"] = time.Since(ac.brownout).Seconds()
+	}
+	return stats
+}
+
+// handleAdmission serves GET /api/admission with load shedding metrics
+func (s *Server) handleAdmission(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.admission.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// admissionExempt reports whether r is a long-lived tunnel, which would
+// hold a slot for its whole lifetime
+func admissionExempt(r *http.Request) bool {
+	return r.Method == http.MethodConnect || isWebSocketUpgrade(r)
+}
+
+// acquireAdmission is admit for requests that are not exempt
+func (s *Server) acquireAdmission(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if admissionExempt(r) {
+		return func() {}, true
+	}
+	release := s.admission.admit(w, r)
+	return release, release != nil
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Agent registration defaults
+const (
+	defaultAgentTTL = 30 * time.Second
+	// agentReportsPerTTL is how often agents are asked to report within one
+	// TTL, so a lost report or two does not expire them
+	agentReportsPerTTL = 3
+)
+
+// AgentsConfig lets backend agents (cmd/quic-lb-agent) register their
+// backend with a pool, fetch the QUIC-LB configs with their server ID and
+// report the backend's health and load. Agents authenticate with an admin
+// API key holding the "agent" scope. Backends an agent added leave the pool
+// when the agent deregisters or stops reporting for a TTL; registrations
+// are applied, not written to the config file, and agents register again
+// after a restart.
+type AgentsConfig struct {
+	Enabled bool              `json:"enabled"`
+	TTL     balancer.Duration `json:"ttl,omitempty"`   // How long a registration lasts without a report, default 30s
+	Pools   []string          `json:"pools,omitempty"` // Pools agents may join, default all
+}
+
+// validate checks the agent settings
+func (ac *AgentsConfig) validate() []error {
+	var errs []error
+	if ac.TTL < 0 {
+		errs = append(errs, fmt.Errorf("agents.ttl must not be negative"))
+	}
+	return errs
+}
+
+// ttl returns the configured registration lifetime or its default
+func (ac *AgentsConfig) ttl() time.Duration {
+	if ac.TTL == 0 {
+		return defaultAgentTTL
+	}
+	return time.Duration(ac.TTL)
+}
+
+// allowsPool reports whether agents may join pool
+func (ac *AgentsConfig) allowsPool(pool string) bool {
+	return len(ac.Pools) == 0 || slices.Contains(ac.Pools, pool)
+}
+
+// agentRegistration is the body of POST /api/agents/register and
+// /api/agents/deregister
+type agentRegistration struct {
+	Name string `json:"name"` // Host name of the backend, shown in /api/agents
+	Pool string `json:"pool"`
+	URL  string `json:"url"` // Backend URL as the load balancer reaches it
+}
+
+// agentReport is the body of POST /api/agents/report
+type agentReport struct {
+	Pool        string  `json:"pool"`
+	URL         string  `json:"url"`
+	Healthy     bool    `json:"healthy"`
+	Reason      string  `json:"reason,omitempty"` // Why the backend is unhealthy
+	Load1       float64 `json:"load1"`
+	CPUs        int     `json:"cpus"`
+	MemoryUsed  float64 `json:"memory_used_percent"`
+	Connections int     `json:"connections,omitempty"`
+}
+
+// agentQUICLBConfig is a QUIC-LB config handed to an agent, key included,
+// for its backend to issue connection IDs the load balancer can route
+type agentQUICLBConfig struct {
+	Algorithm               string `json:"algorithm"`
+	ConfigRotationBits      uint8  `json:"config_rotation_bits"`
+	ServerIDLen             uint8  `json:"server_id_len"`
+	ConnectionIDLen         uint8  `json:"connection_id_len"`
+	NonceLen                uint8  `json:"nonce_len"`
+	Key                     string `json:"key,omitempty"` // Hex
+	FirstOctetEncodesCIDLen bool   `json:"first_octet_encodes_cid_len"`
+	Active                  bool   `json:"active"`
+}
+
+// agentState is what is known of one registered agent
+type agentState struct {
+	agentRegistration
+	added      bool // the backend was added by the agent, not configured
+	registered time.Time
+	lastReport time.Time
+	report     *agentReport
+}
+
+// Agents tracks the registered backend agents
+type Agents struct {
+	mu     sync.Mutex
+	cfg    AgentsConfig
+	agents map[string]*agentState // pool + " " + URL -> agent
+}
+
+// NewAgents creates the agent registry, off until configured
+func NewAgents() *Agents {
+	return &Agents{agents: make(map[string]*agentState)}
+}
+
+// Configure applies new settings
+func (a *Agents) Configure(cfg AgentsConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg
+}
+
+// config returns the current settings
+func (a *Agents) config() AgentsConfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// agentKey identifies the agent of a backend
+func agentKey(pool, backendURL string) string {
+	return pool + " " + backendURL
+}
+
+// registerAgent adds the agent's backend to its pool unless it is
+// configured already and returns the backend
+func (s *Server) registerAgent(reg agentRegistration) (*balancer.Backend, error) {
+	cfg := s.agents.config()
+	if !cfg.Enabled {
+		return nil, fmt.Errorf("agents are not enabled")
+	}
+	if !cfg.allowsPool(reg.Pool) {
+		return nil, fmt.Errorf("agents may not join pool %q", reg.Pool)
+	}
+	u, err := url.Parse(reg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q is not an http or https URL", reg.URL)
+	}
+	reg.URL = u.String()
+
+	added := false
+	if !s.poolHasBackend(reg.Pool, reg.URL) {
+		current := s.config.Accepted()
+		if !addPoolBackend(current, reg.Pool, reg.URL) {
+			return nil, fmt.Errorf("pool %q does not exist", reg.Pool)
+		}
+		if _, err := s.config.Apply(current, "agent "+reg.Name); err != nil {
+			return nil, err
+		}
+		added = true
+		log.Printf("🛰️ Agent %q added %s to pool %s", reg.Name, u.Redacted(), reg.Pool)
+	}
+	backend := s.poolBackend(reg.Pool, reg.URL)
+	if backend == nil {
+		return nil, fmt.Errorf("backend %s did not join pool %q", u.Redacted(), reg.Pool)
+	}
+
+	s.agents.mu.Lock()
+	defer s.agents.mu.Unlock()
+	key := agentKey(reg.Pool, reg.URL)
+	if previous, ok := s.agents.agents[key]; ok {
+		added = added || previous.added
+	}
+	s.agents.agents[key] = &agentState{
+		agentRegistration: reg,
+		added:             added,
+		registered:        time.Now(),
+		lastReport:        time.Now(),
+	}
+	return backend, nil
+}
+
+// addPoolBackend adds backendURL to pool in cfg and reports whether the
+// pool exists
+func addPoolBackend(cfg *Config, pool, backendURL string) bool {
+	if pool == "default" {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: backendURL})
+		return true
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Name == pool {
+			cfg.Pools[i].Backends = append(cfg.Pools[i].Backends, BackendConfig{URL: backendURL})
+			return true
+		}
+	}
+	return false
+}
+
+// removePoolBackend drops backendURL from pool in cfg and reports whether
+// it was there
+func removePoolBackend(cfg *Config, pool, backendURL string) bool {
+	drop := func(backends []BackendConfig) ([]BackendConfig, bool) {
+		kept := slices.DeleteFunc(slices.Clone(backends), func(b BackendConfig) bool { return b.URL == backendURL })
+		return kept, len(kept) != len(backends)
+	}
+	var removed bool
+	if pool == "default" {
+		cfg.Backends, removed = drop(cfg.Backends)
+		return removed
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Name == pool {
+			cfg.Pools[i].Backends, removed = drop(cfg.Pools[i].Backends)
+			return removed
+		}
+	}
+	return false
+}
+
+// poolBackend returns the backend of pool with backendURL, or nil
+func (s *Server) poolBackend(pool, backendURL string) *balancer.Backend {
+	p := s.pools.Get(pool)
+	if p == nil {
+		return nil
+	}
+	for _, backend := range p.Backends() {
+		if backend.URL.String() == backendURL {
+			return backend
+		}
+	}
+	return nil
+}
+
+// poolHasBackend reports whether pool serves backendURL
+func (s *Server) poolHasBackend(pool, backendURL string) bool {
+	return s.poolBackend(pool, backendURL) != nil
+}
+
+// deregisterAgent forgets an agent, removing the backend it added
+func (s *Server) deregisterAgent(pool, backendURL, reason string) {
+	s.agents.mu.Lock()
+	agent, ok := s.agents.agents[agentKey(pool, backendURL)]
+	delete(s.agents.agents, agentKey(pool, backendURL))
+	s.agents.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if backend := s.poolBackend(pool, backendURL); backend != nil && backend.SetAgentDown(false) {
+		s.refreshPool(pool)
+	}
+	if !agent.added {
+		log.Printf("🛰️ Agent %q of %s left (%s)", agent.Name, pool, reason)
+		return
+	}
+	current := s.config.Accepted()
+	if removePoolBackend(current, pool, backendURL) {
+		if _, err := s.config.Apply(current, "agent "+agent.Name); err != nil {
+			log.Printf("⚠️ Backend of agent %q not removed from pool %s: %v", agent.Name, pool, err)
+			return
+		}
+	}
+	log.Printf("🛰️ Agent %q left, its backend was removed from pool %s (%s)", agent.Name, pool, reason)
+}
+
+// refreshPool republishes the routable backends of pool
+func (s *Server) refreshPool(pool string) {
+	if p := s.pools.Get(pool); p != nil {
+		p.RefreshPeers()
+	}
+}
+
+// agentConfigs returns the installed QUIC-LB configs with their keys
+func (s *Server) agentConfigs() []agentQUICLBConfig {
+	active := s.quicLB.ActiveConfigBits()
+	var configs []agentQUICLBConfig
+	for bits, config := range s.quicLB.Configs() {
+		configs = append(configs, agentQUICLBConfig{
+			Algorithm:               config.Algorithm,
+			ConfigRotationBits:      bits,
+			ServerIDLen:             config.ServerIDLen,
+			ConnectionIDLen:         config.ConnectionIDLen,
+			NonceLen:                config.NonceLen,
+			Key:                     hex.EncodeToString(config.Key),
+			FirstOctetEncodesCIDLen: config.FirstOctetEncodesCIDLen,
+			Active:                  bits == active,
+		})
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ConfigRotationBits < configs[j].ConfigRotationBits })
+	return configs
+}
+
+// runAgentExpiry removes agents that stopped reporting until ctx is done
+func (s *Server) runAgentExpiry(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cfg := s.agents.config()
+		ttl := cfg.ttl()
+		var expired []agentRegistration
+		s.agents.mu.Lock()
+		for _, agent := range s.agents.agents {
+			if time.Since(agent.lastReport) > ttl {
+				expired = append(expired, agent.agentRegistration)
+			}
+		}
+		s.agents.mu.Unlock()
+		for _, reg := range expired {
+			s.deregisterAgent(reg.Pool, reg.URL, "no report for "+ttl.String())
+		}
+	}
+}
+
+// handleAgentRegister serves POST /api/agents/register: the backend joins
+// its pool and the agent gets its server ID and the QUIC-LB configs
+func (s *Server) handleAgentRegister(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg agentRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	backend, err := s.registerAgent(reg)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Registration refused: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	cfg := s.agents.config()
+	ttl := cfg.ttl()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id":       backend.ID,
+		"pool":            reg.Pool,
+		"url":             backend.URL.String(),
+		"active_config":   s.quicLB.ActiveConfigBits(),
+		"configs":         s.agentConfigs(),
+		"report_interval": (ttl / agentReportsPerTTL).String(),
+		"timestamp":       time.Now(),
+	})
+}
+
+// handleAgentReport serves POST /api/agents/report with a backend's health
+// and load; an unhealthy report holds the backend down
+func (s *Server) handleAgentReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report agentReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.agents.mu.Lock()
+	agent, ok := s.agents.agents[agentKey(report.Pool, report.URL)]
+	if ok {
+		agent.lastReport = time.Now()
+		agent.report = &report
+	}
+	s.agents.mu.Unlock()
+	backend := s.poolBackend(report.Pool, report.URL)
+	if !ok || backend == nil {
+		// Registrations do not survive a restart; the agent registers again
+		http.Error(w, "Agent not registered", http.StatusNotFound)
+		return
+	}
+
+	if backend.SetAgentDown(!report.Healthy) {
+		s.refreshPool(report.Pool)
+		if report.Healthy {
+			log.Printf("🛰️ Agent %q reports backend #%d healthy again", agent.Name, backend.ID)
+		} else {
+			log.Printf("🛰️ Agent %q reports backend #%d unhealthy: %s", agent.Name, backend.ID, report.Reason)
+		}
+	}
+
+	// The active config tells the agent when to fetch rotated configs
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id":     backend.ID,
+		"active_config": s.quicLB.ActiveConfigBits(),
+		"timestamp":     time.Now(),
+	})
+}
+
+// handleAgentDeregister serves POST /api/agents/deregister, sent by an
+// agent whose backend shuts down
+func (s *Server) handleAgentDeregister(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg agentRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(reg.URL); err == nil {
+		reg.URL = u.String()
+	}
+	s.deregisterAgent(reg.Pool, reg.URL, "deregistered")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Agent deregistered",
+		"timestamp": time.Now(),
+	})
+}
+
+// handleAgents serves GET /api/agents with the registered agents and their
+// last reports
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	s.agents.mu.Lock()
+	cfg := s.agents.cfg
+	agents := make([]map[string]interface{}, 0, len(s.agents.agents))
+	for _, agent := range s.agents.agents {
+		entry := map[string]interface{}{
+			"name":        agent.Name,
+			"pool":        agent.Pool,
+			"url":         agent.URL,
+			"added":       agent.added,
+			"registered":  agent.registered,
+			"last_report": agent.lastReport,
+		}
+		if agent.report != nil {
+			entry["report"] = agent.report
+		}
+		agents = append(agents, entry)
+	}
+	s.agents.mu.Unlock()
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i]["pool"].(string)+agents[i]["url"].(string) < agents[j]["pool"].(string)+agents[j]["url"].(string)
+	})
+
+	stats := map[string]interface{}{
+		"enabled":   cfg.Enabled,
+		"ttl":       cfg.ttl().String(),
+		"agents":    agents,
+		"timestamp": time.Now(),
+	}
+	json.NewEncoder(w).Encode(stats)
+}
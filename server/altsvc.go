@@ -0,0 +1,234 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAltSvcMaxAge is how long clients remember an advertisement by default
+const defaultAltSvcMaxAge = 86400
+
+// altSvcListeners are the listeners an alt_svc entry can be set for, besides "default"
+var altSvcListeners = []string{"tcp", "quic", "http"}
+
+// alpnToken matches the ALPN protocol IDs Alt-Svc and SVCB can carry unescaped
+var alpnToken = regexp.MustCompile(`^[A-Za-z0-9._~!$&'*+^|-]+$`)
+
+// AltSvcSettings maps a listener ("tcp", "quic" or "http") to its Alt-Svc
+// advertisement; "default" applies to listeners without an entry
+type AltSvcSettings map[string]AltSvcConfig
+
+// AltSvcConfig is the Alt-Svc advertisement of a listener
+type AltSvcConfig struct {
+	Disabled  bool             `json:"disabled,omitempty"`  // Send no Alt-Svc header
+	Endpoints []AltSvcEndpoint `json:"endpoints,omitempty"` // Alternatives in order of preference, default h3 on the port of server.listen_addr
+	MaxAge    int              `json:"max_age,omitempty"`   // Seconds clients may remember the alternatives (ma), default 86400
+}
+
+// AltSvcEndpoint is one advertised alternative service
+type AltSvcEndpoint struct {
+	Protocol string `json:"protocol,omitempty"` // ALPN protocol ID, default "h3"
+	Host     string `json:"host,omitempty"`     // Alternative host, empty for the host the client connected to
+	Port     int    `json:"port,omitempty"`     // Alternative port, default the port of server.listen_addr
+}
+
+// validate checks one alt_svc entry
+func (ac *AltSvcConfig) validate(prefix string) []error {
+	var errs []error
+	if ac.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_age %d must not be negative", prefix, ac.MaxAge))
+	}
+	for i, ep := range ac.Endpoints {
+		if ep.Protocol != "" && !alpnToken.MatchString(ep.Protocol) {
+			errs = append(errs, fmt.Errorf("%s.endpoints[%d].protocol %q is not a valid ALPN token", prefix, i, ep.Protocol))
+		}
+		if ep.Host != "" && net.ParseIP(ep.Host) == nil && !alpnToken.MatchString(ep.Host) {
+			errs = append(errs, fmt.Errorf("%s.endpoints[%d].host %q is not a host name or IP address", prefix, i, ep.Host))
+		}
+		if ep.Port < 0 || ep.Port > 65535 {
+			errs = append(errs, fmt.Errorf("%s.endpoints[%d].port %d is out of range", prefix, i, ep.Port))
+		}
+	}
+	return errs
+}
+
+// validate checks the alt_svc section
+func (as AltSvcSettings) validate() []error {
+	var errs []error
+	for listener, ac := range as {
+		if listener != "default" && !slices.Contains(altSvcListeners, listener) {
+			errs = append(errs, fmt.Errorf("alt_svc: unknown listener %q (want default, %s)", listener, strings.Join(altSvcListeners, ", ")))
+			continue
+		}
+		errs = append(errs, ac.validate("alt_svc."+listener)...)
+	}
+	return errs
+}
+
+// altSvcFor returns the advertisement of a listener with defaults filled in
+func (c *Config) altSvcFor(listener string) AltSvcConfig {
+	ac, ok := c.AltSvc[listener]
+	if !ok {
+		ac = c.AltSvc["default"]
+	}
+
+	port := c.listenPort()
+	endpoints := slices.Clone(ac.Endpoints)
+	if len(endpoints) == 0 {
+		endpoints = []AltSvcEndpoint{{}}
+	}
+	for i := range endpoints {
+		if endpoints[i].Protocol == "" {
+			endpoints[i].Protocol = "h3"
+		}
+		if endpoints[i].Port == 0 {
+			endpoints[i].Port = port
+		}
+	}
+	ac.Endpoints = endpoints
+	if ac.MaxAge == 0 {
+		ac.MaxAge = defaultAltSvcMaxAge
+	}
+	return ac
+}
+
+// listenPort returns the port of server.listen_addr, shared by HTTP/2 and HTTP/3
+func (c *Config) listenPort() int {
+	if _, p, err := net.SplitHostPort(c.Server.ListenAddr); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			return n
+		}
+	}
+	return 443
+}
+
+// altSvcHeader formats the Alt-Svc header value of a listener, "" when disabled
+func (c *Config) altSvcHeader(listener string) string {
+	ac := c.altSvcFor(listener)
+	if ac.Disabled {
+		return ""
+	}
+	values := make([]string, 0, len(ac.Endpoints))
+	for _, ep := range ac.Endpoints {
+		authority := net.JoinHostPort(ep.Host, strconv.Itoa(ep.Port))
+		values = append(values, fmt.Sprintf("%s=%q; ma=%d", ep.Protocol, authority, ac.MaxAge))
+	}
+	return strings.Join(values, ", ")
+}
+
+// HTTPSRecords returns the DNS HTTPS records (RFC 9460) matching what the TCP
+// listener advertises in Alt-Svc, so clients can find HTTP/3 before their
+// first connection. Endpoints on the same host and port share one record.
+func (c *Config) HTTPSRecords(name string, ttl int) []string {
+	ac := c.altSvcFor("tcp")
+	owner := strings.TrimSuffix(name, ".") + "."
+
+	type target struct {
+		host string
+		port int
+	}
+	var targets []target
+	alpns := make(map[target][]string)
+	for _, ep := range ac.Endpoints {
+		t := target{host: ep.Host, port: ep.Port}
+		if _, ok := alpns[t]; !ok {
+			targets = append(targets, t)
+		}
+		if !slices.Contains(alpns[t], ep.Protocol) {
+			alpns[t] = append(alpns[t], ep.Protocol)
+		}
+	}
+
+	// The listener's own TCP protocols are reachable on the same port
+	listenPort := c.listenPort()
+	var tcpProtos []string
+	if _, profile, err := c.TLSProfile(c.Server.TLSProfile); err == nil {
+		for _, proto := range profile.nextProtos() {
+			// http/1.1 is the SVCB default ALPN and is not listed
+			if proto != "h3" && proto != "http/1.1" {
+				tcpProtos = append(tcpProtos, proto)
+			}
+		}
+	}
+
+	records := make([]string, 0, len(targets))
+	for i, t := range targets {
+		protos := alpns[t]
+		if t.host == "" && t.port == listenPort {
+			for _, proto := range tcpProtos {
+				if !slices.Contains(protos, proto) {
+					protos = append(protos, proto)
+				}
+			}
+		}
+		targetName := "."
+		if t.host != "" {
+			targetName = strings.TrimSuffix(t.host, ".") + "."
+		}
+		record := fmt.Sprintf("%s %d IN HTTPS %d %s alpn=%q", owner, ttl, i+1, targetName, strings.Join(protos, ","))
+		if t.port != 443 {
+			record += " port=" + strconv.Itoa(t.port)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// altSvcListener names the listener a request arrived on
+func altSvcListener(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 3:
+		return "quic"
+	case r.TLS != nil:
+		return "tcp"
+	}
+	return "http"
+}
+
+// applyAltSvc precomputes the Alt-Svc header value of every listener
+func (s *Server) applyAltSvc(cfg *Config) {
+	headers := make(map[string]string, len(altSvcListeners))
+	for _, listener := range altSvcListeners {
+		headers[listener] = cfg.altSvcHeader(listener)
+	}
+	s.altSvc.Store(&headers)
+}
+
+// altSvcHeader returns the Alt-Svc header value for the listener r arrived on
+func (s *Server) altSvcHeader(r *http.Request) string {
+	if headers := s.altSvc.Load(); headers != nil {
+		return (*headers)[altSvcListener(r)]
+	}
+	return ""
+}
+
+// handleAltSvc serves GET /api/alt-svc with each listener's Alt-Svc header
+// and, for ?name=<host>, the matching DNS HTTPS records
+func (s *Server) handleAltSvc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	response := map[string]interface{}{
+		"listeners": s.altSvc.Load(),
+		"timestamp": time.Now(),
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		ttl := 3600
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "ttl must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			ttl = n
+		}
+		response["https_records"] = s.config.Current().HTTPSRecords(name, ttl)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+const (
+	defaultAuthMaxFailures = 10
+	defaultAuthFailWindow  = time.Minute
+	// maxAuthFailureClients bounds the tracked clients; expired ones are
+	// swept when it is reached
+	maxAuthFailureClients = 65536
+)
+
+// AuthFailuresConfig throttles clients that keep failing authentication.
+// Password hashing, token verification and auth service subrequests cost
+// the load balancer work, so a client over the limit is refused with 429
+// before any of them run again. A failure is a request that presented an
+// Authorization header and was refused by basic auth, JWT or forward auth.
+type AuthFailuresConfig struct {
+	MaxFailures int               `json:"max_failures,omitempty"` // Failures per client within the window before it is refused, default 10; -1 for no limit
+	Window      balancer.Duration `json:"window,omitempty"`       // How long failures count, and a refused client waits, default 1m
+}
+
+// validate checks the failed authentication limits
+func (ac *AuthFailuresConfig) validate() []error {
+	var errs []error
+	if ac.MaxFailures < -1 {
+		errs = append(errs, fmt.Errorf("auth_failures.max_failures must be -1 (no limit) or more, got %d", ac.MaxFailures))
+	}
+	if ac.Window < 0 {
+		errs = append(errs, fmt.Errorf("auth_failures.window must not be negative"))
+	}
+	return errs
+}
+
+// maxFailures returns the configured limit or its default
+func (ac *AuthFailuresConfig) maxFailures() int {
+	if ac.MaxFailures == 0 {
+		return defaultAuthMaxFailures
+	}
+	return ac.MaxFailures
+}
+
+// window returns the configured window or its default
+func (ac *AuthFailuresConfig) window() time.Duration {
+	if ac.Window == 0 {
+		return defaultAuthFailWindow
+	}
+	return ac.Window.Duration()
+}
+
+// authFailureCount is the failures of one client since the window began
+type authFailureCount struct {
+	count int
+	since time.Time
+}
+
+// AuthFailures counts failed authentication per client address
+type AuthFailures struct {
+	mu      sync.Mutex
+	cfg     AuthFailuresConfig
+	clients map[netip.Prefix]*authFailureCount
+
+	failures int64
+	refused  int64
+}
+
+// NewAuthFailures creates a tracker with the default limits
+func NewAuthFailures() *AuthFailures {
+	return &AuthFailures{clients: make(map[netip.Prefix]*authFailureCount)}
+}
+
+// Configure applies new limits; counted failures are kept
+func (af *AuthFailures) Configure(cfg AuthFailuresConfig) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	af.cfg = cfg
+}
+
+// authFailureKey groups IPv6 clients by their /64, as they hold many addresses
+func authFailureKey(r *http.Request) (netip.Prefix, bool) {
+	addr, ok := clientAddr(r)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = defaultClientIPv6Prefix
+	}
+	key, err := addr.Prefix(bits)
+	return key, err == nil
+}
+
+// allow refuses clients over the failure limit with 429, before the auth
+// checks of scope run
+func (af *AuthFailures) allow(w http.ResponseWriter, r *http.Request, scope string) bool {
+	key, ok := authFailureKey(r)
+	if !ok {
+		return true
+	}
+	af.mu.Lock()
+	limit, window := af.cfg.maxFailures(), af.cfg.window()
+	entry := af.clients[key]
+	if entry != nil && time.Since(entry.since) >= window {
+		delete(af.clients, key)
+		entry = nil
+	}
+	refused := limit >= 0 && entry != nil && entry.count >= limit
+	var retryAfter time.Duration
+	if refused {
+		af.refused++
+		retryAfter = window - time.Since(entry.since)
+	}
+	af.mu.Unlock()
+
+	if !refused {
+		return true
+	}
+	log.Printf("🔐 Refused %s %s from %s: too many failed logins (%s)", r.Method, r.URL.Path, r.RemoteAddr, scope)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "🚫 Too many failed logins, try again later", http.StatusTooManyRequests)
+	return false
+}
+
+// record counts a refused request when it presented credentials; clients
+// that sent none, such as browsers before the login prompt, are not counted
+func (af *AuthFailures) record(r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		return
+	}
+	key, ok := authFailureKey(r)
+	if !ok {
+		return
+	}
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	if af.cfg.maxFailures() < 0 {
+		return
+	}
+	af.failures++
+	now := time.Now()
+	entry := af.clients[key]
+	if entry == nil || now.Sub(entry.since) >= af.cfg.window() {
+		if entry == nil && len(af.clients) >= maxAuthFailureClients {
+			af.sweepLocked(now)
+			if len(af.clients) >= maxAuthFailureClients {
+				return
+			}
+		}
+		entry = &authFailureCount{since: now}
+		af.clients[key] = entry
+	}
+	entry.count++
+}
+
+// sweepLocked forgets clients whose window has passed; callers hold mu
+func (af *AuthFailures) sweepLocked(now time.Time) {
+	window := af.cfg.window()
+	for key, entry := range af.clients {
+		if now.Sub(entry.since) >= window {
+			delete(af.clients, key)
+		}
+	}
+}
+
+// Snapshot reports the limits and how many clients are being throttled
+func (af *AuthFailures) Snapshot() map[string]interface{} {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+
+	limit, window := af.cfg.maxFailures(), af.cfg.window()
+	throttled := 0
+	for _, entry := range af.clients {
+		if limit >= 0 && entry.count >= limit && time.Since(entry.since) < window {
+			throttled++
+		}
+	}
+	return map[string]interface{}{
+		"max_failures":      limit,
+		"window":            window.String(),
+		"clients":           len(af.clients),
+		"throttled_clients": throttled,
+		"failures":          af.failures,
+		"refused":           af.refused,
+	}
+}
+
+// handleAuthFailures serves GET /api/auth-failures with the throttled clients
+func (s *Server) handleAuthFailures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.authFailures.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// failedLogin returns a request from addr that presented credentials
+func failedLogin(addr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	r.RemoteAddr = addr
+	r.SetBasicAuth("alice", "wrong")
+	return r
+}
+
+// A client is refused with 429 once it reaches max_failures, and only
+// requests that presented credentials count
+func TestAuthFailuresThrottle(t *testing.T) {
+	af := NewAuthFailures()
+	af.Configure(AuthFailuresConfig{MaxFailures: 3})
+
+	for i := 0; i < 5; i++ {
+		anonymous := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+		anonymous.RemoteAddr = "192.0.2.1:50000"
+		af.record(anonymous)
+	}
+	for i := 0; i < 3; i++ {
+		r := failedLogin("192.0.2.1:50000")
+		if !af.allow(httptest.NewRecorder(), r, "test") {
+			t.Fatalf("refused after %d failures", i)
+		}
+		af.record(r)
+	}
+
+	w := httptest.NewRecorder()
+	if af.allow(w, failedLogin("192.0.2.1:50001"), "test") {
+		t.Fatal("allowed after 3 failures")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("answered %d with Retry-After %q, want 429 and a delay", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !af.allow(httptest.NewRecorder(), failedLogin("192.0.2.2:50000"), "test") {
+		t.Error("another client refused")
+	}
+
+	stats := af.Snapshot()
+	if stats["failures"] != int64(3) || stats["refused"] != int64(1) || stats["throttled_clients"] != 1 {
+		t.Errorf("stats %v, want 3 failures, 1 refused and 1 throttled client", stats)
+	}
+}
+
+// IPv6 clients in one /64 share their failures
+func TestAuthFailuresIPv6Prefix(t *testing.T) {
+	af := NewAuthFailures()
+	af.Configure(AuthFailuresConfig{MaxFailures: 2})
+	af.record(failedLogin("[2001:db8:1:2::1]:50000"))
+	af.record(failedLogin("[2001:db8:1:2::2]:50000"))
+
+	if af.allow(httptest.NewRecorder(), failedLogin("[2001:db8:1:2::3]:50000"), "test") {
+		t.Error("address in a throttled /64 allowed")
+	}
+	if !af.allow(httptest.NewRecorder(), failedLogin("[2001:db8:1:3::1]:50000"), "test") {
+		t.Error("address in another /64 refused")
+	}
+}
+
+// Failures expire with the window, and -1 turns the limit off
+func TestAuthFailuresWindowAndNoLimit(t *testing.T) {
+	af := NewAuthFailures()
+	af.Configure(AuthFailuresConfig{MaxFailures: 1, Window: balancer.Duration(50 * time.Millisecond)})
+	af.record(failedLogin("192.0.2.1:50000"))
+	if af.allow(httptest.NewRecorder(), failedLogin("192.0.2.1:50000"), "test") {
+		t.Fatal("allowed at the limit")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !af.allow(httptest.NewRecorder(), failedLogin("192.0.2.1:50000"), "test") {
+		t.Error("still refused after the window")
+	}
+
+	af.Configure(AuthFailuresConfig{MaxFailures: -1})
+	for i := 0; i < 20; i++ {
+		af.record(failedLogin("192.0.2.3:50000"))
+	}
+	if !af.allow(httptest.NewRecorder(), failedLogin("192.0.2.3:50000"), "test") {
+		t.Error("refused without a limit")
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Basic auth defaults
+const (
+	defaultBasicAuthRealm      = "quic-lb"
+	defaultBasicAuthUserHeader = "X-Remote-User"
+	htpasswdCheckInterval      = 5 * time.Second
+	maxVerifiedCredentials     = 1024
+)
+
+// BasicAuthConfig protects routes with basic_auth and paths served by the
+// load balancer itself, such as the dashboard, with user names and
+// passwords, a lightweight alternative to forward_auth or JWTs. Passwords
+// are stored as htpasswd hashes: bcrypt ($2y$), Apache MD5 ($apr1$) or
+// {SHA}.
+type BasicAuthConfig struct {
+	Realm        string            `json:"realm,omitempty"`         // Shown by browsers in the login prompt, default "quic-lb"
+	Users        map[string]string `json:"users,omitempty"`         // User -> password hash as written by htpasswd
+	HtpasswdFile string            `json:"htpasswd_file,omitempty"` // htpasswd file with further users, reread when it changes
+	Paths        []string          `json:"paths,omitempty"`         // Path prefixes served by the load balancer that need a user, e.g. "/static/" or "/api/"
+	UserHeader   string            `json:"user_header,omitempty"`   // Request header naming the user for backends, default X-Remote-User
+}
+
+// validate checks the basic auth settings
+func (bc *BasicAuthConfig) validate() []error {
+	var errs []error
+	for user, hash := range bc.Users {
+		if user == "" || strings.Contains(user, ":") {
+			errs = append(errs, fmt.Errorf("basic_auth.users: %q is not a valid user name", user))
+		}
+		if !supportedPasswordHash(hash) {
+			errs = append(errs, fmt.Errorf("basic_auth.users.%s: password must be a bcrypt, $apr1$ or {SHA} hash", user))
+		}
+	}
+	if bc.HtpasswdFile != "" {
+		if _, err := loadHtpasswd(bc.HtpasswdFile); err != nil {
+			errs = append(errs, fmt.Errorf("basic_auth.htpasswd_file: %v", err))
+		}
+	}
+	for i, path := range bc.Paths {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("basic_auth.paths[%d] %q must start with /", i, path))
+		}
+	}
+	if len(bc.Paths) > 0 && !bc.hasUsers() {
+		errs = append(errs, fmt.Errorf("basic_auth.paths needs users or an htpasswd_file"))
+	}
+	if strings.ContainsAny(bc.Realm, "\"\r\n") {
+		errs = append(errs, fmt.Errorf("basic_auth.realm must not contain quotes or line breaks"))
+	}
+	return errs
+}
+
+// hasUsers reports whether users can be configured at all
+func (bc *BasicAuthConfig) hasUsers() bool {
+	return len(bc.Users) > 0 || bc.HtpasswdFile != ""
+}
+
+// realm returns the configured realm or its default
+func (bc *BasicAuthConfig) realm() string {
+	if bc.Realm == "" {
+		return defaultBasicAuthRealm
+	}
+	return bc.Realm
+}
+
+// userHeader returns the configured user header or its default
+func (bc *BasicAuthConfig) userHeader() string {
+	if bc.UserHeader == "" {
+		return defaultBasicAuthUserHeader
+	}
+	return bc.UserHeader
+}
+
+// supportedPasswordHash reports whether hash is in a format checkPassword knows
+func supportedPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// loadHtpasswd reads user:hash lines, skipping comments and blank lines
+func loadHtpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if !supportedPasswordHash(hash) {
+			return nil, fmt.Errorf("%s:%d: password of %s must be a bcrypt, $apr1$ or {SHA} hash", path, line, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// checkPassword compares password with an htpasswd hash
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1Hash(password, salt))) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// apr1Hash is Apache's MD5-based crypt, the htpasswd default without -B
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[idx[0]])<<16|uint32(sum[idx[1]])<<8|uint32(sum[idx[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return magic + salt + "$" + out.String()
+}
+
+// unknownUserHash is a bcrypt hash compared for unknown users
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// basicAuthContextKey carries the authenticated user
+type basicAuthContextKey struct{}
+
+// BasicAuth checks user names and passwords against the configured users
+// and the htpasswd file
+type BasicAuth struct {
+	mu        sync.Mutex
+	cfg       BasicAuthConfig
+	users     map[string]string
+	fileMod   time.Time
+	checked   time.Time
+	verified  map[[32]byte]string // digest of user and password -> the hash they matched
+	allowed   int64
+	rejected  map[string]int64 // reason -> requests
+	fileError string
+}
+
+// NewBasicAuth creates basic auth without users
+func NewBasicAuth() *BasicAuth {
+	return &BasicAuth{users: make(map[string]string), verified: make(map[[32]byte]string), rejected: make(map[string]int64)}
+}
+
+// Configure applies new settings and loads the htpasswd file
+func (ba *BasicAuth) Configure(cfg BasicAuthConfig) {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	ba.cfg = cfg
+	ba.fileError = ""
+	ba.reloadLocked(true)
+}
+
+// reloadLocked merges the configured users with the htpasswd file. Unless
+// forced the file is only read when it changed, checking at most every
+// htpasswdCheckInterval.
+func (ba *BasicAuth) reloadLocked(force bool) {
+	if !force && (ba.cfg.HtpasswdFile == "" || time.Since(ba.checked) < htpasswdCheckInterval) {
+		return
+	}
+	ba.checked = time.Now()
+	var fileUsers map[string]string
+	if ba.cfg.HtpasswdFile != "" {
+		info, err := os.Stat(ba.cfg.HtpasswdFile)
+		if !force && err == nil && info.ModTime().Equal(ba.fileMod) {
+			return
+		}
+		if err == nil {
+			fileUsers, err = loadHtpasswd(ba.cfg.HtpasswdFile)
+		}
+		if err != nil {
+			if ba.fileError != err.Error() {
+				log.Printf("⚠️ Failed to load htpasswd file, keeping its previous users: %v", err)
+			}
+			ba.fileError = err.Error()
+			if !force {
+				return
+			}
+		} else {
+			if !force {
+				log.Printf("👤 Reloaded %d users from %s", len(fileUsers), ba.cfg.HtpasswdFile)
+			}
+			ba.fileMod, ba.fileError = info.ModTime(), ""
+		}
+	}
+
+	users := make(map[string]string, len(fileUsers)+len(ba.cfg.Users))
+	for user, hash := range fileUsers {
+		users[user] = hash
+	}
+	// Users in the config win over the file
+	for user, hash := range ba.cfg.Users {
+		users[user] = hash
+	}
+	ba.users = users
+	ba.verified = make(map[[32]byte]string)
+}
+
+// protects reports whether a path served by the load balancer needs a user
+func (ba *BasicAuth) protects(path string) bool {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	for _, prefix := range ba.cfg.Paths {
+		if strings.HasPrefix(path, strings.TrimSuffix(prefix, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the credentials of a request that needs a user,
+// answering missing or wrong ones with 401. The user is stored in the
+// returned request's context.
+func (ba *BasicAuth) authenticate(w http.ResponseWriter, r *http.Request, required bool, scope string) (*http.Request, bool) {
+	if !required {
+		return r, true
+	}
+
+	user, password, ok := r.BasicAuth()
+	reason := "missing"
+	if ok {
+		reason = ba.verify(user, password)
+	}
+
+	ba.mu.Lock()
+	realm := ba.cfg.realm()
+	if reason == "" {
+		ba.allowed++
+	} else {
+		ba.rejected[reason]++
+	}
+	ba.mu.Unlock()
+
+	if reason == "" {
+		return r.WithContext(context.WithValue(r.Context(), basicAuthContextKey{}, user)), true
+	}
+	if reason != "missing" {
+		log.Printf("👤 Rejected %s %s from %s: %s, user %q (%s)", r.Method, r.URL.Path, r.RemoteAddr, strings.ReplaceAll(reason, "_", " "), user, scope)
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+	http.Error(w, "🚫 Login required", http.StatusUnauthorized)
+	return r, false
+}
+
+// verify returns why user and password are refused, "" when they are not.
+// Checked credentials are remembered so bcrypt runs once per password.
+func (ba *BasicAuth) verify(user, password string) string {
+	ba.mu.Lock()
+	ba.reloadLocked(false)
+	hash, known := ba.users[user]
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+	cached := ba.verified[digest]
+	ba.mu.Unlock()
+
+	switch {
+	case !known:
+		// Take as long as a wrong password so user names cannot be probed
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return "unknown_user"
+	case cached == hash:
+		return ""
+	case !checkPassword(hash, password):
+		return "wrong_password"
+	}
+
+	ba.mu.Lock()
+	if len(ba.verified) >= maxVerifiedCredentials {
+		ba.verified = make(map[[32]byte]string)
+	}
+	ba.verified[digest] = hash
+	ba.mu.Unlock()
+	return ""
+}
+
+// setBasicAuthHeaders names the authenticated user to the backend and
+// removes the credentials, always dropping a client-sent user header
+func (ba *BasicAuth) setBasicAuthHeaders(r *http.Request) {
+	ba.mu.Lock()
+	header := ba.cfg.userHeader()
+	ba.mu.Unlock()
+
+	r.Header.Del(header)
+	user, ok := r.Context().Value(basicAuthContextKey{}).(string)
+	if !ok {
+		return
+	}
+	r.Header.Del("Authorization")
+	r.Header.Set(header, user)
+}
+
+// Snapshot reports the users and how many requests were allowed or refused
+func (ba *BasicAuth) Snapshot() map[string]interface{} {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	rejected := make(map[string]int64, len(ba.rejected))
+	for reason, n := range ba.rejected {
+		rejected[reason] = n
+	}
+	stats := map[string]interface{}{
+		"realm":         ba.cfg.realm(),
+		"users":         len(ba.users),
+		"htpasswd_file": ba.cfg.HtpasswdFile,
+		"paths":         ba.cfg.Paths,
+		"allowed":       ba.allowed,
+		"rejected":      rejected,
+	}
+	if ba.fileError != "" {
+		stats["htpasswd_error"] = ba.fileError
+	}
+	return stats
+}
+
+// handleBasicAuth serves GET /api/basic-auth with the login counts
+func (s *Server) handleBasicAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.basicAuth.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes of "secret" as written by htpasswd
+const (
+	testAPR1Hash = "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"
+	testSHAHash  = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+)
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{testAPR1Hash, testSHAHash, string(bcryptHash)} {
+		if !checkPassword(hash, "secret") {
+			t.Errorf("%s: right password refused", hash)
+		}
+		if checkPassword(hash, "Secret") {
+			t.Errorf("%s: wrong password accepted", hash)
+		}
+	}
+}
+
+func TestBasicAuthAuthenticate(t *testing.T) {
+	ba := NewBasicAuth()
+	ba.Configure(BasicAuthConfig{Realm: "moodle", Users: map[string]string{"alice": testAPR1Hash}})
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		allowed  bool
+		reason   string
+	}{
+		{"right password", "alice", "secret", true, ""},
+		{"cached right password", "alice", "secret", true, ""},
+		{"wrong password", "alice", "nope", false, "wrong_password"},
+		{"unknown user", "bob", "secret", false, "unknown_user"},
+		{"no credentials", "", "", false, "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/grade/", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			r.Header.Set("X-Remote-User", "admin")
+			w := httptest.NewRecorder()
+			authed, ok := ba.authenticate(w, r, true, "test")
+			if ok != tt.allowed {
+				t.Fatalf("allowed %v, want %v", ok, tt.allowed)
+			}
+			if !ok {
+				if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="moodle", charset="UTF-8"` {
+					t.Errorf("answered %d with WWW-Authenticate %q, want 401 and the realm", w.Code, w.Header().Get("WWW-Authenticate"))
+				}
+				return
+			}
+			ba.setBasicAuthHeaders(authed)
+			if got := authed.Header.Get("X-Remote-User"); got != "alice" || authed.Header.Get("Authorization") != "" {
+				t.Errorf("backend sees user %q and Authorization %q, want alice without credentials", got, authed.Header.Get("Authorization"))
+			}
+		})
+	}
+
+	rejected := ba.Snapshot()["rejected"].(map[string]int64)
+	if rejected["wrong_password"] != 1 || rejected["unknown_user"] != 1 || rejected["missing"] != 1 {
+		t.Errorf("rejected %v, want one of each reason", rejected)
+	}
+}
+
+// Users come from the htpasswd file too, with the config winning, and a
+// client-sent user header never reaches the backend unauthenticated
+func TestBasicAuthHtpasswdFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\nalice:" + testSHAHash + "\n\nbob:" + testAPR1Hash + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ba := NewBasicAuth()
+	ba.Configure(BasicAuthConfig{HtpasswdFile: path, Users: map[string]string{"bob": "{SHA}invalid"}})
+	if reason := ba.verify("alice", "secret"); reason != "" {
+		t.Errorf("file user refused: %s", reason)
+	}
+	if reason := ba.verify("bob", "secret"); reason != "wrong_password" {
+		t.Errorf("bob checked against the file's hash (%q), want the config's", reason)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Remote-User", "admin")
+	ba.setBasicAuthHeaders(r)
+	if got := r.Header.Get("X-Remote-User"); got != "" {
+		t.Errorf("client-sent X-Remote-User %q reaches the backend", got)
+	}
+}
+
+func TestBasicAuthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BasicAuthConfig
+		err  string
+	}{
+		{"valid", BasicAuthConfig{Users: map[string]string{"alice": testAPR1Hash}, Paths: []string{"/static/"}}, ""},
+		{"plain password", BasicAuthConfig{Users: map[string]string{"alice": "secret"}}, "must be a bcrypt"},
+		{"colon in user", BasicAuthConfig{Users: map[string]string{"a:b": testSHAHash}}, "not a valid user name"},
+		{"paths without users", BasicAuthConfig{Paths: []string{"/static/"}}, "needs users"},
+		{"relative path", BasicAuthConfig{Users: map[string]string{"alice": testSHAHash}, Paths: []string{"static/"}}, "must start with /"},
+		{"quote in realm", BasicAuthConfig{Realm: `a"b`}, "realm must not contain"},
+		{"missing htpasswd file", BasicAuthConfig{HtpasswdFile: "/nonexistent/htpasswd"}, "htpasswd_file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.cfg.validate()
+			if tt.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("errors %v, want none", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+				t.Errorf("errors %v, want one containing %q", errs, tt.err)
+			}
+		})
+	}
+}
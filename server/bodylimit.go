@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request body buffering modes
+const (
+	bodyStream = "stream" // default: forwarded while it is received
+	bodyBuffer = "buffer" // received completely before a backend is contacted
+)
+
+// defaultBodyMemoryBuffer is how much of a buffered body is held in memory
+// before it moves to a temporary file
+const defaultBodyMemoryBuffer = 1 << 20
+
+// RequestBodyConfig limits request bodies and chooses how they are
+// forwarded. Streaming keeps memory flat, buffering keeps slow uploads from
+// tying up a backend worker for their whole duration and lets a backend see
+// the size of chunked uploads up front.
+type RequestBodyConfig struct {
+	MaxSize      int64  `json:"max_size,omitempty"`      // Largest request body in bytes, 0 for no limit; larger requests get 413
+	Buffering    string `json:"buffering,omitempty"`     // "stream" (default) forwards bodies as they arrive, "buffer" receives them completely first
+	MemoryBuffer int64  `json:"memory_buffer,omitempty"` // Buffered bodies larger than this spill to a temporary file, default 1 MiB
+	TempDir      string `json:"temp_dir,omitempty"`      // Directory for spilled bodies, default the system temp dir
+}
+
+// validate checks the request body settings
+func (bc *RequestBodyConfig) validate() []error {
+	var errs []error
+	if bc.MaxSize < 0 {
+		errs = append(errs, fmt.Errorf("request_body.max_size %d must not be negative", bc.MaxSize))
+	}
+	if err := validateBodyBuffering(bc.Buffering); err != nil {
+		errs = append(errs, fmt.Errorf("request_body.buffering: %v", err))
+	}
+	if bc.MemoryBuffer < 0 {
+		errs = append(errs, fmt.Errorf("request_body.memory_buffer %d must not be negative", bc.MemoryBuffer))
+	}
+	return errs
+}
+
+// validateBodyBuffering checks a buffering mode
+func validateBodyBuffering(mode string) error {
+	switch mode {
+	case "", bodyStream, bodyBuffer:
+		return nil
+	}
+	return fmt.Errorf("%q must be \"stream\" or \"buffer\"", mode)
+}
+
+// memoryBuffer returns the configured memory buffer or its default
+func (bc *RequestBodyConfig) memoryBuffer() int64 {
+	if bc.MemoryBuffer == 0 {
+		return defaultBodyMemoryBuffer
+	}
+	return bc.MemoryBuffer
+}
+
+// forRoute returns the size limit and buffering mode for a matched route;
+// route settings override the global ones, a negative route limit lifts it
+func (bc *RequestBodyConfig) forRoute(match RouteMatch) (limit int64, buffering string) {
+	limit, buffering = bc.MaxSize, bc.Buffering
+	if match.MaxBodySize != 0 {
+		limit = max(match.MaxBodySize, 0)
+	}
+	if match.BodyBuffering != "" {
+		buffering = match.BodyBuffering
+	}
+	if buffering == "" {
+		buffering = bodyStream
+	}
+	return limit, buffering
+}
+
+// RequestBodyStats counts rejected and buffered request bodies
+type RequestBodyStats struct {
+	mu            sync.Mutex
+	declaredLarge int64 // rejected from Content-Length before reading
+	exceeded      int64 // grew past the limit while being received
+	buffered      int64
+	spilled       int64 // buffered in a temporary file
+	bufferedBytes int64
+	incomplete    int64 // client stopped sending while being buffered
+}
+
+// NewRequestBodyStats creates empty request body metrics
+func NewRequestBodyStats() *RequestBodyStats {
+	return &RequestBodyStats{}
+}
+
+// limit caps r's body at limit bytes. A declared Content-Length above it is
+// answered with 413 right away, before a 100 Continue invites the body; it
+// reports false then.
+func (bs *RequestBodyStats) limit(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		bs.mu.Lock()
+		bs.declaredLarge++
+		bs.mu.Unlock()
+		log.Printf("📦 Rejected %s %s from %s: body of %s exceeds %s", r.Method, r.URL.Path, r.RemoteAddr,
+			formatBytes(r.ContentLength), formatBytes(limit))
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), stats: bs}
+	return true
+}
+
+// limitedBody counts bodies that grow past the limit while streaming
+type limitedBody struct {
+	io.ReadCloser
+	stats    *RequestBodyStats
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !b.exceeded && errors.As(err, &tooLarge) {
+		b.exceeded = true
+		b.stats.mu.Lock()
+		b.stats.exceeded++
+		b.stats.mu.Unlock()
+	}
+	return n, err
+}
+
+// buffer receives r's body completely and replaces it with the received
+// copy, so the backend gets a request with a Content-Length. It answers
+// the request itself and reports false when the body could not be read.
+// Call the returned function once the request was proxied.
+func (bs *RequestBodyStats) buffer(w http.ResponseWriter, r *http.Request, bc RequestBodyConfig) (func(), bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() {}, true
+	}
+
+	var mem bytes.Buffer
+	n, err := io.CopyN(&mem, r.Body, bc.memoryBuffer()+1)
+	var spill *os.File
+	if err == nil {
+		// Larger than the memory buffer: continue in a temporary file
+		spill, err = os.CreateTemp(bc.TempDir, "quic-lb-body-*")
+		if err == nil {
+			os.Remove(spill.Name())
+			var rest int64
+			if _, err = spill.Write(mem.Bytes()); err == nil {
+				rest, err = io.Copy(spill, r.Body)
+				n += rest
+			}
+			if err == nil {
+				_, err = spill.Seek(0, io.SeekStart)
+			}
+		}
+	} else if err == io.EOF {
+		err = nil
+	}
+	r.Body.Close()
+	if err != nil {
+		if spill != nil {
+			spill.Close()
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Printf("📦 Rejected %s %s from %s: body exceeds %s", r.Method, r.URL.Path, r.RemoteAddr, formatBytes(tooLarge.Limit))
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		bs.mu.Lock()
+		bs.incomplete++
+		bs.mu.Unlock()
+		log.Printf("📦 Buffering %s %s from %s failed after %s: %v", r.Method, r.URL.Path, r.RemoteAddr, formatBytes(n), err)
+		http.Error(w, "Request body incomplete", http.StatusBadRequest)
+		return nil, false
+	}
+
+	bs.mu.Lock()
+	bs.buffered++
+	bs.bufferedBytes += n
+	if spill != nil {
+		bs.spilled++
+	}
+	bs.mu.Unlock()
+
+	r.ContentLength = n
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	if spill != nil {
+		r.Body = io.NopCloser(spill)
+		return func() { spill.Close() }, true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(mem.Bytes()))
+	return func() {}, true
+}
+
+// Snapshot reports rejected and buffered request bodies
+func (bs *RequestBodyStats) Snapshot() map[string]interface{} {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return map[string]interface{}{
+		"rejected_content_length": bs.declaredLarge,
+		"rejected_while_reading":  bs.exceeded,
+		"buffered":                bs.buffered,
+		"buffered_bytes":          bs.bufferedBytes,
+		"spilled_to_disk":         bs.spilled,
+		"incomplete":              bs.incomplete,
+	}
+}
+
+// handleRequestBody serves GET /api/request-body with body limit metrics
+// and the effective settings
+func (s *Server) handleRequestBody(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cfg := s.config.Current()
+	routes := make([]map[string]interface{}, 0)
+	for i, rt := range cfg.Routes {
+		if rt.MaxBodySize == 0 && rt.BodyBuffering == "" {
+			continue
+		}
+		routes = append(routes, map[string]interface{}{
+			"route":          i,
+			"max_body_size":  rt.MaxBodySize,
+			"body_buffering": rt.BodyBuffering,
+		})
+	}
+	stats := s.requestBodies.Snapshot()
+	stats["max_size"] = cfg.RequestBody.MaxSize
+	_, stats["buffering"] = cfg.RequestBody.forRoute(RouteMatch{})
+	stats["memory_buffer"] = cfg.RequestBody.memoryBuffer()
+	stats["routes"] = routes
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,688 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot mitigation defaults
+const (
+	defaultBotLogAbove  = 0.5
+	defaultBotRateLimit = 1.0
+	botChallengeCookie  = "__lb_challenge"
+	botChallengeTTL     = time.Hour
+	botScoreHalfLife    = 5 * time.Minute  // an idle client's reputation halves this often
+	botClientIdle       = 30 * time.Minute // clients not seen this long are forgotten
+	botSweepInterval    = time.Minute
+	botScoreWeight      = 0.3 // share of a request's score in the reputation
+	maxBotClients       = 100000
+)
+
+// Bot mitigation actions, from mildest to strictest
+const (
+	botActionNone = iota
+	botActionLog
+	botActionRateLimit
+	botActionChallenge
+	botActionBlock
+)
+
+var botActionNames = []string{"none", "logged", "rate_limited", "challenged", "blocked"}
+
+// BotConfig scores routed requests for signs of bots and scrapers. Scorers
+// rate each request, their weighted sum feeds a per-client reputation that
+// decays while the client is quiet, and the reputation decides whether the
+// client is logged, rate limited, challenged or refused.
+type BotConfig struct {
+	Scorers        []BotScorerConfig `json:"scorers,omitempty"`          // Scorers feeding the reputation; bot mitigation is off without any
+	LogAbove       float64           `json:"log_above,omitempty"`        // Log clients whose reputation rises above this, default 0.5
+	RateLimitAbove float64           `json:"rate_limit_above,omitempty"` // Limit clients above this to rate_limit requests per second, 0 for never
+	RateLimit      float64           `json:"rate_limit,omitempty"`       // Requests per second of rate limited clients, default 1
+	ChallengeAbove float64           `json:"challenge_above,omitempty"`  // Answer clients above this with a cookie challenge, 0 for never
+	BlockAbove     float64           `json:"block_above,omitempty"`      // Refuse clients above this with 403, 0 for never
+	Exempt         []string          `json:"exempt,omitempty"`           // Addresses or CIDRs never scored, e.g. monitoring
+	ExemptPaths    []string          `json:"exempt_paths,omitempty"`     // Path prefixes never scored, e.g. "/webservice/" for the Moodle app
+}
+
+// BotScorerConfig adds one scorer
+type BotScorerConfig struct {
+	Name   string          `json:"name"`             // Registered scorer: "header_anomalies", "request_patterns" or "missing_cookies"
+	Weight float64         `json:"weight,omitempty"` // Multiplies the scorer's score, default 1
+	Config json.RawMessage `json:"config,omitempty"` // Passed to the scorer as is
+}
+
+// validate checks the bot mitigation settings
+func (bc *BotConfig) validate() []error {
+	var errs []error
+	for name, threshold := range map[string]float64{"log_above": bc.LogAbove, "rate_limit_above": bc.RateLimitAbove, "challenge_above": bc.ChallengeAbove, "block_above": bc.BlockAbove} {
+		if threshold < 0 || threshold > 1 {
+			errs = append(errs, fmt.Errorf("bots.%s %v must be between 0 and 1", name, threshold))
+		}
+	}
+	if bc.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("bots.rate_limit must not be negative"))
+	}
+	for i, sc := range bc.Scorers {
+		if sc.Weight < 0 {
+			errs = append(errs, fmt.Errorf("bots.scorers[%d].weight must not be negative", i))
+		}
+		if _, err := sc.build(); err != nil {
+			errs = append(errs, fmt.Errorf("bots.scorers[%d] %s: %v", i, sc.Name, err))
+		}
+	}
+	for i, entry := range bc.Exempt {
+		if _, err := parseAccessEntry(entry); err != nil {
+			errs = append(errs, fmt.Errorf("bots.exempt[%d]: %v", i, err))
+		}
+	}
+	for i, prefix := range bc.ExemptPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("bots.exempt_paths[%d] %q must start with /", i, prefix))
+		}
+	}
+	return errs
+}
+
+// logAbove returns the configured log threshold or its default
+func (bc *BotConfig) logAbove() float64 {
+	if bc.LogAbove == 0 {
+		return defaultBotLogAbove
+	}
+	return bc.LogAbove
+}
+
+// rateLimit returns the configured rate or its default
+func (bc *BotConfig) rateLimit() float64 {
+	if bc.RateLimit == 0 {
+		return defaultBotRateLimit
+	}
+	return bc.RateLimit
+}
+
+// action returns the strictest action whose threshold score exceeds
+func (bc *BotConfig) action(score float64) int {
+	for _, a := range []struct {
+		above  float64
+		action int
+	}{{bc.BlockAbove, botActionBlock}, {bc.ChallengeAbove, botActionChallenge}, {bc.RateLimitAbove, botActionRateLimit}, {bc.logAbove(), botActionLog}} {
+		if a.above > 0 && score > a.above {
+			return a.action
+		}
+	}
+	return botActionNone
+}
+
+// BotClient is what the load balancer remembers about a client, as seen by
+// scorers. The counters include the request being scored.
+type BotClient struct {
+	Requests      int64     // Requests seen
+	WithCookies   int64     // Requests that carried cookies
+	AssetRequests int64     // Requests for stylesheets, scripts, images and fonts
+	LastMinute    float64   // Requests during the last minute
+	FirstSeen     time.Time // First request
+	Score         float64   // Reputation before this request
+	Verified      bool      // The request carries a valid challenge cookie
+}
+
+// BotScorer rates how much a request looks like it comes from a bot
+type BotScorer interface {
+	// Score returns 0 for nothing suspicious up to 1 for certainly a bot,
+	// with a short reason when above 0
+	Score(r *http.Request, client BotClient) (float64, string)
+}
+
+// BotScorerFunc adapts a function to BotScorer
+type BotScorerFunc func(r *http.Request, client BotClient) (float64, string)
+
+// Score calls f
+func (f BotScorerFunc) Score(r *http.Request, client BotClient) (float64, string) {
+	return f(r, client)
+}
+
+// BotScorerFactory builds a scorer from its config; an error rejects the
+// configuration
+type BotScorerFactory func(config json.RawMessage) (BotScorer, error)
+
+var (
+	botScorersMu sync.RWMutex
+	botScorers   = map[string]BotScorerFactory{
+		"header_anomalies": newHeaderAnomalies,
+		"request_patterns": newRequestPatterns,
+		"missing_cookies":  newMissingCookies,
+	}
+)
+
+// RegisterBotScorer makes a scorer compiled into the binary available under
+// name; call it from an init function before the server starts
+func RegisterBotScorer(name string, factory BotScorerFactory) {
+	botScorersMu.Lock()
+	defer botScorersMu.Unlock()
+	if _, exists := botScorers[name]; exists {
+		panic(fmt.Sprintf("bot scorer %q registered twice", name))
+	}
+	botScorers[name] = factory
+}
+
+// build instantiates the scorer
+func (sc *BotScorerConfig) build() (BotScorer, error) {
+	botScorersMu.RLock()
+	factory, ok := botScorers[sc.Name]
+	botScorersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no bot scorer named %q is registered", sc.Name)
+	}
+	return factory(sc.Config)
+}
+
+// weight returns the configured weight or its default
+func (sc *BotScorerConfig) weight() float64 {
+	if sc.Weight == 0 {
+		return 1
+	}
+	return sc.Weight
+}
+
+// botScorer is a built scorer with its weight
+type botScorer struct {
+	name   string
+	weight float64
+	scorer BotScorer
+}
+
+// botClient is the reputation of one client address
+type botClient struct {
+	BotClient
+	last        time.Time
+	minute      time.Time // start of the current minute window
+	thisMinute  float64
+	prevMinute  float64
+	action      int    // action taken on the previous request, to log escalations once
+	reason      string // reasons of the last suspicious request
+	bucket      float64
+	bucketLast  time.Time
+	rateLimited int64
+}
+
+// Bots scores requests and applies the bot mitigation actions
+type Bots struct {
+	mu      sync.Mutex
+	cfg     BotConfig
+	scorers []botScorer
+	exempt  []netip.Prefix
+	clients map[netip.Addr]*botClient
+	swept   time.Time
+	key     []byte           // signs challenge cookies
+	actions map[string]int64 // action -> requests
+	reasons map[string]int64 // reason -> requests
+}
+
+// NewBots creates bot mitigation without scorers
+func NewBots() *Bots {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &Bots{
+		clients: make(map[netip.Addr]*botClient),
+		swept:   time.Now(),
+		key:     key,
+		actions: make(map[string]int64),
+		reasons: make(map[string]int64),
+	}
+}
+
+// Configure applies new settings; a scorer that fails to build is left out
+// and logged. Reputations carry over.
+func (b *Bots) Configure(cfg BotConfig) {
+	var scorers []botScorer
+	for _, sc := range cfg.Scorers {
+		scorer, err := sc.build()
+		if err != nil {
+			log.Printf("⚠️ Bot scorer %s not loaded: %v", sc.Name, err)
+			continue
+		}
+		scorers = append(scorers, botScorer{name: sc.Name, weight: sc.weight(), scorer: scorer})
+	}
+	var exempt []netip.Prefix
+	for _, entry := range cfg.Exempt {
+		if prefix, err := parseAccessEntry(entry); err == nil {
+			exempt = append(exempt, prefix)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+	b.scorers = scorers
+	b.exempt = exempt
+	if len(scorers) == 0 {
+		b.clients = make(map[netip.Addr]*botClient)
+	}
+}
+
+// check scores r and applies the action its client's reputation calls
+// for, answering the request itself when it is rate limited, challenged
+// or blocked. It reports whether r may proceed.
+func (b *Bots) check(w http.ResponseWriter, r *http.Request, routeReason string) bool {
+	b.mu.Lock()
+	cfg, scorers, exempt := b.cfg, b.scorers, b.exempt
+	b.mu.Unlock()
+	if len(scorers) == 0 || r.Method == http.MethodOptions {
+		return true
+	}
+	for _, prefix := range cfg.ExemptPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	addr, ok := clientAddr(r)
+	if !ok {
+		return true
+	}
+	for _, prefix := range exempt {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	now := time.Now()
+	verified := b.verifyChallenge(r, addr, now)
+	client := b.observe(addr, r, verified, now)
+
+	// Scorers run outside the lock, they may be slow
+	var score float64
+	var reasons []string
+	for _, s := range scorers {
+		v, reason := s.scorer.Score(r, client)
+		if v <= 0 {
+			continue
+		}
+		score += s.weight * math.Min(v, 1)
+		if reason == "" {
+			reason = s.name
+		}
+		reasons = append(reasons, reason)
+	}
+	score = math.Min(score, 1)
+
+	b.mu.Lock()
+	c := b.clients[addr]
+	if c == nil {
+		// Not tracked, the table is full
+		c = &botClient{BotClient: client}
+	}
+	c.Score += (score - c.Score) * botScoreWeight
+	reputation := c.Score
+	action := cfg.action(reputation)
+	if action == botActionChallenge && c.Verified {
+		// The request passed the challenge already, milder actions still apply
+		relaxed := cfg
+		relaxed.ChallengeAbove = 0
+		action = relaxed.action(reputation)
+	}
+	escalated := action > c.action
+	c.action = action
+	if len(reasons) > 0 {
+		c.reason = strings.Join(reasons, ", ")
+		for _, reason := range reasons {
+			b.reasons[reason]++
+		}
+	}
+	why := c.reason
+	allowed := true
+	if action == botActionRateLimit {
+		allowed = c.take(cfg.rateLimit(), now)
+		if !allowed {
+			c.rateLimited++
+		}
+	}
+	if action != botActionNone && (action != botActionRateLimit || !allowed) {
+		b.actions[botActionNames[action]]++
+	}
+	b.mu.Unlock()
+
+	if escalated {
+		log.Printf("🤖 Client %s %s (score %.2f: %s) on %s %s (%s)", addr, botActionNames[action], reputation, why, r.Method, r.URL.Path, routeReason)
+	}
+	switch {
+	case action == botActionBlock:
+		http.Error(w, "🚫 Automated requests are not allowed", http.StatusForbidden)
+		return false
+	case action == botActionChallenge:
+		b.challenge(w, r, addr, now)
+		return false
+	case !allowed:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/cfg.rateLimit()))))
+		http.Error(w, "🚫 Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// observe records r in its client's history and returns the history for
+// the scorers
+func (b *Bots) observe(addr netip.Addr, r *http.Request, verified bool, now time.Time) BotClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.swept) >= botSweepInterval {
+		b.swept = now
+		for a, c := range b.clients {
+			if now.Sub(c.last) > botClientIdle {
+				delete(b.clients, a)
+			}
+		}
+	}
+
+	c, ok := b.clients[addr]
+	if !ok {
+		c = &botClient{BotClient: BotClient{FirstSeen: now}, last: now, minute: now}
+		if len(b.clients) < maxBotClients {
+			b.clients[addr] = c
+		}
+	}
+	// Quiet clients regain their reputation
+	c.Score *= math.Pow(0.5, float64(now.Sub(c.last))/float64(botScoreHalfLife))
+	c.last = now
+	if elapsed := now.Sub(c.minute); elapsed >= time.Minute {
+		c.prevMinute = c.thisMinute
+		if elapsed >= 2*time.Minute {
+			c.prevMinute = 0
+		}
+		c.thisMinute = 0
+		c.minute = now
+	}
+	c.thisMinute++
+	c.LastMinute = c.thisMinute + c.prevMinute*(1-float64(now.Sub(c.minute))/float64(time.Minute))
+
+	c.Requests++
+	if r.Header.Get("Cookie") != "" {
+		c.WithCookies++
+	}
+	if isAssetRequest(r.URL.Path) {
+		c.AssetRequests++
+	}
+	c.Verified = verified
+	return c.BotClient
+}
+
+// take takes a token from the client's rate limit bucket
+func (c *botClient) take(rate float64, now time.Time) bool {
+	burst := math.Max(1, math.Ceil(rate))
+	if c.bucketLast.IsZero() {
+		c.bucket = burst
+	} else {
+		c.bucket = math.Min(burst, c.bucket+now.Sub(c.bucketLast).Seconds()*rate)
+	}
+	c.bucketLast = now
+	if c.bucket < 1 {
+		return false
+	}
+	c.bucket--
+	return true
+}
+
+// challengeValue returns the signed challenge cookie value for addr,
+// "<expiry>.<signature>"
+func (b *Bots) challengeValue(addr netip.Addr, expiry int64) string {
+	mac := hmac.New(sha256.New, b.key)
+	fmt.Fprintf(mac, "%s|%d", addr, expiry)
+	return strconv.FormatInt(expiry, 10) + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verifyChallenge reports whether r carries a valid challenge cookie for addr
+func (b *Bots) verifyChallenge(r *http.Request, addr netip.Addr, now time.Time) bool {
+	cookie, err := r.Cookie(botChallengeCookie)
+	if err != nil {
+		return false
+	}
+	expiryText, _, _ := strings.Cut(cookie.Value, ".")
+	expiry, err := strconv.ParseInt(expiryText, 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(b.challengeValue(addr, expiry)))
+}
+
+// challenge answers with a page setting the challenge cookie and reloading.
+// Browsers pass without noticing; clients that drop cookies stay challenged.
+func (b *Bots) challenge(w http.ResponseWriter, r *http.Request, addr netip.Addr, now time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     botChallengeCookie,
+		Value:    b.challengeValue(addr, now.Add(botChallengeTTL).Unix()),
+		Path:     "/",
+		MaxAge:   int(botChallengeTTL.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Refresh", "1")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="1"><title>Checking your browser</title></head><body><p>Checking your browser, the page reloads in a moment.</p></body></html>`)
+}
+
+// assetScripts are Moodle's scripts serving theme and JavaScript assets,
+// with slash arguments such as /theme/styles.php/boost/1700000000/all
+var assetScripts = map[string]bool{
+	"styles.php": true, "javascript.php": true, "image.php": true, "font.php": true,
+	"yui_combo.php": true, "requirejs.php": true,
+}
+
+// isAssetRequest reports whether path is a stylesheet, script, image or
+// font a browser loads along with pages
+func isAssetRequest(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if assetScripts[segment] {
+			return true
+		}
+	}
+	switch strings.ToLower(path.Ext(p)) {
+	case ".css", ".js", ".mjs", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".woff", ".woff2", ".ttf":
+		return true
+	}
+	return false
+}
+
+// headerAnomaliesConfig configures the header_anomalies scorer
+type headerAnomaliesConfig struct {
+	Agents []string `json:"agents,omitempty"` // Further user agent substrings of tools, matched case-insensitively
+}
+
+// Substrings of user agents sent by HTTP libraries and headless browsers
+var botAgents = []string{
+	"curl/", "wget/", "python-requests", "python-urllib", "python-httpx", "aiohttp", "go-http-client",
+	"scrapy", "libwww-perl", "java/", "okhttp", "node-fetch", "axios/", "headlesschrome", "phantomjs",
+}
+
+// newHeaderAnomalies builds the header_anomalies scorer: requests without a
+// user agent, from HTTP libraries, or claiming to be a browser without the
+// headers every browser sends
+func newHeaderAnomalies(raw json.RawMessage) (BotScorer, error) {
+	var cfg headerAnomaliesConfig
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	agents := append([]string(nil), botAgents...)
+	for _, agent := range cfg.Agents {
+		agents = append(agents, strings.ToLower(agent))
+	}
+
+	return BotScorerFunc(func(r *http.Request, client BotClient) (float64, string) {
+		ua := strings.ToLower(r.UserAgent())
+		if ua == "" {
+			return 1, "no user agent"
+		}
+		for _, agent := range agents {
+			if strings.Contains(ua, agent) {
+				return 0.8, "tool user agent"
+			}
+		}
+		if !strings.HasPrefix(ua, "mozilla/") {
+			return 0, ""
+		}
+		switch {
+		case r.Header.Get("Accept") == "":
+			return 0.6, "browser without accept"
+		case r.Header.Get("Accept-Language") == "":
+			return 0.5, "browser without accept-language"
+		case r.TLS != nil && r.ProtoMajor == 1 && (strings.Contains(ua, "chrome/") || strings.Contains(ua, "firefox/")):
+			// Current browsers always negotiate HTTP/2 or HTTP/3 over TLS
+			return 0.3, "browser over http/1.1"
+		}
+		return 0, ""
+	}), nil
+}
+
+// requestPatternsConfig configures the request_patterns scorer
+type requestPatternsConfig struct {
+	MaxPerMinute  float64 `json:"max_per_minute,omitempty"`  // Requests per minute above which a client is suspicious, default 120
+	MinRequests   int64   `json:"min_requests,omitempty"`    // Requests before the asset ratio counts, default 20; -1 turns the check off
+	MinAssetRatio float64 `json:"min_asset_ratio,omitempty"` // Share of asset requests below which a client only fetches pages, default 0.05
+}
+
+// newRequestPatterns builds the request_patterns scorer: clients requesting
+// faster than people click, or fetching pages without their stylesheets,
+// scripts and images
+func newRequestPatterns(raw json.RawMessage) (BotScorer, error) {
+	cfg := requestPatternsConfig{MaxPerMinute: 120, MinRequests: 20, MinAssetRatio: 0.05}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	if cfg.MaxPerMinute <= 0 {
+		return nil, fmt.Errorf("max_per_minute must be positive")
+	}
+
+	return BotScorerFunc(func(r *http.Request, client BotClient) (float64, string) {
+		if client.LastMinute > cfg.MaxPerMinute {
+			return math.Min(1, 0.5*client.LastMinute/cfg.MaxPerMinute), "high request rate"
+		}
+		if cfg.MinRequests >= 0 && client.Requests >= cfg.MinRequests &&
+			float64(client.AssetRequests)/float64(client.Requests) < cfg.MinAssetRatio {
+			return 0.5, "pages without assets"
+		}
+		return 0, ""
+	}), nil
+}
+
+// missingCookiesConfig configures the missing_cookies scorer
+type missingCookiesConfig struct {
+	MinRequests int64 `json:"min_requests,omitempty"` // Requests without any cookie before a client is suspicious, default 5
+}
+
+// newMissingCookies builds the missing_cookies scorer: clients that keep
+// coming back without the cookies, such as MoodleSession, set on their
+// first visit
+func newMissingCookies(raw json.RawMessage) (BotScorer, error) {
+	cfg := missingCookiesConfig{MinRequests: 5}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+
+	return BotScorerFunc(func(r *http.Request, client BotClient) (float64, string) {
+		if client.Verified || client.WithCookies > 0 || client.Requests < cfg.MinRequests {
+			return 0, ""
+		}
+		return 0.6, "no cookies"
+	}), nil
+}
+
+// Snapshot reports actions, reasons and the clients with the worst
+// reputation
+func (b *Bots) Snapshot(limit int) map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	scorers := make([]string, len(b.scorers))
+	for i, s := range b.scorers {
+		scorers[i] = s.name
+	}
+	actions := make(map[string]int64, len(b.actions))
+	for action, n := range b.actions {
+		actions[action] = n
+	}
+	reasons := make(map[string]int64, len(b.reasons))
+	for reason, n := range b.reasons {
+		reasons[reason] = n
+	}
+
+	now := time.Now()
+	clients := make([]map[string]interface{}, 0, len(b.clients))
+	for addr, c := range b.clients {
+		score := c.Score * math.Pow(0.5, float64(now.Sub(c.last))/float64(botScoreHalfLife))
+		if score < 0.01 {
+			continue
+		}
+		clients = append(clients, map[string]interface{}{
+			"address":      addr.String(),
+			"score":        math.Round(score*1000) / 1000,
+			"action":       botActionNames[b.cfg.action(score)],
+			"reason":       c.reason,
+			"requests":     c.Requests,
+			"rate_limited": c.rateLimited,
+			"verified":     c.Verified,
+			"last_seen":    c.last,
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i]["score"].(float64) > clients[j]["score"].(float64)
+	})
+	if limit > 0 && len(clients) > limit {
+		clients = clients[:limit]
+	}
+
+	botScorersMu.RLock()
+	registered := make([]string, 0, len(botScorers))
+	for name := range botScorers {
+		registered = append(registered, name)
+	}
+	botScorersMu.RUnlock()
+	sort.Strings(registered)
+
+	return map[string]interface{}{
+		"scorers":    scorers,
+		"registered": registered,
+		"actions":    actions,
+		"reasons":    reasons,
+		"tracked":    len(b.clients),
+		"clients":    clients,
+	}
+}
+
+// handleBots serves GET /api/bots?limit=N with bot mitigation counters and
+// the clients with the worst reputation
+func (s *Server) handleBots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	stats := s.bots.Snapshot(limit)
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
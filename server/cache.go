@@ -0,0 +1,898 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Response cache defaults
+const (
+	defaultCacheMemorySize    = 64 << 20
+	defaultCacheDiskSize      = 1 << 30
+	defaultCacheMaxObjectSize = 8 << 20
+	// cacheHeuristicMax caps the freshness derived from Last-Modified
+	cacheHeuristicMax = 24 * time.Hour
+)
+
+// cacheableStatus lists the status codes stored (RFC 9110 section 15.1)
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CacheConfig sizes the shared HTTP cache used by pools with cache enabled.
+// Responses are stored as RFC 9111 allows a shared cache to, so Moodle's
+// theme, JavaScript and language files (served with long max-age) are cached
+// while pages sent with "private" or Set-Cookie never are.
+type CacheConfig struct {
+	MemorySize    int64  `json:"memory_size,omitempty"`     // Bytes of responses kept in memory, default 64 MiB
+	DiskDir       string `json:"disk_dir,omitempty"`        // Responses evicted from memory move here; empty keeps the cache in memory only
+	DiskSize      int64  `json:"disk_size,omitempty"`       // Bytes of responses kept in disk_dir, default 1 GiB
+	MaxObjectSize int64  `json:"max_object_size,omitempty"` // Largest response stored, default 8 MiB
+}
+
+// validate checks the cache settings
+func (cc *CacheConfig) validate() []error {
+	var errs []error
+	if cc.MemorySize < 0 || cc.DiskSize < 0 || cc.MaxObjectSize < 0 {
+		errs = append(errs, fmt.Errorf("cache sizes must not be negative"))
+	}
+	if cc.maxObjectSize() > cc.memorySize() {
+		errs = append(errs, fmt.Errorf("cache.max_object_size %d exceeds cache.memory_size %d", cc.maxObjectSize(), cc.memorySize()))
+	}
+	return errs
+}
+
+// memorySize returns the configured memory size or its default
+func (cc *CacheConfig) memorySize() int64 {
+	if cc.MemorySize == 0 {
+		return defaultCacheMemorySize
+	}
+	return cc.MemorySize
+}
+
+// diskSize returns the configured disk size or its default
+func (cc *CacheConfig) diskSize() int64 {
+	if cc.DiskSize == 0 {
+		return defaultCacheDiskSize
+	}
+	return cc.DiskSize
+}
+
+// maxObjectSize returns the configured object size limit or its default
+func (cc *CacheConfig) maxObjectSize() int64 {
+	if cc.MaxObjectSize == 0 {
+		return defaultCacheMaxObjectSize
+	}
+	return cc.MaxObjectSize
+}
+
+// ResponseCache stores backend responses in memory, moving the least
+// recently used ones to disk when a disk directory is configured
+type ResponseCache struct {
+	mu      sync.Mutex
+	cfg     CacheConfig
+	entries map[string]*cacheEntry // variant key -> entry
+	varies  map[string]*cacheVary  // primary key -> header names the response varies on
+	memory  *list.List             // memory-resident entries, most recent first
+	disk    *list.List             // disk-resident entries, most recent first
+
+	memoryBytes int64
+	diskBytes   int64
+
+	memoryHits  int64
+	diskHits    int64
+	misses      int64
+	revalidated int64
+	stored      int64
+	bypassed    int64
+	purged      int64
+}
+
+// cacheEntry is one stored response
+type cacheEntry struct {
+	Key      string        `json:"key"`
+	Pool     string        `json:"pool"`
+	URI      string        `json:"uri"`
+	Status   int           `json:"status"`
+	Header   http.Header   `json:"header"`
+	Stored   time.Time     `json:"stored"`
+	Age      time.Duration `json:"age"`      // age when stored, from the Age header
+	Lifetime time.Duration `json:"lifetime"` // freshness lifetime
+	NoCache  bool          `json:"no_cache"` // must be revalidated before every use
+	Size     int64         `json:"size"`
+
+	primary string        // primary key, indexing the Vary header names
+	vary    *cacheVary    //
+	body    []byte        // nil while on disk
+	onDisk  bool          //
+	elem    *list.Element // in memory or disk; nil while moving to disk
+}
+
+// cacheVary holds the Vary header names of a resource's variants
+type cacheVary struct {
+	names    []string
+	variants int // stored entries using names
+}
+
+// NewResponseCache creates an empty memory-only cache
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{
+		entries: make(map[string]*cacheEntry),
+		varies:  make(map[string]*cacheVary),
+		memory:  list.New(),
+		disk:    list.New(),
+	}
+}
+
+// Configure applies size limits and the disk directory. A new directory
+// starts empty; entries in the previous one are dropped.
+func (rc *ResponseCache) Configure(cfg CacheConfig) {
+	rc.mu.Lock()
+	old := rc.cfg
+	rc.cfg = cfg
+	var dropped []*cacheEntry
+	if cfg.DiskDir != old.DiskDir {
+		for e := rc.disk.Front(); e != nil; e = e.Next() {
+			dropped = append(dropped, e.Value.(*cacheEntry))
+		}
+		for _, entry := range dropped {
+			rc.removeLocked(entry)
+		}
+	}
+	spill := rc.evictMemoryLocked()
+	removed := rc.evictDiskLocked()
+	rc.mu.Unlock()
+
+	for _, entry := range dropped {
+		os.Remove(filepath.Join(old.DiskDir, cacheFileName(entry.Key)))
+	}
+	if cfg.DiskDir != old.DiskDir && cfg.DiskDir != "" {
+		if err := os.MkdirAll(cfg.DiskDir, 0o700); err != nil {
+			log.Printf("⚠️ Cache disk directory %s: %v", cfg.DiskDir, err)
+		}
+		// Files from an earlier run have no index entry
+		stale, _ := filepath.Glob(filepath.Join(cfg.DiskDir, "*.cache"))
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+	rc.spill(spill)
+	rc.removeFiles(removed)
+}
+
+// cacheFileName returns the disk file of a variant key
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
+
+// cacheableRequest reports whether r may be answered from or stored in the
+// cache: GET and HEAD without credentials or no-store
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	return !cacheDirectives(r.Header).has("no-store")
+}
+
+// primaryKey identifies a resource of a pool
+func primaryKey(pool string, r *http.Request) string {
+	return pool + " " + normalizeHost(r.Host) + r.URL.RequestURI()
+}
+
+// variantKey adds the values of the headers a response varies on
+func variantKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// cacheControl holds parsed Cache-Control directives
+type cacheControl map[string]string
+
+// cacheDirectives parses the Cache-Control header of h; Pragma: no-cache
+// counts as no-cache
+func cacheDirectives(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	if len(cc) == 0 && strings.Contains(h.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime computes how long a response stays fresh in a shared
+// cache (RFC 9111 section 4.2.1), including the Last-Modified heuristic
+func freshnessLifetime(h http.Header, cc cacheControl) time.Duration {
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || t.Before(date) {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if modified, err := http.ParseTime(h.Get("Last-Modified")); err == nil && modified.Before(date) {
+		return min(date.Sub(modified)/10, cacheHeuristicMax)
+	}
+	return 0
+}
+
+// storable decides whether a response may be stored and parses its
+// freshness; responses without validators must have a lifetime
+func storable(code int, h http.Header) (entry *cacheEntry, ok bool) {
+	if !cacheableStatus[code] {
+		return nil, false
+	}
+	cc := cacheDirectives(h)
+	if cc.has("no-store") || cc.has("private") || h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return nil, false
+	}
+	entry = &cacheEntry{
+		Status:   code,
+		Lifetime: freshnessLifetime(h, cc),
+		NoCache:  cc.has("no-cache"),
+		Stored:   time.Now(),
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		entry.Age = time.Duration(age) * time.Second
+	}
+	hasValidator := h.Get("Etag") != "" || h.Get("Last-Modified") != ""
+	if entry.Lifetime == 0 && !hasValidator {
+		return nil, false
+	}
+	return entry, true
+}
+
+// currentAge returns the entry's age now
+func (e *cacheEntry) currentAge() time.Duration {
+	return e.Age + time.Since(e.Stored)
+}
+
+// fresh reports whether the entry may be used for r without revalidation
+func (e *cacheEntry) fresh(r *http.Request) bool {
+	if e.NoCache {
+		return false
+	}
+	reqCC := cacheDirectives(r.Header)
+	if reqCC.has("no-cache") {
+		return false
+	}
+	age := e.currentAge()
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.Lifetime
+}
+
+// varyNames parses the Vary header into canonical header names
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// lookup returns the stored variant for r, or nil
+func (rc *ResponseCache) lookup(pool string, r *http.Request) *cacheEntry {
+	primary := primaryKey(pool, r)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	vary := rc.varies[primary]
+	if vary == nil {
+		return nil
+	}
+	entry := rc.entries[variantKey(primary, vary.names, r)]
+	if entry != nil && entry.elem != nil {
+		if entry.onDisk {
+			rc.disk.MoveToFront(entry.elem)
+		} else {
+			rc.memory.MoveToFront(entry.elem)
+		}
+	}
+	return entry
+}
+
+// body returns the entry's body, reading it from disk when needed
+func (rc *ResponseCache) body(entry *cacheEntry) ([]byte, bool) {
+	rc.mu.Lock()
+	body, dir := entry.body, rc.cfg.DiskDir
+	rc.mu.Unlock()
+	if body != nil {
+		return body, true
+	}
+	f, err := os.Open(filepath.Join(dir, cacheFileName(entry.Key)))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// The metadata line precedes the body
+	if _, err := br.ReadBytes('\n'); err != nil {
+		return nil, false
+	}
+	body = make([]byte, entry.Size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// fresh returns a stored response of pool that may answer r without a
+// backend, and its body; nil when the request has to go to a backend
+func (rc *ResponseCache) fresh(r *http.Request, pool *balancer.Pool) (*cacheEntry, []byte) {
+	if !pool.Settings().Cache || !cacheableRequest(r) {
+		return nil, nil
+	}
+	entry := rc.lookup(pool.Name(), r)
+	if entry == nil || !entry.fresh(r) {
+		return nil, nil
+	}
+	body, ok := rc.body(entry)
+	if !ok {
+		rc.remove(entry)
+		return nil, nil
+	}
+	rc.mu.Lock()
+	if entry.onDisk {
+		rc.diskHits++
+	} else {
+		rc.memoryHits++
+	}
+	rc.mu.Unlock()
+	return entry, body
+}
+
+// write sends a stored response; conditional, HEAD and range requests on
+// 200 responses are answered by http.ServeContent
+func (rc *ResponseCache) write(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body []byte, state string) {
+	h := w.Header()
+	for name, values := range entry.Header {
+		h[name] = slices.Clone(values)
+	}
+	h.Set("Age", strconv.Itoa(int(entry.currentAge().Seconds())))
+	h.Set("X-Cache", state)
+
+	if entry.Status != http.StatusOK {
+		w.WriteHeader(entry.Status)
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+		return
+	}
+	modified, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	h.Del("Content-Length")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// proxy forwards r to peer through the cache. Stale responses with
+// validators are revalidated with a conditional request, and storable
+// responses are stored while they stream to the client.
+func (rc *ResponseCache) proxy(w http.ResponseWriter, r *http.Request, peer *balancer.Backend, pool *balancer.Pool) {
+	if !pool.Settings().Cache {
+		peer.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+	if !cacheableRequest(r) {
+		rc.mu.Lock()
+		rc.bypassed++
+		rc.mu.Unlock()
+		w.Header().Set("X-Cache", "BYPASS")
+		peer.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, cache: rc, req: r, pool: pool.Name(), base: w.Header().Clone()}
+	outgoing := r
+	if stale := rc.lookup(pool.Name(), r); stale != nil && !hasConditionals(r) {
+		etag, modified := stale.Header.Get("Etag"), stale.Header.Get("Last-Modified")
+		if etag != "" || modified != "" {
+			// The client's request stays as it was, the backend gets a
+			// conditional one
+			r2 := *r
+			r2.Header = r.Header.Clone()
+			if etag != "" {
+				r2.Header.Set("If-None-Match", etag)
+			}
+			if modified != "" {
+				r2.Header.Set("If-Modified-Since", modified)
+			}
+			outgoing = &r2
+			cw.stale = stale
+		}
+	}
+	if r.Method == http.MethodGet {
+		cw.maxSize = rc.maxObjectSize()
+	}
+	peer.ReverseProxy.ServeHTTP(cw, outgoing)
+	cw.finish()
+}
+
+// hasConditionals reports whether the client sent its own validators
+func hasConditionals(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" ||
+		r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != ""
+}
+
+// maxObjectSize returns the configured object size limit
+func (rc *ResponseCache) maxObjectSize() int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.cfg.maxObjectSize()
+}
+
+// cacheWriter passes a backend response to the client and keeps a copy to
+// store, or replaces a 304 answering the cache's revalidation with the
+// stored response
+type cacheWriter struct {
+	http.ResponseWriter
+	cache   *ResponseCache
+	req     *http.Request
+	pool    string
+	base    http.Header // headers set before proxying, not part of the response
+	stale   *cacheEntry // entry being revalidated
+	maxSize int64       // 0 when nothing is stored
+
+	wroteHeader bool
+	entry       *cacheEntry // response being stored
+	header      http.Header // its headers, before writers below change them
+	body        bytes.Buffer
+	discard     bool // the backend's 304 body is dropped
+}
+
+// backendHeader returns the response headers the backend set
+func (w *cacheWriter) backendHeader() http.Header {
+	h := w.Header().Clone()
+	for name, values := range w.base {
+		if slices.Equal(h[name], values) {
+			delete(h, name)
+		}
+	}
+	return h
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if code < 200 || w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	if code == http.StatusNotModified && w.stale != nil {
+		// Fresh again: stored headers are updated from the 304
+		// (RFC 9111 section 4.3.4) and the stored body is served
+		entry := w.cache.refresh(w.stale, w.backendHeader())
+		if body, ok := w.cache.body(entry); ok {
+			for name := range w.Header() {
+				if _, ok := w.base[name]; !ok {
+					w.Header().Del(name)
+				}
+			}
+			w.discard = true
+			w.cache.mu.Lock()
+			w.cache.revalidated++
+			w.cache.mu.Unlock()
+			w.cache.write(w.ResponseWriter, w.req, entry, body, "REVALIDATED")
+			return
+		}
+	}
+
+	w.cache.mu.Lock()
+	w.cache.misses++
+	w.cache.mu.Unlock()
+	if w.maxSize > 0 {
+		if entry, ok := storable(code, w.Header()); ok {
+			if length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err != nil || length <= w.maxSize {
+				w.entry = entry
+				// Compression below rewrites the shared header map
+				w.header = w.backendHeader()
+			}
+		}
+	}
+	w.Header().Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	if w.entry != nil {
+		if int64(w.body.Len()+len(b)) > w.maxSize {
+			w.entry = nil
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish stores the response once it was received completely
+func (w *cacheWriter) finish() {
+	if w.entry == nil || w.req.Context().Err() != nil {
+		return
+	}
+	if length := w.header.Get("Content-Length"); length != "" && length != strconv.Itoa(w.body.Len()) {
+		return
+	}
+	w.entry.Header = w.header
+	w.entry.Pool = w.pool
+	w.entry.URI = w.req.URL.RequestURI()
+	w.cache.store(w.entry, w.req, w.body.Bytes())
+}
+
+// Flush passes flushes through
+func (w *cacheWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// store adds a response, replacing the previous variant
+func (rc *ResponseCache) store(entry *cacheEntry, r *http.Request, body []byte) {
+	primary := primaryKey(entry.Pool, r)
+	vary := varyNames(entry.Header)
+	entry.Key = variantKey(primary, vary, r)
+	entry.body = bytes.Clone(body)
+	entry.Size = int64(len(body))
+
+	rc.mu.Lock()
+	if old := rc.entries[entry.Key]; old != nil {
+		rc.removeLocked(old)
+	}
+	v := rc.varies[primary]
+	if v == nil || !slices.Equal(v.names, vary) {
+		v = &cacheVary{names: vary}
+		rc.varies[primary] = v
+	}
+	v.variants++
+	entry.primary, entry.vary = primary, v
+	rc.entries[entry.Key] = entry
+	entry.elem = rc.memory.PushFront(entry)
+	rc.memoryBytes += entry.Size
+	rc.stored++
+	spill := rc.evictMemoryLocked()
+	rc.mu.Unlock()
+	rc.spill(spill)
+}
+
+// refresh updates a revalidated entry with the headers of the 304
+func (rc *ResponseCache) refresh(entry *cacheEntry, header http.Header) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	updated := entry.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		updated[name] = values
+	}
+	entry.Header = updated
+	cc := cacheDirectives(updated)
+	entry.Lifetime = freshnessLifetime(updated, cc)
+	entry.NoCache = cc.has("no-cache")
+	entry.Age = 0
+	entry.Stored = time.Now()
+	return entry
+}
+
+// remove drops an entry, deleting its disk file
+func (rc *ResponseCache) remove(entry *cacheEntry) {
+	rc.mu.Lock()
+	onDisk := entry.onDisk
+	current := rc.entries[entry.Key] == entry
+	if current {
+		rc.removeLocked(entry)
+	}
+	dir := rc.cfg.DiskDir
+	rc.mu.Unlock()
+	if current && onDisk {
+		os.Remove(filepath.Join(dir, cacheFileName(entry.Key)))
+	}
+}
+
+// removeLocked unlinks an entry from the index and its list
+func (rc *ResponseCache) removeLocked(entry *cacheEntry) {
+	rc.forgetLocked(entry)
+	if entry.elem == nil {
+		return
+	}
+	if entry.onDisk {
+		rc.disk.Remove(entry.elem)
+		rc.diskBytes -= entry.Size
+	} else {
+		rc.memory.Remove(entry.elem)
+		rc.memoryBytes -= entry.Size
+	}
+	entry.elem = nil
+}
+
+// forgetLocked drops an entry from the index
+func (rc *ResponseCache) forgetLocked(entry *cacheEntry) {
+	delete(rc.entries, entry.Key)
+	if entry.vary == nil {
+		return
+	}
+	// Entries stored under older Vary names no longer match any lookup
+	if entry.vary.variants--; entry.vary.variants == 0 && rc.varies[entry.primary] == entry.vary {
+		delete(rc.varies, entry.primary)
+	}
+	entry.vary = nil
+}
+
+// evictMemoryLocked takes least recently used entries out of memory until
+// it fits; they are returned to be spilled to disk
+func (rc *ResponseCache) evictMemoryLocked() []*cacheEntry {
+	var spill []*cacheEntry
+	for rc.memoryBytes > rc.cfg.memorySize() {
+		entry := rc.memory.Back().Value.(*cacheEntry)
+		rc.memory.Remove(entry.elem)
+		rc.memoryBytes -= entry.Size
+		entry.elem = nil
+		if rc.cfg.DiskDir == "" || entry.Size > rc.cfg.diskSize() {
+			rc.forgetLocked(entry)
+			continue
+		}
+		spill = append(spill, entry)
+	}
+	return spill
+}
+
+// evictDiskLocked drops least recently used disk entries until the disk
+// tier fits and returns the files to delete
+func (rc *ResponseCache) evictDiskLocked() []string {
+	var files []string
+	for rc.diskBytes > rc.cfg.diskSize() {
+		entry := rc.disk.Back().Value.(*cacheEntry)
+		rc.removeLocked(entry)
+		files = append(files, filepath.Join(rc.cfg.DiskDir, cacheFileName(entry.Key)))
+	}
+	return files
+}
+
+// spill writes entries evicted from memory to disk. They stay readable from
+// memory until written, and are dropped if replaced meanwhile.
+func (rc *ResponseCache) spill(entries []*cacheEntry) {
+	for _, entry := range entries {
+		rc.mu.Lock()
+		dir := rc.cfg.DiskDir
+		rc.mu.Unlock()
+		if dir == "" || writeCacheFile(dir, entry) != nil {
+			rc.mu.Lock()
+			if rc.entries[entry.Key] == entry {
+				rc.forgetLocked(entry)
+			}
+			rc.mu.Unlock()
+			continue
+		}
+
+		rc.mu.Lock()
+		if rc.entries[entry.Key] != entry || rc.cfg.DiskDir != dir {
+			rc.mu.Unlock()
+			os.Remove(filepath.Join(dir, cacheFileName(entry.Key)))
+			continue
+		}
+		entry.body = nil
+		entry.onDisk = true
+		entry.elem = rc.disk.PushFront(entry)
+		rc.diskBytes += entry.Size
+		removed := rc.evictDiskLocked()
+		rc.mu.Unlock()
+		rc.removeFiles(removed)
+	}
+}
+
+// removeFiles deletes evicted disk entries
+func (rc *ResponseCache) removeFiles(files []string) {
+	for _, path := range files {
+		os.Remove(path)
+	}
+}
+
+// writeCacheFile stores an entry as a JSON metadata line followed by the
+// body. It writes a temp file of its own and renames it, so writers of the
+// same key, such as two processes during a binary upgrade, never share a
+// temp file. Files are not synced: the cache is not reloaded at startup.
+func writeCacheFile(dir string, entry *cacheEntry) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	name := cacheFileName(entry.Key)
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(meta, '\n'))
+	if err == nil {
+		_, err = f.Write(entry.body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Purge removes stored responses of pool ("" for all pools) whose request
+// URI starts with prefix and returns how many were removed
+func (rc *ResponseCache) Purge(pool, prefix string) int {
+	rc.mu.Lock()
+	var files []string
+	purged := 0
+	for _, entry := range rc.entries {
+		if pool != "" && entry.Pool != pool || !strings.HasPrefix(entry.URI, prefix) {
+			continue
+		}
+		if entry.onDisk {
+			files = append(files, filepath.Join(rc.cfg.DiskDir, cacheFileName(entry.Key)))
+		}
+		rc.removeLocked(entry)
+		purged++
+	}
+	rc.purged += int64(purged)
+	rc.mu.Unlock()
+	rc.removeFiles(files)
+	return purged
+}
+
+// Snapshot reports cache occupancy and hit ratios
+func (rc *ResponseCache) Snapshot() map[string]interface{} {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	hits := rc.memoryHits + rc.diskHits + rc.revalidated
+	hitRatio := 0.0
+	if lookups := hits + rc.misses; lookups > 0 {
+		hitRatio = float64(hits) / float64(lookups)
+	}
+	return map[string]interface{}{
+		"entries":          len(rc.entries),
+		"memory_entries":   rc.memory.Len(),
+		"memory_bytes":     rc.memoryBytes,
+		"memory_size":      rc.cfg.memorySize(),
+		"disk_entries":     rc.disk.Len(),
+		"disk_bytes":       rc.diskBytes,
+		"disk_dir":         rc.cfg.DiskDir,
+		"memory_hits":      rc.memoryHits,
+		"disk_hits":        rc.diskHits,
+		"revalidated":      rc.revalidated,
+		"misses":           rc.misses,
+		"bypassed":         rc.bypassed,
+		"stored":           rc.stored,
+		"purged":           rc.purged,
+		"hit_ratio":        hitRatio,
+		"max_object_size":  rc.cfg.maxObjectSize(),
+		"cacheable_status": []int{200, 203, 301, 308, 404, 410},
+	}
+}
+
+// handleCache serves GET /api/cache with cache occupancy and hit ratios
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.cache.Snapshot()
+	var pools []string
+	for _, pool := range s.pools.Pools() {
+		if pool.Settings().Cache {
+			pools = append(pools, pool.Name())
+		}
+	}
+	stats["pools"] = pools
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleCachePurge serves POST /api/cache/purge {"pool": "...", "prefix": "/theme/"};
+// an empty body purges everything
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Pool   string `json:"pool"`
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	purged := s.cache.Purge(req.Pool, req.Prefix)
+	log.Printf("🧹 Cache purge (pool: %q, prefix: %q): %d responses removed", req.Pool, req.Prefix, purged)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purged":    purged,
+		"pool":      req.Pool,
+		"prefix":    req.Prefix,
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Writers of the same key each use a temp file of their own: the stored
+// file is one writer's entry, whole, and no temp file is left behind
+func TestWriteCacheFileConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+			entry := &cacheEntry{Key: "pool|GET|/course/view.php", Status: 200, Size: int64(len(body)), body: body}
+			if err := writeCacheFile(dir, entry); err != nil {
+				t.Errorf("writer %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != cacheFileName("pool|GET|/course/view.php") {
+		t.Fatalf("directory holds %v, want only the cache file", entries)
+	}
+
+	f, err := os.Open(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if _, err := br.ReadBytes('\n'); err != nil {
+		t.Fatalf("metadata line: %v", err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 64*1024 || !bytes.Equal(body, bytes.Repeat(body[:1], len(body))) {
+		t.Errorf("stored body of %d bytes mixes writers", len(body))
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certExpiryCheckInterval is how often served certificates are checked for expiry
+const certExpiryCheckInterval = 12 * time.Hour
+
+// CertExpiryMonitor tracks the expiry of every certificate the TLS profiles serve
+type CertExpiryMonitor struct {
+	mu       sync.Mutex
+	profiles map[string][]monitoredCertificate // TLS profile -> its certificates
+}
+
+// monitoredCertificate is one served certificate and its warning threshold
+type monitoredCertificate struct {
+	file     string
+	subject  string
+	names    []string
+	notAfter time.Time
+	warning  time.Duration
+}
+
+// CertificateExpiry is the expiry gauge of one served certificate
+type CertificateExpiry struct {
+	Profile         string    `json:"profile"`
+	CertFile        string    `json:"cert_file"`
+	Subject         string    `json:"subject"`
+	DNSNames        []string  `json:"dns_names,omitempty"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry float64   `json:"days_until_expiry"` // negative once expired
+	WarningDays     int       `json:"warning_days"`
+	Status          string    `json:"status"` // "ok", "expiring" or "expired"
+}
+
+// NewCertExpiryMonitor creates a monitor with no certificates
+func NewCertExpiryMonitor() *CertExpiryMonitor {
+	return &CertExpiryMonitor{profiles: make(map[string][]monitoredCertificate)}
+}
+
+// track replaces the certificates monitored for a TLS profile
+func (m *CertExpiryMonitor) track(profile string, warning time.Duration, loaded []loadedCertificate) {
+	certs := make([]monitoredCertificate, 0, len(loaded))
+	for _, lc := range loaded {
+		if lc.cert == nil || lc.cert.Leaf == nil {
+			continue
+		}
+		certs = append(certs, monitoredCertificate{
+			file:     lc.file,
+			subject:  lc.cert.Leaf.Subject.String(),
+			names:    lc.cert.Leaf.DNSNames,
+			notAfter: lc.cert.Leaf.NotAfter,
+			warning:  warning,
+		})
+	}
+
+	m.mu.Lock()
+	m.profiles[profile] = certs
+	m.mu.Unlock()
+}
+
+// Snapshot returns the expiry of every monitored certificate, soonest first
+func (m *CertExpiryMonitor) Snapshot() []CertificateExpiry {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expiries []CertificateExpiry
+	for profile, certs := range m.profiles {
+		for _, c := range certs {
+			remaining := c.notAfter.Sub(now)
+			status := "ok"
+			switch {
+			case remaining <= 0:
+				status = "expired"
+			case remaining <= c.warning:
+				status = "expiring"
+			}
+			expiries = append(expiries, CertificateExpiry{
+				Profile:         profile,
+				CertFile:        c.file,
+				Subject:         c.subject,
+				DNSNames:        c.names,
+				NotAfter:        c.notAfter,
+				DaysUntilExpiry: math.Round(remaining.Hours()/24*100) / 100,
+				WarningDays:     int(c.warning / (24 * time.Hour)),
+				Status:          status,
+			})
+		}
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].NotAfter.Before(expiries[j].NotAfter)
+	})
+	return expiries
+}
+
+// check logs a warning for every certificate that is expired or expiring soon
+func (m *CertExpiryMonitor) check() {
+	for _, c := range m.Snapshot() {
+		switch c.Status {
+		case "expired":
+			log.Printf("🚨 Certificate %s (%s) of TLS profile %q expired on %s",
+				c.CertFile, c.Subject, c.Profile, c.NotAfter.Format(time.RFC3339))
+		case "expiring":
+			log.Printf("⚠️ Certificate %s (%s) of TLS profile %q expires in %.1f days on %s (%s)",
+				c.CertFile, c.Subject, c.Profile, c.DaysUntilExpiry, c.NotAfter.Format(time.RFC3339), strings.Join(c.DNSNames, ", "))
+		}
+	}
+}
+
+// run checks the certificates now and then periodically until ctx is cancelled
+func (m *CertExpiryMonitor) run(ctx context.Context) {
+	m.check()
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// handleTLSCertificates serves GET /api/tls/certificates
+func (s *Server) handleTLSCertificates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"certificates": s.certExpiry.Snapshot(),
+		"timestamp":    time.Now(),
+	})
+}
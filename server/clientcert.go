@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Headers carrying the verified client certificate to backends. Values sent
+// by clients are always dropped so backends can trust them.
+var clientCertHeaders = []string{
+	"X-Client-Verify",
+	"X-Client-Cert-Subject",
+	"X-Client-Cert-Issuer",
+	"X-Client-Cert-Serial",
+	"X-Client-Cert-Fingerprint",
+}
+
+// hasVerifiedClientCert reports whether the TLS handshake verified a client certificate
+func hasVerifiedClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0
+}
+
+// setClientCertHeaders replaces the client certificate headers on a request
+// about to be proxied with the subject DN, issuer, serial and SHA-256
+// fingerprint of the verified certificate ("X-Client-Verify: NONE" without one)
+func setClientCertHeaders(r *http.Request) {
+	for _, name := range clientCertHeaders {
+		r.Header.Del(name)
+	}
+	if !hasVerifiedClientCert(r) {
+		r.Header.Set("X-Client-Verify", "NONE")
+		return
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set("X-Client-Verify", "SUCCESS")
+	r.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	r.Header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	r.Header.Set("X-Client-Cert-Serial", cert.SerialNumber.Text(16))
+	r.Header.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+}
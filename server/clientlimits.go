@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// defaultClientIPv6Prefix groups IPv6 clients by the /64 a host usually gets
+const defaultClientIPv6Prefix = 64
+
+// ClientLimitsConfig caps what one client address holds on the QUIC
+// listener. quic.max_incoming_streams limits streams per connection, so
+// without these a client opening many connections could still take the
+// whole fleet's stream budget. Excess connections are refused during the
+// handshake and excess request streams are reset with H3_REQUEST_REJECTED,
+// which clients may safely retry.
+type ClientLimitsConfig struct {
+	MaxConnections int      `json:"max_connections,omitempty"` // Concurrent QUIC connections per client; 0 for no limit
+	MaxStreams     int      `json:"max_streams,omitempty"`     // Concurrent HTTP/3 request streams per client across its connections; 0 for no limit
+	IPv6Prefix     int      `json:"ipv6_prefix,omitempty"`     // IPv6 clients are counted per prefix of this length, default 64
+	Exempt         []string `json:"exempt,omitempty"`          // CIDRs or addresses without limits, e.g. campus NAT gateways
+}
+
+// validate checks the client limit settings
+func (cc *ClientLimitsConfig) validate() []error {
+	var errs []error
+	if cc.MaxConnections < 0 || cc.MaxStreams < 0 {
+		errs = append(errs, fmt.Errorf("client_limits.max_connections and client_limits.max_streams must not be negative"))
+	}
+	if cc.IPv6Prefix < 0 || cc.IPv6Prefix > 128 {
+		errs = append(errs, fmt.Errorf("client_limits.ipv6_prefix %d must be between 1 and 128", cc.IPv6Prefix))
+	}
+	for i, entry := range cc.Exempt {
+		if _, err := parseAccessEntry(entry); err != nil {
+			errs = append(errs, fmt.Errorf("client_limits.exempt[%d]: %v", i, err))
+		}
+	}
+	return errs
+}
+
+// ipv6Prefix returns the configured IPv6 grouping or its default
+func (cc *ClientLimitsConfig) ipv6Prefix() int {
+	if cc.IPv6Prefix == 0 {
+		return defaultClientIPv6Prefix
+	}
+	return cc.IPv6Prefix
+}
+
+// clientUsage is what one client holds
+type clientUsage struct {
+	conns   int
+	streams int
+}
+
+// ClientLimits counts QUIC connections and request streams per client
+type ClientLimits struct {
+	mu      sync.Mutex
+	cfg     ClientLimitsConfig
+	exempt  []netip.Prefix
+	clients map[netip.Prefix]*clientUsage
+
+	refusedConns   int64
+	refusedStreams int64
+	peakConns      int
+	peakStreams    int
+}
+
+// NewClientLimits creates limits that allow everything
+func NewClientLimits() *ClientLimits {
+	return &ClientLimits{clients: make(map[netip.Prefix]*clientUsage)}
+}
+
+// Configure applies new limits; connections and streams above a lowered
+// limit stay open, new ones wait for the client to drop below it
+func (cl *ClientLimits) Configure(cfg ClientLimitsConfig) {
+	var exempt []netip.Prefix
+	for _, entry := range cfg.Exempt {
+		if prefix, err := parseAccessEntry(entry); err == nil {
+			exempt = append(exempt, prefix)
+		}
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.cfg = cfg
+	cl.exempt = exempt
+}
+
+// clientKey returns the prefix addr is counted under, false for exempt
+// clients; callers hold mu
+func (cl *ClientLimits) clientKey(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, prefix := range cl.exempt {
+		if prefix.Contains(addr) {
+			return netip.Prefix{}, false
+		}
+	}
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = cl.cfg.ipv6Prefix()
+	}
+	key, err := addr.Prefix(bits)
+	return key, err == nil
+}
+
+// acquire takes a connection or stream for addr, reporting false when the
+// client is at its limit. Call the returned release when it closes.
+func (cl *ClientLimits) acquire(addr netip.Addr, stream bool) (func(), bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	limit := cl.cfg.MaxConnections
+	if stream {
+		limit = cl.cfg.MaxStreams
+	}
+	if limit == 0 {
+		return func() {}, true
+	}
+	key, limited := cl.clientKey(addr)
+	if !limited {
+		return func() {}, true
+	}
+
+	usage := cl.clients[key]
+	if usage == nil {
+		usage = &clientUsage{}
+		cl.clients[key] = usage
+	}
+	count := &usage.conns
+	if stream {
+		count = &usage.streams
+	}
+	if *count >= limit {
+		if stream {
+			cl.refusedStreams++
+		} else {
+			cl.refusedConns++
+		}
+		cl.forgetLocked(key, usage)
+		return nil, false
+	}
+	*count++
+	if stream {
+		cl.peakStreams = max(cl.peakStreams, usage.streams)
+	} else {
+		cl.peakConns = max(cl.peakConns, usage.conns)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+			*count--
+			cl.forgetLocked(key, usage)
+		})
+	}, true
+}
+
+// forgetLocked drops a client holding nothing
+func (cl *ClientLimits) forgetLocked(key netip.Prefix, usage *clientUsage) {
+	if usage.conns == 0 && usage.streams == 0 {
+		delete(cl.clients, key)
+	}
+}
+
+// connContext is the QUIC transport's hook for new connections; it refuses
+// clients at their connection limit and counts the rest until they close
+func (cl *ClientLimits) connContext(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+	udpAddr, ok := info.RemoteAddr.(*net.UDPAddr)
+	if !ok {
+		return ctx, nil
+	}
+	addr := udpAddr.AddrPort().Addr()
+	release, ok := cl.acquire(addr, false)
+	if !ok {
+		log.Printf("🚧 Refused QUIC connection from %s: too many connections from this client", info.RemoteAddr)
+		return nil, fmt.Errorf("too many connections from %s", addr)
+	}
+	// The context ends when the connection closes or its handshake fails
+	context.AfterFunc(ctx, release)
+	return ctx, nil
+}
+
+// acquireStream counts an HTTP/3 request stream of r's client. A client at
+// its limit gets the stream reset with H3_REQUEST_REJECTED and false.
+func (cl *ClientLimits) acquireStream(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	addr, ok := clientAddr(r)
+	if r.ProtoMajor != 3 || !ok {
+		return func() {}, true
+	}
+	release, ok := cl.acquire(addr, true)
+	if ok {
+		return release, true
+	}
+
+	log.Printf("🚧 Rejected %s %s from %s: too many streams from this client", r.Method, r.URL.Path, r.RemoteAddr)
+	if streamer, ok := w.(http3.HTTPStreamer); ok {
+		str := streamer.HTTPStream()
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestRejected))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestRejected))
+	} else {
+		http.Error(w, "🚫 Too many concurrent requests", http.StatusTooManyRequests)
+	}
+	return nil, false
+}
+
+// Snapshot reports refusals and the clients holding the most
+func (cl *ClientLimits) Snapshot() map[string]interface{} {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	type client struct {
+		key   string
+		usage clientUsage
+	}
+	clients := make([]client, 0, len(cl.clients))
+	for key, usage := range cl.clients {
+		name := key.Addr().String()
+		if key.Addr().Is6() {
+			name = key.String()
+		}
+		clients = append(clients, client{key: name, usage: *usage})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := clients[i].usage, clients[j].usage
+		if a.streams != b.streams {
+			return a.streams > b.streams
+		}
+		return a.conns > b.conns
+	})
+	top := make([]map[string]interface{}, 0, 10)
+	for _, c := range clients[:min(len(clients), 10)] {
+		top = append(top, map[string]interface{}{
+			"client":      c.key,
+			"connections": c.usage.conns,
+			"streams":     c.usage.streams,
+		})
+	}
+
+	return map[string]interface{}{
+		"max_connections":     cl.cfg.MaxConnections,
+		"max_streams":         cl.cfg.MaxStreams,
+		"ipv6_prefix":         cl.cfg.ipv6Prefix(),
+		"exempt":              cl.cfg.Exempt,
+		"clients":             len(cl.clients),
+		"top_clients":         top,
+		"refused_connections": cl.refusedConns,
+		"refused_streams":     cl.refusedStreams,
+		"peak_connections":    cl.peakConns,
+		"peak_streams":        cl.peakStreams,
+	}
+}
+
+// handleClientLimits serves GET /api/client-limits with per-client usage
+func (s *Server) handleClientLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.clientLimits.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"quic-moodle/balancer"
+)
+
+// Cluster sync defaults
+const (
+	defaultClusterRedisPrefix  = "quic-lb:cluster:"
+	defaultClusterSyncInterval = 2 * time.Second
+	defaultClusterCIDTTL       = 10 * time.Minute
+	defaultClusterClaimTimeout = 50 * time.Millisecond
+	clusterSyncTimeout         = time.Second
+	// clusterViewLifetimes is how many intervals a published health view
+	// lives without being refreshed; a stopped instance drops out after it
+	clusterViewLifetimes = 3
+	// maxCIDRefreshes bounds the CIDs routed from the local table whose
+	// shared choices are kept alive per refresh; CIDs beyond it expire
+	// from Redis and are claimed again if another instance needs them
+	maxCIDRefreshes = 65536
+)
+
+// moveCIDScript replaces a shared CID choice only while it still names the
+// backend that went down, so the first instance to notice decides where
+// the CID goes and the others follow
+var moveCIDScript = redis.NewScript(`local agreed = redis.call("GET", KEYS[1])
+if agreed == false or agreed == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return ARGV[2]
+end
+return agreed`)
+
+// ClusterSyncConfig shares routing state through Redis between load
+// balancer instances behind the same address: the fallback choice for each
+// unroutable CID, and every instance's health check view. A backend that
+// any live instance sees down is held down by all of them, so whichever
+// instance receives a packet routes it to the same backend. One instance,
+// elected through a Redis lease, makes QUIC-LB config rotations; the others
+// apply what it announces and ignore rotations in their own config.
+type ClusterSyncConfig struct {
+	Redis       RedisConfig       `json:"redis,omitempty"`        // Sync is on when addr is set; key_prefix default "quic-lb:cluster:", timeout bounds CID claims, default 50ms
+	InstanceID  string            `json:"instance_id,omitempty"`  // Unique name of this instance, default the host name
+	Interval    balancer.Duration `json:"interval,omitempty"`     // How often health views are exchanged and the lease renewed, default 2s
+	CIDTTL      balancer.Duration `json:"cid_ttl,omitempty"`      // How long a shared CID choice is kept after its last use, default 10m
+	LeaderLease balancer.Duration `json:"leader_lease,omitempty"` // How long leadership lasts without renewal, default 15s; more than two intervals
+}
+
+// validate checks the cluster sync settings
+func (cc *ClusterSyncConfig) validate() []error {
+	var errs []error
+	if cc.Redis.Addr == "" {
+		if cc.InstanceID != "" {
+			errs = append(errs, fmt.Errorf("cluster_sync.instance_id needs cluster_sync.redis.addr"))
+		}
+		return errs
+	}
+	if cc.Redis.PasswordRef != "" {
+		if _, err := resolveSecret(cc.Redis.PasswordRef); err != nil {
+			errs = append(errs, fmt.Errorf("cluster_sync.redis.password_ref: %v", err))
+		}
+	}
+	if cc.Interval < 0 || cc.CIDTTL < 0 || cc.Redis.Timeout < 0 || cc.LeaderLease < 0 {
+		errs = append(errs, fmt.Errorf("cluster_sync.interval, cid_ttl, leader_lease and redis.timeout must not be negative"))
+	} else if cc.leaderLease() <= 2*cc.interval() {
+		errs = append(errs, fmt.Errorf("cluster_sync.leader_lease %v must be more than two intervals (%v)", cc.leaderLease(), cc.interval()))
+	}
+	return errs
+}
+
+// instanceID returns the configured instance name or the host name
+func (cc *ClusterSyncConfig) instanceID() string {
+	if cc.InstanceID != "" {
+		return cc.InstanceID
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return fmt.Sprintf("pid-%d", os.Getpid())
+}
+
+// prefix returns the configured Redis key prefix or its default
+func (cc *ClusterSyncConfig) prefix() string {
+	if cc.Redis.KeyPrefix == "" {
+		return defaultClusterRedisPrefix
+	}
+	return cc.Redis.KeyPrefix
+}
+
+// interval returns the configured exchange interval or its default
+func (cc *ClusterSyncConfig) interval() time.Duration {
+	if cc.Interval == 0 {
+		return defaultClusterSyncInterval
+	}
+	return time.Duration(cc.Interval)
+}
+
+// cidTTL returns the configured CID choice lifetime or its default
+func (cc *ClusterSyncConfig) cidTTL() time.Duration {
+	if cc.CIDTTL == 0 {
+		return defaultClusterCIDTTL
+	}
+	return time.Duration(cc.CIDTTL)
+}
+
+// claimTimeout returns the Redis budget of one CID claim
+func (cc *ClusterSyncConfig) claimTimeout() time.Duration {
+	if cc.Redis.Timeout == 0 {
+		return defaultClusterClaimTimeout
+	}
+	return time.Duration(cc.Redis.Timeout)
+}
+
+// clusterView is one instance's published health check results
+type clusterView struct {
+	Instance string          `json:"instance"`
+	Backends map[string]bool `json:"backends"` // backend URL -> alive
+}
+
+// ClusterSync exchanges routing state with the other load balancer
+// instances and reports what it learned
+type ClusterSync struct {
+	mu       sync.Mutex
+	instance string // empty while sync is off
+	peers    []clusterView
+	heldDown map[string][]string // backend URL -> instances that see it down
+	lastSync time.Time
+	lastErr  string
+
+	leader          string          // instance holding the leader lease, as last seen
+	isLeader        bool            // this instance holds the lease
+	newlyElected    bool            // leadership was just taken; the active config is to be asserted
+	active          QUICLBSettings  // settings of the active QUIC-LB config
+	pendingRotation *QUICLBSettings // rotated here as leader, not yet announced
+	rotationEpoch   int64           // latest rotation announced or applied here
+	failedEpoch     int64           // announced rotation that could not be applied
+
+	claims      atomic.Int64 // fallback CID choices offered to the cluster
+	adopted     atomic.Int64 // claims settled by another instance's earlier choice
+	moved       atomic.Int64 // shared choices moved off a backend that went down
+	failed      atomic.Int64 // claims and moves that got no answer from Redis in time
+	refreshed   atomic.Int64 // shared choices kept alive for CIDs routed locally
+	unrefreshed atomic.Int64 // locally routed CIDs over maxCIDRefreshes, left to expire
+}
+
+// NewClusterSync creates the cluster sync state; run starts syncing
+func NewClusterSync() *ClusterSync {
+	return &ClusterSync{}
+}
+
+// redisCIDClaims shares fallback CID choices under one Redis key per CID;
+// the first instance to route a CID sets it
+type redisCIDClaims struct {
+	client  *redis.Client
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	stats   *ClusterSync
+
+	touchMu     sync.Mutex
+	touched     map[string]struct{} // CIDs routed from the local table since the last refresh
+	lastRefresh time.Time
+}
+
+// Claim implements balancer.CIDFallbackStore
+func (rc *redisCIDClaims) Claim(cid, backendURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+	rc.stats.claims.Add(1)
+
+	key := rc.prefix + "cid:" + cid
+	set, err := rc.client.SetNX(ctx, key, backendURL, rc.ttl).Result()
+	if err == nil && !set {
+		var agreed string
+		if agreed, err = rc.client.Get(ctx, key).Result(); err == nil {
+			if agreed != backendURL {
+				rc.stats.adopted.Add(1)
+			}
+			return agreed, nil
+		}
+	}
+	if err != nil {
+		rc.stats.failed.Add(1)
+		return "", err
+	}
+	return backendURL, nil
+}
+
+// Move implements balancer.CIDFallbackStore
+func (rc *redisCIDClaims) Move(cid, from, to string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+
+	agreed, err := moveCIDScript.Run(ctx, rc.client, []string{rc.prefix + "cid:" + cid}, from, to, rc.ttl.Milliseconds()).Text()
+	if err != nil {
+		rc.stats.failed.Add(1)
+		return "", err
+	}
+	if agreed == to {
+		rc.stats.moved.Add(1)
+	}
+	return agreed, nil
+}
+
+// Touch implements balancer.CIDFallbackStore; the shared choices are
+// refreshed in batches by refresh
+func (rc *redisCIDClaims) Touch(cid string) {
+	rc.touchMu.Lock()
+	defer rc.touchMu.Unlock()
+	if _, ok := rc.touched[cid]; ok {
+		return
+	}
+	if len(rc.touched) >= maxCIDRefreshes {
+		rc.stats.unrefreshed.Add(1)
+		return
+	}
+	if rc.touched == nil {
+		rc.touched = make(map[string]struct{})
+	}
+	rc.touched[cid] = struct{}{}
+}
+
+// refresh renews the shared choices of the CIDs routed locally since the
+// last refresh, four times per TTL, so another instance taking over a
+// long-lived connection still finds where it goes
+func (rc *redisCIDClaims) refresh(ctx context.Context) {
+	rc.touchMu.Lock()
+	if time.Since(rc.lastRefresh) < rc.ttl/4 || len(rc.touched) == 0 {
+		rc.touchMu.Unlock()
+		return
+	}
+	touched := rc.touched
+	rc.touched = nil
+	rc.lastRefresh = time.Now()
+	rc.touchMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, clusterSyncTimeout)
+	defer cancel()
+	if _, err := rc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for cid := range touched {
+			pipe.PExpire(ctx, rc.prefix+"cid:"+cid, rc.ttl)
+		}
+		return nil
+	}); err != nil {
+		// Refreshed again at the next touch; choices that expire meanwhile
+		// are claimed again
+		return
+	}
+	rc.stats.refreshed.Add(int64(len(touched)))
+}
+
+// runClusterSync shares fallback CID choices and exchanges health views
+// with the other instances until ctx is done
+func (s *Server) runClusterSync(ctx context.Context, cfg ClusterSyncConfig) {
+	if cfg.Redis.Addr == "" {
+		return
+	}
+	client, err := newRedisClient(cfg.Redis, "cluster_sync")
+	if err != nil {
+		log.Printf("⚠️ Cluster sync off: %v", err)
+		return
+	}
+	defer client.Close()
+
+	instance := cfg.instanceID()
+	s.cluster.mu.Lock()
+	s.cluster.instance = instance
+	s.cluster.mu.Unlock()
+	log.Printf("🤝 Cluster sync on as %q through Redis %s", instance, cfg.Redis.Addr)
+
+	claims := &redisCIDClaims{
+		client:      client,
+		prefix:      cfg.prefix(),
+		ttl:         cfg.cidTTL(),
+		timeout:     cfg.claimTimeout(),
+		stats:       s.cluster,
+		lastRefresh: time.Now(),
+	}
+	s.quicLB.SetCIDFallbackStore(claims)
+	defer s.quicLB.SetCIDFallbackStore(nil)
+
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+	for {
+		s.syncClusterRotation(ctx, client, cfg, instance)
+		s.syncClusterHealth(ctx, client, cfg, instance)
+		claims.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			// Leave the cluster so the others stop following this view
+			// and another instance can lead at once
+			leaveCtx, cancel := context.WithTimeout(context.Background(), clusterSyncTimeout)
+			s.releaseLeadership(leaveCtx, client, cfg, instance)
+			client.Del(leaveCtx, cfg.prefix()+"health:"+instance)
+			client.SRem(leaveCtx, cfg.prefix()+"instances", instance)
+			cancel()
+			s.applyClusterHealth(nil)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncClusterHealth publishes this instance's health check results, reads
+// the other instances' and holds down what any of them sees down
+func (s *Server) syncClusterHealth(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, instance string) {
+	ctx, cancel := context.WithTimeout(ctx, clusterSyncTimeout)
+	defer cancel()
+
+	own := clusterView{Instance: instance, Backends: make(map[string]bool)}
+	for _, backend := range s.quicLB.GetBackendStats() {
+		own.Backends[backend.URL.String()] = backend.ProbedAlive()
+	}
+	peers, err := exchangeClusterViews(ctx, client, cfg, own)
+
+	if errors.Is(err, context.Canceled) {
+		return // shutting down
+	}
+
+	s.cluster.mu.Lock()
+	wasFailing := s.cluster.lastErr != ""
+	s.cluster.lastSync = time.Now()
+	s.cluster.lastErr = ""
+	if err != nil {
+		s.cluster.lastErr = err.Error()
+	}
+	s.cluster.mu.Unlock()
+	switch {
+	case err != nil && !wasFailing:
+		log.Printf("⚠️ Cluster sync failed, keeping the last views: %v", err)
+	case err == nil && wasFailing:
+		log.Printf("🤝 Cluster sync recovered")
+	}
+	if err != nil {
+		return
+	}
+	s.applyClusterHealth(peers)
+}
+
+// exchangeClusterViews stores own under a key that expires unless
+// refreshed and returns the views of the other live instances
+func exchangeClusterViews(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, own clusterView) ([]clusterView, error) {
+	data, err := json.Marshal(own)
+	if err != nil {
+		return nil, err
+	}
+	prefix := cfg.prefix()
+	members := prefix + "instances"
+	if _, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, prefix+"health:"+own.Instance, data, clusterViewLifetimes*cfg.interval())
+		pipe.SAdd(ctx, members, own.Instance)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	instances, err := client.SMembers(ctx, members).Result()
+	if err != nil {
+		return nil, err
+	}
+	var peers []clusterView
+	for _, instance := range instances {
+		if instance == own.Instance {
+			continue
+		}
+		data, err := client.Get(ctx, prefix+"health:"+instance).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Its view expired: the instance stopped without leaving
+			client.SRem(ctx, members, instance)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var view clusterView
+		if err := json.Unmarshal(data, &view); err != nil {
+			log.Printf("⚠️ Cluster view of %q unreadable: %v", instance, err)
+			continue
+		}
+		peers = append(peers, view)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Instance < peers[j].Instance })
+	return peers, nil
+}
+
+// applyClusterHealth holds down every backend a peer sees down and releases
+// the rest; nil peers release all
+func (s *Server) applyClusterHealth(peers []clusterView) {
+	heldDown := make(map[string][]string)
+	for _, peer := range peers {
+		for url, alive := range peer.Backends {
+			if !alive {
+				heldDown[url] = append(heldDown[url], peer.Instance)
+			}
+		}
+	}
+
+	changed := false
+	for _, backend := range s.quicLB.GetBackendStats() {
+		url := backend.URL.String()
+		down := len(heldDown[url]) > 0
+		if backend.SetClusterDown(down) {
+			changed = true
+			if down {
+				log.Printf("🤝 Backend #%d %s held down: seen down by %v", backend.ID, backend.URL.Redacted(), heldDown[url])
+			} else {
+				log.Printf("🤝 Backend #%d %s released: no other instance sees it down", backend.ID, backend.URL.Redacted())
+			}
+		}
+	}
+	if changed {
+		for _, pool := range s.pools.Pools() {
+			pool.RefreshPeers()
+		}
+	}
+
+	s.cluster.mu.Lock()
+	s.cluster.peers = peers
+	s.cluster.heldDown = heldDown
+	s.cluster.mu.Unlock()
+}
+
+// Snapshot reports the instances in the cluster, the backends held down by
+// them and the shared CID claims
+func (cs *ClusterSync) Snapshot() map[string]interface{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	snapshot := map[string]interface{}{
+		"enabled": cs.instance != "",
+	}
+	if cs.instance == "" {
+		return snapshot
+	}
+	peers := make([]string, 0, len(cs.peers))
+	for _, peer := range cs.peers {
+		peers = append(peers, peer.Instance)
+	}
+	snapshot["instance"] = cs.instance
+	snapshot["leader"] = cs.leader
+	snapshot["is_leader"] = cs.isLeader
+	snapshot["rotation_epoch"] = cs.rotationEpoch
+	snapshot["peers"] = peers
+	snapshot["held_down"] = cs.heldDown
+	snapshot["cid_claims"] = map[string]interface{}{
+		"claims":      cs.claims.Load(),
+		"adopted":     cs.adopted.Load(),
+		"moved":       cs.moved.Load(),
+		"failed":      cs.failed.Load(),
+		"refreshed":   cs.refreshed.Load(),
+		"unrefreshed": cs.unrefreshed.Load(),
+	}
+	if !cs.lastSync.IsZero() {
+		snapshot["last_sync"] = cs.lastSync
+	}
+	if cs.lastErr != "" {
+		snapshot["last_error"] = cs.lastErr
+	}
+	return snapshot
+}
+
+// handleCluster serves GET /api/cluster with the other load balancer
+// instances, the leader, the backends held down and the shared CID claims
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.cluster.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
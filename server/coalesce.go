@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Upstream connection coalescing defaults
+const (
+	// coalesceResolveTTL is how long backend host addresses are cached
+	coalesceResolveTTL = 30 * time.Second
+	// coalesceH1Retry is how long a backend that did not negotiate HTTP/2
+	// is sent through the HTTP/1.1 transport before h2 is tried again
+	coalesceH1Retry = 5 * time.Minute
+	// upstreamIdleTimeout matches http.DefaultTransport's idle timeout
+	upstreamIdleTimeout = 90 * time.Second
+)
+
+// UpstreamConfig controls the connections to backends
+type UpstreamConfig struct {
+	Coalesce  bool                    `json:"coalesce,omitempty"` // Share HTTP/2 and HTTP/3 connections between backends on the same address whose certificate covers both names
+	Transport UpstreamTransportConfig `json:"transport"`          // Connection limits and timeouts of the backend transport
+}
+
+// errNoH2 reports a backend that negotiated HTTP/1.1
+var errNoH2 = errors.New("backend did not negotiate HTTP/2")
+
+// UpstreamCoalescer lets backends with different host names share an HTTP/2
+// or HTTP/3 connection when they resolve to the same address and the
+// connection's certificate is valid for each of them (RFC 9113 section 9.1.1,
+// RFC 9114 section 3.3), as with several Moodle vhosts on one origin
+type UpstreamCoalescer struct {
+	enabled atomic.Bool
+
+	mu        sync.Mutex
+	addrs     map[string]resolvedHost // host -> addresses
+	dials     int64
+	coalesced int64
+	fallbacks int64 // requests sent over HTTP/1.1 because h2 was refused
+
+	transports     []*coalescingTransport
+	transportStats *upstreamTransportStats // the shared backend transport, once built
+}
+
+// resolvedHost caches the addresses of a backend host
+type resolvedHost struct {
+	ips     []string
+	expires time.Time
+}
+
+// NewUpstreamCoalescer creates a coalescer, disabled until configured
+func NewUpstreamCoalescer() *UpstreamCoalescer {
+	return &UpstreamCoalescer{addrs: make(map[string]resolvedHost)}
+}
+
+// Configure enables or disables coalescing for new requests; connections
+// already shared stay shared until they close
+func (uc *UpstreamCoalescer) Configure(cfg UpstreamConfig) {
+	if uc.enabled.Swap(cfg.Coalesce) != cfg.Coalesce {
+		log.Printf("🔗 Upstream connection coalescing: %v", cfg.Coalesce)
+	}
+}
+
+// Enabled reports whether coalescing is on
+func (uc *UpstreamCoalescer) Enabled() bool {
+	return uc.enabled.Load()
+}
+
+// resolve returns the IP addresses of host, cached for a short while
+func (uc *UpstreamCoalescer) resolve(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	uc.mu.Lock()
+	cached, ok := uc.addrs[host]
+	uc.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for i, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ips[i] = parsed.String()
+		}
+	}
+	uc.mu.Lock()
+	uc.addrs[host] = resolvedHost{ips: ips, expires: time.Now().Add(coalesceResolveTTL)}
+	uc.mu.Unlock()
+	return ips, nil
+}
+
+// canCoalesce reports whether a connection to remote with TLS state can
+// carry requests for host:port, whose addresses are ips. Cleartext
+// connections only need the same address.
+func canCoalesce(remote net.Addr, state *tls.ConnectionState, host, port string, ips []string) bool {
+	remoteIP, remotePort, err := net.SplitHostPort(remote.String())
+	if err != nil || remotePort != port {
+		return false
+	}
+	if parsed := net.ParseIP(remoteIP); parsed != nil {
+		remoteIP = parsed.String()
+	}
+	if !slices.Contains(ips, remoteIP) {
+		return false
+	}
+	if state == nil {
+		return true
+	}
+	return len(state.PeerCertificates) > 0 && state.PeerCertificates[0].VerifyHostname(host) == nil
+}
+
+// count records a dial, a coalesced connection or an HTTP/1.1 fallback
+func (uc *UpstreamCoalescer) count(counter *int64) {
+	uc.mu.Lock()
+	*counter++
+	uc.mu.Unlock()
+}
+
+// coalescingTransport sends backend requests over shared HTTP/2
+// connections when coalescing is enabled and over base otherwise. It is the
+// transport's connection pool, so the HTTP/2 transport's retries on GOAWAY
+// keep working.
+type coalescingTransport struct {
+	uc   *UpstreamCoalescer
+	base http.RoundTripper
+	h2   *http2.Transport
+	tls  *tls.Config
+	h2c  bool // http:// backends speak cleartext HTTP/2 (gRPC pools)
+
+	mu     sync.Mutex
+	conns  []*upstreamConn
+	h1Only map[string]time.Time // origin -> when h2 was refused
+}
+
+// upstreamConn is a backend HTTP/2 connection and the origins it serves
+type upstreamConn struct {
+	cc      *http2.ClientConn
+	remote  net.Addr
+	tls     *tls.ConnectionState // nil for h2c
+	origins map[string]bool      // "host:port" authorities
+}
+
+// newCoalescingTransport wraps base, the transport used while coalescing is
+// off and for backends without HTTP/2
+func (uc *UpstreamCoalescer) newCoalescingTransport(base http.RoundTripper, h2c bool) *coalescingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	tlsConfig := &tls.Config{}
+	if t, ok := base.(*http.Transport); ok && t.TLSClientConfig != nil {
+		tlsConfig = t.TLSClientConfig.Clone()
+	}
+	t := &coalescingTransport{
+		uc:     uc,
+		base:   base,
+		tls:    tlsConfig,
+		h2c:    h2c,
+		h1Only: make(map[string]time.Time),
+	}
+	t.h2 = &http2.Transport{
+		ConnPool:        t,
+		AllowHTTP:       h2c,
+		IdleConnTimeout: upstreamIdleTimeout,
+		ReadIdleTimeout: 30 * time.Second,
+	}
+	uc.mu.Lock()
+	uc.transports = append(uc.transports, t)
+	uc.mu.Unlock()
+	return t
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.uc.Enabled() || !t.coalescable(req) {
+		return t.base.RoundTrip(t.uc.traced(req))
+	}
+	origin := authority(req)
+	t.mu.Lock()
+	refused, ok := t.h1Only[origin]
+	t.mu.Unlock()
+	if ok && time.Since(refused) < coalesceH1Retry {
+		return t.base.RoundTrip(t.uc.traced(req))
+	}
+
+	resp, err := t.h2.RoundTrip(req)
+	if errors.Is(err, errNoH2) {
+		// Nothing was sent, so the request can still go over HTTP/1.1
+		t.uc.count(&t.uc.fallbacks)
+		return t.base.RoundTrip(t.uc.traced(req))
+	}
+	return resp, err
+}
+
+// coalescable reports whether req can use a shared HTTP/2 connection;
+// protocol upgrades need HTTP/1.1
+func (t *coalescingTransport) coalescable(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	switch req.URL.Scheme {
+	case "https":
+		return true
+	case "http":
+		return t.h2c
+	}
+	return false
+}
+
+// authority returns the "host:port" a request is sent to
+func authority(req *http.Request) string {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// GetClientConn returns a connection for addr: one already serving it, one
+// to the same address whose certificate covers the host, or a new one
+func (t *coalescingTransport) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	if cc := t.reserve(func(c *upstreamConn) bool { return c.origins[addr] }); cc != nil {
+		return cc, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := t.uc.resolve(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	cc := t.reserve(func(c *upstreamConn) bool {
+		if !canCoalesce(c.remote, c.tls, host, port, ips) {
+			return false
+		}
+		c.origins[addr] = true
+		log.Printf("🔗 Coalescing %s onto the backend connection to %s", addr, c.remote)
+		return true
+	})
+	if cc != nil {
+		t.uc.count(&t.uc.coalesced)
+		return cc, nil
+	}
+	return t.dial(req.Context(), addr, host, port, ips, req.URL.Scheme == "https")
+}
+
+// reserve returns the first open connection matching match with a stream
+// reserved for the caller, dropping closed connections on the way
+func (t *coalescingTransport) reserve(match func(*upstreamConn) bool) *http2.ClientConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns = slices.DeleteFunc(t.conns, func(c *upstreamConn) bool {
+		return c.cc.State().Closed
+	})
+	for _, c := range t.conns {
+		if c.cc.CanTakeNewRequest() && match(c) && c.cc.ReserveNewRequest() {
+			return c.cc
+		}
+	}
+	return nil
+}
+
+// dial opens a new HTTP/2 connection to the first reachable address, over
+// TLS or, for h2c, in cleartext
+func (t *coalescingTransport) dial(ctx context.Context, addr, host, port string, ips []string, useTLS bool) (*http2.ClientConn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	for _, ip := range ips {
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port)); err == nil {
+			break
+		}
+	}
+	if conn == nil {
+		return nil, err
+	}
+
+	var state *tls.ConnectionState
+	if useTLS {
+		tlsConfig := t.tls.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cs := tlsConn.ConnectionState()
+		if cs.NegotiatedProtocol != http2.NextProtoTLS {
+			tlsConn.Close()
+			t.mu.Lock()
+			t.h1Only[addr] = time.Now()
+			t.mu.Unlock()
+			return nil, errNoH2
+		}
+		conn, state = tlsConn, &cs
+	}
+
+	cc, err := t.h2.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !cc.ReserveNewRequest() {
+		cc.Close()
+		return nil, errors.New("new backend connection refused a request")
+	}
+	t.mu.Lock()
+	t.conns = append(t.conns, &upstreamConn{cc: cc, remote: conn.RemoteAddr(), tls: state, origins: map[string]bool{addr: true}})
+	t.mu.Unlock()
+	t.uc.count(&t.uc.dials)
+	return cc, nil
+}
+
+// MarkDead forgets a connection the HTTP/2 transport found broken
+func (t *coalescingTransport) MarkDead(cc *http2.ClientConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns = slices.DeleteFunc(t.conns, func(c *upstreamConn) bool {
+		return c.cc == cc
+	})
+}
+
+// Snapshot reports the shared connections and coalescing counters
+func (uc *UpstreamCoalescer) Snapshot() map[string]interface{} {
+	uc.mu.Lock()
+	transports := slices.Clone(uc.transports)
+	transportStats := uc.transportStats
+	snapshot := map[string]interface{}{
+		"enabled":   uc.enabled.Load(),
+		"dials":     uc.dials,
+		"coalesced": uc.coalesced,
+		"fallbacks": uc.fallbacks,
+	}
+	uc.mu.Unlock()
+
+	conns := make([]map[string]interface{}, 0)
+	for _, t := range transports {
+		t.mu.Lock()
+		for _, c := range t.conns {
+			state := c.cc.State()
+			if state.Closed {
+				continue
+			}
+			protocol := "h2"
+			if c.tls == nil {
+				protocol = "h2c"
+			}
+			origins := make([]string, 0, len(c.origins))
+			for origin := range c.origins {
+				origins = append(origins, origin)
+			}
+			slices.Sort(origins)
+			conns = append(conns, map[string]interface{}{
+				"protocol":        protocol,
+				"remote":          c.remote.String(),
+				"origins":         origins,
+				"active_streams":  state.StreamsActive,
+				"max_concurrency": state.MaxConcurrentStreams,
+			})
+		}
+		t.mu.Unlock()
+	}
+	snapshot["connections"] = conns
+	if transportStats != nil {
+		snapshot["transport"] = transportStats.snapshot()
+	}
+	return snapshot
+}
+
+// handleUpstream serves GET /api/upstream with the shared backend connections
+// and the backend transport's connection counters
+func (s *Server) handleUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.upstream.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
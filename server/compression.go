@@ -0,0 +1,489 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression defaults
+const (
+	defaultCompressMinSize   = 1024
+	defaultCompressCPUBudget = 0.5
+)
+
+// defaultCompressEncodings is the server's preference when the client
+// accepts several encodings equally
+var defaultCompressEncodings = []string{"zstd", "br", "gzip"}
+
+// defaultCompressTypes are the MIME types worth compressing; "text/*"
+// matches every text type
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/vnd.moodle.*",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+// CompressionConfig enables on-the-fly compression of backend responses
+// that are not already encoded. Compression time is accounted, and once it
+// exceeds the CPU budget within a second responses go out uncompressed.
+type CompressionConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Encodings []string `json:"encodings,omitempty"`  // Content codings in preference order: "zstd", "br", "gzip"; defaults to all three
+	MinSize   int64    `json:"min_size,omitempty"`   // Smallest response compressed in bytes, default 1024
+	MIMETypes []string `json:"mime_types,omitempty"` // Compressible types, "text/*" style wildcards allowed; defaults to text, JSON, JavaScript, XML and SVG
+	CPUBudget float64  `json:"cpu_budget,omitempty"` // Share of all cores compression may use, default 0.5
+}
+
+// validate checks the compression settings
+func (cc *CompressionConfig) validate() []error {
+	var errs []error
+	for _, encoding := range cc.Encodings {
+		if _, ok := compressors[encoding]; !ok {
+			errs = append(errs, fmt.Errorf("compression.encodings: unknown encoding %q (use zstd, br or gzip)", encoding))
+		}
+	}
+	if cc.MinSize < 0 {
+		errs = append(errs, fmt.Errorf("compression.min_size %d must not be negative", cc.MinSize))
+	}
+	for _, t := range cc.MIMETypes {
+		if !strings.Contains(t, "/") {
+			errs = append(errs, fmt.Errorf("compression.mime_types: %q is not a MIME type", t))
+		}
+	}
+	if cc.CPUBudget < 0 || cc.CPUBudget > 1 {
+		errs = append(errs, fmt.Errorf("compression.cpu_budget %.2f must be between 0 and 1", cc.CPUBudget))
+	}
+	return errs
+}
+
+// encodings returns the configured encodings or their default
+func (cc *CompressionConfig) encodings() []string {
+	if len(cc.Encodings) == 0 {
+		return defaultCompressEncodings
+	}
+	return cc.Encodings
+}
+
+// minSize returns the configured minimum size or its default
+func (cc *CompressionConfig) minSize() int64 {
+	if cc.MinSize == 0 {
+		return defaultCompressMinSize
+	}
+	return cc.MinSize
+}
+
+// mimeTypes returns the configured MIME types or their default
+func (cc *CompressionConfig) mimeTypes() []string {
+	if len(cc.MIMETypes) == 0 {
+		return defaultCompressTypes
+	}
+	return cc.MIMETypes
+}
+
+// cpuBudget returns the configured CPU budget or its default
+func (cc *CompressionConfig) cpuBudget() float64 {
+	if cc.CPUBudget == 0 {
+		return defaultCompressCPUBudget
+	}
+	return cc.CPUBudget
+}
+
+// compressible reports whether responses of contentType are compressed
+func (cc *CompressionConfig) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cc.mimeTypes() {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the encoding for a request's Accept-Encoding: the
+// highest q-value wins, and among equals the configured order
+func (cc *CompressionConfig) negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range cc.encodings() {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressor creates and recycles the writers of one content coding
+type compressor struct {
+	pool sync.Pool
+	new  func(io.Writer) compressWriteCloser
+}
+
+// compressWriteCloser is an encoder that can flush and be reused
+type compressWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressors holds the supported content codings. Levels favour speed:
+// responses are compressed on every request, not once like static files.
+var compressors = map[string]*compressor{
+	"gzip": {new: func(w io.Writer) compressWriteCloser {
+		gz, _ := gzip.NewWriterLevel(w, 5)
+		return gz
+	}},
+	"br": {new: func(w io.Writer) compressWriteCloser {
+		return brotli.NewWriterLevel(w, 4)
+	}},
+	"zstd": {new: func(w io.Writer) compressWriteCloser {
+		// Browsers decode zstd with windows of at most 8 MiB (RFC 8878)
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return enc
+	}},
+}
+
+// get returns an encoder writing to w
+func (c *compressor) get(w io.Writer) compressWriteCloser {
+	if enc, ok := c.pool.Get().(compressWriteCloser); ok {
+		enc.Reset(w)
+		return enc
+	}
+	return c.new(w)
+}
+
+// CompressionStats counts compressed responses and keeps compression within
+// the CPU budget
+type CompressionStats struct {
+	mu          sync.Mutex
+	responses   map[string]int64 // per encoding
+	bytesIn     int64
+	bytesOut    int64
+	skipped     map[string]int64 // per reason
+	cpuTime     time.Duration
+	window      time.Time     // start of the current budget second
+	windowSpent time.Duration // compression time within the window
+}
+
+// NewCompressionStats creates empty compression metrics
+func NewCompressionStats() *CompressionStats {
+	return &CompressionStats{responses: make(map[string]int64), skipped: make(map[string]int64)}
+}
+
+// skip records a response left uncompressed
+func (cs *CompressionStats) skip(reason string) {
+	cs.mu.Lock()
+	cs.skipped[reason]++
+	cs.mu.Unlock()
+}
+
+// withinBudget reports whether compression time this second is below the
+// budget's share of all cores
+func (cs *CompressionStats) withinBudget(budget float64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if time.Since(cs.window) >= time.Second {
+		cs.window = time.Now()
+		cs.windowSpent = 0
+	}
+	limit := time.Duration(budget * float64(runtime.GOMAXPROCS(0)) * float64(time.Second))
+	return cs.windowSpent < limit
+}
+
+// spend accounts time spent compressing
+func (cs *CompressionStats) spend(d time.Duration) {
+	cs.mu.Lock()
+	cs.cpuTime += d
+	cs.windowSpent += d
+	cs.mu.Unlock()
+}
+
+// record counts a finished compressed response
+func (cs *CompressionStats) record(encoding string, in, out int64) {
+	cs.mu.Lock()
+	cs.responses[encoding]++
+	cs.bytesIn += in
+	cs.bytesOut += out
+	cs.mu.Unlock()
+}
+
+// compress wraps w so r's response is compressed when eligible; call the
+// returned writer's finish once the handler is done. Requests without an
+// acceptable encoding, HEAD and range requests get w back unwrapped.
+func (cs *CompressionStats) compress(w http.ResponseWriter, r *http.Request, cc CompressionConfig) (http.ResponseWriter, func()) {
+	if !cc.Enabled || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		return w, func() {}
+	}
+	encoding := cc.negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		cs.skip("not_accepted")
+		return w, func() {}
+	}
+	cw := &compressResponseWriter{ResponseWriter: w, stats: cs, cfg: cc, encoding: encoding}
+	return cw, cw.finish
+}
+
+// compressResponseWriter decides at WriteHeader whether to compress. When
+// the backend sent no Content-Length, the body is held back until min_size
+// bytes arrived, so small responses go out as they are.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	stats    *CompressionStats
+	cfg      CompressionConfig
+	encoding string
+
+	code    int // final status held while pending
+	pending []byte
+	state   compressState
+	enc     compressWriteCloser
+	out     countingWriter
+	in      int64
+}
+
+type compressState int
+
+const (
+	compressUndecided compressState = iota // before the final header
+	compressPending                        // buffering to learn the size
+	compressActive
+	compressPassthrough
+)
+
+// countingWriter counts the compressed bytes sent to the client
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.state != compressUndecided || code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+
+	h := w.Header()
+	reason := ""
+	switch {
+	case code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified:
+		reason = "status"
+	case h.Get("Content-Encoding") != "":
+		reason = "already_encoded"
+	case !w.cfg.compressible(h.Get("Content-Type")):
+		reason = "mime_type"
+	case strings.Contains(h.Get("Cache-Control"), "no-transform"):
+		reason = "no_transform"
+	}
+	if reason != "" {
+		w.passthrough(reason)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+
+	if length := h.Get("Content-Length"); length != "" {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n < w.cfg.minSize() {
+			w.passthrough("too_small")
+			return
+		}
+		w.start()
+		return
+	}
+	w.state = compressPending
+}
+
+// passthrough sends the response as the backend sent it
+func (w *compressResponseWriter) passthrough(reason string) {
+	w.stats.skip(reason)
+	w.state = compressPassthrough
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.pending) > 0 {
+		w.ResponseWriter.Write(w.pending)
+		w.pending = nil
+	}
+}
+
+// start switches to the encoder, unless the CPU budget is used up
+func (w *compressResponseWriter) start() {
+	if !w.stats.withinBudget(w.cfg.cpuBudget()) {
+		w.passthrough("cpu_budget")
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.encoding)
+	// The encoded body is a different representation
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+	w.state = compressActive
+	w.ResponseWriter.WriteHeader(w.code)
+
+	w.out.w = w.ResponseWriter
+	w.enc = compressors[w.encoding].get(&w.out)
+	if len(w.pending) > 0 {
+		pending := w.pending
+		w.pending = nil
+		w.encode(pending)
+	}
+}
+
+// encode compresses b and accounts the time spent
+func (w *compressResponseWriter) encode(b []byte) (int, error) {
+	started := time.Now()
+	n, err := w.enc.Write(b)
+	w.stats.spend(time.Since(started))
+	w.in += int64(n)
+	return n, err
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.state == compressUndecided {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.state {
+	case compressPending:
+		w.pending = append(w.pending, b...)
+		if int64(len(w.pending)) >= w.cfg.minSize() {
+			w.start()
+		}
+		return len(b), nil
+	case compressActive:
+		return w.encode(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends what the encoder holds. The proxy flushes after every write
+// of a response without Content-Length, so a pending response keeps
+// buffering unless it is an event stream, which must not be held back.
+func (w *compressResponseWriter) Flush() {
+	if w.state == compressPending {
+		if mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mediaType != "text/event-stream" {
+			return
+		}
+		w.start()
+	}
+	if w.state == compressActive {
+		started := time.Now()
+		w.enc.Flush()
+		w.stats.spend(time.Since(started))
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish completes the encoded body, or sends a response that stayed below
+// min_size as it is
+func (w *compressResponseWriter) finish() {
+	switch w.state {
+	case compressPending:
+		w.passthrough("too_small")
+	case compressActive:
+		started := time.Now()
+		w.enc.Close()
+		w.stats.spend(time.Since(started))
+		compressors[w.encoding].pool.Put(w.enc)
+		w.enc = nil
+		w.stats.record(w.encoding, w.in, w.out.n)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Snapshot reports compressed responses, ratios and skip reasons
+func (cs *CompressionStats) Snapshot() map[string]interface{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ratio := 0.0
+	if cs.bytesOut > 0 {
+		ratio = float64(cs.bytesIn) / float64(cs.bytesOut)
+	}
+	responses := make(map[string]int64, len(cs.responses))
+	for encoding, n := range cs.responses {
+		responses[encoding] = n
+	}
+	skipped := make(map[string]int64, len(cs.skipped))
+	for reason, n := range cs.skipped {
+		skipped[reason] = n
+	}
+	return map[string]interface{}{
+		"responses":   responses,
+		"bytes_in":    cs.bytesIn,
+		"bytes_out":   cs.bytesOut,
+		"ratio":       ratio,
+		"skipped":     skipped,
+		"cpu_seconds": cs.cpuTime.Seconds(),
+	}
+}
+
+// handleCompression serves GET /api/compression with compression metrics
+func (s *Server) handleCompression(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cc := s.config.Current().Compression
+	stats := s.compression.Snapshot()
+	stats["enabled"] = cc.Enabled
+	stats["encodings"] = slices.Clone(cc.encodings())
+	stats["min_size"] = cc.minSize()
+	stats["cpu_budget"] = cc.cpuBudget()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
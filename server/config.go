@@ -0,0 +1,1122 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"quic-moodle/balancer"
+	"quic-moodle/quiclb"
+)
+
+// Config is the on-disk configuration of the load balancer (JSON)
+type Config struct {
+	Include       []string             `json:"include,omitempty"` // Files merged over this one, e.g. "conf.d/*.json"
+	Server        ServerConfig         `json:"server"`
+	TLS           TLSConfig            `json:"tls"`
+	TLSProfiles   map[string]TLSConfig `json:"tls_profiles,omitempty"`
+	LoadBalancer  LoadBalancerConfig   `json:"load_balancer"`
+	Backends      []BackendConfig      `json:"backends"`
+	Pools         []PoolConfig         `json:"pools,omitempty"`         // Additional named backend pools
+	VirtualHosts  []VirtualHostConfig  `json:"virtual_hosts,omitempty"` // Host/SNI -> pool routing
+	Routes        []RouteConfig        `json:"routes,omitempty"`        // Request -> pool rules, checked before virtual_hosts
+	DefaultPool   string               `json:"default_pool,omitempty"`  // Pool used when no rule or host matches ("default")
+	Experiments   []ExperimentConfig   `json:"experiments,omitempty"`   // A/B splits of a pool's clients between variant pools
+	Admin         AdminConfig          `json:"admin"`
+	QUICLB        QUICLBSettings       `json:"quic_lb"`
+	Features      FeaturesConfig       `json:"features"`
+	SPIFFE        SPIFFEConfig         `json:"spiffe"`
+	WebTransport  WebTransportConfig   `json:"webtransport"`
+	HTTPDatagrams HTTPDatagramConfig   `json:"http_datagrams"`
+	Priority      PriorityConfig       `json:"priority"`
+	WebSocket     WebSocketConfig      `json:"websocket"`
+	Streaming     StreamingConfig      `json:"streaming"`
+	Ranges        RangeConfig          `json:"ranges"`
+	Drain         DrainConfig          `json:"drain"`
+	QPACK         QPACKConfig          `json:"qpack"`
+	Upstream      UpstreamConfig       `json:"upstream"`
+	Compression   CompressionConfig    `json:"compression"`
+	Cache         CacheConfig          `json:"cache"`
+	Static        StaticConfig         `json:"static"`
+	RequestBody   RequestBodyConfig    `json:"request_body"`
+	Connect       ConnectConfig        `json:"connect"`
+	RateLimit     RateLimitConfig      `json:"rate_limit"`
+	Admission     AdmissionConfig      `json:"admission"`
+	Access        AccessConfig         `json:"access"`
+	GeoIP         GeoIPConfig          `json:"geoip"`
+	AltSvc        AltSvcSettings       `json:"alt_svc,omitempty"` // Alt-Svc advertisement per listener
+
+	AddressValidation AddressValidationConfig `json:"address_validation"`
+	ClientLimits      ClientLimitsConfig      `json:"client_limits"`
+	Plugins           []PluginConfig          `json:"plugins,omitempty"` // Middleware plugins run in order after access control
+	JWT               JWTConfig               `json:"jwt"`
+	ForwardAuth       ForwardAuthConfig       `json:"forward_auth"`
+	ResponseHeaders   ResponseHeadersConfig   `json:"response_headers"`
+	SecurityHeaders   SecurityHeadersConfig   `json:"security_headers"`
+	RequestValidation RequestValidationConfig `json:"request_validation"`
+	Timeouts          TimeoutsConfig          `json:"timeouts"`
+	BasicAuth         BasicAuthConfig         `json:"basic_auth"`
+	AuthFailures      AuthFailuresConfig      `json:"auth_failures"`
+	SessionState      SessionStateConfig      `json:"session_state"`
+	Bots              BotConfig               `json:"bots"`
+	HeaderLimits      HeaderLimitsConfig      `json:"header_limits"`
+	Memory            MemoryConfig            `json:"memory"`
+	RoutingState      RoutingStateConfig      `json:"routing_state"`
+	ClusterSync       ClusterSyncConfig       `json:"cluster_sync"`
+	Kubernetes        KubernetesConfig        `json:"kubernetes"`
+	Moodle            MoodleConfig            `json:"moodle"`
+	Agents            AgentsConfig            `json:"agents"`
+	Faults            FaultsConfig            `json:"faults"`
+	UDPL4             UDPL4Config             `json:"udp_l4"`
+	ServerIDs         ServerIDsConfig         `json:"server_ids"`
+}
+
+// ServerConfig holds listener addresses
+type ServerConfig struct {
+	ListenAddr     string `json:"listen_addr"`      // HTTP/2 (TCP) and HTTP/3 (UDP) address
+	HTTPListenAddr string `json:"http_listen_addr"` // Plain HTTP/1.1 address, empty disables it
+	StaticDir      string `json:"static_dir"`
+	TLSProfile     string `json:"tls_profile"`      // TLS profile for the TCP listener ("" or "default" = tls)
+	QUICTLSProfile string `json:"quic_tls_profile"` // TLS profile for the QUIC listener, defaults to tls_profile
+	QUICProfile    string `json:"quic_profile"`     // OptimizedQUICConfig scenario for the QUIC listener
+	Disable0RTT    bool   `json:"disable_0rtt"`     // Refuse 0-RTT even when the QUIC profile allows it
+}
+
+// TLSConfig holds certificate and protocol version settings
+type TLSConfig struct {
+	CertFile     string              `json:"cert_file"`
+	KeyFile      string              `json:"key_file,omitempty"`
+	KeyRef       string              `json:"key_ref,omitempty"` // PEM private key from a secret reference, overrides key_file
+	MinVersion   string              `json:"min_version"`       // "1.2" or "1.3"
+	MaxVersion   string              `json:"max_version"`
+	CipherSuites []string            `json:"cipher_suites,omitempty"`  // TLS 1.2 suites by crypto/tls name; TLS 1.3 suites are not configurable
+	Curves       []string            `json:"curves,omitempty"`         // Key exchange groups in preference order: X25519, X25519MLKEM768, P-256, P-384, P-521
+	Certificates []CertificateConfig `json:"certificates,omitempty"`   // Additional certificates selected by SNI; cert_file is the fallback
+	ClientCAFile string              `json:"client_ca_file,omitempty"` // Verify client certificates against this CA bundle
+	ClientAuth   string              `json:"client_auth,omitempty"`    // "request" (default) verifies certificates that are sent, "require" rejects handshakes without one
+	NextProtos   []string            `json:"next_protos,omitempty"`    // ALPN protocols in preference order: "h3", "h2", "http/1.1"; defaults to all three
+
+	SPIFFE            bool `json:"spiffe,omitempty"`              // Serve the SPIFFE X.509 SVID instead of cert_file; requires the spiffe section
+	ExpiryWarningDays int  `json:"expiry_warning_days,omitempty"` // Log warnings for certificates expiring within this many days, default 30
+}
+
+// CertificateConfig is a certificate served to clients asking for one of its names
+type CertificateConfig struct {
+	CertFile    string   `json:"cert_file"`
+	KeyFile     string   `json:"key_file,omitempty"`
+	KeyRef      string   `json:"key_ref,omitempty"`      // PEM private key from a secret reference, overrides key_file
+	ServerNames []string `json:"server_names,omitempty"` // SNI names, "*.example.com" allowed; defaults to the certificate's DNS names
+}
+
+// AdminConfig holds settings for the admin listener and API
+type AdminConfig struct {
+	ListenAddr      string   `json:"listen_addr"`         // Dedicated management address
+	Token           string   `json:"token,omitempty"`     // Bearer token required on every admin request
+	TokenRef        string   `json:"token_ref,omitempty"` // Secret reference for the token, overrides token
+	CertFile        string   `json:"cert_file"`           // Serve the admin API over TLS when set
+	KeyFile         string   `json:"key_file"`            //
+	ClientCAFile    string   `json:"client_ca_file"`      // Require client certificates signed by this CA (mTLS)
+	PublicEndpoints []string `json:"public_endpoints"`    // Read-only endpoints also served on the public listener
+	HistorySize     int      `json:"history_size"`        // Number of applied configs kept for rollback
+
+	APIKeys     []AdminAPIKey     `json:"api_keys,omitempty"`     // Named keys limited to scopes, sent as a bearer token or X-API-Key
+	ClientCerts []AdminClientCert `json:"client_certs,omitempty"` // Scopes of client certificate identities, needs client_ca_file
+
+	AllowedOrigins []string `json:"allowed_origins,omitempty"` // Origins of dashboards on other sites allowed to change state, e.g. "https://ops.example.org"
+}
+
+// AdminAPIKey is an admin API key and the endpoints it may change
+type AdminAPIKey struct {
+	Name   string   `json:"name"`              // Shown in the audit log
+	Key    string   `json:"key,omitempty"`     // The key itself
+	KeyRef string   `json:"key_ref,omitempty"` // Secret reference for the key, overrides key
+	Scopes []string `json:"scopes"`            // "read", "config", "routing", "access", "cache", "agent" or "*" for all
+}
+
+// AdminClientCert grants scopes to admin clients presenting a certificate
+// with the identity
+type AdminClientCert struct {
+	Identity string   `json:"identity"` // Subject common name or a DNS, URI or email SAN
+	Scopes   []string `json:"scopes"`   // As for api_keys
+}
+
+// QUICLBSettings holds the QUIC-LB Draft 20 parameters used at startup
+type QUICLBSettings struct {
+	Algorithm               string `json:"algorithm"` // "plaintext", "stream-cipher", "block-cipher"
+	ConfigRotationBits      uint8  `json:"config_rotation_bits"`
+	ServerIDLen             uint8  `json:"server_id_len"`
+	ConnectionIDLen         uint8  `json:"connection_id_len"`
+	NonceLen                uint8  `json:"nonce_len"`
+	KeyRef                  string `json:"key_ref,omitempty"` // "hex:<32 hex digits>", "file:/path", "env:NAME" or "cred:NAME"
+	FirstOctetEncodesCIDLen bool   `json:"first_octet_encodes_cid_len"`
+}
+
+// LoadBalancerConfig holds the settings of the default backend pool
+type LoadBalancerConfig struct {
+	Algorithm     string                     `json:"algorithm"`
+	SessionCookie string                     `json:"session_cookie"` // Cookie used for session affinity; a trailing "*" matches any suffix, e.g. "MoodleSession*"
+	HealthCheck   balancer.HealthCheckConfig `json:"health_check"`
+	Cache         bool                       `json:"cache,omitempty"` // Cache GET responses of the default pool, see the cache section
+}
+
+// PoolConfig describes a named backend pool
+type PoolConfig struct {
+	Name          string                     `json:"name"`
+	Algorithm     string                     `json:"algorithm"`
+	Backends      []BackendConfig            `json:"backends"`
+	SessionCookie string                     `json:"session_cookie"`
+	HealthCheck   balancer.HealthCheckConfig `json:"health_check"`
+	Protocol      string                     `json:"protocol,omitempty"` // Backend protocol: "http" (default) or "grpc" for HTTP/2 gRPC backends
+	GRPCWeb       bool                       `json:"grpc_web,omitempty"` // Translate gRPC-Web requests from browsers to gRPC (grpc pools only)
+	Cache         bool                       `json:"cache,omitempty"`    // Cache GET responses per Cache-Control, e.g. Moodle theme, JavaScript and language files
+}
+
+// VirtualHostConfig routes requests for a set of hosts to a pool.
+// Hosts are matched against the Host header, then the TLS SNI name;
+// a leading "*." matches any subdomain.
+type VirtualHostConfig struct {
+	Hosts []string `json:"hosts"`
+	Pool  string   `json:"pool"`
+}
+
+// RouteConfig sends requests matching every set condition to a pool. Header
+// and query values are regular expressions; an empty value only requires the
+// header or parameter to be present.
+type RouteConfig struct {
+	Name       string            `json:"name,omitempty"`        // Stable identity of the route, which forward auth sessions are bound to; default a hash of the route's definition
+	PathPrefix string            `json:"path_prefix,omitempty"` // "/webservice/" or "/webservice/*"
+	PathRegex  string            `json:"path_regex,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Query      map[string]string `json:"query,omitempty"`
+	Countries  []string          `json:"countries,omitempty"` // Client countries (ISO 3166-1 alpha-2) from the geoip databases
+	ASNs       []uint            `json:"asns,omitempty"`      // Client autonomous systems from the geoip databases
+	Pool       string            `json:"pool"`
+
+	RequireClientCert bool   `json:"require_client_cert,omitempty"` // Reject requests without a verified client certificate
+	EarlyData         string `json:"early_data,omitempty"`          // 0-RTT requests: "safe" (default) accepts GET, HEAD and OPTIONS, "allow" any method, "reject" none, "wait" holds other methods until the handshake completes
+	MaxBodySize       int64  `json:"max_body_size,omitempty"`       // Overrides request_body.max_size for this route; -1 for no limit
+	BodyBuffering     string `json:"body_buffering,omitempty"`      // Overrides request_body.buffering for this route
+	RequireJWT        bool   `json:"require_jwt,omitempty"`         // Reject requests without a bearer token valid for the jwt settings
+	ForwardAuth       bool   `json:"forward_auth,omitempty"`        // Let the forward_auth service decide about requests
+	BasicAuth         bool   `json:"basic_auth,omitempty"`          // Require a user and password from the basic_auth settings
+
+	Access AccessConfig `json:"access,omitzero"` // Client addresses for this route, checked after the global access lists
+	CORS   *CORSConfig  `json:"cors,omitempty"`  // Cross-origin policy; preflights are answered by the load balancer
+
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers,omitempty"` // Overrides of the global security headers for this route
+}
+
+// identity names the route independently of its position: "route:" and
+// its name, or a hash of its definition when unnamed, so editing the route
+// gives it a new identity
+func (rt *RouteConfig) identity() string {
+	if rt.Name != "" {
+		return "route:" + rt.Name
+	}
+	definition, _ := json.Marshal(rt)
+	sum := sha256.Sum256(definition)
+	return "route:" + hex.EncodeToString(sum[:8])
+}
+
+// BackendConfig describes a single upstream server
+type BackendConfig struct {
+	URL string `json:"url"`
+}
+
+// validAlgorithms lists the algorithms supported by balancer.Pool
+var validAlgorithms = []string{
+	"round-robin", "weighted-round-robin", "least-connections",
+}
+
+// DefaultConfig returns the configuration used when no config file is given.
+// Backend URLs and certificate paths still honour the legacy environment variables.
+func DefaultConfig() *Config {
+	cfg := &Config{
+		Server: ServerConfig{
+			ListenAddr:     ":9443",
+			HTTPListenAddr: ":8080",
+			StaticDir:      "./static/",
+			QUICProfile:    "default",
+		},
+		TLS: TLSConfig{
+			CertFile:   "localhost+2.pem",
+			KeyFile:    "localhost+2-key.pem",
+			MinVersion: "1.2",
+			MaxVersion: "1.3",
+		},
+		LoadBalancer: LoadBalancerConfig{
+			Algorithm:     "round-robin",
+			SessionCookie: "session-id",
+			HealthCheck:   defaultHealthCheck(),
+		},
+		QUICLB: QUICLBSettings{
+			Algorithm:               "plaintext", // Start with plaintext for demonstration
+			ConfigRotationBits:      0x01,        // 3-bit config rotation (0-6)
+			ServerIDLen:             2,           // 2 bytes for server ID (supports up to 65536 backends)
+			ConnectionIDLen:         8,           // 8-byte connection ID length
+			FirstOctetEncodesCIDLen: false,       // Use random bits for privacy by default
+		},
+		Admin: AdminConfig{
+			ListenAddr:      "127.0.0.1:9444",
+			PublicEndpoints: []string{"/api/connections", "/api/loadbalancer", "/api/quic-lb"},
+			HistorySize:     10,
+		},
+	}
+
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cfg.TLS.CertFile = certFile
+	}
+	if keyFile := os.Getenv("TLS_KEY_FILE"); keyFile != "" {
+		cfg.TLS.KeyFile = keyFile
+	}
+
+	for _, u := range getBackendURLs() {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: u})
+	}
+	return cfg
+}
+
+// defaultHealthCheck returns the health check settings used when a pool sets none
+func defaultHealthCheck() balancer.HealthCheckConfig {
+	return balancer.HealthCheckConfig{
+		Interval: balancer.Duration(15 * time.Second),
+		Timeout:  balancer.Duration(3 * time.Second),
+	}
+}
+
+// AllPools returns every backend pool, starting with the "default" pool built
+// from the top-level backends and load_balancer sections. Unset pool settings
+// inherit from load_balancer.
+func (c *Config) AllPools() []PoolConfig {
+	pools := []PoolConfig{{
+		Name:          defaultPoolName,
+		Algorithm:     c.LoadBalancer.Algorithm,
+		Backends:      c.Backends,
+		SessionCookie: c.LoadBalancer.SessionCookie,
+		HealthCheck:   c.LoadBalancer.HealthCheck,
+		Protocol:      balancer.ProtocolHTTP,
+		Cache:         c.LoadBalancer.Cache,
+	}}
+	for _, p := range c.Pools {
+		if p.Algorithm == "" {
+			p.Algorithm = c.LoadBalancer.Algorithm
+		}
+		if p.SessionCookie == "" {
+			p.SessionCookie = c.LoadBalancer.SessionCookie
+		}
+		if p.HealthCheck == (balancer.HealthCheckConfig{}) {
+			p.HealthCheck = c.LoadBalancer.HealthCheck
+		}
+		if p.HealthCheck.Interval == 0 {
+			p.HealthCheck.Interval = c.LoadBalancer.HealthCheck.Interval
+		}
+		if p.HealthCheck.Timeout == 0 {
+			p.HealthCheck.Timeout = c.LoadBalancer.HealthCheck.Timeout
+		}
+		if p.HealthCheck.Concurrency == 0 {
+			p.HealthCheck.Concurrency = c.LoadBalancer.HealthCheck.Concurrency
+		}
+		if p.HealthCheck.SigningKeyRef == "" {
+			p.HealthCheck.SigningKeyRef = c.LoadBalancer.HealthCheck.SigningKeyRef
+		}
+		if p.Protocol == "" {
+			p.Protocol = balancer.ProtocolHTTP
+		}
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// maxIncludeDepth bounds nested include directives
+const maxIncludeDepth = 8
+
+// LoadConfig reads a JSON config file, layering it over DefaultConfig.
+// Files named by include directives (glob patterns relative to the including
+// file, applied in sorted order) are merged over it: scalar settings override,
+// tls_profiles are merged and backends, pools, virtual_hosts and routes append.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	// Backends in the file replace the defaults rather than appending to them
+	cfg.Backends = nil
+
+	if err := loadConfigFile(cfg, path, nil); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadConfigFile decodes path over cfg and then processes its includes.
+// stack holds the files currently being loaded to detect include cycles.
+func loadConfigFile(cfg *Config, path string, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path %s: %v", path, err)
+	}
+	for _, p := range stack {
+		if p == abs {
+			return fmt.Errorf("config include cycle: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return fmt.Errorf("config includes nested deeper than %d at %s", maxIncludeDepth, path)
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	// Lists accumulate across files, everything else is overridden in place
+	backends, pools, vhosts, routes := cfg.Backends, cfg.Pools, cfg.VirtualHosts, cfg.Routes
+	includes := cfg.Include
+	cfg.Backends, cfg.Pools, cfg.VirtualHosts, cfg.Routes, cfg.Include = nil, nil, nil, nil, nil
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+
+	cfg.Backends = append(backends, cfg.Backends...)
+	cfg.Pools = append(pools, cfg.Pools...)
+	cfg.VirtualHosts = append(vhosts, cfg.VirtualHosts...)
+	cfg.Routes = append(routes, cfg.Routes...)
+	fileIncludes := cfg.Include
+	cfg.Include = includes
+	if len(stack) == 1 {
+		cfg.Include = fileIncludes
+	}
+
+	for _, pattern := range fileIncludes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("config %s: include %q: %v", path, pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return fmt.Errorf("config %s: included file %s does not exist", path, pattern)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err := loadConfigFile(cfg, match, stack); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration for structural errors.
+// All problems are reported together so they can be fixed in one pass.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.ListenAddr == "" {
+		errs = append(errs, fmt.Errorf("server.listen_addr must not be empty"))
+	} else if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("server.listen_addr %q: %v", c.Server.ListenAddr, err))
+	}
+	if c.Server.HTTPListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Server.HTTPListenAddr); err != nil {
+			errs = append(errs, fmt.Errorf("server.http_listen_addr %q: %v", c.Server.HTTPListenAddr, err))
+		}
+	}
+
+	errs = append(errs, c.TLS.validate("tls")...)
+	for name, profile := range c.TLSProfiles {
+		if name == "default" {
+			errs = append(errs, fmt.Errorf("tls_profiles: %q is reserved for the top-level tls section", name))
+		}
+		errs = append(errs, profile.validate("tls_profiles."+name)...)
+	}
+	if name, profile, err := c.TLSProfile(c.Server.TLSProfile); err != nil {
+		errs = append(errs, fmt.Errorf("server.tls_profile: %v", err))
+	} else if !slices.Contains(profile.nextProtos(), "h2") && !slices.Contains(profile.nextProtos(), "http/1.1") {
+		errs = append(errs, fmt.Errorf("server.tls_profile: TLS profile %q offers neither h2 nor http/1.1 for the TCP listener", name))
+	}
+	if name, profile, err := c.TLSProfile(c.Server.QUICTLSProfile); err != nil {
+		errs = append(errs, fmt.Errorf("server.quic_tls_profile: %v", err))
+	} else if !slices.Contains(profile.nextProtos(), "h3") {
+		errs = append(errs, fmt.Errorf("server.quic_tls_profile: TLS profile %q does not offer h3 for the QUIC listener", name))
+	}
+	if _, err := OptimizedQUICConfig(c.Server.QUICProfile); err != nil {
+		errs = append(errs, fmt.Errorf("server.quic_profile: %v", err))
+	}
+
+	errs = append(errs, c.SPIFFE.validate(c.usesSPIFFE())...)
+	errs = append(errs, c.Admin.validate()...)
+
+	if quicLBConfig, err := c.QUICLB.ToQUICLBConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("quic_lb: %v", err))
+	} else if err := quiclb.ValidateConfig(quicLBConfig, c.BackendCount()); err != nil {
+		for _, e := range UnwrapErrors(err) {
+			errs = append(errs, fmt.Errorf("quic_lb: %v", e))
+		}
+	}
+	if c.Admin.HistorySize < 1 {
+		errs = append(errs, fmt.Errorf("admin.history_size must be at least 1, got %d", c.Admin.HistorySize))
+	}
+
+	if len(c.Backends) == 0 {
+		errs = append(errs, fmt.Errorf("at least one backend is required"))
+	}
+	errs = append(errs, validatePool("load_balancer", "backends", c.AllPools()[0])...)
+
+	poolNames := map[string]bool{defaultPoolName: true}
+	for i, p := range c.AllPools()[1:] {
+		prefix := fmt.Sprintf("pools[%d]", i)
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name must not be empty", prefix))
+		} else if poolNames[p.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is already used", prefix, p.Name))
+		}
+		poolNames[p.Name] = true
+		if len(p.Backends) == 0 {
+			errs = append(errs, fmt.Errorf("%s: at least one backend is required", prefix))
+		}
+		errs = append(errs, validatePool(prefix, prefix+".backends", p)...)
+	}
+
+	routeNames := make(map[string]bool)
+	for i, rt := range c.Routes {
+		prefix := fmt.Sprintf("routes[%d]", i)
+		if rt.Name != "" {
+			if routeNames[rt.Name] {
+				errs = append(errs, fmt.Errorf("%s.name %q is used twice", prefix, rt.Name))
+			}
+			routeNames[rt.Name] = true
+		}
+		if !poolNames[rt.Pool] {
+			errs = append(errs, fmt.Errorf("%s.pool %q is not a configured pool", prefix, rt.Pool))
+		}
+		if rt.PathPrefix == "" && rt.PathRegex == "" && len(rt.Methods) == 0 && len(rt.Headers) == 0 && len(rt.Query) == 0 &&
+			len(rt.Countries) == 0 && len(rt.ASNs) == 0 {
+			errs = append(errs, fmt.Errorf("%s: at least one match condition is required", prefix))
+		}
+		if rt.RequireClientCert && !c.verifiesClientCerts() {
+			errs = append(errs, fmt.Errorf("%s.require_client_cert needs client_ca_file on the TLS profile of the public listeners", prefix))
+		}
+		if rt.RequireJWT && c.JWT.JWKSURL == "" {
+			errs = append(errs, fmt.Errorf("%s.require_jwt needs jwt.jwks_url", prefix))
+		}
+		if rt.ForwardAuth && c.ForwardAuth.URL == "" {
+			errs = append(errs, fmt.Errorf("%s.forward_auth needs forward_auth.url", prefix))
+		}
+		if rt.BasicAuth && !c.BasicAuth.hasUsers() {
+			errs = append(errs, fmt.Errorf("%s.basic_auth needs basic_auth.users or basic_auth.htpasswd_file", prefix))
+		}
+		if rt.BasicAuth && rt.RequireJWT {
+			errs = append(errs, fmt.Errorf("%s: basic_auth and require_jwt both use the Authorization header", prefix))
+		}
+		if rt.CORS != nil {
+			errs = append(errs, rt.CORS.validate(prefix+".cors")...)
+		}
+		if rt.SecurityHeaders != nil {
+			errs = append(errs, rt.SecurityHeaders.validate(prefix+".security_headers")...)
+		}
+		switch rt.EarlyData {
+		case "", earlyDataSafe, earlyDataAllow, earlyDataReject, earlyDataWait:
+		default:
+			errs = append(errs, fmt.Errorf("%s.early_data %q must be \"safe\", \"allow\", \"reject\" or \"wait\"", prefix, rt.EarlyData))
+		}
+		if rt.MaxBodySize < -1 {
+			errs = append(errs, fmt.Errorf("%s.max_body_size %d must be -1 (no limit) or more", prefix, rt.MaxBodySize))
+		}
+		if err := validateBodyBuffering(rt.BodyBuffering); err != nil {
+			errs = append(errs, fmt.Errorf("%s.body_buffering: %v", prefix, err))
+		}
+		errs = append(errs, rt.Access.validate(prefix+".access")...)
+		for j, code := range rt.Countries {
+			if !validCountryCode(code) {
+				errs = append(errs, fmt.Errorf("%s.countries[%d] %q must be an ISO 3166-1 alpha-2 code", prefix, j, code))
+			}
+		}
+		if (len(rt.Countries) > 0 || rt.Access.usesGeoIP()) && c.GeoIP.CountryDB == "" {
+			errs = append(errs, fmt.Errorf("%s: country rules need geoip.country_db", prefix))
+		}
+		if (len(rt.ASNs) > 0 || len(rt.Access.DenyASNs) > 0) && c.GeoIP.ASNDB == "" {
+			errs = append(errs, fmt.Errorf("%s: ASN rules need geoip.asn_db", prefix))
+		}
+		if rt.PathPrefix != "" && rt.PathRegex != "" {
+			errs = append(errs, fmt.Errorf("%s: path_prefix and path_regex are mutually exclusive", prefix))
+		}
+		if rt.PathPrefix != "" && !strings.HasPrefix(rt.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("%s.path_prefix %q must start with /", prefix, rt.PathPrefix))
+		}
+		if rt.PathRegex != "" {
+			if _, err := regexp.Compile(rt.PathRegex); err != nil {
+				errs = append(errs, fmt.Errorf("%s.path_regex: %v", prefix, err))
+			}
+		}
+		for _, method := range rt.Methods {
+			if method == "" || strings.ContainsAny(method, " \t") {
+				errs = append(errs, fmt.Errorf("%s.methods: invalid method %q", prefix, method))
+			}
+		}
+		for name, pattern := range rt.Headers {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s.headers[%q]: %v", prefix, name, err))
+			}
+		}
+		for name, pattern := range rt.Query {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s.query[%q]: %v", prefix, name, err))
+			}
+		}
+	}
+	errs = append(errs, c.WebTransport.validate(poolNames)...)
+	errs = append(errs, validateExperiments(c.Experiments, poolNames)...)
+	errs = append(errs, c.HTTPDatagrams.validate()...)
+	errs = append(errs, c.Priority.validate()...)
+	errs = append(errs, c.WebSocket.validate()...)
+	errs = append(errs, c.Streaming.validate()...)
+	errs = append(errs, c.Ranges.validate()...)
+	errs = append(errs, c.Drain.validate()...)
+	errs = append(errs, c.QPACK.validate()...)
+	errs = append(errs, c.Compression.validate()...)
+	errs = append(errs, c.Cache.validate()...)
+	errs = append(errs, c.Static.validate()...)
+	errs = append(errs, c.RequestBody.validate()...)
+	errs = append(errs, c.Connect.validate()...)
+	errs = append(errs, c.RateLimit.validate()...)
+	errs = append(errs, c.Admission.validate()...)
+	errs = append(errs, c.Access.validate("access")...)
+	errs = append(errs, c.GeoIP.validate()...)
+	errs = append(errs, c.AddressValidation.validate()...)
+	errs = append(errs, c.ClientLimits.validate()...)
+	errs = append(errs, validatePlugins(c.Plugins)...)
+	errs = append(errs, c.JWT.validate()...)
+	errs = append(errs, c.ForwardAuth.validate()...)
+	errs = append(errs, c.ResponseHeaders.validate()...)
+	errs = append(errs, c.SecurityHeaders.validate("security_headers")...)
+	errs = append(errs, c.RequestValidation.validate()...)
+	errs = append(errs, c.Timeouts.validate()...)
+	errs = append(errs, c.BasicAuth.validate()...)
+	errs = append(errs, c.AuthFailures.validate()...)
+	errs = append(errs, c.SessionState.validate()...)
+	errs = append(errs, c.Bots.validate()...)
+	errs = append(errs, c.HeaderLimits.validate()...)
+	errs = append(errs, c.Upstream.validate()...)
+	errs = append(errs, c.Memory.validate()...)
+	errs = append(errs, c.RoutingState.validate(c.SessionState)...)
+	errs = append(errs, c.ClusterSync.validate()...)
+	errs = append(errs, c.Kubernetes.validate()...)
+	errs = append(errs, c.Moodle.validate()...)
+	errs = append(errs, c.Agents.validate()...)
+	errs = append(errs, c.Faults.validate()...)
+	errs = append(errs, c.UDPL4.validate()...)
+	errs = append(errs, c.ServerIDs.validate(c.QUICLB.ServerIDLen, c.AllPools())...)
+	if (len(c.Access.AllowCountries) > 0 || len(c.Access.DenyCountries) > 0) && c.GeoIP.CountryDB == "" {
+		errs = append(errs, fmt.Errorf("access: country rules need geoip.country_db"))
+	}
+	if len(c.Access.DenyASNs) > 0 && c.GeoIP.ASNDB == "" {
+		errs = append(errs, fmt.Errorf("access: ASN rules need geoip.asn_db"))
+	}
+	errs = append(errs, c.AltSvc.validate()...)
+	if c.DefaultPool != "" && !poolNames[c.DefaultPool] {
+		errs = append(errs, fmt.Errorf("default_pool %q is not a configured pool", c.DefaultPool))
+	}
+
+	seenHosts := make(map[string]int)
+	for i, vh := range c.VirtualHosts {
+		prefix := fmt.Sprintf("virtual_hosts[%d]", i)
+		if !poolNames[vh.Pool] {
+			errs = append(errs, fmt.Errorf("%s.pool %q is not a configured pool", prefix, vh.Pool))
+		}
+		if len(vh.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("%s.hosts must not be empty", prefix))
+		}
+		for _, host := range vh.Hosts {
+			host = normalizeHost(host)
+			if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				errs = append(errs, fmt.Errorf("%s: invalid host %q (wildcards are only allowed as a leading \"*.\")", prefix, host))
+				continue
+			}
+			if j, dup := seenHosts[host]; dup {
+				errs = append(errs, fmt.Errorf("%s: host %q is already routed by virtual_hosts[%d]", prefix, host, j))
+			}
+			seenHosts[host] = i
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validatePool checks a pool's algorithm, health check and backend URLs
+func validatePool(prefix, backendsPrefix string, p PoolConfig) []error {
+	var errs []error
+
+	if !isValidAlgorithm(p.Algorithm) {
+		errs = append(errs, fmt.Errorf("%s.algorithm %q is not one of %s",
+			prefix, p.Algorithm, strings.Join(validAlgorithms, ", ")))
+	}
+	if p.SessionCookie == "" {
+		errs = append(errs, fmt.Errorf("%s.session_cookie must not be empty", prefix))
+	}
+	if p.HealthCheck.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("%s.health_check.interval must be positive", prefix))
+	}
+	if p.HealthCheck.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s.health_check.timeout must be positive", prefix))
+	}
+	if p.HealthCheck.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("%s.health_check.concurrency must not be negative", prefix))
+	}
+	if p.HealthCheck.Path != "" && !strings.HasPrefix(p.HealthCheck.Path, "/") {
+		errs = append(errs, fmt.Errorf("%s.health_check.path %q must start with /", prefix, p.HealthCheck.Path))
+	}
+	if p.HealthCheck.SigningKeyRef != "" {
+		if p.HealthCheck.Path == "" {
+			errs = append(errs, fmt.Errorf("%s.health_check.signing_key_ref needs a path, TCP probes cannot be signed", prefix))
+		}
+		if secret, err := resolveSecret(p.HealthCheck.SigningKeyRef); err != nil {
+			errs = append(errs, fmt.Errorf("%s.health_check.signing_key_ref: %v", prefix, err))
+		} else if len(bytes.TrimSpace(secret)) < 32 {
+			errs = append(errs, fmt.Errorf("%s.health_check.signing_key_ref: key must be at least 32 bytes", prefix))
+		}
+	}
+	if p.Protocol != balancer.ProtocolHTTP && p.Protocol != balancer.ProtocolGRPC {
+		errs = append(errs, fmt.Errorf("%s.protocol %q is not one of http, grpc", prefix, p.Protocol))
+	}
+	if p.GRPCWeb && p.Protocol != balancer.ProtocolGRPC {
+		errs = append(errs, fmt.Errorf("%s.grpc_web requires protocol grpc", prefix))
+	}
+
+	seen := make(map[string]int)
+	for i, b := range p.Backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d].url %q: %v", backendsPrefix, i, b.URL, err))
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("%s[%d].url %q: scheme must be http or https", backendsPrefix, i, b.URL))
+		}
+		if u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s[%d].url %q: missing host", backendsPrefix, i, b.URL))
+		}
+		if j, dup := seen[u.String()]; dup {
+			errs = append(errs, fmt.Errorf("%s[%d].url %q duplicates %s[%d]", backendsPrefix, i, b.URL, backendsPrefix, j))
+		}
+		seen[u.String()] = i
+	}
+	return errs
+}
+
+// BackendCount is the number of backends across all pools, each of which
+// needs its own QUIC-LB server ID
+func (c *Config) BackendCount() int {
+	n := 0
+	for _, p := range c.AllPools() {
+		n += len(p.Backends)
+	}
+	return n
+}
+
+func isValidAlgorithm(algorithm string) bool {
+	for _, alg := range validAlgorithms {
+		if algorithm == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTLSVersion maps a config version string to a crypto/tls constant
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (want 1.2 or 1.3)", v)
+	}
+}
+
+// defaultCipherSuites are the TLS 1.2 suites offered when a profile sets no cipher_suites
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// parseCipherSuites maps crypto/tls cipher suite names to their IDs. Insecure
+// suites and TLS 1.3 suites, which crypto/tls always enables, are rejected.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return defaultCipherSuites, nil
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("%s is insecure and not supported", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("%s is a TLS 1.3 suite, TLS 1.3 suites are always enabled", name)
+		}
+		if slices.Contains(suites, suite.ID) {
+			return nil, fmt.Errorf("%s is listed twice", name)
+		}
+		suites = append(suites, suite.ID)
+	}
+	return suites, nil
+}
+
+// findCipherSuite looks a cipher suite up by name
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, suite := range suites {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
+
+// curveIDs maps config curve names to crypto/tls key exchange groups
+var curveIDs = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// defaultCurves are offered when a profile sets no curves
+var defaultCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+
+// parseCurves maps config curve names to crypto/tls key exchange groups
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return defaultCurves, nil
+	}
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := curveIDs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q (want X25519, X25519MLKEM768, P-256, P-384 or P-521)", name)
+		}
+		if slices.Contains(curves, curve) {
+			return nil, fmt.Errorf("%s is listed twice", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// TLSProfile resolves a TLS profile name; "" and "default" select the top-level tls section
+func (c *Config) TLSProfile(name string) (string, TLSConfig, error) {
+	if name == "" || name == "default" {
+		return "default", c.TLS, nil
+	}
+	profile, ok := c.TLSProfiles[name]
+	if !ok {
+		return name, TLSConfig{}, fmt.Errorf("unknown TLS profile %q", name)
+	}
+	return name, profile, nil
+}
+
+// validate checks a TLS profile; prefix names it in error messages
+func (t *TLSConfig) validate(prefix string) []error {
+	var errs []error
+
+	if t.SPIFFE {
+		if len(t.Certificates) > 0 {
+			errs = append(errs, fmt.Errorf("%s.certificates cannot be combined with %s.spiffe", prefix, prefix))
+		}
+	} else {
+		defaultCert := t.defaultCertificate()
+		errs = append(errs, defaultCert.validate(prefix)...)
+	}
+	seen := make(map[string]int)
+	for i, cert := range t.Certificates {
+		certPrefix := fmt.Sprintf("%s.certificates[%d]", prefix, i)
+		errs = append(errs, cert.validate(certPrefix)...)
+		for _, name := range cert.ServerNames {
+			normalized := normalizeHost(name)
+			if !validServerName(normalized) {
+				errs = append(errs, fmt.Errorf("%s.server_names: invalid name %q", certPrefix, name))
+			} else if j, dup := seen[normalized]; dup {
+				errs = append(errs, fmt.Errorf("%s.server_names: %q is already served by %s.certificates[%d]", certPrefix, name, prefix, j))
+			} else {
+				seen[normalized] = i
+			}
+		}
+	}
+	switch t.ClientAuth {
+	case "", "request", "require":
+		if t.ClientAuth != "" && t.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("%s.client_auth requires %s.client_ca_file", prefix, prefix))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.client_auth %q must be \"request\" or \"require\"", prefix, t.ClientAuth))
+	}
+	if t.ExpiryWarningDays < 0 {
+		errs = append(errs, fmt.Errorf("%s.expiry_warning_days must not be negative", prefix))
+	}
+	seenProtos := make(map[string]bool)
+	for _, proto := range t.NextProtos {
+		switch {
+		case !slices.Contains(defaultNextProtos, proto):
+			errs = append(errs, fmt.Errorf("%s.next_protos: unsupported protocol %q (want h3, h2 or http/1.1)", prefix, proto))
+		case seenProtos[proto]:
+			errs = append(errs, fmt.Errorf("%s.next_protos: %q is listed twice", prefix, proto))
+		}
+		seenProtos[proto] = true
+	}
+	minVersion, err := parseTLSVersion(t.MinVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s.min_version: %v", prefix, err))
+	}
+	maxVersion, err := parseTLSVersion(t.MaxVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s.max_version: %v", prefix, err))
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		errs = append(errs, fmt.Errorf("%s.min_version %s is greater than %s.max_version %s", prefix, t.MinVersion, prefix, t.MaxVersion))
+	}
+	if suites, err := parseCipherSuites(t.CipherSuites); err != nil {
+		errs = append(errs, fmt.Errorf("%s.cipher_suites: %v", prefix, err))
+	} else if minVersion == tls.VersionTLS12 && slices.Contains(t.nextProtos(), "h2") &&
+		!slices.Contains(suites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) && !slices.Contains(suites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		// net/http refuses to serve HTTP/2 over TLS 1.2 without one of them
+		errs = append(errs, fmt.Errorf("%s.cipher_suites: HTTP/2 over TLS 1.2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", prefix))
+	}
+	if _, err := parseCurves(t.Curves); err != nil {
+		errs = append(errs, fmt.Errorf("%s.curves: %v", prefix, err))
+	}
+	return errs
+}
+
+// verifiesClientCerts reports whether a public TLS listener asks clients for certificates
+func (c *Config) verifiesClientCerts() bool {
+	for _, name := range []string{c.Server.TLSProfile, c.Server.QUICTLSProfile} {
+		if _, profile, err := c.TLSProfile(name); err == nil && profile.ClientCAFile != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultNextProtos is offered when a TLS profile sets no next_protos
+var defaultNextProtos = []string{"h3", "h2", "http/1.1"}
+
+// nextProtos returns the ALPN protocols offered by the profile
+func (t *TLSConfig) nextProtos() []string {
+	if len(t.NextProtos) == 0 {
+		return defaultNextProtos
+	}
+	return t.NextProtos
+}
+
+// expiryWarning returns how long before expiry the profile's certificates are reported
+func (t *TLSConfig) expiryWarning() time.Duration {
+	days := t.ExpiryWarningDays
+	if days == 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// defaultCertificate is the certificate served when no SNI name matches
+func (t *TLSConfig) defaultCertificate() CertificateConfig {
+	return CertificateConfig{CertFile: t.CertFile, KeyFile: t.KeyFile, KeyRef: t.KeyRef}
+}
+
+// validate checks that a certificate has a cert file and a loadable key reference
+func (c *CertificateConfig) validate(prefix string) []error {
+	var errs []error
+	if c.CertFile == "" {
+		errs = append(errs, fmt.Errorf("%s.cert_file is required", prefix))
+	}
+	if c.KeyFile == "" && c.KeyRef == "" {
+		errs = append(errs, fmt.Errorf("%s.key_file or %s.key_ref is required", prefix, prefix))
+	} else if c.KeyRef != "" {
+		if _, err := resolveSecret(c.KeyRef); err != nil {
+			errs = append(errs, fmt.Errorf("%s.key_ref: %v", prefix, err))
+		}
+	}
+	return errs
+}
+
+// validServerName accepts a host name, optionally with a leading "*." wildcard label
+func validServerName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	return name != "" && !strings.Contains(name, "*")
+}
+
+// validate checks the admin listener settings
+func (a *AdminConfig) validate() []error {
+	var errs []error
+
+	host, _, err := net.SplitHostPort(a.ListenAddr)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("admin.listen_addr %q: %v", a.ListenAddr, err))
+	} else if a.Token == "" && a.TokenRef == "" && len(a.APIKeys) == 0 && a.ClientCAFile == "" && !isLoopbackHost(host) {
+		errs = append(errs, fmt.Errorf("admin.listen_addr %q is not a loopback address: set admin.token, admin.token_ref, admin.api_keys or admin.client_ca_file", a.ListenAddr))
+	}
+	if a.TokenRef != "" {
+		if _, err := a.resolveToken(); err != nil {
+			errs = append(errs, fmt.Errorf("admin.token_ref: %v", err))
+		}
+	}
+
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("admin.cert_file and admin.key_file must be set together"))
+	}
+	if a.ClientCAFile != "" && a.CertFile == "" {
+		errs = append(errs, fmt.Errorf("admin.client_ca_file requires admin.cert_file and admin.key_file"))
+	}
+
+	names := make(map[string]bool)
+	for i, key := range a.APIKeys {
+		prefix := fmt.Sprintf("admin.api_keys[%d]", i)
+		if key.Name == "" {
+			errs = append(errs, fmt.Errorf("%s needs a name", prefix))
+		} else if names[key.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", prefix, key.Name))
+		}
+		names[key.Name] = true
+		if resolved, err := key.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.key_ref: %v", prefix, err))
+		} else if len(resolved) < 16 {
+			errs = append(errs, fmt.Errorf("%s needs a key of at least 16 characters", prefix))
+		}
+		errs = append(errs, validateAdminScopes(prefix, key.Scopes)...)
+	}
+	if len(a.ClientCerts) > 0 && a.ClientCAFile == "" {
+		errs = append(errs, fmt.Errorf("admin.client_certs requires admin.client_ca_file"))
+	}
+	for i, cert := range a.ClientCerts {
+		prefix := fmt.Sprintf("admin.client_certs[%d]", i)
+		if cert.Identity == "" {
+			errs = append(errs, fmt.Errorf("%s needs an identity", prefix))
+		}
+		errs = append(errs, validateAdminScopes(prefix, cert.Scopes)...)
+	}
+
+	for i, origin := range a.AllowedOrigins {
+		if !validAdminOrigin(origin) {
+			errs = append(errs, fmt.Errorf("admin.allowed_origins[%d] %q must be a scheme://host[:port] origin", i, origin))
+		}
+	}
+
+	for i, path := range a.PublicEndpoints {
+		if !strings.HasPrefix(path, "/api/") {
+			errs = append(errs, fmt.Errorf("admin.public_endpoints[%d] %q must be an /api/ path", i, path))
+		} else if strings.HasPrefix(path, "/api/admin/") {
+			errs = append(errs, fmt.Errorf("admin.public_endpoints[%d] %q: /api/admin/ endpoints cannot be public", i, path))
+		}
+	}
+	return errs
+}
+
+// resolve returns the API key, loading key_ref if set
+func (k *AdminAPIKey) resolve() (string, error) {
+	if k.KeyRef == "" {
+		return k.Key, nil
+	}
+	key, err := resolveSecret(k.KeyRef)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(key)), nil
+}
+
+// resolveToken returns the admin bearer token, loading token_ref if set
+func (a *AdminConfig) resolveToken() (string, error) {
+	if a.TokenRef == "" {
+		return a.Token, nil
+	}
+	token, err := resolveSecret(a.TokenRef)
+	if err != nil {
+		return "", err
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return "", fmt.Errorf("token is empty")
+	}
+	return string(token), nil
+}
+
+// isLoopbackHost reports whether a listen host only accepts local connections
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ToQUICLBConfig resolves the key reference and builds the encoder configuration
+func (q *QUICLBSettings) ToQUICLBConfig() (*quiclb.Config, error) {
+	config := &quiclb.Config{
+		Algorithm:               q.Algorithm,
+		ConfigRotationBits:      q.ConfigRotationBits,
+		ServerIDLen:             q.ServerIDLen,
+		ConnectionIDLen:         q.ConnectionIDLen,
+		NonceLen:                q.NonceLen,
+		FirstOctetEncodesCIDLen: q.FirstOctetEncodesCIDLen,
+		Active:                  true,
+		CreatedAt:               time.Now(),
+	}
+
+	if q.KeyRef != "" {
+		key, err := resolveKeyRef(q.KeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("key_ref: %v", err)
+		}
+		config.Key = key
+		config.KeyRef = q.KeyRef
+	}
+	return config, nil
+}
+
+// getBackendURLs returns backend URLs from environment variables or defaults
+func getBackendURLs() []string {
+	// Try to get from environment variables first
+	if backend1 := os.Getenv("BACKEND_1_URL"); backend1 != "" {
+		if backend2 := os.Getenv("BACKEND_2_URL"); backend2 != "" {
+			if backend3 := os.Getenv("BACKEND_3_URL"); backend3 != "" {
+				return []string{backend1, backend2, backend3}
+			}
+		}
+	}
+
+	// Fall back to localhost defaults
+	return []string{
+		"http://localhost:8081", // Backend 1
+		"http://localhost:8082", // Backend 2
+		"http://localhost:8083", // Backend 3
+	}
+}
+
+// UnwrapErrors flattens an errors.Join result, such as the one returned by
+// Validate, into its parts
+func UnwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigVersion is one entry of the applied configuration history
+type ConfigVersion struct {
+	Version   int       `json:"version"`
+	AppliedAt time.Time `json:"applied_at"`
+	Source    string    `json:"source"` // "startup", "admin-api", "rollback:N", ...
+	Config    *Config   `json:"config,omitempty"`
+}
+
+// ConfigChange describes a single differing field between two configs
+type ConfigChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // "added", "removed", "changed"
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// record appends cfg to the history, trimming it to Admin.HistorySize.
+// Callers must hold m.mu for writing (or own m exclusively).
+func (m *ConfigManager) record(cfg *Config, source string) {
+	m.version++
+	m.history = append(m.history, ConfigVersion{
+		Version:   m.version,
+		AppliedAt: m.appliedAt,
+		Source:    source,
+		Config:    cloneConfig(cfg),
+	})
+
+	limit := cfg.Admin.HistorySize
+	if limit < 1 {
+		limit = 1
+	}
+	if len(m.history) > limit {
+		m.history = append([]ConfigVersion(nil), m.history[len(m.history)-limit:]...)
+	}
+}
+
+// Versions returns the history metadata without the config bodies, newest first
+func (m *ConfigManager) Versions() []ConfigVersion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	versions := make([]ConfigVersion, 0, len(m.history))
+	for i := len(m.history) - 1; i >= 0; i-- {
+		v := m.history[i]
+		v.Config = nil
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// Version returns a copy of a historical configuration
+func (m *ConfigManager) Version(version int) (*ConfigVersion, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, v := range m.history {
+		if v.Version == version {
+			v.Config = cloneConfig(v.Config)
+			return &v, nil
+		}
+	}
+	return nil, fmt.Errorf("config version %d not found (history keeps %d versions)", version, len(m.history))
+}
+
+// Rollback re-applies a historical configuration as a new version
+func (m *ConfigManager) Rollback(version int) (restartRequired []string, persisted bool, err error) {
+	v, err := m.Version(version)
+	if err != nil {
+		return nil, false, err
+	}
+	log.Printf("⏪ Rolling back configuration to version %d (applied %s)", version, v.AppliedAt.Format(time.RFC3339))
+	return m.Update(v.Config, fmt.Sprintf("rollback:%d", version))
+}
+
+// diffConfigs compares two configurations field by field using their JSON
+// form. Changed secrets are reported with their values redacted.
+func diffConfigs(from, to *Config) []ConfigChange {
+	a := flattenConfig(from)
+	b := flattenConfig(to)
+
+	changes := []ConfigChange{}
+	for path, oldValue := range a {
+		newValue, ok := b[path]
+		switch {
+		case !ok:
+			changes = append(changes, ConfigChange{Path: path, Op: "removed", Old: oldValue})
+		case !reflect.DeepEqual(oldValue, newValue):
+			changes = append(changes, ConfigChange{Path: path, Op: "changed", Old: oldValue, New: newValue})
+		}
+	}
+	for path, newValue := range b {
+		if _, ok := a[path]; !ok {
+			changes = append(changes, ConfigChange{Path: path, Op: "added", New: newValue})
+		}
+	}
+
+	redactedA := flattenConfig(redactConfig(from))
+	redactedB := flattenConfig(redactConfig(to))
+	for i := range changes {
+		if value, ok := redactedA[changes[i].Path]; ok && changes[i].Old != nil {
+			changes[i].Old = value
+		}
+		if value, ok := redactedB[changes[i].Path]; ok && changes[i].New != nil {
+			changes[i].New = value
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// flattenConfig maps every leaf of the config's JSON form to a dotted path
+func flattenConfig(cfg *Config) map[string]interface{} {
+	out := make(map[string]interface{})
+	if cfg == nil {
+		return out
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return out
+	}
+	var tree interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return out
+	}
+	flattenValue("", tree, out)
+	return out
+}
+
+func flattenValue(prefix string, v interface{}, out map[string]interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flattenValue(path, child, out)
+		}
+	case []interface{}:
+		if len(val) == 0 {
+			out[prefix] = val
+		}
+		for i, child := range val {
+			flattenValue(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	default:
+		out[prefix] = val
+	}
+}
+
+// handleAdminConfigVersions serves the config history:
+//
+//	GET /api/admin/config/versions            list versions
+//	GET /api/admin/config/versions/N          full config of version N
+//	GET /api/admin/config/versions/N/diff     diff of version N against the running config
+func (s *Server) handleAdminConfigVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/config/versions"), "/")
+	if rest == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"versions":     s.config.Versions(),
+			"history_size": s.config.Accepted().Admin.HistorySize,
+		})
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "diff") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	v, err := s.config.Version(version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		changes := diffConfigs(s.config.Current(), v.Config)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":    "running",
+			"to":      fmt.Sprintf("version-%d", version),
+			"changes": changes,
+		})
+		return
+	}
+
+	v.Config = redactConfig(v.Config)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAdminConfigRollback serves POST /api/admin/config/rollback {"version": N}
+func (s *Server) handleAdminConfigRollback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	v, err := s.config.Version(req.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var changes []ConfigChange
+	log.Printf("⏪ Rolling back configuration to version %d (applied %s)", req.Version, v.AppliedAt.Format(time.RFC3339))
+	restartRequired, persisted, err := s.config.Modify(fmt.Sprintf("rollback:%d", req.Version), func(accepted *Config) (*Config, error) {
+		changes = diffConfigs(accepted, v.Config)
+		return v.Config, configChangeAllowed(r, accepted, v.Config)
+	})
+	if errors.Is(err, errConfigInvalid) {
+		http.Error(w, fmt.Sprintf("Version %d no longer validates: %v", req.Version, err), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), configErrorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          fmt.Sprintf("Rolled back to version %d", req.Version),
+		"changes":          changes,
+		"persisted":        persisted,
+		"restart_required": restartRequired,
+	})
+}
+
+// resolveConfigRef loads the config named by "running", "file" or "version-N"
+func (s *Server) resolveConfigRef(ref string) (*Config, error) {
+	switch {
+	case ref == "running":
+		return s.config.Current(), nil
+	case ref == "file":
+		s.config.mu.RLock()
+		path := s.config.path
+		s.config.mu.RUnlock()
+		if path == "" {
+			return nil, fmt.Errorf("running on built-in defaults, there is no config file")
+		}
+		return LoadConfig(path)
+	case strings.HasPrefix(ref, "version-"):
+		version, err := strconv.Atoi(strings.TrimPrefix(ref, "version-"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", ref)
+		}
+		v, err := s.config.Version(version)
+		if err != nil {
+			return nil, err
+		}
+		return v.Config, nil
+	default:
+		return nil, fmt.Errorf("unknown config %q (want running, file or version-N)", ref)
+	}
+}
+
+// handleAdminConfigDiff serves GET /api/admin/config/diff?against=running|file|version-N[&from=...]
+// comparing the running config (or from) with another config to detect drift
+func (s *Server) handleAdminConfigDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = "running"
+	}
+	against := r.URL.Query().Get("against")
+	if against == "" {
+		against = "file"
+	}
+
+	fromConfig, err := s.resolveConfigRef(from)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("from: %v", err), http.StatusBadRequest)
+		return
+	}
+	againstConfig, err := s.resolveConfigRef(against)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("against: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	changes := diffConfigs(fromConfig, againstConfig)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":      from,
+		"to":        against,
+		"drift":     len(changes) > 0,
+		"changes":   changes,
+		"timestamp": time.Now(),
+	})
+}
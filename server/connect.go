@@ -0,0 +1,363 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// CONNECT tunnel defaults
+const (
+	defaultConnectDialTimeout = 10 * time.Second
+	defaultConnectIdleTimeout = 10 * time.Minute
+)
+
+// ConnectConfig allows CONNECT tunnels (RFC 9110 section 9.3.6) on the TCP
+// listeners to a fixed set of targets, so services a Moodle site embeds,
+// such as BigBlueButton's TURN over TCP, can share the load balancer's
+// address. Targets are "host:port"; a "*." host prefix matches subdomains.
+type ConnectConfig struct {
+	AllowedTargets []string          `json:"allowed_targets,omitempty"` // "turn.example.org:443", "*.bbb.example.org:3478"; empty refuses CONNECT
+	DialTimeout    balancer.Duration `json:"dial_timeout,omitempty"`    // How long connecting to a target may take, default 10s
+	IdleTimeout    balancer.Duration `json:"idle_timeout,omitempty"`    // Close tunnels without traffic in either direction for this long, default 10m
+}
+
+// validate checks the CONNECT settings
+func (cc *ConnectConfig) validate() []error {
+	var errs []error
+	for i, target := range cc.AllowedTargets {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" || port == "" {
+			errs = append(errs, fmt.Errorf("connect.allowed_targets[%d] %q must be host:port", i, target))
+		}
+	}
+	if cc.DialTimeout < 0 || cc.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("connect timeouts must not be negative"))
+	}
+	return errs
+}
+
+// dialTimeout returns the configured dial timeout or its default
+func (cc *ConnectConfig) dialTimeout() time.Duration {
+	if cc.DialTimeout == 0 {
+		return defaultConnectDialTimeout
+	}
+	return cc.DialTimeout.Duration()
+}
+
+// idleTimeout returns the configured idle timeout or its default
+func (cc *ConnectConfig) idleTimeout() time.Duration {
+	if cc.IdleTimeout == 0 {
+		return defaultConnectIdleTimeout
+	}
+	return cc.IdleTimeout.Duration()
+}
+
+// allowed reports whether target is on the allowlist
+func (cc *ConnectConfig) allowed(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, entry := range cc.AllowedTargets {
+		allowedHost, allowedPort, _ := net.SplitHostPort(entry)
+		if allowedPort != port {
+			continue
+		}
+		allowedHost = strings.ToLower(allowedHost)
+		if suffix, ok := strings.CutPrefix(allowedHost, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == allowedHost {
+			return true
+		}
+	}
+	return false
+}
+
+// isConnectTunnel reports whether r is a plain CONNECT on a TCP listener;
+// extended CONNECT requests open WebSockets and other protocols instead
+func isConnectTunnel(r *http.Request) bool {
+	if r.Method != http.MethodConnect {
+		return false
+	}
+	switch r.ProtoMajor {
+	case 1:
+		return true
+	case 2:
+		return r.Header.Get(":protocol") == ""
+	}
+	return false
+}
+
+// ConnectTunnels tracks open CONNECT tunnels. Like upgraded WebSockets they
+// are invisible to the HTTP server's Shutdown, so shutdown drains them here.
+type ConnectTunnels struct {
+	mu       sync.Mutex
+	tunnels  map[*connectTunnel]struct{}
+	draining bool
+	wg       sync.WaitGroup
+
+	total      atomic.Int64
+	refused    atomic.Int64 // targets not on the allowlist
+	dialFailed atomic.Int64
+	idleClosed atomic.Int64
+}
+
+// connectTunnel is one open CONNECT tunnel
+type connectTunnel struct {
+	remote    string
+	target    string
+	proto     string
+	started   time.Time
+	close     func() // closes both sides
+	closeOnce sync.Once
+
+	toTarget atomic.Int64
+	toClient atomic.Int64
+}
+
+// NewConnectTunnels creates an empty tunnel tracker
+func NewConnectTunnels() *ConnectTunnels {
+	return &ConnectTunnels{tunnels: make(map[*connectTunnel]struct{})}
+}
+
+// open registers a tunnel; it fails while draining
+func (ct *ConnectTunnels) open(tun *connectTunnel) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.draining {
+		return false
+	}
+	ct.tunnels[tun] = struct{}{}
+	ct.wg.Add(1)
+	ct.total.Add(1)
+	return true
+}
+
+// done unregisters a closed tunnel
+func (ct *ConnectTunnels) done(tun *connectTunnel) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.tunnels, tun)
+	ct.wg.Done()
+}
+
+// Drain refuses new tunnels, gives open ones timeout to finish and closes
+// the rest, returning once all are gone
+func (ct *ConnectTunnels) Drain(timeout time.Duration) {
+	ct.mu.Lock()
+	ct.draining = true
+	open := len(ct.tunnels)
+	ct.mu.Unlock()
+	if open == 0 {
+		return
+	}
+	log.Printf("🚇 Draining %d CONNECT tunnel(s), closing them in %v", open, timeout)
+
+	finished := make(chan struct{})
+	go func() {
+		ct.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-time.After(timeout):
+	}
+
+	ct.mu.Lock()
+	for tun := range ct.tunnels {
+		tun.closeOnce.Do(tun.close)
+	}
+	ct.mu.Unlock()
+	<-finished
+}
+
+// serveConnect opens a tunnel to an allowlisted target: HTTP/1.1 clients
+// get the hijacked connection, HTTP/2 clients the request stream. Tunnels
+// pass the global access lists, rate limits and admission like requests.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	// Tunnels have no route, so only the global lists apply
+	if !s.access.allow(w, r, RouteMatch{Reason: "connect"}) {
+		return
+	}
+	if !s.rateLimiter.allow(w, r, "") {
+		return
+	}
+	// Overloaded servers open no new tunnels; an open one holds no
+	// admission slot, as it would for its whole lifetime
+	release := s.admission.admit(w, r)
+	if release == nil {
+		return
+	}
+	release()
+
+	cc := s.config.Current().Connect
+	target := r.Host
+	if !cc.allowed(target) {
+		s.tunnels.refused.Add(1)
+		log.Printf("🚇 Refused CONNECT %s from %s: target not allowed", target, r.RemoteAddr)
+		http.Error(w, "🚫 CONNECT target not allowed", http.StatusForbidden)
+		return
+	}
+	s.tunnels.mu.Lock()
+	draining := s.tunnels.draining
+	s.tunnels.mu.Unlock()
+	if draining {
+		http.Error(w, "🚫 Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: cc.dialTimeout()}
+	upstream, err := dialer.DialContext(r.Context(), "tcp", target)
+	if err != nil {
+		s.tunnels.dialFailed.Add(1)
+		log.Printf("❌ CONNECT %s from %s failed: %v", target, r.RemoteAddr, err)
+		http.Error(w, "CONNECT target unreachable", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	tun := &connectTunnel{remote: r.RemoteAddr, target: target, proto: r.Proto, started: time.Now()}
+	rc := http.NewResponseController(w)
+	if r.ProtoMajor == 1 {
+		conn, bufrw, err := rc.Hijack()
+		if err != nil {
+			log.Printf("❌ CONNECT %s for %s failed: %v", target, r.RemoteAddr, err)
+			http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		// The server's read and write timeouts are for requests, not tunnels
+		conn.SetDeadline(time.Time{})
+		bufrw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+		if err := bufrw.Flush(); err != nil {
+			return
+		}
+		tun.close = func() {
+			conn.Close()
+			upstream.Close()
+		}
+		s.relayConnect(tun, bufrw.Reader, conn, nil, upstream, cc.idleTimeout())
+		return
+	}
+
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	tun.close = func() {
+		r.Body.Close()
+		upstream.Close()
+	}
+	s.relayConnect(tun, r.Body, w, rc.Flush, upstream, cc.idleTimeout())
+}
+
+// relayConnect copies bytes between client and target until either side
+// closes, the tunnel idles out or a drain closes it. flush, when set, pushes
+// client writes out immediately.
+func (s *Server) relayConnect(tun *connectTunnel, client io.Reader, clientW io.Writer, flush func() error, upstream net.Conn, idle time.Duration) {
+	if !s.tunnels.open(tun) {
+		tun.close()
+		return
+	}
+	defer s.tunnels.done(tun)
+
+	timer := time.AfterFunc(idle, func() {
+		closed := false
+		tun.closeOnce.Do(func() {
+			tun.close()
+			closed = true
+		})
+		if closed {
+			s.tunnels.idleClosed.Add(1)
+		}
+	})
+	defer timer.Stop()
+
+	log.Printf("🚇 CONNECT %s %s -> %s", tun.proto, tun.remote, tun.target)
+
+	// Client to target until the client closes
+	go func() {
+		buf := s.pools.buffers.Get()
+		defer s.pools.buffers.Put(buf)
+		io.CopyBuffer(upstream, &activityReader{r: client, timer: timer, idle: idle, count: &tun.toTarget}, buf)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+
+	// Target to client, flushing every read so interactive traffic is not delayed
+	buf := s.pools.buffers.Get()
+	defer s.pools.buffers.Put(buf)
+	for {
+		n, err := upstream.Read(buf)
+		if n > 0 {
+			timer.Reset(idle)
+			tun.toClient.Add(int64(n))
+			if _, werr := clientW.Write(buf[:n]); werr != nil {
+				break
+			}
+			if flush != nil && flush() != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	tun.closeOnce.Do(tun.close)
+	log.Printf("🚇 CONNECT %s -> %s closed after %v (%s up, %s down)", tun.remote, tun.target,
+		time.Since(tun.started).Round(time.Millisecond), formatBytes(tun.toTarget.Load()), formatBytes(tun.toClient.Load()))
+}
+
+// Snapshot reports totals and the open tunnels
+func (ct *ConnectTunnels) Snapshot() map[string]interface{} {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	tunnels := make([]map[string]interface{}, 0, len(ct.tunnels))
+	for tun := range ct.tunnels {
+		tunnels = append(tunnels, map[string]interface{}{
+			"remote_addr":     tun.remote,
+			"target":          tun.target,
+			"protocol":        tun.proto,
+			"age_seconds":     int(time.Since(tun.started).Seconds()),
+			"bytes_to_target": tun.toTarget.Load(),
+			"bytes_to_client": tun.toClient.Load(),
+		})
+	}
+	return map[string]interface{}{
+		"open":        len(ct.tunnels),
+		"total":       ct.total.Load(),
+		"refused":     ct.refused.Load(),
+		"dial_failed": ct.dialFailed.Load(),
+		"idle_closed": ct.idleClosed.Load(),
+		"draining":    ct.draining,
+		"tunnels":     tunnels,
+	}
+}
+
+// handleConnect serves GET /api/connect with open CONNECT tunnels and the allowlist
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.tunnels.Snapshot()
+	stats["allowed_targets"] = s.config.Current().Connect.AllowedTargets
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
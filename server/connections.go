@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/maphash"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connectionShards is the number of independently locked parts of the
+// connection table, a power of two so a shard is picked with a mask
+const connectionShards = 64
+
+// connectionIdleTimeout is how long a connection without requests is tracked
+const connectionIdleTimeout = 5 * time.Minute
+
+// Simplified Connection Tracker. Every request updates it, so the table is
+// sharded by connection ID and requests on different connections rarely
+// wait for each other.
+type ConnectionTracker struct {
+	seed          maphash.Seed
+	shards        [connectionShards]connectionShard
+	totalRequests atomic.Int64
+
+	maxPerShard atomic.Int64 // connections a shard holds at most, 0 for no limit
+	shedding    atomic.Bool  // under memory pressure new connections are not tracked
+	evicted     atomic.Int64 // connections dropped to stay under the limit or shed
+	untracked   atomic.Int64 // new connections not tracked while shedding
+}
+
+// connectionShard is one locked part of the connection table
+type connectionShard struct {
+	mu          sync.Mutex
+	connections map[string]*SimpleConnectionInfo
+}
+
+// NewConnectionTracker creates an empty connection tracker
+func NewConnectionTracker() *ConnectionTracker {
+	ct := &ConnectionTracker{seed: maphash.MakeSeed()}
+	for i := range ct.shards {
+		ct.shards[i].connections = make(map[string]*SimpleConnectionInfo)
+	}
+	return ct
+}
+
+// shard returns the shard holding connID
+func (ct *ConnectionTracker) shard(connID string) *connectionShard {
+	return &ct.shards[maphash.String(ct.seed, connID)&(connectionShards-1)]
+}
+
+// Simplified ConnectionInfo for basic tracking
+type SimpleConnectionInfo struct {
+	ConnectionID string    `json:"connection_id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	StartTime    time.Time `json:"start_time"`
+	LastSeen     time.Time `json:"last_seen"`
+	RequestCount int64     `json:"request_count"`
+	Protocol     string    `json:"protocol"`
+}
+
+// getLocalIP returns the local IP address of the machine
+func getLocalIP() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		// Fallback method
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return "localhost"
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				if ipnet.IP.To4() != nil {
+					return ipnet.IP.String()
+				}
+			}
+		}
+		return "localhost"
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	return localAddr.IP.String()
+}
+
+// Enhanced connection tracking with proper QUIC Connection ID
+func extractQuicConnectionID(r *http.Request) string {
+	// Enhanced QUIC Connection ID extraction with multiple strategies
+
+	// Strategy 1: Check for explicit QUIC connection ID header
+	if connID := r.Header.Get("X-Quic-Connection-Id"); connID != "" {
+		return connID
+	}
+
+	// Strategy 2: Try to get from HTTP/3 specific headers
+	if connID := r.Header.Get(":connection-id"); connID != "" {
+		return connID
+	}
+
+	// Strategy 3: Check for connection ID in other headers
+	if connID := r.Header.Get("Connection-Id"); connID != "" {
+		return connID
+	}
+
+	// Strategy 4: Generate deterministic ID based on connection characteristics
+	// This helps maintain consistent tracking across requests. FNV-1a is
+	// enough here: the ID only groups requests and guards nothing.
+	h := fnvOffset64
+	h = fnvString(h, r.RemoteAddr)
+	h = fnvString(h, r.UserAgent())
+
+	// Add more connection-specific data for better uniqueness
+	if r.TLS != nil {
+		// Use TLS connection state for additional entropy
+		for _, b := range r.TLS.TLSUnique {
+			h = (h ^ uint64(b)) * fnvPrime64
+		}
+		h = fnvUint64(h, uint64(r.TLS.Version))
+		h = fnvUint64(h, uint64(r.TLS.CipherSuite))
+	}
+
+	// Include protocol information
+	h = fnvString(h, r.Proto)
+
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], h)
+	return hex.EncodeToString(id[:])
+}
+
+// FNV-1a 64-bit parameters
+const (
+	fnvOffset64 uint64 = 14695981039346656037
+	fnvPrime64  uint64 = 1099511628211
+)
+
+// fnvString folds s into the FNV-1a hash h
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime64
+	}
+	return h
+}
+
+// fnvUint64 folds the bytes of v into the FNV-1a hash h
+func fnvUint64(h, v uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h = (h ^ (v & 0xff)) * fnvPrime64
+		v >>= 8
+	}
+	return h
+}
+
+// detectMigrationReason analyzes address change to determine migration reason
+func detectMigrationReason(oldAddr, newAddr string) string {
+	oldIP := strings.Split(oldAddr, ":")[0]
+	newIP := strings.Split(newAddr, ":")[0]
+
+	// Same IP, different port - likely port change
+	if oldIP == newIP {
+		return "port_change"
+	}
+
+	// Different IP - analyze network change
+	if isPrivateIP(oldIP) != isPrivateIP(newIP) {
+		return "network_type_change" // Private to public or vice versa
+	}
+
+	if strings.HasPrefix(oldIP, "192.168.") && strings.HasPrefix(newIP, "192.168.") {
+		return "wifi_network_change"
+	}
+
+	if strings.HasPrefix(oldIP, "10.") && strings.HasPrefix(newIP, "10.") {
+		return "corporate_network_change"
+	}
+
+	return "network_change_detected"
+}
+
+// isPrivateIP checks if an IP address is in a private range
+func isPrivateIP(ip string) bool {
+	return strings.HasPrefix(ip, "192.168.") ||
+		strings.HasPrefix(ip, "10.") ||
+		strings.HasPrefix(ip, "172.16.") ||
+		ip == "127.0.0.1" || ip == "localhost"
+}
+
+// getPathEventType returns the appropriate event type based on validation result
+func getPathEventType(validated bool) string {
+	if validated {
+		return "validated"
+	}
+	return "validation_failed"
+}
+
+func (ct *ConnectionTracker) trackConnection(connID, quicConnID, remoteAddr, localAddr string, req *http.Request) {
+	now := time.Now()
+	ct.totalRequests.Add(1)
+
+	shard := ct.shard(connID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Simple connection tracking
+	if conn, exists := shard.connections[connID]; exists {
+		// Update existing connection
+		conn.LastSeen = now
+		conn.RequestCount++
+	} else if ct.shedding.Load() {
+		ct.untracked.Add(1)
+	} else {
+		if limit := int(ct.maxPerShard.Load()); limit > 0 && len(shard.connections) >= limit {
+			ct.evicted.Add(int64(shard.evictOldest(len(shard.connections) - limit + 1)))
+		}
+		// Create new connection with simplified info
+		shard.connections[connID] = &SimpleConnectionInfo{
+			ConnectionID: connID,
+			RemoteAddr:   remoteAddr,
+			StartTime:    now,
+			LastSeen:     now,
+			RequestCount: 1,
+			Protocol:     req.Proto,
+		}
+	}
+}
+
+// getConnections returns a copy of every tracked connection, taken one
+// shard at a time
+func (ct *ConnectionTracker) getConnections() map[string]*SimpleConnectionInfo {
+	result := make(map[string]*SimpleConnectionInfo)
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.mu.Lock()
+		for k, v := range shard.connections {
+			info := *v
+			result[k] = &info
+		}
+		shard.mu.Unlock()
+	}
+	return result
+}
+
+// evictOldest drops the n least recently seen connections of the shard and
+// returns how many it dropped; callers hold mu
+func (shard *connectionShard) evictOldest(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	if n == 1 {
+		var oldest string
+		var oldestSeen time.Time
+		for id, conn := range shard.connections {
+			if oldest == "" || conn.LastSeen.Before(oldestSeen) {
+				oldest, oldestSeen = id, conn.LastSeen
+			}
+		}
+		delete(shard.connections, oldest)
+		return 1
+	}
+	ids := make([]string, 0, len(shard.connections))
+	for id := range shard.connections {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return shard.connections[ids[i]].LastSeen.Before(shard.connections[ids[j]].LastSeen)
+	})
+	n = min(n, len(ids))
+	for _, id := range ids[:n] {
+		delete(shard.connections, id)
+	}
+	return n
+}
+
+// SetLimit bounds the tracked connections, evicting the least recently seen
+// first; 0 removes the bound
+func (ct *ConnectionTracker) SetLimit(max int) {
+	perShard := 0
+	if max > 0 {
+		perShard = (max + connectionShards - 1) / connectionShards
+	}
+	ct.maxPerShard.Store(int64(perShard))
+	if perShard > 0 {
+		ct.trim(max)
+	}
+}
+
+// trim evicts the least recently seen connections of every shard beyond
+// its share of keep and returns how many it dropped
+func (ct *ConnectionTracker) trim(keep int) int {
+	perShard := (keep + connectionShards - 1) / connectionShards
+	dropped := 0
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.mu.Lock()
+		dropped += shard.evictOldest(len(shard.connections) - perShard)
+		shard.mu.Unlock()
+	}
+	ct.evicted.Add(int64(dropped))
+	return dropped
+}
+
+// setShedding stops or resumes tracking new connections
+func (ct *ConnectionTracker) setShedding(shedding bool) {
+	ct.shedding.Store(shedding)
+}
+
+// Len returns the number of tracked connections
+func (ct *ConnectionTracker) Len() int {
+	n := 0
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.mu.Lock()
+		n += len(shard.connections)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// cleanup removes old connections, locking one shard at a time so requests
+// on the other shards carry on
+func (ct *ConnectionTracker) cleanup() {
+	cutoff := time.Now().Add(-connectionIdleTimeout)
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.mu.Lock()
+		for id, conn := range shard.connections {
+			if conn.LastSeen.Before(cutoff) {
+				delete(shard.connections, id)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTrackedRequest returns an HTTP/3 request over TLS without a connection
+// ID header, so the fallback ID is derived
+func newTrackedRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://moodle.example/course/view.php?id=2", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/3.0", 3, 0
+	r.RemoteAddr = "192.0.2.10:50123"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	return r
+}
+
+// The fallback ID is stable for a connection and differs between clients
+func TestExtractQuicConnectionID(t *testing.T) {
+	r := newTrackedRequest()
+	id := extractQuicConnectionID(r)
+	if len(id) != 16 {
+		t.Errorf("fallback ID %q, want 16 hex characters", id)
+	}
+	if again := extractQuicConnectionID(newTrackedRequest()); again != id {
+		t.Errorf("fallback ID %q then %q for one connection", id, again)
+	}
+	other := newTrackedRequest()
+	other.RemoteAddr = "192.0.2.11:50123"
+	if extractQuicConnectionID(other) == id {
+		t.Error("two client addresses share a fallback ID")
+	}
+
+	r.Header.Set("X-Quic-Connection-Id", "0a1b2c3d")
+	if got := extractQuicConnectionID(r); got != "0a1b2c3d" {
+		t.Errorf("ID %q, want the X-Quic-Connection-Id header", got)
+	}
+}
+
+func BenchmarkExtractQuicConnectionID(b *testing.B) {
+	r := newTrackedRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		extractQuicConnectionID(r)
+	}
+}
+
+func BenchmarkQuicConnectionMiddleware(b *testing.B) {
+	s := &Server{conns: NewConnectionTracker()}
+	h := s.quicConnectionMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	r := newTrackedRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// CORS defaults
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "X-Requested-With"}
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+// CORSConfig is a route's cross-origin policy. The load balancer answers
+// preflight OPTIONS requests itself and sets the CORS headers of responses,
+// replacing any the backend sent, so browsers calling Moodle web services
+// from other origins never need a backend for the preflight.
+type CORSConfig struct {
+	AllowOrigins     []string          `json:"allow_origins"`               // "https://app.example.edu", "https://*.example.edu" or "*"
+	AllowMethods     []string          `json:"allow_methods,omitempty"`     // Default GET, HEAD and POST
+	AllowHeaders     []string          `json:"allow_headers,omitempty"`     // Request headers scripts may send, default Authorization, Content-Type and X-Requested-With
+	ExposeHeaders    []string          `json:"expose_headers,omitempty"`    // Response headers scripts may read
+	AllowCredentials bool              `json:"allow_credentials,omitempty"` // Allow cookies and HTTP authentication
+	MaxAge           balancer.Duration `json:"max_age,omitempty"`           // How long browsers may cache a preflight, default 10m
+}
+
+// validate checks a route's CORS policy
+func (cc *CORSConfig) validate(prefix string) []error {
+	var errs []error
+	if len(cc.AllowOrigins) == 0 {
+		errs = append(errs, fmt.Errorf("%s.allow_origins needs at least one origin", prefix))
+	}
+	for i, origin := range cc.AllowOrigins {
+		if origin == "*" {
+			if cc.AllowCredentials {
+				errs = append(errs, fmt.Errorf("%s.allow_origins[%d]: \"*\" cannot be used with allow_credentials", prefix, i))
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") ||
+			strings.Count(origin, "*") > 1 || (strings.Contains(origin, "*") && !strings.Contains(origin, "://*.")) {
+			errs = append(errs, fmt.Errorf("%s.allow_origins[%d] %q must be an origin like https://app.example.edu or https://*.example.edu", prefix, i, origin))
+		}
+	}
+	for i, method := range cc.AllowMethods {
+		if method == "" || strings.ContainsAny(method, " ,") {
+			errs = append(errs, fmt.Errorf("%s.allow_methods[%d] %q is not a method", prefix, i, method))
+		}
+	}
+	if cc.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_age must not be negative", prefix))
+	}
+	return errs
+}
+
+// corsPolicy is a compiled CORSConfig
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	wildcards   [][2]string // scheme:// and .domain parts of https://*.domain
+	methods     []string
+	headers     map[string]bool
+	allowHeader string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+// compileCORS compiles a validated policy; nil without one
+func compileCORS(cc *CORSConfig) *corsPolicy {
+	if cc == nil {
+		return nil
+	}
+	p := &corsPolicy{origins: make(map[string]bool), headers: make(map[string]bool), credentials: cc.AllowCredentials}
+	for _, origin := range cc.AllowOrigins {
+		origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, domain, _ := strings.Cut(origin, "*")
+			p.wildcards = append(p.wildcards, [2]string{scheme, domain})
+		default:
+			p.origins[origin] = true
+		}
+	}
+	p.methods = cc.AllowMethods
+	if len(p.methods) == 0 {
+		p.methods = defaultCORSMethods
+	}
+	headers := cc.AllowHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	for _, name := range headers {
+		p.headers[strings.ToLower(name)] = true
+	}
+	p.allowHeader = strings.Join(headers, ", ")
+	p.expose = strings.Join(cc.ExposeHeaders, ", ")
+	maxAge := defaultCORSMaxAge
+	if cc.MaxAge != 0 {
+		maxAge = cc.MaxAge.Duration()
+	}
+	p.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	return p
+}
+
+// allowsOrigin reports whether origin may call the route
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.anyOrigin || p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if host, ok := strings.CutPrefix(origin, w[0]); ok && len(host) > len(w[1]) && strings.HasSuffix(host, w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOriginValue returns the Access-Control-Allow-Origin value for origin
+func (p *corsPolicy) allowOriginValue(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	return origin
+}
+
+// preflight answers a CORS preflight for a route with a policy, reporting
+// whether it did
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, reason string) bool {
+	if p == nil || r.Method != http.MethodOptions || r.Header.Get("Origin") == "" {
+		return false
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	origin := r.Header.Get("Origin")
+	refused := ""
+	switch {
+	case !p.allowsOrigin(origin):
+		refused = "origin " + origin
+	case !slices.Contains(p.methods, method) && method != http.MethodGet && method != http.MethodHead && method != http.MethodPost:
+		refused = "method " + method
+	}
+	if refused == "" {
+		for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !p.headers[name] {
+				refused = "header " + name
+				break
+			}
+		}
+	}
+	if refused != "" {
+		log.Printf("🌐 Refused CORS preflight for %s %s (%s): %s not allowed", method, r.URL.Path, reason, refused)
+		http.Error(w, "🚫 CORS request not allowed", http.StatusForbidden)
+		return true
+	}
+
+	h.Set("Access-Control-Allow-Origin", p.allowOriginValue(origin))
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	h.Set("Access-Control-Allow-Headers", p.allowHeader)
+	h.Set("Access-Control-Max-Age", p.maxAge)
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// wrap returns w setting the CORS headers of r's response in place of the
+// backend's; w itself without a policy
+func (p *corsPolicy) wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if p == nil || r.Method == http.MethodConnect {
+		return w
+	}
+	return &corsWriter{ResponseWriter: w, policy: p, origin: r.Header.Get("Origin")}
+}
+
+// corsWriter sets the CORS headers on the final response
+type corsWriter struct {
+	http.ResponseWriter
+	policy  *corsPolicy
+	origin  string
+	applied bool
+}
+
+func (w *corsWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.ResponseWriter.Header()
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+	// Cached responses are shared between origins
+	h.Add("Vary", "Origin")
+	if w.origin == "" || !w.policy.allowsOrigin(w.origin) {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", w.policy.allowOriginValue(w.origin))
+	if w.policy.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if w.policy.expose != "" {
+		h.Set("Access-Control-Expose-Headers", w.policy.expose)
+	}
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) Flush() {
+	w.apply()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
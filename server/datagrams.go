@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"quic-moodle/balancer"
+)
+
+// datagramDialTimeout bounds connecting to a backend and getting its response
+const datagramDialTimeout = 10 * time.Second
+
+// HTTPDatagramConfig relays HTTP/3 datagrams (RFC 9297) of extended CONNECT
+// requests, such as CONNECT-UDP, to backends that support them. Changes take
+// effect after a restart.
+type HTTPDatagramConfig struct {
+	Protocols     []string `json:"protocols,omitempty"`       // Extended CONNECT protocols to relay, e.g. "connect-udp"; empty disables datagrams
+	BackendPort   int      `json:"backend_port,omitempty"`    // UDP port of the backends' HTTP/3 listener, defaults to the port of their URL
+	BackendCAFile string   `json:"backend_ca_file,omitempty"` // Verify backend certificates against this CA bundle instead of the system roots
+}
+
+// validate checks the HTTP datagram settings
+func (dc *HTTPDatagramConfig) validate() []error {
+	var errs []error
+	for _, proto := range dc.Protocols {
+		switch proto {
+		case "":
+			errs = append(errs, fmt.Errorf("http_datagrams.protocols: empty protocol"))
+		case "websocket", "webtransport":
+			errs = append(errs, fmt.Errorf("http_datagrams.protocols: %q has its own proxy and cannot be relayed here", proto))
+		}
+	}
+	if dc.BackendPort < 0 || dc.BackendPort > 65535 {
+		errs = append(errs, fmt.Errorf("http_datagrams.backend_port %d is out of range", dc.BackendPort))
+	}
+	return errs
+}
+
+// datagramProxy relays extended CONNECT requests with their datagrams to
+// backends over HTTP/3, keeping one QUIC connection per backend address
+type datagramProxy struct {
+	cfg       HTTPDatagramConfig
+	stats     *DatagramStats
+	transport *http3.Transport
+
+	upstream *UpstreamCoalescer
+
+	mu     sync.Mutex
+	conns  map[string]*http3.ClientConn     // backend address -> connection
+	dialed map[*http3.ClientConn]*quic.Conn // connections by their QUIC connection
+}
+
+// newDatagramProxy creates the proxy for the configured protocols
+func newDatagramProxy(cfg HTTPDatagramConfig, stats *DatagramStats, upstream *UpstreamCoalescer) (*datagramProxy, error) {
+	clientTLS := &tls.Config{NextProtos: []string{http3.NextProtoH3}}
+	if cfg.BackendCAFile != "" {
+		pem, err := os.ReadFile(cfg.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read http_datagrams.backend_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in http_datagrams.backend_ca_file %s", cfg.BackendCAFile)
+		}
+		clientTLS.RootCAs = pool
+	}
+	return &datagramProxy{
+		cfg:   cfg,
+		stats: stats,
+		transport: &http3.Transport{
+			TLSClientConfig: clientTLS,
+			QUICConfig:      &quic.Config{EnableDatagrams: true, KeepAlivePeriod: 10 * time.Second},
+			EnableDatagrams: true,
+		},
+		upstream: upstream,
+		conns:    make(map[string]*http3.ClientConn),
+		dialed:   make(map[*http3.ClientConn]*quic.Conn),
+	}, nil
+}
+
+// handles reports whether r is an extended CONNECT for a relayed protocol
+func (p *datagramProxy) handles(r *http.Request) bool {
+	return r.Method == http.MethodConnect && slices.Contains(p.cfg.Protocols, r.Proto)
+}
+
+// Close closes the backend connections
+func (p *datagramProxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for cc, conn := range p.dialed {
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		delete(p.dialed, cc)
+	}
+	clear(p.conns)
+	return p.transport.Close()
+}
+
+// backendAddr returns the HTTP/3 address of a backend
+func (p *datagramProxy) backendAddr(backend *url.URL) string {
+	port := backend.Port()
+	if p.cfg.BackendPort != 0 {
+		port = strconv.Itoa(p.cfg.BackendPort)
+	}
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(backend.Hostname(), port)
+}
+
+// clientConn returns an open connection to addr, dialing a new one when
+// there is none. Backends that do not negotiate datagrams are refused.
+func (p *datagramProxy) clientConn(ctx context.Context, addr, serverName string) (*http3.ClientConn, error) {
+	p.mu.Lock()
+	cc := p.conns[addr]
+	p.mu.Unlock()
+	if cc != nil && cc.Context().Err() == nil {
+		return cc, nil
+	}
+	if p.upstream.Enabled() {
+		if cc := p.coalesce(ctx, addr, serverName); cc != nil {
+			return cc, nil
+		}
+	}
+
+	tlsConf := p.transport.TLSClientConfig.Clone()
+	tlsConf.ServerName = serverName
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, p.transport.QUICConfig)
+	if err != nil {
+		return nil, err
+	}
+	cc = p.transport.NewClientConn(conn)
+	select {
+	case <-cc.ReceivedSettings():
+	case <-ctx.Done():
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		return nil, ctx.Err()
+	}
+	if settings := cc.Settings(); !settings.EnableDatagrams || !settings.EnableExtendedConnect {
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		return nil, fmt.Errorf("backend %s does not support HTTP datagrams with extended CONNECT", addr)
+	}
+
+	p.mu.Lock()
+	if old := p.conns[addr]; old != nil && old.Context().Err() == nil {
+		// Another request dialed the backend meanwhile
+		p.mu.Unlock()
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		return old, nil
+	}
+	p.conns[addr] = cc
+	p.dialed[cc] = conn
+	p.mu.Unlock()
+	p.upstream.count(&p.upstream.dials)
+	return cc, nil
+}
+
+// coalesce returns an open connection to another backend name on the same
+// address whose certificate covers serverName, or nil
+func (p *datagramProxy) coalesce(ctx context.Context, addr, serverName string) *http3.ClientConn {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ips, err := p.upstream.resolve(ctx, serverName)
+	if err != nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for cc, conn := range p.dialed {
+		if conn.Context().Err() != nil {
+			delete(p.dialed, cc)
+			continue
+		}
+		state := conn.ConnectionState().TLS
+		if canCoalesce(conn.RemoteAddr(), &state, serverName, port, ips) {
+			p.conns[addr] = cc
+			p.upstream.count(&p.upstream.coalesced)
+			log.Printf("🔗 Coalescing %s onto the HTTP/3 backend connection to %s", addr, conn.RemoteAddr())
+			return cc
+		}
+	}
+	return nil
+}
+
+// proxy forwards an extended CONNECT to peer and, once the backend accepts
+// it, relays the stream and its datagrams until either side closes
+func (p *datagramProxy) proxy(w http.ResponseWriter, r *http.Request, peer *balancer.Backend) {
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(w, "HTTP datagrams require HTTP/3", http.StatusBadRequest)
+		return
+	}
+
+	addr := p.backendAddr(peer.URL)
+	ctx, cancel := context.WithTimeout(r.Context(), datagramDialTimeout)
+	backendStr, resp, err := p.open(ctx, addr, peer.URL.Hostname(), r)
+	cancel()
+	if err != nil {
+		peer.AddError()
+		log.Printf("❌ %s to Backend #%d (%s) failed: %v", r.Proto, peer.ID, addr, err)
+		http.Error(w, "Backend HTTP datagram flow failed", http.StatusBadGateway)
+		return
+	}
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// The backend refused the flow; pass its answer on as is
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, backendStr)
+		backendStr.Close()
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	clientStr := streamer.HTTPStream()
+
+	peer.AddRequest()
+	peer.AddConnection()
+	defer peer.RemoveConnection()
+	flow := p.stats.open(r, peer, addr)
+	defer p.stats.close(flow)
+	log.Printf("📦 %s flow %s %s -> Backend #%d (%s)", r.Proto, r.RemoteAddr, r.URL.Path, peer.ID, addr)
+	relayDatagramFlow(clientStr, backendStr, flow)
+	log.Printf("📦 %s flow %s -> Backend #%d closed after %v", r.Proto, r.RemoteAddr, peer.ID, time.Since(flow.Started).Round(time.Millisecond))
+}
+
+// open sends the client's request headers to the backend and waits for its response
+func (p *datagramProxy) open(ctx context.Context, addr, serverName string, r *http.Request) (*http3.RequestStream, *http.Response, error) {
+	cc, err := p.clientConn(ctx, addr, serverName)
+	if err != nil {
+		return nil, nil, err
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := r.Header.Clone()
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		header.Set("X-Forwarded-For", ip)
+	}
+	out := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  r.Proto,
+		URL:    &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery},
+		Host:   r.Host,
+		Header: header,
+	}
+	if err := str.SendRequestHeader(out); err != nil {
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		return nil, nil, err
+	}
+
+	// ReadResponse blocks until the response arrives, so unblock it on timeout
+	stop := context.AfterFunc(ctx, func() {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	})
+	resp, err := str.ReadResponse()
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		return nil, nil, err
+	}
+	return str, resp, nil
+}
+
+// datagramStream is the part of http3.Stream and http3.RequestStream the relay uses
+type datagramStream interface {
+	io.ReadWriteCloser
+	CancelRead(quic.StreamErrorCode)
+	CancelWrite(quic.StreamErrorCode)
+	SendDatagram([]byte) error
+	ReceiveDatagram(context.Context) ([]byte, error)
+}
+
+// relayDatagramFlow copies the stream data (capsules) and the datagrams
+// between client and backend in both directions. The flow ends when either
+// stream is closed or reset.
+func relayDatagramFlow(client, backend datagramStream, flow *DatagramFlow) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		relayFlowStream(backend, client)
+		cancel()
+	}()
+	go func() {
+		defer wg.Done()
+		relayFlowStream(client, backend)
+		cancel()
+	}()
+	go func() {
+		defer wg.Done()
+		relayFlowDatagrams(ctx, client, backend, &flow.ToBackend, &flow.dropped)
+	}()
+	go func() {
+		defer wg.Done()
+		relayFlowDatagrams(ctx, backend, client, &flow.ToClient, &flow.dropped)
+	}()
+	<-ctx.Done()
+	// One direction ended; tear down the other so every goroutine exits
+	client.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	backend.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	wg.Wait()
+}
+
+// relayFlowStream copies one direction of the request stream, finishing dst
+// when src ends cleanly and resetting it otherwise
+func relayFlowStream(dst, src datagramStream) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		return
+	}
+	dst.Close()
+}
+
+// relayFlowDatagrams forwards datagrams until ctx is done; datagrams that
+// cannot be sent, e.g. because they exceed the other side's limit, are dropped
+func relayFlowDatagrams(ctx context.Context, from, to datagramStream, counters *DatagramCounters, dropped *atomic.Int64) {
+	for {
+		msg, err := from.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if err := to.SendDatagram(msg); err != nil {
+			dropped.Add(1)
+			continue
+		}
+		counters.datagrams.Add(1)
+		counters.bytes.Add(int64(len(msg)))
+	}
+}
+
+// DatagramCounters counts the datagrams relayed in one direction of a flow
+type DatagramCounters struct {
+	datagrams atomic.Int64
+	bytes     atomic.Int64
+}
+
+// DatagramFlow is one relayed extended CONNECT request
+type DatagramFlow struct {
+	ID        uint64
+	Protocol  string
+	Path      string
+	Client    string
+	BackendID int
+	Backend   string
+	Started   time.Time
+
+	ToBackend DatagramCounters
+	ToClient  DatagramCounters
+	dropped   atomic.Int64
+}
+
+// DatagramStats keeps per-flow datagram counters for the active flows and
+// totals for the closed ones
+type DatagramStats struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*DatagramFlow
+
+	closedFlows     int64
+	closedDatagrams int64
+	closedBytes     int64
+	closedDropped   int64
+}
+
+// NewDatagramStats creates empty datagram statistics
+func NewDatagramStats() *DatagramStats {
+	return &DatagramStats{active: make(map[uint64]*DatagramFlow)}
+}
+
+// open registers a new flow
+func (ds *DatagramStats) open(r *http.Request, peer *balancer.Backend, addr string) *DatagramFlow {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.nextID++
+	flow := &DatagramFlow{
+		ID:        ds.nextID,
+		Protocol:  r.Proto,
+		Path:      r.URL.Path,
+		Client:    r.RemoteAddr,
+		BackendID: peer.ID,
+		Backend:   addr,
+		Started:   time.Now(),
+	}
+	ds.active[flow.ID] = flow
+	return flow
+}
+
+// close removes a flow and adds its counters to the totals
+func (ds *DatagramStats) close(flow *DatagramFlow) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.active, flow.ID)
+	ds.closedFlows++
+	ds.closedDatagrams += flow.ToBackend.datagrams.Load() + flow.ToClient.datagrams.Load()
+	ds.closedBytes += flow.ToBackend.bytes.Load() + flow.ToClient.bytes.Load()
+	ds.closedDropped += flow.dropped.Load()
+}
+
+// Snapshot returns the active flows, oldest first, and the totals over all flows
+func (ds *DatagramStats) Snapshot() map[string]interface{} {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	totalDatagrams, totalBytes, totalDropped := ds.closedDatagrams, ds.closedBytes, ds.closedDropped
+	flows := make([]map[string]interface{}, 0, len(ds.active))
+	for _, flow := range ds.active {
+		toBackend, toBackendBytes := flow.ToBackend.datagrams.Load(), flow.ToBackend.bytes.Load()
+		toClient, toClientBytes := flow.ToClient.datagrams.Load(), flow.ToClient.bytes.Load()
+		dropped := flow.dropped.Load()
+		totalDatagrams += toBackend + toClient
+		totalBytes += toBackendBytes + toClientBytes
+		totalDropped += dropped
+		flows = append(flows, map[string]interface{}{
+			"id":         flow.ID,
+			"protocol":   flow.Protocol,
+			"path":       flow.Path,
+			"client":     flow.Client,
+			"backend_id": flow.BackendID,
+			"backend":    flow.Backend,
+			"started":    flow.Started,
+			"duration":   time.Since(flow.Started).Round(time.Millisecond).String(),
+			"to_backend": map[string]int64{"datagrams": toBackend, "bytes": toBackendBytes},
+			"to_client":  map[string]int64{"datagrams": toClient, "bytes": toClientBytes},
+			"dropped":    dropped,
+		})
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i]["id"].(uint64) < flows[j]["id"].(uint64)
+	})
+
+	return map[string]interface{}{
+		"active_flows": flows,
+		"totals": map[string]int64{
+			"flows":     ds.closedFlows + int64(len(ds.active)),
+			"datagrams": totalDatagrams,
+			"bytes":     totalBytes,
+			"dropped":   totalDropped,
+		},
+	}
+}
+
+// handleHTTPDatagrams serves GET /api/http-datagrams with per-flow datagram counters
+func (s *Server) handleHTTPDatagrams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.datagramStats.Snapshot()
+	stats["protocols"] = []string{}
+	if s.datagrams != nil {
+		stats["protocols"] = s.datagrams.cfg.Protocols
+	}
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
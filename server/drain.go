@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"quic-moodle/balancer"
+)
+
+// Connection draining defaults
+const (
+	defaultDrainGracePeriod = 30 * time.Second
+	// drainQuietPeriod is how long a drained HTTP/3 connection has to be
+	// without requests before it is closed, so responses written just before
+	// are delivered
+	drainQuietPeriod = 5 * time.Second
+)
+
+// DrainConfig controls how client connections are drained. On shutdown and
+// binary upgrade every listener sends GOAWAY (HTTP/2 and HTTP/3) or closes
+// after the current response (HTTP/1.1), and in-flight requests get the grace
+// period to finish. When pools, routes or virtual hosts change, connections
+// opened before the change are drained the same way, so clients reconnect
+// and pick up the new routing, including fresh QUIC-LB connection IDs.
+type DrainConfig struct {
+	GracePeriod    balancer.Duration `json:"grace_period,omitempty"`     // How long in-flight requests may finish after GOAWAY on shutdown, default 30s
+	SkipPoolChange bool              `json:"skip_pool_change,omitempty"` // Keep client connections when pools, routes or virtual hosts change
+}
+
+// validate checks the drain settings
+func (dc *DrainConfig) validate() []error {
+	if dc.GracePeriod < 0 {
+		return []error{fmt.Errorf("drain.grace_period must not be negative")}
+	}
+	return nil
+}
+
+// gracePeriod returns the configured grace period or its default
+func (dc *DrainConfig) gracePeriod() time.Duration {
+	if dc.GracePeriod == 0 {
+		return defaultDrainGracePeriod
+	}
+	return dc.GracePeriod.Duration()
+}
+
+// routingChanged reports whether a config change moves requests to other
+// pools or backends
+func routingChanged(old, cfg *Config) bool {
+	return !reflect.DeepEqual(old.AllPools(), cfg.AllPools()) ||
+		!reflect.DeepEqual(routesWithoutAccess(old.Routes), routesWithoutAccess(cfg.Routes)) ||
+		!reflect.DeepEqual(old.VirtualHosts, cfg.VirtualHosts) ||
+		old.DefaultPool != cfg.DefaultPool
+}
+
+// routesWithoutAccess copies routes without their access lists, which
+// refuse clients but move no requests
+func routesWithoutAccess(routes []RouteConfig) []RouteConfig {
+	stripped := make([]RouteConfig, len(routes))
+	for i, rt := range routes {
+		rt.Access = AccessConfig{}
+		stripped[i] = rt
+	}
+	return stripped
+}
+
+// ConnDrainer asks client connections opened before a routing change to
+// reconnect without failing their requests
+type ConnDrainer struct {
+	mu      sync.Mutex
+	cutoff  time.Time // connections opened before are drained
+	reason  string
+	quic    map[*drainConn]struct{}
+	sweeper bool // an HTTP/3 sweep is running
+
+	tcpSignalled int64 // HTTP/1.1 closes and HTTP/2 GOAWAYs requested
+	quicClosed   int64
+}
+
+// drainConn is a client connection as seen by the drainer
+type drainConn struct {
+	opened     time.Time
+	quic       *quic.Conn // nil for TCP connections
+	active     int
+	lastActive time.Time
+	signalled  bool
+}
+
+// drainConnKey is the context key of a connection's *drainConn
+type drainConnKey struct{}
+
+// NewConnDrainer creates a drainer with nothing to drain
+func NewConnDrainer() *ConnDrainer {
+	return &ConnDrainer{quic: make(map[*drainConn]struct{})}
+}
+
+// tcpConnContext records when a TCP connection was accepted
+func (d *ConnDrainer) tcpConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, drainConnKey{}, &drainConn{opened: time.Now()})
+}
+
+// quicConnContext records a QUIC connection until it closes
+func (d *ConnDrainer) quicConnContext(ctx context.Context, c *quic.Conn) context.Context {
+	dc := &drainConn{opened: time.Now(), quic: c, lastActive: time.Now()}
+	d.mu.Lock()
+	d.quic[dc] = struct{}{}
+	d.mu.Unlock()
+	go func() {
+		<-c.Context().Done()
+		d.mu.Lock()
+		delete(d.quic, dc)
+		d.mu.Unlock()
+	}()
+	return context.WithValue(ctx, drainConnKey{}, dc)
+}
+
+// begin marks a request in flight on its connection and, when the
+// connection is being drained, asks HTTP/1.1 clients to close it and HTTP/2
+// clients to go away; Go's HTTP/2 server turns "Connection: close" into a
+// graceful GOAWAY. The returned function ends the request.
+func (d *ConnDrainer) begin(w http.ResponseWriter, r *http.Request) func() {
+	dc, ok := r.Context().Value(drainConnKey{}).(*drainConn)
+	if !ok {
+		return func() {}
+	}
+	d.mu.Lock()
+	dc.active++
+	if dc.opened.Before(d.cutoff) && dc.quic == nil {
+		w.Header().Set("Connection", "close")
+		if !dc.signalled {
+			dc.signalled = true
+			d.tcpSignalled++
+		}
+	}
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		dc.active--
+		dc.lastActive = time.Now()
+	}
+}
+
+// Drain makes connections opened until now reconnect. HTTP/3 connections
+// have no per-connection GOAWAY in quic-go, so they are closed with
+// H3_NO_ERROR once quiet, which clients treat as a graceful close.
+func (d *ConnDrainer) Drain(ctx context.Context, reason string) {
+	d.mu.Lock()
+	d.cutoff = time.Now()
+	d.reason = reason
+	startSweep := !d.sweeper
+	d.sweeper = true
+	quicConns := len(d.quic)
+	d.mu.Unlock()
+
+	log.Printf("🚪 Draining client connections (%s), %d HTTP/3 connection(s) open", reason, quicConns)
+	if startSweep {
+		go d.sweep(ctx)
+	}
+}
+
+// sweep closes drained HTTP/3 connections once they are quiet
+func (d *ConnDrainer) sweep(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var quiet []*quic.Conn
+		d.mu.Lock()
+		remaining := 0
+		for dc := range d.quic {
+			if !dc.opened.Before(d.cutoff) || dc.signalled {
+				continue
+			}
+			if dc.active > 0 || time.Since(dc.lastActive) < drainQuietPeriod {
+				remaining++
+				continue
+			}
+			dc.signalled = true
+			d.quicClosed++
+			quiet = append(quiet, dc.quic)
+		}
+		if remaining == 0 {
+			d.sweeper = false
+		}
+		d.mu.Unlock()
+
+		for _, c := range quiet {
+			c.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "routing changed")
+		}
+		if remaining == 0 {
+			return
+		}
+	}
+}
+
+// Snapshot reports the last drain and what it signalled
+func (d *ConnDrainer) Snapshot() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pending := 0
+	for dc := range d.quic {
+		if dc.opened.Before(d.cutoff) && !dc.signalled {
+			pending++
+		}
+	}
+	snapshot := map[string]interface{}{
+		"reason":              d.reason,
+		"tcp_signalled":       d.tcpSignalled,
+		"quic_closed":         d.quicClosed,
+		"quic_pending":        pending,
+		"quic_connections":    len(d.quic),
+		"quic_quiet_period_s": drainQuietPeriod.Seconds(),
+	}
+	if !d.cutoff.IsZero() {
+		snapshot["cutoff"] = d.cutoff
+	}
+	return snapshot
+}
+
+// handleDrain serves GET /api/drain with the connection drain state
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.drainer.Snapshot()
+	stats["grace_period_s"] = s.config.Current().Drain.gracePeriod().Seconds()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// RoutingDecision describes where a request would be sent and why
+type RoutingDecision struct {
+	Method        string         `json:"method"`
+	Host          string         `json:"host"`
+	Path          string         `json:"path"`
+	LoadBalanced  bool           `json:"load_balanced"` // false for paths served by the LB itself
+	Pool          string         `json:"pool,omitempty"`
+	PoolReason    string         `json:"pool_reason,omitempty"` // "routes[N]", "virtual-host:<host>", "default-pool"
+	Experiment    string         `json:"experiment,omitempty"`  // "<experiment>=<variant>" when the request takes part in one
+	ClientCert    string         `json:"client_cert,omitempty"` // "verified" or "missing" when the route requires one
+	EarlyData     string         `json:"early_data,omitempty"`  // "accepted", "deferred" or "rejected" for requests received in 0-RTT
+	Priority      string         `json:"priority"`              // RFC 9218 priority the request is scheduled with
+	Algorithm     string         `json:"algorithm,omitempty"`
+	RoutingMethod string         `json:"routing_method,omitempty"` // "quic-lb-cid", "session-affinity", "legacy-lb"
+	SessionKey    string         `json:"session_key,omitempty"`
+	Backend       *DryRunBackend `json:"backend,omitempty"`
+	Notes         []string       `json:"notes,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	EvaluatedAt   time.Time      `json:"evaluated_at"`
+}
+
+// DryRunBackend is the state of the backend a request would be sent to
+type DryRunBackend struct {
+	ID             int     `json:"id"`
+	URL            string  `json:"url"`
+	Alive          bool    `json:"alive"`
+	HealthScore    float64 `json:"health_score"`
+	CircuitBreaker string  `json:"circuit_breaker"`
+	Connections    int64   `json:"connections"`
+}
+
+// explainRouting evaluates the routing, affinity and circuit breaker decisions
+// of LoadBalancerMiddleware for r without proxying or changing any state
+func (s *Server) explainRouting(r *http.Request) *RoutingDecision {
+	d := &RoutingDecision{
+		Method:      r.Method,
+		Host:        r.Host,
+		Path:        r.URL.Path,
+		EvaluatedAt: time.Now(),
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/metrics" {
+		d.Notes = append(d.Notes, "path is served by the load balancer itself")
+		return d
+	}
+	d.LoadBalanced = true
+	d.Priority = parsePriority(r.Header).String()
+
+	match := s.pools.Match(r)
+	if a, poolName := s.experiments.assign(r, match.Pool, func() string { return s.sessionKey(r, match.Pool) }); a != nil {
+		if pool := s.pools.Get(poolName); pool != nil {
+			match.Pool = pool
+			d.Experiment = a.String()
+		}
+	}
+	pool := match.Pool
+	d.Pool, d.PoolReason, d.Algorithm = pool.Name(), match.Reason, pool.Algorithm()
+	if match.RequireClientCert {
+		if !hasVerifiedClientCert(r) {
+			d.ClientCert = "missing"
+			d.Error = "client certificate required"
+			return d
+		}
+		d.ClientCert = "verified"
+	}
+	if isEarlyData(r) {
+		switch {
+		case earlyDataAllowed(match.EarlyData, r.Method):
+			d.EarlyData = "accepted"
+		case match.EarlyData == earlyDataWait:
+			d.EarlyData = "deferred"
+		default:
+			d.EarlyData = "rejected"
+			d.Error = "request received in 0-RTT would get 425 Too Early"
+			return d
+		}
+	}
+
+	var peer *balancer.Backend
+	if connectionIDHeader := r.Header.Get("X-Quic-Connection-Id"); connectionIDHeader != "" {
+		connectionIDBytes, err := hex.DecodeString(connectionIDHeader)
+		switch {
+		case err != nil:
+			d.Notes = append(d.Notes, "X-Quic-Connection-Id is not valid hex: "+err.Error())
+		default:
+			// A dry run must not claim the CID or count it as unroutable
+			selectedPeer, fallback, err := s.quicLB.LookupConnectionID(connectionIDBytes)
+			if fallback {
+				d.Notes = append(d.Notes, "connection ID does not decode to a backend; the unroutable CID fallback picks one")
+			}
+			switch {
+			case err != nil:
+				d.Notes = append(d.Notes, "QUIC-LB routing failed: "+err.Error())
+			case !pool.HasBackend(selectedPeer):
+				d.Notes = append(d.Notes, "QUIC-LB routing ignored: backend #"+strconv.Itoa(selectedPeer.ID)+" is not in pool "+pool.Name())
+			default:
+				peer = selectedPeer
+				d.RoutingMethod = "quic-lb-cid"
+			}
+		}
+	}
+
+	if peer == nil {
+		d.SessionKey = s.sessionKey(r, pool)
+		var affinity bool
+		peer, affinity = pool.PeekNextPeer(d.SessionKey)
+		d.RoutingMethod = "legacy-lb"
+		if affinity {
+			d.RoutingMethod = "session-affinity"
+		}
+	}
+
+	if peer == nil {
+		d.Error = "no healthy backends available"
+		return d
+	}
+
+	d.Backend = &DryRunBackend{
+		ID:             peer.ID,
+		URL:            peer.URL.Redacted(),
+		Alive:          peer.IsAlive(),
+		HealthScore:    peer.HealthScore,
+		CircuitBreaker: "bypassed",
+		Connections:    peer.GetConnections(),
+	}
+	if peer.CircuitBreaker != nil {
+		d.Backend.CircuitBreaker = peer.CircuitBreaker.GetState()
+		if d.Backend.CircuitBreaker == "open" {
+			d.Notes = append(d.Notes, "circuit breaker is open; the request would still be forwarded")
+		}
+	}
+	return d
+}
+
+// writeRoutingDecision answers a request with its dry-run routing decision
+func (s *Server) writeRoutingDecision(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-LB-Dry-Run", "true")
+	json.NewEncoder(w).Encode(s.explainRouting(r))
+}
+
+// dryRunMiddleware answers admin requests carrying "X-LB-Dry-Run: true" with
+// the routing decision for their method, Host, path, headers and query
+func (s *Server) dryRunMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get("X-LB-Dry-Run")
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "X-LB-Dry-Run must be true or false", http.StatusBadRequest)
+			return
+		}
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del("X-LB-Dry-Run")
+		s.writeRoutingDecision(w, r)
+	})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Route early_data policies for requests received in QUIC 0-RTT
+const (
+	earlyDataSafe   = "safe"   // default: only safe, idempotent methods
+	earlyDataAllow  = "allow"  // any method; the backend must tolerate replays
+	earlyDataReject = "reject" // no request, the client retries after the handshake
+	earlyDataWait   = "wait"   // safe methods at once, others once the handshake completes
+)
+
+// earlyDataWaitTimeout bounds how long a 0-RTT request waits for the handshake
+const earlyDataWaitTimeout = 10 * time.Second
+
+// isEarlyData reports whether a request arrived in 0-RTT data, before the
+// TLS handshake with the client completed
+func isEarlyData(r *http.Request) bool {
+	return r.TLS != nil && !r.TLS.HandshakeComplete
+}
+
+// earlyDataAllowed reports whether a route's early_data policy accepts a
+// 0-RTT request with the given method. 0-RTT data can be replayed, so by
+// default only methods without side effects are accepted (RFC 8470).
+func earlyDataAllowed(policy, method string) bool {
+	switch policy {
+	case earlyDataAllow:
+		return true
+	case earlyDataReject:
+		return false
+	default:
+		return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+	}
+}
+
+// quicConnKey carries the QUIC connection of an HTTP/3 request
+type quicConnKey struct{}
+
+// withQUICConn stores c in a connection context
+func withQUICConn(ctx context.Context, c *quic.Conn) context.Context {
+	return context.WithValue(ctx, quicConnKey{}, c)
+}
+
+// waitForHandshake holds a 0-RTT request until its connection's handshake
+// completes. A replayed 0-RTT flight never completes a handshake, so the
+// request that continues is the client's own. It returns r with the final
+// TLS state, or false when the client went away or the handshake stalled.
+func waitForHandshake(r *http.Request) (*http.Request, bool) {
+	conn, ok := r.Context().Value(quicConnKey{}).(*quic.Conn)
+	if !ok {
+		return r, false
+	}
+	timer := time.NewTimer(earlyDataWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-conn.HandshakeComplete():
+	case <-r.Context().Done():
+		return r, false
+	case <-timer.C:
+		return r, false
+	}
+	state := conn.ConnectionState().TLS
+	r = r.WithContext(r.Context())
+	r.TLS = &state
+	return r, true
+}
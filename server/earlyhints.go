@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+)
+
+// informationalWriter forwards backend 1xx responses such as 103 Early Hints
+// with only the backend's headers. httputil.ReverseProxy sends a 1xx with
+// everything in the header map and clears the map afterwards, which would
+// leak the load balancer's headers into the hints and drop them from the
+// final response.
+type informationalWriter struct {
+	http.ResponseWriter
+	req   *http.Request
+	base  http.Header // headers set by the load balancer before proxying
+	hints bool        // a 1xx was forwarded, so base was cleared from the header map
+}
+
+// newInformationalWriter wraps w for proxying r
+func newInformationalWriter(w http.ResponseWriter, r *http.Request) *informationalWriter {
+	return &informationalWriter{ResponseWriter: w, req: r, base: w.Header().Clone()}
+}
+
+func (w *informationalWriter) WriteHeader(code int) {
+	h := w.ResponseWriter.Header()
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		if !w.hints {
+			// The backend's values were appended after ours
+			for name, values := range w.base {
+				if rest := h[name][min(len(values), len(h[name])):]; len(rest) > 0 {
+					h[name] = rest
+				} else {
+					delete(h, name)
+				}
+			}
+			w.hints = true
+		}
+		// HTTP/1.0 clients do not understand interim responses
+		if w.req.ProtoAtLeast(1, 1) {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+
+	if w.hints {
+		for name, values := range w.base {
+			h[name] = append(slices.Clone(values), h[name]...)
+		}
+		w.hints = false
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *informationalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// experimentLatencySamples is how many recent latencies of each variant
+// the percentiles in /api/experiments are taken from
+const experimentLatencySamples = 1024
+
+// Experiment assignment keys
+const (
+	experimentBySession = "session"
+	experimentByCID     = "cid"
+)
+
+// ExperimentConfig splits the clients of a pool between variants, each
+// served by a pool of its own, to compare Moodle configurations. A client
+// keeps its variant: the assignment is a hash of the experiment name and the
+// client's session or QUIC-LB connection ID. Backends learn the variant from
+// the X-Experiment request header, "<experiment>=<variant>"; clients cannot
+// set it. A request takes part in the first experiment that matches it.
+type ExperimentConfig struct {
+	Name       string              `json:"name"`
+	Pool       string              `json:"pool"`                  // Requests routed to this pool take part
+	PathPrefix string              `json:"path_prefix,omitempty"` // Only requests under this path take part
+	AssignBy   string              `json:"assign_by,omitempty"`   // "session" (default) or "cid", the X-Quic-Connection-Id, falling back to the session
+	Variants   []ExperimentVariant `json:"variants"`
+	Disabled   bool                `json:"disabled,omitempty"` // Stop assigning; requests stay on the pool they were routed to
+}
+
+// ExperimentVariant is one arm of an experiment
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool,omitempty"`   // Pool serving the variant, default the experiment's pool
+	Weight int    `json:"weight,omitempty"` // Share of the clients relative to the other variants, default 1
+}
+
+// validateExperiments checks the experiments against the configured pools
+func validateExperiments(experiments []ExperimentConfig, poolNames map[string]bool) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, ec := range experiments {
+		prefix := fmt.Sprintf("experiments[%d]", i)
+		if ec.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is required", prefix))
+		} else if names[ec.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", prefix, ec.Name))
+		}
+		names[ec.Name] = true
+		if !poolNames[ec.Pool] {
+			errs = append(errs, fmt.Errorf("%s.pool %q is not a configured pool", prefix, ec.Pool))
+		}
+		if ec.PathPrefix != "" && !strings.HasPrefix(ec.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("%s.path_prefix %q must start with /", prefix, ec.PathPrefix))
+		}
+		if ec.AssignBy != "" && ec.AssignBy != experimentBySession && ec.AssignBy != experimentByCID {
+			errs = append(errs, fmt.Errorf("%s.assign_by %q is not one of session, cid", prefix, ec.AssignBy))
+		}
+		if len(ec.Variants) < 2 {
+			errs = append(errs, fmt.Errorf("%s needs at least two variants", prefix))
+		}
+		variants := make(map[string]bool)
+		for j, v := range ec.Variants {
+			if v.Name == "" || strings.ContainsAny(v.Name, "=,; ") {
+				errs = append(errs, fmt.Errorf("%s.variants[%d].name %q must be set and free of '=', ',', ';' and spaces", prefix, j, v.Name))
+			} else if variants[v.Name] {
+				errs = append(errs, fmt.Errorf("%s.variants[%d]: duplicate name %q", prefix, j, v.Name))
+			}
+			variants[v.Name] = true
+			if v.Pool != "" && !poolNames[v.Pool] {
+				errs = append(errs, fmt.Errorf("%s.variants[%d].pool %q is not a configured pool", prefix, j, v.Pool))
+			}
+			if v.Weight < 0 {
+				errs = append(errs, fmt.Errorf("%s.variants[%d].weight must not be negative", prefix, j))
+			}
+		}
+	}
+	return errs
+}
+
+// weight returns the configured weight or its default
+func (v *ExperimentVariant) weight() int {
+	if v.Weight == 0 {
+		return 1
+	}
+	return v.Weight
+}
+
+// experimentAssignment is the variant a request was assigned to
+type experimentAssignment struct {
+	experiment string
+	variant    string
+}
+
+// String formats the assignment as sent in X-Experiment
+func (a *experimentAssignment) String() string {
+	return a.experiment + "=" + a.variant
+}
+
+type experimentKey struct{}
+
+// variantStats counts the proxied requests of one variant
+type variantStats struct {
+	pool     string
+	requests int64
+	errors   int64 // 5xx answers
+	latency  time.Duration
+	recent   []time.Duration // ring of the latest latencies
+	next     int
+}
+
+// experiment is a configured experiment with its per-variant counters
+type experiment struct {
+	cfg      ExperimentConfig
+	total    int
+	variants map[string]*variantStats
+}
+
+// Experiments assigns clients to experiment variants and counts their
+// requests
+type Experiments struct {
+	mu          sync.Mutex
+	experiments []*experiment
+}
+
+// NewExperiments creates the experiments, none until configured
+func NewExperiments() *Experiments {
+	return &Experiments{}
+}
+
+// Configure applies new experiments; the counters of a variant are kept
+// while its experiment, name and pool stay the same
+func (e *Experiments) Configure(configs []ExperimentConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := make(map[string]*experiment, len(e.experiments))
+	for _, exp := range e.experiments {
+		old[exp.cfg.Name] = exp
+	}
+	e.experiments = e.experiments[:0]
+	for _, cfg := range configs {
+		exp := &experiment{cfg: cfg, variants: make(map[string]*variantStats)}
+		for _, v := range cfg.Variants {
+			exp.total += v.weight()
+			pool := v.Pool
+			if pool == "" {
+				pool = cfg.Pool
+			}
+			if prev := old[cfg.Name]; prev != nil && prev.variants[v.Name] != nil && prev.variants[v.Name].pool == pool {
+				exp.variants[v.Name] = prev.variants[v.Name]
+				continue
+			}
+			exp.variants[v.Name] = &variantStats{pool: pool}
+		}
+		e.experiments = append(e.experiments, exp)
+	}
+}
+
+// assign returns the variant of the first experiment r takes part in and
+// the pool serving it, or nil. key is called for the client's session key
+// only when needed.
+func (e *Experiments) assign(r *http.Request, pool *balancer.Pool, key func() string) (*experimentAssignment, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, exp := range e.experiments {
+		if exp.cfg.Disabled || exp.cfg.Pool != pool.Name() || !strings.HasPrefix(r.URL.Path, exp.cfg.PathPrefix) {
+			continue
+		}
+		client := ""
+		if exp.cfg.AssignBy == experimentByCID {
+			client = r.Header.Get("X-Quic-Connection-Id")
+		}
+		if client == "" {
+			client = key()
+		}
+		h := fnv.New64a()
+		h.Write([]byte(exp.cfg.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(client))
+		bucket := int(h.Sum64() % uint64(exp.total))
+		for _, v := range exp.cfg.Variants {
+			if bucket -= v.weight(); bucket < 0 {
+				return &experimentAssignment{experiment: exp.cfg.Name, variant: v.Name}, exp.variants[v.Name].pool
+			}
+		}
+	}
+	return nil, ""
+}
+
+// record counts a proxied request of the variant r was assigned to
+func (e *Experiments) record(r *http.Request, status int, elapsed time.Duration) {
+	a, ok := r.Context().Value(experimentKey{}).(*experimentAssignment)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, exp := range e.experiments {
+		if exp.cfg.Name != a.experiment {
+			continue
+		}
+		stats := exp.variants[a.variant]
+		if stats == nil {
+			return // the variant was removed while the request ran
+		}
+		stats.requests++
+		if status >= 500 {
+			stats.errors++
+		}
+		stats.latency += elapsed
+		if len(stats.recent) < experimentLatencySamples {
+			stats.recent = append(stats.recent, elapsed)
+		} else {
+			stats.recent[stats.next] = elapsed
+			stats.next = (stats.next + 1) % experimentLatencySamples
+		}
+		return
+	}
+}
+
+// assignExperiment moves a request taking part in an experiment to the pool
+// of its variant and names the variant in X-Experiment for the backend
+func (s *Server) assignExperiment(r *http.Request, match RouteMatch) (*http.Request, RouteMatch) {
+	// Only the load balancer assigns variants
+	r.Header.Del("X-Experiment")
+	a, poolName := s.experiments.assign(r, match.Pool, func() string { return s.sessionKey(r, match.Pool) })
+	if a == nil {
+		return r, match
+	}
+	pool := s.pools.Get(poolName)
+	if pool == nil {
+		return r, match
+	}
+	match.Pool = pool
+	r.Header.Set("X-Experiment", a.String())
+	return r.WithContext(context.WithValue(r.Context(), experimentKey{}, a)), match
+}
+
+// Snapshot reports every experiment with the share, errors and latency of
+// its variants
+func (e *Experiments) Snapshot() []map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	experiments := make([]map[string]interface{}, 0, len(e.experiments))
+	for _, exp := range e.experiments {
+		variants := make([]map[string]interface{}, 0, len(exp.cfg.Variants))
+		for _, v := range exp.cfg.Variants {
+			stats := exp.variants[v.Name]
+			entry := map[string]interface{}{
+				"name":           v.Name,
+				"pool":           stats.pool,
+				"weight":         v.weight(),
+				"share_percent":  100 * float64(v.weight()) / float64(exp.total),
+				"requests":       stats.requests,
+				"errors":         stats.errors,
+				"error_rate":     float64(stats.errors) / float64(max(stats.requests, 1)),
+				"avg_latency_ms": float64(stats.latency.Microseconds()) / 1000 / float64(max(stats.requests, 1)),
+			}
+			if len(stats.recent) > 0 {
+				recent := slices.Clone(stats.recent)
+				slices.Sort(recent)
+				percentile := func(p float64) float64 {
+					return float64(recent[min(int(float64(len(recent))*p), len(recent)-1)].Microseconds()) / 1000
+				}
+				entry["p50_latency_ms"] = percentile(0.50)
+				entry["p95_latency_ms"] = percentile(0.95)
+				entry["p99_latency_ms"] = percentile(0.99)
+			}
+			variants = append(variants, entry)
+		}
+		assignBy := exp.cfg.AssignBy
+		if assignBy == "" {
+			assignBy = experimentBySession
+		}
+		experiments = append(experiments, map[string]interface{}{
+			"name":        exp.cfg.Name,
+			"pool":        exp.cfg.Pool,
+			"path_prefix": exp.cfg.PathPrefix,
+			"assign_by":   assignBy,
+			"disabled":    exp.cfg.Disabled,
+			"variants":    variants,
+		})
+	}
+	return experiments
+}
+
+// handleExperiments serves GET /api/experiments
+func (s *Server) handleExperiments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := map[string]interface{}{
+		"experiments": s.experiments.Snapshot(),
+		"timestamp":   time.Now(),
+	}
+	json.NewEncoder(w).Encode(stats)
+}
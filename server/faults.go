@@ -0,0 +1,494 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// defaultFaultDuration is how long a fault added through the admin API
+// lasts when the request names no duration, so a forgotten experiment ends
+// by itself
+const defaultFaultDuration = 10 * time.Minute
+
+// errInjectedFault is the failure injected faults record on a backend's
+// circuit breaker
+var errInjectedFault = errors.New("injected fault")
+
+// FaultsConfig injects faults so retries, the circuit breaker, failover and
+// connection migration can be exercised in staging. Nothing is injected
+// unless enabled. Rules from the config apply until changed; rules added
+// through POST /api/faults apply for their duration and are not persisted.
+// Dropping QUIC packets needs faults enabled when the QUIC listener starts.
+type FaultsConfig struct {
+	Enabled bool        `json:"enabled"`
+	Rules   []FaultRule `json:"rules,omitempty"`
+}
+
+// FaultRule selects requests or packets and the fault injected into them.
+// Requests match when every filter set matches; Percent of the matching
+// requests get the fault.
+type FaultRule struct {
+	Name        string            `json:"name"`
+	Route       string            `json:"route,omitempty"`        // Route reason the request matched, e.g. "routes[2]", "virtual-host:moodle.example.edu" or "default-pool"
+	Pool        string            `json:"pool,omitempty"`         // Pool the request was routed to
+	PathPrefix  string            `json:"path_prefix,omitempty"`  // Request path prefix
+	Backend     string            `json:"backend,omitempty"`      // URL of the backend the request was routed to
+	Percent     float64           `json:"percent,omitempty"`      // Share of matching requests faulted, 0-100, default 100
+	Delay       balancer.Duration `json:"delay,omitempty"`        // Latency added before the request is proxied
+	Status      int               `json:"status,omitempty"`       // Answer with this 5xx status instead of proxying; counts as a failure of the backend's circuit breaker
+	FailBackend bool              `json:"fail_backend,omitempty"` // Hold Backend down while the rule applies, as if its health checks failed
+	DropPackets float64           `json:"drop_packets,omitempty"` // Share of QUIC packets dropped in each direction, 0-100
+}
+
+// validate checks the fault injection settings
+func (fc *FaultsConfig) validate() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i := range fc.Rules {
+		prefix := fmt.Sprintf("faults.rules[%d]", i)
+		errs = append(errs, fc.Rules[i].validate(prefix)...)
+		if names[fc.Rules[i].Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", prefix, fc.Rules[i].Name))
+		}
+		names[fc.Rules[i].Name] = true
+	}
+	return errs
+}
+
+// validate checks one fault rule
+func (fr *FaultRule) validate(prefix string) []error {
+	var errs []error
+	if fr.Name == "" {
+		errs = append(errs, fmt.Errorf("%s: name is required", prefix))
+	}
+	if fr.PathPrefix != "" && !strings.HasPrefix(fr.PathPrefix, "/") {
+		errs = append(errs, fmt.Errorf("%s: path_prefix %q must start with /", prefix, fr.PathPrefix))
+	}
+	if fr.Backend != "" {
+		if u, err := url.Parse(fr.Backend); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: backend %q is not a URL", prefix, fr.Backend))
+		}
+	}
+	if fr.Percent < 0 || fr.Percent > 100 {
+		errs = append(errs, fmt.Errorf("%s: percent must be between 0 and 100", prefix))
+	}
+	if fr.Delay < 0 {
+		errs = append(errs, fmt.Errorf("%s: delay must not be negative", prefix))
+	}
+	if fr.Status != 0 && (fr.Status < 500 || fr.Status > 599) {
+		errs = append(errs, fmt.Errorf("%s: status %d is not a 5xx status", prefix, fr.Status))
+	}
+	if fr.FailBackend && fr.Backend == "" {
+		errs = append(errs, fmt.Errorf("%s: fail_backend needs backend", prefix))
+	}
+	if fr.DropPackets < 0 || fr.DropPackets > 100 {
+		errs = append(errs, fmt.Errorf("%s: drop_packets must be between 0 and 100", prefix))
+	}
+	if fr.DropPackets > 0 && (fr.Route != "" || fr.Pool != "" || fr.PathPrefix != "" || fr.Backend != "") {
+		// Packets are dropped before they belong to a request
+		errs = append(errs, fmt.Errorf("%s: drop_packets cannot be limited to a route, pool, path or backend", prefix))
+	}
+	if fr.Delay == 0 && fr.Status == 0 && !fr.FailBackend && fr.DropPackets == 0 {
+		errs = append(errs, fmt.Errorf("%s: set delay, status, fail_backend or drop_packets", prefix))
+	}
+	return errs
+}
+
+// percent returns the configured share of matching requests or its default
+func (fr *FaultRule) percent() float64 {
+	if fr.Percent == 0 {
+		return 100
+	}
+	return fr.Percent
+}
+
+// injectsRequests reports whether the rule acts on proxied requests
+func (fr *FaultRule) injectsRequests() bool {
+	return fr.Delay > 0 || fr.Status != 0
+}
+
+// matches reports whether a request routed by match to peer is selected
+func (fr *FaultRule) matches(r *http.Request, match RouteMatch, peer *balancer.Backend) bool {
+	switch {
+	case fr.Route != "" && fr.Route != match.Reason:
+		return false
+	case fr.Pool != "" && fr.Pool != match.Pool.Name():
+		return false
+	case fr.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, fr.PathPrefix):
+		return false
+	case fr.Backend != "" && fr.Backend != peer.URL.String():
+		return false
+	}
+	return true
+}
+
+// activeFault is a rule in effect with its counters
+type activeFault struct {
+	FaultRule
+	source  string    // "config" or "admin"
+	expires time.Time // zero for config rules
+	hits    int64
+}
+
+// Faults holds the fault rules in effect
+type Faults struct {
+	mu      sync.Mutex
+	cfg     FaultsConfig
+	config  []*activeFault
+	runtime []*activeFault // added through the admin API
+
+	dropPercent    atomic.Uint64 // math.Float64bits of the share of packets dropped
+	droppedPackets atomic.Int64
+	packetFaults   atomic.Bool // whether the QUIC listener can drop packets
+}
+
+// NewFaults creates fault injection, off until configured
+func NewFaults() *Faults {
+	return &Faults{}
+}
+
+// Configure applies new settings; rules added through the admin API stay
+// until they expire
+func (f *Faults) Configure(cfg FaultsConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cfg.Enabled && !f.cfg.Enabled {
+		log.Printf("💥 Fault injection enabled with %d rules", len(cfg.Rules))
+	} else if !cfg.Enabled && f.cfg.Enabled {
+		log.Printf("💥 Fault injection disabled")
+	}
+	f.cfg = cfg
+	f.config = f.config[:0]
+	for _, rule := range cfg.Rules {
+		f.config = append(f.config, &activeFault{FaultRule: normalizeFaultRule(rule), source: "config"})
+	}
+	f.updateDropPercent()
+}
+
+// normalizeFaultRule writes the backend URL the way backends report theirs
+func normalizeFaultRule(rule FaultRule) FaultRule {
+	if u, err := url.Parse(rule.Backend); err == nil && rule.Backend != "" {
+		rule.Backend = u.String()
+	}
+	return rule
+}
+
+// rules returns the rules in effect; callers hold mu
+func (f *Faults) rules() []*activeFault {
+	if !f.cfg.Enabled {
+		return nil
+	}
+	return append(slices.Clip(f.config), f.runtime...)
+}
+
+// updateDropPercent publishes the highest drop_packets in effect to the
+// packet path; callers hold mu
+func (f *Faults) updateDropPercent() {
+	var drop float64
+	for _, fault := range f.rules() {
+		drop = max(drop, fault.DropPackets)
+	}
+	f.dropPercent.Store(math.Float64bits(drop))
+}
+
+// add puts a rule in effect for d, replacing an admin rule of the same name
+func (f *Faults) add(rule FaultRule, d time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.cfg.Enabled {
+		return fmt.Errorf("fault injection is disabled, set faults.enabled")
+	}
+	for _, fault := range f.config {
+		if fault.Name == rule.Name {
+			return fmt.Errorf("rule %q comes from the config", rule.Name)
+		}
+	}
+	f.runtime = slices.DeleteFunc(f.runtime, func(fault *activeFault) bool { return fault.Name == rule.Name })
+	f.runtime = append(f.runtime, &activeFault{
+		FaultRule: normalizeFaultRule(rule),
+		source:    "admin",
+		expires:   time.Now().Add(d),
+	})
+	f.updateDropPercent()
+	return nil
+}
+
+// remove ends the admin rule name, or all of them for "", and reports how
+// many ended
+func (f *Faults) remove(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	before := len(f.runtime)
+	f.runtime = slices.DeleteFunc(f.runtime, func(fault *activeFault) bool { return name == "" || fault.Name == name })
+	f.updateDropPercent()
+	return before - len(f.runtime)
+}
+
+// expire ends admin rules past their duration and reports how many ended
+func (f *Faults) expire(now time.Time) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	before := len(f.runtime)
+	f.runtime = slices.DeleteFunc(f.runtime, func(fault *activeFault) bool {
+		if now.After(fault.expires) {
+			log.Printf("💥 Fault %q expired", fault.Name)
+			return true
+		}
+		return false
+	})
+	if len(f.runtime) == before {
+		return 0
+	}
+	f.updateDropPercent()
+	return before - len(f.runtime)
+}
+
+// pick returns the first request rule that selects the request, counting
+// the hit, or nil
+func (f *Faults) pick(r *http.Request, match RouteMatch, peer *balancer.Backend) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fault := range f.rules() {
+		if !fault.injectsRequests() || !fault.matches(r, match, peer) {
+			continue
+		}
+		if mathrand.Float64()*100 >= fault.percent() {
+			continue
+		}
+		fault.hits++
+		rule := fault.FaultRule
+		return &rule
+	}
+	return nil
+}
+
+// failedBackends returns the URLs of the backends held down and the rule
+// holding each
+func (f *Faults) failedBackends() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failed := make(map[string]string)
+	for _, fault := range f.rules() {
+		if fault.FailBackend {
+			failed[fault.Backend] = fault.Name
+		}
+	}
+	return failed
+}
+
+// applyFaultedBackends holds down the backends a fail_backend rule names
+// and releases the others
+func (s *Server) applyFaultedBackends() {
+	failed := s.faults.failedBackends()
+	for _, pool := range s.pools.Pools() {
+		for _, backend := range pool.Backends() {
+			rule, down := failed[backend.URL.String()]
+			if !backend.SetFaultDown(down) {
+				continue
+			}
+			if down {
+				log.Printf("💥 Backend %s in pool %s held down by fault %q", backend.URL.Redacted(), pool.Name(), rule)
+			} else {
+				log.Printf("💥 Backend %s in pool %s released from injected failure", backend.URL.Redacted(), pool.Name())
+			}
+		}
+	}
+}
+
+// injectFault delays the request or answers it with an error when a rule
+// selects it, and reports whether the request was answered
+func (s *Server) injectFault(w http.ResponseWriter, r *http.Request, match RouteMatch, peer *balancer.Backend) bool {
+	rule := s.faults.pick(r, match, peer)
+	if rule == nil {
+		return false
+	}
+	w.Header().Set("X-Fault-Injected", rule.Name)
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay.Duration())
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return true
+		}
+	}
+	if rule.Status == 0 {
+		return false
+	}
+	// The failure counts against the backend, so the circuit breaker opens
+	// as it would for a failing backend
+	peer.AddError()
+	if peer.CircuitBreaker != nil {
+		peer.CircuitBreaker.Call(func() error { return errInjectedFault })
+	}
+	log.Printf("💥 Fault %q: %s %s -> %d instead of Backend #%d", rule.Name, r.Method, r.URL.Path, rule.Status, peer.ID)
+	http.Error(w, fmt.Sprintf("💥 Fault injected: %s", rule.Name), rule.Status)
+	return true
+}
+
+// runFaultExpiry ends admin rules past their duration
+func (s *Server) runFaultExpiry(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if s.faults.expire(now) > 0 {
+				s.applyFaultedBackends()
+			}
+		}
+	}
+}
+
+// faultPacketConn drops a share of the QUIC packets read and written, so
+// loss recovery and connection migration can be exercised
+type faultPacketConn struct {
+	net.PacketConn
+	faults *Faults
+}
+
+// packetConn wraps the QUIC listener's conn when fault injection is
+// enabled at startup. The wrapper hides the UDP socket from quic-go, which
+// then does without GSO and ECN, so it is only used when asked for.
+func (f *Faults) packetConn(conn net.PacketConn, enabled bool) net.PacketConn {
+	if !enabled {
+		return conn
+	}
+	f.packetFaults.Store(true)
+	log.Printf("💥 QUIC packets can be dropped by fault rules")
+	return &faultPacketConn{PacketConn: conn, faults: f}
+}
+
+// drop reports whether the next packet is dropped
+func (f *Faults) drop() bool {
+	percent := math.Float64frombits(f.dropPercent.Load())
+	if percent == 0 || mathrand.Float64()*100 >= percent {
+		return false
+	}
+	f.droppedPackets.Add(1)
+	return true
+}
+
+// ReadFrom returns the next packet that is not dropped
+func (c *faultPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !c.faults.drop() {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo drops the packet or sends it
+func (c *faultPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.faults.drop() {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Snapshot reports the rules in effect with their hits and the packets
+// dropped
+func (f *Faults) Snapshot() map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := make([]map[string]interface{}, 0, len(f.config)+len(f.runtime))
+	for _, fault := range append(slices.Clip(f.config), f.runtime...) {
+		entry := map[string]interface{}{
+			"rule":   fault.FaultRule,
+			"source": fault.source,
+			"hits":   fault.hits,
+		}
+		if !fault.expires.IsZero() {
+			entry["expires"] = fault.expires
+		}
+		rules = append(rules, entry)
+	}
+	return map[string]interface{}{
+		"enabled":         f.cfg.Enabled,
+		"rules":           rules,
+		"drop_packets":    math.Float64frombits(f.dropPercent.Load()),
+		"dropped_packets": f.droppedPackets.Load(),
+		"packet_faults":   f.packetFaults.Load(),
+	}
+}
+
+// faultRequest is the body of POST /api/faults
+type faultRequest struct {
+	FaultRule
+	Duration balancer.Duration `json:"duration,omitempty"` // How long the rule applies, default 10m
+}
+
+// handleFaults serves /api/faults: GET lists the rules in effect, POST adds
+// a rule for a while, DELETE ?name= ends an added rule or, without a name,
+// all of them
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req faultRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if errs := req.FaultRule.validate("rule"); len(errs) > 0 || req.Duration < 0 {
+			if req.Duration < 0 {
+				errs = append(errs, fmt.Errorf("duration must not be negative"))
+			}
+			http.Error(w, errors.Join(errs...).Error(), http.StatusBadRequest)
+			return
+		}
+		d := req.Duration.Duration()
+		if d == 0 {
+			d = defaultFaultDuration
+		}
+		if err := s.faults.add(req.FaultRule, d); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if req.DropPackets > 0 && !s.faults.packetFaults.Load() {
+			log.Printf("⚠️ Fault %q drops no packets: faults were not enabled when the QUIC listener started", req.Name)
+		}
+		log.Printf("💥 Fault %q added for %v", req.Name, d)
+		s.applyFaultedBackends()
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if removed := s.faults.remove(name); removed == 0 && name != "" {
+			http.Error(w, fmt.Sprintf("No added fault %q", name), http.StatusNotFound)
+			return
+		}
+		if name == "" {
+			log.Printf("💥 Added faults ended")
+		} else {
+			log.Printf("💥 Fault %q ended", name)
+		}
+		s.applyFaultedBackends()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := s.faults.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FeaturesConfig gates experimental subsystems so they can be switched per
+// environment without rebuilding. Everything defaults to off.
+type FeaturesConfig struct {
+	UDPL4          bool `json:"udp_l4"`          // Forward QUIC packets at L4 instead of terminating HTTP/3 (restart required)
+	AdaptiveConfig bool `json:"adaptive_config"` // Tune QUIC transport parameters from observed traffic
+	RetryService   bool `json:"retry_service"`   // Stateless Retry address validation on the QUIC listener
+}
+
+// featureInfo describes one feature flag
+type featureInfo struct {
+	Name            string `json:"name"`
+	Enabled         bool   `json:"enabled"`
+	Available       bool   `json:"available"` // false when this build has no implementation yet
+	RestartRequired bool   `json:"restart_required"`
+}
+
+// featureAvailable lists which gated subsystems are implemented in this build
+var featureAvailable = map[string]bool{
+	"udp_l4":          true,
+	"adaptive_config": false,
+	"retry_service":   true,
+}
+
+// currentFeatures returns the effective feature flags
+func (s *Server) currentFeatures() FeaturesConfig {
+	if f := s.features.Load(); f != nil {
+		return *f
+	}
+	return FeaturesConfig{}
+}
+
+// list describes every flag in a stable order
+func (f FeaturesConfig) list() []featureInfo {
+	features := []featureInfo{
+		{Name: "udp_l4", Enabled: f.UDPL4, RestartRequired: true},
+		{Name: "adaptive_config", Enabled: f.AdaptiveConfig},
+		{Name: "retry_service", Enabled: f.RetryService},
+	}
+	for i := range features {
+		features[i].Available = featureAvailable[features[i].Name]
+	}
+	return features
+}
+
+// applyFeatures installs new feature flags and returns the changed flags that
+// only take effect after a restart
+func (s *Server) applyFeatures(f FeaturesConfig) []string {
+	old, started := s.currentFeatures(), s.features.Load() != nil
+
+	oldList := old.list()
+	var restartRequired []string
+	for i, feature := range f.list() {
+		if feature.Enabled && !feature.Available {
+			log.Printf("⚠️ Feature %s is enabled but not available in this build; ignoring", feature.Name)
+		}
+		if feature.Enabled != oldList[i].Enabled {
+			state := "disabled"
+			if feature.Enabled {
+				state = "enabled"
+			}
+			log.Printf("🚩 Feature %s %s", feature.Name, state)
+			if feature.RestartRequired {
+				restartRequired = append(restartRequired, "features."+feature.Name)
+			}
+		}
+	}
+	// Flags needing a restart keep reporting what runs until then
+	if started {
+		f.UDPL4 = old.UDPL4
+	}
+	s.features.Store(&f)
+	return restartRequired
+}
+
+// handleFeatures serves GET /api/features
+func (s *Server) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"features":  s.currentFeatures().list(),
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedFingerprints bounds the per-fingerprint counters; handshakes
+// with further fingerprints are counted as "other"
+const maxTrackedFingerprints = 1000
+
+// Extensions left out of the sorted JA4 extension hash
+const (
+	extensionServerName uint16 = 0x0000
+	extensionALPN       uint16 = 0x0010
+)
+
+var (
+	ja4Pattern = regexp.MustCompile(`^[tq](13|12|11|10|s3|00)[di]\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// validTLSFingerprint reports whether fp is a JA4 or a JA3 hash
+func validTLSFingerprint(fp string) bool {
+	return ja4Pattern.MatchString(fp) || ja3Pattern.MatchString(fp)
+}
+
+// tlsFingerprint identifies the TLS stack of a client by its ClientHello.
+// Bots rotating addresses usually keep their TLS library, so its
+// fingerprint can be rate limited or blocked instead.
+type tlsFingerprint struct {
+	JA3 string // MD5 of version, ciphers, extensions, curves and point formats in the order sent
+	JA4 string // JA4 with sorted ciphers and extensions, robust to extension order randomization
+}
+
+// fingerprintHello computes the fingerprints of a ClientHello received over
+// QUIC or TCP. crypto/tls does not expose the legacy version field, so JA3
+// uses 771 (TLS 1.2), which every TLS 1.3 client sends, or the highest
+// version of older clients.
+func fingerprintHello(hello *tls.ClientHelloInfo, quic bool) tlsFingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	var curves []uint16
+	for _, curve := range hello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	curves = withoutGREASE(curves)
+	versions := withoutGREASE(hello.SupportedVersions)
+	maxVersion := uint16(0)
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+
+	// JA3
+	ja3Version := maxVersion
+	if ja3Version > tls.VersionTLS12 {
+		ja3Version = tls.VersionTLS12
+	}
+	points := make([]string, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = strconv.Itoa(int(point))
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(ja3Version)),
+		joinDecimal(ciphers),
+		joinDecimal(extensions),
+		joinDecimal(curves),
+		strings.Join(points, "-"),
+	}, ",")
+	ja3Sum := md5.Sum([]byte(ja3))
+
+	// JA4: <proto><version><sni><ciphers><extensions><alpn>_<cipher hash>_<extension hash>
+	proto := "t"
+	if quic {
+		proto = "q"
+	}
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	ja4a := fmt.Sprintf("%s%s%s%02d%02d%s", proto, ja4Version(maxVersion), sni,
+		min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(hello.SupportedProtos))
+
+	sortedCiphers := slices.Clone(ciphers)
+	slices.Sort(sortedCiphers)
+	var sortedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	slices.Sort(sortedExtensions)
+	ja4c := joinHex(sortedExtensions)
+	if len(hello.SignatureSchemes) > 0 {
+		schemes := make([]uint16, len(hello.SignatureSchemes))
+		for i, scheme := range hello.SignatureSchemes {
+			schemes[i] = uint16(scheme)
+		}
+		ja4c += "_" + joinHex(schemes)
+	}
+
+	return tlsFingerprint{
+		JA3: hex.EncodeToString(ja3Sum[:]),
+		JA4: ja4a + "_" + ja4Hash(joinHex(sortedCiphers), len(sortedCiphers)) + "_" + ja4Hash(ja4c, len(sortedExtensions)),
+	}
+}
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja4Hash returns the first 12 hex digits of the SHA-256 of list, zeros
+// for an empty list
+func ja4Hash(list string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ja4Version returns the JA4 label of a TLS version
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the first ALPN value,
+// "00" without ALPN
+func ja4ALPN(protos []string) string {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+	first, last := protos[0][0], protos[0][len(protos[0])-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		return fmt.Sprintf("%02x", first)[:1] + fmt.Sprintf("%02x", last)[1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// fingerprintKey carries the fingerprint slot of a connection
+type fingerprintKey struct{}
+
+// withTLSFingerprint adds an empty fingerprint slot to a connection context.
+// The handshake sees the connection context as its ClientHello context and
+// fills the slot; requests on the connection read it.
+func withTLSFingerprint(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, new(atomic.Pointer[tlsFingerprint]))
+}
+
+// fingerprintFromRequest returns the fingerprint of r's connection; false
+// for plain HTTP
+func fingerprintFromRequest(r *http.Request) (tlsFingerprint, bool) {
+	slot, ok := r.Context().Value(fingerprintKey{}).(*atomic.Pointer[tlsFingerprint])
+	if !ok {
+		return tlsFingerprint{}, false
+	}
+	fp := slot.Load()
+	if fp == nil {
+		return tlsFingerprint{}, false
+	}
+	return *fp, true
+}
+
+// TLSFingerprints fingerprints every ClientHello and counts handshakes per
+// fingerprint, to find the fingerprints of bot floods
+type TLSFingerprints struct {
+	mu     sync.Mutex
+	counts map[string]*fingerprintCount // JA4 -> handshakes
+	other  int64
+}
+
+// fingerprintCount counts the handshakes of one JA4 fingerprint
+type fingerprintCount struct {
+	JA4        string    `json:"ja4"`
+	JA3        string    `json:"ja3"` // JA3 of the latest handshake, JA3 varies with extension order
+	Listener   string    `json:"listener"`
+	Handshakes int64     `json:"handshakes"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// NewTLSFingerprints creates empty fingerprint counters
+func NewTLSFingerprints() *TLSFingerprints {
+	return &TLSFingerprints{counts: make(map[string]*fingerprintCount)}
+}
+
+// instrument returns a copy of config that fingerprints ClientHellos on the
+// named listener before passing them on to config's GetConfigForClient
+func (tf *TLSFingerprints) instrument(listener string, config *tls.Config) *tls.Config {
+	next := config.GetConfigForClient
+	instrumented := config.Clone()
+	instrumented.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fp := fingerprintHello(hello, listener == "quic")
+		if slot, ok := hello.Context().Value(fingerprintKey{}).(*atomic.Pointer[tlsFingerprint]); ok {
+			slot.Store(&fp)
+		}
+		tf.record(listener, fp)
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return instrumented
+}
+
+// record counts a handshake
+func (tf *TLSFingerprints) record(listener string, fp tlsFingerprint) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	count, ok := tf.counts[fp.JA4]
+	if !ok {
+		if len(tf.counts) >= maxTrackedFingerprints {
+			tf.other++
+			return
+		}
+		count = &fingerprintCount{JA4: fp.JA4, Listener: listener}
+		tf.counts[fp.JA4] = count
+	}
+	count.JA3 = fp.JA3
+	count.Handshakes++
+	count.LastSeen = time.Now()
+}
+
+// Snapshot returns the fingerprints with the most handshakes first
+func (tf *TLSFingerprints) Snapshot(limit int) map[string]interface{} {
+	tf.mu.Lock()
+	counts := make([]fingerprintCount, 0, len(tf.counts))
+	for _, count := range tf.counts {
+		counts = append(counts, *count)
+	}
+	other := tf.other
+	tf.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Handshakes != counts[j].Handshakes {
+			return counts[i].Handshakes > counts[j].Handshakes
+		}
+		return counts[i].JA4 < counts[j].JA4
+	})
+	tracked := len(counts)
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return map[string]interface{}{
+		"fingerprints": counts,
+		"tracked":      tracked,
+		"other":        other,
+	}
+}
+
+// handleTLSFingerprints serves GET /api/tls/fingerprints?limit=N with the
+// JA4 and JA3 fingerprints of clients, most frequent first
+func (s *Server) handleTLSFingerprints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	stats := s.fingerprints.Snapshot(limit)
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Forward auth defaults
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	defaultAuthSessionCookie  = "qlb_auth"
+	forwardAuthMaxBody        = 64 << 10 // denial pages passed on to clients
+)
+
+// defaultForwardAuthRequestHeaders are the client headers the auth service
+// needs to recognise a user
+var defaultForwardAuthRequestHeaders = []string{"Authorization", "Cookie"}
+
+// ForwardAuthConfig asks an external auth service about every request to a
+// route with forward_auth, like nginx auth_request: the LB sends a GET with
+// the client's credentials and X-Forwarded-Method, -Proto, -Host, -Uri and
+// -For. A 2xx answer lets the request through, 401, 403 and redirects (for
+// example to an OIDC login) are passed on to the client, anything else
+// fails the request with 503.
+type ForwardAuthConfig struct {
+	URL             string            `json:"url,omitempty"`              // Auth service endpoint
+	Timeout         balancer.Duration `json:"timeout,omitempty"`          // Subrequest timeout, default 5s
+	RequestHeaders  []string          `json:"request_headers,omitempty"`  // Client headers sent to the auth service, default Authorization and Cookie
+	ResponseHeaders []string          `json:"response_headers,omitempty"` // Auth service headers copied onto the proxied request, e.g. X-Auth-User
+	Admin           bool              `json:"admin,omitempty"`            // Also ask about admin API requests, after the admin token
+
+	SessionTTL       balancer.Duration `json:"session_ttl,omitempty"`        // Issue a signed session cookie valid this long after an allowed request, so later ones skip the subrequest; 0 asks every time
+	SessionCookie    string            `json:"session_cookie,omitempty"`     // Prefix of those cookies, one per route named <prefix>_<scope hash>; default qlb_auth
+	SessionSecretRef string            `json:"session_secret_ref,omitempty"` // Secret reference for the cookie signing key; a random key (lost on restart) when unset
+}
+
+// validate checks the forward auth settings
+func (fc *ForwardAuthConfig) validate() []error {
+	var errs []error
+	if fc.URL != "" {
+		if u, err := url.Parse(fc.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("forward_auth.url %q must be an http or https URL", fc.URL))
+		}
+	}
+	if fc.Admin && fc.URL == "" {
+		errs = append(errs, fmt.Errorf("forward_auth.admin needs forward_auth.url"))
+	}
+	if fc.Timeout < 0 || fc.SessionTTL < 0 {
+		errs = append(errs, fmt.Errorf("forward_auth durations must not be negative"))
+	}
+	if fc.SessionCookie != "" && !validCookieName(fc.SessionCookie) {
+		errs = append(errs, fmt.Errorf("forward_auth.session_cookie %q is not a valid cookie name", fc.SessionCookie))
+	}
+	if fc.SessionSecretRef != "" {
+		if secret, err := resolveSecret(fc.SessionSecretRef); err != nil {
+			errs = append(errs, fmt.Errorf("forward_auth.session_secret_ref: %v", err))
+		} else if len(bytes.TrimSpace(secret)) < 32 {
+			errs = append(errs, fmt.Errorf("forward_auth.session_secret_ref: key must be at least 32 bytes"))
+		}
+	}
+	return errs
+}
+
+// validCookieName reports whether name is a cookie token
+func validCookieName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "()<>@,;:\\\"/[]?={} \t\r\n")
+}
+
+// timeout returns the configured subrequest timeout or its default
+func (fc *ForwardAuthConfig) timeout() time.Duration {
+	if fc.Timeout == 0 {
+		return defaultForwardAuthTimeout
+	}
+	return fc.Timeout.Duration()
+}
+
+// requestHeaders returns the client headers sent to the auth service
+func (fc *ForwardAuthConfig) requestHeaders() []string {
+	if len(fc.RequestHeaders) == 0 {
+		return defaultForwardAuthRequestHeaders
+	}
+	return fc.RequestHeaders
+}
+
+// sessionCookie returns the session cookie name or its default
+func (fc *ForwardAuthConfig) sessionCookie() string {
+	if fc.SessionCookie == "" {
+		return defaultAuthSessionCookie
+	}
+	return fc.SessionCookie
+}
+
+// sessionCookieFor returns the name of the session cookie of scope: the
+// session cookie name and a hash of the scope, so a browser keeps one
+// session per route instead of each login replacing the last
+func (fc *ForwardAuthConfig) sessionCookieFor(scope string) string {
+	sum := sha256.Sum256([]byte(scope))
+	return fc.sessionCookie() + "_" + hex.EncodeToString(sum[:6])
+}
+
+// isSessionCookie reports whether name is one of the session cookies
+func (fc *ForwardAuthConfig) isSessionCookie(name string) bool {
+	rest, ok := strings.CutPrefix(name, fc.sessionCookie()+"_")
+	return ok && len(rest) == 12
+}
+
+// authSession is the payload of the session cookie
+type authSession struct {
+	Expires int64             `json:"exp"`
+	Scope   string            `json:"scope"`         // the route ("route:<name>" or "route:<hash>") or "admin" the session was issued for
+	Headers map[string]string `json:"hdr,omitempty"` // the auth service's response headers
+}
+
+// forwardAuthContextKey carries the allowed request's identity headers
+type forwardAuthContextKey struct{}
+
+// ForwardAuth delegates the decision about protected requests to an
+// external auth service
+type ForwardAuth struct {
+	client *http.Client
+
+	mu  sync.RWMutex
+	cfg ForwardAuthConfig
+	key []byte // signs session cookies
+
+	statsMu     sync.Mutex
+	allowed     int64
+	denied      int64
+	errors      int64
+	sessionHits int64
+	issued      int64
+}
+
+// NewForwardAuth creates a forward auth without an auth service and a
+// random session key
+func NewForwardAuth() *ForwardAuth {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &ForwardAuth{
+		// Redirects are answers for the client, not for the LB to follow
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		key:    key,
+	}
+}
+
+// Configure applies new settings; a session secret that cannot be loaded
+// keeps the previous key
+func (fa *ForwardAuth) Configure(cfg ForwardAuthConfig) {
+	var key []byte
+	if cfg.SessionSecretRef != "" {
+		secret, err := resolveSecret(cfg.SessionSecretRef)
+		if err != nil {
+			log.Printf("⚠️ Forward auth session secret not loaded: %v", err)
+		} else {
+			key = bytes.TrimSpace(secret)
+		}
+	}
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	fa.cfg = cfg
+	if key != nil {
+		fa.key = key
+	}
+}
+
+// authorize asks the auth service about a request to a route with
+// forward_auth, or accepts a valid session cookie instead, and answers
+// denied requests itself. The allowed identity is stored in the returned
+// request's context.
+func (fa *ForwardAuth) authorize(w http.ResponseWriter, r *http.Request, match RouteMatch) (*http.Request, bool) {
+	if !match.ForwardAuth {
+		return r, true
+	}
+	return fa.check(w, r, match.Route)
+}
+
+// check runs the forward auth decision for r; scope names what is protected
+// in log lines, and a session cookie is only accepted for the scope it was
+// issued for
+func (fa *ForwardAuth) check(w http.ResponseWriter, r *http.Request, scope string) (*http.Request, bool) {
+	fa.mu.RLock()
+	cfg, key := fa.cfg, fa.key
+	fa.mu.RUnlock()
+	if cfg.URL == "" {
+		return r, true
+	}
+
+	if session, ok := readAuthSession(r, cfg.sessionCookieFor(scope), key, scope); ok {
+		fa.count(&fa.sessionHits)
+		return r.WithContext(context.WithValue(r.Context(), forwardAuthContextKey{}, session.Headers)), true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.timeout())
+	defer cancel()
+	resp, err := fa.subrequest(ctx, r, &cfg)
+	if err != nil {
+		fa.count(&fa.errors)
+		log.Printf("❌ Forward auth for %s %s (%s) failed: %v", r.Method, r.URL.Path, scope, err)
+		http.Error(w, "🚫 Authentication service unavailable", http.StatusServiceUnavailable)
+		return r, false
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		identity := make(map[string]string)
+		for _, name := range cfg.ResponseHeaders {
+			if value := resp.Header.Get(name); value != "" {
+				identity[http.CanonicalHeaderKey(name)] = value
+			}
+		}
+		fa.count(&fa.allowed)
+		if cfg.SessionTTL > 0 {
+			fa.issueSession(w, r, &cfg, key, scope, identity)
+		}
+		return r.WithContext(context.WithValue(r.Context(), forwardAuthContextKey{}, identity)), true
+
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode >= 300 && resp.StatusCode < 400:
+		fa.count(&fa.denied)
+		log.Printf("🔏 Forward auth denied %s %s from %s (%s): %s", r.Method, r.URL.Path, r.RemoteAddr, scope, resp.Status)
+		// Login redirects, challenges and cookies of the auth service reach the client
+		for _, name := range []string{"Location", "WWW-Authenticate", "Set-Cookie", "Content-Type", "Cache-Control"} {
+			for _, value := range resp.Header.Values(name) {
+				w.Header().Add(name, value)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, forwardAuthMaxBody))
+		return r, false
+	}
+
+	fa.count(&fa.errors)
+	log.Printf("❌ Forward auth for %s %s (%s) answered %s", r.Method, r.URL.Path, scope, resp.Status)
+	http.Error(w, "🚫 Authentication service unavailable", http.StatusServiceUnavailable)
+	return r, false
+}
+
+// subrequest asks the auth service about r
+func (fa *ForwardAuth) subrequest(ctx context.Context, r *http.Request, cfg *ForwardAuthConfig) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range cfg.requestHeaders() {
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	return fa.client.Do(req)
+}
+
+// issueSession sets a signed cookie carrying identity for scope until the
+// TTL ends
+func (fa *ForwardAuth) issueSession(w http.ResponseWriter, r *http.Request, cfg *ForwardAuthConfig, key []byte, scope string, identity map[string]string) {
+	ttl := cfg.SessionTTL.Duration()
+	payload, err := json.Marshal(authSession{Expires: time.Now().Add(ttl).Unix(), Scope: scope, Headers: identity})
+	if err != nil {
+		return
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.sessionCookieFor(scope),
+		Value:    encoded + "." + base64.RawURLEncoding.EncodeToString(signAuthSession(key, encoded)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	fa.count(&fa.issued)
+}
+
+// signAuthSession returns the HMAC-SHA256 of an encoded session
+func signAuthSession(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// readAuthSession returns the unexpired session of a correctly signed cookie
+// issued for scope; a session of another route or of the admin API is refused
+func readAuthSession(r *http.Request, name string, key []byte, scope string) (authSession, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return authSession{}, false
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return authSession{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signAuthSession(key, encoded)) {
+		return authSession{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return authSession{}, false
+	}
+	var session authSession
+	if err := json.Unmarshal(payload, &session); err != nil || time.Now().Unix() >= session.Expires || session.Scope != scope {
+		return authSession{}, false
+	}
+	return session, true
+}
+
+// count increments one of the counters
+func (fa *ForwardAuth) count(counter *int64) {
+	fa.statsMu.Lock()
+	*counter++
+	fa.statsMu.Unlock()
+}
+
+// setForwardAuthHeaders replaces the identity headers on a request about to
+// be proxied with the auth service's answer, always dropping client-sent
+// ones, and keeps the LB's session cookie from backends
+func (fa *ForwardAuth) setForwardAuthHeaders(r *http.Request) {
+	fa.mu.RLock()
+	cfg := fa.cfg
+	fa.mu.RUnlock()
+
+	for _, name := range cfg.ResponseHeaders {
+		r.Header.Del(name)
+	}
+	if identity, ok := r.Context().Value(forwardAuthContextKey{}).(map[string]string); ok {
+		for name, value := range identity {
+			r.Header.Set(name, value)
+		}
+	}
+
+	if cfg.SessionTTL == 0 {
+		return
+	}
+	cookies := r.Cookies()
+	if !slices.ContainsFunc(cookies, func(c *http.Cookie) bool { return cfg.isSessionCookie(c.Name) }) {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !cfg.isSessionCookie(cookie.Name) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// adminMiddleware asks the auth service about admin API requests when
+// forward_auth.admin is on
+func (fa *ForwardAuth) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fa.mu.RLock()
+		enabled := fa.cfg.Admin
+		fa.mu.RUnlock()
+		if enabled {
+			var ok bool
+			if r, ok = fa.check(w, r, "admin"); !ok {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Snapshot reports the auth service and decision counts
+func (fa *ForwardAuth) Snapshot() map[string]interface{} {
+	fa.mu.RLock()
+	cfg := fa.cfg
+	fa.mu.RUnlock()
+
+	fa.statsMu.Lock()
+	defer fa.statsMu.Unlock()
+	return map[string]interface{}{
+		"url":              cfg.URL,
+		"admin":            cfg.Admin,
+		"timeout":          cfg.timeout().String(),
+		"response_headers": cfg.ResponseHeaders,
+		"session_ttl":      cfg.SessionTTL.Duration().String(),
+		"allowed":          fa.allowed,
+		"denied":           fa.denied,
+		"errors":           fa.errors,
+		"session_hits":     fa.sessionHits,
+		"sessions_issued":  fa.issued,
+	}
+}
+
+// handleForwardAuth serves GET /api/forward-auth with the decision counts
+func (s *Server) handleForwardAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.forwardAuth.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
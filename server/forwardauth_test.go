@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// newTestForwardAuth returns a forward auth asking an auth service that
+// allows requests carrying "Authorization: Bearer ok" as user alice and
+// redirects others to a login page, counting the subrequests
+func newTestForwardAuth(t *testing.T, cfg ForwardAuthConfig) (*ForwardAuth, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer ok" {
+			http.Redirect(w, r, "https://login.example/?rd="+r.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+			return
+		}
+		w.Header().Set("X-Auth-User", "alice")
+	}))
+	t.Cleanup(service.Close)
+	cfg.URL = service.URL
+	cfg.ResponseHeaders = []string{"X-Auth-User"}
+	fa := NewForwardAuth()
+	fa.Configure(cfg)
+	return fa, &calls
+}
+
+func TestForwardAuthDecision(t *testing.T) {
+	fa, _ := newTestForwardAuth(t, ForwardAuthConfig{})
+	match := RouteMatch{ForwardAuth: true, Route: "route:courses"}
+
+	r := httptest.NewRequest(http.MethodGet, "/course/view.php?id=2", nil)
+	w := httptest.NewRecorder()
+	if _, ok := fa.authorize(w, r, match); ok {
+		t.Fatal("request without credentials allowed")
+	}
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "rd=/course/view.php?id=2") {
+		t.Errorf("denied with %d, Location %q; want the auth service's login redirect", w.Code, w.Header().Get("Location"))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/course/view.php?id=2", nil)
+	r.Header.Set("Authorization", "Bearer ok")
+	r.Header.Set("X-Auth-User", "mallory")
+	allowed, ok := fa.authorize(httptest.NewRecorder(), r, match)
+	if !ok {
+		t.Fatal("request with credentials denied")
+	}
+	fa.setForwardAuthHeaders(allowed)
+	if got := allowed.Header.Get("X-Auth-User"); got != "alice" {
+		t.Errorf("X-Auth-User %q reaches the backend, want the auth service's alice", got)
+	}
+
+	// Routes without forward_auth are not asked about
+	if _, ok := fa.authorize(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), RouteMatch{}); !ok {
+		t.Error("route without forward_auth denied")
+	}
+}
+
+// An auth service that cannot be reached fails closed
+func TestForwardAuthServiceDown(t *testing.T) {
+	fa := NewForwardAuth()
+	fa.Configure(ForwardAuthConfig{URL: "http://127.0.0.1:1", Timeout: balancer.Duration(time.Second)})
+	w := httptest.NewRecorder()
+	if _, ok := fa.authorize(w, httptest.NewRequest(http.MethodGet, "/", nil), RouteMatch{ForwardAuth: true, Route: "route:a"}); ok {
+		t.Fatal("allowed without an auth service")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+}
+
+// A session cookie skips the subrequest on its own route only, and each
+// route's session has a cookie of its own
+func TestForwardAuthSessionBoundToRoute(t *testing.T) {
+	fa, calls := newTestForwardAuth(t, ForwardAuthConfig{SessionTTL: balancer.Duration(time.Hour)})
+	courses := RouteMatch{ForwardAuth: true, Route: "route:courses"}
+	grades := RouteMatch{ForwardAuth: true, Route: "route:grades"}
+
+	login := func(match RouteMatch) *http.Cookie {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer ok")
+		w := httptest.NewRecorder()
+		if _, ok := fa.authorize(w, r, match); !ok {
+			t.Fatalf("login to %s denied", match.Route)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%d cookies issued for %s, want 1", len(cookies), match.Route)
+		}
+		return cookies[0]
+	}
+	coursesCookie, gradesCookie := login(courses), login(grades)
+	if coursesCookie.Name == gradesCookie.Name {
+		t.Errorf("both routes' sessions use cookie %s, so one login replaces the other", coursesCookie.Name)
+	}
+	if !strings.HasPrefix(coursesCookie.Name, defaultAuthSessionCookie+"_") {
+		t.Errorf("session cookie %q does not start with %s_", coursesCookie.Name, defaultAuthSessionCookie)
+	}
+
+	before := calls.Load()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(coursesCookie)
+	if _, ok := fa.authorize(httptest.NewRecorder(), r, courses); !ok || calls.Load() != before {
+		t.Errorf("session of its own route: allowed %v after %d subrequests, want allowed without one", ok, calls.Load()-before)
+	}
+
+	// The courses session, even renamed to the grades cookie, does not
+	// open another route or the admin API
+	for _, scope := range []string{"route:grades", "admin"} {
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: fa.cfg.sessionCookieFor(scope), Value: coursesCookie.Value})
+		if _, ok := fa.check(httptest.NewRecorder(), r, scope); ok {
+			t.Errorf("courses session accepted for %s", scope)
+		}
+	}
+
+	// Backends never see the session cookies
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(coursesCookie)
+	r.AddCookie(gradesCookie)
+	r.AddCookie(&http.Cookie{Name: "MoodleSession", Value: "abc"})
+	fa.setForwardAuthHeaders(r)
+	if got := r.Header.Get("Cookie"); got != "MoodleSession=abc" {
+		t.Errorf("Cookie %q reaches the backend, want only MoodleSession", got)
+	}
+}
+
+// A route keeps its identity when routes are reordered, and an unnamed
+// route gets a new one when its definition changes
+func TestRouteIdentity(t *testing.T) {
+	courses := RouteConfig{PathPrefix: "/course/", Pool: "default", ForwardAuth: true}
+	grades := RouteConfig{PathPrefix: "/grade/", Pool: "default", ForwardAuth: true}
+	if courses.identity() == grades.identity() {
+		t.Error("two routes share an identity")
+	}
+	moved := courses
+	if moved.identity() != courses.identity() {
+		t.Error("identity depends on more than the route's definition")
+	}
+	widened := courses
+	widened.PathPrefix = "/"
+	if widened.identity() == courses.identity() {
+		t.Error("an edited route keeps its sessions")
+	}
+
+	named := RouteConfig{Name: "courses", PathPrefix: "/course/", Pool: "default"}
+	renamedPrefix := named
+	renamedPrefix.PathPrefix = "/courses/"
+	if named.identity() != "route:courses" || renamedPrefix.identity() != "route:courses" {
+		t.Errorf("named route identities %q and %q, want route:courses", named.identity(), renamedPrefix.identity())
+	}
+}
+
+func TestRouteNamesUnique(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{
+		{Name: "courses", PathPrefix: "/course/", Pool: "default"},
+		{Name: "courses", PathPrefix: "/grade/", Pool: "default"},
+	}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), `routes[1].name "courses" is used twice`) {
+		t.Errorf("Validate: %v, want the duplicate route name refused", err)
+	}
+}
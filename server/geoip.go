@@ -0,0 +1,367 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+
+	"quic-moodle/balancer"
+)
+
+// defaultGeoIPReloadInterval is how often the databases are checked for updates
+const defaultGeoIPReloadInterval = time.Minute
+
+// Headers carrying the client's location to backends. Values sent by
+// clients are always dropped so backends can trust them.
+var geoHeaders = []string{
+	"X-Geo-Country",
+	"X-Geo-ASN",
+	"X-Geo-AS-Org",
+}
+
+// GeoIPConfig points at MaxMind DB files (GeoLite2 or GeoIP2) used to tag
+// requests with the client's country and autonomous system. The tags drive
+// the country and ASN rules of access lists and route conditions.
+type GeoIPConfig struct {
+	CountryDB      string            `json:"country_db,omitempty"`      // GeoLite2-Country or GeoIP2-City .mmdb file
+	ASNDB          string            `json:"asn_db,omitempty"`          // GeoLite2-ASN .mmdb file
+	Headers        bool              `json:"headers,omitempty"`         // Send X-Geo-Country, X-Geo-ASN and X-Geo-AS-Org to backends
+	ReloadInterval balancer.Duration `json:"reload_interval,omitempty"` // How often changed database files are reloaded, default 1m
+}
+
+// validate checks that the database files can be opened
+func (gc *GeoIPConfig) validate() []error {
+	var errs []error
+	for name, path := range map[string]string{"country_db": gc.CountryDB, "asn_db": gc.ASNDB} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("geoip.%s: %v", name, err))
+		}
+	}
+	if gc.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("geoip.reload_interval must not be negative"))
+	}
+	return errs
+}
+
+// reloadInterval returns the configured reload interval or its default
+func (gc *GeoIPConfig) reloadInterval() time.Duration {
+	if gc.ReloadInterval == 0 {
+		return defaultGeoIPReloadInterval
+	}
+	return gc.ReloadInterval.Duration()
+}
+
+// geoInfo is what the databases know about a client address
+type geoInfo struct {
+	Country string // ISO 3166-1 alpha-2 code, "" when unknown
+	ASN     uint
+	ASOrg   string
+}
+
+// String formats the location for log lines, "DE AS3320"
+func (g geoInfo) String() string {
+	country := g.Country
+	if country == "" {
+		country = "??"
+	}
+	if g.ASN == 0 {
+		return country
+	}
+	return fmt.Sprintf("%s AS%d", country, g.ASN)
+}
+
+// geoRecord decodes the fields of country, city and ASN databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDB is an open database file
+type geoDB struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// openGeoDB opens a database file
+func openGeoDB(path string) (*geoDB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return &geoDB{path: path, modTime: info.ModTime(), reader: reader}, nil
+}
+
+// geoContextKey carries a request's geoInfo
+type geoContextKey struct{}
+
+// geoFromRequest returns the location GeoIP.tag stored on r
+func geoFromRequest(r *http.Request) (geoInfo, bool) {
+	geo, ok := r.Context().Value(geoContextKey{}).(geoInfo)
+	return geo, ok
+}
+
+// GeoIP looks up client addresses in the configured databases, reloading
+// them when the files change
+type GeoIP struct {
+	mu      sync.RWMutex
+	cfg     GeoIPConfig
+	country *geoDB
+	asn     *geoDB
+
+	lookups   int64
+	countries map[string]int64 // requests per country, "" for unknown
+	failures  int64
+	reloads   int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewGeoIP creates a GeoIP without databases, which tags nothing
+func NewGeoIP() *GeoIP {
+	return &GeoIP{countries: make(map[string]int64)}
+}
+
+// Configure opens the configured databases; a database that fails to open
+// keeps the previous one
+func (g *GeoIP) Configure(cfg GeoIPConfig) {
+	g.mu.Lock()
+	g.cfg = cfg
+	g.country = g.reopen(g.country, cfg.CountryDB)
+	g.asn = g.reopen(g.asn, cfg.ASNDB)
+	enabled := g.country != nil || g.asn != nil
+	g.mu.Unlock()
+
+	g.stopWatching()
+	if enabled {
+		g.stop, g.done = make(chan struct{}), make(chan struct{})
+		go g.watch(cfg.reloadInterval(), g.stop, g.done)
+	}
+}
+
+// reopen returns the database for path: current while the path and the
+// file are unchanged, otherwise a fresh reader
+func (g *GeoIP) reopen(current *geoDB, path string) *geoDB {
+	if path == "" {
+		if current != nil {
+			current.reader.Close()
+		}
+		return nil
+	}
+	if current != nil && current.path == path {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(current.modTime) {
+			return current
+		}
+	}
+
+	db, err := openGeoDB(path)
+	if err != nil {
+		log.Printf("⚠️ GeoIP database not loaded: %v", err)
+		return current
+	}
+	if current != nil {
+		// Lookups in flight hold the read lock, so the old reader is unused
+		current.reader.Close()
+		g.reloads++
+	}
+	log.Printf("🌍 GeoIP database %s loaded (%s, built %s)", path, db.reader.Metadata.DatabaseType,
+		db.reader.Metadata.BuildTime().Format("2006-01-02"))
+	return db
+}
+
+// watch reloads databases whose files changed until stop is closed
+func (g *GeoIP) watch(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			g.mu.Lock()
+			g.country = g.reopen(g.country, g.cfg.CountryDB)
+			g.asn = g.reopen(g.asn, g.cfg.ASNDB)
+			g.mu.Unlock()
+		}
+	}
+}
+
+// stopWatching ends the reload loop
+func (g *GeoIP) stopWatching() {
+	if g.stop != nil {
+		close(g.stop)
+		<-g.done
+		g.stop = nil
+	}
+}
+
+// Close stops reloading and closes the databases
+func (g *GeoIP) Close() {
+	g.stopWatching()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, db := range []*geoDB{g.country, g.asn} {
+		if db != nil {
+			db.reader.Close()
+		}
+	}
+	g.country, g.asn = nil, nil
+}
+
+// lookup returns what the databases know about addr; ok is false without databases
+func (g *GeoIP) lookup(addr netip.Addr) (geo geoInfo, ok bool, err error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.country == nil && g.asn == nil {
+		return geoInfo{}, false, nil
+	}
+	var record geoRecord
+	for _, db := range []*geoDB{g.country, g.asn} {
+		if db == nil {
+			continue
+		}
+		if decodeErr := db.reader.Lookup(addr).Decode(&record); decodeErr != nil {
+			err = decodeErr
+		}
+	}
+	return geoInfo{
+		Country: record.Country.ISOCode,
+		ASN:     record.AutonomousSystemNumber,
+		ASOrg:   record.AutonomousSystemOrganization,
+	}, true, err
+}
+
+// tag looks up r's client and stores the result in r's context; without
+// databases r is returned unchanged
+func (g *GeoIP) tag(r *http.Request) *http.Request {
+	addr, ok := clientAddr(r)
+	if !ok {
+		return r
+	}
+	geo, ok, err := g.lookup(addr)
+	if !ok {
+		return r
+	}
+
+	g.mu.Lock()
+	g.lookups++
+	g.countries[geo.Country]++
+	if err != nil {
+		g.failures++
+	}
+	g.mu.Unlock()
+	return r.WithContext(context.WithValue(r.Context(), geoContextKey{}, geo))
+}
+
+// setGeoHeaders replaces the location headers on a request about to be
+// proxied when geoip.headers is on, and always drops client-sent ones
+func setGeoHeaders(r *http.Request, enabled bool) {
+	for _, name := range geoHeaders {
+		r.Header.Del(name)
+	}
+	geo, ok := geoFromRequest(r)
+	if !enabled || !ok {
+		return
+	}
+	if geo.Country != "" {
+		r.Header.Set("X-Geo-Country", geo.Country)
+	}
+	if geo.ASN != 0 {
+		r.Header.Set("X-Geo-ASN", strconv.FormatUint(uint64(geo.ASN), 10))
+	}
+	if geo.ASOrg != "" {
+		r.Header.Set("X-Geo-AS-Org", geo.ASOrg)
+	}
+}
+
+// Snapshot reports the loaded databases and lookups per country
+func (g *GeoIP) Snapshot() map[string]interface{} {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	databases := make(map[string]interface{})
+	for name, db := range map[string]*geoDB{"country": g.country, "asn": g.asn} {
+		if db == nil {
+			continue
+		}
+		databases[name] = map[string]interface{}{
+			"path":       db.path,
+			"type":       db.reader.Metadata.DatabaseType,
+			"build_time": db.reader.Metadata.BuildTime(),
+			"modified":   db.modTime,
+		}
+	}
+	countries := make(map[string]int64, len(g.countries))
+	for country, n := range g.countries {
+		if country == "" {
+			country = "unknown"
+		}
+		countries[country] = n
+	}
+	return map[string]interface{}{
+		"enabled":   g.country != nil || g.asn != nil,
+		"databases": databases,
+		"headers":   g.cfg.Headers,
+		"lookups":   g.lookups,
+		"failures":  g.failures,
+		"reloads":   g.reloads,
+		"countries": countries,
+	}
+}
+
+// handleGeoIP serves /api/geoip: GET reports the databases and lookups per
+// country, GET ?ip=<addr> looks an address up
+func (s *Server) handleGeoIP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid address %q", ip), http.StatusBadRequest)
+			return
+		}
+		geo, ok, err := s.geoip.lookup(addr.Unmap())
+		if !ok {
+			http.Error(w, "no GeoIP database loaded", http.StatusNotFound)
+			return
+		}
+		response := map[string]interface{}{
+			"ip":        ip,
+			"country":   geo.Country,
+			"asn":       geo.ASN,
+			"as_org":    geo.ASOrg,
+			"timestamp": time.Now(),
+		}
+		if err != nil {
+			response["error"] = err.Error()
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	stats := s.geoip.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
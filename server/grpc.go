@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"quic-moodle/balancer"
+)
+
+// gRPC status codes the load balancer reports for its own errors
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// isGRPCRequest reports whether r is a gRPC or gRPC-Web call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatusForHTTP maps an HTTP status to a gRPC status code following the
+// gRPC "HTTP to gRPC Status Code Mapping"
+func grpcStatusForHTTP(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooEarly, http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// newGRPCTransport clones the backend transport for gRPC pools, speaking only
+// HTTP/2: over TLS for https:// backends and cleartext (h2c) for http:// ones
+func newGRPCTransport(base http.RoundTripper) http.RoundTripper {
+	t, ok := base.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// grpcResponseWriter prepares a gRPC call for proxying: gRPC-Web requests to
+// pools that allow it are translated to gRPC, and the response writer
+// reports every outcome as a grpc-status. The returned function completes
+// the response once the handler is done.
+func grpcResponseWriter(w http.ResponseWriter, r *http.Request, pool *balancer.Pool) (http.ResponseWriter, func()) {
+	finish := func() {}
+	if pool.Settings().GRPCWeb {
+		if web := translateGRPCWeb(w, r); web != nil {
+			w, finish = web, web.finish
+		}
+	}
+	return &grpcStatusWriter{ResponseWriter: w}, finish
+}
+
+// grpcStatusWriter turns responses gRPC clients cannot read, such as the
+// load balancer's own 503 or a backend's HTML error page, into trailers-only
+// gRPC responses carrying the mapped grpc-status
+type grpcStatusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *grpcStatusWriter) WriteHeader(code int) {
+	if code < 200 || w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if code == http.StatusOK && strings.HasPrefix(h.Get("Content-Type"), "application/grpc") {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Trailer"} {
+		h.Del(key)
+	}
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcStatusForHTTP(code)))
+	h.Set("Grpc-Message", "load balancer: HTTP "+strconv.Itoa(code)+" "+http.StatusText(code))
+	w.discard = true
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (w *grpcStatusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *grpcStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// translateGRPCWeb rewrites a gRPC-Web request into a gRPC one and returns
+// the writer translating the response back, or nil when r is plain gRPC
+func translateGRPCWeb(w http.ResponseWriter, r *http.Request) *grpcWebWriter {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc-web") {
+		return nil
+	}
+	// application/grpc-web[-text][+proto]
+	family, suffix, _ := strings.Cut(contentType, "+")
+	if suffix != "" {
+		suffix = "+" + suffix
+	}
+	text := family == "application/grpc-web-text"
+
+	r.Header.Set("Content-Type", "application/grpc"+suffix)
+	r.Header.Set("Te", "trailers")
+	if text {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&grpcWebTextReader{src: r.Body}, r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+	}
+	return &grpcWebWriter{ResponseWriter: w, family: family, text: text}
+}
+
+// grpcWebTextReader decodes a gRPC-Web text body. Clients may send each
+// message as its own padded base64 chunk, so input is decoded one 4-byte
+// quantum at a time rather than as a single base64 stream.
+type grpcWebTextReader struct {
+	src     io.Reader
+	quantum []byte // undecoded input, shorter than a quantum between reads
+	decoded []byte
+	err     error
+}
+
+func (t *grpcWebTextReader) Read(b []byte) (int, error) {
+	buf := make([]byte, 4096)
+	for len(t.decoded) == 0 && t.err == nil {
+		n, err := t.src.Read(buf)
+		in := append(t.quantum, buf[:n]...)
+		whole := len(in) / 4 * 4
+		for i := 0; i < whole; i += 4 {
+			var out [3]byte
+			m, err := base64.StdEncoding.Decode(out[:], in[i:i+4])
+			if err != nil {
+				return 0, err
+			}
+			t.decoded = append(t.decoded, out[:m]...)
+		}
+		t.quantum = append([]byte(nil), in[whole:]...)
+		if err == io.EOF && len(t.quantum) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		t.err = err
+	}
+	if len(t.decoded) == 0 {
+		return 0, t.err
+	}
+	n := copy(b, t.decoded)
+	t.decoded = t.decoded[n:]
+	return n, nil
+}
+
+// grpcWebWriter translates a gRPC response into gRPC-Web: the content type
+// follows the request's, and trailers become a final length-prefixed frame
+// flagged 0x80 in the body
+type grpcWebWriter struct {
+	http.ResponseWriter
+	family       string // application/grpc-web or application/grpc-web-text
+	text         bool
+	wroteHeader  bool
+	trailersOnly bool
+	trailers     []string // trailer names the response announced
+}
+
+func (w *grpcWebWriter) WriteHeader(code int) {
+	if code < 200 || w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if contentType := h.Get("Content-Type"); strings.HasPrefix(contentType, "application/grpc") {
+		_, suffix, _ := strings.Cut(contentType, "+")
+		if suffix != "" {
+			suffix = "+" + suffix
+		}
+		h.Set("Content-Type", w.family+suffix)
+	}
+	for _, value := range h.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				w.trailers = append(w.trailers, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	h.Del("Trailer")
+	h.Del("Content-Length")
+	w.trailersOnly = h.Get("Grpc-Status") != ""
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *grpcWebWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.text {
+		return w.ResponseWriter.Write(b)
+	}
+	if _, err := io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// finish writes the trailer frame unless the status already went out in
+// the headers of a trailers-only response
+func (w *grpcWebWriter) finish() {
+	if !w.wroteHeader || w.trailersOnly {
+		return
+	}
+	h := w.Header()
+	trailers := make(map[string][]string)
+	for _, name := range w.trailers {
+		if values, ok := h[name]; ok {
+			trailers[name] = values
+			delete(h, name)
+		}
+	}
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = values
+			delete(h, key)
+		}
+	}
+	if len(trailers[http.CanonicalHeaderKey("Grpc-Status")]) == 0 {
+		trailers[http.CanonicalHeaderKey("Grpc-Status")] = []string{strconv.Itoa(grpcUnknown)}
+	}
+
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var block strings.Builder
+	for _, name := range names {
+		for _, value := range trailers[name] {
+			block.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.String()...)
+	w.Write(frame)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *grpcWebWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"quic-moodle/quiclb"
+)
+
+// handleConnections serves GET /api/connections with the tracked client connections
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	connections := s.conns.getConnections()
+
+	// Simplified connection stats
+	response := map[string]interface{}{
+		"connections":  connections,
+		"total_count":  len(connections),
+		"active_count": len(connections),
+		"timestamp":    time.Now(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleLoadBalancer serves GET /api/loadbalancer with default pool stats
+func (s *Server) handleLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := s.defaultPool().GetStats()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleQUICLB serves the QUIC-LB Draft 20 status endpoint
+func (s *Server) handleQUICLB(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	response := map[string]interface{}{
+		"draft":                 "IETF QUIC-LB Draft 20",
+		"compliant":             true,
+		"config":                s.quicLB.GetConfig(),
+		"backend_stats":         s.quicLB.GetBackendStats(),
+		"algorithm":             s.quicLB.GetConfig().Algorithm,
+		"stateless":             true,
+		"connection_id_routing": true,
+		"supported_algorithms":  []string{"plaintext", "stream-cipher", "block-cipher"},
+		"timestamp":             time.Now(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleQUICLBConfig lists the QUIC-LB configurations or adds one on POST
+func (s *Server) handleQUICLBConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" {
+		// New parameters go through the config manager like any other
+		// change, rotating to them under their own config rotation bits;
+		// fields left out keep their accepted values
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		restartRequired, persisted, err := s.config.Modify("admin-api", func(accepted *Config) (*Config, error) {
+			cfg := cloneConfig(accepted)
+			if err := json.Unmarshal(body, &cfg.QUICLB); err != nil {
+				return nil, fmt.Errorf("%w: %v", errConfigInvalid, err)
+			}
+			return cfg, configChangeAllowed(r, accepted, cfg)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add config: %v", err), configErrorStatus(err))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":          "Configuration added successfully",
+			"config":           redactConfig(s.config.Accepted()).QUICLB,
+			"persisted":        persisted,
+			"restart_required": restartRequired,
+		})
+		return
+	}
+
+	// GET - return all configurations
+	configs := make(map[string]*quiclb.Config)
+	for bits, config := range s.quicLB.Configs() {
+		configs[fmt.Sprintf("config_%d", bits)] = config
+	}
+	activeConfig := s.quicLB.ActiveConfigBits()
+
+	response := map[string]interface{}{
+		"configurations": configs,
+		"active_config":  activeConfig,
+		"draft":          "IETF QUIC-LB Draft 20",
+		"features": []string{
+			"config-rotation",
+			"length-self-description",
+			"unroutable-cid-handling",
+			"aes-ecb-encryption",
+			"multi-algorithm-support",
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleQUICLBDemo demonstrates CID encoding for each algorithm
+func handleQUICLBDemo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Demonstrate different algorithms
+	demos := make(map[string]interface{})
+
+	// Demo 1: Plaintext algorithm
+	plaintextConfig := &quiclb.Config{
+		Algorithm:               "plaintext",
+		ConfigRotationBits:      0x02,
+		ServerIDLen:             2,
+		ConnectionIDLen:         8,
+		FirstOctetEncodesCIDLen: true, // Enable length encoding for demo
+		Active:                  true,
+		CreatedAt:               time.Now(),
+	}
+
+	encoder := quiclb.NewPlaintext(plaintextConfig.ConfigRotationBits, plaintextConfig.ServerIDLen, plaintextConfig.ConnectionIDLen)
+	encoder.Config().FirstOctetEncodesCIDLen = true
+
+	cid, err := encoder.EncodePlaintextCID(123) // Backend ID 123
+	if err == nil {
+		decoded, decodeErr := encoder.DecodeCID(cid.Raw)
+		demos["plaintext"] = map[string]interface{}{
+			"algorithm":            "plaintext",
+			"config_rotation_bits": fmt.Sprintf("0b%03b", plaintextConfig.ConfigRotationBits),
+			"first_octet_binary":   fmt.Sprintf("0b%08b", cid.Raw[0]),
+			"config_bits":          fmt.Sprintf("bits 5-7: 0b%03b", (cid.Raw[0]>>5)&0x07),
+			"length_bits":          fmt.Sprintf("bits 0-4: 0b%05b", cid.Raw[0]&0x1F),
+			"cid_hex":              hex.EncodeToString(cid.Raw),
+			"decoded_backend_id":   decoded.BackendID,
+			"decode_success":       decodeErr == nil,
+		}
+	}
+
+	// Demo 2: Encrypted algorithm (if we add key)
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	encryptedEncoder, err := quiclb.NewEncrypted("stream-cipher", 0x03, 2, 11, 8, key)
+	if err == nil {
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+
+		encryptedCID, encErr := encryptedEncoder.EncodeEncryptedCID(456, nonce)
+		if encErr == nil {
+			decodedEnc, decEncErr := encryptedEncoder.DecodeCID(encryptedCID.Raw)
+			demos["encrypted"] = map[string]interface{}{
+				"algorithm":            "stream-cipher",
+				"config_rotation_bits": fmt.Sprintf("0b%03b", 0x03),
+				"first_octet_binary":   fmt.Sprintf("0b%08b", encryptedCID.Raw[0]),
+				"config_bits":          fmt.Sprintf("bits 5-7: 0b%03b", (encryptedCID.Raw[0]>>5)&0x07),
+				"length_bits":          fmt.Sprintf("bits 0-4: 0b%05b", encryptedCID.Raw[0]&0x1F),
+				"cid_hex":              hex.EncodeToString(encryptedCID.Raw),
+				"encrypted":            true,
+				"decoded_backend_id":   decodedEnc.BackendID,
+				"decode_success":       decEncErr == nil,
+			}
+		}
+	}
+
+	// Demo 3: Unroutable CID
+	unroutableCID := make([]byte, 8)
+	rand.Read(unroutableCID)
+	unroutableCID[0] = (0x07 << 5) | (unroutableCID[0] & 0x1F) // Set to reserved value 0b111
+
+	demos["unroutable"] = map[string]interface{}{
+		"algorithm":            "unroutable",
+		"config_rotation_bits": "0b111 (reserved)",
+		"first_octet_binary":   fmt.Sprintf("0b%08b", unroutableCID[0]),
+		"config_bits":          "bits 5-7: 0b111 (reserved)",
+		"length_bits":          fmt.Sprintf("bits 0-4: 0b%05b", unroutableCID[0]&0x1F),
+		"cid_hex":              hex.EncodeToString(unroutableCID),
+		"routable":             false,
+		"fallback_required":    true,
+	}
+
+	response := map[string]interface{}{
+		"description": "QUIC-LB Draft 20 Algorithm Demonstrations",
+		"first_octet_format": map[string]string{
+			"bits_5_7": "Config Rotation (3 bits)",
+			"bits_0_4": "CID Length or Random (5 bits)",
+		},
+		"algorithms": demos,
+		"compliance": "IETF QUIC-LB Draft 20",
+		"timestamp":  time.Now(),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleQUICLBTestCID generates and decodes a CID for every backend
+func (s *Server) handleQUICLBTestCID(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Generate test connection IDs for each backend
+	testResults := make(map[string]interface{})
+
+	for _, backend := range s.quicLB.GetBackendStats() {
+		backendID := uint16(backend.ID)
+		cid, cidErr := s.quicLB.GenerateConnectionID(backendID)
+		if cidErr != nil {
+			testResults[fmt.Sprintf("backend_%d", backendID)] = map[string]interface{}{
+				"error": cidErr.Error(),
+			}
+			continue
+		}
+
+		// Test decoding - try with active config first
+		decodedCID, decodeErr := s.quicLB.DecodeCID(cid)
+		if decodeErr != nil {
+			testResults[fmt.Sprintf("backend_%d", backendID)] = map[string]interface{}{
+				"cid_hex":      hex.EncodeToString(cid),
+				"decode_error": decodeErr.Error(),
+			}
+			continue
+		}
+
+		testResults[fmt.Sprintf("backend_%d", backendID)] = map[string]interface{}{
+			"backend_url":          backend.URL.Redacted(),
+			"cid_hex":              hex.EncodeToString(cid),
+			"cid_length":           len(cid),
+			"decoded_backend_id":   decodedCID.BackendID,
+			"config_rotation_bits": decodedCID.ConfigRotationBits,
+			"algorithm":            decodedCID.Algorithm,
+			"valid":                decodedCID.Valid,
+		}
+	}
+
+	response := map[string]interface{}{
+		"test_description": "QUIC-LB Connection ID Generation and Decoding Test",
+		"results":          testResults,
+		"timestamp":        time.Now(),
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleAlgorithm reports or changes the default pool algorithm
+func (s *Server) handleAlgorithm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" {
+		var req struct {
+			Algorithm string `json:"algorithm"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Simplified algorithms only
+		validAlgorithms := []string{
+			"round-robin", "weighted-round-robin", "least-connections",
+		}
+
+		for _, alg := range validAlgorithms {
+			if req.Algorithm == alg {
+				s.defaultPool().SetAlgorithm(req.Algorithm)
+				log.Printf("🔄 Algorithm changed to: %s", req.Algorithm)
+				break
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"algorithm": s.defaultPool().Algorithm(),
+		"available": []string{
+			"round-robin", "weighted-round-robin", "least-connections",
+		},
+	})
+}
+
+// handleTest echoes the load balancing headers set for the request
+func (s *Server) handleTest(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Proto
+	if r.Proto == "HTTP/3.0" {
+		protocol = "HTTP/3.0 🚀"
+	}
+
+	connInfo := s.conns.getConnections()
+	connID := w.Header().Get("X-Connection-ID")
+
+	response := map[string]interface{}{
+		"protocol":           protocol,
+		"method":             r.Method,
+		"remote_addr":        r.RemoteAddr,
+		"connection_id":      connID,
+		"backend_id":         w.Header().Get("X-Backend-ID"),
+		"backend_url":        w.Header().Get("X-Backend-URL"),
+		"lb_algorithm":       w.Header().Get("X-LB-Algorithm"),
+		"health_score":       w.Header().Get("X-Health-Score"),
+		"circuit_breaker":    w.Header().Get("X-Circuit-Breaker"),
+		"session_key":        w.Header().Get("X-Session-Key"),
+		"routing_method":     w.Header().Get("X-Routing-Method"),
+		"quic_lb_compliant":  w.Header().Get("X-QUIC-LB-Compliant"),
+		"quic_lb_draft":      w.Header().Get("X-QUIC-LB-Draft"),
+		"quic_connection_id": w.Header().Get("X-Quic-Connection-Id"),
+		"active_connections": len(connInfo),
+		"migration_support":  "enhanced",
+		"path_validation":    "enabled",
+		"features":           []string{"basic-health-checks", "session-affinity", "quic-lb-draft-20"},
+		"ietf_compliance":    "QUIC-LB Draft 20",
+		"timestamp":          time.Now(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleSimulateMigration records a fake address change on HTTP/3
+func (s *Server) handleSimulateMigration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	currentConnID := w.Header().Get("X-Connection-ID")
+	currentRemoteAddr := r.RemoteAddr
+
+	simulateParam := r.URL.Query().Get("simulate")
+	if simulateParam == "true" && r.Proto == "HTTP/3.0" {
+		simulatedNewAddr := "127.0.0.2:12345"
+		s.conns.trackConnection(currentConnID, extractQuicConnectionID(r), simulatedNewAddr, r.Host, r)
+
+		log.Printf("🔄 Simulated enhanced migration for connection %s: %s -> %s",
+			currentConnID, currentRemoteAddr, simulatedNewAddr)
+	}
+
+	response := map[string]interface{}{
+		"message":       "Enhanced migration test endpoint",
+		"protocol":      r.Proto,
+		"timestamp":     time.Now(),
+		"connection_id": currentConnID,
+		"remote_addr":   currentRemoteAddr,
+		"instructions":  "Add ?simulate=true to manually create a migration event",
+		"features":      "Enhanced migration with path validation and timing",
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
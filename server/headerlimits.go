@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Header limit defaults
+const (
+	defaultMaxHeaderCount      = 100
+	defaultMaxHeaderFieldSize  = 16 << 10
+	defaultMaxHeaderTotalBytes = 64 << 10
+)
+
+// HeaderLimitsConfig bounds request headers. The total is also handed to
+// the protocol stacks (MaxHeaderBytes for HTTP/1.1 and HTTP/2, the
+// advertised field section size for HTTP/3), so oversized headers are
+// refused while they are read rather than after they were buffered; count
+// and field size are checked once the request is parsed. Requests over a
+// limit get 431.
+type HeaderLimitsConfig struct {
+	MaxCount      int `json:"max_count,omitempty"`       // Header lines per request, default 100
+	MaxFieldSize  int `json:"max_field_size,omitempty"`  // Bytes of one header line, name and value, default 16 KiB
+	MaxTotalBytes int `json:"max_total_bytes,omitempty"` // Bytes of all header lines, default 64 KiB; applied to the listeners at startup
+}
+
+// validate checks the header limit settings
+func (hc *HeaderLimitsConfig) validate() []error {
+	var errs []error
+	if hc.MaxCount < 0 || hc.MaxFieldSize < 0 || hc.MaxTotalBytes < 0 {
+		errs = append(errs, fmt.Errorf("header_limits values must not be negative"))
+	}
+	if hc.MaxFieldSize > 0 && hc.maxTotalBytes() < hc.MaxFieldSize {
+		errs = append(errs, fmt.Errorf("header_limits.max_field_size %d exceeds max_total_bytes %d", hc.MaxFieldSize, hc.maxTotalBytes()))
+	}
+	return errs
+}
+
+// maxCount returns the configured header count limit or its default
+func (hc *HeaderLimitsConfig) maxCount() int {
+	if hc.MaxCount == 0 {
+		return defaultMaxHeaderCount
+	}
+	return hc.MaxCount
+}
+
+// maxFieldSize returns the configured header line limit or its default
+func (hc *HeaderLimitsConfig) maxFieldSize() int {
+	if hc.MaxFieldSize == 0 {
+		return defaultMaxHeaderFieldSize
+	}
+	return hc.MaxFieldSize
+}
+
+// maxTotalBytes returns the configured header section limit or its default
+func (hc *HeaderLimitsConfig) maxTotalBytes() int {
+	if hc.MaxTotalBytes == 0 {
+		return defaultMaxHeaderTotalBytes
+	}
+	return hc.MaxTotalBytes
+}
+
+// configureServer limits the header bytes a TCP server reads per request
+func (hc *HeaderLimitsConfig) configureServer(srv *http.Server) {
+	srv.MaxHeaderBytes = hc.maxTotalBytes()
+}
+
+// configureHTTP3 limits the field section size the HTTP/3 server accepts
+// and advertises; a smaller qpack.max_field_section_size still wins
+func (hc *HeaderLimitsConfig) configureHTTP3(h3Server *http3.Server) {
+	if h3Server.MaxHeaderBytes <= 0 || h3Server.MaxHeaderBytes > hc.maxTotalBytes() {
+		h3Server.MaxHeaderBytes = hc.maxTotalBytes()
+	}
+}
+
+// HeaderLimits refuses requests with too many or too large headers and
+// counts them
+type HeaderLimits struct {
+	mu       sync.Mutex
+	cfg      HeaderLimitsConfig
+	rejected map[string]int64 // reason -> requests
+	largest  int              // largest header section accepted
+}
+
+// NewHeaderLimits creates header limits with the defaults
+func NewHeaderLimits() *HeaderLimits {
+	return &HeaderLimits{rejected: make(map[string]int64)}
+}
+
+// Configure applies new settings; max_total_bytes only reaches the
+// listeners on restart
+func (hl *HeaderLimits) Configure(cfg HeaderLimitsConfig) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	hl.cfg = cfg
+}
+
+// check answers requests over a limit with 431 and reports whether r may proceed.
+// Lines are counted as sent over HTTP/1.1, "Name: value\r\n".
+func (hl *HeaderLimits) check(w http.ResponseWriter, r *http.Request) bool {
+	hl.mu.Lock()
+	cfg := hl.cfg
+	hl.mu.Unlock()
+
+	var reason, detail string
+	count, total := 0, 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			size := len(name) + len(value) + len(": \r\n")
+			count++
+			total += size
+			if size > cfg.maxFieldSize() && reason == "" {
+				reason, detail = "field_too_large", name+" "+strconv.Itoa(size)+" bytes"
+			}
+		}
+	}
+	switch {
+	case reason != "":
+	case count > cfg.maxCount():
+		reason, detail = "too_many_headers", strconv.Itoa(count)+" headers"
+	case total > cfg.maxTotalBytes():
+		reason, detail = "headers_too_large", strconv.Itoa(total)+" bytes"
+	}
+
+	hl.mu.Lock()
+	if reason == "" {
+		if total > hl.largest {
+			hl.largest = total
+		}
+		hl.mu.Unlock()
+		return true
+	}
+	hl.rejected[reason]++
+	hl.mu.Unlock()
+
+	log.Printf("📏 Rejected %s request from %s: %s (%s)", r.Proto, r.RemoteAddr, strings.ReplaceAll(reason, "_", " "), detail)
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
+	http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+	return false
+}
+
+// Snapshot reports the limits and the rejected requests per reason
+func (hl *HeaderLimits) Snapshot() map[string]interface{} {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	rejected := make(map[string]int64, len(hl.rejected))
+	var total int64
+	for reason, n := range hl.rejected {
+		rejected[reason] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"max_count":             hl.cfg.maxCount(),
+		"max_field_size":        hl.cfg.maxFieldSize(),
+		"max_total_bytes":       hl.cfg.maxTotalBytes(),
+		"rejected":              rejected,
+		"rejected_total":        total,
+		"largest_section_bytes": hl.largest,
+	}
+}
+
+// handleHeaderLimits serves GET /api/header-limits with the limits and the
+// requests refused with 431
+func (s *Server) handleHeaderLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.headerLimits.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
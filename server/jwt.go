@@ -0,0 +1,472 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"quic-moodle/balancer"
+)
+
+// JWT validation defaults
+const (
+	defaultJWTClockSkew       = time.Minute
+	defaultJWKSRefresh        = 10 * time.Minute
+	jwksMinRefetch            = 30 * time.Second // unknown key IDs refetch the JWKS at most this often
+	jwksFetchTimeout          = 10 * time.Second
+	jwksMaxSize         int64 = 1 << 20
+)
+
+// defaultJWTAlgorithms are the asymmetric algorithms accepted when none are
+// configured; symmetric ones make no sense with a public JWKS
+var defaultJWTAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JWTConfig validates bearer tokens on routes with require_jwt against the
+// keys published by an identity provider. Requests without a valid token
+// get 401 at the edge; verified claims are forwarded to backends as headers.
+type JWTConfig struct {
+	JWKSURL         string            `json:"jwks_url,omitempty"`         // Identity provider's JSON Web Key Set
+	Issuer          string            `json:"issuer,omitempty"`           // Required "iss" claim
+	Audiences       []string          `json:"audiences,omitempty"`        // The "aud" claim must name one of these
+	Algorithms      []string          `json:"algorithms,omitempty"`       // Accepted signature algorithms, default the RSA, ECDSA and EdDSA ones
+	ClockSkew       balancer.Duration `json:"clock_skew,omitempty"`       // Leeway for exp, nbf and iat, default 1m
+	RefreshInterval balancer.Duration `json:"refresh_interval,omitempty"` // How often the JWKS is fetched again, default 10m
+	ClaimHeaders    map[string]string `json:"claim_headers,omitempty"`    // Claim -> request header for backends, default {"sub": "X-JWT-Subject"}
+}
+
+// validate checks the JWT settings
+func (jc *JWTConfig) validate() []error {
+	var errs []error
+	if jc.JWKSURL != "" {
+		if u, err := url.Parse(jc.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("jwt.jwks_url %q must be an http or https URL", jc.JWKSURL))
+		}
+	}
+	for i, alg := range jc.Algorithms {
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") && !strings.HasPrefix(alg, "ES") && alg != "EdDSA" {
+			errs = append(errs, fmt.Errorf("jwt.algorithms[%d] %q is not an asymmetric JWS algorithm", i, alg))
+		}
+	}
+	if jc.ClockSkew < 0 || jc.RefreshInterval < 0 {
+		errs = append(errs, fmt.Errorf("jwt durations must not be negative"))
+	}
+	for claim, header := range jc.ClaimHeaders {
+		if claim == "" || header == "" || strings.ContainsAny(header, " :\r\n") {
+			errs = append(errs, fmt.Errorf("jwt.claim_headers %q: %q is not a valid header name", claim, header))
+		}
+	}
+	return errs
+}
+
+// clockSkew returns the configured leeway or its default
+func (jc *JWTConfig) clockSkew() time.Duration {
+	if jc.ClockSkew == 0 {
+		return defaultJWTClockSkew
+	}
+	return jc.ClockSkew.Duration()
+}
+
+// refreshInterval returns the configured JWKS refresh interval or its default
+func (jc *JWTConfig) refreshInterval() time.Duration {
+	if jc.RefreshInterval == 0 {
+		return defaultJWKSRefresh
+	}
+	return max(jc.RefreshInterval.Duration(), jwksMinRefetch)
+}
+
+// algorithms returns the accepted signature algorithms
+func (jc *JWTConfig) algorithms() []jose.SignatureAlgorithm {
+	names := jc.Algorithms
+	if len(names) == 0 {
+		names = defaultJWTAlgorithms
+	}
+	algs := make([]jose.SignatureAlgorithm, len(names))
+	for i, name := range names {
+		algs[i] = jose.SignatureAlgorithm(name)
+	}
+	return algs
+}
+
+// claimHeaders returns the configured claim headers or the default
+func (jc *JWTConfig) claimHeaders() map[string]string {
+	if len(jc.ClaimHeaders) == 0 {
+		return map[string]string{"sub": "X-JWT-Subject"}
+	}
+	return jc.ClaimHeaders
+}
+
+// jwtContextKey carries a request's verified claims
+type jwtContextKey struct{}
+
+// JWTValidator checks bearer tokens against a JWKS it keeps up to date
+type JWTValidator struct {
+	client *http.Client
+
+	mu         sync.RWMutex
+	cfg        JWTConfig
+	keys       *jose.JSONWebKeySet
+	fetchedAt  time.Time
+	fetchErr   error
+	generation int // bumped on Configure so a stale refresh loop stops
+
+	fetchMu   sync.Mutex // one JWKS fetch at a time
+	lastFetch time.Time
+
+	statsMu  sync.Mutex
+	verified int64
+	rejected map[string]int64 // reason -> requests
+	fetches  int64
+	failures int64
+}
+
+// NewJWTValidator creates a validator without keys
+func NewJWTValidator() *JWTValidator {
+	return &JWTValidator{
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+		rejected: make(map[string]int64),
+	}
+}
+
+// Configure applies new settings and, when the JWKS URL changed, fetches
+// the keys in the background and keeps refreshing them until ctx is done
+func (jv *JWTValidator) Configure(ctx context.Context, cfg JWTConfig) {
+	jv.mu.Lock()
+	urlChanged := cfg.JWKSURL != jv.cfg.JWKSURL
+	intervalChanged := cfg.refreshInterval() != jv.cfg.refreshInterval()
+	jv.cfg = cfg
+	if urlChanged {
+		jv.keys, jv.fetchedAt, jv.fetchErr = nil, time.Time{}, nil
+	}
+	if urlChanged || intervalChanged {
+		jv.generation++
+	}
+	generation := jv.generation
+	jv.mu.Unlock()
+
+	if cfg.JWKSURL != "" && (urlChanged || intervalChanged) {
+		go jv.refreshLoop(ctx, generation, cfg.refreshInterval())
+	}
+}
+
+// refreshLoop fetches the JWKS now and then every interval until ctx is
+// done or a newer configuration replaced the loop
+func (jv *JWTValidator) refreshLoop(ctx context.Context, generation int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		jv.mu.RLock()
+		current := jv.generation == generation
+		jv.mu.RUnlock()
+		if !current {
+			return
+		}
+		jv.fetch(ctx, false)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch downloads the JWKS; onDemand fetches, for a token with an unknown
+// key ID, are skipped when the keys were fetched moments ago
+func (jv *JWTValidator) fetch(ctx context.Context, onDemand bool) {
+	jv.fetchMu.Lock()
+	defer jv.fetchMu.Unlock()
+	if onDemand && time.Since(jv.lastFetch) < jwksMinRefetch {
+		return
+	}
+	jv.lastFetch = time.Now()
+
+	jv.mu.RLock()
+	jwksURL := jv.cfg.JWKSURL
+	jv.mu.RUnlock()
+	if jwksURL == "" {
+		return
+	}
+
+	keys, err := jv.download(ctx, jwksURL)
+	jv.statsMu.Lock()
+	jv.fetches++
+	if err != nil {
+		jv.failures++
+	}
+	jv.statsMu.Unlock()
+
+	jv.mu.Lock()
+	defer jv.mu.Unlock()
+	if jv.cfg.JWKSURL != jwksURL {
+		return
+	}
+	if err != nil {
+		// Keys fetched before stay in use until the provider is reachable again
+		jv.fetchErr = err
+		log.Printf("⚠️ JWKS %s not refreshed: %v", jwksURL, err)
+		return
+	}
+	if jv.keys == nil || len(jv.keys.Keys) != len(keys.Keys) || jv.fetchErr != nil {
+		log.Printf("🔑 JWKS %s loaded (%d keys)", jwksURL, len(keys.Keys))
+	}
+	jv.keys, jv.fetchedAt, jv.fetchErr = keys, time.Now(), nil
+}
+
+// download fetches and parses a JWKS
+func (jv *JWTValidator) download(ctx context.Context, jwksURL string) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := jv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no keys")
+	}
+	return &keys, nil
+}
+
+// key returns the verification key with the given ID
+func (jv *JWTValidator) key(kid string) (interface{}, bool) {
+	jv.mu.RLock()
+	defer jv.mu.RUnlock()
+	if jv.keys == nil {
+		return nil, false
+	}
+	for _, key := range jv.keys.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		// Providers with a single key often leave out key IDs
+		if key.KeyID == kid || (kid == "" && len(jv.keys.Keys) == 1) {
+			return key.Key, true
+		}
+	}
+	return nil, false
+}
+
+// jwtError is a rejected token's reason for the counters and its
+// description for the WWW-Authenticate header
+type jwtError struct {
+	reason      string
+	description string
+}
+
+// verify checks the token and returns its claims
+func (jv *JWTValidator) verify(ctx context.Context, token string) (map[string]interface{}, *jwtError) {
+	jv.mu.RLock()
+	cfg := jv.cfg
+	jv.mu.RUnlock()
+
+	parsed, err := jwt.ParseSigned(token, cfg.algorithms())
+	if err != nil {
+		return nil, &jwtError{"malformed", "malformed token or unsupported algorithm"}
+	}
+	kid := parsed.Headers[0].KeyID
+	key, ok := jv.key(kid)
+	if !ok {
+		// The provider may have rotated its keys since the last refresh
+		jv.fetch(ctx, true)
+		if key, ok = jv.key(kid); !ok {
+			return nil, &jwtError{"unknown_key", fmt.Sprintf("unknown signing key %q", kid)}
+		}
+	}
+
+	var registered jwt.Claims
+	claims := make(map[string]interface{})
+	if err := parsed.Claims(key, &registered, &claims); err != nil {
+		return nil, &jwtError{"bad_signature", "invalid signature"}
+	}
+	if registered.Expiry == nil {
+		return nil, &jwtError{"no_expiry", "token has no exp claim"}
+	}
+	expected := jwt.Expected{Issuer: cfg.Issuer, AnyAudience: cfg.Audiences, Time: time.Now()}
+	if err := registered.ValidateWithLeeway(expected, cfg.clockSkew()); err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrExpired):
+			return nil, &jwtError{"expired", "token expired"}
+		case errors.Is(err, jwt.ErrNotValidYet), errors.Is(err, jwt.ErrIssuedInTheFuture):
+			return nil, &jwtError{"not_yet_valid", "token not valid yet"}
+		case errors.Is(err, jwt.ErrInvalidIssuer):
+			return nil, &jwtError{"issuer", "unexpected issuer"}
+		case errors.Is(err, jwt.ErrInvalidAudience):
+			return nil, &jwtError{"audience", "unexpected audience"}
+		}
+		return nil, &jwtError{"invalid", err.Error()}
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticate checks the bearer token of a request to a route with
+// require_jwt, answering invalid ones with 401 (RFC 6750). The verified
+// claims are stored in the returned request's context.
+func (jv *JWTValidator) authenticate(w http.ResponseWriter, r *http.Request, match RouteMatch) (*http.Request, bool) {
+	if !match.RequireJWT {
+		return r, true
+	}
+
+	token, ok := bearerToken(r)
+	var failure *jwtError
+	var claims map[string]interface{}
+	if !ok {
+		failure = &jwtError{reason: "missing"}
+	} else {
+		claims, failure = jv.verify(r.Context(), token)
+	}
+
+	jv.statsMu.Lock()
+	if failure == nil {
+		jv.verified++
+	} else {
+		jv.rejected[failure.reason]++
+	}
+	jv.statsMu.Unlock()
+
+	if failure == nil {
+		return r.WithContext(context.WithValue(r.Context(), jwtContextKey{}, claims)), true
+	}
+	challenge, why := `Bearer realm="quic-lb"`, "no bearer token"
+	if failure.description != "" {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, failure.description)
+		why = failure.description
+	}
+	log.Printf("🎫 Rejected %s %s from %s: %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, why, match.Reason)
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "🚫 Valid bearer token required", http.StatusUnauthorized)
+	return r, false
+}
+
+// setJWTHeaders replaces the claim headers on a request about to be
+// proxied with the verified claims, and always drops client-sent ones
+func (jv *JWTValidator) setJWTHeaders(r *http.Request) {
+	jv.mu.RLock()
+	headers := jv.cfg.claimHeaders()
+	jv.mu.RUnlock()
+
+	for _, name := range headers {
+		r.Header.Del(name)
+	}
+	claims, ok := r.Context().Value(jwtContextKey{}).(map[string]interface{})
+	if !ok {
+		return
+	}
+	for claim, name := range headers {
+		if value, ok := claimValue(claims[claim]); ok {
+			r.Header.Set(name, value)
+		}
+	}
+}
+
+// claimValue formats a claim for a header: strings and numbers as they are,
+// arrays of them comma separated, objects as JSON
+func claimValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if value, ok := claimValue(item); ok {
+				values = append(values, value)
+			}
+		}
+		return strings.Join(values, ","), len(values) > 0
+	}
+	data, err := json.Marshal(v)
+	return string(data), err == nil
+}
+
+// Snapshot reports the loaded keys and verification counts
+func (jv *JWTValidator) Snapshot() map[string]interface{} {
+	jv.mu.RLock()
+	cfg := jv.cfg
+	var keyIDs []string
+	if jv.keys != nil {
+		for _, key := range jv.keys.Keys {
+			keyIDs = append(keyIDs, key.KeyID)
+		}
+	}
+	fetchedAt, fetchErr := jv.fetchedAt, jv.fetchErr
+	jv.mu.RUnlock()
+	sort.Strings(keyIDs)
+
+	jv.statsMu.Lock()
+	defer jv.statsMu.Unlock()
+	rejected := make(map[string]int64, len(jv.rejected))
+	for reason, n := range jv.rejected {
+		rejected[reason] = n
+	}
+	stats := map[string]interface{}{
+		"jwks_url":       cfg.JWKSURL,
+		"issuer":         cfg.Issuer,
+		"audiences":      cfg.Audiences,
+		"key_ids":        keyIDs,
+		"claim_headers":  cfg.claimHeaders(),
+		"verified":       jv.verified,
+		"rejected":       rejected,
+		"jwks_fetches":   jv.fetches,
+		"jwks_failures":  jv.failures,
+		"clock_skew":     cfg.clockSkew().String(),
+		"refresh_period": cfg.refreshInterval().String(),
+	}
+	if !fetchedAt.IsZero() {
+		stats["jwks_fetched_at"] = fetchedAt
+	}
+	if fetchErr != nil {
+		stats["jwks_error"] = fetchErr.Error()
+	}
+	return stats
+}
+
+// handleJWT serves GET /api/jwt with the JWKS state and verification counts
+func (s *Server) handleJWT(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.jwt.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// newTestJWT returns a validator trusting a JWKS with one ES256 key, and a
+// function signing claims with that key
+func newTestJWT(t *testing.T, cfg JWTConfig) (*JWTValidator, func(claims map[string]interface{}) string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: "ES256", Use: "sig"}}}
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(provider.Close)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: "k1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims map[string]interface{}) string {
+		token, err := jwt.Signed(signer).Claims(claims).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	cfg.JWKSURL = provider.URL
+	jv := NewJWTValidator()
+	jv.Configure(t.Context(), cfg)
+	return jv, sign
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	jv, sign := newTestJWT(t, JWTConfig{Issuer: "https://idp.example", Audiences: []string{"moodle"}})
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://idp.example", "aud": "moodle", "sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		reason        string
+	}{
+		{"valid", "Bearer " + sign(claims(nil)), ""},
+		{"lower-case scheme", "bearer " + sign(claims(nil)), ""},
+		{"missing", "", "missing"},
+		{"basic credentials", "Basic YWxpY2U6c2VjcmV0", "missing"},
+		{"malformed", "Bearer not.a.token", "malformed"},
+		{"expired", "Bearer " + sign(claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), "expired"},
+		{"within clock skew", "Bearer " + sign(claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), ""},
+		{"no expiry", "Bearer " + sign(claims(map[string]interface{}{"exp": nil})), "no_expiry"},
+		{"not yet valid", "Bearer " + sign(claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), "not_yet_valid"},
+		{"other issuer", "Bearer " + sign(claims(map[string]interface{}{"iss": "https://evil.example"})), "issuer"},
+		{"other audience", "Bearer " + sign(claims(map[string]interface{}{"aud": "grades"})), "audience"},
+		{"tampered", "Bearer " + tamper(sign(claims(nil))), "bad_signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/webservice/rest/server.php", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			_, ok := jv.authenticate(w, r, RouteMatch{RequireJWT: true})
+			if ok != (tt.reason == "") {
+				t.Fatalf("allowed %v, want rejection %q", ok, tt.reason)
+			}
+			if ok {
+				return
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if w.Code != http.StatusUnauthorized || !strings.HasPrefix(challenge, `Bearer realm="quic-lb"`) {
+				t.Errorf("answered %d with WWW-Authenticate %q, want 401 and a Bearer challenge", w.Code, challenge)
+			}
+			if invalid := strings.Contains(challenge, `error="invalid_token"`); invalid != (tt.reason != "missing") {
+				t.Errorf("WWW-Authenticate %q for %s", challenge, tt.reason)
+			}
+			if n := jv.Snapshot()["rejected"].(map[string]int64)[tt.reason]; n == 0 {
+				t.Errorf("rejection %q not counted", tt.reason)
+			}
+		})
+	}
+}
+
+// tamper changes the token's subject while keeping its signature
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = bytes.Replace(payload, []byte(`"alice"`), []byte(`"admin"`), 1)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+// Symmetric tokens signed with the public key are refused
+func TestJWTRejectsUnlistedAlgorithm(t *testing.T) {
+	jv, _ := newTestJWT(t, JWTConfig{})
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failure := jv.verify(t.Context(), token); failure == nil || failure.reason != "malformed" {
+		t.Errorf("HS256 token: %+v, want malformed", failure)
+	}
+}
+
+// Verified claims replace client-sent claim headers for the backend
+func TestJWTClaimHeaders(t *testing.T) {
+	jv, sign := newTestJWT(t, JWTConfig{ClaimHeaders: map[string]string{"sub": "X-JWT-Subject", "roles": "X-JWT-Roles"}})
+	token := sign(map[string]interface{}{"sub": "alice", "roles": []string{"teacher", "manager"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("X-JWT-Subject", "admin")
+	authed, ok := jv.authenticate(httptest.NewRecorder(), r, RouteMatch{RequireJWT: true})
+	if !ok {
+		t.Fatal("valid token refused")
+	}
+	jv.setJWTHeaders(authed)
+	if sub, roles := authed.Header.Get("X-JWT-Subject"), authed.Header.Get("X-JWT-Roles"); sub != "alice" || roles != "teacher,manager" {
+		t.Errorf("backend sees subject %q and roles %q, want alice and teacher,manager", sub, roles)
+	}
+
+	// Requests on routes without require_jwt cannot set claim headers either
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-JWT-Subject", "admin")
+	jv.setJWTHeaders(r)
+	if got := r.Header.Get("X-JWT-Subject"); got != "" {
+		t.Errorf("client-sent X-JWT-Subject %q reaches the backend", got)
+	}
+}
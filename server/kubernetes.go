@@ -0,0 +1,635 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Custom resources watched in controller mode, see deploy/kubernetes
+const (
+	kubeGroup          = "lb.quic-moodle.io"
+	kubeVersion        = "v1alpha1"
+	kubeQUICLBConfigs  = "quiclbconfigs"
+	kubeBackendPools   = "backendpools"
+	kubeRoutes         = "quiclbroutes"
+	kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	// kubeSettle is how long changes are collected before the merged
+	// configuration is applied, so a GitOps sync of many resources is
+	// applied once
+	kubeSettle = 500 * time.Millisecond
+	// kubeWatchTimeout makes the API server end watches now and then; the
+	// watch is resumed from the last resource version
+	kubeWatchTimeout = 5 * time.Minute
+	kubeRetryMax     = 30 * time.Second
+)
+
+// kubeResources lists the watched resources in the order they are merged
+var kubeResources = []string{kubeQUICLBConfigs, kubeBackendPools, kubeRoutes}
+
+// KubernetesConfig turns on controller mode: QUICLBConfig, BackendPool and
+// QUICLBRoute custom resources in one namespace are watched and merged over
+// this configuration. BackendPool resources replace file pools of the same
+// name, QUICLBRoute resources are checked before the file routes, and a
+// QUICLBConfig replaces the quic_lb section; a new config_rotation_bits
+// rotates as an admin change would. Resources are applied, not written to
+// the config file.
+type KubernetesConfig struct {
+	Enabled   bool   `json:"enabled"`              // Watch the custom resources
+	Namespace string `json:"namespace,omitempty"`  // Namespace watched, default the pod's own
+	APIServer string `json:"api_server,omitempty"` // Default the in-cluster https://$KUBERNETES_SERVICE_HOST:$KUBERNETES_SERVICE_PORT
+	TokenFile string `json:"token_file,omitempty"` // Bearer token, re-read for every request; default the service account token
+	CAFile    string `json:"ca_file,omitempty"`    // API server CA bundle, default the service account CA
+}
+
+// validate checks the controller mode settings
+func (kc *KubernetesConfig) validate() []error {
+	var errs []error
+	if !kc.Enabled {
+		return errs
+	}
+	if kc.APIServer != "" {
+		if u, err := url.Parse(kc.APIServer); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("kubernetes.api_server %q must be an https URL", kc.APIServer))
+		}
+	} else if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		errs = append(errs, fmt.Errorf("kubernetes.api_server is required outside a cluster"))
+	}
+	return errs
+}
+
+// apiServer returns the configured API server or the in-cluster one
+func (kc *KubernetesConfig) apiServer() string {
+	if kc.APIServer != "" {
+		return strings.TrimSuffix(kc.APIServer, "/")
+	}
+	return "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+}
+
+// namespace returns the configured namespace or the pod's own
+func (kc *KubernetesConfig) namespace() (string, error) {
+	if kc.Namespace != "" {
+		return kc.Namespace, nil
+	}
+	data, err := os.ReadFile(kubeServiceAccount + "namespace")
+	if err != nil {
+		return "", fmt.Errorf("kubernetes.namespace not set and the pod namespace is unknown: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// tokenFile returns the configured token file or the service account token
+func (kc *KubernetesConfig) tokenFile() string {
+	if kc.TokenFile != "" {
+		return kc.TokenFile
+	}
+	return kubeServiceAccount + "token"
+}
+
+// caFile returns the configured CA bundle or the service account CA
+func (kc *KubernetesConfig) caFile() string {
+	if kc.CAFile != "" {
+		return kc.CAFile
+	}
+	return kubeServiceAccount + "ca.crt"
+}
+
+// kubeObject is a custom resource; the spec is decoded per kind
+type kubeObject struct {
+	Metadata struct {
+		Name              string    `json:"name"`
+		ResourceVersion   string    `json:"resourceVersion"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// kubeList is the answer to a list request
+type kubeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubeObject `json:"items"`
+}
+
+// kubeEvent is one line of a watch stream
+type kubeEvent struct {
+	Type   string          `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeStatus is the object of an ERROR event
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errKubeExpired means the resource version to resume from is too old and
+// the resources are to be listed again
+var errKubeExpired = errors.New("resource version expired")
+
+// routeSpec is the spec of a QUICLBRoute; routes apply by ascending
+// priority, then by name
+type routeSpec struct {
+	Priority int `json:"priority,omitempty"`
+	RouteConfig
+}
+
+// kubeResourceState is what is known of one watched resource
+type kubeResourceState struct {
+	objects         map[string]kubeObject // name -> object
+	resourceVersion string
+	synced          bool // listed at least once
+	events          int64
+	lastErr         string
+}
+
+// KubernetesController watches the custom resources and applies them
+type KubernetesController struct {
+	mu        sync.Mutex
+	namespace string // empty while controller mode is off
+	resources map[string]*kubeResourceState
+	changed   chan struct{}
+
+	managedPools []string      // pools last applied from resources
+	routes       []RouteConfig // routes last applied from resources
+	applied      int64
+	lastApplied  time.Time
+	lastErr      string
+	invalid      map[string]string // "kind/name" -> why the resource is skipped
+}
+
+// NewKubernetesController creates the controller; runKubernetes starts it
+func NewKubernetesController() *KubernetesController {
+	return &KubernetesController{changed: make(chan struct{}, 1)}
+}
+
+// kubeClient makes requests to the API server with the service account
+type kubeClient struct {
+	base      string
+	tokenFile string
+	http      *http.Client
+}
+
+// newKubeClient sets up TLS to the API server from the CA bundle
+func newKubeClient(cfg KubernetesConfig) (*kubeClient, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if pem, err := os.ReadFile(cfg.caFile()); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.caFile())
+		}
+		tlsConfig.RootCAs = pool
+	} else if cfg.CAFile != "" {
+		return nil, fmt.Errorf("failed to read kubernetes.ca_file: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &kubeClient{
+		base:      cfg.apiServer(),
+		tokenFile: cfg.tokenFile(),
+		http:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// get requests path and returns the response for the caller to close
+func (kc *kubeClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kc.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	// Projected service account tokens are rotated on disk
+	if token, err := os.ReadFile(kc.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := kc.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var status kubeStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		if resp.StatusCode == http.StatusGone {
+			return nil, errKubeExpired
+		}
+		return nil, fmt.Errorf("%s: %s %s", path, resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// runKubernetes watches the custom resources until ctx is done
+func (s *Server) runKubernetes(ctx context.Context, cfg KubernetesConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	namespace, err := cfg.namespace()
+	if err != nil {
+		log.Printf("⚠️ Kubernetes controller off: %v", err)
+		return
+	}
+	client, err := newKubeClient(cfg)
+	if err != nil {
+		log.Printf("⚠️ Kubernetes controller off: %v", err)
+		return
+	}
+
+	k := s.kubernetes
+	k.mu.Lock()
+	k.namespace = namespace
+	k.resources = make(map[string]*kubeResourceState)
+	for _, resource := range kubeResources {
+		k.resources[resource] = &kubeResourceState{objects: make(map[string]kubeObject)}
+	}
+	k.mu.Unlock()
+	log.Printf("☸️ Kubernetes controller watching %s in namespace %q", kubeGroup, namespace)
+
+	var wg sync.WaitGroup
+	for _, resource := range kubeResources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k.watch(ctx, client, namespace, resource)
+		}()
+	}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-k.changed:
+		}
+		// Let a burst of changes settle
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeSettle):
+		}
+		s.reconcileKubernetes()
+	}
+}
+
+// watch lists resource and follows its changes, listing again when the
+// watch cannot be resumed
+func (k *KubernetesController) watch(ctx context.Context, client *kubeClient, namespace, resource string) {
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", kubeGroup, kubeVersion, url.PathEscape(namespace), resource)
+	backoff := time.Second
+	resourceVersion := ""
+	for ctx.Err() == nil {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = k.list(ctx, client, path, resource)
+		} else {
+			resourceVersion, err = k.follow(ctx, client, path, resource, resourceVersion)
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if errors.Is(err, errKubeExpired) {
+			resourceVersion = ""
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		k.mu.Lock()
+		state := k.resources[resource]
+		// Reported once until the watch recovers
+		if state.lastErr != err.Error() {
+			log.Printf("⚠️ Kubernetes watch of %s failed, retrying: %v", resource, err)
+		}
+		state.lastErr = err.Error()
+		k.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, kubeRetryMax)
+	}
+}
+
+// list replaces the known objects of resource with the current ones
+func (k *KubernetesController) list(ctx context.Context, client *kubeClient, path, resource string) (string, error) {
+	resp, err := client.get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list kubeList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+
+	k.mu.Lock()
+	state := k.resources[resource]
+	state.objects = make(map[string]kubeObject, len(list.Items))
+	for _, obj := range list.Items {
+		state.objects[obj.Metadata.Name] = obj
+	}
+	state.resourceVersion = list.Metadata.ResourceVersion
+	state.synced = true
+	state.lastErr = ""
+	k.mu.Unlock()
+	k.notify()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// follow applies watch events from resourceVersion on until the API
+// server ends the watch and returns the version to resume from
+func (k *KubernetesController) follow(ctx context.Context, client *kubeClient, path, resource, resourceVersion string) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(kubeWatchTimeout / time.Second))},
+	}
+	resp, err := client.get(ctx, path+"?"+query.Encode())
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event kubeEvent
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return resourceVersion, nil
+			}
+			return resourceVersion, fmt.Errorf("%s: %v", path, err)
+		}
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return "", errKubeExpired
+			}
+			return resourceVersion, fmt.Errorf("%s: watch error %d: %s", path, status.Code, status.Message)
+		}
+		var obj kubeObject
+		if err := json.Unmarshal(event.Object, &obj); err != nil {
+			return resourceVersion, fmt.Errorf("%s: %v", path, err)
+		}
+		if obj.Metadata.ResourceVersion != "" {
+			resourceVersion = obj.Metadata.ResourceVersion
+		}
+
+		k.mu.Lock()
+		state := k.resources[resource]
+		state.resourceVersion = resourceVersion
+		state.lastErr = ""
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			state.objects[obj.Metadata.Name] = obj
+			state.events++
+		case "DELETED":
+			delete(state.objects, obj.Metadata.Name)
+			state.events++
+		}
+		k.mu.Unlock()
+		if event.Type != "BOOKMARK" {
+			k.notify()
+		}
+	}
+}
+
+// notify asks for the resources to be merged and applied again
+func (k *KubernetesController) notify() {
+	select {
+	case k.changed <- struct{}{}:
+	default:
+	}
+}
+
+// kubeDesired is the configuration the resources describe
+type kubeDesired struct {
+	quicLB  *QUICLBSettings
+	pools   []PoolConfig
+	routes  []RouteConfig
+	invalid map[string]string
+}
+
+// desired decodes the known resources; nil until every resource was listed
+func (k *KubernetesController) desired() *kubeDesired {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, state := range k.resources {
+		if !state.synced {
+			return nil
+		}
+	}
+
+	d := &kubeDesired{invalid: make(map[string]string)}
+	decode := func(resource string, obj kubeObject, spec interface{}) bool {
+		dec := json.NewDecoder(bytes.NewReader(obj.Spec))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(spec); err != nil {
+			d.invalid[resource+"/"+obj.Metadata.Name] = err.Error()
+			return false
+		}
+		return true
+	}
+
+	// The oldest QUICLBConfig wins; more than one is a mistake to report
+	configs := sortedObjects(k.resources[kubeQUICLBConfigs].objects)
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Metadata.CreationTimestamp.Before(configs[j].Metadata.CreationTimestamp)
+	})
+	for i, obj := range configs {
+		if i > 0 {
+			d.invalid[kubeQUICLBConfigs+"/"+obj.Metadata.Name] = fmt.Sprintf("ignored, %q is the QUICLBConfig in use", configs[0].Metadata.Name)
+			continue
+		}
+		var settings QUICLBSettings
+		if decode(kubeQUICLBConfigs, obj, &settings) {
+			d.quicLB = &settings
+		}
+	}
+
+	for _, obj := range sortedObjects(k.resources[kubeBackendPools].objects) {
+		var pool PoolConfig
+		if decode(kubeBackendPools, obj, &pool) {
+			// The resource name is the pool name routes refer to
+			pool.Name = obj.Metadata.Name
+			d.pools = append(d.pools, pool)
+		}
+	}
+
+	var routes []routeSpec
+	for _, obj := range sortedObjects(k.resources[kubeRoutes].objects) {
+		var route routeSpec
+		if decode(kubeRoutes, obj, &route) {
+			routes = append(routes, route)
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Priority < routes[j].Priority })
+	for _, route := range routes {
+		d.routes = append(d.routes, route.RouteConfig)
+	}
+	return d
+}
+
+// sortedObjects returns objects ordered by name
+func sortedObjects(objects map[string]kubeObject) []kubeObject {
+	sorted := make([]kubeObject, 0, len(objects))
+	for _, obj := range objects {
+		sorted = append(sorted, obj)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Metadata.Name < sorted[j].Metadata.Name })
+	return sorted
+}
+
+// reconcileKubernetes merges the resources over the effective configuration
+// and applies the result when it changed. An invalid merge is not applied;
+// the last valid configuration stays in effect.
+func (s *Server) reconcileKubernetes() {
+	k := s.kubernetes
+	d := k.desired()
+	if d == nil {
+		return // not every resource listed yet
+	}
+
+	current := s.config.Accepted()
+	cfg := cloneConfig(current)
+
+	k.mu.Lock()
+	managedPools, managedRoutes := k.managedPools, k.routes
+	for name, reason := range d.invalid {
+		if k.invalid[name] != reason {
+			log.Printf("⚠️ Kubernetes resource %s skipped: %s", name, reason)
+		}
+	}
+	k.invalid = d.invalid
+	k.mu.Unlock()
+
+	// Drop what resources added last time, and file entries they replace
+	replaced := make(map[string]bool)
+	for _, name := range managedPools {
+		replaced[name] = true
+	}
+	for _, pool := range d.pools {
+		replaced[pool.Name] = true
+	}
+	pools := d.pools
+	for _, pool := range cfg.Pools {
+		if !replaced[pool.Name] {
+			pools = append(pools, pool)
+		}
+	}
+	routes := d.routes
+	for _, route := range cfg.Routes {
+		if !containsRoute(managedRoutes, route) && !containsRoute(d.routes, route) {
+			routes = append(routes, route)
+		}
+	}
+	cfg.Pools, cfg.Routes = pools, routes
+	if d.quicLB != nil {
+		cfg.QUICLB = *d.quicLB
+	}
+
+	names := make([]string, 0, len(d.pools))
+	for _, pool := range d.pools {
+		names = append(names, pool.Name)
+	}
+	if reflect.DeepEqual(cfg, current) {
+		k.mu.Lock()
+		k.managedPools, k.routes = names, d.routes
+		k.mu.Unlock()
+		return
+	}
+
+	restartRequired, err := s.config.Apply(cfg, "kubernetes")
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err != nil {
+		if k.lastErr != err.Error() {
+			log.Printf("⚠️ Kubernetes resources not applied: %v", err)
+		}
+		k.lastErr = err.Error()
+		return
+	}
+	k.managedPools, k.routes = names, d.routes
+	k.applied++
+	k.lastApplied = time.Now()
+	k.lastErr = ""
+	log.Printf("☸️ Applied Kubernetes resources: %d pools, %d routes (restart required: %v)", len(d.pools), len(d.routes), restartRequired)
+}
+
+// containsRoute reports whether routes holds route
+func containsRoute(routes []RouteConfig, route RouteConfig) bool {
+	for _, r := range routes {
+		if reflect.DeepEqual(r, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot reports the watched resources and the last apply
+func (k *KubernetesController) Snapshot() map[string]interface{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	snapshot := map[string]interface{}{
+		"enabled": k.namespace != "",
+	}
+	if k.namespace == "" {
+		return snapshot
+	}
+	resources := make(map[string]interface{}, len(k.resources))
+	for name, state := range k.resources {
+		objects := make([]string, 0, len(state.objects))
+		for obj := range state.objects {
+			objects = append(objects, obj)
+		}
+		sort.Strings(objects)
+		resources[name] = map[string]interface{}{
+			"objects":          objects,
+			"synced":           state.synced,
+			"resource_version": state.resourceVersion,
+			"events":           state.events,
+			"last_error":       state.lastErr,
+		}
+	}
+	snapshot["namespace"] = k.namespace
+	snapshot["group"] = kubeGroup + "/" + kubeVersion
+	snapshot["resources"] = resources
+	snapshot["managed_pools"] = k.managedPools
+	snapshot["managed_routes"] = len(k.routes)
+	snapshot["skipped"] = k.invalid
+	snapshot["applied"] = k.applied
+	snapshot["last_error"] = k.lastErr
+	if !k.lastApplied.IsZero() {
+		snapshot["last_applied"] = k.lastApplied
+	}
+	return snapshot
+}
+
+// handleKubernetes serves GET /api/kubernetes
+func (s *Server) handleKubernetes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.kubernetes.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultLeaderLease is how long leadership lasts without being renewed
+const defaultLeaderLease = 15 * time.Second
+
+// Lease scripts act only while this instance still holds the lease, so a
+// leader that stalled past its lease cannot extend or drop a successor's
+var (
+	renewLeaseScript   = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	releaseLeaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// rotationAnnouncement is a QUIC-LB config rotation made by the leader for
+// the followers to apply. Keys travel as references each instance resolves
+// itself, never as key material.
+type rotationAnnouncement struct {
+	Epoch    int64          `json:"epoch"`
+	Settings QUICLBSettings `json:"settings"`
+	Leader   string         `json:"leader"`
+	At       time.Time      `json:"at"`
+}
+
+// leaderLease returns the configured lease or its default
+func (cc *ClusterSyncConfig) leaderLease() time.Duration {
+	if cc.LeaderLease == 0 {
+		return defaultLeaderLease
+	}
+	return time.Duration(cc.LeaderLease)
+}
+
+// mayRotate reports whether this instance may rotate the QUIC-LB config:
+// always when it runs alone, otherwise only while it leads the cluster
+func (cs *ClusterSync) mayRotate() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.instance == "" || cs.isLeader
+}
+
+// leaderName returns the instance last seen holding the lease
+func (cs *ClusterSync) leaderName() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.leader
+}
+
+// setActive records the settings of the active QUIC-LB config, which a
+// newly elected leader announces
+func (cs *ClusterSync) setActive(settings QUICLBSettings) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.active = settings
+}
+
+// announce queues a rotation made here for the followers; the sync loop
+// publishes it
+func (cs *ClusterSync) announce(settings QUICLBSettings) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.instance != "" {
+		cs.queueAnnouncement(settings)
+	}
+}
+
+// queueAnnouncement queues settings for announcement; callers hold mu
+func (cs *ClusterSync) queueAnnouncement(settings QUICLBSettings) {
+	if strings.HasPrefix(settings.KeyRef, "hex:") {
+		log.Printf("⚠️ QUIC-LB rotation to %d not announced: an inline hex key_ref would put the key in Redis; use env:, file: or cred:", settings.ConfigRotationBits)
+		return
+	}
+	cs.pendingRotation = &settings
+}
+
+// syncClusterRotation renews or seeks the leader lease, publishes a rotation
+// made here as leader and applies rotations the leader announced
+func (s *Server) syncClusterRotation(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, instance string) {
+	ctx, cancel := context.WithTimeout(ctx, clusterSyncTimeout)
+	defer cancel()
+
+	s.electLeader(ctx, client, cfg, instance)
+	s.announceRotation(ctx, client, cfg, instance)
+	s.followRotation(ctx, client, cfg)
+}
+
+// electLeader renews the lease while this instance holds it and takes it
+// when it is free. Without an answer from Redis the instance steps down,
+// since it cannot tell whether another took over.
+func (s *Server) electLeader(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, instance string) {
+	key := cfg.prefix() + "leader"
+	lease := cfg.leaderLease()
+
+	s.cluster.mu.Lock()
+	wasLeader := s.cluster.isLeader
+	s.cluster.mu.Unlock()
+
+	var leading bool
+	var err error
+	if wasLeader {
+		var renewed int64
+		renewed, err = renewLeaseScript.Run(ctx, client, []string{key}, instance, lease.Milliseconds()).Int64()
+		leading = err == nil && renewed == 1
+	}
+	if !leading && err == nil {
+		leading, err = client.SetNX(ctx, key, instance, lease).Result()
+	}
+	holder := ""
+	if leading {
+		holder = instance
+	} else if err == nil {
+		if holder, err = client.Get(ctx, key).Result(); errors.Is(err, redis.Nil) {
+			holder, err = "", nil
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return // shutting down
+	}
+
+	s.cluster.mu.Lock()
+	s.cluster.isLeader = leading
+	s.cluster.leader = holder
+	if leading && !wasLeader {
+		s.cluster.newlyElected = true
+	}
+	s.cluster.mu.Unlock()
+
+	switch {
+	case leading && !wasLeader:
+		log.Printf("🗳️ %q leads the cluster and coordinates QUIC-LB rotations", instance)
+	case !leading && wasLeader && err != nil:
+		log.Printf("🗳️ %q stepped down, Redis did not confirm the lease: %v", instance, err)
+	case !leading && wasLeader:
+		log.Printf("🗳️ %q lost the lease to %q", instance, holder)
+	}
+}
+
+// announceRotation publishes the rotation made here while leading. A newly
+// elected leader announces its active config when the last announcement
+// differs, so its config is the one the cluster follows.
+func (s *Server) announceRotation(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, instance string) {
+	s.cluster.mu.Lock()
+	newlyElected := s.cluster.newlyElected
+	s.cluster.newlyElected = false
+	s.cluster.mu.Unlock()
+	if newlyElected {
+		latest, err := readRotation(ctx, client, cfg)
+		s.cluster.mu.Lock()
+		if err == nil && (latest == nil || latest.Settings != s.cluster.active) && s.cluster.pendingRotation == nil {
+			s.cluster.queueAnnouncement(s.cluster.active)
+		} else if latest != nil {
+			s.cluster.rotationEpoch = max(s.cluster.rotationEpoch, latest.Epoch)
+		}
+		s.cluster.mu.Unlock()
+	}
+
+	s.cluster.mu.Lock()
+	pending, leading := s.cluster.pendingRotation, s.cluster.isLeader
+	s.cluster.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	if !leading {
+		log.Printf("⚠️ QUIC-LB rotation to %d not announced: %q no longer leads the cluster", pending.ConfigRotationBits, instance)
+		s.cluster.mu.Lock()
+		s.cluster.pendingRotation = nil
+		s.cluster.mu.Unlock()
+		return
+	}
+
+	epoch, err := client.Incr(ctx, cfg.prefix()+"quic-lb:epoch").Result()
+	if err != nil {
+		log.Printf("⚠️ QUIC-LB rotation not announced yet: %v", err)
+		return
+	}
+	data, err := json.Marshal(rotationAnnouncement{Epoch: epoch, Settings: *pending, Leader: instance, At: time.Now()})
+	if err != nil {
+		return
+	}
+	if err := client.Set(ctx, cfg.prefix()+"quic-lb", data, 0).Err(); err != nil {
+		log.Printf("⚠️ QUIC-LB rotation not announced yet: %v", err)
+		return
+	}
+
+	s.cluster.mu.Lock()
+	s.cluster.pendingRotation = nil
+	s.cluster.rotationEpoch = epoch
+	s.cluster.mu.Unlock()
+	log.Printf("🗳️ Announced QUIC-LB rotation to %d as epoch %d", pending.ConfigRotationBits, epoch)
+}
+
+// readRotation returns the latest rotation announcement, nil when none
+// was made
+func readRotation(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig) (*rotationAnnouncement, error) {
+	data, err := client.Get(ctx, cfg.prefix()+"quic-lb").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ann rotationAnnouncement
+	if err := json.Unmarshal(data, &ann); err != nil {
+		return nil, fmt.Errorf("rotation announcement unreadable: %v", err)
+	}
+	return &ann, nil
+}
+
+// followRotation applies the latest announced rotation when it is newer
+// than the last one seen here
+func (s *Server) followRotation(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig) {
+	ann, err := readRotation(ctx, client, cfg)
+	if err != nil || ann == nil {
+		return // nothing announced yet, or Redis will answer next time
+	}
+
+	s.cluster.mu.Lock()
+	seen, failed := s.cluster.rotationEpoch, s.cluster.failedEpoch
+	s.cluster.mu.Unlock()
+	if ann.Epoch <= seen {
+		return
+	}
+
+	if ann.Settings.ConfigRotationBits != s.quicLB.ActiveConfigBits() {
+		if err := s.rotateQUICLBConfig(&ann.Settings); err != nil {
+			// Retried every interval, reported once
+			if ann.Epoch != failed {
+				log.Printf("⚠️ Cannot follow QUIC-LB rotation %d from %q: %v", ann.Epoch, ann.Leader, err)
+				s.cluster.mu.Lock()
+				s.cluster.failedEpoch = ann.Epoch
+				s.cluster.mu.Unlock()
+			}
+			return
+		}
+		log.Printf("🗳️ Followed QUIC-LB rotation %d from %q", ann.Epoch, ann.Leader)
+	}
+	s.cluster.mu.Lock()
+	s.cluster.rotationEpoch = ann.Epoch
+	s.cluster.mu.Unlock()
+}
+
+// releaseLeadership gives up the lease at shutdown so another instance
+// takes over without waiting for it to expire
+func (s *Server) releaseLeadership(ctx context.Context, client *redis.Client, cfg ClusterSyncConfig, instance string) {
+	s.cluster.mu.Lock()
+	leading := s.cluster.isLeader
+	s.cluster.isLeader = false
+	s.cluster.mu.Unlock()
+	if leading {
+		releaseLeaseScript.Run(ctx, client, []string{cfg.prefix() + "leader"}, instance)
+	}
+}
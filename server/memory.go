@@ -0,0 +1,367 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Memory budget defaults
+const (
+	defaultMaxTrackedConnections = 100000
+	defaultMaxSessions           = 100000
+	defaultMaxCIDEntries         = 100000
+	defaultMemoryShedPercent     = 85
+	defaultMemoryCheckInterval   = 5 * time.Second
+	// memoryRecoverPercent is how far below shed_percent usage must fall
+	// before tracking resumes, so the watchdog does not flap
+	memoryRecoverPercent = 10
+)
+
+// MemoryConfig bounds the tables that grow with client traffic and sets the
+// memory budget. Table limits evict old entries as new ones arrive. When the
+// process nears its soft memory limit (memory.limit or GOMEMLIMIT) the
+// watchdog sheds tracking detail: new connections are no longer tracked and
+// every table, including the L4 flows of udp_l4, is halved, until usage
+// recovers.
+type MemoryConfig struct {
+	MaxConnections int               `json:"max_connections,omitempty"` // Connections tracked at most, least recently seen evicted first; default 100000, -1 for no limit
+	MaxSessions    int               `json:"max_sessions,omitempty"`    // Session affinity keys per pool, default 100000, -1 for no limit
+	MaxCIDEntries  int               `json:"max_cid_entries,omitempty"` // Fallback CID mappings for unroutable CIDs, default 100000, -1 for no limit
+	Limit          int64             `json:"limit,omitempty"`           // Soft memory limit in bytes; 0 keeps GOMEMLIMIT
+	ShedPercent    int               `json:"shed_percent,omitempty"`    // Share of the memory limit at which tracking detail is shed, default 85
+	CheckInterval  balancer.Duration `json:"check_interval,omitempty"`  // How often memory use is checked, default 5s
+}
+
+// validate checks the memory settings
+func (mc *MemoryConfig) validate() []error {
+	var errs []error
+	if mc.MaxConnections < -1 || mc.MaxSessions < -1 || mc.MaxCIDEntries < -1 {
+		errs = append(errs, fmt.Errorf("memory table limits must be positive, 0 for the default or -1 for no limit"))
+	}
+	if mc.Limit < 0 {
+		errs = append(errs, fmt.Errorf("memory.limit must not be negative"))
+	}
+	if mc.ShedPercent < 0 || mc.ShedPercent > 100 || (mc.ShedPercent > 0 && mc.ShedPercent <= memoryRecoverPercent) {
+		errs = append(errs, fmt.Errorf("memory.shed_percent must be between %d and 100", memoryRecoverPercent+1))
+	}
+	if mc.CheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("memory.check_interval must not be negative"))
+	}
+	return errs
+}
+
+// tableLimit resolves a table limit: 0 means def, -1 no limit (0)
+func tableLimit(configured, def int) int {
+	switch {
+	case configured == 0:
+		return def
+	case configured < 0:
+		return 0
+	}
+	return configured
+}
+
+// maxConnections returns the tracked connection limit, 0 for none
+func (mc *MemoryConfig) maxConnections() int {
+	return tableLimit(mc.MaxConnections, defaultMaxTrackedConnections)
+}
+
+// maxSessions returns the per-pool session limit, 0 for none
+func (mc *MemoryConfig) maxSessions() int {
+	return tableLimit(mc.MaxSessions, defaultMaxSessions)
+}
+
+// maxCIDEntries returns the fallback CID table limit, 0 for none
+func (mc *MemoryConfig) maxCIDEntries() int {
+	return tableLimit(mc.MaxCIDEntries, defaultMaxCIDEntries)
+}
+
+// shedPercent returns the configured shedding threshold or its default
+func (mc *MemoryConfig) shedPercent() int {
+	if mc.ShedPercent == 0 {
+		return defaultMemoryShedPercent
+	}
+	return mc.ShedPercent
+}
+
+// checkInterval returns the configured check interval or its default
+func (mc *MemoryConfig) checkInterval() time.Duration {
+	if mc.CheckInterval == 0 {
+		return defaultMemoryCheckInterval
+	}
+	return time.Duration(mc.CheckInterval)
+}
+
+// memoryMetrics are the runtime metrics the watchdog reads; their
+// difference is the memory GOMEMLIMIT counts
+var memoryMetrics = []string{"/memory/classes/total:bytes", "/memory/classes/heap/released:bytes"}
+
+// MemoryWatchdog enforces the table limits and sheds tracking detail when
+// the process nears its soft memory limit
+type MemoryWatchdog struct {
+	envLimit int64 // GOMEMLIMIT at startup, restored when memory.limit is removed
+
+	mu         sync.Mutex
+	conns      *ConnectionTracker
+	quicLB     *balancer.QUICLB
+	pools      func() []*balancer.Pool
+	l4         *UDPForwarder
+	cfg        MemoryConfig
+	shedding   bool
+	sheds      int64
+	lastShed   time.Time
+	lastDetail string
+}
+
+// NewMemoryWatchdog creates a watchdog; it bounds nothing until attached
+func NewMemoryWatchdog() *MemoryWatchdog {
+	return &MemoryWatchdog{envLimit: debug.SetMemoryLimit(-1)}
+}
+
+// attach hands the watchdog the tables it bounds: the connection tracker,
+// the CID router's fallback table, the session tables of pools and the L4
+// flows, each holding a socket and a goroutine
+func (mw *MemoryWatchdog) attach(conns *ConnectionTracker, quicLB *balancer.QUICLB, pools func() []*balancer.Pool, l4 *UDPForwarder) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.conns, mw.quicLB, mw.pools, mw.l4 = conns, quicLB, pools, l4
+}
+
+// l4Flows returns the attached L4 forwarder
+func (mw *MemoryWatchdog) l4Flows() *UDPForwarder {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.l4
+}
+
+// tables returns the attached tables
+func (mw *MemoryWatchdog) tables() (*ConnectionTracker, *balancer.QUICLB, func() []*balancer.Pool) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.conns, mw.quicLB, mw.pools
+}
+
+// Configure applies the table limits and the memory limit at once
+func (mw *MemoryWatchdog) Configure(cfg MemoryConfig) {
+	mw.mu.Lock()
+	mw.cfg = cfg
+	mw.mu.Unlock()
+
+	limit := cfg.Limit
+	if limit == 0 {
+		limit = mw.envLimit
+	}
+	if debug.SetMemoryLimit(limit) != limit && limit != math.MaxInt64 {
+		log.Printf("🧠 Soft memory limit set to %d MiB", limit>>20)
+	}
+	mw.applyLimits(cfg)
+}
+
+// applyLimits bounds every table, including pools created since the last call
+func (mw *MemoryWatchdog) applyLimits(cfg MemoryConfig) {
+	conns, quicLB, pools := mw.tables()
+	if conns != nil {
+		conns.SetLimit(cfg.maxConnections())
+	}
+	if quicLB != nil {
+		quicLB.SetCIDTableLimit(cfg.maxCIDEntries())
+	}
+	if pools != nil {
+		for _, pool := range pools() {
+			pool.SetSessionLimit(cfg.maxSessions())
+		}
+	}
+}
+
+// run checks memory use every check interval until ctx is done
+func (mw *MemoryWatchdog) run(ctx context.Context) {
+	for {
+		mw.mu.Lock()
+		interval := mw.cfg.checkInterval()
+		mw.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			mw.check()
+		}
+	}
+}
+
+// readMemoryUsage returns the memory the Go runtime holds from the OS
+func readMemoryUsage() uint64 {
+	samples := make([]metrics.Sample, len(memoryMetrics))
+	for i, name := range memoryMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	var total, released uint64
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		total = samples[0].Value.Uint64()
+	}
+	if samples[1].Value.Kind() == metrics.KindUint64 {
+		released = samples[1].Value.Uint64()
+	}
+	return total - released
+}
+
+// check compares memory use with the soft limit, starts shedding above
+// shed_percent and stops once usage is memoryRecoverPercent below it
+func (mw *MemoryWatchdog) check() {
+	usage := readMemoryUsage()
+	limit := debug.SetMemoryLimit(-1)
+
+	mw.mu.Lock()
+	cfg := mw.cfg
+	wasShedding := mw.shedding
+	mw.mu.Unlock()
+	mw.applyLimits(cfg)
+	conns, _, _ := mw.tables()
+	if limit == math.MaxInt64 || conns == nil {
+		return // no memory limit, only the table limits apply
+	}
+
+	shedAt := uint64(limit) / 100 * uint64(cfg.shedPercent())
+	recoverAt := uint64(limit) / 100 * uint64(cfg.shedPercent()-memoryRecoverPercent)
+	switch {
+	case usage >= shedAt:
+		mw.shed(cfg, usage, uint64(limit), wasShedding)
+	case wasShedding && usage < recoverAt:
+		conns.setShedding(false)
+		mw.mu.Lock()
+		mw.shedding = false
+		mw.mu.Unlock()
+		log.Printf("🧠 Memory at %d of %d MiB, tracking new connections again", usage>>20, limit>>20)
+	}
+}
+
+// shed stops tracking new connections and halves every table, then returns
+// the freed memory to the OS
+func (mw *MemoryWatchdog) shed(cfg MemoryConfig, usage, limit uint64, alreadyShedding bool) {
+	conns, quicLB, pools := mw.tables()
+	conns.setShedding(true)
+	connections := conns.trim(conns.Len() / 2)
+
+	cids, sessions := 0, 0
+	if quicLB != nil {
+		cids = quicLB.TrimCIDTable(quicLB.CIDTableStats().Size / 2)
+	}
+	if pools != nil {
+		for _, pool := range pools() {
+			sessions += pool.TrimSessions(pool.SessionStats().Size / 2)
+		}
+	}
+	flows := 0
+	if l4 := mw.l4Flows(); l4 != nil {
+		flows = l4.trim(l4.Len() / 2)
+	}
+	debug.FreeOSMemory()
+
+	detail := fmt.Sprintf("dropped %d connections, %d sessions, %d CID mappings and %d L4 flows", connections, sessions, cids, flows)
+	mw.mu.Lock()
+	mw.shedding = true
+	mw.sheds++
+	mw.lastShed = time.Now()
+	mw.lastDetail = detail
+	mw.mu.Unlock()
+
+	if !alreadyShedding {
+		log.Printf("🧠 Memory at %d of %d MiB (%d%%), shedding tracking detail: %s", usage>>20, limit>>20, usage*100/limit, detail)
+	} else if connections+sessions+cids+flows > 0 {
+		log.Printf("🧠 Memory still at %d of %d MiB, %s", usage>>20, limit>>20, detail)
+	}
+}
+
+// Snapshot reports memory use, the limit and the size of every bounded table
+func (mw *MemoryWatchdog) Snapshot() map[string]interface{} {
+	limit := debug.SetMemoryLimit(-1)
+	mw.mu.Lock()
+	cfg := mw.cfg
+	snapshot := map[string]interface{}{
+		"usage_bytes": readMemoryUsage(),
+		"shedding":    mw.shedding,
+		"sheds":       mw.sheds,
+	}
+	if !mw.lastShed.IsZero() {
+		snapshot["last_shed"] = mw.lastShed
+		snapshot["last_shed_detail"] = mw.lastDetail
+	}
+	conns, quicLB, pools, l4 := mw.conns, mw.quicLB, mw.pools, mw.l4
+	mw.mu.Unlock()
+
+	if limit != math.MaxInt64 {
+		snapshot["limit_bytes"] = limit
+		snapshot["shed_at_bytes"] = limit / 100 * int64(cfg.shedPercent())
+	}
+	if conns != nil {
+		size, maxConns := conns.Len(), cfg.maxConnections()
+		snapshot["connections"] = map[string]interface{}{
+			"size":              size,
+			"max":               maxConns,
+			"occupancy_percent": occupancyPercent(size, maxConns),
+			"evicted":           conns.evicted.Load(),
+			"untracked":         conns.untracked.Load(),
+		}
+	}
+	if quicLB != nil {
+		snapshot["cid_table"] = tableSnapshot(quicLB.CIDTableStats())
+	}
+	if pools != nil {
+		sessions := make(map[string]interface{})
+		for _, pool := range pools() {
+			sessions[pool.Name()] = tableSnapshot(pool.SessionStats())
+		}
+		snapshot["sessions"] = sessions
+	}
+	if l4 != nil {
+		size, maxFlows := l4.Len(), l4.MaxFlows()
+		snapshot["l4_flows"] = map[string]interface{}{
+			"size":              size,
+			"max":               maxFlows,
+			"occupancy_percent": occupancyPercent(size, maxFlows),
+			"refused":           l4.flowsRefused.Load(),
+			"shed":              l4.flowsShed.Load(),
+		}
+	}
+	return snapshot
+}
+
+// occupancyPercent returns how full a table is, 0 when it is unbounded
+func occupancyPercent(size, max int) float64 {
+	if max <= 0 {
+		return 0
+	}
+	return float64(size*1000/max) / 10
+}
+
+// tableSnapshot reports a bounded routing table with its occupancy
+func tableSnapshot(stats balancer.TableStats) map[string]interface{} {
+	return map[string]interface{}{
+		"size":              stats.Size,
+		"max":               stats.Max,
+		"peak":              stats.Peak,
+		"occupancy_percent": occupancyPercent(stats.Size, stats.Max),
+		"evicted":           stats.Evicted,
+		"compactions":       stats.Compactions,
+	}
+}
+
+// handleMemory serves GET /api/memory with memory use, the soft limit and
+// the bounded tables
+func (s *Server) handleMemory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.memory.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
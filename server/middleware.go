@@ -0,0 +1,396 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Enhanced middleware with comprehensive features
+func (s *Server) loadBalancerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/metrics" {
+			// The dashboard and public API endpoints can require a user
+			if s.basicAuth.protects(r.URL.Path) {
+				if !s.authFailures.allow(w, r, "basic_auth.paths") {
+					return
+				}
+				if _, ok := s.basicAuth.authenticate(w, r, true, "basic_auth.paths"); !ok {
+					s.authFailures.record(r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.dryRun {
+			s.writeRoutingDecision(w, r)
+			return
+		}
+
+		// Routing rules and virtual hosts select the backend pool
+		match := s.pools.Match(r)
+		// Clients in an experiment go to the pool of their variant
+		r, match = s.assignExperiment(r, match)
+		pool := match.Pool
+		setRouteSecurityHeaders(r, match.SecurityHeaders)
+		// gRPC clients read the outcome from grpc-status, also for the load
+		// balancer's own errors; gRPC-Web is translated for pools allowing it
+		if isGRPCRequest(r) {
+			var finish func()
+			w, finish = grpcResponseWriter(w, r, pool)
+			defer finish()
+		}
+		if match.RequireClientCert && !hasVerifiedClientCert(r) {
+			log.Printf("🪪 Client certificate required for %s %s (%s)", r.Method, r.URL.Path, match.Reason)
+			http.Error(w, "🚫 Client certificate required", http.StatusForbidden)
+			return
+		}
+
+		// 0-RTT requests can be replayed; let the client retry unsafe ones
+		// after the handshake and tell backends about the rest
+		if isEarlyData(r) {
+			switch {
+			case earlyDataAllowed(match.EarlyData, r.Method):
+				r.Header.Set("Early-Data", "1")
+			case match.EarlyData == earlyDataWait:
+				// Once the handshake completes the request cannot be a replay
+				var ok bool
+				if r, ok = waitForHandshake(r); !ok {
+					log.Printf("⏳ 0-RTT %s %s from %s gave up waiting for the handshake (%s)", r.Method, r.URL.Path, r.RemoteAddr, match.Reason)
+					http.Error(w, "Too Early", http.StatusTooEarly)
+					return
+				}
+			default:
+				log.Printf("⏳ Rejected 0-RTT %s %s from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, match.Reason)
+				http.Error(w, "Too Early", http.StatusTooEarly)
+				return
+			}
+		}
+
+		// Clients outside the allowed address ranges are refused first
+		if !s.access.allow(w, r, match) {
+			return
+		}
+
+		// Clients over their request rate are refused before any auth or
+		// plugin work is done
+		if !s.rateLimiter.allow(w, r, s.sessionKey(r, pool)) {
+			return
+		}
+
+		// Above the global concurrency cap requests wait briefly or are shed
+		releaseAdmission, admitted := s.acquireAdmission(w, r)
+		if !admitted {
+			return
+		}
+		defer releaseAdmission()
+
+		// Browsers' CORS preflights carry no credentials and never reach a
+		// backend; responses get the route's CORS headers
+		if match.CORS.preflight(w, r, match.Reason) {
+			return
+		}
+		w = match.CORS.wrap(w, r)
+
+		// Clients with a bot-like reputation are rate limited, challenged or refused
+		if !s.bots.check(w, r, match.Reason) {
+			return
+		}
+
+		// Clients that keep failing to log in are refused before the
+		// password hashing, token checks and auth subrequests run again
+		if (match.RequireJWT || match.BasicAuth || match.ForwardAuth) && !s.authFailures.allow(w, r, match.Reason) {
+			return
+		}
+
+		// API routes only accept requests with a valid bearer token
+		r, ok := s.jwt.authenticate(w, r, match)
+		if !ok {
+			s.authFailures.record(r)
+			return
+		}
+
+		// Routes with basic_auth need a user from the configured list
+		if r, ok = s.basicAuth.authenticate(w, r, match.BasicAuth, match.Reason); !ok {
+			s.authFailures.record(r)
+			return
+		}
+
+		// Protected routes let the external auth service decide
+		if r, ok = s.forwardAuth.authorize(w, r, match); !ok {
+			s.authFailures.record(r)
+			return
+		}
+
+		// Operator plugins inspect the request next and may answer it themselves
+		s.plugins.serve(w, r, func(w http.ResponseWriter, r *http.Request) {
+			s.proxyMatched(w, r, match)
+		})
+	})
+}
+
+// proxyMatched serves cached responses and otherwise proxies a routed,
+// admitted request to a peer of its pool
+func (s *Server) proxyMatched(w http.ResponseWriter, r *http.Request, match RouteMatch) {
+	pool := match.Pool
+
+	// Oversized uploads are refused before they reach a backend
+	bodyLimit, bodyBuffering := s.config.Current().RequestBody.forRoute(match)
+	if !s.requestBodies.limit(w, r, bodyLimit) {
+		return
+	}
+
+	// Requests multiplexed on one connection are proxied most urgent
+	// first (RFC 9218); long-lived CONNECT tunnels are not scheduled
+	if r.Method != http.MethodConnect {
+		priority := parsePriority(r.Header)
+		release, err := s.priority.Acquire(r.Context(), r.RemoteAddr, priority)
+		if err != nil {
+			// The client gave up on the request while it was queued
+			return
+		}
+		defer release()
+		if priority.Incremental {
+			w = newIncrementalWriter(w)
+		}
+	}
+
+	// Fresh responses stored for the pool need no backend
+	if entry, body := s.cache.fresh(r, pool); entry != nil {
+		cw, finishCompression := s.compression.compress(w, r, s.config.Current().Compression)
+		s.cache.write(cw, r, entry, body, "HIT")
+		finishCompression()
+		return
+	}
+
+	// QUIC-LB Draft 20 compliant routing
+	var peer *balancer.Backend
+	var routingMethod string
+
+	// Moodle uploads and draft files go to the session's backend, which
+	// holds them, even when their connection was routed to another
+	if peer = s.pinUpload(r, pool); peer != nil {
+		routingMethod = "moodle-upload"
+	}
+
+	// Try QUIC-LB connection ID based routing first (Draft 20 compliance)
+	if connectionIDHeader := r.Header.Get("X-Quic-Connection-Id"); peer == nil && connectionIDHeader != "" {
+		if connectionIDBytes, err := hex.DecodeString(connectionIDHeader); err == nil {
+			if selectedPeer, err := s.quicLB.RouteByConnectionID(connectionIDBytes); err == nil && !pool.HasBackend(selectedPeer) {
+				log.Printf("⚠️ QUIC-LB routing ignored: Backend #%d is not in pool %s", selectedPeer.ID, pool.Name())
+			} else if err == nil {
+				peer = selectedPeer
+				routingMethod = "quic-lb-cid"
+				log.Printf("🚀 QUIC-LB routing: Connection ID %s -> Backend #%d",
+					connectionIDHeader[:8], peer.ID)
+			} else {
+				log.Printf("⚠️ QUIC-LB routing failed: %v", err)
+			}
+		}
+	}
+
+	// Fallback to traditional load balancing for non-QUIC connections
+	if peer == nil {
+		sessionKey := s.sessionKey(r, pool)
+		peer = pool.GetNextPeer(sessionKey)
+		routingMethod = "legacy-lb"
+
+		// For new connections, generate QUIC-LB connection ID
+		if r.Proto == "HTTP/3.0" && peer != nil {
+			var cid [20]byte
+			if n, err := s.quicLB.GenerateConnectionIDInto(cid[:], uint16(peer.ID)); err == nil {
+				cidHex := hex.EncodeToString(cid[:n])
+				w.Header().Set("X-Quic-Connection-Id", cidHex)
+				log.Printf("🔗 Generated QUIC-LB CID for Backend #%d: %s",
+					peer.ID, cidHex[:8])
+			}
+		}
+	}
+
+	if peer == nil {
+		http.Error(w, "🚫 No healthy backends available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Simple direct forwarding without circuit breaker to avoid hanging
+	start := time.Now()
+
+	peer.AddRequest()
+	peer.AddConnection()
+	defer peer.RemoveConnection()
+
+	// Set session affinity for legacy routing
+	if routingMethod == "legacy-lb" {
+		sessionKey := s.sessionKey(r, pool)
+		if sessionKey != "" {
+			pool.SetSession(sessionKey, peer)
+		}
+	} else if routingMethod == "quic-lb-cid" && s.moodle.enabled() {
+		// A Moodle session's home is the backend its first connection reached
+		sessionKey := s.sessionKey(r, pool)
+		if _, affinity := pool.PeekNextPeer(sessionKey); !affinity {
+			pool.SetSession(sessionKey, peer)
+		}
+	}
+
+	// Enhanced headers including QUIC-LB information
+	w.Header().Set("X-Load-Balanced", "true")
+	w.Header().Set("X-Backend-ID", fmt.Sprintf("%d", peer.ID))
+	w.Header().Set("X-Backend-URL", peer.URL.Redacted())
+	w.Header().Set("X-LB-Pool", pool.Name())
+	w.Header().Set("X-LB-Algorithm", pool.Algorithm())
+	w.Header().Set("X-Health-Score", fmt.Sprintf("%.3f", peer.HealthScore))
+	w.Header().Set("X-Circuit-Breaker", "bypassed")
+	w.Header().Set("X-Backend-Connections", fmt.Sprintf("%d", peer.GetConnections()))
+	w.Header().Set("X-Routing-Method", routingMethod)
+	w.Header().Set("X-QUIC-LB-Compliant", "true")
+	w.Header().Set("X-QUIC-LB-Draft", "20")
+
+	if routingMethod == "legacy-lb" {
+		sessionKey := s.sessionKey(r, pool)
+		w.Header().Set("X-Session-Key", sessionKey)
+	}
+
+	emoji := "🔀"
+	if routingMethod == "quic-lb-cid" {
+		emoji = "🚀"
+	}
+
+	log.Printf("%s Load Balance: %s %s -> Backend #%d (Health: %.3f, Method: %s)",
+		emoji, r.Method, r.URL.Path, peer.ID, peer.HealthScore, routingMethod)
+
+	// Injected faults exercise retries and the circuit breaker in staging
+	if s.injectFault(w, r, match, peer) {
+		return
+	}
+
+	// Direct forwarding without circuit breaker
+	setClientCertHeaders(r)
+	setGeoHeaders(r, s.config.Current().GeoIP.Headers)
+	s.jwt.setJWTHeaders(r)
+	s.forwardAuth.setForwardAuthHeaders(r)
+	s.basicAuth.setBasicAuthHeaders(r)
+	// WebSockets are long-lived, so kept out of the response time average
+	if isH3WebSocket(r) || isWebSocketUpgrade(r) {
+		if s.websockets.Draining() {
+			http.Error(w, "🚫 Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if isH3WebSocket(r) {
+			s.proxyH3WebSocket(w, r, peer)
+		} else {
+			s.proxyWebSocket(w, r, peer)
+		}
+		return
+	}
+	if s.datagrams != nil && s.datagrams.handles(r) {
+		s.datagrams.proxy(w, r, peer)
+		return
+	}
+	// Bodies stream through a fixed buffer with deadlines that follow
+	// progress; 1xx responses such as 103 Early Hints reach the client
+	// before the response
+	cfg := s.config.Current()
+	tw, tr := s.transfers.start(w, r, peer, cfg.Streaming)
+	// Buffered uploads reach the backend complete, with a Content-Length
+	if bodyBuffering == bodyBuffer {
+		release, ok := s.requestBodies.buffer(tw, tr, cfg.RequestBody)
+		if !ok {
+			s.transfers.finish(tw, r)
+			return
+		}
+		defer release()
+	}
+	// Seeks in course files may be answered from read-ahead blocks
+	if !s.ranges.serve(tw, tr, peer, pool, cfg.Ranges) {
+		// Text responses the backend left unencoded are compressed
+		cw, finishCompression := s.compression.compress(tw, tr, cfg.Compression)
+		// Cacheable responses of pools with cache enabled are stored
+		s.cache.proxy(newInformationalWriter(cw, tr), tr, peer, pool)
+		finishCompression()
+	}
+	s.transfers.finish(tw, r)
+	s.experiments.record(r, tw.statusCode(), time.Since(start))
+
+	// Session IDs issued at login stay on the backend that issued them
+	s.followSessionRotation(w.Header(), pool, peer)
+
+	// Update metrics
+	peer.RecordResponseTime(time.Since(start))
+	s.moodle.countCourse(r, peer, routingMethod == "moodle-upload" || s.moodle.isUpload(r), time.Since(start))
+
+	// Simplified: Removed complex metrics recording
+}
+
+func extractSessionKey(r *http.Request, cookieName string) string {
+	// Try multiple sources for session identification
+	if sessionID, ok := requestSessionID(r, cookieName); ok {
+		return sessionID
+	}
+	if userID := r.Header.Get("X-User-ID"); userID != "" {
+		return "user-" + userID
+	}
+	// Fallback to IP-based session
+	return "ip-" + strings.Split(r.RemoteAddr, ":")[0]
+}
+
+// requestSessionID returns the session ID r carries in X-Session-ID or in
+// the session cookie
+func requestSessionID(r *http.Request, cookieName string) (string, bool) {
+	if sessionID := r.Header.Get("X-Session-ID"); sessionID != "" {
+		return sessionID, true
+	}
+	if !strings.HasSuffix(cookieName, "*") {
+		if cookie, err := r.Cookie(cookieName); err == nil {
+			return cookie.Value, true
+		}
+		return "", false
+	}
+	for _, cookie := range r.Cookies() {
+		if sessionCookieMatches(cookie.Name, cookieName) {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// sessionCookieMatches reports whether name is the session cookie; a
+// trailing "*" in cookieName matches any suffix, such as the one Moodle's
+// $CFG->sessioncookie appends to MoodleSession
+func sessionCookieMatches(name, cookieName string) bool {
+	if prefix, ok := strings.CutSuffix(cookieName, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == cookieName
+}
+
+// Enhanced QUIC Connection Middleware
+func (s *Server) quicConnectionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connID := fmt.Sprintf("conn-%s", r.RemoteAddr)
+		quicConnID := extractQuicConnectionID(r)
+		remoteAddr := r.RemoteAddr
+		localAddr := r.Host
+
+		// Enhanced connection tracking
+		s.conns.trackConnection(connID, quicConnID, remoteAddr, localAddr, r)
+
+		// Comprehensive headers
+		w.Header().Set("X-Connection-ID", connID)
+		w.Header().Set("X-Quic-Connection-ID", quicConnID)
+		w.Header().Set("X-Remote-Addr", remoteAddr)
+		w.Header().Set("X-Protocol", r.Proto)
+		w.Header().Set("X-Migration-Support", "enhanced")
+		w.Header().Set("X-Path-Validation", "enabled")
+		w.Header().Set("X-Connection-Multiplexing", "active")
+
+		next.ServeHTTP(w, r)
+	})
+}
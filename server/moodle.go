@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Moodle routing defaults
+const (
+	defaultMoodleMaxCourses = 1000
+	// maxMoodleSesskeys bounds the sesskey table; when full, an arbitrary
+	// half is dropped and those sessions are learned again
+	maxMoodleSesskeys = 100000
+)
+
+// defaultMoodleUploadPaths are the file picker, draft area and draft file
+// endpoints whose files live on the backend that received the upload
+var defaultMoodleUploadPaths = []string{"/repository/", "/draftfile.php"}
+
+// MoodleConfig adds routing that knows Moodle's requests. A session
+// cookie ending in "*", such as "MoodleSession*", matches Moodle's cookie
+// with any $CFG->sessioncookie suffix, in every mode. With moodle enabled,
+// requests carrying only a sesskey parameter share the affinity of the
+// session it was issued to, the session ID Moodle issues at login stays on
+// the backend of the session it replaces, uploads and draft files go to the
+// session's backend even when their QUIC connection was routed elsewhere,
+// and traffic is counted per course.
+type MoodleConfig struct {
+	Enabled     bool     `json:"enabled"`
+	UploadPaths []string `json:"upload_paths,omitempty"` // Path prefixes pinned to the session's backend, default "/repository/", "/draftfile.php"
+	MaxCourses  int      `json:"max_courses,omitempty"`  // Courses counted separately in /api/moodle, default 1000; later ones count as "other"
+}
+
+// validate checks the Moodle routing settings
+func (mc *MoodleConfig) validate() []error {
+	var errs []error
+	for i, path := range mc.UploadPaths {
+		if !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("moodle.upload_paths[%d] %q must start with /", i, path))
+		}
+	}
+	if mc.MaxCourses < 0 {
+		errs = append(errs, fmt.Errorf("moodle.max_courses must not be negative"))
+	}
+	return errs
+}
+
+// uploadPaths returns the configured upload paths or their defaults
+func (mc *MoodleConfig) uploadPaths() []string {
+	if len(mc.UploadPaths) == 0 {
+		return defaultMoodleUploadPaths
+	}
+	return mc.UploadPaths
+}
+
+// maxCourses returns the configured course limit or its default
+func (mc *MoodleConfig) maxCourses() int {
+	if mc.MaxCourses == 0 {
+		return defaultMoodleMaxCourses
+	}
+	return mc.MaxCourses
+}
+
+// courseTraffic counts the requests of one course
+type courseTraffic struct {
+	Requests int64            `json:"requests"`
+	Uploads  int64            `json:"uploads"`
+	Duration time.Duration    `json:"-"`
+	Backends map[string]int64 `json:"backends"` // backend ID -> requests
+	LastSeen time.Time        `json:"last_seen"`
+}
+
+// Moodle tracks sesskeys and course traffic for Moodle-aware routing
+type Moodle struct {
+	mu       sync.Mutex
+	cfg      MoodleConfig
+	sesskeys map[string]string // HMAC of a sesskey -> affinity key of its session
+	courses  map[string]*courseTraffic
+	other    courseTraffic // courses over max_courses
+
+	pinnedUploads int64 // uploads sent to the session's backend over their connection's
+	rotations     int64 // session IDs issued at login kept on their backend
+}
+
+// NewMoodle creates Moodle-aware routing, off until configured
+func NewMoodle() *Moodle {
+	return &Moodle{
+		sesskeys: make(map[string]string),
+		courses:  make(map[string]*courseTraffic),
+	}
+}
+
+// Configure applies new settings; course counts are kept
+func (m *Moodle) Configure(cfg MoodleConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	if !cfg.Enabled {
+		m.sesskeys = make(map[string]string)
+	}
+}
+
+// enabled reports whether Moodle-aware routing is on
+func (m *Moodle) enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg.Enabled
+}
+
+// sessionKey returns the affinity key of r in pool: the session's own, or,
+// for a request carrying only a sesskey, that of the session the sesskey
+// belongs to
+func (s *Server) sessionKey(r *http.Request, pool *balancer.Pool) string {
+	cookieName := pool.SessionCookie()
+	if !s.moodle.enabled() {
+		return s.sessionState.key(r, cookieName)
+	}
+
+	sesskey := r.URL.Query().Get("sesskey")
+	if sesskey == "" {
+		return s.sessionState.key(r, cookieName)
+	}
+	sesskeyHash := s.sessionState.hash("sesskey-" + sesskey)
+	if _, ok := requestSessionID(r, cookieName); ok {
+		// Learn which session the sesskey belongs to
+		key := s.sessionState.key(r, cookieName)
+		s.moodle.learnSesskey(sesskeyHash, key)
+		return key
+	}
+	if key, ok := s.moodle.sesskeySession(sesskeyHash); ok {
+		return key
+	}
+	return s.sessionState.key(r, cookieName)
+}
+
+// learnSesskey maps a sesskey to the affinity key of its session
+func (m *Moodle) learnSesskey(sesskeyHash, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sesskeys[sesskeyHash] == key {
+		return
+	}
+	if len(m.sesskeys) >= maxMoodleSesskeys {
+		dropped := 0
+		for k := range m.sesskeys {
+			if dropped >= maxMoodleSesskeys/2 {
+				break
+			}
+			delete(m.sesskeys, k)
+			dropped++
+		}
+	}
+	m.sesskeys[sesskeyHash] = key
+}
+
+// sesskeySession returns the affinity key of the session a sesskey belongs to
+func (m *Moodle) sesskeySession(sesskeyHash string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.sesskeys[sesskeyHash]
+	return key, ok
+}
+
+// isUpload reports whether r uploads or reads draft files, which stay on
+// the session's backend
+func (m *Moodle) isUpload(r *http.Request) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.cfg.Enabled {
+		return false
+	}
+	for _, prefix := range m.cfg.uploadPaths() {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinUpload returns the backend the session of an upload is pinned to,
+// or nil to route it as usual
+func (s *Server) pinUpload(r *http.Request, pool *balancer.Pool) *balancer.Backend {
+	if !s.moodle.isUpload(r) {
+		return nil
+	}
+	backend, affinity := pool.PeekNextPeer(s.sessionKey(r, pool))
+	if !affinity {
+		return nil
+	}
+	s.moodle.mu.Lock()
+	s.moodle.pinnedUploads++
+	s.moodle.mu.Unlock()
+	return backend
+}
+
+// followSessionRotation pins a session ID the backend issued, as Moodle
+// does at login, to the backend that issued it, so the user's draft files
+// and uploads stay reachable
+func (s *Server) followSessionRotation(header http.Header, pool *balancer.Pool, peer *balancer.Backend) {
+	if !s.moodle.enabled() || len(header["Set-Cookie"]) == 0 {
+		return
+	}
+	cookieName := pool.SessionCookie()
+	for _, line := range header["Set-Cookie"] {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil || !sessionCookieMatches(cookie.Name, cookieName) || cookie.Value == "" || cookie.Value == "deleted" || cookie.MaxAge < 0 {
+			continue
+		}
+		pool.SetSession(s.sessionState.hash(cookie.Value), peer)
+		s.moodle.mu.Lock()
+		s.moodle.rotations++
+		s.moodle.mu.Unlock()
+	}
+}
+
+// courseOf returns the course a Moodle request belongs to, or ""
+func courseOf(r *http.Request) string {
+	query := r.URL.Query()
+	if r.URL.Path == "/course/view.php" || r.URL.Path == "/course/edit.php" {
+		if id := query.Get("id"); id != "" {
+			return courseID(id)
+		}
+	}
+	for _, param := range []string{"courseid", "course"} {
+		if id := query.Get(param); id != "" {
+			return courseID(id)
+		}
+	}
+	return ""
+}
+
+// courseID returns id when it is a course number, otherwise ""
+func courseID(id string) string {
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > 0 {
+		return strconv.FormatUint(n, 10)
+	}
+	return ""
+}
+
+// countCourse records a proxied request of the course it belongs to
+func (m *Moodle) countCourse(r *http.Request, peer *balancer.Backend, upload bool, elapsed time.Duration) {
+	if !m.enabled() {
+		return
+	}
+	course := courseOf(r)
+	if course == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	traffic := m.courses[course]
+	if traffic == nil {
+		if len(m.courses) >= m.cfg.maxCourses() {
+			traffic = &m.other
+		} else {
+			traffic = &courseTraffic{}
+			m.courses[course] = traffic
+		}
+	}
+	traffic.Requests++
+	if upload {
+		traffic.Uploads++
+	}
+	traffic.Duration += elapsed
+	if traffic.Backends == nil {
+		traffic.Backends = make(map[string]int64)
+	}
+	traffic.Backends[strconv.Itoa(peer.ID)]++
+	traffic.LastSeen = time.Now()
+}
+
+// Snapshot reports the sesskeys learned, pinned uploads and course traffic,
+// busiest courses first
+func (m *Moodle) Snapshot() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	courses := make([]map[string]interface{}, 0, len(m.courses))
+	for id, traffic := range m.courses {
+		courses = append(courses, courseSnapshot(id, traffic))
+	}
+	sort.Slice(courses, func(i, j int) bool {
+		return courses[i]["requests"].(int64) > courses[j]["requests"].(int64)
+	})
+
+	snapshot := map[string]interface{}{
+		"enabled":        m.cfg.Enabled,
+		"upload_paths":   m.cfg.uploadPaths(),
+		"sesskeys":       len(m.sesskeys),
+		"pinned_uploads": m.pinnedUploads,
+		"rotations":      m.rotations,
+		"courses":        courses,
+		"max_courses":    m.cfg.maxCourses(),
+	}
+	if m.other.Requests > 0 {
+		snapshot["other_courses"] = courseSnapshot("other", &m.other)
+	}
+	return snapshot
+}
+
+// courseSnapshot reports the traffic of one course
+func courseSnapshot(id string, traffic *courseTraffic) map[string]interface{} {
+	return map[string]interface{}{
+		"course":         id,
+		"requests":       traffic.Requests,
+		"uploads":        traffic.Uploads,
+		"avg_latency_ms": float64(traffic.Duration.Microseconds()) / 1000 / float64(max(traffic.Requests, 1)),
+		"backends":       traffic.Backends,
+		"last_seen":      traffic.LastSeen,
+	}
+}
+
+// handleMoodle serves GET /api/moodle
+func (s *Server) handleMoodle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.moodle.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
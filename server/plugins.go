@@ -0,0 +1,455 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"plugin"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps the rest of the proxy pipeline: it calls next to let a
+// request continue, or answers w itself to stop it
+type Middleware func(next http.Handler) http.Handler
+
+// MiddlewarePlugin inspects or rewrites requests after routing, access
+// control, rate limiting and authentication and before caching and
+// proxying, so operators can add WAF rules or header policies without
+// forking the load balancer.
+// New is called with the plugin's config when the configuration is
+// validated and whenever it is applied; an error rejects the configuration.
+type MiddlewarePlugin interface {
+	New(config json.RawMessage) (Middleware, error)
+}
+
+// MiddlewarePluginFunc adapts a function to MiddlewarePlugin
+type MiddlewarePluginFunc func(config json.RawMessage) (Middleware, error)
+
+// New calls f
+func (f MiddlewarePluginFunc) New(config json.RawMessage) (Middleware, error) {
+	return f(config)
+}
+
+// goPluginSymbol is the function a Go plugin (.so) exports. It only uses
+// standard library types, so the plugin does not have to import this module.
+const goPluginSymbol = "NewMiddleware"
+
+var (
+	pluginRegistryMu sync.RWMutex
+	pluginRegistry   = map[string]MiddlewarePlugin{
+		"request_rules": MiddlewarePluginFunc(newRequestRules),
+		"header_policy": MiddlewarePluginFunc(newHeaderPolicy),
+	}
+)
+
+// RegisterPlugin makes a plugin compiled into the binary available under
+// name; call it from an init function before the server starts
+func RegisterPlugin(name string, p MiddlewarePlugin) {
+	pluginRegistryMu.Lock()
+	defer pluginRegistryMu.Unlock()
+	if _, exists := pluginRegistry[name]; exists {
+		panic(fmt.Sprintf("plugin %q registered twice", name))
+	}
+	pluginRegistry[name] = p
+}
+
+// PluginConfig inserts one middleware plugin; plugins run in the order
+// they are listed
+type PluginConfig struct {
+	Name     string          `json:"name"`               // Registered plugin ("request_rules", "header_policy") or a label for one loaded from path
+	Path     string          `json:"path,omitempty"`     // Go plugin (.so) exporting NewMiddleware(json.RawMessage) (func(http.Handler) http.Handler, error)
+	Config   json.RawMessage `json:"config,omitempty"`   // Passed to the plugin as is
+	Disabled bool            `json:"disabled,omitempty"` // Keep the entry without running it
+}
+
+// build instantiates the plugin
+func (pc *PluginConfig) build() (Middleware, error) {
+	if pc.Path != "" {
+		p, err := plugin.Open(pc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", pc.Path, err)
+		}
+		sym, err := p.Lookup(goPluginSymbol)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pc.Path, err)
+		}
+		newMiddleware, ok := sym.(func(json.RawMessage) (func(http.Handler) http.Handler, error))
+		if !ok {
+			return nil, fmt.Errorf("%s: %s has type %T", pc.Path, goPluginSymbol, sym)
+		}
+		mw, err := newMiddleware(pc.Config)
+		return Middleware(mw), err
+	}
+
+	pluginRegistryMu.RLock()
+	p, ok := pluginRegistry[pc.Name]
+	pluginRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no plugin named %q is registered", pc.Name)
+	}
+	return p.New(pc.Config)
+}
+
+// check validates the entry without running code from outside the binary:
+// a Go plugin is only opened when the configuration is applied, so its path
+// has to name a file and its config has to be JSON, while a registered
+// plugin is built to check its config
+func (pc *PluginConfig) check() error {
+	if pc.Path == "" {
+		_, err := pc.build()
+		return err
+	}
+	info, err := os.Stat(pc.Path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", pc.Path)
+	}
+	if len(pc.Config) > 0 && !json.Valid(pc.Config) {
+		return fmt.Errorf("config is not valid JSON")
+	}
+	return nil
+}
+
+// validatePlugins checks every enabled plugin entry
+func validatePlugins(plugins []PluginConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, pc := range plugins {
+		if pc.Name == "" {
+			errs = append(errs, fmt.Errorf("plugins[%d].name is required", i))
+			continue
+		}
+		if names[pc.Name] {
+			errs = append(errs, fmt.Errorf("plugins[%d]: name %q is used twice", i, pc.Name))
+		}
+		names[pc.Name] = true
+		if pc.Disabled {
+			continue
+		}
+		if err := pc.check(); err != nil {
+			errs = append(errs, fmt.Errorf("plugins[%d] %s: %v", i, pc.Name, err))
+		}
+	}
+	return errs
+}
+
+// pluginInstance is a running plugin with its counters
+type pluginInstance struct {
+	name     string
+	requests atomic.Int64
+	stopped  atomic.Int64 // answered without calling next
+	panics   atomic.Int64
+}
+
+// pluginChain is the composed middleware of the enabled plugins
+type pluginChain struct {
+	handler   http.Handler
+	instances []*pluginInstance
+}
+
+// Context values threading a request through the composed chain
+type (
+	pluginFinalKey struct{} // func(http.ResponseWriter, *http.Request) continuing past the plugins
+	pluginDepthKey struct{} // *int, how many plugins called next
+)
+
+// Plugins runs the configured middleware plugins in front of proxying
+type Plugins struct {
+	chain atomic.Pointer[pluginChain]
+}
+
+// NewPlugins creates an empty plugin chain
+func NewPlugins() *Plugins {
+	return &Plugins{}
+}
+
+// Configure rebuilds the chain; a plugin that fails to build is left out
+// and logged. Counters of plugins kept by name carry over.
+func (p *Plugins) Configure(plugins []PluginConfig) {
+	previous := make(map[string]*pluginInstance)
+	if old := p.chain.Load(); old != nil {
+		for _, inst := range old.instances {
+			previous[inst.name] = inst
+		}
+	}
+
+	var middlewares []Middleware
+	chain := &pluginChain{}
+	for _, pc := range plugins {
+		if pc.Disabled {
+			continue
+		}
+		mw, err := pc.build()
+		if err != nil {
+			log.Printf("⚠️ Plugin %s not loaded: %v", pc.Name, err)
+			continue
+		}
+		inst := previous[pc.Name]
+		if inst == nil {
+			inst = &pluginInstance{name: pc.Name}
+		}
+		middlewares = append(middlewares, mw)
+		chain.instances = append(chain.instances, inst)
+	}
+	if len(middlewares) == 0 {
+		p.chain.Store(nil)
+		return
+	}
+
+	// Composed once, innermost first; the final handler comes per request
+	// through the context
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Context().Value(pluginFinalKey{}).(func(http.ResponseWriter, *http.Request))(w, r)
+	})
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		next := h
+		depth := i + 1
+		h = middlewares[i](http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*r.Context().Value(pluginDepthKey{}).(*int) = depth
+			next.ServeHTTP(w, r)
+		}))
+	}
+	chain.handler = h
+	p.chain.Store(chain)
+
+	names := make([]string, len(chain.instances))
+	for i, inst := range chain.instances {
+		names[i] = inst.name
+	}
+	log.Printf("🧩 Middleware plugins: %s", strings.Join(names, " -> "))
+}
+
+// serve runs r through the plugins and then final, unless a plugin answers
+// it. A panicking plugin fails the request with 500 instead of the
+// connection.
+func (p *Plugins) serve(w http.ResponseWriter, r *http.Request, final func(http.ResponseWriter, *http.Request)) {
+	chain := p.chain.Load()
+	if chain == nil {
+		final(w, r)
+		return
+	}
+
+	depth := 0
+	ctx := context.WithValue(r.Context(), pluginFinalKey{}, final)
+	ctx = context.WithValue(ctx, pluginDepthKey{}, &depth)
+	for _, inst := range chain.instances {
+		inst.requests.Add(1)
+	}
+	defer func() {
+		if depth < len(chain.instances) {
+			inst := chain.instances[depth]
+			// Later plugins never saw the request
+			for _, skipped := range chain.instances[depth+1:] {
+				skipped.requests.Add(-1)
+			}
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				inst.panics.Add(1)
+				log.Printf("❌ Plugin %s panicked on %s %s: %v", inst.name, r.Method, r.URL.Path, v)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			inst.stopped.Add(1)
+		}
+	}()
+	chain.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Snapshot reports the plugins in chain order with their counters
+func (p *Plugins) Snapshot() map[string]interface{} {
+	plugins := make([]map[string]interface{}, 0)
+	if chain := p.chain.Load(); chain != nil {
+		for _, inst := range chain.instances {
+			plugins = append(plugins, map[string]interface{}{
+				"name":     inst.name,
+				"requests": inst.requests.Load(),
+				"stopped":  inst.stopped.Load(),
+				"panics":   inst.panics.Load(),
+			})
+		}
+	}
+	pluginRegistryMu.RLock()
+	registered := make([]string, 0, len(pluginRegistry))
+	for name := range pluginRegistry {
+		registered = append(registered, name)
+	}
+	pluginRegistryMu.RUnlock()
+	sort.Strings(registered)
+	return map[string]interface{}{
+		"plugins":    plugins,
+		"registered": registered,
+	}
+}
+
+// handlePlugins serves GET /api/plugins with the chain and its counters
+func (s *Server) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.plugins.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// requestRule is one rule of the request_rules plugin
+type requestRule struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`           // "path", "query", "method", "host" or "header:<Name>"
+	Regex  string `json:"regex"`            // Matched against the target; a rule on a missing header never matches
+	Status int    `json:"status,omitempty"` // Response status for matching requests, default 403
+
+	re *regexp.Regexp
+}
+
+// requestRulesConfig configures the request_rules plugin
+type requestRulesConfig struct {
+	Rules   []requestRule `json:"rules"`
+	LogOnly bool          `json:"log_only,omitempty"` // Log matches without blocking, to try rules out
+}
+
+// newRequestRules builds the request_rules plugin, which blocks requests
+// whose path, query, method, host or a header matches a rule
+func newRequestRules(raw json.RawMessage) (Middleware, error) {
+	var cfg requestRulesConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		switch {
+		case rule.Target == "path", rule.Target == "query", rule.Target == "method", rule.Target == "host":
+		case strings.HasPrefix(rule.Target, "header:") && len(rule.Target) > len("header:"):
+		default:
+			return nil, fmt.Errorf("rules[%d].target %q must be path, query, method, host or header:<Name>", i, rule.Target)
+		}
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d].regex: %v", i, err)
+		}
+		rule.re = re
+		if rule.Status == 0 {
+			rule.Status = http.StatusForbidden
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, rule := range cfg.Rules {
+				if !rule.matches(r) {
+					continue
+				}
+				if cfg.LogOnly {
+					log.Printf("🧱 Rule %s would block %s %s from %s", rule.Name, r.Method, r.URL.Path, r.RemoteAddr)
+					continue
+				}
+				log.Printf("🧱 Rule %s blocked %s %s from %s", rule.Name, r.Method, r.URL.Path, r.RemoteAddr)
+				http.Error(w, "🚫 Request blocked", rule.Status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// matches reports whether the rule's target in r matches its regex
+func (rule *requestRule) matches(r *http.Request) bool {
+	switch rule.Target {
+	case "path":
+		return rule.re.MatchString(r.URL.Path)
+	case "query":
+		return rule.re.MatchString(r.URL.RawQuery)
+	case "method":
+		return rule.re.MatchString(r.Method)
+	case "host":
+		return rule.re.MatchString(r.Host)
+	}
+	for _, value := range r.Header.Values(strings.TrimPrefix(rule.Target, "header:")) {
+		if rule.re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerPolicyConfig configures the header_policy plugin
+type headerPolicyConfig struct {
+	RequestSet     map[string]string `json:"request_set,omitempty"`     // Headers set on requests to backends
+	RequestRemove  []string          `json:"request_remove,omitempty"`  // Headers removed from requests to backends
+	ResponseSet    map[string]string `json:"response_set,omitempty"`    // Headers set on responses, replacing the backend's
+	ResponseRemove []string          `json:"response_remove,omitempty"` // Headers removed from responses, e.g. X-Powered-By
+}
+
+// newHeaderPolicy builds the header_policy plugin, which sets and removes
+// request and response headers
+func newHeaderPolicy(raw json.RawMessage) (Middleware, error) {
+	var cfg headerPolicyConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, name := range cfg.RequestRemove {
+				r.Header.Del(name)
+			}
+			for name, value := range cfg.RequestSet {
+				r.Header.Set(name, value)
+			}
+			if len(cfg.ResponseSet) > 0 || len(cfg.ResponseRemove) > 0 {
+				w = &headerPolicyWriter{ResponseWriter: w, cfg: &cfg}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// headerPolicyWriter applies response header rules to the final response
+type headerPolicyWriter struct {
+	http.ResponseWriter
+	cfg     *headerPolicyConfig
+	applied bool
+}
+
+func (w *headerPolicyWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.ResponseWriter.Header()
+	for _, name := range w.cfg.ResponseRemove {
+		h.Del(name)
+	}
+	for name, value := range w.cfg.ResponseSet {
+		h.Set(name, value)
+	}
+}
+
+func (w *headerPolicyWriter) WriteHeader(code int) {
+	// Interim responses such as 103 Early Hints keep their headers
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerPolicyWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerPolicyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidatePlugins(t *testing.T) {
+	dir := t.TempDir()
+	// Not a Go plugin, so opening it would fail; validation must not try
+	notPlugin := filepath.Join(dir, "waf.so")
+	if err := os.WriteFile(notPlugin, []byte("not an ELF file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		plugins []PluginConfig
+		wantErr string
+	}{
+		{"registered", []PluginConfig{{Name: "header_policy", Config: json.RawMessage(`{}`)}}, ""},
+		{"path not opened", []PluginConfig{{Name: "waf", Path: notPlugin, Config: json.RawMessage(`{"mode":"block"}`)}}, ""},
+		{"disabled skipped", []PluginConfig{{Name: "waf", Path: filepath.Join(dir, "missing.so"), Disabled: true}}, ""},
+		{"missing name", []PluginConfig{{Path: notPlugin}}, "name is required"},
+		{"duplicate name", []PluginConfig{{Name: "header_policy", Config: json.RawMessage(`{}`)}, {Name: "header_policy", Config: json.RawMessage(`{}`)}}, "used twice"},
+		{"unregistered", []PluginConfig{{Name: "nope"}}, "no plugin named"},
+		{"missing path", []PluginConfig{{Name: "waf", Path: filepath.Join(dir, "missing.so")}}, "no such file"},
+		{"directory path", []PluginConfig{{Name: "waf", Path: dir}}, "not a regular file"},
+		{"path config not JSON", []PluginConfig{{Name: "waf", Path: notPlugin, Config: json.RawMessage(`{mode`)}}, "not valid JSON"},
+		{"registered config rejected", []PluginConfig{{Name: "request_rules", Config: json.RawMessage(`{"rules":[{"target":"path","regex":"("}]}`)}}, "regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validatePlugins(tt.plugins)
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("unexpected errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr) {
+				t.Errorf("errors %v, want one containing %q", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A Go plugin that passes validation but fails to open on apply is left
+// out of the chain instead of failing the configuration
+func TestPluginsConfigureSkipsUnloadable(t *testing.T) {
+	notPlugin := filepath.Join(t.TempDir(), "waf.so")
+	if err := os.WriteFile(notPlugin, []byte("not an ELF file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlugins()
+	p.Configure([]PluginConfig{
+		{Name: "waf", Path: notPlugin},
+		{Name: "header_policy", Config: json.RawMessage(`{}`)},
+	})
+	plugins := p.Snapshot()["plugins"].([]map[string]interface{})
+	if len(plugins) != 1 || plugins[0]["name"] != "header_policy" {
+		t.Errorf("chain %v, want only header_policy", plugins)
+	}
+}
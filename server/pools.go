@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// defaultPoolName is the pool built from the top-level backends section
+const defaultPoolName = "default"
+
+// PoolRegistry holds the named backend pools and the virtual host table
+type PoolRegistry struct {
+	mu         sync.RWMutex
+	pools      map[string]*balancer.Pool
+	exactHosts map[string]string // host -> pool
+	wildcards  []wildcardHost    // "*.example.com" entries, longest suffix first
+	routes     []routeRule       // routing rules in config order, first match wins
+	fallback   string            // pool used when nothing matches
+	router     *balancer.QUICLB  // assigns QUIC-LB server IDs to new backends
+	ctx        context.Context   // bounds the pools' health check loops
+	transport  http.RoundTripper // backend connections
+	grpc       http.RoundTripper // HTTP/2-only backend connections of gRPC pools
+	buffers    *balancer.BufferPool
+}
+
+// routeRule is a compiled RouteConfig; every set condition must match
+type routeRule struct {
+	id      string // RouteConfig.identity
+	prefix  string
+	re      *regexp.Regexp
+	methods map[string]bool
+	headers []valueMatch
+	query   []valueMatch
+	// Client location from the geoip databases
+	countries map[string]bool
+	asns      map[uint]bool
+	pool      string
+
+	requireClientCert bool
+	earlyData         string
+	maxBodySize       int64
+	bodyBuffering     string
+	access            *accessList
+	requireJWT        bool
+	forwardAuth       bool
+	basicAuth         bool
+	cors              *corsPolicy
+	securityHeaders   *SecurityHeadersConfig
+}
+
+// valueMatch requires a header or query parameter to be present and, when
+// re is set, to match it
+type valueMatch struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (rt routeRule) matches(r *http.Request) bool {
+	if rt.re != nil && !rt.re.MatchString(r.URL.Path) {
+		return false
+	}
+	if rt.prefix != "" && !strings.HasPrefix(r.URL.Path, rt.prefix) {
+		return false
+	}
+	if len(rt.methods) > 0 && !rt.methods[r.Method] {
+		return false
+	}
+	for _, m := range rt.headers {
+		values := r.Header.Values(m.name)
+		if !m.matchAny(values) {
+			return false
+		}
+	}
+	if len(rt.countries) > 0 || len(rt.asns) > 0 {
+		geo, ok := geoFromRequest(r)
+		if !ok {
+			return false
+		}
+		if len(rt.countries) > 0 && !rt.countries[geo.Country] {
+			return false
+		}
+		if len(rt.asns) > 0 && !rt.asns[geo.ASN] {
+			return false
+		}
+	}
+	if len(rt.query) > 0 {
+		query := r.URL.Query()
+		for _, m := range rt.query {
+			values, ok := query[m.name]
+			if !ok || !m.matchAny(values) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m valueMatch) matchAny(values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if m.re == nil {
+		return true
+	}
+	for _, v := range values {
+		if m.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type wildcardHost struct {
+	suffix string // ".example.com"
+	pool   string
+}
+
+// NewPoolRegistry creates an empty registry whose backends are registered with
+// router and reached through transport, sharing HTTP/2 connections through
+// upstream when it is enabled. Health checks run until ctx is done or Close
+// is called.
+func NewPoolRegistry(ctx context.Context, router *balancer.QUICLB, transport http.RoundTripper, upstream *UpstreamCoalescer) *PoolRegistry {
+	return &PoolRegistry{
+		pools:      make(map[string]*balancer.Pool),
+		exactHosts: make(map[string]string),
+		router:     router,
+		ctx:        ctx,
+		transport:  upstream.newCoalescingTransport(transport, false),
+		grpc:       upstream.newCoalescingTransport(newGRPCTransport(transport), true),
+		buffers:    balancer.NewBufferPool(0),
+	}
+}
+
+// transportFor returns the backend transport of a pool protocol
+func (pr *PoolRegistry) transportFor(protocol string) http.RoundTripper {
+	if protocol == balancer.ProtocolGRPC {
+		return pr.grpc
+	}
+	return pr.transport
+}
+
+// Close stops every pool's health checks and waits for them to exit
+func (pr *PoolRegistry) Close() {
+	for _, pool := range pr.Pools() {
+		pool.Stop()
+	}
+}
+
+// Get returns a pool by name, or nil
+func (pr *PoolRegistry) Get(name string) *balancer.Pool {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return pr.pools[name]
+}
+
+// Pools returns all pools sorted by name
+func (pr *PoolRegistry) Pools() []*balancer.Pool {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	pools := make([]*balancer.Pool, 0, len(pr.pools))
+	for _, pool := range pr.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name() < pools[j].Name()
+	})
+	return pools
+}
+
+// RouteMatch is the outcome of resolving a request to a pool
+type RouteMatch struct {
+	Pool              *balancer.Pool
+	Reason            string      // "routes[N]", "virtual-host:<host>" or "default-pool"
+	Route             string      // the matched route's identity, kept when routes are reordered; "" when no route matched
+	RequireClientCert bool        // the matched route only accepts verified client certificates
+	EarlyData         string      // the matched route's 0-RTT policy, "" for the default
+	MaxBodySize       int64       // the matched route's body limit, 0 for the global one
+	BodyBuffering     string      // the matched route's buffering mode, "" for the global one
+	Access            *accessList // the matched route's client address lists, nil for none
+	RequireJWT        bool        // the matched route only accepts valid bearer tokens
+	ForwardAuth       bool        // the matched route asks the forward auth service
+	BasicAuth         bool        // the matched route needs a basic auth user
+	CORS              *corsPolicy // the matched route's cross-origin policy, nil for none
+
+	SecurityHeaders *SecurityHeadersConfig // the matched route's security header overrides, nil for none
+}
+
+// Resolve picks the pool for a request: routing rules first, then the Host
+// header, then the TLS SNI name, and finally the configured default pool
+func (pr *PoolRegistry) Resolve(r *http.Request) *balancer.Pool {
+	return pr.Match(r).Pool
+}
+
+// ResolveWithReason is Resolve that also describes what selected the pool
+func (pr *PoolRegistry) ResolveWithReason(r *http.Request) (*balancer.Pool, string) {
+	m := pr.Match(r)
+	return m.Pool, m.Reason
+}
+
+// Match resolves a request like Resolve and reports the matched route's requirements
+func (pr *PoolRegistry) Match(r *http.Request) RouteMatch {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	for i, rt := range pr.routes {
+		if rt.matches(r) {
+			if pool, ok := pr.pools[rt.pool]; ok {
+				return RouteMatch{Pool: pool, Reason: fmt.Sprintf("routes[%d]", i), Route: rt.id, RequireClientCert: rt.requireClientCert, EarlyData: rt.earlyData,
+					MaxBodySize: rt.maxBodySize, BodyBuffering: rt.bodyBuffering, Access: rt.access, RequireJWT: rt.requireJWT,
+					ForwardAuth: rt.forwardAuth, BasicAuth: rt.basicAuth, CORS: rt.cors, SecurityHeaders: rt.securityHeaders}
+			}
+		}
+	}
+
+	host := normalizeHost(r.Host)
+	if host == "" && r.TLS != nil {
+		host = normalizeHost(r.TLS.ServerName)
+	}
+
+	if name, ok := pr.lookupHost(host); ok {
+		if pool, ok := pr.pools[name]; ok {
+			return RouteMatch{Pool: pool, Reason: "virtual-host:" + host}
+		}
+	}
+	if pool, ok := pr.pools[pr.fallback]; ok {
+		return RouteMatch{Pool: pool, Reason: "default-pool"}
+	}
+	return RouteMatch{Pool: pr.pools[defaultPoolName], Reason: "default-pool"}
+}
+
+func (pr *PoolRegistry) lookupHost(host string) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	if name, ok := pr.exactHosts[host]; ok {
+		return name, true
+	}
+	for _, w := range pr.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.pool, true
+		}
+	}
+	return "", false
+}
+
+// Hosts returns the virtual hosts routed to each pool
+func (pr *PoolRegistry) Hosts() map[string][]string {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	hosts := make(map[string][]string)
+	for host, pool := range pr.exactHosts {
+		hosts[pool] = append(hosts[pool], host)
+	}
+	for _, w := range pr.wildcards {
+		hosts[w.pool] = append(hosts[w.pool], "*"+w.suffix)
+	}
+	for _, list := range hosts {
+		sort.Strings(list)
+	}
+	return hosts
+}
+
+// Fallback returns the name of the pool used when nothing matches
+func (pr *PoolRegistry) Fallback() string {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return pr.fallback
+}
+
+// normalizeHost lowercases a host and strips any port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Apply reconciles the pools and virtual hosts with cfg: pools and backends
+// are created or removed as needed, existing backends keep their state.
+func (pr *PoolRegistry) Apply(cfg *Config) {
+	pr.buffers.SetSize(cfg.Streaming.BufferSize)
+
+	// Removed pools are stopped after the lock is released, since stopping
+	// waits for in-flight health probes
+	var removed []*balancer.Pool
+	defer func() {
+		for _, pool := range removed {
+			pool.Stop()
+		}
+	}()
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	wanted := make(map[string]PoolConfig)
+	for _, pc := range cfg.AllPools() {
+		wanted[pc.Name] = pc
+	}
+
+	// Drop pools that are no longer configured
+	for name, pool := range pr.pools {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+		for _, backend := range pool.Backends() {
+			pool.RemoveBackend(backend.URL.String())
+			pr.router.RemoveBackend(backend)
+		}
+		removed = append(removed, pool)
+		delete(pr.pools, name)
+		log.Printf("🗑️ Pool %s removed", name)
+	}
+
+	for _, pc := range cfg.AllPools() {
+		pool, ok := pr.pools[pc.Name]
+		if !ok {
+			pool = balancer.NewPool(pc.settings(pr.transportFor(pc.Protocol), pr.buffers))
+			pr.pools[pc.Name] = pool
+			pool.StartHealthChecks(pr.ctx)
+			log.Printf("🏊 Pool %s created (algorithm: %s, session cookie: %s)", pc.Name, pc.Algorithm, pc.SessionCookie)
+		} else if pool.Configure(pc.settings(pr.transportFor(pc.Protocol), pr.buffers)) {
+			pool.StartHealthChecks(pr.ctx)
+		}
+		pool.ReconcileBackends(pc.backendURLs(), pr.router)
+	}
+
+	pr.exactHosts = make(map[string]string)
+	pr.wildcards = nil
+	for _, vh := range cfg.VirtualHosts {
+		for _, host := range vh.Hosts {
+			host = normalizeHost(host)
+			if suffix, ok := strings.CutPrefix(host, "*"); ok {
+				pr.wildcards = append(pr.wildcards, wildcardHost{suffix: suffix, pool: vh.Pool})
+			} else {
+				pr.exactHosts[host] = vh.Pool
+			}
+		}
+	}
+	sort.Slice(pr.wildcards, func(i, j int) bool {
+		return len(pr.wildcards[i].suffix) > len(pr.wildcards[j].suffix)
+	})
+
+	// Patterns are checked by Validate, so MustCompile cannot panic here
+	pr.routes = nil
+	for _, rt := range cfg.Routes {
+		route := routeRule{id: rt.identity(), prefix: strings.TrimSuffix(rt.PathPrefix, "*"), pool: rt.Pool, requireClientCert: rt.RequireClientCert, earlyData: rt.EarlyData,
+			maxBodySize: rt.MaxBodySize, bodyBuffering: rt.BodyBuffering, access: compileAccess(rt.Access), requireJWT: rt.RequireJWT,
+			forwardAuth: rt.ForwardAuth, basicAuth: rt.BasicAuth, cors: compileCORS(rt.CORS), securityHeaders: rt.SecurityHeaders}
+		if rt.PathRegex != "" {
+			route.re = regexp.MustCompile(rt.PathRegex)
+		}
+		if len(rt.Methods) > 0 {
+			route.methods = make(map[string]bool)
+			for _, method := range rt.Methods {
+				route.methods[strings.ToUpper(method)] = true
+			}
+		}
+		route.headers = compileValueMatches(rt.Headers, http.CanonicalHeaderKey)
+		if len(rt.Countries) > 0 {
+			route.countries = make(map[string]bool)
+			for _, code := range rt.Countries {
+				route.countries[code] = true
+			}
+		}
+		if len(rt.ASNs) > 0 {
+			route.asns = make(map[uint]bool)
+			for _, asn := range rt.ASNs {
+				route.asns[asn] = true
+			}
+		}
+		route.query = compileValueMatches(rt.Query, nil)
+		pr.routes = append(pr.routes, route)
+	}
+
+	pr.fallback = cfg.DefaultPool
+	if pr.fallback == "" {
+		pr.fallback = defaultPoolName
+	}
+}
+
+// compileValueMatches turns a name -> pattern map into matchers sorted by name
+func compileValueMatches(patterns map[string]string, canonical func(string) string) []valueMatch {
+	var matches []valueMatch
+	for name, pattern := range patterns {
+		if canonical != nil {
+			name = canonical(name)
+		}
+		m := valueMatch{name: name}
+		if pattern != "" {
+			m.re = regexp.MustCompile(pattern)
+		}
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].name < matches[j].name
+	})
+	return matches
+}
+
+// settings converts the pool config into balancer settings
+func (pc PoolConfig) settings(transport http.RoundTripper, buffers *balancer.BufferPool) balancer.PoolSettings {
+	return balancer.PoolSettings{
+		Name:           pc.Name,
+		Algorithm:      pc.Algorithm,
+		SessionCookie:  pc.SessionCookie,
+		HealthCheck:    pc.HealthCheck,
+		HealthCheckKey: pc.healthCheckKey(),
+		Transport:      transport,
+		Protocol:       pc.Protocol,
+		GRPCWeb:        pc.GRPCWeb,
+		Cache:          pc.Cache,
+		Buffers:        buffers,
+	}
+}
+
+// healthCheckKey resolves the key signing health probes; Validate has
+// already checked it
+func (pc PoolConfig) healthCheckKey() []byte {
+	if pc.HealthCheck.SigningKeyRef == "" {
+		return nil
+	}
+	secret, err := resolveSecret(pc.HealthCheck.SigningKeyRef)
+	if err != nil {
+		log.Printf("⚠️ Pool %s health checks unsigned: %v", pc.Name, err)
+		return nil
+	}
+	return bytes.TrimSpace(secret)
+}
+
+// backendURLs parses the pool's backend URLs; Validate has already checked them
+func (pc PoolConfig) backendURLs() []*url.URL {
+	urls := make([]*url.URL, 0, len(pc.Backends))
+	for _, b := range pc.Backends {
+		u, _ := url.Parse(b.URL)
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// handlePools serves GET /api/pools with per-pool settings and stats
+func (s *Server) handlePools(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cfg := s.config.Current()
+	hosts := s.pools.Hosts()
+	var pools []map[string]interface{}
+	for _, pool := range s.pools.Pools() {
+		settings := pool.Settings()
+		pools = append(pools, map[string]interface{}{
+			"name":           pool.Name(),
+			"hosts":          hosts[pool.Name()],
+			"session_cookie": settings.SessionCookie,
+			"protocol":       settings.Protocol,
+			"grpc_web":       settings.GRPCWeb,
+			"cache":          settings.Cache,
+			"health_check":   settings.HealthCheck,
+			"stats":          pool.GetStats(),
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pools":        pools,
+		"routes":       cfg.Routes,
+		"default_pool": s.pools.Fallback(),
+		"timestamp":    time.Now(),
+	})
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extensible Priorities (RFC 9218) defaults and range
+const (
+	defaultUrgency = 3
+	maxUrgency     = 7
+)
+
+// PriorityConfig schedules the requests multiplexed on one client connection
+// by their RFC 9218 priority. PRIORITY_UPDATE frames are consumed by the
+// HTTP/2 and HTTP/3 servers without being surfaced, so only the Priority
+// request header is used.
+type PriorityConfig struct {
+	MaxConcurrentStreams int `json:"max_concurrent_streams,omitempty"` // Requests per client connection proxied at once, the rest wait in urgency order; 0 disables scheduling
+}
+
+// validate checks the priority scheduling settings
+func (pc *PriorityConfig) validate() []error {
+	if pc.MaxConcurrentStreams < 0 {
+		return []error{fmt.Errorf("priority.max_concurrent_streams %d must not be negative", pc.MaxConcurrentStreams)}
+	}
+	return nil
+}
+
+// Priority is a request's urgency (0 most urgent to 7) and whether its
+// response is useful when delivered incrementally
+type Priority struct {
+	Urgency     int
+	Incremental bool
+}
+
+// String formats the priority as a Priority header value
+func (p Priority) String() string {
+	if p.Incremental {
+		return fmt.Sprintf("u=%d, i", p.Urgency)
+	}
+	return fmt.Sprintf("u=%d", p.Urgency)
+}
+
+// parsePriority reads the Priority header, a structured field dictionary.
+// Unknown members and out of range values are ignored as RFC 9218 requires.
+func parsePriority(h http.Header) Priority {
+	p := Priority{Urgency: defaultUrgency}
+	for _, value := range h.Values("Priority") {
+		for _, member := range strings.Split(value, ",") {
+			// Parameters of a member (";x=y") carry nothing for u and i
+			member, _, _ = strings.Cut(strings.TrimSpace(member), ";")
+			key, val, hasValue := strings.Cut(member, "=")
+			switch key {
+			case "u":
+				if u, err := strconv.Atoi(val); err == nil && u >= 0 && u <= maxUrgency {
+					p.Urgency = u
+				}
+			case "i":
+				switch {
+				case !hasValue || val == "?1":
+					p.Incremental = true
+				case val == "?0":
+					p.Incremental = false
+				}
+			}
+		}
+	}
+	return p
+}
+
+// PriorityScheduler limits the requests of each client connection that are
+// proxied at once. Waiting requests are admitted most urgent first and in
+// arrival order within an urgency, so CSS and JS a page blocks on overtake
+// images and downloads requested on the same connection.
+type PriorityScheduler struct {
+	mu    sync.Mutex
+	limit int
+	conns map[string]*priorityQueue // client connection -> its requests
+	seq   uint64
+
+	stats [maxUrgency + 1]urgencyStats
+}
+
+// urgencyStats counts the requests scheduled at one urgency
+type urgencyStats struct {
+	requests int64
+	queued   int64
+	waited   time.Duration
+}
+
+// priorityQueue holds a connection's running and waiting requests
+type priorityQueue struct {
+	active  int
+	waiting waiterHeap
+}
+
+// priorityWaiter is a request waiting for a slot; ready is closed on admission
+type priorityWaiter struct {
+	priority Priority
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+// waiterHeap orders waiters by urgency, then arrival
+type waiterHeap []*priorityWaiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority.Urgency != h[j].priority.Urgency {
+		return h[i].priority.Urgency < h[j].priority.Urgency
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *waiterHeap) Push(x any) {
+	w := x.(*priorityWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// NewPriorityScheduler creates a scheduler; a limit of 0 admits everything
+func NewPriorityScheduler(limit int) *PriorityScheduler {
+	return &PriorityScheduler{limit: limit, conns: make(map[string]*priorityQueue)}
+}
+
+// SetLimit changes the per-connection limit and admits waiters it now allows
+func (ps *PriorityScheduler) SetLimit(limit int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.limit = limit
+	for conn, q := range ps.conns {
+		ps.admitLocked(q)
+		if q.active == 0 && q.waiting.Len() == 0 {
+			delete(ps.conns, conn)
+		}
+	}
+}
+
+// Acquire waits until the request may be proxied on its connection and
+// returns the function that frees its slot. It fails when ctx ends first.
+func (ps *PriorityScheduler) Acquire(ctx context.Context, conn string, p Priority) (func(), error) {
+	ps.mu.Lock()
+	stats := &ps.stats[p.Urgency]
+	stats.requests++
+	if ps.limit == 0 {
+		ps.mu.Unlock()
+		return func() {}, nil
+	}
+	q := ps.conns[conn]
+	if q == nil {
+		q = &priorityQueue{}
+		ps.conns[conn] = q
+	}
+	if q.active < ps.limit && q.waiting.Len() == 0 {
+		q.active++
+		ps.mu.Unlock()
+		return ps.releaseFunc(conn, q), nil
+	}
+
+	ps.seq++
+	w := &priorityWaiter{priority: p, seq: ps.seq, ready: make(chan struct{})}
+	heap.Push(&q.waiting, w)
+	stats.queued++
+	ps.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-w.ready:
+		ps.mu.Lock()
+		stats.waited += time.Since(start)
+		ps.mu.Unlock()
+		return ps.releaseFunc(conn, q), nil
+	case <-ctx.Done():
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		stats.waited += time.Since(start)
+		if w.index >= 0 {
+			heap.Remove(&q.waiting, w.index)
+			if q.active == 0 && q.waiting.Len() == 0 {
+				delete(ps.conns, conn)
+			}
+			return nil, ctx.Err()
+		}
+		// Admitted while giving up; hand the slot on
+		ps.releaseLocked(conn, q)
+		return nil, ctx.Err()
+	}
+}
+
+// releaseFunc returns a function freeing one slot of q exactly once
+func (ps *PriorityScheduler) releaseFunc(conn string, q *priorityQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ps.mu.Lock()
+			defer ps.mu.Unlock()
+			ps.releaseLocked(conn, q)
+		})
+	}
+}
+
+func (ps *PriorityScheduler) releaseLocked(conn string, q *priorityQueue) {
+	q.active--
+	ps.admitLocked(q)
+	if q.active == 0 && q.waiting.Len() == 0 {
+		delete(ps.conns, conn)
+	}
+}
+
+// admitLocked starts the most urgent waiters while q has free slots
+func (ps *PriorityScheduler) admitLocked(q *priorityQueue) {
+	for q.waiting.Len() > 0 && (ps.limit == 0 || q.active < ps.limit) {
+		w := heap.Pop(&q.waiting).(*priorityWaiter)
+		q.active++
+		close(w.ready)
+	}
+}
+
+// Snapshot reports the limit, the current queue and per-urgency counters
+func (ps *PriorityScheduler) Snapshot() map[string]interface{} {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	active, waiting := 0, 0
+	for _, q := range ps.conns {
+		active += q.active
+		waiting += q.waiting.Len()
+	}
+	urgencies := make([]map[string]interface{}, 0, len(ps.stats))
+	for u, st := range ps.stats {
+		avgWait := 0.0
+		if st.queued > 0 {
+			avgWait = float64(st.waited.Microseconds()) / 1000 / float64(st.queued)
+		}
+		urgencies = append(urgencies, map[string]interface{}{
+			"urgency":     u,
+			"requests":    st.requests,
+			"queued":      st.queued,
+			"avg_wait_ms": avgWait,
+		})
+	}
+	return map[string]interface{}{
+		"max_concurrent_streams": ps.limit,
+		"connections":            len(ps.conns),
+		"active":                 active,
+		"waiting":                waiting,
+		"urgencies":              urgencies,
+	}
+}
+
+// incrementalWriter flushes after every write so incremental responses
+// reach the client as the backend produces them
+type incrementalWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newIncrementalWriter wraps w when it can flush, otherwise returns w
+func newIncrementalWriter(w http.ResponseWriter) http.ResponseWriter {
+	if f, ok := w.(http.Flusher); ok {
+		return &incrementalWriter{ResponseWriter: w, flusher: f}
+	}
+	return w
+}
+
+func (w *incrementalWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.flusher.Flush()
+	return n, err
+}
+
+func (w *incrementalWriter) Flush() {
+	w.flusher.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *incrementalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// handlePriority serves GET /api/priority with the scheduler state
+func (s *Server) handlePriority(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.priority.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// defaultQPACKEstimateCapacity is the dynamic table size compression
+// estimates assume when max_table_capacity is not set (RFC 9204 examples
+// and most browsers use 4 KiB)
+const defaultQPACKEstimateCapacity = 4096
+
+// qpackEntryOverhead is the per-entry overhead a dynamic table counts
+// against its capacity (RFC 9204 section 3.2.1)
+const qpackEntryOverhead = 32
+
+// QPACKConfig tunes HTTP/3 header compression. Moodle requests repeat the
+// same long cookies, user agent and accept headers on every request, which
+// the QPACK static table cannot compress.
+type QPACKConfig struct {
+	MaxTableCapacity    uint64 `json:"max_table_capacity,omitempty"`     // Dynamic table capacity in bytes; estimates assume 4096 when unset
+	BlockedStreams      uint64 `json:"blocked_streams,omitempty"`        // Streams that may wait on dynamic table updates
+	MaxFieldSectionSize int    `json:"max_field_section_size,omitempty"` // Largest request header section accepted and advertised, default 1 MiB
+}
+
+// validate checks the QPACK settings
+func (qc *QPACKConfig) validate() []error {
+	var errs []error
+	if qc.MaxTableCapacity > 1<<30 {
+		errs = append(errs, fmt.Errorf("qpack.max_table_capacity %d must be at most 1 GiB", qc.MaxTableCapacity))
+	}
+	if qc.BlockedStreams > 1<<16 {
+		errs = append(errs, fmt.Errorf("qpack.blocked_streams %d must be at most 65536", qc.BlockedStreams))
+	}
+	if qc.MaxFieldSectionSize < 0 {
+		errs = append(errs, fmt.Errorf("qpack.max_field_section_size %d must not be negative", qc.MaxFieldSectionSize))
+	}
+	return errs
+}
+
+// estimateCapacity returns the dynamic table size used for estimates
+func (qc *QPACKConfig) estimateCapacity() uint64 {
+	if qc.MaxTableCapacity == 0 {
+		return defaultQPACKEstimateCapacity
+	}
+	return qc.MaxTableCapacity
+}
+
+// configure applies the QPACK settings to the HTTP/3 server. quic-go decodes
+// field sections with the static table only, so a dynamic table is never
+// advertised: clients would reference entries the server cannot decode.
+// The configured capacity still drives the savings estimate.
+func (qc *QPACKConfig) configure(h3Server *http3.Server) {
+	h3Server.MaxHeaderBytes = qc.MaxFieldSectionSize
+	if qc.MaxTableCapacity > 0 || qc.BlockedStreams > 0 {
+		log.Printf("⚠️ QPACK max_table_capacity=%d blocked_streams=%d not advertised: the HTTP/3 stack only supports the static table; /api/qpack estimates the savings",
+			qc.MaxTableCapacity, qc.BlockedStreams)
+	}
+}
+
+// HeaderCompressionStats measures how well HTTP/3 request field sections
+// compress with the static table, and estimates the size a per-connection
+// dynamic table would achieve
+type HeaderCompressionStats struct {
+	mu           sync.Mutex
+	sections     int64
+	rawBytes     int64 // HTTP/1.1 wire size of the fields
+	staticBytes  int64 // QPACK encoded size with the static table
+	dynamicBytes int64 // estimated size with a dynamic table, encoder stream included
+	cookieRaw    int64
+	cookieStatic int64
+	largest      int // largest raw section seen
+}
+
+// NewHeaderCompressionStats creates empty header compression metrics
+func NewHeaderCompressionStats() *HeaderCompressionStats {
+	return &HeaderCompressionStats{}
+}
+
+// qpackTableKey is the context key of a connection's *qpackTable
+type qpackTableKey struct{}
+
+// qpackTable simulates one connection's dynamic table: entries are
+// inserted on first use and evicted oldest first
+type qpackTable struct {
+	mu      sync.Mutex
+	entries []qpack.HeaderField
+	index   map[qpack.HeaderField]int
+	size    uint64
+}
+
+// connContext gives each QUIC connection its own simulated table
+func (hs *HeaderCompressionStats) connContext(ctx context.Context, c *quic.Conn) context.Context {
+	return context.WithValue(ctx, qpackTableKey{}, &qpackTable{index: make(map[qpack.HeaderField]int)})
+}
+
+// lookup reports whether f is in the table and otherwise whether it was
+// inserted, evicting old entries to make room; fields larger than capacity
+// are not inserted
+func (t *qpackTable) lookup(f qpack.HeaderField, capacity uint64) (found, inserted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.index[f] > 0 {
+		return true, false
+	}
+	size := uint64(len(f.Name)+len(f.Value)) + qpackEntryOverhead
+	if size > capacity {
+		return false, false
+	}
+	for t.size+size > capacity {
+		evicted := t.entries[0]
+		t.entries = t.entries[1:]
+		t.size -= uint64(len(evicted.Name)+len(evicted.Value)) + qpackEntryOverhead
+		if t.index[evicted]--; t.index[evicted] == 0 {
+			delete(t.index, evicted)
+		}
+	}
+	t.entries = append(t.entries, f)
+	t.index[f]++
+	t.size += size
+	return false, true
+}
+
+// requestFields lists r's field section as an HTTP/3 client sends it, with
+// cookies split into crumbs (RFC 9114 section 4.2.1)
+func requestFields(r *http.Request) []qpack.HeaderField {
+	fields := []qpack.HeaderField{
+		{Name: ":method", Value: r.Method},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: r.Host},
+		{Name: ":path", Value: r.URL.RequestURI()},
+	}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		for _, value := range values {
+			if name == "cookie" {
+				for _, crumb := range strings.Split(value, "; ") {
+					fields = append(fields, qpack.HeaderField{Name: name, Value: crumb})
+				}
+				continue
+			}
+			fields = append(fields, qpack.HeaderField{Name: name, Value: value})
+		}
+	}
+	return fields
+}
+
+// byteCounter counts what the QPACK encoder writes
+type byteCounter int
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// observe records the compression of an HTTP/3 request's field section
+func (hs *HeaderCompressionStats) observe(r *http.Request, qc QPACKConfig) {
+	table, _ := r.Context().Value(qpackTableKey{}).(*qpackTable)
+	capacity := qc.estimateCapacity()
+
+	var counter byteCounter
+	enc := qpack.NewEncoder(&counter)
+	var raw, static, dynamic, cookieRaw, cookieStatic int64
+	for _, f := range requestFields(r) {
+		before := counter
+		enc.WriteField(f)
+		encoded := int64(counter - before)
+		fieldRaw := int64(len(f.Name) + len(f.Value) + len(": \r\n"))
+		raw += fieldRaw
+		static += encoded
+		if f.Name == "cookie" {
+			cookieRaw += fieldRaw
+			cookieStatic += encoded
+		}
+		if table == nil {
+			dynamic += encoded
+			continue
+		}
+		switch found, inserted := table.lookup(f, capacity); {
+		case found:
+			// Indexed field line referencing the dynamic table
+			dynamic += 2
+		case inserted:
+			// Literal on the encoder stream plus the reference to it
+			dynamic += encoded + 2
+		default:
+			dynamic += encoded
+		}
+	}
+	enc.Close()
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.sections++
+	hs.rawBytes += raw
+	hs.staticBytes += static
+	hs.dynamicBytes += dynamic
+	hs.cookieRaw += cookieRaw
+	hs.cookieStatic += cookieStatic
+	if int(raw) > hs.largest {
+		hs.largest = int(raw)
+	}
+}
+
+// compressionRatio returns raw bytes per encoded byte
+func compressionRatio(raw, encoded int64) float64 {
+	if encoded == 0 {
+		return 0
+	}
+	return float64(raw) / float64(encoded)
+}
+
+// Snapshot reports the compression ratios of the observed field sections
+func (hs *HeaderCompressionStats) Snapshot() map[string]interface{} {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	cookieShare := 0.0
+	if hs.rawBytes > 0 {
+		cookieShare = float64(hs.cookieRaw) / float64(hs.rawBytes)
+	}
+	return map[string]interface{}{
+		"field_sections":          hs.sections,
+		"raw_bytes":               hs.rawBytes,
+		"static_bytes":            hs.staticBytes,
+		"static_ratio":            compressionRatio(hs.rawBytes, hs.staticBytes),
+		"estimated_dynamic_bytes": hs.dynamicBytes,
+		"estimated_dynamic_ratio": compressionRatio(hs.rawBytes, hs.dynamicBytes),
+		"cookie_raw_bytes":        hs.cookieRaw,
+		"cookie_static_bytes":     hs.cookieStatic,
+		"cookie_share":            cookieShare,
+		"largest_section_bytes":   hs.largest,
+	}
+}
+
+// handleQPACK serves GET /api/qpack with HTTP/3 header compression metrics
+func (s *Server) handleQPACK(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	qc := s.config.Current().QPACK
+	stats := s.qpack.Snapshot()
+	stats["settings"] = map[string]interface{}{
+		"max_table_capacity":         qc.MaxTableCapacity,
+		"blocked_streams":            qc.BlockedStreams,
+		"max_field_section_size":     qc.MaxFieldSectionSize,
+		"advertised_table_capacity":  0,
+		"advertised_blocked_streams": 0,
+		"estimate_table_capacity":    qc.estimateCapacity(),
+	}
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
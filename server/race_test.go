@@ -0,0 +1,7 @@
+//go:build race
+
+package server
+
+// raceEnabled skips allocation tests under the race detector, which makes
+// sync.Pool drop items at random
+const raceEnabled = true
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Range read-ahead defaults
+const (
+	defaultRangeCacheSize = 64 << 20
+	defaultRangeCacheTTL  = 30 * time.Second
+	rangeFetchTimeout     = 30 * time.Second
+	noRangeRetry          = 5 * time.Minute // how long a resource whose backend ignored Range is passed through
+	maxNoRangeResources   = 16384           // resources remembered as passed through; the oldest are forgotten first
+)
+
+// defaultRangePaths are Moodle's file serving scripts and media types
+// players seek in
+var defaultRangePaths = []string{
+	"/pluginfile.php", "/webservice/pluginfile.php", "/tokenpluginfile.php", "/draftfile.php",
+	".mp4", ".m4v", ".webm", ".mov", ".mp3", ".m4a", ".ogg", ".oga", ".wav", ".pdf",
+}
+
+var (
+	errIgnoresRange  = errors.New("backend ignored the Range header")
+	errNotPartial    = errors.New("backend did not answer with 206 Partial Content")
+	errBlockTooLarge = errors.New("backend sent more than the requested block")
+)
+
+// RangeConfig controls Range requests for course files and static assets.
+// Matching requests always pass through unchanged unless read_ahead is set;
+// then client ranges are served from aligned blocks fetched once, shared by
+// concurrent requests and kept briefly, so seeking in course videos does not
+// cost a backend round trip per player request.
+type RangeConfig struct {
+	Paths     []string          `json:"paths,omitempty"`      // Path prefixes ("/pluginfile.php") or file extensions (".mp4"), default Moodle's file scripts and common media types
+	ReadAhead int64             `json:"read_ahead,omitempty"` // Block size in bytes fetched from backends, e.g. 1048576; 0 passes ranges through
+	CacheSize int64             `json:"cache_size,omitempty"` // Memory for fetched blocks, default 64 MiB
+	CacheTTL  balancer.Duration `json:"cache_ttl,omitempty"`  // How long a fetched block is reused, default 30s
+}
+
+// validate checks the ranges settings
+func (rc *RangeConfig) validate() []error {
+	var errs []error
+	for i, p := range rc.Paths {
+		if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, ".") {
+			errs = append(errs, fmt.Errorf("ranges.paths[%d] %q must be a path prefix (/...) or an extension (.ext)", i, p))
+		}
+	}
+	if rc.ReadAhead < 0 {
+		errs = append(errs, fmt.Errorf("ranges.read_ahead %d must not be negative", rc.ReadAhead))
+	}
+	if rc.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("ranges.cache_size %d must not be negative", rc.CacheSize))
+	} else if rc.ReadAhead > 0 && rc.CacheSize > 0 && rc.CacheSize < rc.ReadAhead {
+		errs = append(errs, fmt.Errorf("ranges.cache_size %d must hold at least one read_ahead block", rc.CacheSize))
+	}
+	if rc.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("ranges.cache_ttl must not be negative"))
+	}
+	return errs
+}
+
+// matches reports whether r is a Range request for a file the config covers
+func (rc *RangeConfig) matches(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") == "" {
+		return false
+	}
+	paths := rc.Paths
+	if len(paths) == 0 {
+		paths = defaultRangePaths
+	}
+	path := strings.ToLower(r.URL.Path)
+	for _, p := range paths {
+		if strings.HasPrefix(p, "/") && strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+		if strings.HasPrefix(p, ".") && strings.HasSuffix(path, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheSize returns the configured block memory or its default
+func (rc *RangeConfig) cacheSize() int64 {
+	if rc.CacheSize == 0 {
+		return defaultRangeCacheSize
+	}
+	return rc.CacheSize
+}
+
+// cacheTTL returns the configured block lifetime or its default
+func (rc *RangeConfig) cacheTTL() time.Duration {
+	if rc.CacheTTL == 0 {
+		return defaultRangeCacheTTL
+	}
+	return rc.CacheTTL.Duration()
+}
+
+// parseSingleRange reads "bytes=first-" or "bytes=first-last"; last is -1
+// when open. Suffix and multiple ranges are left to the backend.
+func parseSingleRange(value string) (first, last int64, ok bool) {
+	spec, found := strings.CutPrefix(value, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	a, b, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || a == "" {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	if b == "" {
+		return first, -1, true
+	}
+	last, err = strconv.ParseInt(b, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// parseContentRange reads "bytes first-last/total" of a 206 response
+func parseContentRange(value string) (first, last, total int64, ok bool) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, size, found := strings.Cut(spec, "/")
+	a, b, found2 := strings.Cut(span, "-")
+	if !found || !found2 {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	first, err1 = strconv.ParseInt(a, 10, 64)
+	last, err2 = strconv.ParseInt(b, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || first > last || last >= total {
+		return 0, 0, 0, false
+	}
+	return first, last, total, true
+}
+
+// RangeCache serves Range requests from read-ahead blocks
+type RangeCache struct {
+	mu           sync.Mutex
+	blocks       map[rangeKey]*rangeBlock
+	lru          *list.List // of rangeKey, most recently used first
+	size         int64
+	inflight     map[rangeKey]*blockFetch
+	noRange      map[string]*list.Element // resource -> its noRangeEntry, passed through until then
+	noRangeOrder *list.List               // of *noRangeEntry, oldest first, which is the order they expire in
+
+	requests    int64
+	hits        int64
+	misses      int64
+	coalesced   int64
+	prefetches  int64
+	fallbacks   int64
+	bytesServed int64
+	bytesFetch  int64
+}
+
+// rangeKey names one block of a resource
+type rangeKey struct {
+	resource string
+	index    int64
+}
+
+// rangeBlock is a fetched block with the representation it belongs to
+type rangeBlock struct {
+	data    []byte
+	total   int64
+	header  http.Header // representation headers of the backend's 206, without cookies
+	expires time.Time
+	elem    *list.Element
+}
+
+// noRangeEntry is a resource whose backend ignored Range, passed through
+// until a deadline
+type noRangeEntry struct {
+	resource string
+	until    time.Time
+}
+
+// blockFetch is a backend request other requests for the same block wait on
+type blockFetch struct {
+	done      chan struct{}
+	block     *rangeBlock
+	setCookie []string
+	err       error
+}
+
+// NewRangeCache creates an empty cache
+func NewRangeCache() *RangeCache {
+	return &RangeCache{
+		blocks:       make(map[rangeKey]*rangeBlock),
+		lru:          list.New(),
+		inflight:     make(map[rangeKey]*blockFetch),
+		noRange:      make(map[string]*list.Element),
+		noRangeOrder: list.New(),
+	}
+}
+
+// rangeResource identifies what a block belongs to. Moodle files depend on
+// the session, so the credentials are part of the key.
+func rangeResource(r *http.Request, pool *balancer.Pool) string {
+	credentials := sha256.Sum256([]byte(strings.Join(r.Header.Values("Cookie"), "; ") + "\x00" + r.Header.Get("Authorization")))
+	return pool.Name() + "\x00" + r.Host + r.URL.RequestURI() + "\x00" + hex.EncodeToString(credentials[:8])
+}
+
+// serve answers a Range request from read-ahead blocks. It returns false
+// without writing anything when the request should be proxied as is.
+func (rc *RangeCache) serve(w http.ResponseWriter, r *http.Request, peer *balancer.Backend, pool *balancer.Pool, cfg RangeConfig) bool {
+	if !cfg.matches(r) {
+		return false
+	}
+	rc.mu.Lock()
+	rc.requests++
+	rc.mu.Unlock()
+
+	first, last, ok := parseSingleRange(r.Header.Get("Range"))
+	if cfg.ReadAhead <= 0 || !ok || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	resource := rangeResource(r, pool)
+	rc.mu.Lock()
+	rc.expireNoRangeLocked(time.Now())
+	_, skip := rc.noRange[resource]
+	if skip {
+		rc.fallbacks++
+	}
+	rc.mu.Unlock()
+	if skip {
+		return false
+	}
+
+	blockSize := cfg.ReadAhead
+	index := first / blockSize
+	block, setCookie, err := rc.block(r, peer, resource, index, cfg)
+	if err != nil {
+		// Backends that ignore ranges are proxied directly for a while
+		rc.mu.Lock()
+		rc.fallbacks++
+		if errors.Is(err, errIgnoresRange) {
+			rc.passThroughLocked(resource, time.Now())
+		}
+		rc.mu.Unlock()
+		return false
+	}
+
+	total := block.total
+	if first >= total {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if last < 0 || last >= total {
+		last = total - 1
+	}
+
+	h := w.Header()
+	for name, values := range block.header {
+		h[name] = append([]string(nil), values...)
+	}
+	for _, cookie := range setCookie {
+		h.Add("Set-Cookie", cookie)
+	}
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, total))
+	h.Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	// The player will most likely read on, so the next block is fetched
+	// while this one is written
+	prefetch := r.Clone(context.WithoutCancel(r.Context()))
+	for pos := first; pos <= last; {
+		if block == nil {
+			if block, _, err = rc.block(r, peer, resource, index, cfg); err != nil || block.total != total ||
+				block.header.Get("Etag") != h.Get("Etag") {
+				// The file changed or the backend failed mid-response
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if next := (index + 1) * blockSize; next < total {
+			rc.prefetch(prefetch, peer, resource, index+1, cfg)
+		}
+
+		start := index * blockSize
+		end := min(last+1-start, int64(len(block.data)))
+		if pos-start >= end {
+			panic(http.ErrAbortHandler)
+		}
+		n, err := w.Write(block.data[pos-start : end])
+		rc.mu.Lock()
+		rc.bytesServed += int64(n)
+		rc.mu.Unlock()
+		if err != nil {
+			return true
+		}
+		pos = start + end
+		index++
+		block = nil
+	}
+	return true
+}
+
+// block returns a block from the cache, from a fetch already underway or
+// from the backend. Set-Cookie headers are only returned to the request
+// that fetched the block.
+func (rc *RangeCache) block(r *http.Request, peer *balancer.Backend, resource string, index int64, cfg RangeConfig) (*rangeBlock, []string, error) {
+	key := rangeKey{resource: resource, index: index}
+	rc.mu.Lock()
+	if b, ok := rc.blocks[key]; ok {
+		if time.Now().Before(b.expires) {
+			rc.lru.MoveToFront(b.elem)
+			rc.hits++
+			rc.mu.Unlock()
+			return b, nil, nil
+		}
+		rc.removeLocked(key, b)
+	}
+	if f, ok := rc.inflight[key]; ok {
+		rc.coalesced++
+		rc.mu.Unlock()
+		<-f.done
+		return f.block, nil, f.err
+	}
+	f := &blockFetch{done: make(chan struct{})}
+	rc.inflight[key] = f
+	rc.misses++
+	rc.mu.Unlock()
+
+	f.block, f.setCookie, f.err = fetchBlock(r, peer, index*cfg.ReadAhead, cfg.ReadAhead)
+
+	rc.mu.Lock()
+	delete(rc.inflight, key)
+	if f.err == nil {
+		rc.bytesFetch += int64(len(f.block.data))
+		cacheControl := strings.ToLower(f.block.header.Get("Cache-Control"))
+		if !strings.Contains(cacheControl, "no-store") && int64(len(f.block.data)) <= cfg.cacheSize() {
+			f.block.expires = time.Now().Add(cfg.cacheTTL())
+			f.block.elem = rc.lru.PushFront(key)
+			rc.blocks[key] = f.block
+			rc.size += int64(len(f.block.data))
+			for rc.size > cfg.cacheSize() {
+				oldest := rc.lru.Back().Value.(rangeKey)
+				rc.removeLocked(oldest, rc.blocks[oldest])
+			}
+		}
+	}
+	rc.mu.Unlock()
+	close(f.done)
+	return f.block, f.setCookie, f.err
+}
+
+// prefetch fetches a block in the background unless it is cached or underway
+func (rc *RangeCache) prefetch(r *http.Request, peer *balancer.Backend, resource string, index int64, cfg RangeConfig) {
+	key := rangeKey{resource: resource, index: index}
+	rc.mu.Lock()
+	b, cached := rc.blocks[key]
+	fresh := cached && time.Now().Before(b.expires)
+	_, underway := rc.inflight[key]
+	if !fresh && !underway {
+		rc.prefetches++
+	}
+	rc.mu.Unlock()
+	if fresh || underway {
+		return
+	}
+	go rc.block(r, peer, resource, index, cfg)
+}
+
+func (rc *RangeCache) removeLocked(key rangeKey, b *rangeBlock) {
+	rc.lru.Remove(b.elem)
+	delete(rc.blocks, key)
+	rc.size -= int64(len(b.data))
+}
+
+// fetchBlock asks the backend for bytes [start, start+size) of r's file
+// through the backend's reverse proxy, so forwarding headers and transport
+// are the same as for proxied requests
+func fetchBlock(r *http.Request, peer *balancer.Backend, start, size int64) (block *rangeBlock, setCookie []string, err error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), rangeFetchTimeout)
+	defer cancel()
+	out := r.Clone(ctx)
+	out.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+size-1))
+	out.Header.Del("If-Range")
+
+	bw := &blockWriter{header: make(http.Header), limit: size}
+	func() {
+		// The proxy aborts with http.ErrAbortHandler when the block writer
+		// refuses the body
+		defer func() {
+			if v := recover(); v != nil && v != http.ErrAbortHandler {
+				panic(v)
+			}
+		}()
+		peer.ReverseProxy.ServeHTTP(bw, out)
+	}()
+	if bw.err != nil {
+		return nil, nil, bw.err
+	}
+	switch bw.status {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, nil, errIgnoresRange
+	default:
+		return nil, nil, errNotPartial
+	}
+	first, last, total, ok := parseContentRange(bw.header.Get("Content-Range"))
+	if !ok || first != start || last-first+1 != int64(bw.buf.Len()) {
+		return nil, nil, fmt.Errorf("unexpected Content-Range %q for %d bytes", bw.header.Get("Content-Range"), bw.buf.Len())
+	}
+
+	setCookie = bw.header.Values("Set-Cookie")
+	for _, name := range []string{"Set-Cookie", "Content-Range", "Content-Length", "Date", "Connection", "Transfer-Encoding"} {
+		bw.header.Del(name)
+	}
+	return &rangeBlock{data: bw.buf.Bytes(), total: total, header: bw.header}, setCookie, nil
+}
+
+// blockWriter collects a backend's 206 response for one block
+type blockWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	limit  int64
+	err    error
+}
+
+func (bw *blockWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *blockWriter) WriteHeader(code int) {
+	// 1xx responses are not part of a block
+	if code >= 200 && bw.status == 0 {
+		bw.status = code
+	}
+}
+
+func (bw *blockWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	switch {
+	case bw.status == http.StatusOK:
+		bw.err = errIgnoresRange
+	case bw.status != http.StatusPartialContent:
+		bw.err = errNotPartial
+	case int64(bw.buf.Len()+len(b)) > bw.limit:
+		bw.err = errBlockTooLarge
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	return bw.buf.Write(b)
+}
+
+// passThroughLocked passes resource through for noRangeRetry, forgetting
+// the oldest resource when maxNoRangeResources are remembered; callers
+// hold mu
+func (rc *RangeCache) passThroughLocked(resource string, now time.Time) {
+	if elem, ok := rc.noRange[resource]; ok {
+		rc.noRangeOrder.Remove(elem)
+		delete(rc.noRange, resource)
+	}
+	for len(rc.noRange) >= maxNoRangeResources {
+		oldest := rc.noRangeOrder.Remove(rc.noRangeOrder.Front()).(*noRangeEntry)
+		delete(rc.noRange, oldest.resource)
+	}
+	rc.noRange[resource] = rc.noRangeOrder.PushBack(&noRangeEntry{resource: resource, until: now.Add(noRangeRetry)})
+}
+
+// expireNoRangeLocked forgets the passed through resources whose time is
+// up, so ranges of them are tried again; callers hold mu
+func (rc *RangeCache) expireNoRangeLocked(now time.Time) {
+	for elem := rc.noRangeOrder.Front(); elem != nil; elem = rc.noRangeOrder.Front() {
+		entry := elem.Value.(*noRangeEntry)
+		if now.Before(entry.until) {
+			return
+		}
+		rc.noRangeOrder.Remove(elem)
+		delete(rc.noRange, entry.resource)
+	}
+}
+
+// Snapshot reports request, cache and byte counters
+func (rc *RangeCache) Snapshot() map[string]interface{} {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return map[string]interface{}{
+		"range_requests": rc.requests,
+		"hits":           rc.hits,
+		"misses":         rc.misses,
+		"coalesced":      rc.coalesced,
+		"prefetches":     rc.prefetches,
+		"fallbacks":      rc.fallbacks,
+		"bytes_served":   rc.bytesServed,
+		"bytes_fetched":  rc.bytesFetch,
+		"cached_blocks":  len(rc.blocks),
+		"cached_bytes":   rc.size,
+		"passed_through": len(rc.noRange),
+	}
+}
+
+// handleRanges serves GET /api/ranges with the read-ahead counters
+func (s *Server) handleRanges(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.ranges.Snapshot()
+	stats["read_ahead"] = s.config.Current().Ranges.ReadAhead
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Resources whose backend ignored Range are forgotten once their time is
+// up, and the oldest go first when too many are remembered
+func TestRangeCachePassThroughBounded(t *testing.T) {
+	rc := NewRangeCache()
+	start := time.Now()
+
+	for i := range maxNoRangeResources + 100 {
+		rc.passThroughLocked(fmt.Sprintf("resource-%d", i), start)
+	}
+	if len(rc.noRange) != maxNoRangeResources || rc.noRangeOrder.Len() != maxNoRangeResources {
+		t.Fatalf("%d resources remembered (%d in order), want %d", len(rc.noRange), rc.noRangeOrder.Len(), maxNoRangeResources)
+	}
+	if _, ok := rc.noRange["resource-0"]; ok {
+		t.Error("the oldest resource was kept over the limit")
+	}
+	if _, ok := rc.noRange[fmt.Sprintf("resource-%d", maxNoRangeResources+99)]; !ok {
+		t.Error("the newest resource was not remembered")
+	}
+
+	// Marking a resource again moves it to the back with a new deadline
+	later := start.Add(noRangeRetry / 2)
+	rc.passThroughLocked("resource-100", later)
+	rc.expireNoRangeLocked(start.Add(noRangeRetry))
+	if len(rc.noRange) != 1 {
+		t.Fatalf("%d resources remembered after the retry time, want 1", len(rc.noRange))
+	}
+	if _, ok := rc.noRange["resource-100"]; !ok {
+		t.Error("the resource marked again expired with its first deadline")
+	}
+	rc.expireNoRangeLocked(later.Add(noRangeRetry))
+	if len(rc.noRange) != 0 || rc.noRangeOrder.Len() != 0 {
+		t.Errorf("%d resources remembered after every deadline", len(rc.noRange))
+	}
+}
@@ -0,0 +1,440 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"quic-moodle/balancer"
+)
+
+// Rate limit counter stores
+const (
+	rateLimitMemory = "memory"
+	rateLimitRedis  = "redis"
+)
+
+// Rate limiting defaults
+const (
+	defaultRateLimitRedisPrefix  = "quic-lb:ratelimit:"
+	defaultRateLimitRedisTimeout = 50 * time.Millisecond
+	// rateLimitSweepInterval is how often idle in-memory buckets are dropped
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitConfig limits request rates with token buckets. Each rule keeps
+// one bucket per client IP, session, TLS fingerprint or header value; a
+// request is refused with 429 when any matching rule's bucket is empty.
+// Counters live in memory or, for several load balancer instances sharing
+// limits, in Redis.
+type RateLimitConfig struct {
+	Rules      []RateLimitRule `json:"rules,omitempty"`
+	Store      string          `json:"store,omitempty"`       // "memory" (default) or "redis"
+	Redis      RedisConfig     `json:"redis,omitempty"`       // Used with store "redis"
+	FailClosed bool            `json:"fail_closed,omitempty"` // Refuse requests with 503 while Redis is unreachable; by default they are allowed
+}
+
+// RateLimitRule is one token bucket per key
+type RateLimitRule struct {
+	Name       string  `json:"name"`
+	Key        string  `json:"key"`                   // "ip", "session" (the pool's session cookie), "ja4" or "ja3" (TLS fingerprint) or "header:<Name>"; requests without the session, fingerprint or header skip the rule
+	Rate       float64 `json:"rate"`                  // Tokens added per second
+	Burst      int     `json:"burst,omitempty"`       // Bucket size, default the rate rounded up
+	PathPrefix string  `json:"path_prefix,omitempty"` // Only requests below this path count, e.g. "/login/"
+}
+
+// RedisConfig locates the Redis server shared by load balancer instances
+type RedisConfig struct {
+	Addr        string            `json:"addr,omitempty"` // "redis:6379"
+	Username    string            `json:"username,omitempty"`
+	PasswordRef string            `json:"password_ref,omitempty"` // Secret reference, e.g. "env:REDIS_PASSWORD"
+	DB          int               `json:"db,omitempty"`
+	KeyPrefix   string            `json:"key_prefix,omitempty"` // Prepended to bucket keys, default "quic-lb:ratelimit:"
+	Timeout     balancer.Duration `json:"timeout,omitempty"`    // Per-request budget for Redis, default 50ms
+}
+
+// validate checks the rate limiting settings
+func (rc *RateLimitConfig) validate() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, rule := range rc.Rules {
+		prefix := fmt.Sprintf("rate_limit.rules[%d]", i)
+		if rule.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is required", prefix))
+		} else if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("%s.name %q is used twice", prefix, rule.Name))
+		}
+		names[rule.Name] = true
+		switch header, isHeader := strings.CutPrefix(rule.Key, "header:"); {
+		case rule.Key == "ip" || rule.Key == "session" || rule.Key == "ja4" || rule.Key == "ja3":
+		case isHeader && header != "":
+		default:
+			errs = append(errs, fmt.Errorf("%s.key %q must be \"ip\", \"session\", \"ja4\", \"ja3\" or \"header:<Name>\"", prefix, rule.Key))
+		}
+		if rule.Rate <= 0 {
+			errs = append(errs, fmt.Errorf("%s.rate must be positive", prefix))
+		}
+		if rule.Burst < 0 {
+			errs = append(errs, fmt.Errorf("%s.burst %d must not be negative", prefix, rule.Burst))
+		}
+	}
+	switch rc.Store {
+	case "", rateLimitMemory:
+	case rateLimitRedis:
+		if rc.Redis.Addr == "" {
+			errs = append(errs, fmt.Errorf("rate_limit.redis.addr is required with store \"redis\""))
+		}
+		if rc.Redis.PasswordRef != "" {
+			if _, err := resolveSecret(rc.Redis.PasswordRef); err != nil {
+				errs = append(errs, fmt.Errorf("rate_limit.redis.password_ref: %v", err))
+			}
+		}
+		if rc.Redis.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.redis.timeout must not be negative"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit.store %q must be \"memory\" or \"redis\"", rc.Store))
+	}
+	return errs
+}
+
+// burst returns the configured bucket size or its default
+func (rule *RateLimitRule) burst() int {
+	if rule.Burst == 0 {
+		return int(math.Max(1, math.Ceil(rule.Rate)))
+	}
+	return rule.Burst
+}
+
+// key returns the bucket key of r for the rule, or "" when the rule does
+// not apply to r
+func (rule *RateLimitRule) key(r *http.Request, sessionKey string) string {
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return ""
+	}
+	var value string
+	switch {
+	case rule.Key == "ip":
+		value, _, _ = net.SplitHostPort(r.RemoteAddr)
+		if value == "" {
+			value = r.RemoteAddr
+		}
+	case rule.Key == "session":
+		value = sessionKey
+	case rule.Key == "ja4" || rule.Key == "ja3":
+		if fp, ok := fingerprintFromRequest(r); ok {
+			value = fp.JA4
+			if rule.Key == "ja3" {
+				value = fp.JA3
+			}
+		}
+	default:
+		value = r.Header.Get(strings.TrimPrefix(rule.Key, "header:"))
+	}
+	if value == "" {
+		return ""
+	}
+	return rule.Name + ":" + value
+}
+
+// rateLimitStore takes tokens from buckets
+type rateLimitStore interface {
+	// take removes a token from key's bucket; when it is empty, it returns
+	// how long until the next token
+	take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+	Close() error
+}
+
+// memoryBuckets keeps token buckets of this instance
+type memoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket is one key's bucket
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket is full again and can be dropped
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	return &memoryBuckets{buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+func (m *memoryBuckets) take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.swept) >= rateLimitSweepInterval {
+		m.swept = now
+		for k, b := range m.buckets {
+			if now.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	allowed, wait := true, time.Duration(0)
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		allowed = false
+		wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return allowed, wait, nil
+}
+
+func (m *memoryBuckets) Close() error {
+	return nil
+}
+
+// redisTokenBucket refills and takes from a bucket atomically, using the
+// Redis server's clock so instances with skewed clocks agree. It returns
+// whether a token was taken and otherwise the wait in milliseconds.
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// redisBuckets keeps token buckets in Redis, shared by all instances
+type redisBuckets struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// newRedisClient connects to the Redis server of rc; section names the
+// config section in errors
+func newRedisClient(rc RedisConfig, section string) (*redis.Client, error) {
+	var password string
+	if rc.PasswordRef != "" {
+		secret, err := resolveSecret(rc.PasswordRef)
+		if err != nil {
+			return nil, fmt.Errorf("%s.redis.password_ref: %v", section, err)
+		}
+		password = strings.TrimSpace(string(secret))
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     rc.Addr,
+		Username: rc.Username,
+		Password: password,
+		DB:       rc.DB,
+	}), nil
+}
+
+func newRedisBuckets(rc RedisConfig) (*redisBuckets, error) {
+	client, err := newRedisClient(rc, "rate_limit")
+	if err != nil {
+		return nil, err
+	}
+	prefix := rc.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRateLimitRedisPrefix
+	}
+	timeout := rc.Timeout.Duration()
+	if timeout == 0 {
+		timeout = defaultRateLimitRedisTimeout
+	}
+	return &redisBuckets{client: client, prefix: prefix, timeout: timeout}, nil
+}
+
+func (rb *redisBuckets) take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, rb.timeout)
+	defer cancel()
+	result, err := redisTokenBucket.Run(ctx, rb.client, []string{rb.prefix + key}, rate, burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket reply %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (rb *redisBuckets) Close() error {
+	return rb.client.Close()
+}
+
+// RateLimiter applies the configured rules
+type RateLimiter struct {
+	mu         sync.RWMutex
+	cfg        RateLimitConfig
+	store      rateLimitStore
+	storeName  string
+	redis      RedisConfig // settings the Redis store was created with
+	limited    map[string]int64
+	allowed    int64
+	storeError int64
+	lastError  string
+}
+
+// NewRateLimiter creates a limiter without rules
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{store: newMemoryBuckets(), storeName: rateLimitMemory, limited: make(map[string]int64)}
+}
+
+// Configure applies new rules, switching the counter store when it changed.
+// Memory buckets survive rule changes; a rule whose rate changed refills
+// its buckets at the new rate.
+func (rl *RateLimiter) Configure(cfg RateLimitConfig) {
+	storeName := cfg.Store
+	if storeName == "" {
+		storeName = rateLimitMemory
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+	if storeName == rl.storeName && (storeName == rateLimitMemory || cfg.Redis == rl.redis) {
+		return
+	}
+
+	var store rateLimitStore = newMemoryBuckets()
+	if storeName == rateLimitRedis {
+		rb, err := newRedisBuckets(cfg.Redis)
+		if err != nil {
+			log.Printf("⚠️ Rate limiting keeps the %s store: %v", rl.storeName, err)
+			return
+		}
+		store = rb
+	}
+	rl.store.Close()
+	rl.store, rl.storeName, rl.redis = store, storeName, cfg.Redis
+	log.Printf("🚦 Rate limit counters in %s (%d rule(s))", storeName, len(cfg.Rules))
+}
+
+// Close releases the counter store
+func (rl *RateLimiter) Close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.store.Close()
+}
+
+// allow checks r against every matching rule. It answers refused requests
+// with 429 and Retry-After, or 503 when the store failed and fail_closed is
+// set, and reports whether r may proceed.
+func (rl *RateLimiter) allow(w http.ResponseWriter, r *http.Request, sessionKey string) bool {
+	rl.mu.RLock()
+	cfg, store := rl.cfg, rl.store
+	rl.mu.RUnlock()
+	if len(cfg.Rules) == 0 {
+		return true
+	}
+
+	for _, rule := range cfg.Rules {
+		key := rule.key(r, sessionKey)
+		if key == "" {
+			continue
+		}
+		ok, wait, err := store.take(r.Context(), key, rule.Rate, rule.burst())
+		if err != nil {
+			rl.mu.Lock()
+			rl.storeError++
+			rl.lastError = err.Error()
+			rl.mu.Unlock()
+			if cfg.FailClosed {
+				http.Error(w, "🚫 Rate limiting unavailable", http.StatusServiceUnavailable)
+				return false
+			}
+			continue
+		}
+		if ok {
+			continue
+		}
+
+		rl.mu.Lock()
+		rl.limited[rule.Name]++
+		rl.mu.Unlock()
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		log.Printf("🚦 Rate limited %s %s from %s by rule %s, retry in %ds", r.Method, r.URL.Path, r.RemoteAddr, rule.Name, retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		w.Header().Set("X-RateLimit-Rule", rule.Name)
+		http.Error(w, "🚦 Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+
+	rl.mu.Lock()
+	rl.allowed++
+	rl.mu.Unlock()
+	return true
+}
+
+// Snapshot reports refused requests per rule and store health
+func (rl *RateLimiter) Snapshot() map[string]interface{} {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	rules := make([]map[string]interface{}, 0, len(rl.cfg.Rules))
+	for _, rule := range rl.cfg.Rules {
+		rules = append(rules, map[string]interface{}{
+			"name":        rule.Name,
+			"key":         rule.Key,
+			"rate":        rule.Rate,
+			"burst":       rule.burst(),
+			"path_prefix": rule.PathPrefix,
+			"limited":     rl.limited[rule.Name],
+		})
+	}
+	stats := map[string]interface{}{
+		"store":        rl.storeName,
+		"fail_closed":  rl.cfg.FailClosed,
+		"allowed":      rl.allowed,
+		"store_errors": rl.storeError,
+		"rules":        rules,
+	}
+	if rl.lastError != "" {
+		stats["last_store_error"] = rl.lastError
+	}
+	if buckets, ok := rl.store.(*memoryBuckets); ok {
+		buckets.mu.Lock()
+		stats["buckets"] = len(buckets.buckets)
+		buckets.mu.Unlock()
+	}
+	return stats
+}
+
+// handleRateLimit serves GET /api/rate-limit with refused requests per rule
+func (s *Server) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.rateLimiter.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A bucket allows its burst at once and then refills at the rate
+func TestMemoryBucketsTake(t *testing.T) {
+	m := newMemoryBuckets()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := m.take(ctx, "login:192.0.2.1", 20, 2); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait, _ := m.take(ctx, "login:192.0.2.1", 20, 2)
+	if ok || wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("empty bucket: allowed %v, wait %v; want refused for up to 50ms", ok, wait)
+	}
+	if ok, _, _ := m.take(ctx, "login:192.0.2.2", 20, 2); !ok {
+		t.Error("another key shares the bucket")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _, _ := m.take(ctx, "login:192.0.2.1", 20, 2); !ok {
+		t.Error("bucket not refilled")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.Configure(RateLimitConfig{Rules: []RateLimitRule{
+		{Name: "login", Key: "ip", Rate: 0.001, Burst: 2, PathPrefix: "/login/"},
+		{Name: "api", Key: "header:X-Api-Client", Rate: 0.001, Burst: 1},
+	}})
+	request := func(path, remote, client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.RemoteAddr = remote
+		if client != "" {
+			r.Header.Set("X-Api-Client", client)
+		}
+		w := httptest.NewRecorder()
+		rl.allow(w, r, "")
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		remote string
+		client string
+		status int
+	}{
+		{"first login", "/login/index.php", "192.0.2.1:5000", "", http.StatusOK},
+		{"second login from another port", "/login/index.php", "192.0.2.1:5001", "", http.StatusOK},
+		{"third login", "/login/index.php", "192.0.2.1:5002", "", http.StatusTooManyRequests},
+		{"login from another client", "/login/index.php", "192.0.2.2:5000", "", http.StatusOK},
+		{"outside the path prefix", "/course/view.php", "192.0.2.1:5000", "", http.StatusOK},
+		{"first api call", "/webservice/", "192.0.2.1:5000", "app", http.StatusOK},
+		{"second api call", "/webservice/", "192.0.2.3:5000", "app", http.StatusTooManyRequests},
+		{"without the header", "/webservice/", "192.0.2.3:5000", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.path, tt.remote, tt.client)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Code == http.StatusTooManyRequests && (w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Rule") == "") {
+				t.Errorf("429 without Retry-After or X-RateLimit-Rule: %v", w.Header())
+			}
+		})
+	}
+
+	rules := rl.Snapshot()["rules"].([]map[string]interface{})
+	if rules[0]["limited"] != int64(1) || rules[1]["limited"] != int64(1) {
+		t.Errorf("rules %v, want one refusal each", rules)
+	}
+}
+
+// Requests pass while Redis is unreachable unless fail_closed is set
+func TestRateLimiterStoreDown(t *testing.T) {
+	rule := RateLimitRule{Name: "all", Key: "ip", Rate: 1}
+	redisDown := RedisConfig{Addr: "127.0.0.1:1"}
+	for _, failClosed := range []bool{false, true} {
+		rl := NewRateLimiter()
+		rl.Configure(RateLimitConfig{Rules: []RateLimitRule{rule}, Store: rateLimitRedis, Redis: redisDown, FailClosed: failClosed})
+		w := httptest.NewRecorder()
+		allowed := rl.allow(w, httptest.NewRequest(http.MethodGet, "/", nil), "")
+		if allowed == failClosed || (failClosed && w.Code != http.StatusServiceUnavailable) {
+			t.Errorf("fail_closed %v: allowed %v with status %d", failClosed, allowed, w.Code)
+		}
+		if stats := rl.Snapshot(); stats["store_errors"] != int64(1) || stats["store"] != rateLimitRedis {
+			t.Errorf("fail_closed %v: stats %v, want one store error in redis", failClosed, stats)
+		}
+		rl.Close()
+	}
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  RateLimitConfig
+		err  string
+	}{
+		{"valid", RateLimitConfig{Rules: []RateLimitRule{{Name: "login", Key: "ip", Rate: 1}, {Name: "bots", Key: "ja4", Rate: 5}}}, ""},
+		{"missing name", RateLimitConfig{Rules: []RateLimitRule{{Key: "ip", Rate: 1}}}, "name is required"},
+		{"duplicate name", RateLimitConfig{Rules: []RateLimitRule{{Name: "a", Key: "ip", Rate: 1}, {Name: "a", Key: "ip", Rate: 1}}}, `rules[1].name "a" is used twice`},
+		{"unknown key", RateLimitConfig{Rules: []RateLimitRule{{Name: "a", Key: "cookie", Rate: 1}}}, "key \"cookie\""},
+		{"empty header", RateLimitConfig{Rules: []RateLimitRule{{Name: "a", Key: "header:", Rate: 1}}}, "key \"header:\""},
+		{"zero rate", RateLimitConfig{Rules: []RateLimitRule{{Name: "a", Key: "ip"}}}, "rate must be positive"},
+		{"redis without addr", RateLimitConfig{Store: rateLimitRedis}, "redis.addr is required"},
+		{"unknown store", RateLimitConfig{Store: "etcd"}, `store "etcd"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.cfg.validate()
+			if tt.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("errors %v, want none", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+				t.Errorf("errors %v, want one containing %q", errs, tt.err)
+			}
+		})
+	}
+}
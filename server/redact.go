@@ -0,0 +1,121 @@
+package server
+
+import "strings"
+
+// redactedValue replaces secrets in API responses
+const redactedValue = "<redacted>"
+
+// redactConfig returns a copy of cfg safe to serve from the admin API:
+// tokens, API keys, password hashes and inline key material are replaced,
+// secret references only name where the secret lives
+func redactConfig(cfg *Config) *Config {
+	if cfg == nil {
+		return nil
+	}
+	out := cloneConfig(cfg)
+	if out == cfg {
+		// The round trip failed; never serve the original
+		return &Config{}
+	}
+
+	redactTLSConfig(&out.TLS)
+	for name, profile := range out.TLSProfiles {
+		redactTLSConfig(&profile)
+		out.TLSProfiles[name] = profile
+	}
+	out.Admin.Token = redactSecret(out.Admin.Token)
+	out.Admin.TokenRef = redactSecretRef(out.Admin.TokenRef)
+	for i := range out.Admin.APIKeys {
+		out.Admin.APIKeys[i].Key = redactSecret(out.Admin.APIKeys[i].Key)
+		out.Admin.APIKeys[i].KeyRef = redactSecretRef(out.Admin.APIKeys[i].KeyRef)
+	}
+	out.QUICLB.KeyRef = redactSecretRef(out.QUICLB.KeyRef)
+	out.RateLimit.Redis.PasswordRef = redactSecretRef(out.RateLimit.Redis.PasswordRef)
+	out.ForwardAuth.SessionSecretRef = redactSecretRef(out.ForwardAuth.SessionSecretRef)
+	out.SessionState.KeyRef = redactSecretRef(out.SessionState.KeyRef)
+	out.LoadBalancer.HealthCheck.SigningKeyRef = redactSecretRef(out.LoadBalancer.HealthCheck.SigningKeyRef)
+	for i := range out.Pools {
+		out.Pools[i].HealthCheck.SigningKeyRef = redactSecretRef(out.Pools[i].HealthCheck.SigningKeyRef)
+	}
+	for user, hash := range out.BasicAuth.Users {
+		out.BasicAuth.Users[user] = redactSecret(hash)
+	}
+	return out
+}
+
+// redactTLSConfig hides inline private keys of a TLS profile
+func redactTLSConfig(tc *TLSConfig) {
+	tc.KeyRef = redactSecretRef(tc.KeyRef)
+	for i := range tc.Certificates {
+		tc.Certificates[i].KeyRef = redactSecretRef(tc.Certificates[i].KeyRef)
+	}
+}
+
+// redactSecret replaces a set secret
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// restoreRedacted puts the running secrets back into a config submitted to
+// the admin API, so a config fetched from it can be edited and sent back.
+// Redacted values are matched by position in the config: API keys by name,
+// basic auth users by user, pools by name.
+func restoreRedacted(cfg, current *Config) {
+	restoreTLSConfig(&cfg.TLS, &current.TLS)
+	for name, profile := range cfg.TLSProfiles {
+		if running, ok := current.TLSProfiles[name]; ok {
+			restoreTLSConfig(&profile, &running)
+			cfg.TLSProfiles[name] = profile
+		}
+	}
+	restoreSecret(&cfg.Admin.Token, current.Admin.Token)
+	restoreSecret(&cfg.Admin.TokenRef, current.Admin.TokenRef)
+	for i := range cfg.Admin.APIKeys {
+		for _, running := range current.Admin.APIKeys {
+			if running.Name == cfg.Admin.APIKeys[i].Name {
+				restoreSecret(&cfg.Admin.APIKeys[i].Key, running.Key)
+				restoreSecret(&cfg.Admin.APIKeys[i].KeyRef, running.KeyRef)
+			}
+		}
+	}
+	restoreSecret(&cfg.QUICLB.KeyRef, current.QUICLB.KeyRef)
+	restoreSecret(&cfg.RateLimit.Redis.PasswordRef, current.RateLimit.Redis.PasswordRef)
+	restoreSecret(&cfg.ForwardAuth.SessionSecretRef, current.ForwardAuth.SessionSecretRef)
+	restoreSecret(&cfg.SessionState.KeyRef, current.SessionState.KeyRef)
+	restoreSecret(&cfg.LoadBalancer.HealthCheck.SigningKeyRef, current.LoadBalancer.HealthCheck.SigningKeyRef)
+	for i := range cfg.Pools {
+		for _, running := range current.Pools {
+			if running.Name == cfg.Pools[i].Name {
+				restoreSecret(&cfg.Pools[i].HealthCheck.SigningKeyRef, running.HealthCheck.SigningKeyRef)
+			}
+		}
+	}
+	for user, hash := range cfg.BasicAuth.Users {
+		if hash == redactedValue {
+			cfg.BasicAuth.Users[user] = current.BasicAuth.Users[user]
+		}
+	}
+}
+
+// restoreTLSConfig restores the inline private keys of a TLS profile;
+// additional certificates are matched by cert_file
+func restoreTLSConfig(tc, running *TLSConfig) {
+	restoreSecret(&tc.KeyRef, running.KeyRef)
+	for i := range tc.Certificates {
+		for _, cert := range running.Certificates {
+			if cert.CertFile == tc.Certificates[i].CertFile {
+				restoreSecret(&tc.Certificates[i].KeyRef, cert.KeyRef)
+			}
+		}
+	}
+}
+
+// restoreSecret sets *field to running when it holds a redacted value
+func restoreSecret(field *string, running string) {
+	if *field == redactedValue || (strings.HasSuffix(*field, ":"+redactedValue) && redactSecretRef(running) == *field) {
+		*field = running
+	}
+}
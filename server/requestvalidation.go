@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Absolute-form request target handling
+const (
+	absoluteFormNormalize = "normalize"
+	absoluteFormReject    = "reject"
+)
+
+// connectionSpecificHeaders are hop-by-hop fields that are malformed in
+// HTTP/2 (RFC 9113 section 8.2.2) and HTTP/3 (RFC 9114 section 4.2)
+var connectionSpecificHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// RequestValidationConfig rejects requests that the load balancer and a
+// backend could frame or route differently, the root of request smuggling.
+// The HTTP/1.1 parser already refuses conflicting Content-Length values and
+// drops Content-Length when chunked framing is used, so backends only ever
+// see one framing; these checks cover what reaches the handler.
+type RequestValidationConfig struct {
+	Disabled     bool   `json:"disabled,omitempty"`      // Skip these checks
+	AbsoluteForm string `json:"absolute_form,omitempty"` // "normalize" (default) rewrites http://host/path targets to /path, "reject" refuses them
+}
+
+// validate checks the request validation settings
+func (vc *RequestValidationConfig) validate() []error {
+	switch vc.AbsoluteForm {
+	case "", absoluteFormNormalize, absoluteFormReject:
+		return nil
+	}
+	return []error{fmt.Errorf("request_validation.absolute_form %q must be \"normalize\" or \"reject\"", vc.AbsoluteForm)}
+}
+
+// RequestValidator applies the checks and counts rejected requests
+type RequestValidator struct {
+	mu  sync.RWMutex
+	cfg RequestValidationConfig
+
+	statsMu    sync.Mutex
+	rejected   map[string]int64 // reason -> requests
+	normalized int64
+}
+
+// NewRequestValidator creates a validator with the default checks
+func NewRequestValidator() *RequestValidator {
+	return &RequestValidator{rejected: make(map[string]int64)}
+}
+
+// Configure applies new settings
+func (rv *RequestValidator) Configure(cfg RequestValidationConfig) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.cfg = cfg
+}
+
+// check validates r against one snapshot of the settings, normalizing an
+// absolute-form target in place. Invalid requests are answered with 400
+// and the connection is not reused.
+func (rv *RequestValidator) check(w http.ResponseWriter, r *http.Request) bool {
+	rv.mu.RLock()
+	cfg := rv.cfg
+	rv.mu.RUnlock()
+	if cfg.Disabled {
+		return true
+	}
+
+	reason, detail := requestViolation(r)
+	if reason == "" && isAbsoluteForm(r) {
+		if cfg.AbsoluteForm == absoluteFormReject {
+			reason, detail = "absolute_form", r.RequestURI
+		} else {
+			// The authority already became r.Host
+			r.URL.Scheme, r.URL.Host = "", ""
+			r.RequestURI = r.URL.RequestURI()
+			rv.statsMu.Lock()
+			rv.normalized++
+			rv.statsMu.Unlock()
+		}
+	}
+	if reason == "" {
+		return true
+	}
+
+	rv.statsMu.Lock()
+	rv.rejected[reason]++
+	rv.statsMu.Unlock()
+	log.Printf("🧹 Rejected %s request from %s: %s (%s)", r.Proto, r.RemoteAddr, strings.ReplaceAll(reason, "_", " "), detail)
+	// A client sending ambiguous framing may have more of it queued
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
+	http.Error(w, "Bad Request", http.StatusBadRequest)
+	return false
+}
+
+// isAbsoluteForm reports whether an HTTP/1 request target was http://host/path
+func isAbsoluteForm(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.Method != http.MethodConnect && !strings.HasPrefix(r.RequestURI, "/") && r.URL.Host != ""
+}
+
+// requestViolation returns why r is ambiguous, or "" when it is not
+func requestViolation(r *http.Request) (reason, detail string) {
+	if !httpguts.ValidHostHeader(r.Host) {
+		return "invalid_host", r.Host
+	}
+	// HTTP/2 and HTTP/3 carry the authority in a pseudo-header; a Host
+	// header naming another host routes differently depending on who reads it
+	if host := r.Header.Get("Host"); host != "" && !strings.EqualFold(host, r.Host) {
+		return "conflicting_host", host + " vs " + r.Host
+	}
+	if r.Method != http.MethodConnect && !strings.HasPrefix(r.URL.Path, "/") && r.URL.Path != "" &&
+		!(r.Method == http.MethodOptions && r.RequestURI == "*") {
+		return "invalid_target", r.URL.Path
+	}
+
+	for name, values := range r.Header {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return "invalid_header_name", strconv.Quote(name)
+		}
+		for _, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return "invalid_header_value", name
+			}
+		}
+	}
+
+	if lengths := r.Header.Values("Content-Length"); len(lengths) > 0 {
+		for _, value := range lengths {
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil || n < 0 || strings.TrimSpace(value) != strings.TrimSpace(lengths[0]) {
+				return "conflicting_content_length", strings.Join(lengths, ", ")
+			}
+		}
+		if len(r.TransferEncoding) > 0 {
+			return "content_length_with_transfer_encoding", strings.Join(r.TransferEncoding, ", ")
+		}
+	}
+
+	if r.ProtoMajor >= 2 {
+		for _, name := range connectionSpecificHeaders {
+			if _, ok := r.Header[name]; ok {
+				return "connection_specific_header", name
+			}
+		}
+		// TE is only allowed as "trailers"
+		if te := r.Header.Values("Te"); len(te) > 0 && (len(te) > 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "trailers")) {
+			return "connection_specific_header", "TE"
+		}
+	}
+	return "", ""
+}
+
+// Snapshot reports rejected and normalized requests
+func (rv *RequestValidator) Snapshot() map[string]interface{} {
+	rv.mu.RLock()
+	cfg := rv.cfg
+	rv.mu.RUnlock()
+	rv.statsMu.Lock()
+	defer rv.statsMu.Unlock()
+
+	rejected := make(map[string]int64, len(rv.rejected))
+	var total int64
+	for reason, n := range rv.rejected {
+		rejected[reason] = n
+		total += n
+	}
+	absoluteForm := cfg.AbsoluteForm
+	if absoluteForm == "" {
+		absoluteForm = absoluteFormNormalize
+	}
+	return map[string]interface{}{
+		"enabled":        !cfg.Disabled,
+		"absolute_form":  absoluteForm,
+		"rejected":       rejected,
+		"rejected_total": total,
+		"normalized":     rv.normalized,
+	}
+}
+
+// handleRequestValidation serves GET /api/request-validation with the
+// rejected requests per reason
+func (s *Server) handleRequestValidation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.requestValidator.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
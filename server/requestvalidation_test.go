@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testRequest builds a request as the server would hand it to the
+// handler for protoMajor 1, 2 or 3
+func testRequest(protoMajor int, method, target string, header map[string][]string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.ProtoMajor, r.ProtoMinor = protoMajor, 0
+	switch protoMajor {
+	case 1:
+		r.Proto, r.ProtoMinor = "HTTP/1.1", 1
+	case 2:
+		r.Proto = "HTTP/2.0"
+	case 3:
+		r.Proto = "HTTP/3.0"
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	return r
+}
+
+func TestRequestViolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      *http.Request
+		reason string
+	}{
+		{"plain request", testRequest(1, "GET", "/course/view.php?id=2", nil), ""},
+		{"OPTIONS *", testRequest(1, "OPTIONS", "*", nil), ""},
+
+		// Framing
+		{"content-length with chunked", func() *http.Request {
+			r := testRequest(1, "POST", "/upload", map[string][]string{"Content-Length": {"5"}})
+			r.TransferEncoding = []string{"chunked"}
+			return r
+		}(), "content_length_with_transfer_encoding"},
+		{"identical content-lengths", testRequest(1, "POST", "/upload", map[string][]string{"Content-Length": {"5", "5"}}), ""},
+		{"differing content-lengths", testRequest(1, "POST", "/upload", map[string][]string{"Content-Length": {"5", "6"}}), "conflicting_content_length"},
+		{"content-length list", testRequest(1, "POST", "/upload", map[string][]string{"Content-Length": {"5, 5"}}), "conflicting_content_length"},
+		{"negative content-length", testRequest(1, "POST", "/upload", map[string][]string{"Content-Length": {"-1"}}), "conflicting_content_length"},
+		{"differing content-lengths on h2", testRequest(2, "POST", "/upload", map[string][]string{"Content-Length": {"5", "6"}}), "conflicting_content_length"},
+
+		// Header syntax
+		{"obs-fold", testRequest(1, "GET", "/", map[string][]string{"X-Forwarded-For": {"192.0.2.1\r\n 10.0.0.1"}}), "invalid_header_value"},
+		{"NUL in value", testRequest(1, "GET", "/", map[string][]string{"X-Trace": {"a\x00b"}}), "invalid_header_value"},
+		{"DEL in value", testRequest(3, "GET", "/", map[string][]string{"X-Trace": {"a\x7fb"}}), "invalid_header_value"},
+		{"tab in value", testRequest(1, "GET", "/", map[string][]string{"X-Trace": {"a\tb"}}), ""},
+		{"space in name", testRequest(1, "GET", "/", map[string][]string{"Transfer-Encoding ": {"chunked"}}), "invalid_header_name"},
+		{"control character in name", testRequest(2, "GET", "/", map[string][]string{"X-\x01": {"1"}}), "invalid_header_name"},
+
+		// Authority
+		{"invalid host", func() *http.Request {
+			r := testRequest(1, "GET", "/", nil)
+			r.Host = "a b.example"
+			return r
+		}(), "invalid_host"},
+		{"host differs from :authority on h2", testRequest(2, "GET", "/", map[string][]string{"Host": {"admin.internal"}}), "conflicting_host"},
+		{"host differs from :authority on h3", testRequest(3, "GET", "/", map[string][]string{"Host": {"admin.internal"}}), "conflicting_host"},
+		{"host matches :authority in another case", testRequest(2, "GET", "/", map[string][]string{"Host": {"EXAMPLE.com"}}), ""},
+		{"relative target", func() *http.Request {
+			r := testRequest(1, "GET", "/", nil)
+			r.URL.Path = "course/view.php"
+			return r
+		}(), "invalid_target"},
+
+		// Connection-specific fields are malformed in HTTP/2 and HTTP/3
+		{"connection on h1", testRequest(1, "GET", "/", map[string][]string{"Connection": {"keep-alive"}}), ""},
+		{"connection on h2", testRequest(2, "GET", "/", map[string][]string{"Connection": {"keep-alive"}}), "connection_specific_header"},
+		{"keep-alive on h3", testRequest(3, "GET", "/", map[string][]string{"Keep-Alive": {"timeout=5"}}), "connection_specific_header"},
+		{"proxy-connection on h2", testRequest(2, "GET", "/", map[string][]string{"Proxy-Connection": {"close"}}), "connection_specific_header"},
+		{"transfer-encoding on h3", testRequest(3, "POST", "/", map[string][]string{"Transfer-Encoding": {"chunked"}}), "connection_specific_header"},
+		{"upgrade on h2", testRequest(2, "GET", "/", map[string][]string{"Upgrade": {"websocket"}}), "connection_specific_header"},
+		{"te trailers on h2", testRequest(2, "GET", "/", map[string][]string{"Te": {"trailers"}}), ""},
+		{"te gzip on h3", testRequest(3, "GET", "/", map[string][]string{"Te": {"gzip"}}), "connection_specific_header"},
+		{"te twice on h2", testRequest(2, "GET", "/", map[string][]string{"Te": {"trailers", "trailers"}}), "connection_specific_header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason, detail := requestViolation(tt.r); reason != tt.reason {
+				t.Errorf("violation %q (%s), want %q", reason, detail, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRequestValidatorAbsoluteForm(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		protoMajor int
+		allowed    bool
+		requestURI string
+	}{
+		{"normalized by default", "", 1, true, "/course/view.php?id=2"},
+		{"normalized", absoluteFormNormalize, 1, true, "/course/view.php?id=2"},
+		{"rejected", absoluteFormReject, 1, false, ""},
+		// HTTP/2 and HTTP/3 targets always carry the scheme and authority
+		{"not absolute-form on h2", absoluteFormReject, 2, true, "http://a.example/course/view.php?id=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rv := NewRequestValidator()
+			rv.Configure(RequestValidationConfig{AbsoluteForm: tt.mode})
+			r := testRequest(tt.protoMajor, "GET", "http://a.example/course/view.php?id=2", nil)
+			w := httptest.NewRecorder()
+			if ok := rv.check(w, r); ok != tt.allowed {
+				t.Fatalf("allowed %v, want %v", ok, tt.allowed)
+			}
+			if !tt.allowed {
+				if w.Code != http.StatusBadRequest || w.Header().Get("Connection") != "close" {
+					t.Errorf("answered %d with Connection %q, want 400 and close", w.Code, w.Header().Get("Connection"))
+				}
+				return
+			}
+			if r.RequestURI != tt.requestURI || r.Host != "a.example" {
+				t.Errorf("target %q host %q, want %q on a.example", r.RequestURI, r.Host, tt.requestURI)
+			}
+		})
+	}
+}
+
+func TestRequestValidatorCounts(t *testing.T) {
+	rv := NewRequestValidator()
+	rv.check(httptest.NewRecorder(), testRequest(2, "GET", "/", map[string][]string{"Connection": {"close"}}))
+	rv.check(httptest.NewRecorder(), testRequest(1, "GET", "http://a.example/", nil))
+	rv.check(httptest.NewRecorder(), testRequest(1, "GET", "/", nil))
+
+	stats := rv.Snapshot()
+	rejected := stats["rejected"].(map[string]int64)
+	if rejected["connection_specific_header"] != 1 || stats["rejected_total"] != int64(1) || stats["normalized"] != int64(1) {
+		t.Errorf("stats %v, want one rejected and one normalized", stats)
+	}
+
+	// Disabled checks let anything through
+	rv.Configure(RequestValidationConfig{Disabled: true})
+	if !rv.check(httptest.NewRecorder(), testRequest(2, "GET", "/", map[string][]string{"Connection": {"close"}})) {
+		t.Error("disabled validator rejected a request")
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// internalResponseHeaders describe the load balancer's internals: backend
+// addresses, health, routing and connection details. They help debugging
+// but tell clients how the fleet is built, so they are removed from
+// responses unless exposed by response_headers.
+var internalResponseHeaders = []string{
+	"X-Load-Balanced",
+	"X-Backend-ID",
+	"X-Backend-URL",
+	"X-Backend-Connections",
+	"X-Health-Score",
+	"X-Circuit-Breaker",
+	"X-LB-Pool",
+	"X-LB-Algorithm",
+	"X-Routing-Method",
+	"X-Session-Key",
+	"X-QUIC-LB-Compliant",
+	"X-QUIC-LB-Draft",
+	"X-Quic-Connection-Id",
+	"X-Connection-ID",
+	"X-Remote-Addr",
+	"X-Protocol",
+	"X-Server-Protocol",
+	"X-Enhanced-Features",
+	"X-Migration-Support",
+	"X-Path-Validation",
+	"X-Connection-Multiplexing",
+	"X-RateLimit-Rule",
+}
+
+// ResponseHeadersConfig controls which headers reach clients
+type ResponseHeadersConfig struct {
+	ExposeInternal []string          `json:"expose_internal,omitempty"` // Internal headers still sent to every client, "*" for all
+	DebugClients   []string          `json:"debug_clients,omitempty"`   // CIDRs or addresses that get all internal headers
+	Remove         []string          `json:"remove,omitempty"`          // Further headers removed from every response, e.g. Server or X-Powered-By
+	Set            map[string]string `json:"set,omitempty"`             // Headers set on every response, replacing the backend's value
+}
+
+// validate checks the response header policy
+func (rc *ResponseHeadersConfig) validate() []error {
+	var errs []error
+	for i, name := range rc.ExposeInternal {
+		if name != "*" && !isInternalResponseHeader(name) {
+			errs = append(errs, fmt.Errorf("response_headers.expose_internal[%d] %q is not an internal header", i, name))
+		}
+	}
+	for i, entry := range rc.DebugClients {
+		if _, err := parseAccessEntry(entry); err != nil {
+			errs = append(errs, fmt.Errorf("response_headers.debug_clients[%d]: %v", i, err))
+		}
+	}
+	for name := range rc.Set {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			errs = append(errs, fmt.Errorf("response_headers.set: %q is not a valid header name", name))
+		}
+	}
+	return errs
+}
+
+// isInternalResponseHeader reports whether name is one of internalResponseHeaders
+func isInternalResponseHeader(name string) bool {
+	for _, internal := range internalResponseHeaders {
+		if strings.EqualFold(name, internal) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseHeaderPolicy is a compiled ResponseHeadersConfig
+type responseHeaderPolicy struct {
+	strip        []string // internal headers not exposed, and the remove list
+	debugClients []netip.Prefix
+	set          map[string]string
+	security     SecurityHeadersConfig
+}
+
+// ResponseHeaders applies the response header policy to public responses
+type ResponseHeaders struct {
+	mu     sync.RWMutex
+	policy *responseHeaderPolicy
+}
+
+// NewResponseHeaders creates a policy that strips every internal header
+func NewResponseHeaders() *ResponseHeaders {
+	rh := &ResponseHeaders{}
+	rh.Configure(ResponseHeadersConfig{}, SecurityHeadersConfig{})
+	return rh
+}
+
+// Configure replaces the policy and the global security headers
+func (rh *ResponseHeaders) Configure(cfg ResponseHeadersConfig, security SecurityHeadersConfig) {
+	policy := &responseHeaderPolicy{set: cfg.Set, security: security}
+	exposeAll := false
+	exposed := make(map[string]bool)
+	for _, name := range cfg.ExposeInternal {
+		exposeAll = exposeAll || name == "*"
+		exposed[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range internalResponseHeaders {
+		if !exposeAll && !exposed[http.CanonicalHeaderKey(name)] {
+			policy.strip = append(policy.strip, name)
+		}
+	}
+	policy.strip = append(policy.strip, cfg.Remove...)
+	for _, entry := range cfg.DebugClients {
+		if prefix, err := parseAccessEntry(entry); err == nil {
+			policy.debugClients = append(policy.debugClients, prefix)
+		}
+	}
+
+	rh.mu.Lock()
+	rh.policy = policy
+	rh.mu.Unlock()
+}
+
+// wrap returns w applying the policy to r's response when its headers are
+// written, and r carrying it for the route's security headers
+func (rh *ResponseHeaders) wrap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	rh.mu.RLock()
+	policy := rh.policy
+	rh.mu.RUnlock()
+
+	debug := false
+	if addr, ok := clientAddr(r); ok {
+		for _, prefix := range policy.debugClients {
+			if prefix.Contains(addr) {
+				debug = true
+				break
+			}
+		}
+	}
+	rw := &responseHeaderWriter{ResponseWriter: w, policy: policy, debug: debug, tls: r.TLS != nil}
+	r = withResponseHeaderWriter(r, rw)
+	if streamer, ok := w.(http3.HTTPStreamer); ok {
+		return &responseHeaderStreamer{responseHeaderWriter: rw, streamer: streamer}, r
+	}
+	return rw, r
+}
+
+// responseHeaderWriter strips and sets headers on the final response; 1xx
+// responses such as 103 Early Hints carry only what the backend sent
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	policy  *responseHeaderPolicy
+	debug   bool                   // the client gets the internal headers
+	tls     bool                   // HSTS is only sent over HTTPS
+	route   *SecurityHeadersConfig // the matched route's security header overrides
+	applied bool
+}
+
+func (w *responseHeaderWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.ResponseWriter.Header()
+	for _, name := range w.policy.strip {
+		if w.debug && isInternalResponseHeader(name) {
+			continue
+		}
+		h.Del(name)
+	}
+	for name, value := range w.policy.set {
+		h.Set(name, value)
+	}
+	security := w.policy.security.merged(w.route)
+	security.apply(h, w.tls)
+}
+
+func (w *responseHeaderWriter) WriteHeader(code int) {
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseHeaderWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseHeaderWriter) Flush() {
+	w.apply()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseHeaderStreamer keeps the HTTP/3 stream reachable for extended
+// CONNECT requests proxying datagrams
+type responseHeaderStreamer struct {
+	*responseHeaderWriter
+	streamer http3.HTTPStreamer
+}
+
+func (w *responseHeaderStreamer) HTTPStream() *http3.Stream {
+	return w.streamer.HTTPStream()
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Attack detector defaults
+const (
+	defaultAttackWindow   = 10 * time.Second
+	defaultAttackHoldDown = time.Minute
+)
+
+// AddressValidationConfig decides when new QUIC connections must prove
+// their source address with a Retry round trip (RFC 9000 section 8.1.2)
+// before the server keeps any state for them. Retry costs every client an
+// extra round trip, so with the retry_service feature on it is only
+// required while the rate of new connections or unroutable connection IDs
+// suggests a flood of spoofed Initial packets. New connections are counted
+// as Initial packets without a valid token; a large ClientHello spans two.
+type AddressValidationConfig struct {
+	Always            bool              `json:"always,omitempty"`              // Require Retry for every new connection, not just under attack
+	NewConnectionRate float64           `json:"new_connection_rate,omitempty"` // Initial packets per second without a valid token that count as an attack; 0 ignores them
+	UnroutableCIDRate float64           `json:"unroutable_cid_rate,omitempty"` // Unroutable QUIC-LB connection IDs per second that count as an attack; 0 ignores them
+	Window            balancer.Duration `json:"window,omitempty"`              // Period the rates are averaged over, default 10s
+	HoldDown          balancer.Duration `json:"hold_down,omitempty"`           // How long rates must stay below the thresholds before Retry is no longer required, default 1m
+}
+
+// validate checks the address validation settings
+func (ac *AddressValidationConfig) validate() []error {
+	var errs []error
+	if ac.NewConnectionRate < 0 || ac.UnroutableCIDRate < 0 {
+		errs = append(errs, fmt.Errorf("address_validation rates must not be negative"))
+	}
+	if ac.Window < 0 || ac.HoldDown < 0 {
+		errs = append(errs, fmt.Errorf("address_validation durations must not be negative"))
+	}
+	return errs
+}
+
+// window returns the configured averaging period, at least a second
+func (ac *AddressValidationConfig) window() time.Duration {
+	if ac.Window == 0 {
+		return defaultAttackWindow
+	}
+	return max(ac.Window.Duration(), time.Second)
+}
+
+// holdDown returns the configured hold-down or its default
+func (ac *AddressValidationConfig) holdDown() time.Duration {
+	if ac.HoldDown == 0 {
+		return defaultAttackHoldDown
+	}
+	return ac.HoldDown.Duration()
+}
+
+// attackSample counts events in one second
+type attackSample struct {
+	attempts   int64
+	unroutable int64
+}
+
+// AddressValidation samples new connection attempts and unroutable
+// connection IDs every second and switches Retry on while either rate is
+// above its threshold
+type AddressValidation struct {
+	attempts atomic.Int64 // Initial packets from unvalidated addresses
+	retries  atomic.Int64 // Retry packets requested
+	required atomic.Bool  // new connections must be validated
+
+	mu             sync.Mutex
+	cfg            AddressValidationConfig
+	samples        []attackSample // the last window's seconds, oldest first
+	lastAttempts   int64
+	lastUnroutable int64
+	attemptRate    float64
+	unroutableRate float64
+	enforcing      bool
+	since          time.Time // when enforcement started or, outside it, ended
+	calmSince      time.Time // when rates fell below the thresholds during enforcement
+	reason         string
+	switches       int64
+}
+
+// NewAddressValidation creates a detector that requires no validation
+func NewAddressValidation() *AddressValidation {
+	return &AddressValidation{}
+}
+
+// Configure applies new thresholds
+func (av *AddressValidation) Configure(cfg AddressValidationConfig) {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	av.cfg = cfg
+	av.required.Store(cfg.Always || av.enforcing)
+}
+
+// verify counts an Initial packet from an unvalidated address and reports
+// whether it has to be answered with a Retry
+func (av *AddressValidation) verify(enabled bool) bool {
+	av.attempts.Add(1)
+	if !enabled || !av.required.Load() {
+		return false
+	}
+	av.retries.Add(1)
+	return true
+}
+
+// run samples the rates every second until ctx is done
+func (av *AddressValidation) run(ctx context.Context, enabled func() bool, unroutable func() int64) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			av.sample(enabled(), unroutable())
+		}
+	}
+}
+
+// sample records the last second and starts or ends enforcement
+func (av *AddressValidation) sample(enabled bool, unroutable int64) {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+
+	attempts := av.attempts.Load()
+	s := attackSample{attempts: attempts - av.lastAttempts, unroutable: max(unroutable-av.lastUnroutable, 0)}
+	av.lastAttempts, av.lastUnroutable = attempts, unroutable
+	seconds := int(av.cfg.window() / time.Second)
+	av.samples = append(av.samples, s)
+	if len(av.samples) > seconds {
+		av.samples = av.samples[len(av.samples)-seconds:]
+	}
+
+	var total attackSample
+	for _, s := range av.samples {
+		total.attempts += s.attempts
+		total.unroutable += s.unroutable
+	}
+	av.attemptRate = float64(total.attempts) / float64(len(av.samples))
+	av.unroutableRate = float64(total.unroutable) / float64(len(av.samples))
+
+	reason := ""
+	switch {
+	case av.cfg.NewConnectionRate > 0 && av.attemptRate > av.cfg.NewConnectionRate:
+		reason = fmt.Sprintf("%.1f new connection attempts/s over %v, threshold %.1f", av.attemptRate, av.cfg.window(), av.cfg.NewConnectionRate)
+	case av.cfg.UnroutableCIDRate > 0 && av.unroutableRate > av.cfg.UnroutableCIDRate:
+		reason = fmt.Sprintf("%.1f unroutable connection IDs/s over %v, threshold %.1f", av.unroutableRate, av.cfg.window(), av.cfg.UnroutableCIDRate)
+	}
+
+	now := time.Now()
+	switch {
+	case !enabled && av.enforcing:
+		av.stopLocked(now, "retry_service feature disabled")
+	case !enabled:
+	case reason != "" && !av.enforcing:
+		av.enforcing, av.since, av.calmSince, av.reason = true, now, time.Time{}, reason
+		av.switches++
+		log.Printf("🛡️ Address validation required for new QUIC connections: %s", reason)
+	case reason != "":
+		av.calmSince = time.Time{}
+	case av.enforcing && av.calmSince.IsZero():
+		av.calmSince = now
+	case av.enforcing && now.Sub(av.calmSince) >= av.cfg.holdDown():
+		av.stopLocked(now, fmt.Sprintf("rates below thresholds for %v", av.cfg.holdDown()))
+	}
+	av.required.Store(av.cfg.Always || av.enforcing)
+}
+
+// stopLocked ends enforcement
+func (av *AddressValidation) stopLocked(now time.Time, why string) {
+	log.Printf("🛡️ Address validation no longer required after %v (%s); %d Retry packets requested so far",
+		now.Sub(av.since).Round(time.Second), why, av.retries.Load())
+	av.enforcing, av.since, av.calmSince, av.reason = false, now, time.Time{}, ""
+}
+
+// Snapshot reports the mode, the measured rates and the Retry count
+func (av *AddressValidation) Snapshot() map[string]interface{} {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+
+	mode := "off"
+	switch {
+	case av.cfg.Always:
+		mode = "always"
+	case av.enforcing:
+		mode = "under_attack"
+	case av.cfg.NewConnectionRate > 0 || av.cfg.UnroutableCIDRate > 0:
+		mode = "monitoring"
+	}
+	stats := map[string]interface{}{
+		"mode":                     mode,
+		"retry_required":           av.required.Load(),
+		"unvalidated_initials":     av.attempts.Load(),
+		"retries_requested":        av.retries.Load(),
+		"new_connection_rate":      av.attemptRate,
+		"unroutable_cid_rate":      av.unroutableRate,
+		"new_connection_threshold": av.cfg.NewConnectionRate,
+		"unroutable_cid_threshold": av.cfg.UnroutableCIDRate,
+		"window_seconds":           av.cfg.window().Seconds(),
+		"hold_down_seconds":        av.cfg.holdDown().Seconds(),
+		"mode_switches":            av.switches,
+	}
+	if av.enforcing {
+		stats["under_attack_since"] = av.since
+		stats["reason"] = av.reason
+	}
+	return stats
+}
+
+// verifySourceAddress is the QUIC transport's hook deciding whether an
+// Initial packet without a valid token gets a Retry
+func (s *Server) verifySourceAddress(net.Addr) bool {
+	return s.addressValidation.verify(s.currentFeatures().RetryService)
+}
+
+// handleAddressValidation serves GET /api/address-validation with the
+// attack detector's state
+func (s *Server) handleAddressValidation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.addressValidation.Snapshot()
+	stats["retry_service"] = s.currentFeatures().RetryService
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"quic-moodle/balancer"
+	"quic-moodle/internal/atomicfile"
+)
+
+// Routing state persistence defaults
+const (
+	routingStateFile  = "file"
+	routingStateRedis = "redis"
+
+	defaultRoutingStateInterval = 30 * time.Second
+	defaultRoutingStateMaxAge   = 15 * time.Minute
+	defaultRoutingStateRedisKey = "quic-lb:routing-state"
+	routingStateRedisTimeout    = 2 * time.Second
+)
+
+// RoutingStateConfig saves the session affinity and CID fallback tables
+// periodically and on shutdown, and restores them at startup, so a restart
+// keeps Moodle sessions on their backends. Binary upgrades hand the tables
+// over directly and skip the store. Sessions are sealed with the session
+// state key, so a store requires session_state.key_ref.
+type RoutingStateConfig struct {
+	Store    string            `json:"store,omitempty"`    // "" (off), "file" or "redis"
+	Path     string            `json:"path,omitempty"`     // File written with store "file", e.g. "/var/lib/quic-lb/routing-state.json"
+	Redis    RedisConfig       `json:"redis,omitempty"`    // Used with store "redis"; key_prefix is the key, default "quic-lb:routing-state"
+	Interval balancer.Duration `json:"interval,omitempty"` // How often the tables are saved, default 30s
+	MaxAge   balancer.Duration `json:"max_age,omitempty"`  // Older saved tables are not restored, default 15m
+}
+
+// validate checks the routing state settings. Saved sessions are sealed
+// with the session state key, so persisting them needs a key that outlives
+// the process.
+func (rc *RoutingStateConfig) validate(session SessionStateConfig) []error {
+	var errs []error
+	if rc.Store != "" && session.KeyRef == "" {
+		errs = append(errs, fmt.Errorf("routing_state.store %q needs session_state.key_ref: without it sessions are sealed with a random key and cannot be restored after a restart", rc.Store))
+	}
+	switch rc.Store {
+	case "":
+	case routingStateFile:
+		if rc.Path == "" {
+			errs = append(errs, fmt.Errorf("routing_state.path is required with store \"file\""))
+		}
+	case routingStateRedis:
+		if rc.Redis.Addr == "" {
+			errs = append(errs, fmt.Errorf("routing_state.redis.addr is required with store \"redis\""))
+		}
+		if rc.Redis.PasswordRef != "" {
+			if _, err := resolveSecret(rc.Redis.PasswordRef); err != nil {
+				errs = append(errs, fmt.Errorf("routing_state.redis.password_ref: %v", err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("routing_state.store %q must be \"file\" or \"redis\"", rc.Store))
+	}
+	if rc.Interval < 0 || rc.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("routing_state.interval and max_age must not be negative"))
+	}
+	return errs
+}
+
+// interval returns the configured save interval or its default
+func (rc *RoutingStateConfig) interval() time.Duration {
+	if rc.Interval == 0 {
+		return defaultRoutingStateInterval
+	}
+	return time.Duration(rc.Interval)
+}
+
+// maxAge returns the configured maximum age or its default
+func (rc *RoutingStateConfig) maxAge() time.Duration {
+	if rc.MaxAge == 0 {
+		return defaultRoutingStateMaxAge
+	}
+	return time.Duration(rc.MaxAge)
+}
+
+// routingStateStore keeps one saved copy of the routing state
+type routingStateStore interface {
+	load(ctx context.Context) ([]byte, error) // nil, nil when nothing was saved
+	save(ctx context.Context, state []byte) error
+	Close() error
+}
+
+// newRoutingStateStore opens the configured store, or returns nil when
+// persistence is off
+func newRoutingStateStore(rc RoutingStateConfig) (routingStateStore, error) {
+	switch rc.Store {
+	case routingStateFile:
+		return fileRoutingState(rc.Path), nil
+	case routingStateRedis:
+		client, err := newRedisClient(rc.Redis, "routing_state")
+		if err != nil {
+			return nil, err
+		}
+		key := rc.Redis.KeyPrefix
+		if key == "" {
+			key = defaultRoutingStateRedisKey
+		}
+		return &redisRoutingState{client: client, key: key, ttl: rc.maxAge()}, nil
+	}
+	return nil, nil
+}
+
+// fileRoutingState keeps the routing state in a file, replaced atomically
+type fileRoutingState string
+
+func (path fileRoutingState) load(context.Context) ([]byte, error) {
+	data, err := os.ReadFile(string(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (path fileRoutingState) save(_ context.Context, state []byte) error {
+	return atomicfile.WriteFile(string(path), state, 0o600)
+}
+
+func (path fileRoutingState) Close() error {
+	return nil
+}
+
+// redisRoutingState keeps the routing state under one Redis key that
+// expires once it is too old to restore
+type redisRoutingState struct {
+	client *redis.Client
+	key    string
+	ttl    time.Duration
+}
+
+func (rs *redisRoutingState) load(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, routingStateRedisTimeout)
+	defer cancel()
+	data, err := rs.client.Get(ctx, rs.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (rs *redisRoutingState) save(ctx context.Context, state []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, routingStateRedisTimeout)
+	defer cancel()
+	return rs.client.Set(ctx, rs.key, state, rs.ttl).Err()
+}
+
+func (rs *redisRoutingState) Close() error {
+	return rs.client.Close()
+}
+
+// persistRoutingState restores the saved routing tables unless the previous
+// process handed them over, then saves them every interval until ctx is
+// done and once more at shutdown
+func (s *Server) persistRoutingState(ctx context.Context, cfg RoutingStateConfig, handedOver bool) {
+	store, err := newRoutingStateStore(cfg)
+	if err != nil {
+		log.Printf("⚠️ Routing state not persisted: %v", err)
+		return
+	}
+	if store == nil {
+		return
+	}
+	defer store.Close()
+	if s.sessionState.generatedKey() {
+		log.Printf("⚠️ Saved sessions are sealed with a random key and will not be restored after a restart; set session_state.key_ref")
+	}
+
+	if !handedOver {
+		s.loadRoutingState(ctx, store, cfg.maxAge())
+	}
+
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The run context is gone; the last save gets its own deadline
+			saveCtx, cancel := context.WithTimeout(context.Background(), routingStateRedisTimeout)
+			if err := s.saveRoutingState(saveCtx, store); err != nil {
+				log.Printf("⚠️ Failed to save routing state at shutdown: %v", err)
+			} else {
+				log.Printf("💾 Saved routing state for the next start")
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := s.saveRoutingState(ctx, store); err != nil {
+				log.Printf("⚠️ Failed to save routing state: %v", err)
+			}
+		}
+	}
+}
+
+// saveRoutingState writes the current session and CID tables to store
+func (s *Server) saveRoutingState(ctx context.Context, store routingStateStore) error {
+	data, err := json.Marshal(s.snapshotRoutingState())
+	if err != nil {
+		return err
+	}
+	return store.save(ctx, data)
+}
+
+// loadRoutingState restores the tables saved in store unless they are older
+// than maxAge
+func (s *Server) loadRoutingState(ctx context.Context, store routingStateStore, maxAge time.Duration) {
+	data, err := store.load(ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to load saved routing state: %v", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	var state RoutingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("⚠️ Saved routing state unreadable: %v", err)
+		return
+	}
+	if age := time.Since(state.SavedAt); age > maxAge {
+		log.Printf("💾 Saved routing state is %v old, older than %v; not restored", age.Round(time.Second), maxAge)
+		return
+	}
+	sessions, cids := s.restoreRoutingState(&state)
+	log.Printf("💾 Restored %d sessions and %d CID mappings saved %v ago", sessions, cids, time.Since(state.SavedAt).Round(time.Second))
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretProvider loads the secret named by the part of a reference after the scheme
+type SecretProvider func(name string) ([]byte, error)
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"file": readSecretFile,
+		"env":  readSecretEnv,
+		"cred": readSecretCredential,
+	}
+)
+
+// RegisterSecretProvider adds a reference scheme such as "vault" so config
+// fields can use "vault:<path>"; it replaces any provider for the same scheme
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[scheme] = provider
+}
+
+// secretSchemes lists the registered reference schemes
+func secretSchemes() []string {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+
+	schemes := make([]string, 0, len(secretProviders))
+	for scheme := range secretProviders {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// resolveSecret loads the secret behind a "<scheme>:<name>" reference
+func resolveSecret(ref string) ([]byte, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok || name == "" {
+		// Not a reference, possibly the secret itself: never echo it
+		return nil, fmt.Errorf("secret reference must be <scheme>:<name> (schemes: %s)", strings.Join(secretSchemes(), ", "))
+	}
+
+	secretProvidersMu.RLock()
+	provider, ok := secretProviders[scheme]
+	secretProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported secret reference scheme %q (schemes: %s)", scheme, strings.Join(secretSchemes(), ", "))
+	}
+
+	secret, err := provider(name)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %v", redactSecretRef(ref), err)
+	}
+	return secret, nil
+}
+
+// redactSecretRef returns a reference that is safe to log or echo: inline
+// "hex:" key material is hidden, other references only name where the secret lives
+func redactSecretRef(ref string) string {
+	if strings.HasPrefix(ref, "hex:") {
+		return "hex:" + redactedValue
+	}
+	return ref
+}
+
+func readSecretFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func readSecretEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return []byte(value), nil
+}
+
+// readSecretCredential reads a systemd credential (LoadCredential=) by name
+func readSecretCredential(name string) ([]byte, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, fmt.Errorf("CREDENTIALS_DIRECTORY is not set (is LoadCredential= configured?)")
+	}
+	if strings.ContainsRune(name, '/') {
+		return nil, fmt.Errorf("credential name %q must not contain /", name)
+	}
+	return os.ReadFile(filepath.Join(dir, name))
+}
+
+// resolveKeyRef loads hex-encoded key material. "hex:" references hold the key
+// inline; every other scheme is resolved through resolveSecret.
+func resolveKeyRef(ref string) ([]byte, error) {
+	value := strings.TrimPrefix(ref, "hex:")
+	if value == ref {
+		secret, err := resolveSecret(ref)
+		if err != nil {
+			return nil, err
+		}
+		value = string(secret)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid hex: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// securityHeadersOff drops a globally configured header on one route
+const securityHeadersOff = "off"
+
+// SecurityHeadersConfig adds security headers to responses so every
+// backend gets the same posture. Headers a backend sets itself are kept
+// unless override is on. Routes can override single values, "off" removes
+// a global header for the route.
+type SecurityHeadersConfig struct {
+	HSTS                  string `json:"hsts,omitempty"`                    // Strict-Transport-Security, e.g. "max-age=31536000; includeSubDomains"; sent over HTTPS only
+	ContentTypeOptions    string `json:"content_type_options,omitempty"`    // X-Content-Type-Options, "nosniff"
+	FrameOptions          string `json:"frame_options,omitempty"`           // X-Frame-Options, "DENY" or "SAMEORIGIN"
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"` // Content-Security-Policy
+	ReferrerPolicy        string `json:"referrer_policy,omitempty"`         // Referrer-Policy, e.g. "strict-origin-when-cross-origin"
+	Override              bool   `json:"override,omitempty"`                // Replace the backend's values instead of only filling in missing ones
+}
+
+// validate checks the header values
+func (sc *SecurityHeadersConfig) validate(prefix string) []error {
+	var errs []error
+	for name, value := range sc.headers() {
+		if strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s: %s must be a single line", prefix, name))
+		}
+	}
+	if sc.HSTS != "" && sc.HSTS != securityHeadersOff && !strings.Contains(strings.ToLower(sc.HSTS), "max-age=") {
+		errs = append(errs, fmt.Errorf("%s.hsts %q needs a max-age directive", prefix, sc.HSTS))
+	}
+	switch strings.ToUpper(sc.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN", "OFF":
+	default:
+		errs = append(errs, fmt.Errorf("%s.frame_options %q must be DENY, SAMEORIGIN or off", prefix, sc.FrameOptions))
+	}
+	return errs
+}
+
+// headers maps response header names to the configured values
+func (sc *SecurityHeadersConfig) headers() map[string]string {
+	return map[string]string{
+		"Strict-Transport-Security": sc.HSTS,
+		"X-Content-Type-Options":    sc.ContentTypeOptions,
+		"X-Frame-Options":           sc.FrameOptions,
+		"Content-Security-Policy":   sc.ContentSecurityPolicy,
+		"Referrer-Policy":           sc.ReferrerPolicy,
+	}
+}
+
+// merged returns sc with the values route sets replacing sc's
+func (sc SecurityHeadersConfig) merged(route *SecurityHeadersConfig) SecurityHeadersConfig {
+	if route == nil {
+		return sc
+	}
+	for _, field := range []struct{ global, route *string }{
+		{&sc.HSTS, &route.HSTS},
+		{&sc.ContentTypeOptions, &route.ContentTypeOptions},
+		{&sc.FrameOptions, &route.FrameOptions},
+		{&sc.ContentSecurityPolicy, &route.ContentSecurityPolicy},
+		{&sc.ReferrerPolicy, &route.ReferrerPolicy},
+	} {
+		if *field.route != "" {
+			*field.global = *field.route
+		}
+	}
+	sc.Override = sc.Override || route.Override
+	return sc
+}
+
+// apply sets the security headers on a response header map
+func (sc *SecurityHeadersConfig) apply(h http.Header, tls bool) {
+	for name, value := range sc.headers() {
+		switch {
+		case value == "":
+		case strings.EqualFold(value, securityHeadersOff):
+			h.Del(name)
+		case name == "Strict-Transport-Security" && !tls:
+			// Browsers ignore HSTS received over plain HTTP
+		case sc.Override || h.Get(name) == "":
+			h.Set(name, value)
+		}
+	}
+}
+
+// responseHeadersContextKey carries the request's responseHeaderWriter
+type responseHeadersContextKey struct{}
+
+// setRouteSecurityHeaders applies the matched route's security header
+// overrides to r's response
+func setRouteSecurityHeaders(r *http.Request, route *SecurityHeadersConfig) {
+	if route == nil {
+		return
+	}
+	if rw, ok := r.Context().Value(responseHeadersContextKey{}).(*responseHeaderWriter); ok {
+		rw.route = route
+	}
+}
+
+// withResponseHeaderWriter stores rw in r's context for the route match
+func withResponseHeaderWriter(r *http.Request, rw *responseHeaderWriter) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), responseHeadersContextKey{}, rw))
+}
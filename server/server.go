@@ -0,0 +1,964 @@
+// Package server is the QUIC-LB Draft 20 HTTP/3 load balancer: it wires the
+// CID router, the backend pools, the public listeners and the admin API
+// together so the load balancer can be embedded in other Go programs.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+
+	"quic-moodle/balancer"
+)
+
+// Server is a load balancer instance built from a Config
+type Server struct {
+	configPath string
+	dryRun     bool
+	devTLS     bool
+
+	mu        sync.Mutex
+	listeners *Listeners // set by WithListeners or when Run opens them
+
+	config        *ConfigManager
+	quicLB        *balancer.QUICLB
+	pools         *PoolRegistry
+	conns         *ConnectionTracker
+	handshakes    *HandshakeStats
+	certExpiry    *CertExpiryMonitor
+	datagrams     *datagramProxy // relays HTTP/3 datagram flows, nil unless http_datagrams is configured
+	datagramStats *DatagramStats
+	priority      *PriorityScheduler
+	websockets    *WebSocketTracker
+	transfers     *TransferStats
+	ranges        *RangeCache
+	drainer       *ConnDrainer
+	qpack         *HeaderCompressionStats
+	upstream      *UpstreamCoalescer
+	compression   *CompressionStats
+	cache         *ResponseCache
+	requestBodies *RequestBodyStats
+	tunnels       *ConnectTunnels
+	rateLimiter   *RateLimiter
+	admission     *AdmissionController
+	access        *AccessControl
+	geoip         *GeoIP
+	svids         *workloadapi.X509Source // SPIFFE SVID and bundles, nil unless the config uses SPIFFE
+	features      atomic.Pointer[FeaturesConfig]
+	altSvc        atomic.Pointer[map[string]string] // listener -> Alt-Svc header value
+
+	addressValidation *AddressValidation    // QUIC Retry enforcement under attack
+	clientLimits      *ClientLimits         // QUIC connections and streams per client
+	plugins           *Plugins              // Operator middleware in front of proxying
+	jwt               *JWTValidator         // Bearer tokens on routes with require_jwt
+	forwardAuth       *ForwardAuth          // External auth service for routes with forward_auth
+	responseHeaders   *ResponseHeaders      // Keeps internal headers from clients
+	requestValidator  *RequestValidator     // Rejects ambiguous requests before routing
+	timeouts          *Timeouts             // Slowloris defenses and timed-out request counts
+	basicAuth         *BasicAuth            // Users and passwords for routes and LB-served paths
+	authFailures      *AuthFailures         // Throttles clients that keep failing authentication
+	sessionState      *SessionState         // Session ID hashing and session table encryption
+	fingerprints      *TLSFingerprints      // JA3/JA4 fingerprints of ClientHellos
+	bots              *Bots                 // Per-client bot reputation and mitigation
+	adminCSRF         *AdminCSRF            // Cross-site request forgery checks of admin changes
+	headerLimits      *HeaderLimits         // Request header count and size limits
+	memory            *MemoryWatchdog       // Table size limits and shedding under memory pressure
+	cluster           *ClusterSync          // Routing state shared with other instances behind the same address
+	kubernetes        *KubernetesController // Pools, routes and QUIC-LB config from custom resources
+	moodle            *Moodle               // Sesskeys, upload pinning and course traffic
+	agents            *Agents               // Backend agents that register, fetch QUIC-LB configs and report load
+	faults            *Faults               // Injected latency, errors, backend failures and packet loss
+	experiments       *Experiments          // A/B variants assigned per session or CID, with their metrics
+	udpL4             *UDPForwarder         // QUIC packets forwarded by connection ID when features.udp_l4 is on
+
+	handler      http.Handler
+	adminHandler http.Handler
+
+	// Background goroutines (health checks, cleanup) run until Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithConfigPath sets the file that admin API changes are persisted to.
+// Without it configuration changes only live in memory.
+func WithConfigPath(path string) Option {
+	return func(s *Server) {
+		s.configPath = path
+	}
+}
+
+// WithDryRun makes the public listeners answer load-balanced requests with
+// the routing decision instead of proxying them
+func WithDryRun(enabled bool) Option {
+	return func(s *Server) {
+		s.dryRun = enabled
+	}
+}
+
+// WithDevTLS serves a self-signed certificate generated at startup for
+// localhost instead of the configured certificate files
+func WithDevTLS(enabled bool) Option {
+	return func(s *Server) {
+		s.devTLS = enabled
+	}
+}
+
+// WithListeners serves on already opened sockets instead of calling
+// OpenListeners when Run starts
+func WithListeners(l *Listeners) Option {
+	return func(s *Server) {
+		s.listeners = l
+	}
+}
+
+// New validates cfg and builds the QUIC-LB router, the backend pools and the
+// HTTP handlers. Backends are health checked from this point on; call Run to
+// start serving.
+func New(cfg *Config, opts ...Option) (*Server, error) {
+	s := &Server{
+		conns:         NewConnectionTracker(),
+		handshakes:    NewHandshakeStats(),
+		certExpiry:    NewCertExpiryMonitor(),
+		datagramStats: NewDatagramStats(),
+		priority:      NewPriorityScheduler(0),
+		websockets:    NewWebSocketTracker(),
+		transfers:     NewTransferStats(),
+		ranges:        NewRangeCache(),
+		drainer:       NewConnDrainer(),
+		qpack:         NewHeaderCompressionStats(),
+		upstream:      NewUpstreamCoalescer(),
+		compression:   NewCompressionStats(),
+		cache:         NewResponseCache(),
+		requestBodies: NewRequestBodyStats(),
+		tunnels:       NewConnectTunnels(),
+		rateLimiter:   NewRateLimiter(),
+		admission:     NewAdmissionController(),
+		access:        NewAccessControl(),
+		geoip:         NewGeoIP(),
+
+		addressValidation: NewAddressValidation(),
+		clientLimits:      NewClientLimits(),
+		plugins:           NewPlugins(),
+		jwt:               NewJWTValidator(),
+		forwardAuth:       NewForwardAuth(),
+		responseHeaders:   NewResponseHeaders(),
+		requestValidator:  NewRequestValidator(),
+		timeouts:          NewTimeouts(),
+		basicAuth:         NewBasicAuth(),
+		authFailures:      NewAuthFailures(),
+		sessionState:      NewSessionState(),
+		fingerprints:      NewTLSFingerprints(),
+		bots:              NewBots(),
+		adminCSRF:         NewAdminCSRF(),
+		headerLimits:      NewHeaderLimits(),
+		memory:            NewMemoryWatchdog(),
+		cluster:           NewClusterSync(),
+		kubernetes:        NewKubernetesController(),
+		moodle:            NewMoodle(),
+		agents:            NewAgents(),
+		faults:            NewFaults(),
+		experiments:       NewExperiments(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	// Every early return below releases the context
+	created := false
+	defer func() {
+		if !created {
+			s.cancel()
+		}
+	}()
+
+	// Initialize QUIC-LB configuration per Draft 20
+	quicLBConfig, err := cfg.QUICLB.ToQUICLBConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create QUIC-LB compliant load balancer
+	s.quicLB, err = balancer.NewQUICLB("health-aware", quicLBConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create QUIC-LB load balancer: %v", err)
+	}
+
+	s.cluster.setActive(cfg.QUICLB)
+	log.Printf("✅ QUIC-LB Draft 20 compliant load balancer initialized")
+	log.Printf("🔧 Algorithm: %s, Config Rotation: %d, Server ID Length: %d bytes",
+		quicLBConfig.Algorithm, quicLBConfig.ConfigRotationBits, quicLBConfig.ServerIDLen)
+
+	// Extended CONNECT flows whose datagrams are relayed to the backends
+	if len(cfg.HTTPDatagrams.Protocols) > 0 {
+		if s.datagrams, err = newDatagramProxy(cfg.HTTPDatagrams, s.datagramStats, s.upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch the SPIFFE SVID for SPIFFE TLS profiles and backend mTLS
+	var backendTLS *tls.Config
+	if cfg.usesSPIFFE() {
+		if s.svids, err = newSPIFFESource(cfg.SPIFFE); err != nil {
+			return nil, err
+		}
+		if cfg.SPIFFE.BackendMTLS {
+			if backendTLS, err = spiffeBackendTLS(s.svids, cfg.SPIFFE); err != nil {
+				s.svids.Close()
+				return nil, err
+			}
+			log.Printf("🪪 SPIFFE mTLS enabled for https backends")
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			logSVIDRotations(s.ctx, s.svids)
+		}()
+	}
+
+	// Initialize enhanced backend pools (the "default" pool plus any named pools);
+	// each pool runs its own health checks
+	s.upstream.Configure(cfg.Upstream)
+	s.cache.Configure(cfg.Cache)
+	s.rateLimiter.Configure(cfg.RateLimit)
+	s.admission.Configure(cfg.Admission)
+	s.access.Configure(cfg.Access)
+	s.geoip.Configure(cfg.GeoIP)
+	s.addressValidation.Configure(cfg.AddressValidation)
+	s.clientLimits.Configure(cfg.ClientLimits)
+	s.plugins.Configure(cfg.Plugins)
+	s.jwt.Configure(s.ctx, cfg.JWT)
+	s.forwardAuth.Configure(cfg.ForwardAuth)
+	s.responseHeaders.Configure(cfg.ResponseHeaders, cfg.SecurityHeaders)
+	s.requestValidator.Configure(cfg.RequestValidation)
+	s.timeouts.Configure(cfg.Timeouts)
+	s.basicAuth.Configure(cfg.BasicAuth)
+	s.authFailures.Configure(cfg.AuthFailures)
+	s.sessionState.Configure(cfg.SessionState)
+	s.bots.Configure(cfg.Bots)
+	s.headerLimits.Configure(cfg.HeaderLimits)
+	backendTransport := s.upstream.newTransport(cfg.Upstream.Transport, backendTLS)
+	// Backends get back their saved server IDs when the pools add them
+	s.restoreServerIDs(cfg.ServerIDs)
+	s.applyServerIDs(cfg.ServerIDs)
+	s.pools = NewPoolRegistry(s.ctx, s.quicLB, backendTransport, s.upstream)
+	s.pools.Apply(cfg)
+	s.udpL4 = NewUDPForwarder(s.quicLB)
+	s.memory.attach(s.conns, s.quicLB, s.pools.Pools, s.udpL4)
+	s.memory.Configure(cfg.Memory)
+	s.moodle.Configure(cfg.Moodle)
+	s.agents.Configure(cfg.Agents)
+	s.faults.Configure(cfg.Faults)
+	s.applyFaultedBackends()
+	s.experiments.Configure(cfg.Experiments)
+	s.udpL4.Configure(cfg.UDPL4)
+	s.applyFeatures(cfg.Features)
+	s.priority.SetLimit(cfg.Priority.MaxConcurrentStreams)
+	s.applyAltSvc(cfg)
+
+	s.config = NewConfigManager(s.configPath, cfg, s.applyConfig)
+	s.config.running = s.checkServerIDLen
+	s.buildHandlers(cfg)
+
+	// The attack detector samples connection rates while the server runs
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.addressValidation.run(s.ctx, func() bool { return s.currentFeatures().RetryService }, s.quicLB.UnroutableCIDs)
+	}()
+
+	// The memory watchdog enforces table limits and sheds under memory pressure
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.memory.run(s.ctx)
+	}()
+
+	// Share fallback CID choices and health views with the other instances
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runClusterSync(s.ctx, cfg.ClusterSync)
+	}()
+
+	// Merge QUICLBConfig, BackendPool and QUICLBRoute resources in controller mode
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runKubernetes(s.ctx, cfg.Kubernetes)
+	}()
+
+	// Remove backends whose agents stopped reporting
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runAgentExpiry(s.ctx)
+	}()
+
+	// End faults added through the admin API after their duration
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runFaultExpiry(s.ctx)
+	}()
+
+	// Start connection cleanup routine
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.conns.cleanup()
+			}
+		}
+	}()
+
+	created = true
+	return s, nil
+}
+
+// Close stops the health checks and other background goroutines and waits
+// for them to exit. A running Run returns once Close is called.
+func (s *Server) Close() error {
+	s.cancel()
+	s.pools.Close()
+	s.wg.Wait()
+	s.rateLimiter.Close()
+	s.geoip.Close()
+	if s.datagrams != nil {
+		s.datagrams.Close()
+	}
+	if s.svids != nil {
+		return s.svids.Close()
+	}
+	return nil
+}
+
+// defaultPool returns the pool built from the top-level backends section
+func (s *Server) defaultPool() *balancer.Pool {
+	return s.pools.Get(defaultPoolName)
+}
+
+// Config returns a copy of the effective configuration
+func (s *Server) Config() *Config {
+	return s.config.Current()
+}
+
+// ConfigManager returns the owner of the effective configuration, which
+// applies and persists updates the same way the admin API does
+func (s *Server) ConfigManager() *ConfigManager {
+	return s.config
+}
+
+// Pools returns the backend pool registry
+func (s *Server) Pools() *PoolRegistry {
+	return s.pools
+}
+
+// Handler returns the public handler that load balances requests
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// AdminHandler returns the admin API handler, without the authentication
+// applied by the admin listener
+func (s *Server) AdminHandler() http.Handler {
+	return s.adminHandler
+}
+
+// buildHandlers sets up the public and admin routes
+func (s *Server) buildHandlers(cfg *Config) {
+	mux := http.NewServeMux()
+
+	static := newStaticHandler(cfg.Server.StaticDir, func() StaticConfig { return s.config.Current().Static })
+	mux.Handle("/static/", http.StripPrefix("/static/", static))
+
+	// Management and stats endpoints live on the admin listener; selected
+	// read-only ones are additionally exposed on the public listener below
+	adminMux := http.NewServeMux()
+
+	// Enhanced connection monitoring endpoints
+	adminMux.HandleFunc("/api/connections", s.handleConnections)
+
+	// Admin configuration API (full effective config, persisted on PUT)
+	adminMux.HandleFunc("/api/admin/config", s.handleAdminConfig)
+	adminMux.HandleFunc("/api/admin/config/versions", s.handleAdminConfigVersions)
+	adminMux.HandleFunc("/api/admin/config/versions/", s.handleAdminConfigVersions)
+	adminMux.HandleFunc("/api/admin/config/rollback", s.handleAdminConfigRollback)
+	adminMux.HandleFunc("/api/admin/config/diff", s.handleAdminConfigDiff)
+
+	// CSRF token for changes by clients authenticated with a certificate
+	adminMux.HandleFunc("/api/admin/csrf-token", s.handleAdminCSRFToken)
+
+	// Enhanced load balancer API endpoints
+	adminMux.HandleFunc("/api/loadbalancer", s.handleLoadBalancer)
+	adminMux.HandleFunc("/api/loadbalancer/algorithm", s.handleAlgorithm)
+
+	// Per-pool stats for virtual host routing
+	adminMux.HandleFunc("/api/pools", s.handlePools)
+
+	// TLS handshake counters per listener
+	adminMux.HandleFunc("/api/tls/handshakes", s.handleTLSHandshakes)
+
+	// JA3/JA4 fingerprints of clients, most frequent first
+	adminMux.HandleFunc("/api/tls/fingerprints", s.handleTLSFingerprints)
+
+	// Bot mitigation actions and the clients with the worst reputation
+	adminMux.HandleFunc("/api/bots", s.handleBots)
+
+	// Days until expiry of every served certificate
+	adminMux.HandleFunc("/api/tls/certificates", s.handleTLSCertificates)
+
+	// Per-flow HTTP/3 datagram counters
+	adminMux.HandleFunc("/api/http-datagrams", s.handleHTTPDatagrams)
+
+	// Alt-Svc per listener and the matching DNS HTTPS records
+	adminMux.HandleFunc("/api/alt-svc", s.handleAltSvc)
+
+	// RFC 9218 priority scheduling per client connection
+	adminMux.HandleFunc("/api/priority", s.handlePriority)
+
+	// Open WebSocket tunnels per backend
+	adminMux.HandleFunc("/api/websockets", s.handleWebSockets)
+
+	// Request and response body transfer rates
+	adminMux.HandleFunc("/api/transfers", s.handleTransfers)
+
+	// Range requests and read-ahead blocks for course files
+	adminMux.HandleFunc("/api/ranges", s.handleRanges)
+
+	// Client connection draining after routing changes
+	adminMux.HandleFunc("/api/drain", s.handleDrain)
+
+	// HTTP/3 header compression ratios
+	adminMux.HandleFunc("/api/qpack", s.handleQPACK)
+
+	// Upstream HTTP/2 and HTTP/3 connection coalescing
+	adminMux.HandleFunc("/api/upstream", s.handleUpstream)
+
+	// Response compression of unencoded backend responses
+	adminMux.HandleFunc("/api/compression", s.handleCompression)
+
+	// Shared response cache and purges
+	adminMux.HandleFunc("/api/cache", s.handleCache)
+	adminMux.HandleFunc("/api/cache/purge", s.handleCachePurge)
+
+	// Request body size limits and upload buffering
+	adminMux.HandleFunc("/api/request-body", s.handleRequestBody)
+
+	// CONNECT tunnels to allowlisted targets
+	adminMux.HandleFunc("/api/connect", s.handleConnect)
+
+	// Token bucket rate limiting per client IP, session or header
+	adminMux.HandleFunc("/api/rate-limit", s.handleRateLimit)
+
+	// Global concurrency cap, queueing and brownout load shedding
+	adminMux.HandleFunc("/api/admission", s.handleAdmission)
+
+	// Client IP allow and deny lists, globally and per route
+	adminMux.HandleFunc("/api/access", s.handleAccess)
+
+	// GeoIP databases, lookups per country and address lookups
+	adminMux.HandleFunc("/api/geoip", s.handleGeoIP)
+
+	// QUIC Retry enforcement by the attack detector
+	adminMux.HandleFunc("/api/address-validation", s.handleAddressValidation)
+
+	// QUIC connections and HTTP/3 streams per client address
+	adminMux.HandleFunc("/api/client-limits", s.handleClientLimits)
+
+	// Middleware plugins and how many requests each stopped
+	adminMux.HandleFunc("/api/plugins", s.handlePlugins)
+
+	// JWKS keys and bearer token verification counts
+	adminMux.HandleFunc("/api/jwt", s.handleJWT)
+
+	// Forward auth decisions and session cookies
+	adminMux.HandleFunc("/api/forward-auth", s.handleForwardAuth)
+
+	// Basic auth users and login counts
+	adminMux.HandleFunc("/api/basic-auth", s.handleBasicAuth)
+
+	// Clients throttled after failed logins
+	adminMux.HandleFunc("/api/auth-failures", s.handleAuthFailures)
+
+	// Requests rejected as ambiguous, per reason
+	adminMux.HandleFunc("/api/request-validation", s.handleRequestValidation)
+
+	// Requests refused for too many or too large headers
+	adminMux.HandleFunc("/api/header-limits", s.handleHeaderLimits)
+
+	// Memory use, the soft memory limit and the bounded tables
+	adminMux.HandleFunc("/api/memory", s.handleMemory)
+
+	// Other load balancer instances, backends they hold down and shared CID claims
+	adminMux.HandleFunc("/api/cluster", s.handleCluster)
+
+	// Custom resources watched in controller mode and the last merge applied
+	adminMux.HandleFunc("/api/kubernetes", s.handleKubernetes)
+
+	// Moodle sesskeys learned, uploads pinned to sessions and traffic per course
+	adminMux.HandleFunc("/api/moodle", s.handleMoodle)
+
+	// Backend agents: registration with QUIC-LB configs, health and load reports
+	adminMux.HandleFunc("/api/agents", s.handleAgents)
+	adminMux.HandleFunc("/api/agents/register", s.handleAgentRegister)
+	adminMux.HandleFunc("/api/agents/report", s.handleAgentReport)
+	adminMux.HandleFunc("/api/agents/deregister", s.handleAgentDeregister)
+	// Fault injection: latency, 5xx answers, held-down backends, dropped QUIC packets
+	adminMux.HandleFunc("/api/faults", s.handleFaults)
+	// A/B experiments: variants with their request, error and latency metrics
+	adminMux.HandleFunc("/api/experiments", s.handleExperiments)
+	// L4 QUIC forwarding: flow table, packet counters and steering queues
+	adminMux.HandleFunc("/api/udp-l4", s.handleUDPL4)
+	// QUIC-LB server IDs assigned to backends, ?url= for one backend
+	adminMux.HandleFunc("/api/server-ids", s.handleServerIDs)
+
+	// Header, idle and body timeouts that fired, per reason
+	adminMux.HandleFunc("/api/timeouts", s.handleTimeouts)
+
+	// Experimental feature flags
+	adminMux.HandleFunc("/api/features", s.handleFeatures)
+
+	// QUIC-LB Draft 20 specific endpoints
+	adminMux.HandleFunc("/api/quic-lb", s.handleQUICLB)
+	adminMux.HandleFunc("/api/quic-lb/config", s.handleQUICLBConfig)
+	adminMux.HandleFunc("/api/quic-lb/demo", handleQUICLBDemo)
+	adminMux.HandleFunc("/api/quic-lb/test-cid", s.handleQUICLBTestCID)
+
+	// Enhanced test API endpoints
+	mux.HandleFunc("/api/test", s.handleTest)
+	mux.HandleFunc("/api/simulate-migration", s.handleSimulateMigration)
+
+	// Read-only admin endpoints that stay reachable on the public listener
+	for _, path := range cfg.Admin.PublicEndpoints {
+		mux.Handle(path, readOnlyHandler(adminMux))
+	}
+
+	// Enhanced middleware chain
+	finalHandler := s.loadBalancerMiddleware(s.quicConnectionMiddleware(mux))
+
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocol := r.Proto
+		emoji := ""
+		if r.Proto == "HTTP/3.0" {
+			protocol = "HTTP/3.0 🚀"
+			emoji = "🚀 "
+		}
+
+		// The client's country and ASN feed access lists and routes
+		r = s.geoip.tag(r)
+		if !strings.HasPrefix(r.URL.Path, "/static/") &&
+			!strings.HasPrefix(r.URL.Path, "/favicon.ico") {
+			if geo, ok := geoFromRequest(r); ok {
+				log.Printf("%s%s [%s] %s %s (%s)", emoji, r.RemoteAddr, geo, r.Method, r.URL.Path, protocol)
+			} else {
+				log.Printf("%s%s %s %s (%s)", emoji, r.RemoteAddr, r.Method, r.URL.Path, protocol)
+			}
+		}
+
+		// Requests a backend could frame or route differently never reach one
+		if !s.requestValidator.check(w, r) {
+			return
+		}
+
+		// Oversized header sections stop here, before backends see them
+		if !s.headerLimits.check(w, r) {
+			return
+		}
+
+		// Uploads trickled to hold the request open are cut off
+		s.timeouts.track(w, r)
+
+		// CONNECT tunnels to allowlisted targets bypass routing and live
+		// outside the request drain; serveConnect applies the access lists,
+		// rate limits and admission itself
+		if isConnectTunnel(r) {
+			s.serveConnect(w, r)
+			return
+		}
+
+		// A client's HTTP/3 streams are capped across all its connections
+		releaseStream, ok := s.clientLimits.acquireStream(w, r)
+		if !ok {
+			return
+		}
+		defer releaseStream()
+
+		// Internal headers set below and by the proxy stay with the LB
+		w, r = s.responseHeaders.wrap(w, r)
+		if altSvc := s.altSvcHeader(r); altSvc != "" {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		w.Header().Set("X-Server-Protocol", r.Proto)
+		w.Header().Set("X-Enhanced-Features", "basic-health-checks,session-affinity,quic-lb-draft-20")
+
+		if r.ProtoMajor == 3 {
+			s.qpack.observe(r, s.config.Current().QPACK)
+		}
+		defer s.drainer.begin(w, r)()
+		finalHandler.ServeHTTP(w, r)
+	})
+	s.adminHandler = s.dryRunMiddleware(adminMux)
+}
+
+// Run serves the public and admin listeners until ctx is cancelled or Close
+// is called, then shuts the servers down gracefully
+func (s *Server) Run(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	context.AfterFunc(s.ctx, stop)
+
+	cfg := s.config.Current()
+
+	// TLS configs for the TCP (HTTP/1.1 + HTTP/2) and QUIC (HTTP/3) listeners
+	var devCert *tls.Certificate
+	var err error
+	if s.devTLS {
+		if devCert, err = generateDevCertificate(); err != nil {
+			return fmt.Errorf("failed to generate development certificate: %v", err)
+		}
+	}
+	tcpTLSName, tcpTLSProfile, _ := cfg.TLSProfile(cfg.Server.TLSProfile)
+	tlsConfig, err := s.buildTLSConfig(tcpTLSName, tcpTLSProfile, devCert)
+	if err != nil {
+		return err
+	}
+	quicTLSConfig := tlsConfig
+	if quicTLSName, quicTLSProfile, _ := cfg.TLSProfile(cfg.Server.QUICTLSProfile); quicTLSName != tcpTLSName {
+		if quicTLSConfig, err = s.buildTLSConfig(quicTLSName, quicTLSProfile, devCert); err != nil {
+			return err
+		}
+	}
+
+	// QUIC transport settings from the listener's profile
+	quicConfig, err := OptimizedQUICConfig(cfg.Server.QUICProfile)
+	if err != nil {
+		return err
+	}
+	if cfg.Server.Disable0RTT {
+		quicConfig.Allow0RTT = false
+	}
+	log.Printf("⚙️ QUIC profile: %s (0-RTT: %v)", cfg.Server.QUICProfile, quicConfig.Allow0RTT)
+
+	adminServer, err := newAdminServer(cfg.Admin, s.adminCSRF, s.forwardAuth.adminMiddleware(s.adminHandler))
+	if err != nil {
+		return err
+	}
+
+	// WebTransport sessions share the QUIC listener with HTTP/3
+	var webTransport *webTransportProxy
+	if cfg.WebTransport.Path != "" {
+		if webTransport, err = s.newWebTransportProxy(cfg.WebTransport); err != nil {
+			return err
+		}
+	}
+
+	// Bind (or inherit from a previous process) the TCP and UDP sockets
+	s.mu.Lock()
+	if s.listeners == nil {
+		if s.listeners, err = OpenListeners(cfg); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	listeners := s.listeners
+	s.mu.Unlock()
+	if listeners.Inherited {
+		log.Printf("♻️ Inherited listening sockets from previous process")
+	}
+	// Affinity keys and the sealed session table need the previous key
+	// before anything is served or restored
+	s.sessionState.inherit(listeners.inheritedSessionKey())
+
+	// Serve goroutines end once their server is shut down below
+	var serving sync.WaitGroup
+
+	// Start HTTP/2 server (TCP) for browser compatibility
+	tcpTLS := s.fingerprints.instrument("tcp", s.handshakes.instrument("tcp", tcpTLSConfig(tlsConfig)))
+	tcpHandler := s.handler
+	if !slices.Contains(tcpTLS.NextProtos, "http/1.1") {
+		// crypto/tls accepts clients that only offer http/1.1 despite ALPN,
+		// so HTTP/1.1 has to be refused per request
+		tcpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor < 2 {
+				http.Error(w, "HTTP/1.1 is disabled on this listener, use HTTP/2 or HTTP/3", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			s.handler.ServeHTTP(w, r)
+		})
+	}
+	tcpServer := &http.Server{
+		Addr:         cfg.Server.ListenAddr,
+		Handler:      tcpHandler,
+		TLSConfig:    tcpTLS,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return withTLSFingerprint(s.drainer.tcpConnContext(ctx, c))
+		},
+		// Handshake errors become failure metrics instead of raw log lines
+		ErrorLog: log.New(handshakeErrorLog{stats: s.handshakes, listener: "tcp"}, "", 0),
+	}
+	s.timeouts.configureServer(tcpServer)
+	cfg.HeaderLimits.configureServer(tcpServer)
+	if !slices.Contains(tcpTLS.NextProtos, "h2") {
+		// A non-nil empty map turns off the built-in HTTP/2 support
+		tcpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		log.Printf("🔄 Starting Enhanced HTTP/1.1 & HTTP/2 server (TCP) on %s, ALPN: %s", cfg.Server.ListenAddr, strings.Join(tcpTLS.NextProtos, ", "))
+
+		// Serve over our own TLS listener: ServeTLS would add http/1.1 back to the ALPN list
+		if err := tcpServer.Serve(tls.NewListener(listeners.TCP, tcpTLS)); err != nil && err != http.ErrServerClosed {
+			log.Printf("Enhanced TCP server error: %v", err)
+		}
+	}()
+
+	h3Server := &http3.Server{
+		Addr:       cfg.Server.ListenAddr, // Same port as HTTP/2 - QUIC uses UDP, HTTP/2 uses TCP
+		Handler:    s.handler,
+		TLSConfig:  s.fingerprints.instrument("quic", s.handshakes.instrument("quic", quicTLSConfig)),
+		QUICConfig: quicConfig,
+		// Connections without requests are closed like idle keep-alives
+		IdleTimeout: cfg.Timeouts.idle(),
+		// Connections are tracked so routing changes can drain them, and
+		// get their own simulated QPACK dynamic table
+		ConnContext: func(ctx context.Context, c *quic.Conn) context.Context {
+			return s.qpack.connContext(s.drainer.quicConnContext(withQUICConn(ctx, c), c), c)
+		},
+	}
+	cfg.QPACK.configure(h3Server)
+	cfg.HeaderLimits.configureHTTP3(h3Server)
+	if s.datagrams != nil {
+		h3Server.EnableDatagrams = true
+		log.Printf("📦 HTTP/3 datagrams are relayed for %s", strings.Join(cfg.HTTPDatagrams.Protocols, ", "))
+	}
+	// QUIC gets a transport of its own so the attack detector can demand
+	// address validation (Retry) and per-client limits can refuse
+	// connections before they are accepted
+	quicTransport := &quic.Transport{
+		Conn:                s.faults.packetConn(listeners.UDP, cfg.Faults.Enabled),
+		VerifySourceAddress: s.verifySourceAddress,
+		ConnContext: func(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+			ctx, err := s.clientLimits.connContext(ctx, info)
+			if err != nil {
+				return ctx, err
+			}
+			// The handshake gets this context, so it can fill in the fingerprint
+			return withTLSFingerprint(ctx), nil
+		},
+	}
+	h3QUICConfig := quicConfig.Clone()
+	h3QUICConfig.EnableDatagrams = h3Server.EnableDatagrams
+	serveQUIC := func() error {
+		ln, err := quicTransport.ListenEarly(http3.ConfigureTLSConfig(h3Server.TLSConfig), h3QUICConfig)
+		if err != nil {
+			return err
+		}
+		return h3Server.ServeListener(ln)
+	}
+	if webTransport != nil {
+		webTransport.attach(h3Server)
+		serveQUIC = func() error {
+			return webTransport.Serve(quicTransport, quicConfig)
+		}
+	}
+	// At L4 the backends terminate QUIC and the socket only forwards packets
+	udpL4 := s.currentFeatures().UDPL4
+	if udpL4 {
+		serveQUIC = func() error {
+			return s.udpL4.Serve(ctx, quicTransport.Conn)
+		}
+	}
+
+	s.logBanner(cfg)
+
+	// Start the admin API on its own listener
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		var err error
+		if adminServer.TLSConfig != nil {
+			log.Printf("🛠️ Starting admin API (TLS, mTLS: %v) on %s", cfg.Admin.ClientCAFile != "", cfg.Admin.ListenAddr)
+			err = adminServer.ServeTLS(listeners.Admin, "", "")
+		} else {
+			log.Printf("🛠️ Starting admin API on %s", cfg.Admin.ListenAddr)
+			err = adminServer.Serve(listeners.Admin)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin server error: %v", err)
+		}
+	}()
+
+	// Start a simple HTTP server for comparison
+	var httpServer *http.Server
+	if listeners.HTTP != nil {
+		httpServer = &http.Server{
+			Addr:        cfg.Server.HTTPListenAddr,
+			Handler:     s.handler,
+			ConnContext: s.drainer.tcpConnContext,
+		}
+		s.timeouts.configureServer(httpServer)
+		cfg.HeaderLimits.configureServer(httpServer)
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			log.Printf("🌐 Starting Enhanced HTTP/1.1 server (no TLS) on %s for testing", cfg.Server.HTTPListenAddr)
+			if err := httpServer.Serve(listeners.HTTP); err != nil && err != http.ErrServerClosed {
+				log.Printf("HTTP server error: %v", err)
+			}
+		}()
+	}
+
+	log.Println("🚀 Enhanced HTTP/3 server starting...")
+	log.Printf("🔧 HTTP/3 Server Config: Addr=%s, QUICConfig timeout=%v", h3Server.Addr, quicConfig.MaxIdleTimeout)
+
+	// Start HTTP/3 server in a goroutine so it doesn't block
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		log.Printf("🚀 Starting HTTP/3 server on %s...", cfg.Server.ListenAddr)
+
+		if err := serveQUIC(); err != nil && err != http.ErrServerClosed {
+			log.Printf("❌ Enhanced HTTP/3 server stopped: %v", err)
+			log.Printf("💡 HTTP/3 is experimental - HTTP/2 will work normally")
+		}
+	}()
+
+	// Restore routing state and release the previous process, if any
+	handedOver := listeners.completeHandoff(s.restoreRoutingState)
+
+	// Without a previous process, restore the saved routing state and keep saving it
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		s.persistRoutingState(ctx, cfg.RoutingState, handedOver)
+	}()
+
+	// Warn about certificates approaching expiry until shutdown
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		s.certExpiry.run(ctx)
+	}()
+
+	log.Printf("🌐 Server is running - HTTP/2 on TCP%s, HTTP/3 on UDP%s", cfg.Server.ListenAddr, cfg.Server.ListenAddr)
+	log.Printf("🔗 Access: https://localhost%s", cfg.Server.ListenAddr)
+
+	<-ctx.Done()
+
+	// Every listener sends GOAWAY at once (HTTP/1.1 closes after the current
+	// response) and in-flight requests get the grace period to finish
+	current := s.config.Current()
+	grace := current.Drain.gracePeriod()
+	log.Printf("🚪 Draining client connections, grace period %v", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var draining sync.WaitGroup
+	drain := func(shutdown func(context.Context) error) {
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			shutdown(shutdownCtx)
+		}()
+	}
+	if httpServer != nil {
+		drain(httpServer.Shutdown)
+	}
+	drain(tcpServer.Shutdown)
+	drain(h3Server.Shutdown)
+	// HTTP/3 clients may keep a connection open after GOAWAY; quiet ones are
+	// closed so shutdown does not wait out the grace period for them
+	s.drainer.Drain(shutdownCtx, "shutdown")
+	// Upgraded WebSockets are invisible to Shutdown and drain separately
+	draining.Add(1)
+	go func() {
+		defer draining.Done()
+		s.websockets.Drain(current.WebSocket.drainTimeout())
+	}()
+	// CONNECT tunnels get the same time to finish
+	draining.Add(1)
+	go func() {
+		defer draining.Done()
+		s.tunnels.Drain(current.WebSocket.drainTimeout())
+	}()
+	draining.Wait()
+	if !udpL4 {
+		quicTransport.Close()
+	}
+	if webTransport != nil {
+		webTransport.Close()
+	}
+	adminServer.Shutdown(shutdownCtx)
+	serving.Wait()
+	return nil
+}
+
+// Upgrade hands the listening sockets and routing state to a fresh copy of
+// the running binary. On success the caller should cancel Run's context so
+// this process drains and exits.
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		return fmt.Errorf("upgrade failed: server is not running")
+	}
+	return s.listeners.upgrade(s.snapshotRoutingState, s.sessionState.upgradeKey())
+}
+
+// logBanner prints the startup summary
+func (s *Server) logBanner(cfg *Config) {
+	quicLBConfig := s.quicLB.GetConfig()
+
+	log.Println("🚀 Starting IETF QUIC-LB Draft 20 Fully Compliant HTTP/3 Load Balancer")
+	log.Printf("📋 QUIC-LB Config: Algorithm=%s, ConfigRotation=%d, ServerIDLen=%d bytes",
+		quicLBConfig.Algorithm, quicLBConfig.ConfigRotationBits, quicLBConfig.ServerIDLen)
+	log.Printf("🌐 Enhanced Server: https://localhost:9443")
+	log.Printf("🌐 Local IP: %s", getLocalIP())
+	log.Printf("📊 Enhanced Dashboard: https://localhost:9443/")
+	adminBase := "http://" + cfg.Admin.ListenAddr
+	if cfg.Admin.CertFile != "" {
+		adminBase = "https://" + cfg.Admin.ListenAddr
+	}
+	log.Printf("🔧 QUIC-LB API: %s/api/quic-lb", adminBase)
+	log.Printf("⚙️ Config Management: %s/api/quic-lb/config, %s/api/admin/config", adminBase, adminBase)
+	log.Printf("🧪 Algorithm Demo: %s/api/quic-lb/demo", adminBase)
+	log.Printf("🧪 CID Test: %s/api/quic-lb/test-cid", adminBase)
+	log.Printf("🔄 Algorithms: round-robin, weighted-round-robin, least-connections")
+	log.Printf("🛡️ Features: Full Draft 20 Compliance")
+	log.Printf("✅ QUIC-LB Draft 20 Features:")
+	log.Printf("   • 3-bit Config Rotation (0-6)")
+	log.Printf("   • 5-bit Length Self-Description")
+	log.Printf("   • Unroutable CID Handling (0b111 reserved)")
+	log.Printf("   • AES-ECB Single/Four-Pass Encryption")
+	log.Printf("   • Plaintext, Stream-Cipher, Block-Cipher Algorithms")
+	log.Printf("   • Stateless Routing with Fallback")
+	log.Printf("   • Multiple Configuration Support")
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+	"quic-moodle/quiclb"
+)
+
+// ServerIDsConfig keeps the QUIC-LB server IDs of the backends stable. A
+// backend keeps its ID while the load balancer runs; with a path it also
+// keeps it across restarts, so connections survive them. Backends learn
+// their ID from /api/server-ids or the agent API.
+type ServerIDsConfig struct {
+	Path string            `json:"path,omitempty"` // File the assigned IDs are saved to and restored from at startup, e.g. "/var/lib/quic-lb/server-ids.json"
+	Pins map[string]uint16 `json:"pins,omitempty"` // Backend URL to server ID; a pinned ID is never allocated to another backend
+}
+
+// savedServerIDs is the file written to ServerIDsConfig.Path
+type savedServerIDs struct {
+	SavedAt     time.Time                `json:"saved_at"`
+	ServerIDLen uint8                    `json:"server_id_len"`
+	Entries     []balancer.ServerIDEntry `json:"entries"`
+}
+
+// validate checks the server ID settings against the server ID length and
+// the pools: a pinned backend can only be in one pool, as IDs are unique
+func (sc *ServerIDsConfig) validate(serverIDLen uint8, pools []PoolConfig) []error {
+	var errs []error
+	capacity := quiclb.ServerIDCapacity(serverIDLen)
+	owners := make(map[uint16]string)
+	poolsOf := make(map[string][]string)
+	for _, pc := range pools {
+		for _, bc := range pc.Backends {
+			if u, err := url.Parse(bc.URL); err == nil {
+				poolsOf[u.Redacted()] = append(poolsOf[u.Redacted()], pc.Name)
+			}
+		}
+	}
+	for rawURL, id := range sc.Pins {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("server_ids.pins: %q is not a backend URL", rawURL))
+			continue
+		}
+		if id == 0 || int(id) > capacity {
+			errs = append(errs, fmt.Errorf("server_ids.pins[%q]: server ID must be 1-%d for %d-byte server IDs, got %d", u.Redacted(), capacity, serverIDLen, id))
+		}
+		if owner, taken := owners[id]; taken {
+			errs = append(errs, fmt.Errorf("server_ids.pins: server ID %d is pinned for both %s and %s", id, owner, u.Redacted()))
+		}
+		owners[id] = u.Redacted()
+		if len(poolsOf[u.Redacted()]) > 1 {
+			errs = append(errs, fmt.Errorf("server_ids.pins: %s is pinned but in pools %s", u.Redacted(), strings.Join(poolsOf[u.Redacted()], ", ")))
+		}
+	}
+	return errs
+}
+
+// pins returns the pins keyed by redacted URL, as the registry keys backends
+func (sc *ServerIDsConfig) pins() map[string]uint16 {
+	pins := make(map[string]uint16, len(sc.Pins))
+	for rawURL, id := range sc.Pins {
+		if u, err := url.Parse(rawURL); err == nil {
+			pins[u.Redacted()] = id
+		}
+	}
+	return pins
+}
+
+// restoreServerIDs loads the saved server IDs, before any backend is added
+func (s *Server) restoreServerIDs(cfg ServerIDsConfig) {
+	if cfg.Path == "" {
+		return
+	}
+	data, err := os.ReadFile(cfg.Path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var saved savedServerIDs
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to restore server IDs from %s: %v", cfg.Path, err)
+		return
+	}
+	restored := s.quicLB.ServerIDs().Load(saved.Entries)
+	log.Printf("🆔 Restored %d server ID(s) from %s, saved %s", restored, cfg.Path, saved.SavedAt.Format(time.RFC3339))
+}
+
+// applyServerIDs installs the pins and saves the registry to the configured
+// path whenever it changes
+func (s *Server) applyServerIDs(cfg ServerIDsConfig) {
+	registry := s.quicLB.ServerIDs()
+	registry.SetPins(cfg.pins())
+	if cfg.Path == "" {
+		registry.SetOnChange(nil)
+		return
+	}
+	// Saves are serialized so the file ends with the latest entries
+	var saving sync.Mutex
+	registry.SetOnChange(func() {
+		saving.Lock()
+		defer saving.Unlock()
+		saved := savedServerIDs{
+			SavedAt:     time.Now(),
+			ServerIDLen: s.quicLB.GetConfig().ServerIDLen,
+			Entries:     registry.Entries(),
+		}
+		data, err := json.MarshalIndent(saved, "", "  ")
+		if err == nil {
+			err = fileRoutingState(cfg.Path).save(context.Background(), data)
+		}
+		if err != nil {
+			log.Printf("⚠️ Failed to save server IDs to %s: %v", cfg.Path, err)
+		}
+	})
+}
+
+// checkServerIDLen refuses a QUIC-LB server ID length that cannot encode
+// the server IDs of the running backends; backends to be removed by the
+// same change still count, so shrink the pools first
+func (s *Server) checkServerIDLen(cfg *Config) error {
+	if cfg.QUICLB.ServerIDLen == s.quicLB.GetConfig().ServerIDLen {
+		return nil
+	}
+	if err := s.quicLB.ServerIDs().CheckFits(cfg.QUICLB.ServerIDLen); err != nil {
+		return fmt.Errorf("quic_lb.server_id_len: %v", err)
+	}
+	return nil
+}
+
+// handleServerIDs serves GET /api/server-ids, every assigned server ID or,
+// with ?url=, those of one backend
+func (s *Server) handleServerIDs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	registry := s.quicLB.ServerIDs()
+	serverIDLen := s.quicLB.GetConfig().ServerIDLen
+	filter := r.URL.Query().Get("url")
+	if u, err := url.Parse(filter); filter != "" && err == nil {
+		filter = u.Redacted()
+	}
+
+	entries := make([]map[string]interface{}, 0)
+	active := 0
+	for _, entry := range registry.Entries() {
+		if entry.Active {
+			active++
+		}
+		if filter != "" && entry.URL != filter {
+			continue
+		}
+		serverID := make([]byte, serverIDLen)
+		quiclb.PutServerID(serverID, entry.ID)
+		entries = append(entries, map[string]interface{}{
+			"pool":          entry.Pool,
+			"url":           entry.URL,
+			"id":            entry.ID,
+			"server_id_hex": hex.EncodeToString(serverID),
+			"pinned":        entry.Pinned,
+			"active":        entry.Active,
+			"assigned_at":   entry.AssignedAt,
+			"released_at":   entry.ReleasedAt,
+		})
+	}
+
+	stats := map[string]interface{}{
+		"server_id_len": serverIDLen,
+		"capacity":      registry.Capacity(),
+		"active":        active,
+		"collisions":    registry.Collisions(),
+		"persisted":     s.config.Current().ServerIDs.Path != "",
+		"entries":       entries,
+		"timestamp":     time.Now(),
+	}
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Environment variable earlier versions handed a generated session state key
+// to an upgraded process in; the key now comes through an inherited pipe
+const sessionStateKeyEnv = "QUIC_LB_SESSION_STATE_KEY"
+
+// SessionStateConfig protects session affinity state. Session IDs such as
+// Moodle's MoodleSession cookie are only kept as an HMAC, in memory, in rate
+// limit buckets (also in Redis) and in headers, and the session table handed
+// to an upgraded process is encrypted. Without a key_ref a random key is used
+// that survives upgrades but not restarts.
+type SessionStateConfig struct {
+	KeyRef string `json:"key_ref,omitempty"` // Secret reference with at least 32 bytes, e.g. "env:QUIC_LB_SESSION_KEY"; needed for instances sharing Redis
+}
+
+// validate checks the session state settings
+func (sc *SessionStateConfig) validate() []error {
+	var errs []error
+	if sc.KeyRef != "" {
+		if secret, err := resolveSecret(sc.KeyRef); err != nil {
+			errs = append(errs, fmt.Errorf("session_state.key_ref: %v", err))
+		} else if len(bytes.TrimSpace(secret)) < 32 {
+			errs = append(errs, fmt.Errorf("session_state.key_ref: key must be at least 32 bytes"))
+		}
+	}
+	return errs
+}
+
+// SessionState hashes session IDs and seals the session table
+type SessionState struct {
+	mu     sync.RWMutex
+	macs   *sync.Pool // sessionMACs keyed with the session ID key, reused across requests
+	aead   cipher.AEAD
+	master []byte // set when the key was generated, handed to upgraded processes
+}
+
+// NewSessionState creates session state protection with a random key
+func NewSessionState() *SessionState {
+	ss := &SessionState{}
+	ss.setKey(randomSessionStateKey(), true)
+	return ss
+}
+
+// Configure loads the key; it is set up once, changes need a restart.
+// Without a key_ref, a key generated by the previous process is taken over
+// with inherit, or from the environment of an earlier version.
+func (ss *SessionState) Configure(cfg SessionStateConfig) {
+	inherited := os.Getenv(sessionStateKeyEnv)
+	os.Unsetenv(sessionStateKeyEnv)
+
+	if cfg.KeyRef != "" {
+		secret, err := resolveSecret(cfg.KeyRef)
+		if err != nil {
+			log.Printf("⚠️ Session state key not loaded, using a random key: %v", err)
+			return
+		}
+		ss.setKey(bytes.TrimSpace(secret), false)
+		return
+	}
+	if inherited != "" {
+		if key, err := hex.DecodeString(inherited); err == nil && len(key) >= 32 {
+			ss.setKey(key, true)
+		}
+	}
+}
+
+// setKey derives the HMAC and encryption keys from master
+func (ss *SessionState) setKey(master []byte, generated bool) {
+	block, err := aes.NewCipher(deriveSessionStateKey(master, "quic-lb session state encryption"))
+	if err != nil {
+		panic(err) // AES-256 with a 32 byte key cannot fail
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	hmacKey := deriveSessionStateKey(master, "quic-lb session id")
+	ss.macs = &sync.Pool{New: func() any { return &sessionMAC{mac: hmac.New(sha256.New, hmacKey)} }}
+	ss.aead = aead
+	ss.master = nil
+	if generated {
+		ss.master = master
+	}
+}
+
+// deriveSessionStateKey derives a 32 byte key for one purpose from master
+func deriveSessionStateKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func randomSessionStateKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// key returns the affinity key of r: an HMAC of its session ID, so the raw
+// ID is never stored
+func (ss *SessionState) key(r *http.Request, cookieName string) string {
+	return ss.hash(extractSessionKey(r, cookieName))
+}
+
+// sessionMAC is an HMAC state with the buffers of one hash, so hashing a
+// session ID allocates only the returned string
+type sessionMAC struct {
+	mac hash.Hash
+	in  []byte
+	sum [sha256.Size]byte
+	hex [32]byte
+}
+
+// hash returns the HMAC of a session ID
+func (ss *SessionState) hash(sessionID string) string {
+	ss.mu.RLock()
+	macs := ss.macs
+	ss.mu.RUnlock()
+	sm := macs.Get().(*sessionMAC)
+	defer macs.Put(sm)
+	sm.mac.Reset()
+	sm.in = append(sm.in[:0], sessionID...)
+	sm.mac.Write(sm.in)
+	hex.Encode(sm.hex[:], sm.mac.Sum(sm.sum[:0])[:16])
+	return string(sm.hex[:])
+}
+
+// upgradeKey returns the generated key to hand to an upgraded process, so
+// its affinity keys match and it can open the sealed session table; nil
+// when the key is configured
+func (ss *SessionState) upgradeKey() []byte {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return bytes.Clone(ss.master)
+}
+
+// inherit takes over a key generated by the previous process, unless the
+// key is configured
+func (ss *SessionState) inherit(key []byte) {
+	if len(key) < 32 || !ss.generatedKey() {
+		return
+	}
+	ss.setKey(key, true)
+}
+
+// generatedKey reports whether the key was generated, by this or an
+// earlier process of the same upgrade chain, rather than configured
+func (ss *SessionState) generatedKey() bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.master != nil
+}
+
+// sealedSessions is the session part of the routing state before encryption
+type sealedSessions struct {
+	Sessions     map[string]string            `json:"sessions"`
+	PoolSessions map[string]map[string]string `json:"pool_sessions,omitempty"`
+}
+
+// seal encrypts the session tables
+func (ss *SessionState) seal(sessions sealedSessions) (string, error) {
+	plain, err := json.Marshal(sessions)
+	if err != nil {
+		return "", err
+	}
+	ss.mu.RLock()
+	aead := ss.aead
+	ss.mu.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// open decrypts session tables sealed with the same key
+func (ss *SessionState) open(sealed string) (sealedSessions, error) {
+	var sessions sealedSessions
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return sessions, fmt.Errorf("sealed sessions are not valid base64: %v", err)
+	}
+	ss.mu.RLock()
+	aead := ss.aead
+	ss.mu.RUnlock()
+
+	if len(data) < aead.NonceSize() {
+		return sessions, fmt.Errorf("sealed sessions are truncated")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return sessions, fmt.Errorf("sealed sessions cannot be decrypted, was the session state key changed? %v", err)
+	}
+	err = json.Unmarshal(plain, &sessions)
+	return sessions, err
+}
+
+// hashSessions converts a session table keyed by raw session IDs, as sent by
+// earlier versions, to affinity keys
+func (ss *SessionState) hashSessions(saved map[string]string) map[string]string {
+	hashed := make(map[string]string, len(saved))
+	for sessionID, backendURL := range saved {
+		hashed[ss.hash(sessionID)] = backendURL
+	}
+	return hashed
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+// Session IDs are hashed on every request with pooled HMAC states; only the
+// returned hex string is allocated
+func TestSessionStateHashAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	ss := NewSessionState()
+	first := ss.hash("session-1")
+	if first != ss.hash("session-1") || first == ss.hash("session-2") {
+		t.Fatalf("hash is not a function of the session ID")
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		ss.hash("session-1")
+	})
+	if allocs > 1 {
+		t.Errorf("hash allocates %.1f times per call, want at most 1", allocs)
+	}
+}
+
+func BenchmarkSessionStateHash(b *testing.B) {
+	ss := NewSessionState()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ss.hash("0123456789abcdef0123456789abcdef")
+	}
+}
+
+// A generated key reaches the upgraded process through an inherited pipe,
+// so it hashes session IDs alike and opens the sealed session table
+func TestSessionStateKeyHandoff(t *testing.T) {
+	parent := NewSessionState()
+	sealed, err := parent.seal(sealedSessions{Sessions: map[string]string{parent.hash("s1"): "http://10.0.0.1:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyRead, keyWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyWrite.Write(parent.upgradeKey())
+	keyWrite.Close()
+	l := &Listeners{sessionKey: keyRead}
+
+	child := NewSessionState()
+	child.Configure(SessionStateConfig{})
+	child.inherit(l.inheritedSessionKey())
+	if child.hash("s1") != parent.hash("s1") {
+		t.Error("upgraded process hashes session IDs differently")
+	}
+	if sessions, err := child.open(sealed); err != nil || len(sessions.Sessions) != 1 {
+		t.Errorf("upgraded process opened %v, %v", sessions, err)
+	}
+	if l.sessionKey != nil || l.inheritedSessionKey() != nil {
+		t.Error("session key pipe left open after reading")
+	}
+	if _, ok := os.LookupEnv(sessionStateKeyEnv); ok {
+		t.Errorf("%s set in the environment", sessionStateKeyEnv)
+	}
+}
+
+// A configured key is not handed over and not replaced by an inherited one
+func TestSessionStateConfiguredKeyNotHandedOver(t *testing.T) {
+	t.Setenv("QUIC_LB_TEST_SESSION_KEY", "0123456789abcdef0123456789abcdef")
+	ss := NewSessionState()
+	ss.Configure(SessionStateConfig{KeyRef: "env:QUIC_LB_TEST_SESSION_KEY"})
+	if key := ss.upgradeKey(); key != nil {
+		t.Errorf("configured key handed over: %x", key)
+	}
+	before := ss.hash("s1")
+	ss.inherit(NewSessionState().upgradeKey())
+	if ss.hash("s1") != before {
+		t.Error("inherited key replaced the configured one")
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeFetchTimeout bounds the wait for the first SVID at startup
+const spiffeFetchTimeout = 30 * time.Second
+
+// SPIFFEConfig connects the load balancer to a SPIFFE Workload API, such as
+// a SPIRE agent, which issues and rotates its X.509 SVID
+type SPIFFEConfig struct {
+	WorkloadAPIAddr string   `json:"workload_api_addr,omitempty"` // "unix:///run/spire/sockets/agent.sock", defaults to $SPIFFE_ENDPOINT_SOCKET
+	BackendMTLS     bool     `json:"backend_mtls,omitempty"`      // Present the SVID to https backends and verify theirs
+	BackendIDs      []string `json:"backend_ids,omitempty"`       // SPIFFE IDs accepted from backends, default any ID in the load balancer's trust domain
+}
+
+// workloadAPIAddr returns the configured Workload API address or the one from the environment
+func (sc *SPIFFEConfig) workloadAPIAddr() string {
+	if sc.WorkloadAPIAddr != "" {
+		return sc.WorkloadAPIAddr
+	}
+	return os.Getenv(workloadapi.SocketEnv)
+}
+
+// validate checks the Workload API address when SPIFFE is used and the backend IDs
+func (sc *SPIFFEConfig) validate(used bool) []error {
+	var errs []error
+	if used {
+		if addr := sc.workloadAPIAddr(); addr == "" {
+			errs = append(errs, fmt.Errorf("spiffe.workload_api_addr is required when SPIFFE is used (or set %s)", workloadapi.SocketEnv))
+		} else if err := workloadapi.ValidateAddress(addr); err != nil {
+			errs = append(errs, fmt.Errorf("spiffe.workload_api_addr %q: %v", addr, err))
+		}
+	}
+	if len(sc.BackendIDs) > 0 && !sc.BackendMTLS {
+		errs = append(errs, fmt.Errorf("spiffe.backend_ids requires spiffe.backend_mtls"))
+	}
+	for _, id := range sc.BackendIDs {
+		if _, err := spiffeid.FromString(id); err != nil {
+			errs = append(errs, fmt.Errorf("spiffe.backend_ids: %q: %v", id, err))
+		}
+	}
+	return errs
+}
+
+// usesSPIFFE reports whether a listener serves the SVID or backends get SPIFFE mTLS
+func (c *Config) usesSPIFFE() bool {
+	if c.SPIFFE.BackendMTLS {
+		return true
+	}
+	for _, name := range []string{c.Server.TLSProfile, c.Server.QUICTLSProfile} {
+		if _, profile, err := c.TLSProfile(name); err == nil && profile.SPIFFE {
+			return true
+		}
+	}
+	return false
+}
+
+// newSPIFFESource connects to the Workload API and waits for the first SVID.
+// The source keeps the SVID and trust bundles current until it is closed.
+func newSPIFFESource(cfg SPIFFEConfig) (*workloadapi.X509Source, error) {
+	addr := cfg.workloadAPIAddr()
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeFetchTimeout)
+	defer cancel()
+
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch X.509 SVID from SPIFFE Workload API %s: %v", addr, err)
+	}
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	log.Printf("🪪 SPIFFE identity %s from %s (expires %s)", svid.ID, addr, svid.Certificates[0].NotAfter.Format(time.RFC3339))
+	return source, nil
+}
+
+// spiffeBackendTLS returns the TLS config presenting the SVID to https
+// backends and accepting only backends with an authorized SPIFFE ID. Plain
+// http backends are unaffected.
+func spiffeBackendTLS(source *workloadapi.X509Source, cfg SPIFFEConfig) (*tls.Config, error) {
+	var authorizer tlsconfig.Authorizer
+	if len(cfg.BackendIDs) > 0 {
+		ids := make([]spiffeid.ID, 0, len(cfg.BackendIDs))
+		for _, id := range cfg.BackendIDs {
+			parsed, err := spiffeid.FromString(id)
+			if err != nil {
+				return nil, fmt.Errorf("spiffe.backend_ids: %q: %v", id, err)
+			}
+			ids = append(ids, parsed)
+		}
+		authorizer = tlsconfig.AuthorizeOneOf(ids...)
+	} else {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return nil, err
+		}
+		authorizer = tlsconfig.AuthorizeMemberOf(svid.ID.TrustDomain())
+	}
+
+	return tlsconfig.MTLSClientConfig(source, source, authorizer), nil
+}
+
+// logSVIDRotations logs every SVID the Workload API pushes until ctx is cancelled
+func logSVIDRotations(ctx context.Context, source *workloadapi.X509Source) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-source.Updated():
+			svid, err := source.GetX509SVID()
+			if err != nil {
+				log.Printf("⚠️ SPIFFE SVID update: %v", err)
+				continue
+			}
+			log.Printf("🔄 SPIFFE SVID rotated for %s (expires %s)", svid.ID, svid.Certificates[0].NotAfter.Format(time.RFC3339))
+		}
+	}
+}
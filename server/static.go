@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// defaultStaticMaxAge is how long browsers may reuse static files without
+// revalidating them
+const defaultStaticMaxAge = time.Hour
+
+// staticEncodings lists precompressed variants in preference order, with
+// the file suffix each is stored under
+var staticEncodings = []struct {
+	encoding string
+	suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// StaticConfig controls how /static/ files are served from server.static_dir
+type StaticConfig struct {
+	MaxAge           balancer.Duration `json:"max_age,omitempty"`           // Cache-Control max-age, default 1h; negative sends no-cache so every use is revalidated
+	Immutable        bool              `json:"immutable,omitempty"`         // Add "immutable" for fingerprinted assets that never change under the same name
+	DirectoryListing bool              `json:"directory_listing,omitempty"` // List directories without an index.html; off answers 404
+}
+
+// validate checks the static file settings
+func (sc *StaticConfig) validate() []error {
+	var errs []error
+	if sc.Immutable && sc.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("static.immutable needs a positive static.max_age"))
+	}
+	return errs
+}
+
+// cacheControl returns the Cache-Control header value for static files
+func (sc *StaticConfig) cacheControl() string {
+	maxAge := sc.MaxAge.Duration()
+	switch {
+	case maxAge < 0:
+		return "no-cache"
+	case maxAge == 0:
+		maxAge = defaultStaticMaxAge
+	}
+	value := "public, max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if sc.Immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+// staticHandler serves files below root with validators and caching
+// headers, preferring .br and .gz files stored next to the requested one
+type staticHandler struct {
+	root   string
+	config func() StaticConfig
+	list   http.Handler // directory listings
+}
+
+// newStaticHandler serves root; config is read on every request so reloads
+// apply immediately
+func newStaticHandler(root string, config func() StaticConfig) *staticHandler {
+	return &staticHandler{root: root, config: config, list: http.FileServer(http.Dir(root))}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := h.config()
+	name := path.Clean("/" + r.URL.Path)
+	info, err := os.Stat(h.path(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		if r.URL.Path != "" && !strings.HasSuffix(r.URL.Path, "/") {
+			// Relative links in the index resolve against the directory
+			http.Redirect(w, r, path.Base(name)+"/", http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if indexInfo, err := os.Stat(h.path(index)); err == nil && indexInfo.Mode().IsRegular() {
+			name, info = index, indexInfo
+		} else if cfg.DirectoryListing {
+			w.Header().Set("Cache-Control", "no-cache")
+			h.list.ServeHTTP(w, r)
+			return
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	header := w.Header()
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Cache-Control", cfg.cacheControl())
+
+	// A precompressed variant is sent as is, with the original's type
+	served, servedInfo, encoding := name, info, ""
+	precompressed := false
+	for _, variant := range staticEncodings {
+		variantInfo, err := os.Stat(h.path(name + variant.suffix))
+		if err != nil || !variantInfo.Mode().IsRegular() {
+			continue
+		}
+		precompressed = true
+		if encoding == "" && contentType != "" && acceptsEncoding(r, variant.encoding) {
+			served, servedInfo, encoding = name+variant.suffix, variantInfo, variant.encoding
+		}
+	}
+	if precompressed {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("Etag", staticETag(servedInfo, encoding))
+
+	f, err := os.Open(h.path(served))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	// Last-Modified and conditional requests follow the original file
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// path maps a cleaned URL path below root
+func (h *staticHandler) path(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+// staticETag derives a strong validator from size and modification time;
+// each encoding is a different representation
+func staticETag(info fs.FileInfo, encoding string) string {
+	tag := strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36)
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding allows encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	cc := CompressionConfig{Encodings: []string{encoding}}
+	return cc.negotiateEncoding(r.Header.Get("Accept-Encoding")) == encoding
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultSteeringQueueLen is how many datagrams wait for one worker before
+// new ones are dropped, as a kernel socket buffer would
+const defaultSteeringQueueLen = 1024
+
+// maxL4Datagram is the largest datagram read. QUIC packets stay below the
+// path MTU, far smaller.
+const maxL4Datagram = 2048
+
+// l4Buffers recycles the datagram buffers handed from the reader to the
+// steering workers
+var l4Buffers = sync.Pool{New: func() any { return new([maxL4Datagram]byte) }}
+
+// steeredPacket is one received datagram waiting for its worker
+type steeredPacket struct {
+	data []byte         // the datagram, owned by the worker until handled
+	from netip.AddrPort // sender
+	dcid []byte         // destination connection ID within data
+}
+
+// packetSteering hands received QUIC datagrams to per-core workers by a hash
+// of their destination connection ID, so all packets for one connection ID
+// are handled by one worker: they stay in order and workers share no locks.
+// A full worker queue drops the datagram, which QUIC recovers from like any
+// other loss.
+type packetSteering struct {
+	seed    maphash.Seed
+	workers []*steeringWorker
+	wg      sync.WaitGroup
+}
+
+// steeringWorker is one worker's queue and counters
+type steeringWorker struct {
+	queue     chan steeredPacket
+	handled   atomic.Int64
+	dropped   atomic.Int64
+	highWater atomic.Int64 // deepest the queue has been
+}
+
+// newPacketSteering starts workers (GOMAXPROCS when 0) with queueLen slots
+// each (defaultSteeringQueueLen when 0), each calling handle for its
+// datagrams until close
+func newPacketSteering(workers, queueLen int, handle func(worker int, pkt steeredPacket)) *packetSteering {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queueLen <= 0 {
+		queueLen = defaultSteeringQueueLen
+	}
+	ps := &packetSteering{seed: maphash.MakeSeed(), workers: make([]*steeringWorker, workers)}
+	for i := range ps.workers {
+		w := &steeringWorker{queue: make(chan steeredPacket, queueLen)}
+		ps.workers[i] = w
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			for pkt := range w.queue {
+				handle(i, pkt)
+				w.handled.Add(1)
+			}
+		}()
+	}
+	return ps
+}
+
+// steer queues pkt for the worker owning its connection ID and reports
+// whether it was queued
+func (ps *packetSteering) steer(pkt steeredPacket) bool {
+	w := ps.workers[maphash.Bytes(ps.seed, pkt.dcid)%uint64(len(ps.workers))]
+	select {
+	case w.queue <- pkt:
+		if depth := int64(len(w.queue)); depth > w.highWater.Load() {
+			w.highWater.Store(depth)
+		}
+		return true
+	default:
+		w.dropped.Add(1)
+		return false
+	}
+}
+
+// receive reads datagrams from conn into l4Buffers and steers each by the
+// connection ID dcid finds in it, until reading fails; it returns that
+// error. dcid sees the datagram as read, so one filling maxL4Datagram may
+// have been truncated. Datagrams dcid rejects, and those dropped by a full
+// queue, go back to l4Buffers; the others are the handler's to put back.
+func (ps *packetSteering) receive(conn net.PacketConn, dcid func(packet []byte) ([]byte, bool)) error {
+	for {
+		buf := l4Buffers.Get().(*[maxL4Datagram]byte)
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			l4Buffers.Put(buf)
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			l4Buffers.Put(buf)
+			continue
+		}
+		id, ok := dcid(buf[:n])
+		if !ok {
+			l4Buffers.Put(buf)
+			continue
+		}
+		if !ps.steer(steeredPacket{data: buf[:n], from: udpAddr.AddrPort(), dcid: id}) {
+			l4Buffers.Put(buf)
+		}
+	}
+}
+
+// close stops accepting datagrams and waits for the workers to finish the
+// queued ones; steer must not be called afterwards
+func (ps *packetSteering) close() {
+	for _, w := range ps.workers {
+		close(w.queue)
+	}
+	ps.wg.Wait()
+}
+
+// snapshot reports the queue depth and counters of every worker
+func (ps *packetSteering) snapshot() []map[string]interface{} {
+	workers := make([]map[string]interface{}, len(ps.workers))
+	for i, w := range ps.workers {
+		workers[i] = map[string]interface{}{
+			"worker":      i,
+			"queue_depth": len(w.queue),
+			"queue_len":   cap(w.queue),
+			"high_water":  w.highWater.Load(),
+			"handled":     w.handled.Load(),
+			"dropped":     w.dropped.Load(),
+		}
+	}
+	return workers
+}
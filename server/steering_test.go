@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"quic-moodle/quiclb"
+)
+
+// Every datagram of a connection ID is handled by one worker, in the order
+// received
+func TestPacketSteeringKeepsConnectionsOnOneWorker(t *testing.T) {
+	var mu sync.Mutex
+	workerOf := make(map[string]int)
+	seen := make(map[string][]byte)
+	ps := newPacketSteering(4, 4096, func(worker int, pkt steeredPacket) {
+		mu.Lock()
+		defer mu.Unlock()
+		dcid := string(pkt.dcid)
+		if w, ok := workerOf[dcid]; ok && w != worker {
+			t.Errorf("connection ID %x handled by workers %d and %d", pkt.dcid, w, worker)
+		}
+		workerOf[dcid] = worker
+		seen[dcid] = append(seen[dcid], pkt.data[len(pkt.data)-1])
+	})
+
+	for seq := range 50 {
+		for conn := range 16 {
+			dcid := []byte(fmt.Sprintf("conn-%02d", conn))
+			data := append(append([]byte{0x40}, dcid...), byte(seq))
+			if !ps.steer(steeredPacket{data: data, dcid: data[1 : 1+len(dcid)]}) {
+				t.Fatalf("datagram %d of %s dropped with room in the queue", seq, dcid)
+			}
+		}
+	}
+	ps.close()
+
+	if len(seen) != 16 {
+		t.Fatalf("%d connection IDs handled, want 16", len(seen))
+	}
+	for dcid, seqs := range seen {
+		for i, seq := range seqs {
+			if int(seq) != i {
+				t.Fatalf("%s: datagram %d handled in position %d", dcid, seq, i)
+			}
+		}
+	}
+	var handled int64
+	for _, w := range ps.snapshot() {
+		handled += w["handled"].(int64)
+	}
+	if handled != 16*50 {
+		t.Errorf("workers handled %d datagrams, want %d", handled, 16*50)
+	}
+}
+
+// A full worker queue drops the datagram and counts it
+func TestPacketSteeringDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	ps := newPacketSteering(1, 2, func(int, steeredPacket) { <-release })
+
+	dcid := []byte("conn")
+	queued := 0
+	for range 10 {
+		if ps.steer(steeredPacket{data: dcid, dcid: dcid}) {
+			queued++
+		}
+	}
+	close(release)
+	ps.close()
+
+	// One datagram may be with the worker while two wait in the queue
+	if queued < 2 || queued > 3 {
+		t.Errorf("%d of 10 datagrams queued with a 2-slot queue", queued)
+	}
+	stats := ps.snapshot()[0]
+	if dropped := stats["dropped"].(int64); dropped != int64(10-queued) {
+		t.Errorf("dropped %d, want %d", dropped, 10-queued)
+	}
+	if hw := stats["high_water"].(int64); hw < 1 || hw > 2 {
+		t.Errorf("high water %d, want 1-2", hw)
+	}
+}
+
+// receive reads datagrams off the socket and steers them by the connection
+// ID found in each, skipping the ones without
+func TestPacketSteeringReceive(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan steeredPacket, 8)
+	ps := newPacketSteering(2, 8, func(_ int, pkt steeredPacket) {
+		handled <- pkt
+	})
+	rejected := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- ps.receive(conn, func(packet []byte) ([]byte, bool) {
+			dcid, err := quiclb.DestinationCID(packet, 4)
+			if err != nil {
+				rejected++
+				return nil, false
+			}
+			return dcid, true
+		})
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, packet := range [][]byte{
+		{0x40, 1, 2, 3, 4, 0xaa}, // 1-RTT
+		{0xc0, 0, 0, 0, 1, 21},   // long header with a 21-byte DCID
+		{0x40, 5, 6, 7, 8, 0xbb}, // 1-RTT
+	} {
+		if _, err := client.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The two connection IDs may be on different workers, so in any order
+	steered := make(map[string]bool)
+	for range 2 {
+		select {
+		case pkt := <-handled:
+			steered[string(pkt.dcid)] = true
+			if pkt.from.String() != client.LocalAddr().String() {
+				t.Errorf("datagram from %s, want %s", pkt.from, client.LocalAddr())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("datagram not steered")
+		}
+	}
+	if !steered["\x01\x02\x03\x04"] || !steered["\x05\x06\x07\x08"] {
+		t.Errorf("steered connection IDs %x, want 01020304 and 05060708", slices.Collect(maps.Keys(steered)))
+	}
+
+	conn.Close()
+	if err := <-done; err == nil {
+		t.Error("receive returned no error for a closed socket")
+	}
+	ps.close()
+	if rejected != 1 {
+		t.Errorf("%d datagrams rejected, want 1", rejected)
+	}
+}
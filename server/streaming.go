@@ -0,0 +1,366 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Streaming defaults
+const (
+	defaultFlushInterval   = 100 * time.Millisecond
+	defaultTransferIdle    = 30 * time.Second
+	defaultMinTrackedBytes = 1 << 20
+)
+
+// deadlineStep is how often a transfer's deadlines are pushed back at most
+const deadlineStep = time.Second
+
+// StreamingConfig tunes how proxied bodies stream. Bodies are copied through
+// a fixed-size buffer, never held whole in memory, and the read and write
+// deadlines of a proxied request move with its progress so large Moodle
+// uploads, downloads and backups outlive the listener's 10s timeouts.
+type StreamingConfig struct {
+	FlushInterval   balancer.Duration `json:"flush_interval,omitempty"`    // Flush response data to the client at least this often, default 100ms; negative flushes after every write
+	BufferSize      int               `json:"buffer_size,omitempty"`       // Copy buffer per proxied body in bytes, default 32768
+	IdleTimeout     balancer.Duration `json:"idle_timeout,omitempty"`      // How long a transfer may stall before it is aborted, default 30s
+	MinTrackedBytes int64             `json:"min_tracked_bytes,omitempty"` // Transfers at least this large are reported in /api/transfers, default 1 MiB
+}
+
+// validate checks the streaming settings
+func (sc *StreamingConfig) validate() []error {
+	var errs []error
+	if sc.BufferSize < 0 || sc.BufferSize > 16<<20 {
+		errs = append(errs, fmt.Errorf("streaming.buffer_size %d must be between 0 and 16 MiB", sc.BufferSize))
+	}
+	if sc.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("streaming.idle_timeout must not be negative"))
+	}
+	if sc.MinTrackedBytes < 0 {
+		errs = append(errs, fmt.Errorf("streaming.min_tracked_bytes %d must not be negative", sc.MinTrackedBytes))
+	}
+	return errs
+}
+
+// flushInterval returns the configured flush interval or its default
+func (sc *StreamingConfig) flushInterval() time.Duration {
+	if sc.FlushInterval == 0 {
+		return defaultFlushInterval
+	}
+	return sc.FlushInterval.Duration()
+}
+
+// idleTimeout returns the configured idle timeout or its default
+func (sc *StreamingConfig) idleTimeout() time.Duration {
+	if sc.IdleTimeout == 0 {
+		return defaultTransferIdle
+	}
+	return sc.IdleTimeout.Duration()
+}
+
+// minTrackedBytes returns the configured reporting threshold or its default
+func (sc *StreamingConfig) minTrackedBytes() int64 {
+	if sc.MinTrackedBytes == 0 {
+		return defaultMinTrackedBytes
+	}
+	return sc.MinTrackedBytes
+}
+
+// TransferStats measures proxied request and response bodies. Transfers of
+// at least min_tracked_bytes are counted with their rates.
+type TransferStats struct {
+	mu         sync.Mutex
+	active     map[*transfer]struct{}
+	completed  int64
+	aborted    int64
+	uploaded   int64
+	downloaded int64
+	busy       time.Duration // summed duration of the counted transfers
+	peakRate   float64       // bytes/s of the fastest counted transfer
+}
+
+// NewTransferStats creates empty transfer metrics
+func NewTransferStats() *TransferStats {
+	return &TransferStats{active: make(map[*transfer]struct{})}
+}
+
+// transfer is one proxied request whose bodies are streamed
+type transfer struct {
+	method    string
+	path      string
+	backendID int
+	started   time.Time
+	idle      time.Duration
+	min       int64
+	rc        *http.ResponseController
+
+	in  atomic.Int64 // request body bytes read from the client
+	out atomic.Int64 // response body bytes written to the client
+
+	deadlineMu    sync.Mutex
+	readExtended  time.Time
+	writeExtended time.Time
+}
+
+// start begins streaming r to peer. The returned writer and request carry
+// the bodies; call finish with the writer once the proxy returns.
+func (ts *TransferStats) start(w http.ResponseWriter, r *http.Request, peer *balancer.Backend, sc StreamingConfig) (*transferWriter, *http.Request) {
+	t := &transfer{
+		method:    r.Method,
+		path:      r.URL.Path,
+		backendID: peer.ID,
+		started:   time.Now(),
+		idle:      sc.idleTimeout(),
+		min:       sc.minTrackedBytes(),
+		rc:        http.NewResponseController(w),
+	}
+	// The server's fixed timeouts would cut off long transfers; progress
+	// moves these deadlines forward instead
+	t.rc.SetReadDeadline(t.started.Add(t.idle))
+	t.rc.SetWriteDeadline(t.started.Add(t.idle))
+
+	ts.mu.Lock()
+	ts.active[t] = struct{}{}
+	ts.mu.Unlock()
+
+	if r.Body != nil && r.Body != http.NoBody {
+		// A shallow copy keeps sharing the Trailer map the server fills in
+		// once the body is read
+		body := &transferBody{ReadCloser: r.Body, t: t}
+		r2 := *r
+		r = &r2
+		r.Body = body
+	}
+	return &transferWriter{ResponseWriter: w, t: t, interval: sc.flushInterval()}, r
+}
+
+// finish records the transfer; aborted transfers are those whose client or
+// backend went away before the response was complete
+func (ts *TransferStats) finish(tw *transferWriter, r *http.Request) {
+	tw.stopFlushing()
+	t := tw.t
+	elapsed := time.Since(t.started)
+	in, out := t.in.Load(), t.out.Load()
+	aborted := r.Context().Err() != nil
+
+	ts.mu.Lock()
+	delete(ts.active, t)
+	counted := in+out >= t.min
+	if counted {
+		if aborted {
+			ts.aborted++
+		} else {
+			ts.completed++
+		}
+		ts.uploaded += in
+		ts.downloaded += out
+		ts.busy += elapsed
+		if rate := transferRate(in+out, elapsed); rate > ts.peakRate {
+			ts.peakRate = rate
+		}
+	}
+	ts.mu.Unlock()
+
+	if counted {
+		state := "✅"
+		if aborted {
+			state = "⚠️ aborted"
+		}
+		log.Printf("🚚 Transfer %s %s via Backend #%d %s: %s up, %s down in %v (%s/s)",
+			t.method, t.path, t.backendID, state, formatBytes(in), formatBytes(out),
+			elapsed.Round(time.Millisecond), formatBytes(int64(transferRate(in+out, elapsed))))
+	}
+}
+
+// transferRate returns bytes per second
+func transferRate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// formatBytes prints a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// extendRead pushes the read deadline back after request body progress
+func (t *transfer) extendRead() {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	if now := time.Now(); now.Sub(t.readExtended) >= deadlineStep {
+		t.readExtended = now
+		t.rc.SetReadDeadline(now.Add(t.idle))
+	}
+}
+
+// extendWrite pushes the write deadline back after response body progress
+func (t *transfer) extendWrite() {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	if now := time.Now(); now.Sub(t.writeExtended) >= deadlineStep {
+		t.writeExtended = now
+		t.rc.SetWriteDeadline(now.Add(t.idle))
+	}
+}
+
+// transferBody counts the request body and extends the read deadline
+type transferBody struct {
+	io.ReadCloser
+	t *transfer
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.t.in.Add(int64(n))
+		b.t.extendRead()
+	}
+	return n, err
+}
+
+// transferWriter counts the response body, extends the write deadline and
+// flushes buffered data at least every interval
+type transferWriter struct {
+	http.ResponseWriter
+	t        *transfer
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer // pending flush, nil when everything is flushed
+	stopped bool
+	status  int // final status written, 0 until then
+}
+
+// WriteHeader remembers the final status for the request's metrics
+func (w *transferWriter) WriteHeader(code int) {
+	if code >= 200 && w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// statusCode returns the final status of the response
+func (w *transferWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *transferWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		w.t.out.Add(int64(n))
+		w.t.extendWrite()
+	}
+	if err != nil {
+		return n, err
+	}
+	if w.interval < 0 {
+		w.t.rc.Flush()
+	} else if w.timer == nil && !w.stopped {
+		w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+	}
+	return n, nil
+}
+
+// delayedFlush sends what was written since the last flush
+func (w *transferWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.timer = nil
+	w.t.rc.Flush()
+}
+
+func (w *transferWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.t.rc.Flush()
+}
+
+// stopFlushing cancels a pending flush before the handler returns
+func (w *transferWriter) stopFlushing() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *transferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Snapshot reports totals and the active transfers above the threshold
+func (ts *TransferStats) Snapshot() map[string]interface{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	active := make([]map[string]interface{}, 0)
+	for t := range ts.active {
+		in, out := t.in.Load(), t.out.Load()
+		if in+out < t.min {
+			continue
+		}
+		elapsed := time.Since(t.started)
+		active = append(active, map[string]interface{}{
+			"method":          t.method,
+			"path":            t.path,
+			"backend_id":      t.backendID,
+			"bytes_in":        in,
+			"bytes_out":       out,
+			"elapsed_seconds": elapsed.Seconds(),
+			"rate_bps":        transferRate(in+out, elapsed),
+		})
+	}
+	avgRate := 0.0
+	if ts.busy > 0 {
+		avgRate = transferRate(ts.uploaded+ts.downloaded, ts.busy)
+	}
+	return map[string]interface{}{
+		"completed":        ts.completed,
+		"aborted":          ts.aborted,
+		"bytes_uploaded":   ts.uploaded,
+		"bytes_downloaded": ts.downloaded,
+		"avg_rate_bps":     avgRate,
+		"peak_rate_bps":    ts.peakRate,
+		"in_flight":        len(ts.active),
+		"active":           active,
+	}
+}
+
+// handleTransfers serves GET /api/transfers with body transfer rates
+func (s *Server) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.transfers.Snapshot()
+	stats["buffer_size"] = s.pools.buffers.Size()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
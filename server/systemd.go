@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemd socket activation passes sockets starting at fd 3
+const sdListenFDsStart = 3
+
+// systemdListeners builds the listeners from sockets passed by systemd
+// (LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES). It returns nil when the process
+// was not socket-activated.
+//
+// Sockets are matched by FileDescriptorName= ("tcp", "udp", "http", "admin") when
+// set; otherwise stream sockets are matched to server.listen_addr,
+// server.http_listen_addr and admin.listen_addr by port, and the datagram
+// socket is used for QUIC. The admin listener is bound directly if not passed.
+func systemdListeners(cfg *Config) (*Listeners, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	// Don't pass the activation environment on to children (e.g. upgrades)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	l := &Listeners{Inherited: true}
+	var unnamedStreams []net.Listener
+
+	for i := 0; i < count; i++ {
+		fd := sdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			return nil, fmt.Errorf("systemd fd %d (%s): %v", fd, name, err)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		if sotype == syscall.SOCK_DGRAM {
+			conn, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("systemd fd %d (%s): %v", fd, name, err)
+			}
+			if l.UDP != nil {
+				conn.Close()
+				return nil, fmt.Errorf("systemd passed more than one datagram socket")
+			}
+			l.UDP = conn
+			continue
+		}
+
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd fd %d (%s): %v", fd, name, err)
+		}
+		switch name {
+		case "tcp":
+			l.TCP = ln
+		case "http":
+			l.HTTP = ln
+		case "admin":
+			l.Admin = ln
+		default:
+			unnamedStreams = append(unnamedStreams, ln)
+		}
+	}
+
+	for _, ln := range unnamedStreams {
+		switch {
+		case l.TCP == nil && samePort(ln.Addr(), cfg.Server.ListenAddr):
+			l.TCP = ln
+		case l.HTTP == nil && cfg.Server.HTTPListenAddr != "" && samePort(ln.Addr(), cfg.Server.HTTPListenAddr):
+			l.HTTP = ln
+		case l.Admin == nil && samePort(ln.Addr(), cfg.Admin.ListenAddr):
+			l.Admin = ln
+		default:
+			return nil, fmt.Errorf("systemd socket %s matches none of server.listen_addr, server.http_listen_addr, admin.listen_addr; set FileDescriptorName=", ln.Addr())
+		}
+	}
+
+	if l.TCP == nil || l.UDP == nil {
+		return nil, fmt.Errorf("systemd socket activation requires a TCP and a UDP socket for %s (got tcp=%v udp=%v)",
+			cfg.Server.ListenAddr, l.TCP != nil, l.UDP != nil)
+	}
+	if l.Admin == nil {
+		// The admin API is private by default; bind it ourselves if systemd didn't
+		ln, err := net.Listen("tcp", cfg.Admin.ListenAddr)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to listen on admin address %s: %v", cfg.Admin.ListenAddr, err)
+		}
+		l.Admin = ln
+	}
+	return l, nil
+}
+
+// samePort reports whether addr listens on the port of a configured address
+func samePort(addr net.Addr, configured string) bool {
+	_, port, err := net.SplitHostPort(configured)
+	if err != nil {
+		return false
+	}
+	_, actual, err := net.SplitHostPort(addr.String())
+	return err == nil && actual == port
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Timeout defaults
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMinBodyRate       = 1024
+	defaultBodyGrace         = 10 * time.Second
+)
+
+// TimeoutsConfig bounds how long clients may take to send requests, the
+// defense against slowloris clients holding connections open by trickling
+// bytes. Header and idle timeouts apply to the TCP listeners and take effect
+// after a restart; HTTP/3 has no header phase hook, there the QUIC idle
+// timeout and the per-client stream limits bound half-sent requests. Body
+// limits apply to every protocol and are answered with 408.
+type TimeoutsConfig struct {
+	ReadHeader  balancer.Duration `json:"read_header,omitempty"`   // Time a TCP client has to send the request headers, default 10s
+	Idle        balancer.Duration `json:"idle,omitempty"`          // Close keep-alive connections and HTTP/3 connections without requests after this long, default 2m
+	Body        balancer.Duration `json:"body,omitempty"`          // Longest a request body may take to arrive, 0 for no limit
+	MinBodyRate int64             `json:"min_body_rate,omitempty"` // Bytes per second a body must arrive at while the load balancer waits for it, default 1024; -1 turns the check off
+	BodyGrace   balancer.Duration `json:"body_grace,omitempty"`    // Waiting time before min_body_rate applies, default 10s
+}
+
+// validate checks the timeouts
+func (tc *TimeoutsConfig) validate() []error {
+	var errs []error
+	if tc.ReadHeader < 0 || tc.Idle < 0 || tc.Body < 0 || tc.BodyGrace < 0 {
+		errs = append(errs, fmt.Errorf("timeouts must not be negative"))
+	}
+	if tc.MinBodyRate < -1 {
+		errs = append(errs, fmt.Errorf("timeouts.min_body_rate %d must be -1 (off) or more", tc.MinBodyRate))
+	}
+	return errs
+}
+
+// readHeader returns the configured header timeout or its default
+func (tc *TimeoutsConfig) readHeader() time.Duration {
+	if tc.ReadHeader == 0 {
+		return defaultReadHeaderTimeout
+	}
+	return tc.ReadHeader.Duration()
+}
+
+// idle returns the configured idle timeout or its default
+func (tc *TimeoutsConfig) idle() time.Duration {
+	if tc.Idle == 0 {
+		return defaultIdleTimeout
+	}
+	return tc.Idle.Duration()
+}
+
+// minBodyRate returns the configured body rate or its default, 0 when off
+func (tc *TimeoutsConfig) minBodyRate() int64 {
+	switch tc.MinBodyRate {
+	case 0:
+		return defaultMinBodyRate
+	case -1:
+		return 0
+	}
+	return tc.MinBodyRate
+}
+
+// bodyGrace returns the configured grace period or its default
+func (tc *TimeoutsConfig) bodyGrace() time.Duration {
+	if tc.BodyGrace == 0 {
+		return defaultBodyGrace
+	}
+	return tc.BodyGrace.Duration()
+}
+
+// Reasons a request or connection timed out
+const (
+	timeoutHeader    = "header"
+	timeoutIdle      = "idle"
+	timeoutBodyLimit = "body"
+	timeoutBodyRate  = "body_rate"
+	timeoutBodyIdle  = "body_stalled"
+)
+
+// Timeouts enforces the body limits and counts timed-out requests and
+// connections
+type Timeouts struct {
+	mu       sync.Mutex
+	cfg      TimeoutsConfig
+	listener TimeoutsConfig       // settings the TCP listeners were started with
+	counts   map[string]int64     // reason -> requests or connections
+	conns    map[string]*connWait // TCP connections by client address
+}
+
+// connWait is a TCP connection waiting for its next request
+type connWait struct {
+	since   time.Time // when the connection was accepted or went idle
+	idle    bool      // waiting after an earlier request
+	reading bool      // part of a request arrived
+	served  bool      // the request reached the handler
+}
+
+// NewTimeouts creates timeouts with the defaults
+func NewTimeouts() *Timeouts {
+	return &Timeouts{counts: make(map[string]int64), conns: make(map[string]*connWait)}
+}
+
+// Configure applies new settings; header and idle timeouts only change
+// with the listeners
+func (t *Timeouts) Configure(cfg TimeoutsConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg = cfg
+}
+
+// configureServer sets the header and idle timeouts of a TCP server and
+// counts the connections they close
+func (t *Timeouts) configureServer(srv *http.Server) {
+	t.mu.Lock()
+	t.listener = t.cfg
+	cfg := t.cfg
+	t.mu.Unlock()
+	srv.ReadHeaderTimeout = cfg.readHeader()
+	srv.IdleTimeout = cfg.idle()
+	srv.ConnState = t.connState
+}
+
+// connState counts connections closed before a request arrived in time.
+// net/http closes them silently, so a close after waiting at least the
+// timeout without the request reaching the handler is taken as one.
+func (t *Timeouts) connState(c net.Conn, state http.ConnState) {
+	addr := c.RemoteAddr().String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew, http.StateIdle:
+		t.conns[addr] = &connWait{since: time.Now(), idle: state == http.StateIdle}
+		return
+	case http.StateActive:
+		// Set once the first bytes of a request arrived
+		if wait, ok := t.conns[addr]; ok {
+			wait.reading = true
+		}
+		return
+	}
+	wait, ok := t.conns[addr]
+	delete(t.conns, addr)
+	if !ok || wait.served || state != http.StateClosed {
+		return
+	}
+	waited := time.Since(wait.since)
+	switch {
+	case (wait.reading || !wait.idle) && waited >= t.listener.readHeader():
+		t.counts[timeoutHeader]++
+		log.Printf("🐌 Closed %s: no complete request headers within %v", addr, t.listener.readHeader())
+	case wait.idle && waited >= t.listener.idle():
+		t.counts[timeoutIdle]++
+	}
+}
+
+// track notes that r reached the handler and limits its body
+func (t *Timeouts) track(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	if wait, ok := t.conns[r.RemoteAddr]; ok {
+		wait.served = true
+	}
+	t.mu.Unlock()
+	t.limitBody(w, r)
+}
+
+// limitBody makes r's body fail with balancer.ErrSlowClient when it takes
+// longer than the body timeout or arrives slower than the minimum rate.
+// CONNECT tunnels and gRPC streams may legitimately idle and are left alone.
+func (t *Timeouts) limitBody(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody || r.Method == http.MethodConnect || isGRPCRequest(r) {
+		return
+	}
+	t.mu.Lock()
+	cfg := t.cfg
+	t.mu.Unlock()
+	body := &timeoutBody{ReadCloser: r.Body, t: t, w: w, r: r, minRate: cfg.minBodyRate(), grace: cfg.bodyGrace()}
+	if cfg.Body > 0 {
+		body.limit = cfg.Body.Duration()
+	}
+	r.Body = body
+}
+
+// count records a timed-out request
+func (t *Timeouts) count(reason string) {
+	t.mu.Lock()
+	t.counts[reason]++
+	t.mu.Unlock()
+}
+
+// timeoutBody measures how long reads wait for the client. Only waiting
+// time counts towards the rate, so a slow backend reading the body does not
+// make the client look slow.
+type timeoutBody struct {
+	io.ReadCloser
+	t       *Timeouts
+	w       http.ResponseWriter
+	r       *http.Request
+	minRate int64
+	grace   time.Duration
+	limit   time.Duration
+
+	started time.Time
+	waited  time.Duration
+	bytes   int64
+	failed  error
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	if b.failed != nil {
+		return 0, b.failed
+	}
+	start := time.Now()
+	if b.started.IsZero() {
+		b.started = start
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.waited += time.Since(start)
+	b.bytes += int64(n)
+
+	switch {
+	case err != nil && errors.Is(err, os.ErrDeadlineExceeded):
+		err = b.fail(timeoutBodyIdle, "stalled")
+	case err != nil:
+	case b.limit > 0 && time.Since(b.started) > b.limit:
+		err = b.fail(timeoutBodyLimit, fmt.Sprintf("not complete after %v", b.limit))
+	case b.minRate > 0 && b.waited > b.grace && float64(b.bytes)/b.waited.Seconds() < float64(b.minRate):
+		err = b.fail(timeoutBodyRate, fmt.Sprintf("%d bytes in %v, below %d bytes/s", b.bytes, b.waited.Round(time.Millisecond), b.minRate))
+	}
+	return n, err
+}
+
+// fail counts the timeout and returns the error the proxy turns into 408.
+// The read deadline is moved to now so closing the body does not wait for
+// the rest of it.
+func (b *timeoutBody) fail(reason, detail string) error {
+	b.t.count(reason)
+	http.NewResponseController(b.w).SetReadDeadline(time.Now())
+	log.Printf("🐌 Request body of %s %s from %s %s", b.r.Method, b.r.URL.Path, b.r.RemoteAddr, detail)
+	b.failed = fmt.Errorf("%w: %s", balancer.ErrSlowClient, detail)
+	return b.failed
+}
+
+// Snapshot reports the timeouts and how often each one fired
+func (t *Timeouts) Snapshot() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int64, len(t.counts))
+	var total int64
+	for reason, n := range t.counts {
+		counts[reason] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"read_header":   t.listener.readHeader().String(),
+		"idle":          t.listener.idle().String(),
+		"body":          t.cfg.Body.Duration().String(),
+		"min_body_rate": t.cfg.minBodyRate(),
+		"body_grace":    t.cfg.bodyGrace().String(),
+		"timed_out":     counts,
+		"total":         total,
+	}
+}
+
+// handleTimeouts serves GET /api/timeouts with timed-out requests and
+// connections per reason
+func (s *Server) handleTimeouts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.timeouts.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// loadKeyPair loads a certificate with its key from key_file or key_ref
+func loadKeyPair(name string, cc CertificateConfig) (tls.Certificate, error) {
+	if cc.KeyRef == "" {
+		log.Printf("🔐 Loading certificates for TLS profile %q: cert=%s, key=%s", name, cc.CertFile, cc.KeyFile)
+		return tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+	}
+
+	log.Printf("🔐 Loading certificates for TLS profile %q: cert=%s, key from %s", name, cc.CertFile, redactSecretRef(cc.KeyRef))
+	certPEM, err := os.ReadFile(cc.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := resolveSecret(cc.KeyRef)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certSelector picks the certificate for a ClientHello by its SNI name
+type certSelector struct {
+	exact     map[string]*tls.Certificate // host -> certificate
+	wildcards map[string]*tls.Certificate // ".example.com" -> certificate for "*.example.com"
+	fallback  *tls.Certificate            // served when nothing matches or no SNI is sent
+	loaded    []loadedCertificate         // every certificate above with the file it came from
+}
+
+// loadedCertificate is a certificate a profile serves, kept for expiry monitoring
+type loadedCertificate struct {
+	file string
+	cert *tls.Certificate
+}
+
+// newCertSelector loads a profile's default certificate and its SNI certificates
+func newCertSelector(name string, profile TLSConfig) (*certSelector, error) {
+	fallback, err := loadKeyPair(name, profile.defaultCertificate())
+	if err != nil {
+		return nil, err
+	}
+	cs := &certSelector{
+		exact:     make(map[string]*tls.Certificate),
+		wildcards: make(map[string]*tls.Certificate),
+		fallback:  &fallback,
+		loaded:    []loadedCertificate{{file: profile.CertFile, cert: &fallback}},
+	}
+
+	for i, cc := range profile.Certificates {
+		cert, err := loadKeyPair(name, cc)
+		if err != nil {
+			return nil, fmt.Errorf("certificates[%d]: %v", i, err)
+		}
+		cs.loaded = append(cs.loaded, loadedCertificate{file: cc.CertFile, cert: &cert})
+		names := cc.ServerNames
+		if len(names) == 0 && cert.Leaf != nil {
+			names = cert.Leaf.DNSNames
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("certificates[%d]: %s has no DNS names, set server_names", i, cc.CertFile)
+		}
+		for _, host := range names {
+			host = normalizeHost(host)
+			if suffix, ok := strings.CutPrefix(host, "*"); ok {
+				cs.wildcards[suffix] = &cert
+			} else {
+				cs.exact[host] = &cert
+			}
+		}
+		log.Printf("🔐 TLS profile %q serves %s for %s", name, cc.CertFile, strings.Join(names, ", "))
+	}
+	return cs, nil
+}
+
+// certificate returns the certificate for an SNI name: an exact match, then a
+// wildcard covering its first label, then the default certificate
+func (cs *certSelector) certificate(serverName string) *tls.Certificate {
+	host := normalizeHost(serverName)
+	if cert, ok := cs.exact[host]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		if cert, ok := cs.wildcards[host[i:]]; ok {
+			return cert
+		}
+	}
+	return cs.fallback
+}
+
+// tcpTLSConfig adapts a listener TLS config for the TCP listener, where h3
+// cannot be negotiated
+func tcpTLSConfig(config *tls.Config) *tls.Config {
+	tcp := config.Clone()
+	tcp.NextProtos = slices.DeleteFunc(slices.Clone(config.NextProtos), func(proto string) bool {
+		return proto == "h3"
+	})
+	return tcp
+}
+
+// generateDevCertificate creates an in-memory self-signed certificate for
+// localhost, 127.0.0.1 and ::1 so the server runs without certificate files
+func generateDevCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"quic-lb development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	log.Printf("🧪 Generated self-signed development certificate for localhost (SHA-256 %s)", hex.EncodeToString(fingerprint[:]))
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// buildTLSConfig loads a profile's certificates, registers them with the
+// expiry monitor and builds the server TLS config. A non-nil devCert replaces
+// every certificate of the profile. SPIFFE profiles serve the current SVID,
+// which the Workload API rotates long before it expires, so they are not
+// monitored.
+func (s *Server) buildTLSConfig(name string, profile TLSConfig, devCert *tls.Certificate) (*tls.Config, error) {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if devCert == nil && profile.SPIFFE {
+		getCertificate = tlsconfig.GetCertificate(s.svids)
+		log.Printf("🪪 TLS profile %q serves the SPIFFE X.509 SVID", name)
+	} else {
+		certs := &certSelector{fallback: devCert, loaded: []loadedCertificate{{file: "(generated by -dev-tls)", cert: devCert}}}
+		if devCert == nil {
+			var err error
+			if certs, err = newCertSelector(name, profile); err != nil {
+				return nil, fmt.Errorf("failed to load certificates for TLS profile %q: %v", name, err)
+			}
+		}
+		s.certExpiry.track(name, profile.expiryWarning(), certs.loaded)
+		getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.certificate(hello.ServerName), nil
+		}
+	}
+
+	// Enhanced TLS configuration optimized for HTTP/3
+	minVersion, _ := parseTLSVersion(profile.MinVersion)
+	maxVersion, _ := parseTLSVersion(profile.MaxVersion)
+	cipherSuites, _ := parseCipherSuites(profile.CipherSuites)
+	curves, _ := parseCurves(profile.Curves)
+	config := &tls.Config{
+		MinVersion: minVersion,
+		MaxVersion: maxVersion,
+		// ALPN from the profile, HTTP/3, HTTP/2 and HTTP/1.1 by default
+		NextProtos: slices.Clone(profile.nextProtos()),
+		// TLS 1.2 cipher suites from the profile; TLS 1.3 (and so HTTP/3)
+		// always uses the crypto/tls TLS 1.3 suites
+		CipherSuites: slices.Clone(cipherSuites),
+		// Enable session resumption for 0-RTT
+		ClientSessionCache:     tls.NewLRUClientSessionCache(1000),
+		SessionTicketsDisabled: false,
+		// Key exchange groups from the profile, X25519, P-256 and P-384 by default
+		CurvePreferences: slices.Clone(curves),
+		GetCertificate:   getCertificate,
+	}
+
+	// Client certificates are verified during the handshake; routes that
+	// require one reject unauthenticated requests in the load balancer
+	if profile.ClientCAFile != "" {
+		pem, err := os.ReadFile(profile.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA for TLS profile %q: %v", name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA %s for TLS profile %q", profile.ClientCAFile, name)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if profile.ClientAuth == "require" {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		log.Printf("🪪 TLS profile %q verifies client certificates (%s)", name, profile.ClientCAFile)
+	}
+	return config, nil
+}
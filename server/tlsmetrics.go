@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeBuckets are the upper bounds of the handshake duration histogram
+var handshakeBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// HandshakeStats counts TLS handshakes per listener ("tcp", "quic")
+type HandshakeStats struct {
+	mu        sync.Mutex
+	listeners map[string]*ListenerHandshakeStats
+}
+
+// ListenerHandshakeStats is a snapshot of one listener's handshake counters
+type ListenerHandshakeStats struct {
+	Started        int64            `json:"started"`
+	Completed      int64            `json:"completed"`
+	Full           int64            `json:"full"`
+	Resumed        int64            `json:"resumed"`
+	Failed         int64            `json:"failed"` // TCP only; QUIC failures show as started but not completed
+	FailureReasons map[string]int64 `json:"failure_reasons"`
+	Versions       map[string]int64 `json:"versions"`
+	CipherSuites   map[string]int64 `json:"cipher_suites"`
+	ALPN           map[string]int64 `json:"alpn"`
+	DurationMs     map[string]int64 `json:"duration_ms"` // histogram keyed by upper bound, "+Inf" for the rest
+	AvgDurationMs  float64          `json:"avg_duration_ms"`
+
+	totalDuration time.Duration
+}
+
+// NewHandshakeStats creates empty handshake counters
+func NewHandshakeStats() *HandshakeStats {
+	return &HandshakeStats{listeners: make(map[string]*ListenerHandshakeStats)}
+}
+
+// listener returns the counters for a listener; the caller holds hs.mu
+func (hs *HandshakeStats) listener(name string) *ListenerHandshakeStats {
+	ls, ok := hs.listeners[name]
+	if !ok {
+		ls = &ListenerHandshakeStats{
+			FailureReasons: make(map[string]int64),
+			Versions:       make(map[string]int64),
+			CipherSuites:   make(map[string]int64),
+			ALPN:           make(map[string]int64),
+			DurationMs:     make(map[string]int64),
+		}
+		hs.listeners[name] = ls
+	}
+	return ls
+}
+
+// Snapshot returns a copy of the counters of every listener
+func (hs *HandshakeStats) Snapshot() map[string]ListenerHandshakeStats {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	snapshot := make(map[string]ListenerHandshakeStats, len(hs.listeners))
+	for name, ls := range hs.listeners {
+		c := *ls
+		c.FailureReasons = cloneCounts(ls.FailureReasons)
+		c.Versions = cloneCounts(ls.Versions)
+		c.CipherSuites = cloneCounts(ls.CipherSuites)
+		c.ALPN = cloneCounts(ls.ALPN)
+		c.DurationMs = cloneCounts(ls.DurationMs)
+		if ls.Completed > 0 {
+			c.AvgDurationMs = float64(ls.totalDuration) / float64(ls.Completed) / float64(time.Millisecond)
+		}
+		snapshot[name] = c
+	}
+	return snapshot
+}
+
+// cloneCounts copies a counter map
+func cloneCounts(m map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// instrument returns a copy of config that records every handshake on the
+// named listener. Each handshake gets its own config so its completion can be
+// matched with the ClientHello that started it.
+func (hs *HandshakeStats) instrument(listener string, config *tls.Config) *tls.Config {
+	base := config.Clone()
+	instrumented := config.Clone()
+	instrumented.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+		hs.mu.Lock()
+		hs.listener(listener).Started++
+		hs.mu.Unlock()
+
+		remote := ""
+		if hello.Conn != nil {
+			remote = hello.Conn.RemoteAddr().String()
+		}
+		perConn := base.Clone()
+		perConn.VerifyConnection = func(cs tls.ConnectionState) error {
+			if base.VerifyConnection != nil {
+				if err := base.VerifyConnection(cs); err != nil {
+					return err
+				}
+			}
+			hs.recordCompleted(listener, remote, cs, time.Since(start))
+			return nil
+		}
+		return perConn, nil
+	}
+	return instrumented
+}
+
+// recordCompleted counts a finished handshake and logs its parameters
+func (hs *HandshakeStats) recordCompleted(listener, remote string, cs tls.ConnectionState, d time.Duration) {
+	version := tls.VersionName(cs.Version)
+	cipher := tls.CipherSuiteName(cs.CipherSuite)
+	alpn := cs.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	mode := "full"
+	if cs.DidResume {
+		mode = "resumed"
+	}
+
+	hs.mu.Lock()
+	ls := hs.listener(listener)
+	ls.Completed++
+	if cs.DidResume {
+		ls.Resumed++
+	} else {
+		ls.Full++
+	}
+	ls.Versions[version]++
+	ls.CipherSuites[cipher]++
+	ls.ALPN[alpn]++
+	ls.DurationMs[durationBucket(d)]++
+	ls.totalDuration += d
+	hs.mu.Unlock()
+
+	log.Printf("🔒 tls_handshake listener=%s remote=%s sni=%q version=%q cipher=%s alpn=%s mode=%s duration_ms=%.2f",
+		listener, remote, cs.ServerName, version, cipher, alpn, mode, float64(d)/float64(time.Millisecond))
+}
+
+// recordFailed counts a failed handshake and logs its reason
+func (hs *HandshakeStats) recordFailed(listener, remote string, err string) {
+	reason := handshakeFailureReason(err)
+
+	hs.mu.Lock()
+	ls := hs.listener(listener)
+	ls.Failed++
+	ls.FailureReasons[reason]++
+	hs.mu.Unlock()
+
+	log.Printf("⚠️ tls_handshake_failed listener=%s remote=%s reason=%s error=%q", listener, remote, reason, err)
+}
+
+// durationBucket returns the histogram bucket label for a handshake duration
+func durationBucket(d time.Duration) string {
+	for _, bound := range handshakeBuckets {
+		if d <= bound {
+			return strconv.FormatInt(bound.Milliseconds(), 10)
+		}
+	}
+	return "+Inf"
+}
+
+// handshakeFailureReason maps a crypto/tls handshake error to a short reason
+func handshakeFailureReason(err string) string {
+	switch {
+	case strings.Contains(err, "EOF"), strings.Contains(err, "connection reset"):
+		return "client_closed"
+	case strings.Contains(err, "timeout"):
+		return "timeout"
+	case strings.Contains(err, "does not look like a TLS handshake"), strings.Contains(err, "HTTP request to an HTTPS server"):
+		return "not_tls"
+	case strings.Contains(err, "protocol version"), strings.Contains(err, "unsupported versions"):
+		return "version_mismatch"
+	case strings.Contains(err, "no cipher suite"):
+		return "no_shared_cipher"
+	case strings.Contains(err, "no application protocol"):
+		return "no_shared_alpn"
+	case strings.Contains(err, "certificate"):
+		return "bad_certificate"
+	default:
+		return "other"
+	}
+}
+
+// handshakeErrorLog is an http.Server ErrorLog writer that turns "TLS
+// handshake error" lines into failure metrics and passes other lines through
+type handshakeErrorLog struct {
+	stats    *HandshakeStats
+	listener string
+}
+
+func (l handshakeErrorLog) Write(p []byte) (int, error) {
+	line := string(bytes.TrimSpace(p))
+	const prefix = "http: TLS handshake error from "
+	if rest, ok := strings.CutPrefix(line, prefix); ok {
+		// "<remote>: <error>"; IPv6 remotes contain colons, errors start after ": "
+		if remote, err, ok := strings.Cut(rest, ": "); ok {
+			l.stats.recordFailed(l.listener, remote, err)
+			return len(p), nil
+		}
+	}
+	log.Print(line)
+	return len(p), nil
+}
+
+// handleTLSHandshakes serves GET /api/tls/handshakes
+func (s *Server) handleTLSHandshakes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"listeners": s.handshakes.Snapshot(),
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+	"quic-moodle/quiclb"
+)
+
+// defaultL4FlowIdleTimeout is how long a flow is kept without packets in
+// either direction
+const defaultL4FlowIdleTimeout = 2 * time.Minute
+
+// defaultL4MaxFlows is how many flows are forwarded at once
+const defaultL4MaxFlows = 10000
+
+// errL4FlowLimit refuses a new flow at max_flows
+var errL4FlowLimit = errors.New("flow limit reached")
+
+// UDPL4Config tunes the L4 forwarding of QUIC packets used when
+// features.udp_l4 is enabled at startup. The QUIC socket then no longer
+// terminates HTTP/3: each datagram is routed by its destination connection
+// ID and forwarded to the backend, which must terminate QUIC itself and
+// issue connection IDs from the QUIC-LB config (see /api/agents). Return
+// traffic flows back through a socket per client address and backend.
+type UDPL4Config struct {
+	BackendPort     int               `json:"backend_port,omitempty"`      // UDP port of the backends' QUIC listeners, default the port of each backend URL
+	FlowIdleTimeout balancer.Duration `json:"flow_idle_timeout,omitempty"` // Close a flow after this long without packets, default 2m
+	Workers         int               `json:"workers,omitempty"`           // Packet steering workers, default GOMAXPROCS (restart required)
+	QueueLen        int               `json:"queue_len,omitempty"`         // Datagrams waiting per worker before new ones are dropped, default 1024 (restart required)
+	MaxFlows        int               `json:"max_flows,omitempty"`         // Flows forwarded at once, each holding a socket and a goroutine; packets needing a new flow are dropped at the limit. Default 10000, -1 for no limit
+}
+
+// validate checks the L4 forwarding settings
+func (uc *UDPL4Config) validate() []error {
+	var errs []error
+	if uc.BackendPort < 0 || uc.BackendPort > 65535 {
+		errs = append(errs, fmt.Errorf("udp_l4.backend_port must be 0-65535, got %d", uc.BackendPort))
+	}
+	if uc.FlowIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("udp_l4.flow_idle_timeout must not be negative"))
+	}
+	if uc.Workers < 0 {
+		errs = append(errs, fmt.Errorf("udp_l4.workers must not be negative"))
+	}
+	if uc.QueueLen < 0 {
+		errs = append(errs, fmt.Errorf("udp_l4.queue_len must not be negative"))
+	}
+	if uc.MaxFlows < -1 {
+		errs = append(errs, fmt.Errorf("udp_l4.max_flows must be positive, 0 for the default or -1 for no limit"))
+	}
+	return errs
+}
+
+// maxFlows returns the flow limit, 0 for none
+func (uc *UDPL4Config) maxFlows() int {
+	return tableLimit(uc.MaxFlows, defaultL4MaxFlows)
+}
+
+// flowIdleTimeout returns the configured flow idle timeout or its default
+func (uc *UDPL4Config) flowIdleTimeout() time.Duration {
+	if uc.FlowIdleTimeout == 0 {
+		return defaultL4FlowIdleTimeout
+	}
+	return time.Duration(uc.FlowIdleTimeout)
+}
+
+// l4FlowKey identifies a flow. A client address may reach several
+// backends at once, as clients behind one NAT address do, so each backend
+// gets its own flow.
+type l4FlowKey struct {
+	client  netip.AddrPort
+	backend *balancer.Backend
+}
+
+// l4Flow is the path of one client address to one backend
+type l4Flow struct {
+	client   net.Addr // the client, as written back to
+	backend  *balancer.Backend
+	upstream *net.UDPConn // connected to the backend
+	lastSeen atomic.Int64 // unix nanoseconds of the latest packet
+}
+
+// UDPForwarder routes QUIC datagrams to backends by their QUIC-LB
+// connection ID and relays the answers, keeping a flow table keyed by
+// client address and backend
+type UDPForwarder struct {
+	mu       sync.Mutex
+	cfg      UDPL4Config
+	qlb      *balancer.QUICLB
+	conn     net.PacketConn // the QUIC socket while serving
+	steering *packetSteering
+	flows    map[l4FlowKey]*l4Flow
+
+	packetsIn    atomic.Int64 // client to backend
+	packetsOut   atomic.Int64 // backend to client
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	malformed    atomic.Int64                              // no destination connection ID
+	packetTypes  [quiclb.PacketLongHeader + 1]atomic.Int64 // client packets read, by quiclb.PacketType
+	unroutable   atomic.Int64                              // no healthy backend for the connection ID
+	sendErrors   atomic.Int64
+	flowsCreated atomic.Int64
+	flowsExpired atomic.Int64
+	flowsRefused atomic.Int64 // packets needing a new flow dropped at max_flows
+	flowsShed    atomic.Int64 // closed by the memory watchdog
+}
+
+// NewUDPForwarder creates a forwarder routing with qlb, idle until served
+func NewUDPForwarder(qlb *balancer.QUICLB) *UDPForwarder {
+	return &UDPForwarder{qlb: qlb, flows: make(map[l4FlowKey]*l4Flow)}
+}
+
+// Configure applies new settings; the backend port and idle timeout take
+// effect for new flows, the steering settings on the next start
+func (f *UDPForwarder) Configure(cfg UDPL4Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg = cfg
+}
+
+// Serve forwards the datagrams read from conn until ctx is done
+func (f *UDPForwarder) Serve(ctx context.Context, conn net.PacketConn) error {
+	f.mu.Lock()
+	cfg := f.cfg
+	f.conn = conn
+	f.steering = newPacketSteering(cfg.Workers, cfg.QueueLen, f.forward)
+	steering := f.steering
+	f.mu.Unlock()
+	log.Printf("🔀 Forwarding QUIC packets at L4 on %s with %d steering workers", conn.LocalAddr(), len(steering.workers))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the read below
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	go f.runFlowExpiry(done)
+
+	defer func() {
+		steering.close()
+		f.mu.Lock()
+		for key, flow := range f.flows {
+			flow.upstream.Close()
+			delete(f.flows, key)
+		}
+		f.conn = nil
+		f.mu.Unlock()
+	}()
+
+	err := steering.receive(conn, f.destinationCID)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("reading QUIC packets: %v", err)
+}
+
+// destinationCID finds the connection ID a client datagram is steered by,
+// counting it by packet type, or as malformed when it is not QUIC or was
+// truncated. Short headers do not carry the DCID length, so it is that of
+// the config named by the rotation bits of the DCID's first octet.
+func (f *UDPForwarder) destinationCID(packet []byte) ([]byte, bool) {
+	var shortLen int
+	if len(packet) > 1 {
+		shortLen = f.qlb.ConnectionIDLen(packet[1])
+	}
+	header, err := quiclb.ParseHeader(packet, shortLen)
+	if err != nil || len(packet) == maxL4Datagram {
+		f.malformed.Add(1)
+		return nil, false
+	}
+	f.packetTypes[header.Type].Add(1)
+	return header.DCID, true
+}
+
+// forward sends one client datagram to the backend its connection ID
+// routes to; it runs on the steering worker owning the connection ID
+func (f *UDPForwarder) forward(_ int, pkt steeredPacket) {
+	defer l4Buffers.Put((*[maxL4Datagram]byte)(pkt.data[:maxL4Datagram]))
+
+	// Connection IDs this load balancer issued decode to their backend;
+	// others, like the client's first Initial, get a fallback backend that
+	// is remembered for them
+	backend, err := f.qlb.RouteByConnectionID(pkt.dcid)
+	if err != nil {
+		f.unroutable.Add(1)
+		return
+	}
+	flow, err := f.flow(pkt.from, backend)
+	if errors.Is(err, errL4FlowLimit) {
+		f.flowsRefused.Add(1)
+		return
+	}
+	if err != nil {
+		f.sendErrors.Add(1)
+		log.Printf("⚠️ L4 flow from %s to backend %d: %v", pkt.from, backend.ID, err)
+		return
+	}
+	flow.lastSeen.Store(time.Now().UnixNano())
+	if _, err := flow.upstream.Write(pkt.data); err != nil {
+		f.sendErrors.Add(1)
+		return
+	}
+	f.packetsIn.Add(1)
+	f.bytesIn.Add(int64(len(pkt.data)))
+}
+
+// flow returns the flow of client to backend, creating it when missing. A
+// new flow is refused with errL4FlowLimit once max_flows are open, so
+// spoofed source addresses cannot take every socket and goroutine.
+func (f *UDPForwarder) flow(client netip.AddrPort, backend *balancer.Backend) (*l4Flow, error) {
+	key := l4FlowKey{client: client, backend: backend}
+	f.mu.Lock()
+	existing := f.flows[key]
+	port := f.cfg.BackendPort
+	full := f.fullLocked()
+	f.mu.Unlock()
+	if existing != nil {
+		return existing, nil
+	}
+	if full {
+		return nil, errL4FlowLimit
+	}
+
+	// Resolve and dial outside the lock
+	addr, err := backendUDPAddr(backend, port)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	flow := &l4Flow{client: net.UDPAddrFromAddrPort(client), backend: backend, upstream: upstream}
+	flow.lastSeen.Store(time.Now().UnixNano())
+
+	f.mu.Lock()
+	if current := f.flows[key]; current != nil {
+		// Another worker created the flow meanwhile
+		f.mu.Unlock()
+		upstream.Close()
+		return current, nil
+	}
+	if f.conn == nil {
+		f.mu.Unlock()
+		upstream.Close()
+		return nil, net.ErrClosed
+	}
+	if f.fullLocked() {
+		f.mu.Unlock()
+		upstream.Close()
+		return nil, errL4FlowLimit
+	}
+	f.flows[key] = flow
+	conn := f.conn
+	f.mu.Unlock()
+
+	f.flowsCreated.Add(1)
+	go f.relay(flow, conn)
+	return flow, nil
+}
+
+// fullLocked reports whether max_flows are open; callers hold mu
+func (f *UDPForwarder) fullLocked() bool {
+	limit := f.cfg.maxFlows()
+	return limit > 0 && len(f.flows) >= limit
+}
+
+// Len returns the number of open flows
+func (f *UDPForwarder) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.flows)
+}
+
+// MaxFlows returns the flow limit, 0 for none
+func (f *UDPForwarder) MaxFlows() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cfg.maxFlows()
+}
+
+// trim closes the least recently seen flows until at most keep are left,
+// returning how many were closed. Clients of a closed flow get a new one
+// with their next packet.
+func (f *UDPForwarder) trim(keep int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.flows) <= keep {
+		return 0
+	}
+	keys := make([]l4FlowKey, 0, len(f.flows))
+	for key := range f.flows {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b l4FlowKey) int {
+		return cmp.Compare(f.flows[a].lastSeen.Load(), f.flows[b].lastSeen.Load())
+	})
+	closed := 0
+	for _, key := range keys[:len(keys)-keep] {
+		f.flows[key].upstream.Close()
+		delete(f.flows, key)
+		closed++
+	}
+	f.flowsShed.Add(int64(closed))
+	return closed
+}
+
+// relay writes the backend's datagrams of flow back to its client until
+// the flow is closed
+func (f *UDPForwarder) relay(flow *l4Flow, conn net.PacketConn) {
+	buf := make([]byte, maxL4Datagram)
+	for {
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// An ICMP error, like a backend port that is not open yet
+			continue
+		}
+		flow.lastSeen.Store(time.Now().UnixNano())
+		if _, err := conn.WriteTo(buf[:n], flow.client); err != nil {
+			f.sendErrors.Add(1)
+			continue
+		}
+		f.packetsOut.Add(1)
+		f.bytesOut.Add(int64(n))
+	}
+}
+
+// runFlowExpiry closes idle flows until done is closed
+func (f *UDPForwarder) runFlowExpiry(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			f.expire(now)
+		}
+	}
+}
+
+// expire closes the flows idle for longer than the flow idle timeout
+func (f *UDPForwarder) expire(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	idle := f.cfg.flowIdleTimeout()
+	for key, flow := range f.flows {
+		if now.Sub(time.Unix(0, flow.lastSeen.Load())) > idle {
+			flow.upstream.Close()
+			delete(f.flows, key)
+			f.flowsExpired.Add(1)
+		}
+	}
+}
+
+// backendUDPAddr returns the address of the backend's QUIC listener: its
+// URL host at port, or at the URL's port when port is 0
+func backendUDPAddr(backend *balancer.Backend, port int) (*net.UDPAddr, error) {
+	p := backend.URL.Port()
+	if port != 0 {
+		p = strconv.Itoa(port)
+	} else if p == "" {
+		p = "443"
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(backend.URL.Hostname(), p))
+}
+
+// Snapshot reports the flow table, counters and steering queues
+func (f *UDPForwarder) Snapshot() map[string]interface{} {
+	f.mu.Lock()
+	serving := f.conn != nil
+	steering := f.steering
+	flowsPerBackend := make(map[string]int)
+	for _, flow := range f.flows {
+		flowsPerBackend[flow.backend.URL.String()]++
+	}
+	flows := len(f.flows)
+	cfg := f.cfg
+	f.mu.Unlock()
+
+	packetTypes := make(map[string]int64)
+	for t := quiclb.PacketInitial; t <= quiclb.PacketLongHeader; t++ {
+		packetTypes[t.String()] = f.packetTypes[t].Load()
+	}
+	stats := map[string]interface{}{
+		"serving":           serving,
+		"flows":             flows,
+		"flows_per_backend": flowsPerBackend,
+		"flows_created":     f.flowsCreated.Load(),
+		"flows_expired":     f.flowsExpired.Load(),
+		"flows_refused":     f.flowsRefused.Load(),
+		"flows_shed":        f.flowsShed.Load(),
+		"max_flows":         cfg.maxFlows(),
+		"packets_in":        f.packetsIn.Load(),
+		"packets_out":       f.packetsOut.Load(),
+		"bytes_in":          f.bytesIn.Load(),
+		"bytes_out":         f.bytesOut.Load(),
+		"malformed":         f.malformed.Load(),
+		"packet_types":      packetTypes,
+		"unroutable":        f.unroutable.Load(),
+		"send_errors":       f.sendErrors.Load(),
+		"flow_idle_timeout": cfg.flowIdleTimeout().String(),
+	}
+	if steering != nil {
+		stats["steering"] = steering.snapshot()
+	}
+	return stats
+}
+
+// handleUDPL4 serves GET /api/udp-l4
+func (s *Server) handleUDPL4(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.udpL4.Snapshot()
+	stats["enabled"] = s.currentFeatures().UDPL4
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"quic-moodle/balancer"
+	"quic-moodle/quiclb"
+)
+
+// newTestForwarder returns a forwarder serving on a loopback socket
+// without reading from it, so flows can be opened directly
+func newTestForwarder(t *testing.T, cfg UDPL4Config) *UDPForwarder {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewUDPForwarder(nil)
+	f.Configure(cfg)
+	f.conn = conn
+	t.Cleanup(func() {
+		f.trim(0)
+		conn.Close()
+	})
+	return f
+}
+
+// newTestUDPBackend returns a backend whose QUIC listener would be at port
+// on loopback
+func newTestUDPBackend(t *testing.T, port string) *balancer.Backend {
+	t.Helper()
+	u, err := url.Parse("https://127.0.0.1:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balancer.NewBackend(u)
+}
+
+// A client address reaching two backends keeps a flow to each instead of
+// the second replacing the first
+func TestUDPForwarderFlowPerBackend(t *testing.T) {
+	f := newTestForwarder(t, UDPL4Config{})
+	client := netip.MustParseAddrPort("192.0.2.1:4433")
+	b1, b2 := newTestUDPBackend(t, "9001"), newTestUDPBackend(t, "9002")
+
+	flow1, err := f.flow(client, b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow2, err := f.flow(client, b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow1 == flow2 {
+		t.Fatal("one flow for two backends")
+	}
+	if again, err := f.flow(client, b1); err != nil || again != flow1 {
+		t.Errorf("flow to the first backend replaced after using the second: %v", err)
+	}
+	if n := f.Len(); n != 2 {
+		t.Errorf("%d flows, want 2", n)
+	}
+}
+
+// New flows are refused at max_flows while existing ones keep working
+func TestUDPForwarderMaxFlows(t *testing.T) {
+	f := newTestForwarder(t, UDPL4Config{MaxFlows: 2})
+	backend := newTestUDPBackend(t, "9001")
+	a := netip.MustParseAddrPort("192.0.2.1:4433")
+	b := netip.MustParseAddrPort("192.0.2.2:4433")
+	c := netip.MustParseAddrPort("192.0.2.3:4433")
+
+	for _, client := range []netip.AddrPort{a, b} {
+		if _, err := f.flow(client, backend); err != nil {
+			t.Fatalf("flow of %s: %v", client, err)
+		}
+	}
+	if _, err := f.flow(c, backend); !errors.Is(err, errL4FlowLimit) {
+		t.Errorf("third flow: %v, want errL4FlowLimit", err)
+	}
+	if _, err := f.flow(a, newTestUDPBackend(t, "9002")); !errors.Is(err, errL4FlowLimit) {
+		t.Errorf("flow of a known client to another backend: %v, want errL4FlowLimit", err)
+	}
+	if _, err := f.flow(a, backend); err != nil {
+		t.Errorf("existing flow refused at the limit: %v", err)
+	}
+	if n, max := f.Len(), f.MaxFlows(); n != 2 || max != 2 {
+		t.Errorf("%d flows, max %d, want 2 and 2", n, max)
+	}
+
+	// Unlimited with -1
+	f.Configure(UDPL4Config{MaxFlows: -1})
+	if _, err := f.flow(c, backend); err != nil {
+		t.Errorf("flow without a limit: %v", err)
+	}
+}
+
+// Short header DCIDs are cut at the length of the config their rotation
+// bits name, so connections keep routing while a config with another
+// length rotates in
+func TestUDPForwarderShortHeaderCIDLen(t *testing.T) {
+	qlb, err := balancer.NewQUICLB("health-aware", &quiclb.Config{Algorithm: "plaintext", ConfigRotationBits: 0, ServerIDLen: 2, ConnectionIDLen: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qlb.AddConfig(&quiclb.Config{Algorithm: "plaintext", ConfigRotationBits: 1, ServerIDLen: 2, ConnectionIDLen: 12}); err != nil {
+		t.Fatal(err)
+	}
+	f := NewUDPForwarder(qlb)
+
+	packet := make([]byte, 64)
+	packet[0] = 0x40
+	for _, tt := range []struct {
+		firstOctet byte
+		want       int
+	}{
+		{0 << 5, 8},
+		{1 << 5, 12},
+	} {
+		packet[1] = tt.firstOctet
+		dcid, ok := f.destinationCID(packet)
+		if !ok || len(dcid) != tt.want {
+			t.Errorf("rotation bits %d: DCID of %d bytes (ok %v), want %d", tt.firstOctet>>5, len(dcid), ok, tt.want)
+		}
+	}
+}
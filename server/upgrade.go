@@ -0,0 +1,397 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variable used to hand listener and pipe FDs to an upgraded process.
+// Format: "tcp=3,udp=4,http=5,admin=6,state=7,ready=8,session-key=9" (http is
+// omitted when disabled, session-key when the session state key is configured).
+const upgradeFDsEnv = "QUIC_LB_UPGRADE_FDS"
+
+// upgradeReadyTimeout bounds how long the old process waits for the new one
+const upgradeReadyTimeout = 30 * time.Second
+
+// Listeners holds the sockets served by the load balancer
+type Listeners struct {
+	TCP   net.Listener   // HTTP/1.1 + HTTP/2 over TLS
+	UDP   net.PacketConn // HTTP/3 over QUIC
+	HTTP  net.Listener   // Plain HTTP/1.1, nil when disabled
+	Admin net.Listener   // Admin API
+
+	Inherited  bool     // true when the sockets came from a previous process
+	state      *os.File // routing state sent by the previous process
+	ready      *os.File // closed once this process is serving
+	sessionKey *os.File // generated session state key sent by the previous process
+}
+
+// RoutingState is the transferable part of the routing tables, keyed by backend URL.
+// Session tables are sent encrypted in SealedSessions; the plain fields are
+// only read from earlier versions.
+type RoutingState struct {
+	Sessions       map[string]string            `json:"sessions,omitempty"`        // default pool: session key -> backend URL
+	PoolSessions   map[string]map[string]string `json:"pool_sessions,omitempty"`   // other pools: pool -> session key -> backend URL
+	SealedSessions string                       `json:"sealed_sessions,omitempty"` // both session tables, encrypted with the session state key
+	CIDTable       map[string]string            `json:"cid_table"`                 // hex CID -> backend URL
+	SavedAt        time.Time                    `json:"saved_at"`
+}
+
+// OpenListeners inherits sockets from a previous process or systemd, or binds new ones
+func OpenListeners(cfg *Config) (*Listeners, error) {
+	if spec := os.Getenv(upgradeFDsEnv); spec != "" {
+		os.Unsetenv(upgradeFDsEnv)
+		return inheritListeners(spec)
+	}
+	if l, err := systemdListeners(cfg); l != nil || err != nil {
+		if err == nil {
+			log.Printf("🧩 Using %d systemd-activated socket(s)", l.count())
+		}
+		return l, err
+	}
+
+	l := &Listeners{}
+	var err error
+	if l.TCP, err = net.Listen("tcp", cfg.Server.ListenAddr); err != nil {
+		return nil, fmt.Errorf("failed to listen on tcp %s: %v", cfg.Server.ListenAddr, err)
+	}
+	if l.UDP, err = net.ListenPacket("udp", cfg.Server.ListenAddr); err != nil {
+		l.TCP.Close()
+		return nil, fmt.Errorf("failed to listen on udp %s: %v", cfg.Server.ListenAddr, err)
+	}
+	if cfg.Server.HTTPListenAddr != "" {
+		if l.HTTP, err = net.Listen("tcp", cfg.Server.HTTPListenAddr); err != nil {
+			l.TCP.Close()
+			l.UDP.Close()
+			return nil, fmt.Errorf("failed to listen on tcp %s: %v", cfg.Server.HTTPListenAddr, err)
+		}
+	}
+	if l.Admin, err = net.Listen("tcp", cfg.Admin.ListenAddr); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to listen on admin address %s: %v", cfg.Admin.ListenAddr, err)
+	}
+	return l, nil
+}
+
+// Close closes every listener that has been opened
+func (l *Listeners) Close() {
+	for _, ln := range []net.Listener{l.TCP, l.HTTP, l.Admin} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	if l.UDP != nil {
+		l.UDP.Close()
+	}
+}
+
+func (l *Listeners) count() int {
+	n := 3
+	if l.HTTP != nil {
+		n++
+	}
+	return n
+}
+
+// inheritListeners rebuilds the listeners from FDs passed by the parent process
+func inheritListeners(spec string) (*Listeners, error) {
+	fds := make(map[string]int)
+	for _, part := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed %s entry %q", upgradeFDsEnv, part)
+		}
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s entry %q: %v", upgradeFDsEnv, part, err)
+		}
+		fds[name] = fd
+	}
+
+	l := &Listeners{Inherited: true}
+	var err error
+	if l.TCP, err = fileListener(fds, "tcp"); err != nil {
+		return nil, err
+	}
+	if l.UDP, err = filePacketConn(fds, "udp"); err != nil {
+		return nil, err
+	}
+	if _, ok := fds["http"]; ok {
+		if l.HTTP, err = fileListener(fds, "http"); err != nil {
+			return nil, err
+		}
+	}
+	if l.Admin, err = fileListener(fds, "admin"); err != nil {
+		return nil, err
+	}
+	if fd, ok := fds["state"]; ok {
+		l.state = os.NewFile(uintptr(fd), "routing-state")
+	}
+	if fd, ok := fds["ready"]; ok {
+		l.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	if fd, ok := fds["session-key"]; ok {
+		l.sessionKey = os.NewFile(uintptr(fd), "session-key")
+	}
+	return l, nil
+}
+
+func fileListener(fds map[string]int, name string) (net.Listener, error) {
+	fd, ok := fds[name]
+	if !ok {
+		return nil, fmt.Errorf("no %s listener passed in %s", name, upgradeFDsEnv)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit %s listener: %v", name, err)
+	}
+	return ln, nil
+}
+
+func filePacketConn(fds map[string]int, name string) (net.PacketConn, error) {
+	fd, ok := fds[name]
+	if !ok {
+		return nil, fmt.Errorf("no %s socket passed in %s", name, upgradeFDsEnv)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit %s socket: %v", name, err)
+	}
+	return conn, nil
+}
+
+// inheritedSessionKey returns the generated session state key sent by the
+// previous process, or nil. It is read once; the pipe is closed afterwards.
+func (l *Listeners) inheritedSessionKey() []byte {
+	if l.sessionKey == nil {
+		return nil
+	}
+	defer func() {
+		l.sessionKey.Close()
+		l.sessionKey = nil
+	}()
+	key, err := io.ReadAll(io.LimitReader(l.sessionKey, 1024))
+	if err != nil {
+		log.Printf("⚠️ Failed to read the session state key from previous process: %v", err)
+		return nil
+	}
+	return key
+}
+
+// completeHandoff passes routing state sent by the previous process to restore
+// and tells it that this process is serving, reporting whether there was a
+// previous process. It is a no-op on a fresh start.
+func (l *Listeners) completeHandoff(restore func(*RoutingState) (sessions, cids int)) bool {
+	handedOver := l.state != nil
+	if l.state != nil {
+		var state RoutingState
+		if err := json.NewDecoder(l.state).Decode(&state); err != nil {
+			log.Printf("⚠️ Failed to read routing state from previous process: %v", err)
+		} else {
+			sessions, cids := restore(&state)
+			log.Printf("♻️ Restored %d sessions and %d CID mappings from previous process", sessions, cids)
+		}
+		l.state.Close()
+		l.state = nil
+	}
+	if l.ready != nil {
+		l.ready.Write([]byte("ready\n"))
+		l.ready.Close()
+		l.ready = nil
+		log.Printf("🤝 Socket handoff complete, previous process may drain")
+	}
+	return handedOver
+}
+
+// upgrade re-executes the current binary with the listening sockets, the
+// routing state from snapshot and, when set, the generated session state
+// key, returning once the new process reports it is serving. The key goes
+// through a pipe like the routing state, never the environment, which other
+// processes of the same user can read. The caller is expected to drain and
+// exit afterwards.
+func (l *Listeners) upgrade(snapshot func() *RoutingState, sessionKey []byte) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot locate executable: %v", err)
+	}
+
+	var files []*os.File
+	var spec []string
+	addFile := func(name string, f *os.File) {
+		files = append(files, f)
+		spec = append(spec, fmt.Sprintf("%s=%d", name, 2+len(files))) // ExtraFiles start at fd 3
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	tcpFile, err := l.TCP.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		return fmt.Errorf("cannot dup tcp listener: %v", err)
+	}
+	addFile("tcp", tcpFile)
+
+	udpFile, err := l.UDP.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		return fmt.Errorf("cannot dup udp socket: %v", err)
+	}
+	addFile("udp", udpFile)
+
+	if l.HTTP != nil {
+		httpFile, err := l.HTTP.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return fmt.Errorf("cannot dup http listener: %v", err)
+		}
+		addFile("http", httpFile)
+	}
+
+	adminFile, err := l.Admin.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		return fmt.Errorf("cannot dup admin listener: %v", err)
+	}
+	addFile("admin", adminFile)
+
+	stateRead, stateWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateWrite.Close()
+	addFile("state", stateRead)
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+	addFile("ready", readyWrite)
+
+	var keyWrite *os.File
+	if sessionKey != nil {
+		var keyRead *os.File
+		if keyRead, keyWrite, err = os.Pipe(); err != nil {
+			return err
+		}
+		defer keyWrite.Close()
+		addFile("session-key", keyRead)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeFDsEnv+"="+strings.Join(spec, ","))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process: %v", err)
+	}
+	log.Printf("🔁 Started upgraded process pid %d, handing off sockets", cmd.Process.Pid)
+
+	// The child holds its own copies now
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	if keyWrite != nil {
+		// A key fits in the pipe buffer, so this does not wait for the child
+		keyWrite.Write(sessionKey)
+		keyWrite.Close()
+	}
+	go func() {
+		json.NewEncoder(stateWrite).Encode(snapshot())
+		stateWrite.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeReadyTimeout)
+	defer cancel()
+	readyCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		if n, _ := readyRead.Read(buf); n > 0 {
+			readyCh <- nil
+			return
+		}
+		readyCh <- fmt.Errorf("new process exited before becoming ready")
+	}()
+
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("upgrade failed: %v", err)
+		}
+		go cmd.Wait()
+		return nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade failed: new process not ready after %v", upgradeReadyTimeout)
+	}
+}
+
+// snapshotRoutingState captures session affinity and CID fallback mappings
+func (s *Server) snapshotRoutingState() *RoutingState {
+	state := &RoutingState{
+		CIDTable: s.quicLB.CIDMappings(),
+		SavedAt:  time.Now(),
+	}
+
+	sessions := sealedSessions{
+		Sessions:     make(map[string]string),
+		PoolSessions: make(map[string]map[string]string),
+	}
+	for _, pool := range s.pools.Pools() {
+		if pool.Name() == defaultPoolName {
+			sessions.Sessions = pool.Sessions()
+		} else {
+			sessions.PoolSessions[pool.Name()] = pool.Sessions()
+		}
+	}
+	sealed, err := s.sessionState.seal(sessions)
+	if err != nil {
+		log.Printf("⚠️ Session affinity not handed over: %v", err)
+	}
+	state.SealedSessions = sealed
+
+	return state
+}
+
+// restoreRoutingState re-links saved mappings to backends that still exist
+func (s *Server) restoreRoutingState(state *RoutingState) (sessions, cids int) {
+	saved := sealedSessions{Sessions: state.Sessions, PoolSessions: state.PoolSessions}
+	if state.SealedSessions != "" {
+		var err error
+		if saved, err = s.sessionState.open(state.SealedSessions); err != nil {
+			log.Printf("⚠️ Session affinity not restored: %v", err)
+		}
+	} else {
+		// Earlier versions send raw session IDs
+		saved.Sessions = s.sessionState.hashSessions(saved.Sessions)
+		for name, poolSessions := range saved.PoolSessions {
+			saved.PoolSessions[name] = s.sessionState.hashSessions(poolSessions)
+		}
+	}
+
+	for _, pool := range s.pools.Pools() {
+		poolSessions := saved.Sessions
+		if pool.Name() != defaultPoolName {
+			poolSessions = saved.PoolSessions[pool.Name()]
+		}
+		sessions += pool.RestoreSessions(poolSessions)
+	}
+
+	return sessions, s.quicLB.RestoreCIDMappings(state.CIDTable)
+}
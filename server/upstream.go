@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// Upstream transport defaults
+const (
+	defaultUpstreamMaxIdleConns        = 1024
+	defaultUpstreamMaxIdleConnsPerHost = 128
+	defaultUpstreamDialTimeout         = 5 * time.Second
+	defaultUpstreamTLSHandshakeTimeout = 10 * time.Second
+)
+
+// UpstreamTransportConfig tunes the HTTP transport shared by every backend.
+// The defaults keep far more idle connections per backend than
+// http.DefaultTransport's two, so bursts reuse connections instead of
+// dialing. Changes take effect after a restart.
+type UpstreamTransportConfig struct {
+	MaxIdleConns          int               `json:"max_idle_conns,omitempty"`          // Idle connections kept over all backends, default 1024
+	MaxIdleConnsPerHost   int               `json:"max_idle_conns_per_host,omitempty"` // Idle connections kept per backend, default 128
+	MaxConnsPerHost       int               `json:"max_conns_per_host,omitempty"`      // Connections per backend, requests wait beyond it; 0 for no limit
+	DialTimeout           balancer.Duration `json:"dial_timeout,omitempty"`            // Time to connect to a backend, default 5s
+	TLSHandshakeTimeout   balancer.Duration `json:"tls_handshake_timeout,omitempty"`   // Time for the TLS handshake with a backend, default 10s
+	ResponseHeaderTimeout balancer.Duration `json:"response_header_timeout,omitempty"` // Time a backend has to answer once the request is sent, 0 for no limit
+	IdleConnTimeout       balancer.Duration `json:"idle_conn_timeout,omitempty"`       // Idle connections close after this long, default 90s
+	DisableHTTP2          bool              `json:"disable_http2,omitempty"`           // Only speak HTTP/1.1 to https backends
+}
+
+// validate checks the upstream settings
+func (uc *UpstreamConfig) validate() []error {
+	return uc.Transport.validate()
+}
+
+// validate checks the upstream transport settings
+func (tc *UpstreamTransportConfig) validate() []error {
+	var errs []error
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("upstream.transport connection limits must not be negative"))
+	}
+	if tc.DialTimeout < 0 || tc.TLSHandshakeTimeout < 0 || tc.ResponseHeaderTimeout < 0 || tc.IdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf("upstream.transport timeouts must not be negative"))
+	}
+	if tc.MaxConnsPerHost > 0 && tc.maxIdleConnsPerHost() > tc.MaxConnsPerHost {
+		errs = append(errs, fmt.Errorf("upstream.transport.max_idle_conns_per_host %d exceeds max_conns_per_host %d", tc.maxIdleConnsPerHost(), tc.MaxConnsPerHost))
+	}
+	return errs
+}
+
+// maxIdleConns returns the configured idle connection limit or its default
+func (tc *UpstreamTransportConfig) maxIdleConns() int {
+	if tc.MaxIdleConns == 0 {
+		return defaultUpstreamMaxIdleConns
+	}
+	return tc.MaxIdleConns
+}
+
+// maxIdleConnsPerHost returns the configured per-backend idle limit or its
+// default, never above max_conns_per_host
+func (tc *UpstreamTransportConfig) maxIdleConnsPerHost() int {
+	if tc.MaxIdleConnsPerHost == 0 {
+		if tc.MaxConnsPerHost > 0 {
+			return min(defaultUpstreamMaxIdleConnsPerHost, tc.MaxConnsPerHost)
+		}
+		return defaultUpstreamMaxIdleConnsPerHost
+	}
+	return tc.MaxIdleConnsPerHost
+}
+
+// dialTimeout returns the configured dial timeout or its default
+func (tc *UpstreamTransportConfig) dialTimeout() time.Duration {
+	if tc.DialTimeout == 0 {
+		return defaultUpstreamDialTimeout
+	}
+	return time.Duration(tc.DialTimeout)
+}
+
+// tlsHandshakeTimeout returns the configured handshake timeout or its default
+func (tc *UpstreamTransportConfig) tlsHandshakeTimeout() time.Duration {
+	if tc.TLSHandshakeTimeout == 0 {
+		return defaultUpstreamTLSHandshakeTimeout
+	}
+	return time.Duration(tc.TLSHandshakeTimeout)
+}
+
+// idleConnTimeout returns the configured idle timeout or its default
+func (tc *UpstreamTransportConfig) idleConnTimeout() time.Duration {
+	if tc.IdleConnTimeout == 0 {
+		return upstreamIdleTimeout
+	}
+	return time.Duration(tc.IdleConnTimeout)
+}
+
+// upstreamTransportStats counts the connections of the shared backend
+// transport and how often requests found one idle
+type upstreamTransportStats struct {
+	cfg        UpstreamTransportConfig
+	dials      atomic.Int64
+	dialErrors atomic.Int64
+	open       atomic.Int64
+	reused     atomic.Int64 // requests sent on an idle connection
+	fresh      atomic.Int64 // requests that waited for a new connection
+	connWait   atomic.Int64 // nanoseconds requests waited for a connection
+}
+
+// newTransport builds the backend transport from cfg, presenting tlsConfig
+// to https backends when it is set. Connections it dials are counted.
+func (uc *UpstreamCoalescer) newTransport(cfg UpstreamTransportConfig, tlsConfig *tls.Config) *http.Transport {
+	stats := &upstreamTransportStats{cfg: cfg}
+	uc.mu.Lock()
+	uc.transportStats = stats
+	uc.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: cfg.dialTimeout(), KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				stats.dialErrors.Add(1)
+				return nil, err
+			}
+			stats.dials.Add(1)
+			stats.open.Add(1)
+			return &countedConn{Conn: conn, open: &stats.open}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          cfg.maxIdleConns(),
+		MaxIdleConnsPerHost:   cfg.maxIdleConnsPerHost(),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.idleConnTimeout(),
+		TLSHandshakeTimeout:   cfg.tlsHandshakeTimeout(),
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty TLSNextProto turns HTTP/2 off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// traced returns req recording whether it got an idle connection and how
+// long it waited, or req itself when no transport is counted
+func (uc *UpstreamCoalescer) traced(req *http.Request) *http.Request {
+	uc.mu.Lock()
+	stats := uc.transportStats
+	uc.mu.Unlock()
+	if stats == nil {
+		return req
+	}
+
+	start := time.Now()
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				stats.reused.Add(1)
+			} else {
+				stats.fresh.Add(1)
+			}
+			stats.connWait.Add(int64(time.Since(start)))
+		},
+	}))
+}
+
+// snapshot reports the transport limits and connection counters
+func (ts *upstreamTransportStats) snapshot() map[string]interface{} {
+	reused, fresh := ts.reused.Load(), ts.fresh.Load()
+	reuseRatio, avgWait := 0.0, time.Duration(0)
+	if requests := reused + fresh; requests > 0 {
+		reuseRatio = float64(reused) / float64(requests)
+		avgWait = time.Duration(ts.connWait.Load() / requests)
+	}
+	return map[string]interface{}{
+		"max_idle_conns":          ts.cfg.maxIdleConns(),
+		"max_idle_conns_per_host": ts.cfg.maxIdleConnsPerHost(),
+		"max_conns_per_host":      ts.cfg.MaxConnsPerHost,
+		"http2":                   !ts.cfg.DisableHTTP2,
+		"open_connections":        ts.open.Load(),
+		"dials":                   ts.dials.Load(),
+		"dial_errors":             ts.dialErrors.Load(),
+		"requests_reused":         reused,
+		"requests_new_conn":       fresh,
+		"reuse_ratio":             reuseRatio,
+		"avg_conn_wait_ms":        float64(avgWait.Microseconds()) / 1000,
+	}
+}
+
+// countedConn decrements the open connection gauge once when closed
+type countedConn struct {
+	net.Conn
+	open   *atomic.Int64
+	closed atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if !c.closed.Swap(true) {
+		c.open.Add(-1)
+	}
+	return c.Conn.Close()
+}
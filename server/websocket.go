@@ -0,0 +1,498 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-moodle/balancer"
+)
+
+// websocketGUID is the key suffix of the Sec-WebSocket-Accept computation (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket tunnel defaults
+const (
+	defaultWebSocketIdleTimeout  = 10 * time.Minute
+	defaultWebSocketDrainTimeout = 30 * time.Second
+)
+
+// hopHeaders are connection-specific and never forwarded on an upgrade
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Sec-Websocket-Key", "Sec-Websocket-Accept",
+}
+
+// WebSocketConfig controls proxied WebSocket tunnels
+type WebSocketConfig struct {
+	IdleTimeout  balancer.Duration `json:"idle_timeout,omitempty"`  // Close tunnels without traffic in either direction for this long, default 10m
+	DrainTimeout balancer.Duration `json:"drain_timeout,omitempty"` // On shutdown or binary upgrade, how long open tunnels may finish before they are closed, default 30s
+}
+
+// validate checks the websocket settings
+func (wc *WebSocketConfig) validate() []error {
+	var errs []error
+	if wc.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("websocket.idle_timeout must not be negative"))
+	}
+	if wc.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("websocket.drain_timeout must not be negative"))
+	}
+	return errs
+}
+
+// idleTimeout returns the configured idle timeout or its default
+func (wc *WebSocketConfig) idleTimeout() time.Duration {
+	if wc.IdleTimeout == 0 {
+		return defaultWebSocketIdleTimeout
+	}
+	return wc.IdleTimeout.Duration()
+}
+
+// drainTimeout returns the configured drain timeout or its default
+func (wc *WebSocketConfig) drainTimeout() time.Duration {
+	if wc.DrainTimeout == 0 {
+		return defaultWebSocketDrainTimeout
+	}
+	return wc.DrainTimeout.Duration()
+}
+
+// WebSocketTracker keeps the open WebSocket tunnels. Upgraded connections
+// outlive their handler from the HTTP server's point of view, so shutdown
+// drains them here.
+type WebSocketTracker struct {
+	mu         sync.Mutex
+	tunnels    map[*wsTunnel]struct{}
+	perBackend map[int]int // backend ID -> open tunnels
+	draining   bool
+	wg         sync.WaitGroup
+
+	total       atomic.Int64
+	idleClosed  atomic.Int64
+	drainClosed atomic.Int64
+}
+
+// wsTunnel is one proxied WebSocket
+type wsTunnel struct {
+	backendID int
+	remote    string
+	path      string
+	proto     string
+	started   time.Time
+	close     func() // closes both sides
+	closeOnce sync.Once
+	reason    string // why the load balancer closed it, empty when a peer did
+
+	toBackend atomic.Int64
+	toClient  atomic.Int64
+}
+
+// NewWebSocketTracker creates an empty tracker
+func NewWebSocketTracker() *WebSocketTracker {
+	return &WebSocketTracker{
+		tunnels:    make(map[*wsTunnel]struct{}),
+		perBackend: make(map[int]int),
+	}
+}
+
+// open registers a tunnel; it fails while draining
+func (t *WebSocketTracker) open(tun *wsTunnel) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.tunnels[tun] = struct{}{}
+	t.perBackend[tun.backendID]++
+	t.wg.Add(1)
+	t.total.Add(1)
+	return true
+}
+
+// done unregisters a closed tunnel
+func (t *WebSocketTracker) done(tun *wsTunnel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.tunnels[tun]; !ok {
+		return
+	}
+	delete(t.tunnels, tun)
+	if t.perBackend[tun.backendID]--; t.perBackend[tun.backendID] == 0 {
+		delete(t.perBackend, tun.backendID)
+	}
+	t.wg.Done()
+}
+
+// Draining reports whether new tunnels are refused
+func (t *WebSocketTracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Drain refuses new tunnels, gives open ones timeout to finish and closes
+// the rest, returning once all are gone
+func (t *WebSocketTracker) Drain(timeout time.Duration) {
+	t.mu.Lock()
+	t.draining = true
+	open := len(t.tunnels)
+	t.mu.Unlock()
+	if open == 0 {
+		return
+	}
+	log.Printf("🔌 Draining %d WebSocket tunnel(s), closing them in %v", open, timeout)
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	for tun := range t.tunnels {
+		if tun.shutdown("drain") {
+			t.drainClosed.Add(1)
+		}
+	}
+	t.mu.Unlock()
+	<-finished
+}
+
+// shutdown closes the tunnel on behalf of the load balancer, reporting
+// whether this call closed it
+func (tun *wsTunnel) shutdown(reason string) bool {
+	closed := false
+	tun.closeOnce.Do(func() {
+		tun.reason = reason
+		tun.close()
+		closed = true
+	})
+	return closed
+}
+
+// Snapshot reports totals, open tunnels per backend and the open tunnels
+func (t *WebSocketTracker) Snapshot() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	perBackend := make(map[string]int, len(t.perBackend))
+	for id, n := range t.perBackend {
+		perBackend[fmt.Sprintf("%d", id)] = n
+	}
+	tunnels := make([]map[string]interface{}, 0, len(t.tunnels))
+	for tun := range t.tunnels {
+		tunnels = append(tunnels, map[string]interface{}{
+			"backend_id":       tun.backendID,
+			"remote_addr":      tun.remote,
+			"path":             tun.path,
+			"protocol":         tun.proto,
+			"age_seconds":      int(time.Since(tun.started).Seconds()),
+			"bytes_to_backend": tun.toBackend.Load(),
+			"bytes_to_client":  tun.toClient.Load(),
+		})
+	}
+	return map[string]interface{}{
+		"open":         len(t.tunnels),
+		"total":        t.total.Load(),
+		"idle_closed":  t.idleClosed.Load(),
+		"drain_closed": t.drainClosed.Load(),
+		"draining":     t.draining,
+		"per_backend":  perBackend,
+		"tunnels":      tunnels,
+	}
+}
+
+// isWebSocketUpgrade reports whether r asks to upgrade an HTTP/1.1
+// connection to a WebSocket (RFC 6455)
+func isWebSocketUpgrade(r *http.Request) bool {
+	if r.ProtoMajor != 1 || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newWebSocketRequest builds the HTTP/1.1 upgrade request sent to the backend
+// with the client's end-to-end headers and the forwarding headers
+func newWebSocketRequest(r *http.Request, peer *balancer.Backend, secKey string) (*http.Request, error) {
+	target := *peer.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	out, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	out.Host = r.Host
+	out.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		out.Header.Del(name)
+	}
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", "websocket")
+	out.Header.Set("Sec-WebSocket-Key", secKey)
+	if out.Header.Get("Sec-WebSocket-Version") == "" {
+		out.Header.Set("Sec-WebSocket-Version", "13")
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if r.TLS != nil || r.ProtoMajor == 3 {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	return out, nil
+}
+
+// dialWebSocket sends the upgrade request to the backend. It returns the
+// upgraded connection, or nil after answering the client itself when the
+// backend refused the upgrade or failed.
+func dialWebSocket(w http.ResponseWriter, out *http.Request, peer *balancer.Backend, secKey string) (*http.Response, io.ReadWriteCloser) {
+	transport := peer.ReverseProxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		peer.AddError()
+		log.Printf("❌ WebSocket upgrade to Backend #%d failed: %v", peer.ID, err)
+		http.Error(w, "Backend temporarily unavailable", http.StatusBadGateway)
+		return nil, nil
+	}
+
+	// Backends refusing the upgrade answer like any other request
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return nil, nil
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	accept := sha1.Sum([]byte(secKey + websocketGUID))
+	if !ok || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		resp.Body.Close()
+		peer.AddError()
+		log.Printf("❌ Backend #%d sent an invalid WebSocket handshake", peer.ID)
+		http.Error(w, "Invalid WebSocket handshake from backend", http.StatusBadGateway)
+		return nil, nil
+	}
+	return resp, backend
+}
+
+// proxyWebSocket proxies an HTTP/1.1 WebSocket upgrade: the backend's 101
+// is relayed on the hijacked client connection, then frames flow both ways
+// until either side closes, the tunnel idles out or the server drains
+func (s *Server) proxyWebSocket(w http.ResponseWriter, r *http.Request, peer *balancer.Backend) {
+	secKey := r.Header.Get("Sec-WebSocket-Key")
+	if secKey == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	out, err := newWebSocketRequest(r, peer, secKey)
+	if err != nil {
+		http.Error(w, "Bad WebSocket request", http.StatusBadRequest)
+		return
+	}
+	resp, backend := dialWebSocket(w, out, peer, secKey)
+	if backend == nil {
+		return
+	}
+	defer backend.Close()
+
+	conn, bufrw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("❌ WebSocket upgrade for %s failed: %v", r.RemoteAddr, err)
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// The server's read and write timeouts are for requests, not tunnels
+	conn.SetDeadline(time.Time{})
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	fmt.Fprintf(bufrw, "HTTP/1.1 101 Switching Protocols\r\n")
+	w.Header().Write(bufrw)
+	bufrw.WriteString("\r\n")
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+
+	tun := &wsTunnel{
+		backendID: peer.ID,
+		remote:    r.RemoteAddr,
+		path:      r.URL.Path,
+		proto:     r.Proto,
+		started:   time.Now(),
+		close: func() {
+			conn.Close()
+			backend.Close()
+		},
+	}
+	s.relayWebSocket(tun, bufrw.Reader, conn, nil, backend)
+}
+
+// relayWebSocket copies frames between client and backend until either side
+// closes, the tunnel has been idle for websocket.idle_timeout or a drain
+// closes it. flush, when set, pushes client writes out immediately.
+func (s *Server) relayWebSocket(tun *wsTunnel, client io.Reader, clientW io.Writer, flush func() error, backend io.ReadWriteCloser) {
+	if !s.websockets.open(tun) {
+		tun.close()
+		return
+	}
+	defer s.websockets.done(tun)
+
+	cfg := s.config.Current()
+	idle := cfg.WebSocket.idleTimeout()
+	timer := time.AfterFunc(idle, func() {
+		if tun.shutdown("idle") {
+			s.websockets.idleClosed.Add(1)
+		}
+	})
+	defer timer.Stop()
+
+	log.Printf("🔌 WebSocket %s %s %s -> Backend #%d", tun.proto, tun.remote, tun.path, tun.backendID)
+
+	// Client to backend until the client closes
+	go func() {
+		buf := s.pools.buffers.Get()
+		defer s.pools.buffers.Put(buf)
+		io.CopyBuffer(backend, &activityReader{r: client, timer: timer, idle: idle, count: &tun.toBackend}, buf)
+		if cw, ok := backend.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			backend.Close()
+		}
+	}()
+
+	// Backend to client, flushing every read so frames are not delayed
+	buf := s.pools.buffers.Get()
+	defer s.pools.buffers.Put(buf)
+	for {
+		n, err := backend.Read(buf)
+		if n > 0 {
+			timer.Reset(idle)
+			tun.toClient.Add(int64(n))
+			if _, werr := clientW.Write(buf[:n]); werr != nil {
+				break
+			}
+			if flush != nil && flush() != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	tun.closeOnce.Do(tun.close)
+
+	reason := ""
+	if tun.reason != "" {
+		reason = " (" + tun.reason + ")"
+	}
+	log.Printf("🔌 WebSocket %s -> Backend #%d closed after %v%s", tun.remote, tun.backendID, time.Since(tun.started).Round(time.Millisecond), reason)
+}
+
+// activityReader pushes the idle deadline back and counts bytes on every read
+type activityReader struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+	count *atomic.Int64
+}
+
+func (a *activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.timer.Reset(a.idle)
+		a.count.Add(int64(n))
+	}
+	return n, err
+}
+
+// handleWebSockets serves GET /api/websockets with open tunnels and counters
+func (s *Server) handleWebSockets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := s.websockets.Snapshot()
+	stats["timestamp"] = time.Now()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// isH3WebSocket reports whether r opens a WebSocket with an HTTP/3 extended
+// CONNECT request (RFC 9220)
+func isH3WebSocket(r *http.Request) bool {
+	return r.ProtoMajor == 3 && r.Method == http.MethodConnect && strings.EqualFold(r.Proto, "websocket")
+}
+
+// proxyH3WebSocket opens an HTTP/1.1 WebSocket to the backend for an HTTP/3
+// extended CONNECT request and relays the WebSocket frames, which are the same
+// in both versions, over the request stream
+func (s *Server) proxyH3WebSocket(w http.ResponseWriter, r *http.Request, peer *balancer.Backend) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	secKey := base64.StdEncoding.EncodeToString(key)
+
+	out, err := newWebSocketRequest(r, peer, secKey)
+	if err != nil {
+		http.Error(w, "Bad WebSocket request", http.StatusBadRequest)
+		return
+	}
+	resp, backend := dialWebSocket(w, out, peer, secKey)
+	if backend == nil {
+		return
+	}
+	defer backend.Close()
+
+	for _, name := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions", "Set-Cookie"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	tun := &wsTunnel{
+		backendID: peer.ID,
+		remote:    r.RemoteAddr,
+		path:      r.URL.Path,
+		proto:     "HTTP/3", // r.Proto holds the :protocol pseudo-header
+		started:   time.Now(),
+		close: func() {
+			r.Body.Close()
+			backend.Close()
+		},
+	}
+	s.relayWebSocket(tun, r.Body, w, rc.Flush, backend)
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// webTransportDialTimeout bounds establishing the backend session
+const webTransportDialTimeout = 10 * time.Second
+
+// WebTransportConfig proxies WebTransport sessions from the HTTP/3 listener
+// to a backend pool. Changes take effect after a restart.
+type WebTransportConfig struct {
+	Path           string   `json:"path,omitempty"`            // Path prefix accepting sessions, e.g. "/webtransport/"; empty disables WebTransport
+	Pool           string   `json:"pool,omitempty"`            // Backend pool the sessions go to, defaults to default_pool
+	BackendPort    int      `json:"backend_port,omitempty"`    // UDP port of the backends' HTTP/3 listener, defaults to the port of their URL
+	BackendCAFile  string   `json:"backend_ca_file,omitempty"` // Verify backend certificates against this CA bundle instead of the system roots
+	AllowedOrigins []string `json:"allowed_origins,omitempty"` // Origins allowed to open sessions, default only the request's own host
+}
+
+// validate checks the WebTransport settings against the configured pools
+func (wc *WebTransportConfig) validate(poolNames map[string]bool) []error {
+	var errs []error
+	if wc.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(wc.Path, "/") {
+		errs = append(errs, fmt.Errorf("webtransport.path %q must start with /", wc.Path))
+	}
+	if wc.Pool != "" && !poolNames[wc.Pool] {
+		errs = append(errs, fmt.Errorf("webtransport.pool %q is not a configured pool", wc.Pool))
+	}
+	if wc.BackendPort < 0 || wc.BackendPort > 65535 {
+		errs = append(errs, fmt.Errorf("webtransport.backend_port %d is out of range", wc.BackendPort))
+	}
+	for _, origin := range wc.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webtransport.allowed_origins: %q is not an origin like https://moodle.example.com", origin))
+		}
+	}
+	return errs
+}
+
+// webTransportProxy accepts WebTransport sessions and mirrors their streams
+// and datagrams onto a session with a backend of the configured pool
+type webTransportProxy struct {
+	s      *Server
+	cfg    WebTransportConfig
+	server *webtransport.Server
+	dialer *webtransport.Dialer
+}
+
+// newWebTransportProxy creates the proxy for the configured WebTransport path
+func (s *Server) newWebTransportProxy(cfg WebTransportConfig) (*webTransportProxy, error) {
+	clientTLS := &tls.Config{NextProtos: []string{"h3"}}
+	if cfg.BackendCAFile != "" {
+		pem, err := os.ReadFile(cfg.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webtransport.backend_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in webtransport.backend_ca_file %s", cfg.BackendCAFile)
+		}
+		clientTLS.RootCAs = pool
+	}
+
+	p := &webTransportProxy{
+		s:      s,
+		cfg:    cfg,
+		server: &webtransport.Server{},
+		dialer: &webtransport.Dialer{
+			TLSClientConfig: clientTLS,
+			QUICConfig: &quic.Config{
+				EnableDatagrams:                  true,
+				EnableStreamResetPartialDelivery: true,
+			},
+		},
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		p.server.CheckOrigin = func(r *http.Request) bool {
+			return slices.Contains(cfg.AllowedOrigins, r.Header.Get("Origin"))
+		}
+	}
+	return p, nil
+}
+
+// attach enables WebTransport on h3Server and routes session requests under
+// the configured path to the proxy. Serve the QUIC listener with the proxy
+// instead of h3Server afterwards.
+func (p *webTransportProxy) attach(h3Server *http3.Server) {
+	p.server.H3 = h3Server
+	webtransport.ConfigureHTTP3Server(h3Server)
+
+	next := h3Server.Handler
+	h3Server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect && r.Proto == "webtransport" && strings.HasPrefix(r.URL.Path, p.cfg.Path) {
+			p.serveSession(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	log.Printf("🛰️ WebTransport sessions under %s are proxied to pool %s", p.cfg.Path, p.poolName())
+}
+
+// Serve accepts QUIC connections on transport for both HTTP/3 and
+// WebTransport until the transport is closed
+func (p *webTransportProxy) Serve(transport *quic.Transport, quicConfig *quic.Config) error {
+	conf := quicConfig.Clone()
+	conf.EnableDatagrams = true
+	conf.EnableStreamResetPartialDelivery = true
+	ln, err := transport.ListenEarly(http3.ConfigureTLSConfig(p.server.H3.TLSConfig), conf)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return http.ErrServerClosed
+		}
+		go func() {
+			if err := p.server.ServeQUICConn(conn); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("❌ WebTransport connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections and closes the backend connections
+func (p *webTransportProxy) Close() error {
+	return errors.Join(p.server.Close(), p.dialer.Close())
+}
+
+// poolName returns the pool sessions are proxied to
+func (p *webTransportProxy) poolName() string {
+	if p.cfg.Pool != "" {
+		return p.cfg.Pool
+	}
+	return p.s.pools.Fallback()
+}
+
+// backendURL returns the WebTransport URL of a backend for a client request
+func (p *webTransportProxy) backendURL(backend *url.URL, r *http.Request) string {
+	host := backend.Host
+	if p.cfg.BackendPort != 0 {
+		host = net.JoinHostPort(backend.Hostname(), strconv.Itoa(p.cfg.BackendPort))
+	}
+	return (&url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}).String()
+}
+
+// serveSession opens a session with a backend, accepts the client's session
+// and relays between them until either side closes
+func (p *webTransportProxy) serveSession(w http.ResponseWriter, r *http.Request) {
+	pool := p.s.pools.Get(p.poolName())
+	if pool == nil {
+		http.Error(w, "🚫 WebTransport pool is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	peer := pool.GetNextPeer(p.s.sessionKey(r, pool))
+	if peer == nil {
+		http.Error(w, "🚫 No healthy backends available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Dial the backend first so the client gets a proper status on failure
+	target := p.backendURL(peer.URL, r)
+	header := http.Header{}
+	for _, name := range []string{"Origin", "Cookie", "Authorization", "User-Agent", "Wt-Available-Protocols"} {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		header.Set("X-Forwarded-For", ip)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), webTransportDialTimeout)
+	resp, backendSess, err := p.dialer.Dial(ctx, target, header)
+	cancel()
+	if err != nil {
+		peer.AddError()
+		log.Printf("❌ WebTransport session to Backend #%d (%s) failed: %v", peer.ID, target, err)
+		status := http.StatusBadGateway
+		if resp != nil && resp.StatusCode >= 400 {
+			status = resp.StatusCode
+		}
+		http.Error(w, "Backend WebTransport session failed", status)
+		return
+	}
+
+	clientSess, err := p.server.Upgrade(w, r)
+	if err != nil {
+		backendSess.CloseWithError(0, "client upgrade failed")
+		log.Printf("⚠️ WebTransport upgrade from %s failed: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	peer.AddRequest()
+	peer.AddConnection()
+	defer peer.RemoveConnection()
+	log.Printf("🛰️ WebTransport session %s %s -> Backend #%d (%s)", r.RemoteAddr, r.URL.Path, peer.ID, target)
+	start := time.Now()
+	relayWebTransport(clientSess, backendSess)
+	log.Printf("🛰️ WebTransport session %s -> Backend #%d closed after %v", r.RemoteAddr, peer.ID, time.Since(start).Round(time.Millisecond))
+}
+
+// relayWebTransport forwards streams and datagrams between two sessions in
+// both directions and closes each session when the other one ends
+func relayWebTransport(client, backend *webtransport.Session) {
+	var wg sync.WaitGroup
+	relay := func(from, to *webtransport.Session) {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			// Accepting fails once from is closed, with the reason it was closed
+			err := relayStreams(from, to)
+			code, msg := sessionCloseReason(err)
+			to.CloseWithError(code, msg)
+		}()
+		go func() {
+			defer wg.Done()
+			relayUniStreams(from, to)
+		}()
+		go func() {
+			defer wg.Done()
+			relayDatagrams(from, to)
+		}()
+	}
+	relay(client, backend)
+	relay(backend, client)
+	wg.Wait()
+}
+
+// sessionCloseReason returns the application error a session was closed with
+func sessionCloseReason(err error) (webtransport.SessionErrorCode, string) {
+	var sessErr *webtransport.SessionError
+	if errors.As(err, &sessErr) {
+		return sessErr.ErrorCode, sessErr.Message
+	}
+	return 0, ""
+}
+
+// relayStreams opens a stream on to for every bidirectional stream from
+// opens, until either session is closed
+func relayStreams(from, to *webtransport.Session) error {
+	for {
+		in, err := from.AcceptStream(context.Background())
+		if err != nil {
+			return err
+		}
+		out, err := to.OpenStreamSync(to.Context())
+		if err != nil {
+			in.CancelRead(0)
+			in.CancelWrite(0)
+			return err
+		}
+		go copyStream(out, in)
+		go copyStream(in, out)
+	}
+}
+
+// relayUniStreams opens a unidirectional stream on to for every one from opens
+func relayUniStreams(from, to *webtransport.Session) {
+	for {
+		in, err := from.AcceptUniStream(from.Context())
+		if err != nil {
+			return
+		}
+		out, err := to.OpenUniStreamSync(to.Context())
+		if err != nil {
+			in.CancelRead(0)
+			return
+		}
+		go copyStream(out, in)
+	}
+}
+
+// webTransportWriter and webTransportReader are the stream halves copyStream works on
+type webTransportWriter interface {
+	io.WriteCloser
+	CancelWrite(webtransport.StreamErrorCode)
+}
+
+type webTransportReader interface {
+	io.Reader
+	CancelRead(webtransport.StreamErrorCode)
+}
+
+// copyStream copies one direction of a stream, finishing dst when src ends
+// cleanly and resetting it with the same error code when src is reset
+func copyStream(dst webTransportWriter, src webTransportReader) {
+	if _, err := io.Copy(dst, src); err != nil {
+		var streamErr *webtransport.StreamError
+		code := webtransport.StreamErrorCode(0)
+		if errors.As(err, &streamErr) {
+			code = streamErr.ErrorCode
+		}
+		dst.CancelWrite(code)
+		src.CancelRead(code)
+		return
+	}
+	dst.Close()
+}
+
+// relayDatagrams forwards datagrams; like the datagrams themselves, this is
+// best effort and drops those the other side cannot take
+func relayDatagrams(from, to *webtransport.Session) {
+	for {
+		msg, err := from.ReceiveDatagram(from.Context())
+		if err != nil {
+			return
+		}
+		to.SendDatagram(msg)
+	}
+}